@@ -0,0 +1,105 @@
+package substrate
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWindowMax            = 10000
+	defaultWindowDecreaseFactor = 0.5
+)
+
+// AdaptiveWindowOptions is the configuration of an AdaptiveWindow.
+type AdaptiveWindowOptions struct {
+	// TargetLatency is the latency of acknowledgements, from the delivery
+	// of the messages, under which the window grows.
+	TargetLatency time.Duration
+	// Min and Max bound the window. They default to 1 and 10000.
+	Min int
+	Max int
+	// Initial is the initial window, which defaults to Min.
+	Initial int
+	// DecreaseFactor is the factor the window is multiplied by when it
+	// shrinks. Defaults to 0.5.
+	DecreaseFactor float64
+}
+
+// AdaptiveWindow limits the number of messages in flight, delivered by a
+// source and not acknowledged yet, to a window adapted to the latency of the
+// acknowledgements, so that fast consumers are not throttled and slow ones
+// don't hold too many messages in memory. The window grows by one for every
+// window of messages acknowledged under the target latency, and shrinks by
+// the decrease factor when an acknowledgement exceeds it, at most once per
+// target latency, or when Shrink is called, e.g. on memory pressure.
+//
+// A window is set on a source with the InFlightLimitOptions of
+// NewInFlightLimitedSource, or the config of backends supporting it, such as
+// kafka sources, and must not be shared between sources.
+type AdaptiveWindow struct {
+	opts AdaptiveWindowOptions
+	now  func() time.Time
+
+	mu           sync.Mutex
+	size         float64
+	lastDecrease time.Time
+}
+
+// NewAdaptiveWindow returns a window configured with opts.
+func NewAdaptiveWindow(opts AdaptiveWindowOptions) *AdaptiveWindow {
+	if opts.Min <= 0 {
+		opts.Min = 1
+	}
+	if opts.Max <= 0 {
+		opts.Max = defaultWindowMax
+	}
+	if opts.Max < opts.Min {
+		opts.Max = opts.Min
+	}
+	if opts.DecreaseFactor <= 0 || opts.DecreaseFactor >= 1 {
+		opts.DecreaseFactor = defaultWindowDecreaseFactor
+	}
+	w := &AdaptiveWindow{opts: opts, now: time.Now}
+	w.size = w.clamp(float64(opts.Initial))
+	return w
+}
+
+func (w *AdaptiveWindow) clamp(size float64) float64 {
+	return math.Max(float64(w.opts.Min), math.Min(float64(w.opts.Max), size))
+}
+
+// Size returns the current window, the number of messages allowed in flight.
+func (w *AdaptiveWindow) Size() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return int(w.size)
+}
+
+// Acked records the latency of an acknowledgement, from the delivery of the
+// message. It is called by the sources the window is set on.
+func (w *AdaptiveWindow) Acked(latency time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if latency <= w.opts.TargetLatency {
+		w.size = w.clamp(w.size + 1/w.size)
+		return
+	}
+	// The acknowledgements of the messages delivered before the window
+	// shrank are as late, so they don't shrink it again.
+	now := w.now()
+	if now.Sub(w.lastDecrease) < w.opts.TargetLatency {
+		return
+	}
+	w.lastDecrease = now
+	w.size = w.clamp(w.size * w.opts.DecreaseFactor)
+}
+
+// Shrink shrinks the window by the decrease factor, e.g. from a callback
+// notified of memory pressure.
+func (w *AdaptiveWindow) Shrink() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastDecrease = w.now()
+	w.size = w.clamp(w.size * w.opts.DecreaseFactor)
+}
@@ -0,0 +1,80 @@
+package substrate
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// simulateAcks acknowledges messages through w for the given duration, with
+// a consumer handling a message every perMessage, so that the latency of the
+// acknowledgements grows with the window, as messages queue in the consumer.
+// It returns the smallest and largest window once converged, over the second
+// half of the simulation.
+func simulateAcks(w *AdaptiveWindow, now *time.Time, perMessage, duration time.Duration) (int, int) {
+	min, max := -1, -1
+	end := now.Add(duration)
+	half := now.Add(duration / 2)
+	for now.Before(end) {
+		latency := time.Duration(w.Size()) * perMessage
+		w.Acked(latency)
+		*now = now.Add(perMessage)
+		if now.After(half) {
+			size := w.Size()
+			if min < 0 || size < min {
+				min = size
+			}
+			if size > max {
+				max = size
+			}
+		}
+	}
+	return min, max
+}
+
+func TestAdaptiveWindowConverges(t *testing.T) {
+	now := time.Now()
+	w := NewAdaptiveWindow(AdaptiveWindowOptions{TargetLatency: 100 * time.Millisecond})
+	w.now = func() time.Time { return now }
+	assert.Equal(t, 1, w.Size())
+
+	// With a consumer handling a message every millisecond, 100 messages
+	// in flight reach the target latency: the window saws below it.
+	min, max := simulateAcks(w, &now, time.Millisecond, time.Minute)
+	assert.True(t, min >= 45, fmt.Sprintf("min %d", min))
+	assert.True(t, max <= 101, fmt.Sprintf("max %d", max))
+
+	// The window follows the consumer slowing down.
+	min, max = simulateAcks(w, &now, 5*time.Millisecond, 5*time.Minute)
+	assert.True(t, min >= 8, fmt.Sprintf("min %d", min))
+	assert.True(t, max <= 21, fmt.Sprintf("max %d", max))
+}
+
+func TestAdaptiveWindowBounds(t *testing.T) {
+	now := time.Now()
+	w := NewAdaptiveWindow(AdaptiveWindowOptions{TargetLatency: time.Second, Min: 2, Max: 4, Initial: 3})
+	w.now = func() time.Time { return now }
+	assert.Equal(t, 3, w.Size())
+
+	for i := 0; i < 100; i++ {
+		w.Acked(time.Millisecond)
+	}
+	assert.Equal(t, 4, w.Size())
+
+	// Late acknowledgements shrink the window once per target latency.
+	w.Acked(2 * time.Second)
+	assert.Equal(t, 2, w.Size())
+	w.Acked(2 * time.Second)
+	assert.Equal(t, 2, w.Size())
+
+	for i := 0; i < 100; i++ {
+		w.Acked(time.Millisecond)
+	}
+	assert.Equal(t, 4, w.Size())
+
+	// Memory pressure shrinks it straight away.
+	w.Shrink()
+	assert.Equal(t, 2, w.Size())
+}
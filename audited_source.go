@@ -0,0 +1,329 @@
+package substrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/uw-labs/sync/rungroup"
+)
+
+const (
+	// auditBufferSize is the number of audit records buffered for the audit
+	// sink in best-effort mode, before records are dropped.
+	auditBufferSize = 1024
+	// auditRetryInterval is the time waited in best-effort mode before
+	// publishing to the audit sink again after it failed.
+	auditRetryInterval = time.Second
+)
+
+// ErrAuditRecordDropped is passed to the OnError callback of an audited
+// source in best-effort mode for every audit record dropped because the audit
+// sink is not keeping up.
+var ErrAuditRecordDropped = errors.New("audit record dropped")
+
+// AuditOptions are the options of an audited source.
+type AuditOptions struct {
+	// BestEffort forwards acknowledgements to the underlying source as soon
+	// as their audit record is queued for the audit sink, rather than once
+	// the audit sink has acknowledged it. Records are dropped if the audit
+	// sink is not keeping up, and publishing to the audit sink is retried
+	// if it fails, so that it never holds back consuming.
+	BestEffort bool
+	// OnError, if set, is called in best-effort mode with the errors of the
+	// audit sink, and with ErrAuditRecordDropped for every dropped record.
+	OnError func(error)
+}
+
+// AuditRecord is the payload of the audit records published by an audited
+// source, encoded as JSON.
+type AuditRecord struct {
+	// Topic, Partition and Offset locate the acknowledged message, when its
+	// source exposes them, e.g. for kafka sources.
+	Topic     string `json:"topic,omitempty"`
+	Partition *int32 `json:"partition,omitempty"`
+	Offset    *int64 `json:"offset,omitempty"`
+	// Digest is the digest of the message.
+	Digest []byte `json:"digest"`
+	// AckedAt is the time the message was acknowledged.
+	AckedAt time.Time `json:"acked_at"`
+	// Chain is the SHA-256 of the chain of the previous record and of the
+	// JSON encoding of this record without its chain, so that records
+	// removed or altered after the fact are detected. The chain starts
+	// from an empty one with every call of ConsumeMessages, and in
+	// best-effort mode, dropped records show as a broken chain.
+	Chain []byte `json:"chain"`
+}
+
+// NewAuditedSource returns a source that publishes an audit record, see
+// AuditRecord, to auditSink for every message delivered from source and
+// acknowledged, e.g. to keep a record of the messages processed by a service
+// for compliance. The digest of a message is computed with digest when it is
+// delivered, so that its payload may be discarded before it is acknowledged.
+// It defaults to the SHA-256 of the payload if nil.
+//
+// Audit records are published in the order of the acknowledgements. By
+// default, acknowledgements are only forwarded to source once auditSink has
+// acknowledged their record, which adds the latency of the audit sink to
+// every acknowledgement. If auditSink stops acknowledging records, the
+// acknowledgements are held back until it does, and if it fails,
+// ConsumeMessages returns its error, so that no message is acknowledged
+// without being audited. Messages acknowledged but not audited are then
+// delivered again by the next consumer, and audited again, so a message may
+// have several records. See AuditOptions for a best-effort mode instead.
+//
+// When Close is called on the returned source, this is also propagated to
+// source, but not to auditSink, which is owned by the caller.
+func NewAuditedSource(source AsyncMessageSource, auditSink AsyncMessageSink, digest func(Message) []byte, opts AuditOptions) AsyncMessageSource {
+	if digest == nil {
+		digest = sha256Digest
+	}
+	return &auditedSource{
+		source:    source,
+		auditSink: auditSink,
+		digest:    digest,
+		opts:      opts,
+	}
+}
+
+type auditedSource struct {
+	source    AsyncMessageSource
+	auditSink AsyncMessageSink
+	digest    func(Message) []byte
+	opts      AuditOptions
+}
+
+// auditedMessage is a delivered message awaiting its acknowledgement, along
+// with the record fields computed when it was delivered.
+type auditedMessage struct {
+	msg    Message
+	record AuditRecord
+}
+
+// auditRecordMessage is an audit record published to the audit sink, for the
+// acknowledgement of msg.
+type auditRecordMessage struct {
+	data []byte
+	msg  Message
+}
+
+func (m *auditRecordMessage) Data() []byte {
+	return m.data
+}
+
+func sha256Digest(msg Message) []byte {
+	sum := sha256.Sum256(msg.Data())
+	return sum[:]
+}
+
+func (s *auditedSource) ConsumeMessages(ctx context.Context, messages chan<- Message, acks <-chan Message) error {
+	rg, ctx := rungroup.New(ctx)
+
+	fromInner := make(chan Message, cap(messages))
+	toInner := make(chan Message, cap(acks))
+	needAcks := make(chan auditedMessage, 1024)
+	records := make(chan Message, cap(acks))
+	if s.opts.BestEffort {
+		records = make(chan Message, auditBufferSize)
+	}
+	recordAcks := make(chan Message, cap(acks))
+	// pending are the records published to the audit sink, in order.
+	pending := make(chan *auditRecordMessage, 1024)
+
+	rg.Go(func() error {
+		return s.source.ConsumeMessages(ctx, fromInner, toInner)
+	})
+
+	rg.Go(func() error {
+		for {
+			var msg Message
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case msg = <-fromInner:
+			}
+			am := auditedMessage{msg: msg, record: s.locate(msg)}
+			am.record.Digest = s.digest(msg)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case messages <- msg:
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case needAcks <- am:
+			}
+		}
+	})
+
+	rg.Go(func() error {
+		var chain []byte
+		for {
+			var am auditedMessage
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case am = <-needAcks:
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case ack := <-acks:
+				if !SameMessage(ack, am.msg) {
+					return InvalidAckError{Acked: ack, Expected: am.msg}
+				}
+			}
+			am.record.AckedAt = time.Now()
+			data, err := am.record.seal(chain)
+			if err != nil {
+				return err
+			}
+			chain = am.record.Chain
+			record := &auditRecordMessage{data: data, msg: am.msg}
+
+			if s.opts.BestEffort {
+				select {
+				case records <- record:
+				default:
+					s.onError(ErrAuditRecordDropped)
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case toInner <- am.msg:
+				}
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case pending <- record:
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case records <- record:
+			}
+		}
+	})
+
+	if s.opts.BestEffort {
+		rg.Go(func() error {
+			for {
+				err := s.auditSink.PublishMessages(ctx, recordAcks, records)
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if err != nil {
+					s.onError(err)
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(auditRetryInterval):
+				}
+			}
+		})
+		rg.Go(func() error {
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-recordAcks:
+				}
+			}
+		})
+		return rg.Wait()
+	}
+
+	rg.Go(func() error {
+		return s.auditSink.PublishMessages(ctx, recordAcks, records)
+	})
+
+	rg.Go(func() error {
+		for {
+			var ack Message
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case ack = <-recordAcks:
+			}
+			var record *auditRecordMessage
+			select {
+			case record = <-pending:
+			default:
+				return InvalidAckError{Acked: ack}
+			}
+			if !SameMessage(ack, record) {
+				return InvalidAckError{Acked: ack, Expected: record}
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case toInner <- record.msg:
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+// locate returns a record with the topic, partition and offset of a message,
+// when its source exposes them.
+func (s *auditedSource) locate(msg Message) AuditRecord {
+	var record AuditRecord
+	if pm, ok := partitioned(msg); ok {
+		partition, offset := pm.Partition(), pm.Offset()
+		record.Partition, record.Offset = &partition, &offset
+	}
+	for {
+		if tm, ok := msg.(interface{ Topic() string }); ok {
+			record.Topic = tm.Topic()
+			return record
+		}
+		wrapper, ok := msg.(interface{ Original() Message })
+		if !ok {
+			return record
+		}
+		msg = wrapper.Original()
+	}
+}
+
+// seal sets the chain of the record, following the chain of the previous
+// record, and returns its encoding.
+func (r *AuditRecord) seal(previous []byte) ([]byte, error) {
+	r.Chain = nil
+	unsealed, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write(previous)
+	h.Write(unsealed)
+	r.Chain = h.Sum(nil)
+	return json.Marshal(r)
+}
+
+func (s *auditedSource) onError(err error) {
+	if s.opts.OnError != nil {
+		s.opts.OnError(err)
+	}
+}
+
+// Close closes the underlying source.
+func (s *auditedSource) Close() error {
+	return s.source.Close()
+}
+
+// Status returns the status of the underlying source, combined with the status
+// of the audit sink unless in best-effort mode, as a failing audit sink holds
+// back acknowledgements otherwise.
+func (s *auditedSource) Status() (*Status, error) {
+	if s.opts.BestEffort {
+		return s.source.Status()
+	}
+	return CombinedStatus(s.source, s.auditSink)
+}
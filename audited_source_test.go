@@ -0,0 +1,174 @@
+package substrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// topicTestMessage is a message of a topic of a partitioned log.
+type topicTestMessage struct {
+	partitionedTestMessage
+	topic string
+}
+
+func (m *topicTestMessage) Topic() string {
+	return m.topic
+}
+
+func decodeAuditRecord(t *testing.T, msg Message) AuditRecord {
+	var record AuditRecord
+	require.NoError(t, json.Unmarshal(msg.Data(), &record))
+	return record
+}
+
+func TestAuditedSource(t *testing.T) {
+	m1 := &topicTestMessage{partitionedTestMessage{partition: 1, offset: 7}, "orders"}
+	m2 := message("two")
+	inner := newStreamingAsyncSource(m1, &m2)
+	auditSink := newRecordingAsyncSink()
+	source := NewAuditedSource(inner, auditSink, nil, AuditOptions{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	before := time.Now()
+	for _, expected := range []Message{m1, &m2} {
+		delivered := <-msgs
+		assert.Equal(t, expected, delivered)
+		acks <- callerWrapped{delivered}
+		assert.Equal(t, expected, <-inner.acked)
+	}
+
+	first := decodeAuditRecord(t, <-auditSink.published)
+	assert.Equal(t, "orders", first.Topic)
+	require.NotNil(t, first.Partition)
+	require.NotNil(t, first.Offset)
+	assert.Equal(t, int32(1), *first.Partition)
+	assert.Equal(t, int64(7), *first.Offset)
+	digest := sha256.Sum256([]byte("1/7"))
+	assert.Equal(t, digest[:], first.Digest)
+	assert.False(t, first.AckedAt.Before(before))
+
+	second := decodeAuditRecord(t, <-auditSink.published)
+	assert.Empty(t, second.Topic)
+	assert.Nil(t, second.Partition)
+	assert.Nil(t, second.Offset)
+	digest = sha256.Sum256([]byte("two"))
+	assert.Equal(t, digest[:], second.Digest)
+
+	// Every record is chained to the previous one.
+	var chain []byte
+	for _, record := range []AuditRecord{first, second} {
+		sealed := record.Chain
+		_, err := record.seal(chain)
+		require.NoError(t, err)
+		assert.Equal(t, record.Chain, sealed)
+		chain = sealed
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+	assert.Len(t, inner.acked, 0)
+}
+
+func TestAuditedSourceHoldsBackAcks(t *testing.T) {
+	m1, m2 := message("one"), message("two")
+	inner := newStreamingAsyncSource(&m1, &m2)
+	auditSink := &gatedAsyncSink{release: make(chan struct{})}
+	digest := func(msg Message) []byte {
+		return msg.Data()
+	}
+	source := NewAuditedSource(inner, auditSink, digest, AuditOptions{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	for _, expected := range []Message{&m1, &m2} {
+		delivered := <-msgs
+		assert.Equal(t, expected, delivered)
+		acks <- delivered
+	}
+	select {
+	case ack := <-inner.acked:
+		t.Fatalf("acknowledged before the audit record was: %s", ack.Data())
+	case <-time.After(20 * time.Millisecond):
+	}
+	for _, expected := range []Message{&m1, &m2} {
+		auditSink.release <- struct{}{}
+		assert.Equal(t, expected, <-inner.acked)
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+func TestAuditedSourceFailingAuditSink(t *testing.T) {
+	m1, m2 := message("one"), message("two")
+
+	// Without best-effort, the error of the audit sink terminates
+	// consuming, and nothing is acknowledged.
+	inner := newStreamingAsyncSource(&m1, &m2)
+	source := NewAuditedSource(inner, &mockAsyncSink{}, nil, AuditOptions{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message, 2)
+	acks := make(chan Message, 2)
+	err := func() error {
+		errs := make(chan error, 1)
+		go func() {
+			errs <- source.ConsumeMessages(ctx, msgs, acks)
+		}()
+		acks <- <-msgs
+		return <-errs
+	}()
+	assert.Equal(t, errSeenAllMessages, err)
+	assert.Len(t, inner.acked, 0)
+
+	// In best-effort mode, acknowledgements are forwarded regardless.
+	inner = newStreamingAsyncSource(&m1, &m2)
+	sinkErrs := make(chan error, 2)
+	source = NewAuditedSource(inner, &mockAsyncSink{}, nil, AuditOptions{
+		BestEffort: true,
+		OnError: func(err error) {
+			sinkErrs <- err
+		},
+	})
+	msgs = make(chan Message)
+	acks = make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+	for _, expected := range []Message{&m1, &m2} {
+		delivered := <-msgs
+		acks <- delivered
+		assert.Equal(t, expected, <-inner.acked)
+	}
+	assert.True(t, errors.Is(<-sinkErrs, errSeenAllMessages))
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
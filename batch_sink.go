@@ -0,0 +1,367 @@
+package substrate
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/uw-labs/sync/rungroup"
+
+	"github.com/uw-labs/substrate/internal/clock"
+	"github.com/uw-labs/substrate/internal/flush"
+)
+
+// AsyncMessageBatchSink is implemented by the sinks that publish explicit
+// batches of messages more efficiently than a message at a time, as the
+// PublishMessages channels hide the boundaries of the batches. Sinks that
+// don't implement it can be used as one with NewBatchSink.
+type AsyncMessageBatchSink interface {
+	AsyncMessageSink
+	// PublishBatches publishes the batches found on the `batches` channel
+	// and returns them on the `acks` channel, as the slices received, once
+	// all of their messages have been published. Batches are processed and
+	// acknowledged in order, and empty batches are acknowledged as they
+	// are. A batch is all or nothing: if any of its messages fails,
+	// PublishBatches terminates with an error and the batch is not
+	// acknowledged, although some of its messages may have been published,
+	// so they are published at least once when the batch is published
+	// again. The error is a *BatchError when the sink can tell which
+	// messages failed. Messages failing in a way the sink handles itself,
+	// such as with an error handler returning nil, count as published.
+	// Like PublishMessages, it blocks until `ctx` is done, returning
+	// ctx.Err(), or until an error occurs, and it must not run
+	// concurrently with PublishMessages.
+	PublishBatches(ctx context.Context, acks chan<- []Message, batches <-chan []Message) error
+}
+
+// BatchError is returned by PublishBatches for a batch whose failed messages
+// are known.
+type BatchError struct {
+	// Errs holds the errors of the failed messages of the batch, by their
+	// index in the batch.
+	Errs map[int]error
+}
+
+func (e *BatchError) Error() string {
+	i := e.first()
+	if len(e.Errs) == 1 {
+		return fmt.Sprintf("message %d of the batch failed: %s", i, e.Errs[i])
+	}
+	return fmt.Sprintf("%d messages of the batch failed, the first one, message %d, with: %s", len(e.Errs), i, e.Errs[i])
+}
+
+// Unwrap returns the error of the first failed message of the batch.
+func (e *BatchError) Unwrap() error {
+	return e.Errs[e.first()]
+}
+
+func (e *BatchError) first() int {
+	indexes := make([]int, 0, len(e.Errs))
+	for i := range e.Errs {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	if len(indexes) == 0 {
+		return -1
+	}
+	return indexes[0]
+}
+
+// NewBatchSink returns sink as an AsyncMessageBatchSink: sink itself if it
+// implements it, or a sink emulating PublishBatches with PublishMessages
+// otherwise, see PublishBatches.
+func NewBatchSink(sink AsyncMessageSink) AsyncMessageBatchSink {
+	if bs, ok := sink.(AsyncMessageBatchSink); ok {
+		return bs
+	}
+	return &emulatedBatchSink{sink}
+}
+
+type emulatedBatchSink struct {
+	AsyncMessageSink
+}
+
+func (s *emulatedBatchSink) PublishBatches(ctx context.Context, acks chan<- []Message, batches <-chan []Message) error {
+	return PublishBatches(ctx, s.AsyncMessageSink, acks, batches, nil)
+}
+
+// PublishBatches implements the PublishBatches method of the
+// AsyncMessageBatchSink interface with the PublishMessages method of sink, by
+// publishing the messages of every batch in order, and acknowledging the
+// batch once all of its messages are acknowledged. Errors of sink are returned
+// as they are, unless failed is set and returns the message an error is
+// about, in which case the error is returned as a *BatchError for that
+// message of the batch holding it. Backends use it to implement
+// PublishBatches natively, as the batches are published back to back, so
+// that their messages are sent together.
+func PublishBatches(ctx context.Context, sink AsyncMessageSink, acks chan<- []Message, batches <-chan []Message, failed func(error) Message) error {
+	rg, ctx := rungroup.New(ctx)
+
+	toInner := make(chan Message, cap(batches))
+	fromInner := make(chan Message, cap(acks))
+	needAcks := make(chan []Message, 1024)
+	// current is the batch awaiting its acknowledgement, which is only read
+	// once every goroutine has returned.
+	var current []Message
+
+	rg.Go(func() error {
+		return sink.PublishMessages(ctx, fromInner, toInner)
+	})
+
+	rg.Go(func() error {
+		for {
+			var batch []Message
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case batch = <-batches:
+			}
+			select {
+			case needAcks <- batch:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			for _, msg := range batch {
+				select {
+				case toInner <- msg:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	})
+
+	rg.Go(func() error {
+		for {
+			current = nil
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case current = <-needAcks:
+			}
+			for _, msg := range current {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case ack := <-fromInner:
+					if !SameMessage(ack, msg) {
+						return InvalidAckError{Acked: ack, Expected: msg}
+					}
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case acks <- current:
+			}
+		}
+	})
+
+	err := rg.Wait()
+	if err == nil || failed == nil {
+		return err
+	}
+	msg := failed(err)
+	if msg == nil {
+		return err
+	}
+	pending := [][]Message{current}
+	for len(needAcks) > 0 {
+		pending = append(pending, <-needAcks)
+	}
+	for _, batch := range pending {
+		for i, m := range batch {
+			if SameMessage(msg, m) {
+				return &BatchError{Errs: map[int]error{i: err}}
+			}
+		}
+	}
+	return err
+}
+
+// BatchingSinkOptions are the options of a batching sink.
+type BatchingSinkOptions struct {
+	// MaxSize is the maximum number of messages of a batch. Defaults to
+	// 100.
+	MaxSize int
+	// MaxDelay is the longest time a message waits for its batch to fill
+	// up. Defaults to 5ms.
+	MaxDelay time.Duration
+	// Priority, if set, returns the priority of a message, so that messages
+	// that mustn't wait for their batch, e.g. control messages, are
+	// published straight away. A message whose priority is at least
+	// FlushPriority ends its batch, which is published at once, so the order
+	// of the messages is kept. The next message starts a new batch, with its
+	// own MaxDelay. Other messages end their batch when it reaches MaxSize
+	// messages, and the batch is otherwise published MaxDelay after its
+	// first message, whichever comes first. Like the other options, Priority
+	// and FlushPriority only apply when the wrapped sink implements
+	// AsyncMessageBatchSink, such as the kafka sink, since messages are
+	// otherwise published straight away.
+	Priority func(Message) int
+	// FlushPriority is the priority from which messages flush their batch.
+	// Flushing on priority is disabled unless it is positive.
+	FlushPriority int
+}
+
+const (
+	defaultBatchMaxSize  = 100
+	defaultBatchMaxDelay = 5 * time.Millisecond
+)
+
+// NewBatchingSink returns a sink accumulating the published messages into
+// batches of up to MaxSize messages, for at most MaxDelay, which are published
+// with the PublishBatches method of sink, if it implements
+// AsyncMessageBatchSink. Otherwise, as batching would only delay them, the
+// messages are published straight to sink. The messages are acknowledged as
+// their batch is, in order. When Close is called on the returned sink, this is
+// also propagated to sink. The returned sink implements Flushable.
+func NewBatchingSink(sink AsyncMessageSink, opts BatchingSinkOptions) AsyncMessageSink {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = defaultBatchMaxSize
+	}
+	if opts.MaxDelay <= 0 {
+		opts.MaxDelay = defaultBatchMaxDelay
+	}
+	return &batchingSink{sink: sink, opts: opts, clock: clock.Real}
+}
+
+var _ Flushable = (*batchingSink)(nil)
+
+type batchingSink struct {
+	sink    AsyncMessageSink
+	opts    BatchingSinkOptions
+	clock   clock.Clock
+	flushes flush.Tracker
+}
+
+func (s *batchingSink) PublishMessages(ctx context.Context, acks chan<- Message, messages <-chan Message) (err error) {
+	bs, ok := s.sink.(AsyncMessageBatchSink)
+	if !ok {
+		return s.sink.PublishMessages(ctx, acks, messages)
+	}
+
+	s.flushes.Start()
+	defer func() { s.flushes.Stop(err) }()
+
+	rg, ctx := rungroup.New(ctx)
+
+	batches := make(chan []Message)
+	batchAcks := make(chan []Message)
+
+	rg.Go(func() error {
+		return bs.PublishBatches(ctx, batchAcks, batches)
+	})
+
+	rg.Go(func() error {
+		for {
+			batch, err := s.nextBatch(ctx, messages)
+			if err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case batches <- batch:
+			}
+		}
+	})
+
+	rg.Go(func() error {
+		for {
+			var batch []Message
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case batch = <-batchAcks:
+			}
+			for _, msg := range batch {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case acks <- msg:
+					s.flushes.Acked()
+				}
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+// nextBatch waits for the first message of a batch, and accumulates the next
+// ones until the batch is complete, until MaxDelay has elapsed since the
+// first one, or until Flush is called.
+func (s *batchingSink) nextBatch(ctx context.Context, messages <-chan Message) ([]Message, error) {
+	var batch []Message
+	for batch == nil {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case req := <-s.flushes.Requests():
+			// There is no pending batch to hand off.
+			s.flushes.Mark(req)
+		case msg := <-messages:
+			s.flushes.Submitted()
+			batch = append(make([]Message, 0, s.opts.MaxSize), msg)
+		}
+	}
+	if s.complete(batch) {
+		return batch, nil
+	}
+
+	timer := s.clock.NewTimer(s.opts.MaxDelay)
+	defer timer.Stop()
+	for !s.complete(batch) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case req := <-s.flushes.Requests():
+			// The pending batch is handed off straight away, rather than
+			// being waited for until MaxDelay.
+			s.flushes.Mark(req)
+			return batch, nil
+		case msg := <-messages:
+			s.flushes.Submitted()
+			batch = append(batch, msg)
+		case <-timer.C():
+			return batch, nil
+		}
+	}
+	return batch, nil
+}
+
+// complete returns whether a batch is full, or ends with a message with at
+// least the flush priority.
+func (s *batchingSink) complete(batch []Message) bool {
+	if len(batch) >= s.opts.MaxSize {
+		return true
+	}
+	return s.opts.Priority != nil && s.opts.FlushPriority > 0 && s.opts.Priority(batch[len(batch)-1]) >= s.opts.FlushPriority
+}
+
+// Flush implements the Flushable interface. The pending batch is handed off
+// to the underlying sink without waiting for MaxDelay, and Flush then waits
+// for the acknowledgements of the underlying sink. When it doesn't implement
+// AsyncMessageBatchSink, in which case messages are not batched, Flush is
+// delegated to it if it implements Flushable, and returns nil otherwise.
+func (s *batchingSink) Flush(ctx context.Context) error {
+	if _, ok := s.sink.(AsyncMessageBatchSink); !ok {
+		if f, ok := s.sink.(Flushable); ok {
+			return f.Flush(ctx)
+		}
+		return nil
+	}
+	return s.flushes.Flush(ctx)
+}
+
+// Close closes the underlying sink.
+func (s *batchingSink) Close() error {
+	return s.sink.Close()
+}
+
+// Status returns the status of the underlying sink.
+func (s *batchingSink) Status() (*Status, error) {
+	return s.sink.Status()
+}
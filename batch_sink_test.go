@@ -0,0 +1,422 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate/internal/testutil"
+)
+
+func TestBatchSinkEmulated(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &mockAsyncSink{3, make(chan struct{}, 1)}
+	sink := NewBatchSink(inner)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	batches := make(chan []Message)
+	acks := make(chan []Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishBatches(ctx, acks, batches)
+	}()
+
+	m1, m2, m3 := message("1"), message("2"), message("3")
+	for _, batch := range [][]Message{{&m1, &m2}, {}, {&m3}} {
+		batches <- batch
+		assert.Equal(batch, <-acks)
+	}
+
+	cancel()
+	assert.Equal(context.Canceled, <-errs)
+
+	assert.NoError(sink.Close())
+	select {
+	case <-inner.closed:
+	default:
+		t.Error("underlying async sink didn't get closed")
+	}
+}
+
+func TestBatchSinkEmulatedError(t *testing.T) {
+	inner := &mockAsyncSink{1, make(chan struct{}, 1)}
+	sink := NewBatchSink(inner)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	batches := make(chan []Message, 1)
+	acks := make(chan []Message, 1)
+	m1, m2 := message("1"), message("2")
+	batches <- []Message{&m1, &m2}
+
+	// The first message is published, but the batch is not acknowledged.
+	assert.Equal(t, errSeenAllMessages, sink.PublishBatches(ctx, acks, batches))
+	assert.Empty(t, acks)
+}
+
+func TestNewBatchSinkNative(t *testing.T) {
+	native := &mockBatchSink{}
+	assert.Equal(t, AsyncMessageBatchSink(native), NewBatchSink(native))
+}
+
+// failingSink acknowledges the messages, but fails on the ones with the
+// payload "bad".
+type failingSink struct {
+	mockAsyncSink
+}
+
+type badMessageError struct {
+	msg Message
+}
+
+func (e badMessageError) Error() string {
+	return "bad message"
+}
+
+func (s *failingSink) PublishMessages(ctx context.Context, acks chan<- Message, messages <-chan Message) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m := <-messages:
+			if string(m.Data()) == "bad" {
+				return badMessageError{msg: m}
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case acks <- m:
+			}
+		}
+	}
+}
+
+func TestPublishBatchesFailedMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	failed := func(err error) Message {
+		var berr badMessageError
+		if errors.As(err, &berr) {
+			return berr.msg
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	batches := make(chan []Message)
+	acks := make(chan []Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- PublishBatches(ctx, &failingSink{}, acks, batches, failed)
+	}()
+
+	m1, m2, m3, m4 := message("1"), message("2"), message("3"), message("bad")
+	batches <- []Message{&m1}
+	assert.Equal([]Message{&m1}, <-acks)
+	batches <- []Message{&m2, &m3, &m4}
+
+	err := <-errs
+	require.IsType(t, &BatchError{}, err)
+	assert.Equal(map[int]error{2: badMessageError{msg: &m4}}, err.(*BatchError).Errs)
+	assert.Equal("message 2 of the batch failed: bad message", err.Error())
+	assert.True(errors.As(err, &badMessageError{}))
+}
+
+func TestBatchError(t *testing.T) {
+	err1, err2 := errors.New("first"), errors.New("second")
+	err := &BatchError{Errs: map[int]error{7: err2, 3: err1}}
+	assert.Equal(t, "2 messages of the batch failed, the first one, message 3, with: first", err.Error())
+	assert.True(t, errors.Is(err, err1))
+	assert.False(t, errors.Is(err, err2))
+}
+
+// mockBatchSink records the batches it publishes, and acknowledges them.
+type mockBatchSink struct {
+	mockAsyncSink
+	batches [][]Message
+}
+
+func (s *mockBatchSink) PublishBatches(ctx context.Context, acks chan<- []Message, batches <-chan []Message) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case batch := <-batches:
+			s.batches = append(s.batches, batch)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case acks <- batch:
+			}
+		}
+	}
+}
+
+func TestBatchingSink(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &mockBatchSink{mockAsyncSink: mockAsyncSink{closed: make(chan struct{}, 1)}}
+	sink := NewBatchingSink(inner, BatchingSinkOptions{MaxSize: 2, MaxDelay: 50 * time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	messages := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishMessages(ctx, acks, messages)
+	}()
+
+	// Full batches are published at once, and the last one after MaxDelay.
+	m1, m2, m3 := message("1"), message("2"), message("3")
+	for _, m := range []Message{&m1, &m2, &m3} {
+		messages <- m
+	}
+	for _, m := range []Message{&m1, &m2, &m3} {
+		assert.Equal(m, <-acks)
+	}
+
+	cancel()
+	assert.Equal(context.Canceled, <-errs)
+	assert.Equal([][]Message{{&m1, &m2}, {&m3}}, inner.batches)
+
+	assert.NoError(sink.Close())
+	select {
+	case <-inner.closed:
+	default:
+		t.Error("underlying async sink didn't get closed")
+	}
+}
+
+func TestBatchingSinkFlush(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &mockBatchSink{mockAsyncSink: mockAsyncSink{closed: make(chan struct{}, 1)}}
+	sink := NewBatchingSink(inner, BatchingSinkOptions{MaxSize: 10, MaxDelay: time.Hour})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	messages := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishMessages(ctx, acks, messages)
+	}()
+
+	// Flushing doesn't wait for MaxDelay to publish the pending batch.
+	m1, m2 := message("1"), message("2")
+	messages <- &m1
+	messages <- &m2
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- sink.(Flushable).Flush(ctx)
+	}()
+	assert.Equal(&m1, <-acks)
+	assert.Equal(&m2, <-acks)
+	assert.NoError(<-flushed)
+
+	// Nothing is pending.
+	assert.NoError(sink.(Flushable).Flush(ctx))
+
+	cancel()
+	assert.Equal(context.Canceled, <-errs)
+	assert.Equal([][]Message{{&m1, &m2}}, inner.batches)
+}
+
+func TestBatchingSinkPassThrough(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &mockAsyncSink{2, make(chan struct{}, 1)}
+	sink := NewBatchingSink(inner, BatchingSinkOptions{MaxSize: 10, MaxDelay: time.Hour})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	messages := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishMessages(ctx, acks, messages)
+	}()
+
+	// The messages are not held until their batch is full.
+	m1, m2 := message("1"), message("2")
+	for _, m := range []Message{&m1, &m2} {
+		messages <- m
+		assert.Equal(m, <-acks)
+	}
+
+	cancel()
+	assert.Equal(context.Canceled, <-errs)
+}
+
+// publishedBatchSink passes the batches it publishes to its channel, and
+// acknowledges them.
+type publishedBatchSink struct {
+	mockAsyncSink
+	published chan []Message
+}
+
+func (s *publishedBatchSink) PublishBatches(ctx context.Context, acks chan<- []Message, batches <-chan []Message) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case batch := <-batches:
+			s.published <- batch
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case acks <- batch:
+			}
+		}
+	}
+}
+
+func TestBatchingSinkPriority(t *testing.T) {
+	// Messages starting with "c" are control messages, with a higher
+	// priority than bulk messages.
+	priority := func(msg Message) int {
+		if msg.Data()[0] == 'c' {
+			return 1
+		}
+		return 0
+	}
+	type step struct {
+		// msg is published, if set, and the clock is then advanced by
+		// advance, if set.
+		msg     string
+		advance time.Duration
+		// batches are the batches published by the end of the step.
+		batches [][]string
+	}
+	for _, tst := range []struct {
+		name          string
+		priority      func(Message) int
+		flushPriority int
+		steps         []step
+	}{
+		{
+			name:          "flushes partial batch",
+			priority:      priority,
+			flushPriority: 1,
+			steps: []step{
+				{msg: "b1"},
+				{msg: "c1", batches: [][]string{{"b1", "c1"}}},
+			},
+		},
+		{
+			name:          "first in batch",
+			priority:      priority,
+			flushPriority: 1,
+			steps: []step{
+				{msg: "c1", batches: [][]string{{"c1"}}},
+				{msg: "c2", batches: [][]string{{"c2"}}},
+			},
+		},
+		{
+			name:          "fills batch",
+			priority:      priority,
+			flushPriority: 1,
+			steps: []step{
+				{msg: "b1"},
+				{msg: "b2"},
+				{msg: "c1", batches: [][]string{{"b1", "b2", "c1"}}},
+				{msg: "b3"},
+				{msg: "b4"},
+				{msg: "b5", batches: [][]string{{"b3", "b4", "b5"}}},
+			},
+		},
+		{
+			name:          "restarts delay",
+			priority:      priority,
+			flushPriority: 1,
+			steps: []step{
+				{msg: "b1", advance: 30 * time.Millisecond},
+				{msg: "c1", batches: [][]string{{"b1", "c1"}}},
+				{msg: "b2", advance: 30 * time.Millisecond},
+				{advance: 20 * time.Millisecond, batches: [][]string{{"b2"}}},
+			},
+		},
+		{
+			name:          "below flush priority",
+			priority:      priority,
+			flushPriority: 2,
+			steps: []step{
+				{msg: "c1"},
+				{msg: "c2"},
+				{msg: "c3", batches: [][]string{{"c1", "c2", "c3"}}},
+				{msg: "c4", advance: 50 * time.Millisecond, batches: [][]string{{"c4"}}},
+			},
+		},
+		{
+			name:     "zero flush priority",
+			priority: func(Message) int { return 0 },
+			steps: []step{
+				{msg: "b1"},
+				{msg: "b2", advance: 50 * time.Millisecond, batches: [][]string{{"b1", "b2"}}},
+			},
+		},
+		{
+			name:          "without priority",
+			flushPriority: 1,
+			steps: []step{
+				{msg: "c1"},
+				{msg: "c2"},
+				{msg: "c3", batches: [][]string{{"c1", "c2", "c3"}}},
+			},
+		},
+	} {
+		t.Run(tst.name, func(t *testing.T) {
+			clock := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+			inner := &publishedBatchSink{published: make(chan []Message, 2)}
+			sink := NewBatchingSink(inner, BatchingSinkOptions{
+				MaxSize:       3,
+				MaxDelay:      50 * time.Millisecond,
+				Priority:      tst.priority,
+				FlushPriority: tst.flushPriority,
+			})
+			sink.(*batchingSink).clock = clock
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			messages := make(chan Message)
+			acks := make(chan Message, 10)
+			go func() {
+				_ = sink.PublishMessages(ctx, acks, messages)
+			}()
+
+			for i, s := range tst.steps {
+				if s.msg != "" {
+					m := message(s.msg)
+					messages <- &m
+				}
+				if s.advance > 0 {
+					clock.BlockUntil(1)
+					clock.Advance(s.advance)
+				}
+				for _, expected := range s.batches {
+					var published []string
+					for _, msg := range <-inner.published {
+						published = append(published, string(msg.Data()))
+					}
+					assert.Equal(t, expected, published, fmt.Sprintf("step %d", i))
+				}
+				assert.Len(t, inner.published, 0, fmt.Sprintf("step %d", i))
+			}
+		})
+	}
+}
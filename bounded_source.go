@@ -0,0 +1,260 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/uw-labs/sync/rungroup"
+)
+
+// BoundedSourceOptions is the configuration parameters for a bounded source.
+// At least one bound should be set, as the source is unbounded otherwise.
+type BoundedSourceOptions struct {
+	// MaxMessages, if positive, is the number of messages delivered before
+	// the source stops.
+	MaxMessages int
+	// StopAtOffsets, if set, is the offset at which consuming stops for
+	// each of the listed partitions: the messages at or after that offset
+	// are not delivered. As acknowledgements are in order, they are only
+	// acknowledged to the underlying source along with messages consumed
+	// after them, so that they are otherwise consumed again by the next
+	// consumer. The source stops once all the listed partitions have
+	// reached their offset. Messages of other partitions are delivered
+	// until then. It requires messages implementing PartitionedMessage,
+	// such as the messages of kafka sources.
+	StopAtOffsets map[int32]int64
+	// IdleTimeout, if positive, stops the source once it has been idle for
+	// that long: no message was consumed from the underlying source, and
+	// all the delivered messages were acknowledged, e.g. to consume a topic
+	// until it is drained in a batch job. It never stops while messages are
+	// waiting to be acknowledged.
+	IdleTimeout time.Duration
+}
+
+// NewIdleTerminatingSource returns a bounded source that stops once source has
+// been idle for idleTimeout, see BoundedSourceOptions.IdleTimeout, so that
+// ConsumeMessages returns nil once the messages are drained.
+func NewIdleTerminatingSource(source AsyncMessageSource, idleTimeout time.Duration) AsyncMessageSource {
+	return NewBoundedSource(source, BoundedSourceOptions{IdleTimeout: idleTimeout})
+}
+
+// ErrNotPartitioned is returned by a bounded source stopping at offsets for
+// a message that doesn't implement PartitionedMessage.
+var ErrNotPartitioned = errors.New("message does not expose its partition and offset")
+
+// errBoundReached is returned internally once a bounded source has stopped,
+// and all the delivered messages have been acknowledged.
+var errBoundReached = errors.New("bound reached")
+
+// NewBoundedSource returns a source that delivers the messages consumed from
+// source until one of the bounds of opts is reached, e.g. to consume a fixed
+// number of messages in an operational script. The source then stops
+// delivering messages, waits for the delivered messages to be acknowledged,
+// and ConsumeMessages returns nil. If ConsumeMessages terminates with an
+// error instead, the messages acknowledged until then have been
+// acknowledged to source, and the others are consumed again by the next
+// consumer. The bounds apply to every call of ConsumeMessages. When Close is
+// called on the returned source, this is also propagated to source.
+func NewBoundedSource(source AsyncMessageSource, opts BoundedSourceOptions) AsyncMessageSource {
+	return &boundedSource{
+		source: source,
+		opts:   opts,
+	}
+}
+
+type boundedSource struct {
+	source AsyncMessageSource
+	opts   BoundedSourceOptions
+}
+
+// bounds tracks the progress of a call of ConsumeMessages towards the bounds.
+type bounds struct {
+	opts     BoundedSourceOptions
+	admitted int
+	// remaining are the listed partitions that haven't reached their
+	// offset yet.
+	remaining map[int32]bool
+}
+
+func newBounds(opts BoundedSourceOptions) *bounds {
+	b := &bounds{opts: opts}
+	if len(opts.StopAtOffsets) > 0 {
+		b.remaining = make(map[int32]bool, len(opts.StopAtOffsets))
+		for p, offset := range opts.StopAtOffsets {
+			if offset > 0 {
+				b.remaining[p] = true
+			}
+		}
+	}
+	return b
+}
+
+// reached reports whether consuming should stop.
+func (b *bounds) reached() bool {
+	if b.opts.MaxMessages > 0 && b.admitted >= b.opts.MaxMessages {
+		return true
+	}
+	return b.remaining != nil && len(b.remaining) == 0
+}
+
+// admit reports whether a message consumed from the underlying source is to
+// be delivered, and records its delivery.
+func (b *bounds) admit(msg Message) (bool, error) {
+	if b.remaining == nil {
+		b.admitted++
+		return true, nil
+	}
+	pm, ok := partitioned(msg)
+	if !ok {
+		return false, ErrNotPartitioned
+	}
+	stop, listed := b.opts.StopAtOffsets[pm.Partition()]
+	if listed && pm.Offset() >= stop {
+		// There can be gaps between offsets, e.g. after compaction.
+		delete(b.remaining, pm.Partition())
+		return false, nil
+	}
+	if listed && pm.Offset() == stop-1 {
+		delete(b.remaining, pm.Partition())
+	}
+	b.admitted++
+	return true, nil
+}
+
+// boundedMessage is a message consumed by a bounded source, which is dropped
+// if it is past the bounds.
+type boundedMessage struct {
+	msg     Message
+	dropped bool
+}
+
+// partitioned returns the outermost message of a chain of wrappers that
+// implements PartitionedMessage.
+func partitioned(msg Message) (PartitionedMessage, bool) {
+	for {
+		if pm, ok := msg.(PartitionedMessage); ok {
+			return pm, true
+		}
+		wrapper, ok := msg.(interface{ Original() Message })
+		if !ok {
+			return nil, false
+		}
+		msg = wrapper.Original()
+	}
+}
+
+func (s *boundedSource) ConsumeMessages(ctx context.Context, messages chan<- Message, acks <-chan Message) error {
+	b := newBounds(s.opts)
+	if b.reached() {
+		return nil
+	}
+
+	rg, ctx := rungroup.New(ctx)
+
+	fromInner := make(chan Message, cap(messages))
+	toInner := make(chan Message, cap(acks))
+
+	rg.Go(func() error {
+		return s.source.ConsumeMessages(ctx, fromInner, toInner)
+	})
+
+	rg.Go(func() error {
+		var (
+			// consumed are the messages consumed from the underlying
+			// source and not acknowledged to it yet, in order.
+			consumed []boundedMessage
+			// delivered is the number of consumed messages that were
+			// delivered and not acknowledged yet.
+			delivered int
+			// next is the message being delivered, on out.
+			next Message
+			out  chan<- Message
+			// idleTimer runs while the source is idle, if IdleTimeout is
+			// set.
+			idleTimer *time.Timer
+		)
+		stopIdleTimer := func() {
+			if idleTimer != nil {
+				idleTimer.Stop()
+				idleTimer = nil
+			}
+		}
+		defer stopIdleTimer()
+		for {
+			stopped := b.reached()
+			if stopped && next == nil && delivered == 0 {
+				return errBoundReached
+			}
+			in := fromInner
+			if stopped || next != nil {
+				in = nil
+			}
+			var idle <-chan time.Time
+			if s.opts.IdleTimeout > 0 && next == nil && delivered == 0 {
+				if idleTimer == nil {
+					idleTimer = time.NewTimer(s.opts.IdleTimeout)
+				}
+				idle = idleTimer.C
+			} else {
+				stopIdleTimer()
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-idle:
+				return errBoundReached
+			case msg := <-in:
+				stopIdleTimer()
+				deliver, err := b.admit(msg)
+				if err != nil {
+					return err
+				}
+				consumed = append(consumed, boundedMessage{msg: msg, dropped: !deliver})
+				if deliver {
+					next, out = msg, messages
+				}
+			case out <- next:
+				delivered++
+				next, out = nil, nil
+			case ack := <-acks:
+				if delivered == 0 {
+					return InvalidAckError{Acked: ack}
+				}
+				// The dropped messages before the acknowledged one are
+				// acknowledged along with it.
+				i := 0
+				for consumed[i].dropped {
+					i++
+				}
+				if !SameMessage(ack, consumed[i].msg) {
+					return InvalidAckError{Acked: ack, Expected: consumed[i].msg}
+				}
+				for _, bm := range consumed[:i+1] {
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case toInner <- bm.msg:
+					}
+				}
+				consumed = consumed[i+1:]
+				delivered--
+			}
+		}
+	})
+
+	if err := rg.Wait(); err != errBoundReached {
+		return err
+	}
+	return nil
+}
+
+// Close closes the underlying source.
+func (s *boundedSource) Close() error {
+	return s.source.Close()
+}
+
+// Status returns the status of the underlying source.
+func (s *boundedSource) Status() (*Status, error) {
+	return s.source.Status()
+}
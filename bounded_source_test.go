@@ -0,0 +1,193 @@
+package substrate
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// partitionedTestMessage is a message of a partitioned log.
+type partitionedTestMessage struct {
+	partition int32
+	offset    int64
+}
+
+func (m *partitionedTestMessage) Data() []byte {
+	return []byte(fmt.Sprintf("%d/%d", m.partition, m.offset))
+}
+
+func (m *partitionedTestMessage) Partition() int32 {
+	return m.partition
+}
+
+func (m *partitionedTestMessage) Offset() int64 {
+	return m.offset
+}
+
+func TestBoundedSourceMaxMessages(t *testing.T) {
+	m1, m2, m3 := message("one"), message("two"), message("three")
+	inner := newStreamingAsyncSource(&m1, &m2, &m3)
+	source := NewBoundedSource(inner, BoundedSourceOptions{MaxMessages: 2})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message, 3)
+	acks := make(chan Message, 3)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	assert.Equal(t, &m1, <-msgs)
+	assert.Equal(t, &m2, <-msgs)
+	acks <- &m1
+	assert.Equal(t, &m1, <-inner.acked)
+
+	// ConsumeMessages waits for the delivered messages to be acknowledged.
+	select {
+	case err := <-errs:
+		t.Fatalf("returned before all messages were acknowledged: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	acks <- &m2
+	assert.Equal(t, &m2, <-inner.acked)
+	assert.NoError(t, <-errs)
+	assert.Len(t, msgs, 0)
+}
+
+func TestBoundedSourceStopAtOffsets(t *testing.T) {
+	p0o0, p1o0 := &partitionedTestMessage{0, 0}, &partitionedTestMessage{1, 0}
+	p0o1, p1o1 := &partitionedTestMessage{0, 1}, &partitionedTestMessage{1, 1}
+	p1o2 := &partitionedTestMessage{1, 2}
+	inner := newStreamingAsyncSource(p0o0, p1o0, p0o1, p1o1, p1o2)
+	source := NewBoundedSource(inner, BoundedSourceOptions{
+		StopAtOffsets: map[int32]int64{0: 1, 1: 2},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	// The message at the offset of partition 0 is dropped, and
+	// acknowledged along with the message after it.
+	for _, m := range []Message{p0o0, p1o0, p1o1} {
+		delivered := <-msgs
+		assert.Equal(t, m, delivered)
+		acks <- delivered
+	}
+	assert.NoError(t, <-errs)
+	for _, m := range []Message{p0o0, p1o0, p0o1, p1o1} {
+		assert.Equal(t, m, <-inner.acked)
+	}
+	assert.Len(t, inner.acked, 0)
+}
+
+func TestBoundedSourceDropsTrailingMessages(t *testing.T) {
+	p0o0, p0o1 := &partitionedTestMessage{0, 0}, &partitionedTestMessage{0, 1}
+	p1o0 := &partitionedTestMessage{1, 0}
+	inner := newStreamingAsyncSource(p0o0, p0o1, p1o0)
+	source := NewBoundedSource(inner, BoundedSourceOptions{
+		StopAtOffsets: map[int32]int64{0: 1, 1: 1},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	for _, m := range []Message{p0o0, p1o0} {
+		delivered := <-msgs
+		assert.Equal(t, m, delivered)
+		acks <- delivered
+	}
+	assert.NoError(t, <-errs)
+	// The message after the last delivered one isn't acknowledged, so
+	// that it is consumed again.
+	for _, m := range []Message{p0o0, p0o1, p1o0} {
+		assert.Equal(t, m, <-inner.acked)
+	}
+
+	p0o2 := &partitionedTestMessage{0, 2}
+	inner = newStreamingAsyncSource(p0o0, p0o2)
+	source = NewBoundedSource(inner, BoundedSourceOptions{
+		StopAtOffsets: map[int32]int64{0: 1, 1: 1},
+	})
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+	delivered := <-msgs
+	acks <- delivered
+	assert.Equal(t, p0o0, <-inner.acked)
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+	assert.Len(t, inner.acked, 0)
+}
+
+func TestBoundedSourceErrors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	m := message("one")
+	source := NewBoundedSource(newStreamingAsyncSource(&m), BoundedSourceOptions{
+		StopAtOffsets: map[int32]int64{0: 1},
+	})
+	err := source.ConsumeMessages(ctx, make(chan Message), make(chan Message))
+	assert.Equal(t, ErrNotPartitioned, err)
+
+	// Partitions are already past offsets that aren't positive.
+	source = NewBoundedSource(newStreamingAsyncSource(&m), BoundedSourceOptions{
+		StopAtOffsets: map[int32]int64{0: 0},
+	})
+	assert.NoError(t, source.ConsumeMessages(ctx, make(chan Message), make(chan Message)))
+
+	// An acknowledgement without a delivered message is invalid.
+	source = NewBoundedSource(newStreamingAsyncSource(), BoundedSourceOptions{MaxMessages: 1})
+	acks := make(chan Message, 1)
+	acks <- &m
+	assert.Equal(t, InvalidAckError{Acked: &m}, source.ConsumeMessages(ctx, make(chan Message), acks))
+}
+
+func TestIdleTerminatingSource(t *testing.T) {
+	m1, m2 := message("one"), message("two")
+	inner := newStreamingAsyncSource(&m1, &m2)
+	source := NewIdleTerminatingSource(inner, 50*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	assert.Equal(t, &m1, <-msgs)
+	// The source is not idle while a message waits to be acknowledged.
+	select {
+	case err := <-errs:
+		t.Fatalf("returned before all messages were acknowledged: %v", err)
+	case <-time.After(150 * time.Millisecond):
+	}
+	acks <- &m1
+	assert.Equal(t, &m1, <-inner.acked)
+	assert.Equal(t, &m2, <-msgs)
+	acks <- &m2
+	assert.Equal(t, &m2, <-inner.acked)
+	assert.NoError(t, <-errs)
+}
@@ -0,0 +1,153 @@
+package checksum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/transform"
+	"github.com/uw-labs/substrate/internal/unwrap"
+)
+
+// Attribute is the attribute holding the checksum of the messages that have
+// attributes, as 8 hex digits.
+const Attribute = "substrate-crc32c"
+
+// The footer of a payload is the checksum, as a big endian uint32, followed by
+// the marker. Payloads without the marker are not checksummed.
+var footerMarker = []byte{0, 'S', 'B', 'C'}
+
+const footerSize = 8
+
+// ErrCorrupted is the error passed to OnCorrupt, wrapped in a
+// substrate.ValidationError, for a message whose payload does not match its
+// checksum.
+var ErrCorrupted = errors.New("payload does not match its checksum")
+
+var table = crc32.MakeTable(crc32.Castagnoli)
+
+// SinkConfig is the configuration parameters for a checksummed sink.
+type SinkConfig struct {
+	// Footer, if set, appends the checksum to the payload of every
+	// message, including the ones that have attributes, for backends that
+	// don't carry attributes.
+	Footer bool
+}
+
+// NewChecksummedSink returns a sink that sets the checksum of the payload of
+// every message before publishing it to sink. Acknowledged messages are the
+// ones sent to the returned sink.
+func NewChecksummedSink(sink substrate.AsyncMessageSink, c SinkConfig) substrate.AsyncMessageSink {
+	return transform.NewMessageSink(sink, func(msg substrate.Message) ([]byte, map[string]string, error) {
+		data := msg.Data()
+		sum := crc32.Checksum(data, table)
+
+		if attrs := unwrap.Attributes(msg); attrs != nil && !c.Footer {
+			out := make(map[string]string, len(attrs)+1)
+			for k, v := range attrs {
+				out[k] = v
+			}
+			var b [4]byte
+			binary.BigEndian.PutUint32(b[:], sum)
+			out[Attribute] = hex.EncodeToString(b[:])
+			return data, out, nil
+		}
+
+		out := make([]byte, len(data)+footerSize)
+		copy(out, data)
+		binary.BigEndian.PutUint32(out[len(data):], sum)
+		copy(out[len(data)+4:], footerMarker)
+		return out, nil, nil
+	})
+}
+
+// Metrics is implemented by callers wishing to count the messages verified by
+// a checksummed source. The methods are called for every message, so they
+// must not block.
+type Metrics interface {
+	// Verified is called for a message matching its checksum.
+	Verified()
+	// Unverified is called for a message without a checksum.
+	Unverified()
+	// Corrupted is called for a message not matching its checksum.
+	Corrupted()
+}
+
+// SourceConfig is the configuration parameters for a checksummed source.
+type SourceConfig struct {
+	// OnCorrupt is passed the messages not matching their checksum, which
+	// are not delivered. If it returns nil, the message is acknowledged to
+	// the underlying source. If it is nil or returns an error, consuming
+	// terminates with that error.
+	OnCorrupt substrate.MessageErrorHandler
+	// Metrics, if set, counts the verified, unverified and corrupted
+	// messages.
+	Metrics Metrics
+}
+
+// NewChecksummedSource returns a source that verifies the checksum of every
+// message consumed from source. Messages without a checksum are delivered
+// unchanged, so that sinks can be migrated to checksumming without disrupting
+// consumers. The delivered messages can be unwrapped to the messages of
+// source, and are discardable.
+func NewChecksummedSource(source substrate.AsyncMessageSource, c SourceConfig) substrate.AsyncMessageSource {
+	verified := substrate.NewValidatingSource(source, func(msg substrate.Message) error {
+		err := verify(msg)
+		if c.Metrics != nil {
+			switch err {
+			case nil:
+				c.Metrics.Verified()
+			case errUnverified:
+				c.Metrics.Unverified()
+			default:
+				c.Metrics.Corrupted()
+			}
+		}
+		if err == errUnverified {
+			return nil
+		}
+		return err
+	}, c.OnCorrupt)
+
+	return transform.NewMessageSource(verified, func(msg substrate.Message) ([]byte, map[string]string, error) {
+		data := msg.Data()
+		if _, ok := unwrap.Attributes(msg)[Attribute]; !ok && hasFooter(data) {
+			return data[:len(data)-footerSize], nil, nil
+		}
+		return data, nil, nil
+	})
+}
+
+// errUnverified is returned by verify for a message without a checksum.
+var errUnverified = errors.New("message has no checksum")
+
+// verify checks the payload of a message against its checksum, taken from its
+// attributes, or else from its footer.
+func verify(msg substrate.Message) error {
+	data := msg.Data()
+	if v, ok := unwrap.Attributes(msg)[Attribute]; ok {
+		b, err := hex.DecodeString(v)
+		if err != nil || len(b) != 4 {
+			return ErrCorrupted
+		}
+		if crc32.Checksum(data, table) != binary.BigEndian.Uint32(b) {
+			return ErrCorrupted
+		}
+		return nil
+	}
+	if !hasFooter(data) {
+		return errUnverified
+	}
+	payload := data[:len(data)-footerSize]
+	if crc32.Checksum(payload, table) != binary.BigEndian.Uint32(data[len(payload):]) {
+		return ErrCorrupted
+	}
+	return nil
+}
+
+func hasFooter(data []byte) bool {
+	return len(data) >= footerSize && bytes.HasSuffix(data, footerMarker)
+}
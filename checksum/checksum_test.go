@@ -0,0 +1,177 @@
+package checksum
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/testshared"
+	"github.com/uw-labs/substrate/internal/unwrap"
+)
+
+type counters struct {
+	verified, unverified, corrupted int
+}
+
+func (c *counters) Verified()   { c.verified++ }
+func (c *counters) Unverified() { c.unverified++ }
+func (c *counters) Corrupted()  { c.corrupted++ }
+
+// publish publishes the messages through a checksummed sink, and returns the
+// messages received by the broker.
+func publish(t *testing.T, c SinkConfig, msgs ...substrate.Message) []substrate.Message {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	broker := testshared.ChannelSink{
+		Messages:       make(chan substrate.Message, len(msgs)),
+		KeepAttributes: true,
+	}
+	sink := NewChecksummedSink(broker, c)
+	toSink := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishMessages(ctx, acks, toSink)
+	}()
+	for _, m := range msgs {
+		toSink <- m
+		assert.Equal(t, m, <-acks)
+	}
+	cancel()
+	require.Equal(t, context.Canceled, <-errs)
+
+	close(broker.Messages)
+	var published []substrate.Message
+	for m := range broker.Messages {
+		published = append(published, m)
+	}
+	return published
+}
+
+// consume consumes the messages through a checksummed source, acknowledging
+// the delivered ones, and returns their payloads once all the messages are
+// acknowledged to the underlying source.
+func consume(t *testing.T, c SourceConfig, msgs ...substrate.Message) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	inner := testshared.ChannelSource{
+		Messages: make(chan substrate.Message, len(msgs)),
+		Acked:    make(chan substrate.Message, len(msgs)),
+	}
+	for _, m := range msgs {
+		inner.Messages <- m
+	}
+	source := NewChecksummedSource(inner, c)
+	delivered := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, delivered, acks)
+	}()
+
+	var payloads []string
+	for acked := 0; acked < len(msgs); {
+		select {
+		case m := <-delivered:
+			payloads = append(payloads, string(m.Data()))
+			acks <- m
+		case m := <-inner.Acked:
+			assert.Equal(t, msgs[acked], m)
+			acked++
+		case err := <-errs:
+			t.Fatalf("consuming failed: %s", err)
+		}
+	}
+	cancel()
+	require.Equal(t, context.Canceled, <-errs)
+	return payloads
+}
+
+func TestChecksummedRoundTrip(t *testing.T) {
+	published := publish(t, SinkConfig{},
+		testshared.NewMessage("in band", nil),
+		testshared.NewMessage("with attributes", map[string]string{"key": "value"}),
+	)
+	require.Len(t, published, 2)
+	assert.Len(t, published[0].Data(), len("in band")+footerSize)
+	assert.Nil(t, unwrap.Attributes(published[0]))
+	assert.Equal(t, "with attributes", string(published[1].Data()))
+	assert.Equal(t, "value", unwrap.Attributes(published[1])["key"])
+	assert.Len(t, unwrap.Attributes(published[1])[Attribute], 8)
+
+	metrics := &counters{}
+	payloads := consume(t, SourceConfig{Metrics: metrics}, published...)
+	assert.Equal(t, []string{"in band", "with attributes"}, payloads)
+	assert.Equal(t, &counters{verified: 2}, metrics)
+}
+
+func TestChecksummedSinkFooter(t *testing.T) {
+	published := publish(t, SinkConfig{Footer: true}, testshared.NewMessage("payload", map[string]string{"key": "value"}))
+	require.Len(t, published, 1)
+	assert.Len(t, published[0].Data(), len("payload")+footerSize)
+	assert.NotContains(t, unwrap.Attributes(published[0]), Attribute)
+
+	assert.Equal(t, []string{"payload"}, consume(t, SourceConfig{}, published...))
+}
+
+func TestChecksummedSourceCorrupted(t *testing.T) {
+	published := publish(t, SinkConfig{},
+		testshared.NewMessage("truncated", nil),
+		testshared.NewMessage("intact", nil),
+		testshared.NewMessage("altered", map[string]string{}),
+	)
+	require.Len(t, published, 3)
+	truncated := testshared.NewMessage(string(published[0].Data()[1:]), nil)
+	altered := testshared.NewMessage("Altered", unwrap.Attributes(published[2]))
+
+	metrics := &counters{}
+	var corrupted []substrate.Message
+	payloads := consume(t, SourceConfig{
+		OnCorrupt: func(msg substrate.Message, err error) error {
+			assert.Equal(t, substrate.ValidationError{Err: ErrCorrupted}, err)
+			corrupted = append(corrupted, msg)
+			return nil
+		},
+		Metrics: metrics,
+	}, truncated, published[1], altered)
+
+	// The corrupted messages are not delivered, but are acknowledged.
+	assert.Equal(t, []string{"intact"}, payloads)
+	assert.Equal(t, []substrate.Message{truncated, altered}, corrupted)
+	assert.Equal(t, &counters{verified: 1, corrupted: 2}, metrics)
+}
+
+func TestChecksummedSourceUnverified(t *testing.T) {
+	// Messages published before sinks were migrated pass through.
+	published := publish(t, SinkConfig{}, testshared.NewMessage("checksummed", nil))
+	metrics := &counters{}
+	payloads := consume(t, SourceConfig{Metrics: metrics},
+		testshared.NewMessage("legacy", nil),
+		published[0],
+		testshared.NewMessage("legacy with attributes", map[string]string{"key": "value"}),
+	)
+	assert.Equal(t, []string{"legacy", "checksummed", "legacy with attributes"}, payloads)
+	assert.Equal(t, &counters{verified: 1, unverified: 2}, metrics)
+}
+
+func TestChecksummedSourceTerminatesWithoutOnCorrupt(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	published := publish(t, SinkConfig{}, testshared.NewMessage("payload", nil))
+	inner := testshared.ChannelSource{
+		Messages: make(chan substrate.Message, 1),
+		Acked:    make(chan substrate.Message, 1),
+	}
+	inner.Messages <- testshared.NewMessage(string(published[0].Data()[2:]), nil)
+
+	source := NewChecksummedSource(inner, SourceConfig{})
+	err := source.ConsumeMessages(ctx, make(chan substrate.Message), make(chan substrate.Message))
+	assert.Equal(t, substrate.ValidationError{Err: ErrCorrupted}, err)
+}
@@ -0,0 +1,29 @@
+// Package checksum provides substrate sink and source wrappers that detect
+// corrupted payloads, such as truncated messages published by a misbehaving
+// producer.
+//
+// Usage
+//
+// Checksummed sinks compute a CRC32C over the payload of every message. The
+// checksum is set in the Attribute attribute of the messages that have
+// attributes, and appended to the payload in a small footer otherwise, or
+// always if Footer is set, for backends that don't carry attributes.
+// Checksummed sources verify the checksum, remove the footer, and pass
+// corrupted messages to OnCorrupt, which may for example publish them to a
+// dead letter sink. Messages without a checksum are delivered unchanged and
+// counted as unverified, which allows consumers to be upgraded before
+// producers start checksumming.
+//
+//      sink = checksum.NewChecksummedSink(sink, checksum.SinkConfig{})
+//      ...
+//      source = checksum.NewChecksummedSource(source, checksum.SourceConfig{
+//          OnCorrupt: func(msg substrate.Message, err error) error {
+//              return deadLetter(msg)
+//          },
+//          Metrics: metrics,
+//      })
+//
+// The instrumented package provides NewChecksumCounter to count the verified,
+// unverified and corrupted messages with prometheus.
+//
+package checksum
@@ -0,0 +1,130 @@
+package cloudevents
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofrs/uuid"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/transform"
+	"github.com/uw-labs/substrate/internal/unwrap"
+)
+
+// SinkConfig is the configuration of the events published by a sink.
+type SinkConfig struct {
+	// Source is the source attribute of the events, identifying the context
+	// they happen in, e.g. the URI of the producing service.
+	Source string
+	// Type is the type attribute of the events.
+	Type string
+	// DataContentType, if set, is the datacontenttype attribute of the
+	// events, which otherwise have JSON data. Payloads that are not valid
+	// JSON are published in base64.
+	DataContentType string
+	// ID, if set, returns the id attribute of the event of a message.
+	// Defaults to a random UUID.
+	ID func(substrate.Message) string
+	// Time, if set, returns the time attribute of the event of a message,
+	// which is omitted if it is zero. Defaults to the timestamp of messages
+	// implementing substrate.TimestampedMessage, or to the current time.
+	Time func(substrate.Message) time.Time
+	// Attributes, if set, returns attributes of the event of a message
+	// overriding the ones set from the config, e.g. to set the type by
+	// message, a subject, or extension attributes.
+	Attributes func(substrate.Message) map[string]string
+}
+
+// NewSink returns a sink that wraps the payload of every message in an event
+// in the structured JSON mode before publishing it to sink. Publishing
+// terminates with an error wrapping ErrInvalidEvent if the event of a message
+// has no source or type. Acknowledged messages are the ones sent to the
+// returned sink.
+func NewSink(sink substrate.AsyncMessageSink, c SinkConfig) (substrate.AsyncMessageSink, error) {
+	if c.Source == "" && c.Attributes == nil {
+		return nil, errors.New("cloud events source must be set")
+	}
+	if c.Type == "" && c.Attributes == nil {
+		return nil, errors.New("cloud events type must be set")
+	}
+	return transform.NewMessageSink(sink, func(msg substrate.Message) ([]byte, map[string]string, error) {
+		data, err := encodeStructured(c.attributes(msg), msg.Data())
+		if err != nil {
+			return nil, nil, err
+		}
+		return data, map[string]string{contentTypeAttribute: ContentType}, nil
+	}), nil
+}
+
+// attributes returns the attributes of the event of a message.
+func (c *SinkConfig) attributes(msg substrate.Message) map[string]string {
+	attrs := map[string]string{
+		"specversion": SpecVersion,
+		"source":      c.Source,
+		"type":        c.Type,
+	}
+	if c.ID != nil {
+		attrs["id"] = c.ID(msg)
+	} else {
+		attrs["id"] = uuid.Must(uuid.NewV4()).String()
+	}
+	var t time.Time
+	if c.Time != nil {
+		t = c.Time(msg)
+	} else if tm, ok := unwrap.Unwrap(msg).(substrate.TimestampedMessage); ok && !tm.Timestamp().IsZero() {
+		t = tm.Timestamp()
+	} else {
+		t = time.Now()
+	}
+	if !t.IsZero() {
+		attrs["time"] = t.UTC().Format(time.RFC3339Nano)
+	}
+	if c.DataContentType != "" {
+		attrs["datacontenttype"] = c.DataContentType
+	}
+	if c.Attributes != nil {
+		for k, v := range c.Attributes(msg) {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+// SourceConfig is the configuration of a source of events.
+type SourceConfig struct {
+	// PassThroughInvalid makes the source deliver the messages that are not
+	// valid events unchanged, instead of terminating consuming.
+	PassThroughInvalid bool
+}
+
+// NewSource returns a source that parses the event of every message consumed
+// from source, in the structured JSON mode or the binary mode, delivering
+// messages with the data of the event as their payload, and its attributes
+// as their attributes. The delivered messages can be unwrapped to the
+// messages of source, and are discardable.
+func NewSource(source substrate.AsyncMessageSource, c SourceConfig) substrate.AsyncMessageSource {
+	return transform.NewMessageSource(source, func(msg substrate.Message) ([]byte, map[string]string, error) {
+		attrs, data, err := decode(msg)
+		if err != nil && c.PassThroughInvalid {
+			return msg.Data(), nil, nil
+		}
+		return data, attrs, err
+	})
+}
+
+// decode returns the attributes and data of the event of a message.
+func decode(msg substrate.Message) (map[string]string, []byte, error) {
+	attrs, binary, err := decodeBinary(unwrap.Attributes(msg))
+	data := msg.Data()
+	if !binary {
+		attrs, data, err = decodeStructured(data)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	// Events without data are delivered with an empty payload.
+	if data == nil {
+		data = []byte{}
+	}
+	return attrs, data, nil
+}
@@ -0,0 +1,283 @@
+package cloudevents
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/unwrap"
+	"github.com/uw-labs/substrate/mock"
+)
+
+type message struct {
+	data  []byte
+	attrs map[string]string
+}
+
+func (m *message) Data() []byte {
+	return m.data
+}
+
+func (m *message) Attributes() map[string]string {
+	return m.attrs
+}
+
+// publish publishes the messages through a sink with the config, and returns
+// the messages published to the underlying sink.
+func publish(t *testing.T, c SinkConfig, msgs ...substrate.Message) ([]substrate.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	recorder := mock.NewSink()
+	sink, err := NewSink(recorder, c)
+	require.NoError(t, err)
+
+	messages := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishMessages(ctx, acks, messages)
+	}()
+	for _, m := range msgs {
+		messages <- m
+		select {
+		case <-acks:
+		case err := <-errs:
+			return nil, err
+		}
+	}
+	return recorder.Published(), nil
+}
+
+// consume consumes the messages through a source with the config, and returns
+// the delivered messages.
+func consume(t *testing.T, c SourceConfig, msgs ...substrate.Message) ([]substrate.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	source := NewSource(mock.NewSource().DeliverMessages(msgs...), c)
+	messages := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, messages, acks)
+	}()
+
+	var delivered []substrate.Message
+	for range msgs {
+		select {
+		case m := <-messages:
+			delivered = append(delivered, m)
+			acks <- m
+		case err := <-errs:
+			return nil, err
+		}
+	}
+	return delivered, nil
+}
+
+func TestSink(t *testing.T) {
+	published, err := publish(t, SinkConfig{
+		Source: "/billing",
+		Type:   "com.example.invoice.created",
+		ID:     func(substrate.Message) string { return "A234-1234-1234" },
+		Time:   func(substrate.Message) time.Time { return time.Date(2018, 4, 5, 17, 31, 0, 0, time.UTC) },
+		Attributes: func(msg substrate.Message) map[string]string {
+			return map[string]string{"subject": msg.(*message).attrs["invoice"]}
+		},
+	},
+		&message{data: []byte(`{"amount":10}`), attrs: map[string]string{"invoice": "123"}},
+		&message{data: []byte("not json")},
+	)
+	require.NoError(t, err)
+	require.Len(t, published, 2)
+
+	assert.Equal(t, map[string]string{"content-type": "application/cloudevents+json"}, published[0].(substrate.AttributedMessage).Attributes())
+	assert.JSONEq(t, `{
+		"specversion": "1.0",
+		"id": "A234-1234-1234",
+		"source": "/billing",
+		"type": "com.example.invoice.created",
+		"time": "2018-04-05T17:31:00Z",
+		"subject": "123",
+		"data": {"amount": 10}
+	}`, string(published[0].Data()))
+
+	// Payloads that are not JSON are encoded in base64.
+	var event map[string]interface{}
+	require.NoError(t, json.Unmarshal(published[1].Data(), &event))
+	assert.Equal(t, "bm90IGpzb24=", event["data_base64"])
+	assert.Equal(t, "", event["subject"])
+
+	_, err = publish(t, SinkConfig{
+		Attributes: func(substrate.Message) map[string]string { return map[string]string{"type": "t"} },
+	}, &message{data: []byte("{}")})
+	assert.True(t, errors.Is(err, ErrInvalidEvent))
+
+	_, err = NewSink(mock.NewSink(), SinkConfig{Type: "t"})
+	assert.EqualError(t, err, "cloud events source must be set")
+	_, err = NewSink(mock.NewSink(), SinkConfig{Source: "s"})
+	assert.EqualError(t, err, "cloud events type must be set")
+}
+
+func TestRoundTrip(t *testing.T) {
+	payloads := []string{`{"amount":10}`, "plain text", "<much wow=\"xml\"/>", ""}
+	contentTypes := []string{"", "text/plain", "application/xml", ""}
+
+	var msgs []substrate.Message
+	for i, p := range payloads {
+		published, err := publish(t, SinkConfig{Source: "/billing", Type: "created", DataContentType: contentTypes[i]}, &message{data: []byte(p)})
+		require.NoError(t, err)
+		msgs = append(msgs, published...)
+	}
+
+	delivered, err := consume(t, SourceConfig{}, msgs...)
+	require.NoError(t, err)
+	for i, m := range delivered {
+		assert.Equal(t, payloads[i], string(m.Data()))
+		attrs := m.(substrate.AttributedMessage).Attributes()
+		assert.Equal(t, "created", attrs["type"])
+		assert.Equal(t, "/billing", attrs["source"])
+		assert.NotEmpty(t, attrs["id"])
+		assert.NotEmpty(t, attrs["time"])
+	}
+}
+
+func TestSource(t *testing.T) {
+	tests := []struct {
+		name  string
+		msg   *message
+		data  string
+		attrs map[string]string
+	}{
+		{
+			// The example of the JSON event format specification.
+			name: "structured",
+			msg: &message{data: []byte(`{
+				"specversion" : "1.0",
+				"type" : "com.example.someevent",
+				"source" : "/mycontext",
+				"id" : "A234-1234-1234",
+				"time" : "2018-04-05T17:31:00Z",
+				"comexampleextension1" : "value",
+				"comexampleothervalue" : 5,
+				"datacontenttype" : "application/vnd.apache.thrift.binary",
+				"data_base64" : "... base64 encoded string ..."
+			}`)},
+		},
+		{
+			name: "structured with xml data",
+			msg: &message{data: []byte(`{
+				"specversion" : "1.0",
+				"type" : "com.example.someevent",
+				"source" : "/mycontext",
+				"id" : "B234-1234-1234",
+				"time" : "2018-04-05T17:31:00Z",
+				"comexampleextension1" : "value",
+				"unsetextension": null,
+				"datacontenttype" : "text/xml",
+				"data" : "<much wow=\"xml\"/>"
+			}`)},
+			data: `<much wow="xml"/>`,
+			attrs: map[string]string{
+				"specversion":          "1.0",
+				"type":                 "com.example.someevent",
+				"source":               "/mycontext",
+				"id":                   "B234-1234-1234",
+				"time":                 "2018-04-05T17:31:00Z",
+				"comexampleextension1": "value",
+				"datacontenttype":      "text/xml",
+			},
+		},
+		{
+			name: "structured with json data",
+			msg:  &message{data: []byte(`{"specversion":"1.0","type":"t","source":"s","id":"1","data":{"a":[1,2]}}`)},
+			data: `{"a":[1,2]}`,
+			attrs: map[string]string{
+				"specversion": "1.0",
+				"type":        "t",
+				"source":      "s",
+				"id":          "1",
+			},
+		},
+		{
+			name: "kafka binary",
+			msg: &message{data: []byte(`{"a":1}`), attrs: map[string]string{
+				"ce_specversion": "1.0",
+				"ce_type":        "t",
+				"ce_source":      "s",
+				"ce_id":          "1",
+				"content-type":   "application/json",
+				"traceparent":    "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+			}},
+			data: `{"a":1}`,
+			attrs: map[string]string{
+				"specversion":     "1.0",
+				"type":            "t",
+				"source":          "s",
+				"id":              "1",
+				"datacontenttype": "application/json",
+			},
+		},
+		{
+			name: "http binary",
+			msg: &message{data: []byte("hello"), attrs: map[string]string{
+				"Ce-Specversion": "1.0",
+				"Ce-Type":        "t",
+				"Ce-Source":      "s",
+				"Ce-Id":          "1",
+			}},
+			data: "hello",
+			attrs: map[string]string{
+				"specversion": "1.0",
+				"type":        "t",
+				"source":      "s",
+				"id":          "1",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delivered, err := consume(t, SourceConfig{}, tt.msg)
+			if tt.attrs == nil {
+				// The example data is not valid base64.
+				assert.True(t, errors.Is(err, ErrInvalidEvent))
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, delivered, 1)
+			assert.Equal(t, tt.data, string(delivered[0].Data()))
+			assert.Equal(t, tt.attrs, delivered[0].(substrate.AttributedMessage).Attributes())
+		})
+	}
+}
+
+func TestInvalidEvents(t *testing.T) {
+	invalid := []*message{
+		{data: []byte("not json")},
+		{data: []byte(`{"specversion":"1.0","type":"t","source":"s"}`)},
+		{data: []byte(`{"specversion":"0.3","type":"t","source":"s","id":"1"}`)},
+		{data: []byte(`{"specversion":"1.0","type":"t","source":"s","id":"1","data":"a","data_base64":"YQ=="}`)},
+		{data: []byte(`{"specversion":"1.0","type":"t","source":"s","id":"1","datacontenttype":"text/plain","data":{}}`)},
+		{data: []byte("{}"), attrs: map[string]string{"ce_specversion": "1.0"}},
+	}
+
+	for _, msg := range invalid {
+		_, err := consume(t, SourceConfig{}, msg)
+		assert.True(t, errors.Is(err, ErrInvalidEvent), string(msg.data))
+
+		delivered, err := consume(t, SourceConfig{PassThroughInvalid: true}, msg)
+		require.NoError(t, err)
+		require.Len(t, delivered, 1)
+		assert.Equal(t, msg.data, delivered[0].Data())
+		// Invalid messages keep their attributes.
+		assert.Equal(t, msg.attrs, unwrap.Attributes(delivered[0]))
+	}
+}
@@ -0,0 +1,38 @@
+// Package cloudevents provides substrate sink and source wrappers for messages
+// in the CloudEvents v1.0 format, see https://cloudevents.io.
+//
+// Usage
+//
+// Sinks wrap the payload of every message in a CloudEvents envelope in the
+// structured JSON mode, with the content-type attribute set to
+// application/cloudevents+json. The source and type of the events are set in
+// the config, and can be overridden by message, along with any other
+// attribute:
+//
+//      sink, err := cloudevents.NewSink(sink, cloudevents.SinkConfig{
+//          Source: "/billing",
+//          Type:   "com.example.invoice.created",
+//      })
+//
+// The id of an event defaults to a random UUID, and its time to the timestamp
+// of messages implementing substrate.TimestampedMessage, or to the time it is
+// published.
+//
+// Sources parse events in the structured JSON mode, and in the binary mode,
+// where the event attributes are message attributes prefixed with ce_ or ce-,
+// as set by the kafka and HTTP bindings. The delivered messages expose the
+// event attributes, keyed by their CloudEvents names, such as id and type,
+// through the substrate.AttributedMessage interface, and the event data as
+// their payload:
+//
+//      source = cloudevents.NewSource(source, cloudevents.SourceConfig{})
+//      ...
+//      attrs := msg.(substrate.AttributedMessage).Attributes()
+//      switch attrs["type"] {
+//      ...
+//
+// Consuming terminates with an error wrapping ErrInvalidEvent on a message
+// that is not a valid event, unless PassThroughInvalid is set, in which case
+// the message is delivered unchanged.
+//
+package cloudevents
@@ -0,0 +1,169 @@
+package cloudevents
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// SpecVersion is the version of the CloudEvents specification of the
+	// events.
+	SpecVersion = "1.0"
+	// ContentType is the content type of events in the structured JSON
+	// mode.
+	ContentType = "application/cloudevents+json"
+
+	// contentTypeAttribute is the message attribute holding the content
+	// type, which is the datacontenttype of events in the binary mode.
+	contentTypeAttribute = "content-type"
+)
+
+// ErrInvalidEvent is wrapped by the errors of sources for messages that are
+// not valid events, and of sinks for messages whose events would not be
+// valid.
+var ErrInvalidEvent = errors.New("invalid cloud event")
+
+// requiredAttributes are the attributes every event has.
+var requiredAttributes = []string{"id", "source", "specversion", "type"}
+
+// validate checks that the event attributes have the required attributes,
+// and are of the supported version.
+func validate(attrs map[string]string) error {
+	for _, name := range requiredAttributes {
+		if attrs[name] == "" {
+			return fmt.Errorf("%w: missing %s attribute", ErrInvalidEvent, name)
+		}
+	}
+	if v := attrs["specversion"]; v != SpecVersion {
+		return fmt.Errorf("%w: unsupported specversion %q", ErrInvalidEvent, v)
+	}
+	return nil
+}
+
+// isJSON returns whether data of the content type is JSON, which is the case
+// when the content type is not set.
+func isJSON(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// encodeStructured returns the event of the attributes and data in the
+// structured JSON mode. JSON data is embedded as is, text data as a string,
+// and any other data in base64.
+func encodeStructured(attrs map[string]string, data []byte) ([]byte, error) {
+	if err := validate(attrs); err != nil {
+		return nil, err
+	}
+	event := make(map[string]interface{}, len(attrs)+1)
+	for k, v := range attrs {
+		event[k] = v
+	}
+	contentType := attrs["datacontenttype"]
+	switch {
+	case data == nil:
+	case isJSON(contentType) && json.Valid(data):
+		event["data"] = json.RawMessage(data)
+	case strings.HasPrefix(contentType, "text/") && utf8.Valid(data):
+		event["data"] = string(data)
+	default:
+		event["data_base64"] = base64.StdEncoding.EncodeToString(data)
+	}
+	return json.Marshal(event)
+}
+
+// decodeStructured parses an event in the structured JSON mode, returning its
+// attributes and data. Attributes that are not strings, such as integer
+// extensions, are returned in their JSON form.
+func decodeStructured(payload []byte) (map[string]string, []byte, error) {
+	var event map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidEvent, err)
+	}
+
+	attrs := make(map[string]string, len(event))
+	var data []byte
+	for k, v := range event {
+		if string(v) == "null" {
+			continue
+		}
+		switch k {
+		case "data", "data_base64":
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(v, &s); err != nil {
+			s = string(v)
+		}
+		attrs[k] = s
+	}
+	if err := validate(attrs); err != nil {
+		return nil, nil, err
+	}
+
+	raw, hasData := event["data"]
+	encoded, hasBase64 := event["data_base64"]
+	switch {
+	case hasData && hasBase64:
+		return nil, nil, fmt.Errorf("%w: both data and data_base64 are set", ErrInvalidEvent)
+	case hasBase64:
+		var s string
+		if err := json.Unmarshal(encoded, &s); err != nil {
+			return nil, nil, fmt.Errorf("%w: data_base64 is not a string", ErrInvalidEvent)
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: invalid data_base64: %v", ErrInvalidEvent, err)
+		}
+		data = b
+	case hasData && !isJSON(attrs["datacontenttype"]):
+		// Data that isn't JSON is carried as a string.
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, nil, fmt.Errorf("%w: data of type %s is not a string", ErrInvalidEvent, attrs["datacontenttype"])
+		}
+		data = []byte(s)
+	case hasData:
+		data = raw
+	}
+	return attrs, data, nil
+}
+
+// binaryPrefixes are the prefixes of the message attributes holding the event
+// attributes in the binary mode, of the kafka and HTTP bindings.
+var binaryPrefixes = []string{"ce_", "ce-"}
+
+// decodeBinary returns the event attributes of a message in the binary mode,
+// or false if it isn't in the binary mode. Attribute names are case
+// insensitive, like HTTP headers.
+func decodeBinary(msgAttrs map[string]string) (map[string]string, bool, error) {
+	attrs := make(map[string]string, len(msgAttrs))
+	binary := false
+	for k, v := range msgAttrs {
+		name := strings.ToLower(k)
+		if name == contentTypeAttribute {
+			attrs["datacontenttype"] = v
+			continue
+		}
+		for _, prefix := range binaryPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				attrs[strings.TrimPrefix(name, prefix)] = v
+				binary = true
+			}
+		}
+	}
+	if !binary {
+		return nil, false, nil
+	}
+	return attrs, true, validate(attrs)
+}
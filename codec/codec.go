@@ -0,0 +1,49 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// JSONMarshal marshals a value to JSON.
+func JSONMarshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// JSONUnmarshal returns a function unmarshalling JSON payloads into the
+// values returned by newValue, which must be pointers, e.g.
+// func() interface{} { return &Order{} }.
+func JSONUnmarshal(newValue func() interface{}) func([]byte) (interface{}, error) {
+	return func(data []byte) (interface{}, error) {
+		v := newValue()
+		if err := json.Unmarshal(data, v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+}
+
+// ProtoMarshal marshals a protobuf message. It fails on values that are not
+// protobuf messages.
+func ProtoMarshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a protobuf message", v)
+	}
+	return proto.Marshal(m)
+}
+
+// ProtoUnmarshal returns a function unmarshalling protobuf payloads into the
+// messages returned by newMessage, e.g.
+// func() proto.Message { return &pb.Order{} }.
+func ProtoUnmarshal(newMessage func() proto.Message) func([]byte) (interface{}, error) {
+	return func(data []byte) (interface{}, error) {
+		m := newMessage()
+		if err := proto.Unmarshal(data, m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+}
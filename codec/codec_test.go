@@ -0,0 +1,180 @@
+package codec
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	proximo "github.com/uw-labs/proximo/proto"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/inmemory"
+)
+
+type order struct {
+	ID     string `json:"id"`
+	Amount int    `json:"amount"`
+}
+
+func newOrder() interface{} {
+	return &order{}
+}
+
+func newSink(t *testing.T, broker *inmemory.Broker, topic string) substrate.SynchronousMessageSink {
+	sink, err := inmemory.NewAsyncMessageSink(inmemory.AsyncMessageSinkConfig{Broker: broker, Topic: topic})
+	require.NoError(t, err)
+	return substrate.NewSynchronousMessageSink(sink)
+}
+
+func newSource(t *testing.T, broker *inmemory.Broker, topic string) substrate.SynchronousMessageSource {
+	source, err := inmemory.NewAsyncMessageSource(inmemory.AsyncMessageSourceConfig{Broker: broker, Topic: topic})
+	require.NoError(t, err)
+	return substrate.NewSynchronousMessageSource(source)
+}
+
+// roundTrip publishes the values, with an invalid payload after the first
+// one, and returns the values consumed with the Skip policy.
+func roundTrip(t *testing.T, marshal func(interface{}) ([]byte, error), unmarshal func([]byte) (interface{}, error), values []interface{}) []interface{} {
+	broker := inmemory.NewBroker()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	raw := newSink(t, broker, "values")
+	sink := NewSink(raw, marshal)
+	for i, v := range values {
+		require.NoError(t, sink.Publish(ctx, v))
+		if i == 0 {
+			require.NoError(t, raw.PublishMessage(ctx, &message{data: []byte{0xff, 0x01}}))
+		}
+	}
+
+	var consumed []interface{}
+	source := NewSource(newSource(t, broker, "values"), unmarshal, func(_ context.Context, v interface{}) error {
+		if consumed = append(consumed, v); len(consumed) == len(values) {
+			cancel()
+		}
+		return nil
+	}, Skip)
+	assert.Equal(t, context.Canceled, source.Run(ctx))
+	assert.NoError(t, sink.Close())
+	return consumed
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		test func(t *testing.T)
+	}{
+		{
+			name: "json",
+			test: func(t *testing.T) {
+				values := []interface{}{&order{ID: "a", Amount: 1}, &order{ID: "b", Amount: 2}, &order{ID: "c", Amount: 3}}
+				assert.Equal(t, values, roundTrip(t, JSONMarshal, JSONUnmarshal(newOrder), values))
+			},
+		},
+		{
+			name: "proto",
+			test: func(t *testing.T) {
+				values := []interface{}{
+					&proximo.Message{Id: "a", Data: []byte("1")},
+					&proximo.Message{Id: "b", Data: []byte("2")},
+					&proximo.Message{Id: "c", Data: []byte("3")},
+				}
+				consumed := roundTrip(t, ProtoMarshal, ProtoUnmarshal(func() proto.Message { return &proximo.Message{} }), values)
+				require.Len(t, consumed, len(values))
+				for i := range values {
+					assert.True(t, proto.Equal(values[i].(proto.Message), consumed[i].(proto.Message)))
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, tt.test)
+	}
+}
+
+func TestUnmarshalErrorPolicies(t *testing.T) {
+	tests := []struct {
+		name string
+		// policy returns the policy to test, given the dead letter sink.
+		policy     func(substrate.SynchronousMessageSink) UnmarshalErrorPolicy
+		err        bool
+		deadLetter bool
+	}{
+		{
+			name:   "default",
+			policy: func(substrate.SynchronousMessageSink) UnmarshalErrorPolicy { return nil },
+			err:    true,
+		},
+		{
+			name:   "skip",
+			policy: func(substrate.SynchronousMessageSink) UnmarshalErrorPolicy { return Skip },
+		},
+		{
+			name:       "dead letter",
+			policy:     DeadLetter,
+			deadLetter: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := inmemory.NewBroker()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			raw := newSink(t, broker, "orders")
+			require.NoError(t, raw.PublishMessage(ctx, &message{data: []byte("not json")}))
+			require.NoError(t, NewSink(raw, JSONMarshal).Publish(ctx, order{ID: "a"}))
+
+			deadLetters := newSink(t, broker, "dead-letters")
+			var handled []order
+			source := NewSource(newSource(t, broker, "orders"), JSONUnmarshal(newOrder), func(_ context.Context, v interface{}) error {
+				handled = append(handled, *v.(*order))
+				cancel()
+				return nil
+			}, tt.policy(deadLetters))
+
+			err := source.Run(ctx)
+			if tt.err {
+				var uerr UnmarshalError
+				assert.True(t, errors.As(err, &uerr))
+				assert.Empty(t, handled)
+				return
+			}
+			assert.Equal(t, context.Canceled, err)
+			assert.Equal(t, []order{{ID: "a"}}, handled)
+
+			if tt.deadLetter {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				var dead []string
+				_ = newSource(t, broker, "dead-letters").ConsumeMessages(ctx, func(_ context.Context, msg substrate.Message) error {
+					dead = append(dead, string(msg.Data()))
+					cancel()
+					return nil
+				})
+				assert.Equal(t, []string{"not json"}, dead)
+			}
+		})
+	}
+}
+
+func TestHandlerError(t *testing.T) {
+	broker := inmemory.NewBroker()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	require.NoError(t, NewSink(newSink(t, broker, "orders"), JSONMarshal).Publish(ctx, order{ID: "a"}))
+
+	failure := errors.New("handler failed")
+	source := NewSource(newSource(t, broker, "orders"), JSONUnmarshal(newOrder), func(context.Context, interface{}) error {
+		return failure
+	}, nil)
+	assert.Equal(t, failure, source.Run(ctx))
+}
@@ -0,0 +1,30 @@
+// Package codec provides sinks and sources of values, which marshal them to
+// and unmarshal them from message payloads, over the synchronous substrate
+// sinks and sources.
+//
+// Usage
+//
+// Sinks marshal the published values, and sources unmarshal the payload of
+// every consumed message before calling the handler with the value. Messages
+// are acknowledged once the handler returns nil, in the order they were
+// consumed, as by the synchronous source.
+//
+//      orders := codec.NewSink(substrate.NewSynchronousMessageSink(sink), codec.JSONMarshal)
+//      err := orders.Publish(ctx, order)
+//      ...
+//      source := codec.NewSource(substrate.NewSynchronousMessageSource(source),
+//          codec.ProtoUnmarshal(func() proto.Message { return &pb.Order{} }),
+//          func(ctx context.Context, v interface{}) error {
+//              return handle(ctx, v.(*pb.Order))
+//          }, codec.Skip)
+//      err := source.Run(ctx)
+//
+// The module supports Go versions without type parameters, so values are
+// passed as interface{}: the handler receives the values returned by the
+// unmarshal function, which are pointers for the JSON and protobuf codecs.
+//
+// Payloads that can't be unmarshalled are passed to the UnmarshalErrorPolicy
+// of the source, which either fails consuming, skips the message, or publishes
+// it to a dead letter sink.
+//
+package codec
@@ -0,0 +1,60 @@
+package codec
+
+import (
+	"context"
+
+	"github.com/uw-labs/substrate"
+)
+
+// Sink publishes values to a synchronous sink.
+type Sink struct {
+	sink    substrate.SynchronousMessageSink
+	marshal func(interface{}) ([]byte, error)
+}
+
+// NewSink returns a sink that publishes the values marshalled by marshal to
+// sink. When Close is called on the returned sink, this is also propagated to
+// sink.
+func NewSink(sink substrate.SynchronousMessageSink, marshal func(interface{}) ([]byte, error)) *Sink {
+	return &Sink{sink: sink, marshal: marshal}
+}
+
+// message is a marshalled value.
+type message struct {
+	data []byte
+	key  []byte
+}
+
+func (m *message) Data() []byte {
+	return m.data
+}
+
+func (m *message) Key() []byte {
+	return m.key
+}
+
+// Publish marshals and publishes a value, waiting for the sink to acknowledge
+// it.
+func (s *Sink) Publish(ctx context.Context, v interface{}) error {
+	return s.PublishWithKey(ctx, nil, v)
+}
+
+// PublishWithKey marshals and publishes a value with a key, for the backends
+// that use keys, waiting for the sink to acknowledge it.
+func (s *Sink) PublishWithKey(ctx context.Context, key []byte, v interface{}) error {
+	data, err := s.marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.sink.PublishMessage(ctx, &message{data: data, key: key})
+}
+
+// Close closes the underlying sink.
+func (s *Sink) Close() error {
+	return s.sink.Close()
+}
+
+// Status returns the status of the underlying sink.
+func (s *Sink) Status() (*substrate.Status, error) {
+	return s.sink.Status()
+}
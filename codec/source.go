@@ -0,0 +1,92 @@
+package codec
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/uw-labs/substrate"
+)
+
+// UnmarshalErrorPolicy handles a message whose payload can't be unmarshalled.
+// If it returns nil, the message is acknowledged without being handled,
+// otherwise consuming terminates with the returned error.
+type UnmarshalErrorPolicy func(ctx context.Context, msg substrate.Message, err error) error
+
+// UnmarshalError is returned by Fail for a payload that can't be unmarshalled.
+type UnmarshalError struct {
+	Err error
+}
+
+func (e UnmarshalError) Error() string {
+	return fmt.Sprintf("failed to unmarshal message: %s", e.Err)
+}
+
+func (e UnmarshalError) Unwrap() error {
+	return e.Err
+}
+
+// Fail terminates consuming with an UnmarshalError. It is the default policy.
+func Fail(_ context.Context, _ substrate.Message, err error) error {
+	return UnmarshalError{Err: err}
+}
+
+// Skip acknowledges messages that can't be unmarshalled.
+func Skip(context.Context, substrate.Message, error) error {
+	return nil
+}
+
+// DeadLetter returns a policy that publishes messages that can't be
+// unmarshalled to sink, and acknowledges them once sink has.
+func DeadLetter(sink substrate.SynchronousMessageSink) UnmarshalErrorPolicy {
+	return func(ctx context.Context, msg substrate.Message, _ error) error {
+		return sink.PublishMessage(ctx, msg)
+	}
+}
+
+// Source consumes values from a synchronous source.
+type Source struct {
+	source    substrate.SynchronousMessageSource
+	unmarshal func([]byte) (interface{}, error)
+	handler   func(context.Context, interface{}) error
+	onError   UnmarshalErrorPolicy
+}
+
+// NewSource returns a source that unmarshals the payload of every message
+// consumed from source with unmarshal, and calls handler with the value.
+// Payloads that can't be unmarshalled are passed to onError, which defaults to
+// Fail. When Close is called on the returned source, this is also propagated
+// to source.
+func NewSource(source substrate.SynchronousMessageSource, unmarshal func([]byte) (interface{}, error), handler func(context.Context, interface{}) error, onError UnmarshalErrorPolicy) *Source {
+	if onError == nil {
+		onError = Fail
+	}
+	return &Source{
+		source:    source,
+		unmarshal: unmarshal,
+		handler:   handler,
+		onError:   onError,
+	}
+}
+
+// Run consumes messages until the context is done or an error occurs. A
+// message is acknowledged once the handler returns nil for its value, and an
+// error returned by the handler terminates consuming.
+func (s *Source) Run(ctx context.Context) error {
+	return s.source.ConsumeMessages(ctx, func(ctx context.Context, msg substrate.Message) error {
+		v, err := s.unmarshal(msg.Data())
+		if err != nil {
+			return s.onError(ctx, msg, err)
+		}
+		return s.handler(ctx, v)
+	})
+}
+
+// Close closes the underlying source.
+func (s *Source) Close() error {
+	return s.source.Close()
+}
+
+// Status returns the status of the underlying source.
+func (s *Source) Status() (*substrate.Status, error) {
+	return s.source.Status()
+}
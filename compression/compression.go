@@ -0,0 +1,179 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/transform"
+)
+
+// Codec is a compression algorithm.
+type Codec byte
+
+const (
+	// Gzip compresses payloads with gzip.
+	Gzip Codec = 1
+	// Zstd compresses payloads with zstandard.
+	Zstd Codec = 2
+	// Snappy compresses payloads with snappy.
+	Snappy Codec = 3
+)
+
+// The envelope of a compressed payload is the marker followed by the codec
+// byte and the compressed payload. Payloads without the marker are passed
+// through unchanged by decompressing sources.
+var envelopeMarker = []byte{0, 'S', 'B', 'Z'}
+
+const (
+	envelopeSize           = 5
+	defaultMaxMessageBytes = 64 * 1024 * 1024
+)
+
+// ErrMessageTooLarge is returned when a payload decompresses to more than the
+// maximum message size.
+var ErrMessageTooLarge = errors.New("decompressed payload is too large")
+
+// SinkConfig is the configuration parameters for a compressing sink.
+type SinkConfig struct {
+	// Codec is the compression algorithm. Defaults to Gzip.
+	Codec Codec
+	// MinBytes is the minimum payload size to compress. Smaller payloads
+	// are published unchanged.
+	MinBytes int
+}
+
+// NewCompressingSink returns a sink that compresses the payload of every
+// message before publishing it to sink. Acknowledged messages are the ones
+// sent to the returned sink.
+func NewCompressingSink(sink substrate.AsyncMessageSink, c SinkConfig) (substrate.AsyncMessageSink, error) {
+	if c.Codec == 0 {
+		c.Codec = Gzip
+	}
+
+	var compress func([]byte) ([]byte, error)
+	switch c.Codec {
+	case Gzip:
+		compress = gzipCompress
+	case Zstd:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		compress = func(data []byte) ([]byte, error) {
+			return enc.EncodeAll(data, nil), nil
+		}
+	case Snappy:
+		compress = func(data []byte) ([]byte, error) {
+			return snappy.Encode(nil, data), nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown compression codec %d", c.Codec)
+	}
+
+	return transform.NewSink(sink, func(data []byte) ([]byte, error) {
+		if len(data) < c.MinBytes {
+			return data, nil
+		}
+		compressed, err := compress(data)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]byte, envelopeSize+len(compressed))
+		copy(out, envelopeMarker)
+		out[len(envelopeMarker)] = byte(c.Codec)
+		copy(out[envelopeSize:], compressed)
+		return out, nil
+	}), nil
+}
+
+func gzipCompress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SourceConfig is the configuration parameters for a decompressing source.
+type SourceConfig struct {
+	// MaxMessageBytes is the maximum size of a decompressed payload.
+	// Defaults to 64MiB.
+	MaxMessageBytes int
+}
+
+// NewDecompressingSource returns a source that decompresses the payload of
+// every message consumed from source. Payloads that are not compressed are
+// delivered unchanged, so that sinks can be migrated to compression without
+// disrupting consumers. Consuming terminates if a payload can not be
+// decompressed. The delivered messages can be unwrapped to the messages of
+// source, and are discardable.
+func NewDecompressingSource(source substrate.AsyncMessageSource, c SourceConfig) (substrate.AsyncMessageSource, error) {
+	if c.MaxMessageBytes <= 0 {
+		c.MaxMessageBytes = defaultMaxMessageBytes
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(c.MaxMessageBytes)))
+	if err != nil {
+		return nil, err
+	}
+
+	return transform.NewSource(source, func(data []byte) ([]byte, error) {
+		if len(data) < envelopeSize || !bytes.HasPrefix(data, envelopeMarker) {
+			return data, nil
+		}
+		compressed := data[envelopeSize:]
+
+		switch codec := Codec(data[len(envelopeMarker)]); codec {
+		case Gzip:
+			return gzipDecompress(compressed, c.MaxMessageBytes)
+		case Zstd:
+			out, err := dec.DecodeAll(compressed, nil)
+			if err != nil {
+				return nil, err
+			}
+			if len(out) > c.MaxMessageBytes {
+				return nil, ErrMessageTooLarge
+			}
+			return out, nil
+		case Snappy:
+			n, err := snappy.DecodedLen(compressed)
+			if err != nil {
+				return nil, err
+			}
+			if n > c.MaxMessageBytes {
+				return nil, ErrMessageTooLarge
+			}
+			return snappy.Decode(nil, compressed)
+		default:
+			return nil, fmt.Errorf("unknown compression codec %d", codec)
+		}
+	}), nil
+}
+
+func gzipDecompress(data []byte, maxBytes int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(maxBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxBytes {
+		return nil, ErrMessageTooLarge
+	}
+	return out, nil
+}
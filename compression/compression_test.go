@@ -0,0 +1,134 @@
+package compression
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/testshared"
+)
+
+// roundTrip publishes the payloads through a compressing sink, and returns
+// what the broker received along with what a decompressing source delivered.
+func roundTrip(t *testing.T, sinkConf SinkConfig, sourceConf SourceConfig, payloads ...[]byte) ([][]byte, [][]byte, error) {
+	broker := make(chan substrate.Message, len(payloads))
+	sink, err := NewCompressingSink(testshared.ChannelSink{Messages: broker}, sinkConf)
+	require.NoError(t, err)
+	source, err := NewDecompressingSource(testshared.ChannelSource{Messages: broker}, sourceConf)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	toSink := make(chan substrate.Message)
+	sinkAcks := make(chan substrate.Message)
+	sinkErrs := make(chan error, 1)
+	go func() {
+		sinkErrs <- sink.PublishMessages(ctx, sinkAcks, toSink)
+	}()
+	for _, p := range payloads {
+		m := &testshared.Message{Payload: p}
+		toSink <- m
+		assert.Equal(t, m, <-sinkAcks)
+	}
+
+	var published [][]byte
+	for range payloads {
+		m := <-broker
+		published = append(published, m.Data())
+		broker <- m
+	}
+
+	fromSource := make(chan substrate.Message)
+	sourceAcks := make(chan substrate.Message)
+	sourceErrs := make(chan error, 1)
+	go func() {
+		sourceErrs <- source.ConsumeMessages(ctx, fromSource, sourceAcks)
+	}()
+	var consumed [][]byte
+	for range payloads {
+		select {
+		case m := <-fromSource:
+			consumed = append(consumed, m.Data())
+			sourceAcks <- m
+		case err := <-sourceErrs:
+			return published, consumed, err
+		}
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-sinkErrs)
+	assert.Equal(t, context.Canceled, <-sourceErrs)
+	return published, consumed, nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("compressible "), 100)
+
+	for _, codec := range []Codec{Gzip, Zstd, Snappy} {
+		t.Run(fmt.Sprint(codec), func(t *testing.T) {
+			published, consumed, err := roundTrip(t, SinkConfig{Codec: codec}, SourceConfig{}, payload, []byte{})
+			require.NoError(t, err)
+			assert.Equal(t, [][]byte{payload, {}}, consumed)
+			assert.True(t, bytes.HasPrefix(published[0], envelopeMarker))
+			assert.Equal(t, byte(codec), published[0][len(envelopeMarker)])
+			assert.True(t, len(published[0]) < len(payload))
+		})
+	}
+}
+
+func TestMinBytes(t *testing.T) {
+	published, consumed, err := roundTrip(t, SinkConfig{MinBytes: 10}, SourceConfig{}, []byte("short"), []byte("long enough"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("short"), published[0])
+	assert.True(t, bytes.HasPrefix(published[1], envelopeMarker))
+	assert.Equal(t, [][]byte{[]byte("short"), []byte("long enough")}, consumed)
+}
+
+func TestUncompressedPassThrough(t *testing.T) {
+	broker := make(chan substrate.Message, 1)
+	broker <- &testshared.Message{Payload: []byte(`{"plain":"json"}`)}
+	source, err := NewDecompressingSource(testshared.ChannelSource{Messages: broker}, SourceConfig{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan substrate.Message)
+	go func() {
+		_ = source.ConsumeMessages(ctx, msgs, make(chan substrate.Message))
+	}()
+	assert.Equal(t, `{"plain":"json"}`, string((<-msgs).Data()))
+}
+
+func TestMaxMessageBytes(t *testing.T) {
+	payload := bytes.Repeat([]byte{'x'}, 1000)
+
+	for _, codec := range []Codec{Gzip, Snappy} {
+		t.Run(fmt.Sprint(codec), func(t *testing.T) {
+			_, _, err := roundTrip(t, SinkConfig{Codec: codec}, SourceConfig{MaxMessageBytes: 999}, payload)
+			assert.Equal(t, ErrMessageTooLarge, err)
+		})
+	}
+}
+
+func TestUnknownCodec(t *testing.T) {
+	_, err := NewCompressingSink(testshared.ChannelSink{}, SinkConfig{Codec: 42})
+	assert.Error(t, err)
+
+	_, _, err = roundTrip(t, SinkConfig{}, SourceConfig{})
+	require.NoError(t, err)
+
+	broker := make(chan substrate.Message, 1)
+	broker <- &testshared.Message{Payload: append(append([]byte{}, envelopeMarker...), 42, 'x')}
+	source, err := NewDecompressingSource(testshared.ChannelSource{Messages: broker}, SourceConfig{})
+	require.NoError(t, err)
+	err = source.ConsumeMessages(context.Background(), make(chan substrate.Message), make(chan substrate.Message))
+	assert.EqualError(t, err, "unknown compression codec 42")
+}
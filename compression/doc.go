@@ -0,0 +1,16 @@
+// Package compression provides substrate sink and source wrappers that
+// compress message payloads.
+//
+// Usage
+//
+// Compressed payloads are wrapped in a small envelope identifying the codec
+// they were compressed with, so a decompressing source can consume payloads
+// compressed with any of the supported codecs. Payloads without the envelope
+// are passed through unchanged, which allows consumers to be upgraded before
+// producers start compressing.
+//
+//      sink, err = compression.NewCompressingSink(sink, compression.SinkConfig{Codec: compression.Zstd})
+//      ...
+//      source, err = compression.NewDecompressingSource(source, compression.SourceConfig{})
+//
+package compression
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var (
+	defaultsMu sync.RWMutex
+	defaults   = make(map[string][]func(interface{}) error)
+)
+
+// RegisterDefaults registers a function applying default options for the url
+// scheme of a backend. The function is called with a pointer to a zero config
+// struct of a source or a sink, and sets the options it provides defaults for.
+// Functions registered for the same scheme are applied in the order they were
+// registered. If apply is nil, it panics.
+func RegisterDefaults(scheme string, apply func(interface{}) error) {
+	defaultsMu.Lock()
+	defer defaultsMu.Unlock()
+	if apply == nil {
+		panic("config: RegisterDefaults apply is nil")
+	}
+	defaults[scheme] = append(defaults[scheme], apply)
+}
+
+// Apply sets the options of the config struct pointed to by conf that are not
+// set, that is are zero, to the defaults registered for scheme. Options that
+// are set are left as they are.
+func Apply(scheme string, conf interface{}) error {
+	defaultsMu.RLock()
+	applies := defaults[scheme]
+	defaultsMu.RUnlock()
+	if len(applies) == 0 {
+		return nil
+	}
+
+	v := reflect.ValueOf(conf)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config: expected a pointer to a struct, got %T", conf)
+	}
+	explicit := v.Elem()
+
+	merged := reflect.New(explicit.Type())
+	for _, apply := range applies {
+		if err := apply(merged.Interface()); err != nil {
+			return fmt.Errorf("config: failed to apply the defaults for %s: %w", scheme, err)
+		}
+	}
+	for i := 0; i < explicit.NumField(); i++ {
+		if f := explicit.Field(i); f.IsZero() && f.CanSet() {
+			f.Set(merged.Elem().Field(i))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testConfig struct {
+	Topic    string
+	ClientID string
+	Timeout  time.Duration
+	Brokers  []string
+	Debug    bool
+}
+
+func TestApply(t *testing.T) {
+	RegisterDefaults("test-apply", func(c interface{}) error {
+		conf := c.(*testConfig)
+		conf.ClientID = "default-client"
+		conf.Timeout = time.Second
+		conf.Brokers = []string{"default:9092"}
+		return nil
+	})
+	RegisterDefaults("test-apply", func(c interface{}) error {
+		c.(*testConfig).Timeout = 2 * time.Second
+		return nil
+	})
+
+	conf := testConfig{
+		Topic:   "t1",
+		Brokers: []string{"localhost:9092"},
+		Debug:   true,
+	}
+	require.NoError(t, Apply("test-apply", &conf))
+	assert.Equal(t, testConfig{
+		Topic:    "t1",
+		ClientID: "default-client",
+		Timeout:  2 * time.Second,
+		Brokers:  []string{"localhost:9092"},
+		Debug:    true,
+	}, conf)
+}
+
+func TestApplyWithoutDefaults(t *testing.T) {
+	conf := testConfig{Topic: "t1"}
+	require.NoError(t, Apply("test-unregistered", &conf))
+	assert.Equal(t, testConfig{Topic: "t1"}, conf)
+}
+
+func TestApplyErrors(t *testing.T) {
+	errDefaults := errors.New("no defaults")
+	RegisterDefaults("test-errors", func(interface{}) error {
+		return errDefaults
+	})
+
+	conf := testConfig{Topic: "t1"}
+	err := Apply("test-errors", &conf)
+	assert.True(t, errors.Is(err, errDefaults))
+	assert.Equal(t, testConfig{Topic: "t1"}, conf)
+
+	assert.Error(t, Apply("test-errors", conf))
+}
+
+func TestRegisterNilDefaults(t *testing.T) {
+	assert.Panics(t, func() {
+		RegisterDefaults("test-nil", nil)
+	})
+}
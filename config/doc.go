@@ -0,0 +1,52 @@
+// Package config provides a registry of default options for the backends of
+// substrate, so that a platform library can set organisation wide defaults,
+// such as timeouts and client ids, in one place.
+//
+// Usage
+//
+// Defaults are registered for a url scheme, with a function that is called
+// with a pointer to the config struct of a source or a sink of the backend:
+//
+//      config.RegisterDefaults("kafka", func(c interface{}) error {
+//          switch c := c.(type) {
+//          case *kafka.AsyncMessageSinkConfig:
+//              c.Version = "2.4.0"
+//          case *kafka.AsyncMessageSourceConfig:
+//              c.Version = "2.4.0"
+//              c.MetadataRefreshFrequency = time.Minute
+//          }
+//          return nil
+//      })
+//
+// The registered defaults are always applied to the sources and sinks
+// obtained from the suburl package. The constructors of the backends apply them
+// only when UseRegisteredDefaults is set on their config, so that existing
+// callers are unaffected.
+//
+// Precedence
+//
+// An option is taken from the first of the following that sets it:
+//
+//      1. the config passed to a constructor
+//      2. the url parameters, when using suburl
+//      3. the registered defaults
+//
+// An option is set when its value is not the zero value of its type, so a
+// default can't be overridden with a zero value, such as false.
+//
+// Namespaces
+//
+// Backends supporting it, such as kafka and proximo, prepend the Namespace
+// option of their configs to the topic, so that teams sharing a cluster can't
+// forget the prefix of their topics. A platform library can enforce it with
+// WithNamespace, or set it for every source and sink with a registered
+// default:
+//
+//      conf := kafka.AsyncMessageSinkConfig{Topic: "invoices"}
+//      if err := config.WithNamespace(&conf, "billing."); err != nil {
+//          ...
+//      }
+//
+// The topic is then billing.invoices, as reported by Status.
+//
+package config
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Namespaced returns topic prefixed with namespace. The namespace is prepended
+// as it is, so it includes any separator, such as "billing.". An empty topic
+// is returned as it is, so that it is still reported as missing.
+func Namespaced(namespace, topic string) string {
+	if topic == "" {
+		return topic
+	}
+	return namespace + topic
+}
+
+// WithNamespace sets the Namespace option of the config struct pointed to by
+// conf, such as a kafka or proximo source or sink config, so that a platform
+// library can enforce the namespace of the topics of a service. It returns an
+// error if conf has no Namespace option, or if it is already set to another
+// namespace.
+func WithNamespace(conf interface{}, namespace string) error {
+	v := reflect.ValueOf(conf)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config: expected a pointer to a struct, got %T", conf)
+	}
+	f := v.Elem().FieldByName("Namespace")
+	if !f.IsValid() || f.Kind() != reflect.String || !f.CanSet() {
+		return fmt.Errorf("config: %T has no namespace option", conf)
+	}
+	if current := f.String(); current != "" && current != namespace {
+		return fmt.Errorf("config: namespace is already set to %q, not %q", current, namespace)
+	}
+	f.SetString(namespace)
+	return nil
+}
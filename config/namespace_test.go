@@ -0,0 +1,33 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type namespacedConfig struct {
+	Topic     string
+	Namespace string
+}
+
+func TestNamespaced(t *testing.T) {
+	assert.Equal(t, "billing.invoices", Namespaced("billing.", "invoices"))
+	assert.Equal(t, "invoices", Namespaced("", "invoices"))
+	assert.Equal(t, "", Namespaced("billing.", ""))
+}
+
+func TestWithNamespace(t *testing.T) {
+	conf := namespacedConfig{Topic: "invoices"}
+	require.NoError(t, WithNamespace(&conf, "billing."))
+	assert.Equal(t, namespacedConfig{Topic: "invoices", Namespace: "billing."}, conf)
+
+	// Setting the same namespace again is allowed, another one isn't.
+	require.NoError(t, WithNamespace(&conf, "billing."))
+	assert.EqualError(t, WithNamespace(&conf, "shipping."), `config: namespace is already set to "billing.", not "shipping."`)
+	assert.Equal(t, "billing.", conf.Namespace)
+
+	assert.EqualError(t, WithNamespace(&testConfig{}, "billing."), "config: *config.testConfig has no namespace option")
+	assert.Error(t, WithNamespace(conf, "billing."))
+}
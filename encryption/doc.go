@@ -0,0 +1,22 @@
+// Package encryption provides substrate sink and source wrappers that encrypt
+// message payloads end to end, so that they can not be read by the broker or
+// its operators.
+//
+// Usage
+//
+// Payloads are encrypted with AES-GCM. Each encrypted payload carries the id
+// of the key it was encrypted with, so keys can be rotated by changing the
+// current key of the KeyProvider used by sinks, while sources keep being able
+// to decrypt payloads encrypted with previous keys.
+//
+//      keys := encryption.StaticKeyProvider{
+//          CurrentID: "2020-06",
+//          Keys: map[string][]byte{
+//              "2020-01": oldKey,
+//              "2020-06": newKey,
+//          },
+//      }
+//      sink = encryption.NewEncryptingSink(sink, keys)
+//      source = encryption.NewDecryptingSource(source, keys)
+//
+package encryption
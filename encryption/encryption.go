@@ -0,0 +1,154 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/transform"
+)
+
+// The envelope of an encrypted payload is the marker, a version byte, the
+// length of the key id, the key id, the nonce and the sealed payload. The
+// marker, version and key id are authenticated as additional data.
+var envelopeMarker = []byte{0, 'S', 'B', 'E'}
+
+const envelopeVersion = 1
+
+var (
+	// ErrNotEncrypted is returned by a decrypting source for a payload that
+	// is not encrypted.
+	ErrNotEncrypted = errors.New("payload is not encrypted")
+	// ErrInvalidEnvelope is returned for an encrypted payload that can not be
+	// parsed.
+	ErrInvalidEnvelope = errors.New("invalid encrypted payload envelope")
+)
+
+// KeyProvider provides the AES keys used to encrypt and decrypt payloads.
+// Keys must be 16, 24 or 32 bytes long, to select AES-128, AES-192 or AES-256.
+type KeyProvider interface {
+	// CurrentKey returns the id of the key used to encrypt new payloads,
+	// along with the key itself.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given id, used to decrypt payloads.
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeyProvider is a KeyProvider for a fixed set of keys.
+type StaticKeyProvider struct {
+	// CurrentID is the id of the key used for encryption.
+	CurrentID string
+	// Keys holds the keys by id. Keys that have been rotated out should be
+	// kept for as long as payloads encrypted with them may be consumed.
+	Keys map[string][]byte
+}
+
+// CurrentKey implements KeyProvider.
+func (p StaticKeyProvider) CurrentKey() (string, []byte, error) {
+	key, err := p.Key(p.CurrentID)
+	return p.CurrentID, key, err
+}
+
+// Key implements KeyProvider.
+func (p StaticKeyProvider) Key(id string) ([]byte, error) {
+	key, ok := p.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key id '%s'", id)
+	}
+	return key, nil
+}
+
+// NewEncryptingSink returns a sink that encrypts the payload of every message
+// with AES-GCM, using the current key of keys, before publishing it to sink.
+// Acknowledged messages are the ones sent to the returned sink.
+func NewEncryptingSink(sink substrate.AsyncMessageSink, keys KeyProvider) substrate.AsyncMessageSink {
+	return transform.NewSink(sink, func(data []byte) ([]byte, error) {
+		return encrypt(keys, data)
+	})
+}
+
+// NewDecryptingSource returns a source that decrypts the payload of every
+// message consumed from source with the key it was encrypted with. Consuming
+// terminates if a payload is not encrypted or can not be decrypted. The
+// delivered messages can be unwrapped to the messages of source, and are
+// discardable.
+func NewDecryptingSource(source substrate.AsyncMessageSource, keys KeyProvider) substrate.AsyncMessageSource {
+	return transform.NewSource(source, func(data []byte) ([]byte, error) {
+		return decrypt(keys, data)
+	})
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encrypt(keys KeyProvider, plaintext []byte) ([]byte, error) {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(id) > 255 {
+		return nil, fmt.Errorf("encryption key id '%s' is too long", id)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(envelopeMarker)+2+len(id))
+	header = append(header, envelopeMarker...)
+	header = append(header, envelopeVersion, byte(len(id)))
+	header = append(header, id...)
+
+	out := make([]byte, len(header)+aead.NonceSize(), len(header)+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	copy(out, header)
+	nonce := out[len(header):]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, plaintext, header), nil
+}
+
+func decrypt(keys KeyProvider, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, envelopeMarker) {
+		return nil, ErrNotEncrypted
+	}
+	pos := len(envelopeMarker)
+	if len(data) < pos+2 || data[pos] != envelopeVersion {
+		return nil, ErrInvalidEnvelope
+	}
+	idLen := int(data[pos+1])
+	pos += 2
+	if len(data) < pos+idLen {
+		return nil, ErrInvalidEnvelope
+	}
+	header, id := data[:pos+idLen], string(data[pos:pos+idLen])
+
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	rest := data[len(header):]
+	if len(rest) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidEnvelope
+	}
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt payload with key id '%s': %w", id, err)
+	}
+	return plaintext, nil
+}
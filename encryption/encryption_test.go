@@ -0,0 +1,123 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/testshared"
+)
+
+var (
+	key1 = bytes.Repeat([]byte{1}, 32)
+	key2 = bytes.Repeat([]byte{2}, 16)
+)
+
+func TestRoundTrip(t *testing.T) {
+	keys := StaticKeyProvider{CurrentID: "k1", Keys: map[string][]byte{"k1": key1}}
+	broker := make(chan substrate.Message, 10)
+	sink := NewEncryptingSink(testshared.ChannelSink{Messages: broker}, keys)
+	source := NewDecryptingSource(testshared.ChannelSource{Messages: broker}, keys)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	toSink := make(chan substrate.Message)
+	sinkAcks := make(chan substrate.Message)
+	fromSource := make(chan substrate.Message)
+	sourceAcks := make(chan substrate.Message)
+	errs := make(chan error, 2)
+	go func() {
+		errs <- sink.PublishMessages(ctx, sinkAcks, toSink)
+	}()
+
+	for _, payload := range []string{"secret", ""} {
+		m := &testshared.Message{Payload: []byte(payload)}
+		toSink <- m
+		assert.Equal(t, m, <-sinkAcks)
+	}
+	// The broker only sees ciphertext.
+	encrypted := <-broker
+	assert.False(t, bytes.Contains(encrypted.Data(), []byte("secret")))
+	broker <- encrypted
+
+	go func() {
+		errs <- source.ConsumeMessages(ctx, fromSource, sourceAcks)
+	}()
+	for _, expected := range []string{"", "secret"} {
+		m := <-fromSource
+		assert.Equal(t, expected, string(m.Data()))
+		sourceAcks <- m
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+func TestKeyRotation(t *testing.T) {
+	old := StaticKeyProvider{CurrentID: "k1", Keys: map[string][]byte{"k1": key1}}
+	rotated := StaticKeyProvider{CurrentID: "k2", Keys: map[string][]byte{"k1": key1, "k2": key2}}
+
+	before, err := encrypt(old, []byte("before"))
+	require.NoError(t, err)
+	after, err := encrypt(rotated, []byte("after"))
+	require.NoError(t, err)
+
+	plaintext, err := decrypt(rotated, before)
+	require.NoError(t, err)
+	assert.Equal(t, "before", string(plaintext))
+	plaintext, err = decrypt(rotated, after)
+	require.NoError(t, err)
+	assert.Equal(t, "after", string(plaintext))
+
+	_, err = decrypt(old, after)
+	assert.EqualError(t, err, "unknown encryption key id 'k2'")
+}
+
+func TestWrongKey(t *testing.T) {
+	encrypted, err := encrypt(StaticKeyProvider{CurrentID: "k", Keys: map[string][]byte{"k": key1}}, []byte("secret"))
+	require.NoError(t, err)
+
+	_, err = decrypt(StaticKeyProvider{Keys: map[string][]byte{"k": bytes.Repeat([]byte{9}, 32)}}, encrypted)
+	assert.Error(t, err)
+}
+
+func TestTamperedPayload(t *testing.T) {
+	keys := StaticKeyProvider{CurrentID: "k1", Keys: map[string][]byte{"k1": key1, "k2": key1}}
+	encrypted, err := encrypt(keys, []byte("secret"))
+	require.NoError(t, err)
+
+	tampered := append([]byte{}, encrypted...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = decrypt(keys, tampered)
+	assert.Error(t, err)
+
+	// The key id is authenticated, even when both ids map to the same key.
+	swapped := append([]byte{}, encrypted...)
+	swapped[len(envelopeMarker)+3] = '2'
+	_, err = decrypt(keys, swapped)
+	assert.Error(t, err)
+
+	_, err = decrypt(keys, encrypted[:len(envelopeMarker)+4])
+	assert.Equal(t, ErrInvalidEnvelope, err)
+}
+
+func TestNotEncrypted(t *testing.T) {
+	keys := StaticKeyProvider{CurrentID: "k1", Keys: map[string][]byte{"k1": key1}}
+	_, err := decrypt(keys, []byte("plaintext"))
+	assert.Equal(t, ErrNotEncrypted, err)
+}
+
+func TestInvalidKeySize(t *testing.T) {
+	_, err := encrypt(StaticKeyProvider{CurrentID: "k", Keys: map[string][]byte{"k": []byte("short")}}, []byte("secret"))
+	var sizeErr aes.KeySizeError
+	assert.True(t, errors.As(err, &sizeErr))
+}
@@ -0,0 +1,19 @@
+// Package envelope provides substrate sink and source wrappers that carry
+// message attributes inside the payload, for backends that can't carry them
+// natively.
+//
+// Usage
+//
+// Sinks wrap the attributes and payload of every message in an envelope, and
+// sources unwrap them, delivering messages that implement
+// substrate.AttributedMessage. Sources deliver payloads that are not in an
+// envelope unchanged, so that consumers can be migrated before producers.
+//
+//      sink = envelope.NewEnvelopeSink(sink)
+//      source = envelope.NewEnvelopeSource(source)
+//
+// The envelope is a marker, a version byte, the number of attributes, the
+// length prefixed key and value of every attribute, and the payload. Numbers
+// are encoded as unsigned varints.
+//
+package envelope
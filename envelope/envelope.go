@@ -0,0 +1,124 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/transform"
+	"github.com/uw-labs/substrate/internal/unwrap"
+)
+
+var envelopeMarker = []byte{0, 'S', 'B', 'A'}
+
+const envelopeVersion = 1
+
+var (
+	// ErrInvalidEnvelope is returned by an envelope source for a payload
+	// that starts like an envelope but can not be parsed.
+	ErrInvalidEnvelope = errors.New("invalid attributes envelope")
+
+	errNotEnvelope = errors.New("payload is not an envelope")
+)
+
+// NewEnvelopeSink returns a sink that wraps the attributes and payload of
+// every message in an envelope before publishing it to sink. The published
+// messages have no attributes of their own. Acknowledged messages are the
+// ones sent to the returned sink.
+func NewEnvelopeSink(sink substrate.AsyncMessageSink) substrate.AsyncMessageSink {
+	return transform.NewMessageSink(sink, func(msg substrate.Message) ([]byte, map[string]string, error) {
+		return encode(unwrap.Attributes(msg), msg.Data()), map[string]string{}, nil
+	})
+}
+
+// NewEnvelopeSource returns a source that unwraps the envelope of every
+// message consumed from source, delivering messages with the attributes and
+// payload of the envelope. Messages that are not in an envelope are delivered
+// unchanged. Consuming terminates if an envelope can not be parsed. The
+// delivered messages can be unwrapped to the messages of source, and are
+// discardable.
+func NewEnvelopeSource(source substrate.AsyncMessageSource) substrate.AsyncMessageSource {
+	return transform.NewMessageSource(source, func(msg substrate.Message) ([]byte, map[string]string, error) {
+		attrs, data, err := decode(msg.Data())
+		if err == errNotEnvelope {
+			return msg.Data(), nil, nil
+		}
+		return data, attrs, err
+	})
+}
+
+// encode returns the envelope of the attributes and payload. Attributes are
+// encoded in key order, so that equal messages have equal envelopes.
+func encode(attrs map[string]string, data []byte) []byte {
+	keys := make([]string, 0, len(attrs))
+	size := len(envelopeMarker) + 1 + binary.MaxVarintLen64 + len(data)
+	for k, v := range attrs {
+		keys = append(keys, k)
+		size += 2*binary.MaxVarintLen64 + len(k) + len(v)
+	}
+	sort.Strings(keys)
+
+	out := make([]byte, 0, size)
+	out = append(out, envelopeMarker...)
+	out = append(out, envelopeVersion)
+	out = appendUvarint(out, uint64(len(keys)))
+	for _, k := range keys {
+		out = appendUvarint(out, uint64(len(k)))
+		out = append(out, k...)
+		out = appendUvarint(out, uint64(len(attrs[k])))
+		out = append(out, attrs[k]...)
+	}
+	return append(out, data...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// decode parses an envelope, returning its attributes and payload, which
+// shares its memory with data.
+func decode(data []byte) (map[string]string, []byte, error) {
+	if !bytes.HasPrefix(data, envelopeMarker) {
+		return nil, nil, errNotEnvelope
+	}
+	rest := data[len(envelopeMarker):]
+	if len(rest) == 0 || rest[0] != envelopeVersion {
+		return nil, nil, ErrInvalidEnvelope
+	}
+	rest = rest[1:]
+
+	count, n := binary.Uvarint(rest)
+	// Every attribute takes at least two bytes, which bounds the count
+	// before anything is allocated for it.
+	if n <= 0 || count > uint64(len(rest)-n)/2 {
+		return nil, nil, ErrInvalidEnvelope
+	}
+	rest = rest[n:]
+
+	attrs := make(map[string]string, count)
+	for i := uint64(0); i < count; i++ {
+		var k, v []byte
+		var ok bool
+		if k, rest, ok = readBytes(rest); !ok {
+			return nil, nil, ErrInvalidEnvelope
+		}
+		if v, rest, ok = readBytes(rest); !ok {
+			return nil, nil, ErrInvalidEnvelope
+		}
+		attrs[string(k)] = string(v)
+	}
+	return attrs, rest, nil
+}
+
+// readBytes reads a length prefixed byte string.
+func readBytes(b []byte) (value []byte, rest []byte, ok bool) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || l > uint64(len(b)-n) {
+		return nil, nil, false
+	}
+	end := n + int(l)
+	return b[n:end], b[end:], true
+}
@@ -0,0 +1,36 @@
+//go:build go1.18
+// +build go1.18
+
+package envelope
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzDecode(f *testing.F) {
+	f.Add([]byte("plain"))
+	f.Add(encode(nil, []byte("data")))
+	f.Add(encode(map[string]string{"key": "value", "other": ""}, []byte("data")))
+	f.Add(append(append([]byte{}, envelopeMarker...), envelopeVersion, 0xff, 0xff, 0xff, 0xff, 0x0f))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		attrs, payload, err := decode(data)
+		if err != nil {
+			return
+		}
+		// Valid envelopes survive a round trip.
+		attrs2, payload2, err := decode(encode(attrs, payload))
+		if err != nil {
+			t.Fatalf("failed to decode re-encoded envelope: %v", err)
+		}
+		if !bytes.Equal(payload, payload2) || len(attrs) != len(attrs2) {
+			t.Fatalf("round trip mismatch: %v %q != %v %q", attrs, payload, attrs2, payload2)
+		}
+		for k, v := range attrs {
+			if attrs2[k] != v {
+				t.Fatalf("round trip mismatch for attribute %q: %q != %q", k, v, attrs2[k])
+			}
+		}
+	})
+}
@@ -0,0 +1,92 @@
+package envelope
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/testshared"
+	"github.com/uw-labs/substrate/internal/unwrap"
+)
+
+func TestRoundTrip(t *testing.T) {
+	broker := make(chan substrate.Message, 10)
+	sink := NewEnvelopeSink(testshared.ChannelSink{Messages: broker})
+	source := NewEnvelopeSource(testshared.ChannelSource{Messages: broker})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	toSink := make(chan substrate.Message)
+	sinkAcks := make(chan substrate.Message)
+	fromSource := make(chan substrate.Message)
+	sourceAcks := make(chan substrate.Message)
+	errs := make(chan error, 2)
+	go func() {
+		errs <- sink.PublishMessages(ctx, sinkAcks, toSink)
+	}()
+
+	sent := []substrate.Message{
+		testshared.NewMessage("payload", map[string]string{"trace-id": "abc", "empty": ""}),
+		testshared.NewMessage("", nil),
+	}
+	for _, m := range sent {
+		toSink <- m
+		assert.Equal(t, m, <-sinkAcks)
+	}
+	// A payload that was published without an envelope is passed through.
+	broker <- testshared.NewMessage("legacy", nil)
+
+	go func() {
+		errs <- source.ConsumeMessages(ctx, fromSource, sourceAcks)
+	}()
+	for _, expected := range []struct {
+		data  string
+		attrs map[string]string
+	}{
+		{data: "payload", attrs: map[string]string{"trace-id": "abc", "empty": ""}},
+		{data: "", attrs: map[string]string{}},
+		{data: "legacy"},
+	} {
+		m := <-fromSource
+		assert.Equal(t, expected.data, string(m.Data()))
+		assert.Equal(t, expected.attrs, unwrap.Attributes(m))
+		sourceAcks <- m
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+func TestEncodeIsDeterministic(t *testing.T) {
+	attrs := map[string]string{"a": "1", "b": "2", "c": "3"}
+	assert.Equal(t, encode(attrs, []byte("data")), encode(attrs, []byte("data")))
+}
+
+func TestDecodeInvalidEnvelopes(t *testing.T) {
+	valid := encode(map[string]string{"key": "value"}, []byte("data"))
+	attrs, data, err := decode(valid)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"key": "value"}, attrs)
+	assert.Equal(t, "data", string(data))
+
+	_, _, err = decode([]byte("plain"))
+	assert.Equal(t, errNotEnvelope, err)
+
+	for _, invalid := range [][]byte{
+		envelopeMarker,
+		append(append([]byte{}, envelopeMarker...), 2, 0),
+		// The attribute count exceeds the remaining bytes.
+		append(append([]byte{}, envelopeMarker...), envelopeVersion, 0xff, 0xff, 0xff, 0xff, 0x0f),
+		// Truncated in the middle of the value.
+		valid[:len(envelopeMarker)+8],
+	} {
+		_, _, err := decode(invalid)
+		assert.Equal(t, ErrInvalidEnvelope, err)
+	}
+}
@@ -0,0 +1,43 @@
+package substrate
+
+import "time"
+
+// NewExpiringSource returns a source that drops the messages consumed from
+// source that are older than ttl, for messages that are only useful for a
+// short time, so that a backlog isn't processed in vain. The time a message
+// was produced is returned by timestampFunc, or, if it is nil, by the
+// Timestamp method of messages implementing TimestampedMessage, such as the
+// messages of kafka sources. Messages without a timestamp are delivered.
+// Expired messages are not delivered, and are passed to onExpired instead, if
+// it is set, e.g. to count them. They are acknowledged to source once the
+// messages before them are, as acknowledgements are in order.
+// When Close is called on the returned source, this is also propagated to
+// source.
+func NewExpiringSource(source AsyncMessageSource, ttl time.Duration, timestampFunc func(Message) (time.Time, bool), onExpired func(Message)) AsyncMessageSource {
+	if timestampFunc == nil {
+		timestampFunc = messageTimestamp
+	}
+	return &validatingSource{
+		source: source,
+		check: func(msg Message) (bool, error) {
+			ts, ok := timestampFunc(msg)
+			if !ok || time.Since(ts) <= ttl {
+				return false, nil
+			}
+			if onExpired != nil {
+				onExpired(msg)
+			}
+			return true, nil
+		},
+	}
+}
+
+// messageTimestamp returns the timestamp of messages implementing
+// TimestampedMessage, if it is known.
+func messageTimestamp(msg Message) (time.Time, bool) {
+	tm, ok := msg.(TimestampedMessage)
+	if !ok || tm.Timestamp().IsZero() {
+		return time.Time{}, false
+	}
+	return tm.Timestamp(), true
+}
@@ -0,0 +1,113 @@
+package substrate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type timestampedTestMessage struct {
+	data      string
+	timestamp time.Time
+}
+
+func (m *timestampedTestMessage) Data() []byte {
+	return []byte(m.data)
+}
+
+func (m *timestampedTestMessage) Timestamp() time.Time {
+	return m.timestamp
+}
+
+func TestExpiringSourceDropsExpiredMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &mockAsyncSource{
+		toSend: make(chan Message, 4),
+		acked:  make(chan Message, 4),
+		closed: make(chan struct{}),
+	}
+	var expired []Message
+	source := NewExpiringSource(inner, time.Minute, nil, func(msg Message) {
+		expired = append(expired, msg)
+	})
+
+	old := &timestampedTestMessage{data: "old", timestamp: time.Now().Add(-time.Hour)}
+	fresh := &timestampedTestMessage{data: "fresh", timestamp: time.Now()}
+	unknown := &timestampedTestMessage{data: "unknown"}
+	untimed := message("untimed")
+	for _, m := range []Message{old, fresh, unknown, &untimed} {
+		inner.toSend <- m
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	// Messages without a timestamp are delivered.
+	for _, expected := range []Message{fresh, unknown, &untimed} {
+		m := <-msgs
+		assert.Equal(expected, m)
+		acks <- m
+	}
+	// All messages, including the expired one, are acknowledged in order.
+	for _, expected := range []Message{old, fresh, unknown, &untimed} {
+		assert.Equal(expected, <-inner.acked)
+	}
+	assert.Equal([]Message{old}, expired)
+
+	cancel()
+	assert.Equal(context.Canceled, <-errs)
+
+	assert.NoError(source.Close())
+	select {
+	case <-inner.closed:
+	default:
+		t.Error("underlying async source didn't get closed")
+	}
+}
+
+func TestExpiringSourceWithTimestampFunc(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &mockAsyncSource{
+		toSend: make(chan Message, 2),
+		acked:  make(chan Message, 2),
+		closed: make(chan struct{}),
+	}
+	timestamps := map[string]time.Time{
+		"old":   time.Now().Add(-time.Hour),
+		"fresh": time.Now(),
+	}
+	source := NewExpiringSource(inner, time.Minute, func(msg Message) (time.Time, bool) {
+		ts, ok := timestamps[string(msg.Data())]
+		return ts, ok
+	}, nil)
+
+	old, fresh := message("old"), message("fresh")
+	inner.toSend <- &old
+	inner.toSend <- &fresh
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	go func() {
+		_ = source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	m := <-msgs
+	assert.Equal(&fresh, m)
+	acks <- m
+	assert.Equal(&old, <-inner.acked)
+	assert.Equal(&fresh, <-inner.acked)
+}
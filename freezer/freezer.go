@@ -22,6 +22,9 @@ type AsyncMessageSinkConfig struct {
 }
 
 func NewAsyncMessageSink(config AsyncMessageSinkConfig) (substrate.AsyncMessageSink, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
 	if config.MaxUnflushedMessages == 0 {
 		config.MaxUnflushedMessages = 1024
 	}
@@ -46,7 +49,7 @@ func (ams *asyncMessageSink) PublishMessages(ctx context.Context, acks chan<- su
 	for {
 		select {
 		case <-ctx.Done():
-			return nil
+			return ctx.Err()
 		case m := <-messages:
 			if !t.Stop() {
 				select {
@@ -66,7 +69,7 @@ func (ams *asyncMessageSink) PublishMessages(ctx context.Context, acks chan<- su
 			for _, m := range toAck {
 				select {
 				case <-ctx.Done():
-					return nil
+					return ctx.Err()
 				case acks <- m:
 				}
 			}
@@ -106,6 +109,9 @@ type AsyncMessageSourceConfig struct {
 }
 
 func NewAsyncMessageSource(c AsyncMessageSourceConfig) (substrate.AsyncMessageSource, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
 	fms := freezer.NewMessageSource(c.StreamStore, c.FreezerConfig)
 	ams := &asyncMessageSource{fms}
 	return ams, nil
@@ -144,7 +150,7 @@ func (ams *asyncMessageSource) ConsumeMessages(ctx context.Context, messages cha
 						Acked:    ack,
 						Expected: nil,
 					}
-				case ack != forAcking[0]:
+				case !substrate.SameMessage(ack, forAcking[0]):
 					return substrate.InvalidAckError{
 						Acked:    ack,
 						Expected: forAcking[0],
@@ -177,11 +183,7 @@ func (ams *asyncMessageSource) ConsumeMessages(ctx context.Context, messages cha
 		return ams.fms.ConsumeMessages(ctx, handler)
 	})
 
-	err := eg.Wait()
-	if err == context.Canceled || err == context.DeadlineExceeded {
-		err = nil
-	}
-	return err
+	return eg.Wait()
 }
 
 func (ams *asyncMessageSource) Status() (*substrate.Status, error) {
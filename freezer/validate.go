@@ -0,0 +1,22 @@
+package freezer
+
+import "github.com/uw-labs/substrate/internal/validate"
+
+// Validate returns an error listing the problems of the config, if any, such
+// as "freezer: AsyncMessageSinkConfig.StreamStore must be set". It is called
+// by NewAsyncMessageSink.
+func (c AsyncMessageSinkConfig) Validate() error {
+	p := validate.New("freezer", "AsyncMessageSinkConfig")
+	p.Check(c.StreamStore != nil, "StreamStore", "must be set")
+	p.NotNegative(c.MaxUnflushedMessages, "MaxUnflushedMessages")
+	return p.Err()
+}
+
+// Validate returns an error listing the problems of the config, if any, such
+// as "freezer: AsyncMessageSourceConfig.StreamStore must be set". It is
+// called by NewAsyncMessageSource.
+func (c AsyncMessageSourceConfig) Validate() error {
+	p := validate.New("freezer", "AsyncMessageSourceConfig")
+	p.Check(c.StreamStore != nil, "StreamStore", "must be set")
+	return p.Err()
+}
@@ -0,0 +1,17 @@
+package freezer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigValidate(t *testing.T) {
+	_, err := NewAsyncMessageSink(AsyncMessageSinkConfig{MaxUnflushedMessages: -1})
+	assert.EqualError(t, err, "2 problems: "+
+		"freezer: AsyncMessageSinkConfig.StreamStore must be set; "+
+		"freezer: AsyncMessageSinkConfig.MaxUnflushedMessages must not be negative")
+
+	_, err = NewAsyncMessageSource(AsyncMessageSourceConfig{})
+	assert.EqualError(t, err, "freezer: AsyncMessageSourceConfig.StreamStore must be set")
+}
@@ -6,20 +6,27 @@ require (
 	github.com/Shopify/sarama v1.29.0
 	github.com/Shopify/toxiproxy v2.1.4+incompatible
 	github.com/gofrs/uuid v3.2.0+incompatible
+	github.com/golang/protobuf v1.3.2
+	github.com/golang/snappy v0.0.3
 	github.com/google/uuid v1.1.1
 	github.com/hashicorp/go-multierror v1.0.0
+	github.com/klauspost/compress v1.12.2
+	github.com/lib/pq v1.2.0
 	github.com/nats-io/nats-streaming-server v0.16.2
 	github.com/nats-io/nats.go v1.9.0
 	github.com/nats-io/stan.go v0.5.0
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/client_golang v1.2.1
 	github.com/prometheus/client_model v0.0.0-20190812154241-14fe0d1b01d4
+	github.com/rcrowley/go-metrics v0.0.0-20201227073835-cf1acfcdf475
 	github.com/sirupsen/logrus v1.4.2
 	github.com/stretchr/testify v1.7.0
 	github.com/uw-labs/freezer v0.0.0-20200403100623-d1c19e689e07
 	github.com/uw-labs/proximo v0.0.0-20190913093050-8229af78f5dd
 	github.com/uw-labs/straw v0.0.0-20200213162553-01e9a0f94f69
 	github.com/uw-labs/sync v0.0.0-20190307114256-1bb306bf6e71
+	go.etcd.io/bbolt v1.3.3
+	golang.org/x/net v0.0.0-20210427231257-85d9c07bbe3a
 	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
 	google.golang.org/grpc v1.27.0
 )
@@ -0,0 +1,21 @@
+// Package httpsink provides a substrate sink that delivers messages as HTTP
+// POST requests, for example to webhook endpoints.
+//
+// Each message is sent as the body of a single request, with its attributes
+// as request headers, and is acknowledged once a 2xx response is received.  Transport errors, 5xx and 429 responses
+// are retried with exponential backoff, honouring any Retry-After header, and
+// other responses reject the message via the OnMessageError handler.
+//
+// Usage
+//
+// This package support two methods of use.  The first is to directly use this package. See the function documentation for more details.
+//
+// The second method is to use the suburl package. See https://godoc.org/github.com/uw-labs/substrate/suburl for more information.
+//
+// Using suburl
+//
+// The url structure is http://host:port/path or https://host:port/path
+//
+// The url is used unchanged as the request url, including any url parameters.
+//
+package httpsink
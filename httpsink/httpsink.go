@@ -0,0 +1,273 @@
+package httpsink
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/helper"
+	"github.com/uw-labs/substrate/internal/unwrap"
+)
+
+var _ substrate.AsyncMessageSink = (*asyncMessageSink)(nil)
+
+const (
+	defaultContentType     = "application/octet-stream"
+	defaultTimeout         = 30 * time.Second
+	defaultMaxConcurrency  = 8
+	defaultMaxRetries      = 5
+	defaultRetryBackoff    = 100 * time.Millisecond
+	defaultMaxRetryBackoff = 30 * time.Second
+	defaultSignatureHeader = "X-Signature"
+)
+
+// AsyncMessageSinkConfig is the configuration parameters for an
+// AsyncMessageSink.
+type AsyncMessageSinkConfig struct {
+	// URL is the endpoint that messages are POSTed to.
+	URL string
+	// ContentType is the content type of the request body.
+	// Defaults to application/octet-stream.
+	ContentType string
+	// Header contains additional headers sent with every request. The
+	// attributes of a message are sent as headers of the same name, taking
+	// precedence over these.
+	Header http.Header
+	// Client is the HTTP client used to send requests. Defaults to
+	// http.DefaultClient.
+	Client *http.Client
+	// Timeout is the timeout for a single request. Defaults to 30s.
+	Timeout time.Duration
+	// MaxConcurrency is the maximum number of requests in flight.
+	// Defaults to 8.
+	MaxConcurrency int
+	// MaxRetries is the maximum number of times a request is retried after
+	// a transport error, a 5xx or a 429 response. Defaults to 5, and a
+	// negative value disables retries.
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, doubling for each
+	// subsequent retry. A Retry-After response header takes precedence.
+	// Defaults to 100ms.
+	RetryBackoff time.Duration
+	// MaxRetryBackoff caps the exponential retry backoff. Defaults to 30s.
+	MaxRetryBackoff time.Duration
+	// SigningKey, when set, is used to compute a hex encoded HMAC-SHA256 of
+	// the request body, which is sent in the SignatureHeader as
+	// "sha256=<signature>".
+	SigningKey []byte
+	// SignatureHeader is the header carrying the body signature.
+	// Defaults to X-Signature.
+	SignatureHeader string
+	// OnMessageError is called when a message is permanently rejected with
+	// a 4xx response. When it is not set, the rejection terminates
+	// publishing.
+	OnMessageError substrate.MessageErrorHandler
+}
+
+// StatusError is returned when a request fails with an unexpected HTTP
+// status code.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("http sink request failed with status %s", e.Status)
+}
+
+// NewAsyncMessageSink returns a new sink that POSTs every message to the
+// configured URL, acknowledging it once a 2xx response is received.
+func NewAsyncMessageSink(c AsyncMessageSinkConfig) (substrate.AsyncMessageSink, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.ContentType == "" {
+		c.ContentType = defaultContentType
+	}
+	if c.Client == nil {
+		c.Client = http.DefaultClient
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultTimeout
+	}
+	if c.MaxConcurrency <= 0 {
+		c.MaxConcurrency = defaultMaxConcurrency
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = defaultMaxRetries
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = defaultRetryBackoff
+	}
+	if c.MaxRetryBackoff == 0 {
+		c.MaxRetryBackoff = defaultMaxRetryBackoff
+	}
+	if c.SignatureHeader == "" {
+		c.SignatureHeader = defaultSignatureHeader
+	}
+
+	// Concurrent requests complete out of order.
+	return helper.NewAckOrderingSink(&asyncMessageSink{conf: c}), nil
+}
+
+type asyncMessageSink struct {
+	conf AsyncMessageSinkConfig
+}
+
+func (ams *asyncMessageSink) PublishMessages(ctx context.Context, acks chan<- substrate.Message, messages <-chan substrate.Message) error {
+	eg, ctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, ams.conf.MaxConcurrency)
+
+	eg.Go(func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case msg := <-messages:
+				select {
+				case sem <- struct{}{}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				eg.Go(func() error {
+					defer func() { <-sem }()
+
+					if err := ams.publish(ctx, msg); err != nil {
+						return err
+					}
+					select {
+					case acks <- msg:
+						return nil
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				})
+			}
+		}
+	})
+
+	return eg.Wait()
+}
+
+// publish sends the message, retrying transient failures. A nil return means
+// the message can be acknowledged.
+func (ams *asyncMessageSink) publish(ctx context.Context, msg substrate.Message) error {
+	backoff := ams.conf.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retryAfter, retry, err := ams.post(ctx, msg)
+		switch {
+		case err == nil:
+			return nil
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case !retry:
+			if ams.conf.OnMessageError == nil {
+				return err
+			}
+			return ams.conf.OnMessageError(unwrap.Unwrap(msg), err)
+		case attempt >= ams.conf.MaxRetries:
+			return fmt.Errorf("http sink giving up after %d retries: %w", attempt, err)
+		}
+
+		wait := backoff
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > ams.conf.MaxRetryBackoff {
+			backoff = ams.conf.MaxRetryBackoff
+		}
+	}
+}
+
+// post performs a single request, reporting whether a failure is worth
+// retrying and how long the server asked us to wait.
+func (ams *asyncMessageSink) post(ctx context.Context, msg substrate.Message) (time.Duration, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, ams.conf.Timeout)
+	defer cancel()
+
+	body := msg.Data()
+	req, err := http.NewRequest(http.MethodPost, ams.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	req = req.WithContext(ctx)
+	for k, vs := range ams.conf.Header {
+		req.Header[k] = vs
+	}
+	for k, v := range unwrap.Attributes(msg) {
+		// The request would fail the same way on every retry.
+		if !httpguts.ValidHeaderFieldName(k) || !httpguts.ValidHeaderFieldValue(v) {
+			return 0, false, fmt.Errorf("http sink can't send attribute %q as a header", k)
+		}
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", ams.conf.ContentType)
+	if len(ams.conf.SigningKey) > 0 {
+		req.Header.Set(ams.conf.SignatureHeader, "sha256="+sign(ams.conf.SigningKey, body))
+	}
+
+	resp, err := ams.conf.Client.Do(req)
+	if err != nil {
+		return 0, true, err
+	}
+	// Drain (a bounded amount of) the body so the connection can be reused.
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+
+	switch code := resp.StatusCode; {
+	case code >= 200 && code < 300:
+		return 0, false, nil
+	case code == http.StatusTooManyRequests || code >= 500:
+		return retryAfter(resp.Header.Get("Retry-After")), true, StatusError{StatusCode: code, Status: resp.Status}
+	default:
+		return 0, false, StatusError{StatusCode: code, Status: resp.Status}
+	}
+}
+
+func sign(key, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryAfter parses a Retry-After header value, which is either a number of
+// seconds or an HTTP date.
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func (ams *asyncMessageSink) Status() (*substrate.Status, error) {
+	return &substrate.Status{Working: true}, nil
+}
+
+// Close implements the Close method of the substrate.AsyncMessageSink
+// interface.
+func (ams *asyncMessageSink) Close() error {
+	return nil
+}
@@ -0,0 +1,339 @@
+package httpsink
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+)
+
+type message struct {
+	data []byte
+}
+
+func (m *message) Data() []byte {
+	return m.data
+}
+
+type attributedMessage struct {
+	message
+	attributes map[string]string
+}
+
+func (m *attributedMessage) Attributes() map[string]string {
+	return m.attributes
+}
+
+// publish sends the messages through a new sink for the given config and
+// returns the received acks along with the error returned from
+// PublishMessages once all messages were acked, or publishing failed.
+func publish(t *testing.T, conf AsyncMessageSinkConfig, msgs ...substrate.Message) ([]substrate.Message, error) {
+	sink, err := NewAsyncMessageSink(conf)
+	require.NoError(t, err)
+	defer sink.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	toSend := make(chan substrate.Message, len(msgs))
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishMessages(ctx, acks, toSend)
+	}()
+	for _, m := range msgs {
+		toSend <- m
+	}
+
+	var acked []substrate.Message
+	for len(acked) < len(msgs) {
+		select {
+		case ack := <-acks:
+			acked = append(acked, ack)
+		case err := <-errs:
+			return acked, err
+		}
+	}
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		return acked, err
+	}
+	return acked, nil
+}
+
+func TestPublishSuccess(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		bodies []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "value", r.Header.Get("X-Custom"))
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	msgs := []substrate.Message{
+		&message{data: []byte(`{"n":1}`)},
+		&message{data: []byte(`{"n":2}`)},
+		&message{data: []byte(`{"n":3}`)},
+	}
+	acked, err := publish(t, AsyncMessageSinkConfig{
+		URL:         srv.URL,
+		ContentType: "application/json",
+		Header:      http.Header{"X-Custom": []string{"value"}},
+	}, msgs...)
+	require.NoError(t, err)
+	assert.Equal(t, msgs, acked)
+	assert.ElementsMatch(t, []string{`{"n":1}`, `{"n":2}`, `{"n":3}`}, bodies)
+}
+
+func TestPublishRetriesServerErrors(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	msg := &message{data: []byte("retried")}
+	acked, err := publish(t, AsyncMessageSinkConfig{
+		URL:          srv.URL,
+		RetryBackoff: time.Millisecond,
+	}, msg)
+	require.NoError(t, err)
+	assert.Equal(t, []substrate.Message{msg}, acked)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestPublishHonoursRetryAfter(t *testing.T) {
+	var first time.Time
+	var second time.Time
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			first = time.Now()
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		second = time.Now()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	_, err := publish(t, AsyncMessageSinkConfig{
+		URL:          srv.URL,
+		RetryBackoff: time.Millisecond,
+	}, &message{data: []byte("throttled")})
+	require.NoError(t, err)
+	assert.True(t, second.Sub(first) >= time.Second, "retried too early")
+}
+
+func TestPublishGivesUpAfterMaxRetries(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	_, err := publish(t, AsyncMessageSinkConfig{
+		URL:          srv.URL,
+		MaxRetries:   2,
+		RetryBackoff: time.Millisecond,
+	}, &message{data: []byte("failing")})
+	require.Error(t, err)
+
+	var statusErr StatusError
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusInternalServerError, statusErr.StatusCode)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestPublishWithRetriesDisabled(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	_, err := publish(t, AsyncMessageSinkConfig{
+		URL:        srv.URL,
+		MaxRetries: -1,
+	}, &message{data: []byte("failing")})
+	require.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestPublishAttributesAsHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "order-created", r.Header.Get("X-Event-Type"))
+		assert.Equal(t, "attribute", r.Header.Get("X-Custom"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	msg := &attributedMessage{
+		message: message{data: []byte("payload")},
+		attributes: map[string]string{
+			"x-event-type": "order-created",
+			"X-Custom":     "attribute",
+		},
+	}
+	acked, err := publish(t, AsyncMessageSinkConfig{
+		URL:    srv.URL,
+		Header: http.Header{"X-Custom": []string{"value"}},
+	}, msg)
+	require.NoError(t, err)
+	assert.Equal(t, []substrate.Message{msg}, acked)
+}
+
+func TestPublishInvalidAttributeIsRejected(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	_, err := publish(t, AsyncMessageSinkConfig{URL: srv.URL}, &attributedMessage{
+		message:    message{data: []byte("payload")},
+		attributes: map[string]string{"not a header": "value"},
+	})
+	assert.EqualError(t, err, `http sink can't send attribute "not a header" as a header`)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+}
+
+func TestPublishClientErrorWithoutHandler(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	_, err := publish(t, AsyncMessageSinkConfig{URL: srv.URL}, &message{data: []byte("rejected")})
+	assert.Equal(t, StatusError{StatusCode: http.StatusBadRequest, Status: "400 Bad Request"}, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestPublishClientErrorWithHandler(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) == "bad" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	var rejected []substrate.Message
+	var rejectedErrs []error
+	msgs := []substrate.Message{
+		&message{data: []byte("good")},
+		&message{data: []byte("bad")},
+		&message{data: []byte("good again")},
+	}
+	acked, err := publish(t, AsyncMessageSinkConfig{
+		URL:            srv.URL,
+		MaxConcurrency: 1,
+		OnMessageError: func(msg substrate.Message, err error) error {
+			rejected = append(rejected, msg)
+			rejectedErrs = append(rejectedErrs, err)
+			return nil
+		},
+	}, msgs...)
+	require.NoError(t, err)
+	assert.Equal(t, msgs, acked)
+	assert.Equal(t, []substrate.Message{msgs[1]}, rejected)
+	assert.Equal(t, []error{StatusError{StatusCode: http.StatusUnprocessableEntity, Status: "422 Unprocessable Entity"}}, rejectedErrs)
+}
+
+func TestPublishSignsBody(t *testing.T) {
+	key := []byte("secret")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, "sha256="+sign(key, body), r.Header.Get("X-Hub-Signature"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	// Known HMAC-SHA256 test value for key "secret" and body "payload".
+	assert.Equal(t, "b82fcb791acec57859b989b430a826488ce2e479fdf92326bd0a2e8375a42ba4", sign(key, []byte("payload")))
+
+	_, err := publish(t, AsyncMessageSinkConfig{
+		URL:             srv.URL,
+		SigningKey:      key,
+		SignatureHeader: "X-Hub-Signature",
+	}, &message{data: []byte("payload")})
+	require.NoError(t, err)
+}
+
+func TestPublishConcurrencyLimit(t *testing.T) {
+	var inFlight, maxInFlight int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	var msgs []substrate.Message
+	for i := 0; i < 20; i++ {
+		msgs = append(msgs, &message{data: []byte{byte(i)}})
+	}
+	acked, err := publish(t, AsyncMessageSinkConfig{
+		URL:            srv.URL,
+		MaxConcurrency: 3,
+	}, msgs...)
+	require.NoError(t, err)
+	assert.Equal(t, msgs, acked)
+	assert.True(t, atomic.LoadInt32(&maxInFlight) <= 3, "concurrency limit exceeded")
+	assert.True(t, atomic.LoadInt32(&maxInFlight) > 1, "requests were not concurrent")
+}
+
+func TestRequestTimeoutIsRetried(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	_, err := publish(t, AsyncMessageSinkConfig{
+		URL:          srv.URL,
+		Timeout:      50 * time.Millisecond,
+		RetryBackoff: time.Millisecond,
+	}, &message{data: []byte("slow")})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
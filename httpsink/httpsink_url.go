@@ -0,0 +1,21 @@
+package httpsink
+
+import (
+	"net/url"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/suburl"
+)
+
+func init() {
+	suburl.RegisterSink("http", newHTTPSink)
+	suburl.RegisterSink("https", newHTTPSink)
+}
+
+func newHTTPSink(u *url.URL) (substrate.AsyncMessageSink, error) {
+	return httpSinker(AsyncMessageSinkConfig{
+		URL: u.String(),
+	})
+}
+
+var httpSinker = NewAsyncMessageSink
@@ -0,0 +1,24 @@
+package httpsink
+
+import (
+	"net/url"
+
+	"github.com/uw-labs/substrate/internal/validate"
+)
+
+// Validate returns an error listing the problems of the config, if any, such
+// as "httpsink: AsyncMessageSinkConfig.URL must not be empty". It is called by
+// NewAsyncMessageSink.
+func (c AsyncMessageSinkConfig) Validate() error {
+	p := validate.New("httpsink", "AsyncMessageSinkConfig")
+	if c.URL == "" {
+		p.NotEmpty(c.URL, "URL")
+	} else {
+		u, err := url.Parse(c.URL)
+		p.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "URL", "must be an absolute http or https url, got %q", c.URL)
+	}
+	p.NotNegativeDuration(c.Timeout, "Timeout")
+	p.NotNegativeDuration(c.RetryBackoff, "RetryBackoff")
+	p.NotNegativeDuration(c.MaxRetryBackoff, "MaxRetryBackoff")
+	return p.Err()
+}
@@ -0,0 +1,87 @@
+package httpsink
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsyncMessageSinkConfigValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(*AsyncMessageSinkConfig)
+		expected string
+	}{
+		{
+			name:   "valid",
+			modify: func(c *AsyncMessageSinkConfig) {},
+		},
+		{
+			name: "valid with options",
+			modify: func(c *AsyncMessageSinkConfig) {
+				c.URL = "https://example.com:8443/hooks?source=substrate"
+				c.Timeout = time.Second
+				c.MaxRetries = 3
+				c.RetryBackoff = time.Millisecond
+				c.MaxRetryBackoff = time.Second
+			},
+		},
+		{
+			name:   "retries disabled",
+			modify: func(c *AsyncMessageSinkConfig) { c.MaxRetries = -1 },
+		},
+		{
+			name:     "no url",
+			modify:   func(c *AsyncMessageSinkConfig) { c.URL = "" },
+			expected: "httpsink: AsyncMessageSinkConfig.URL must not be empty",
+		},
+		{
+			name:     "relative url",
+			modify:   func(c *AsyncMessageSinkConfig) { c.URL = "/hooks" },
+			expected: `httpsink: AsyncMessageSinkConfig.URL must be an absolute http or https url, got "/hooks"`,
+		},
+		{
+			name:     "url scheme",
+			modify:   func(c *AsyncMessageSinkConfig) { c.URL = "ftp://example.com/hooks" },
+			expected: `httpsink: AsyncMessageSinkConfig.URL must be an absolute http or https url, got "ftp://example.com/hooks"`,
+		},
+		{
+			name:     "invalid url",
+			modify:   func(c *AsyncMessageSinkConfig) { c.URL = "http://%zz" },
+			expected: `httpsink: AsyncMessageSinkConfig.URL must be an absolute http or https url, got "http://%zz"`,
+		},
+		{
+			name:     "timeout",
+			modify:   func(c *AsyncMessageSinkConfig) { c.Timeout = -time.Second },
+			expected: "httpsink: AsyncMessageSinkConfig.Timeout must not be negative",
+		},
+		{
+			name: "every problem",
+			modify: func(c *AsyncMessageSinkConfig) {
+				c.URL = ""
+				c.RetryBackoff = -time.Millisecond
+				c.MaxRetryBackoff = -time.Second
+			},
+			expected: "3 problems: " +
+				"httpsink: AsyncMessageSinkConfig.URL must not be empty; " +
+				"httpsink: AsyncMessageSinkConfig.RetryBackoff must not be negative; " +
+				"httpsink: AsyncMessageSinkConfig.MaxRetryBackoff must not be negative",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			c := AsyncMessageSinkConfig{URL: "http://localhost:8080/hooks"}
+			tst.modify(&c)
+			err := c.Validate()
+			if tst.expected == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tst.expected)
+			_, err = NewAsyncMessageSink(c)
+			assert.EqualError(t, err, tst.expected)
+		})
+	}
+}
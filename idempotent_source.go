@@ -0,0 +1,197 @@
+package substrate
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/uw-labs/sync/rungroup"
+)
+
+// IdempotencyStore records which messages have been processed, so that
+// duplicates can be skipped. Implementations are expected to be backed by
+// durable state shared by all the replicas consuming from a source.
+type IdempotencyStore interface {
+	// GetProcessed reports whether the key has been marked as processed.
+	GetProcessed(ctx context.Context, key string) (bool, error)
+	// SetProcessed marks the key as processed for the given time to live.
+	// A zero ttl means the mark does not expire.
+	SetProcessed(ctx context.Context, key string, ttl time.Duration) error
+}
+
+// NewIdempotentSource returns a source that skips messages that have already
+// been processed, according to store. The key of every message is computed
+// by keyFunc, and messages with an empty key are always delivered. A message
+// whose key is already marked as processed is acknowledged to source without
+// being delivered. Otherwise the key is marked as processed for ttl when the
+// message is acknowledged, before the acknowledgement is passed on to source.
+// If the process crashes after handling a message but before marking it, the
+// message is redelivered, so handling must still tolerate the occasional
+// duplicate. When Close is called on the returned source, this is also
+// propagated to source.
+func NewIdempotentSource(source AsyncMessageSource, store IdempotencyStore, keyFunc func(Message) string, ttl time.Duration) AsyncMessageSource {
+	return &idempotentSource{
+		source:  source,
+		store:   store,
+		keyFunc: keyFunc,
+		ttl:     ttl,
+	}
+}
+
+type idempotentSource struct {
+	source  AsyncMessageSource
+	store   IdempotencyStore
+	keyFunc func(Message) string
+	ttl     time.Duration
+}
+
+// keyedAck is a message awaiting its acknowledgement, which comes from the
+// caller unless the message is a duplicate.
+type keyedAck struct {
+	msg       Message
+	key       string
+	duplicate bool
+}
+
+func (s *idempotentSource) ConsumeMessages(ctx context.Context, messages chan<- Message, acks <-chan Message) error {
+	rg, ctx := rungroup.New(ctx)
+
+	fromInner := make(chan Message, cap(messages))
+	toInner := make(chan Message, cap(acks))
+	needAcks := make(chan keyedAck, 1024)
+
+	rg.Go(func() error {
+		return s.source.ConsumeMessages(ctx, fromInner, toInner)
+	})
+
+	rg.Go(func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case msg := <-fromInner:
+				ka := keyedAck{msg: msg, key: s.keyFunc(msg)}
+				if ka.key != "" {
+					processed, err := s.store.GetProcessed(ctx, ka.key)
+					if err != nil {
+						return err
+					}
+					ka.duplicate = processed
+				}
+				select {
+				case needAcks <- ka:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				if ka.duplicate {
+					continue
+				}
+				select {
+				case messages <- msg:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	})
+
+	rg.Go(func() error {
+		for {
+			var ka keyedAck
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case ka = <-needAcks:
+			}
+			if !ka.duplicate {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case ack := <-acks:
+					if !SameMessage(ack, ka.msg) {
+						return InvalidAckError{Acked: ack, Expected: ka.msg}
+					}
+				}
+				if ka.key != "" {
+					if err := s.store.SetProcessed(ctx, ka.key, s.ttl); err != nil {
+						return err
+					}
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case toInner <- ka.msg:
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+// Close closes the underlying source.
+func (s *idempotentSource) Close() error {
+	return s.source.Close()
+}
+
+// Status returns the status of the underlying source.
+func (s *idempotentSource) Status() (*Status, error) {
+	return s.source.Status()
+}
+
+// NewMemoryIdempotencyStore returns an IdempotencyStore that keeps the
+// processed keys in memory. It is not shared across processes, and is mainly
+// useful for tests and single replica deployments.
+func NewMemoryIdempotencyStore() IdempotencyStore {
+	return &memoryIdempotencyStore{
+		keys:      make(map[string]time.Time),
+		nextSweep: 1024,
+	}
+}
+
+type memoryIdempotencyStore struct {
+	mu        sync.Mutex
+	keys      map[string]time.Time
+	nextSweep int
+}
+
+func (s *memoryIdempotencyStore) GetProcessed(_ context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expiry, ok := s.keys[key]
+	if !ok {
+		return false, nil
+	}
+	if !expiry.IsZero() && !time.Now().Before(expiry) {
+		delete(s.keys, key)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *memoryIdempotencyStore) SetProcessed(_ context.Context, key string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expiry time.Time
+	if ttl > 0 {
+		expiry = time.Now().Add(ttl)
+	}
+	s.keys[key] = expiry
+
+	if len(s.keys) >= s.nextSweep {
+		// Remove expired keys, amortised over the number of keys added.
+		now := time.Now()
+		for k, e := range s.keys {
+			if !e.IsZero() && !now.Before(e) {
+				delete(s.keys, k)
+			}
+		}
+		s.nextSweep = 2 * len(s.keys)
+		if s.nextSweep < 1024 {
+			s.nextSweep = 1024
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func payloadKey(msg Message) string {
+	return string(msg.Data())
+}
+
+func TestIdempotentSourceSkipsProcessedMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &mockAsyncSource{
+		toSend: make(chan Message, 4),
+		acked:  make(chan Message, 4),
+		closed: make(chan struct{}),
+	}
+	store := NewMemoryIdempotencyStore()
+	assert.NoError(store.SetProcessed(context.Background(), "seen", time.Minute))
+	source := NewIdempotentSource(inner, store, payloadKey, time.Minute)
+
+	m1, m2, m3, m4 := message("first"), message("seen"), message("first"), message("second")
+	inner.toSend <- &m1
+	inner.toSend <- &m2
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	m := <-msgs
+	assert.Equal(&m1, m)
+	acks <- m
+	// All messages, including the skipped ones, are acknowledged in order.
+	assert.Equal(&m1, <-inner.acked)
+	assert.Equal(&m2, <-inner.acked)
+
+	// The first message has been acknowledged, so its duplicate is skipped.
+	inner.toSend <- &m3
+	inner.toSend <- &m4
+	m = <-msgs
+	assert.Equal(&m4, m)
+	acks <- m
+	assert.Equal(&m3, <-inner.acked)
+	assert.Equal(&m4, <-inner.acked)
+	processed, err := store.GetProcessed(ctx, "second")
+	assert.NoError(err)
+	assert.True(processed)
+
+	cancel()
+	assert.Equal(context.Canceled, <-errs)
+
+	assert.NoError(source.Close())
+	select {
+	case <-inner.closed:
+	default:
+		t.Error("underlying async source didn't get closed")
+	}
+}
+
+func TestIdempotentSourceDeliversMessagesWithoutKey(t *testing.T) {
+	inner := &mockAsyncSource{
+		toSend: make(chan Message, 2),
+		acked:  make(chan Message, 2),
+		closed: make(chan struct{}),
+	}
+	source := NewIdempotentSource(inner, NewMemoryIdempotencyStore(), func(Message) string { return "" }, 0)
+
+	m1, m2 := message("same"), message("same")
+	inner.toSend <- &m1
+	inner.toSend <- &m2
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	go func() {
+		_ = source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	for _, expected := range []Message{&m1, &m2} {
+		m := <-msgs
+		assert.Equal(t, expected, m)
+		acks <- m
+		assert.Equal(t, expected, <-inner.acked)
+	}
+}
+
+type failingIdempotencyStore struct {
+	IdempotencyStore
+	err error
+}
+
+func (s failingIdempotencyStore) SetProcessed(context.Context, string, time.Duration) error {
+	return s.err
+}
+
+func TestIdempotentSourceDoesNotAckWhenMarkingFails(t *testing.T) {
+	inner := &mockAsyncSource{
+		toSend: make(chan Message, 1),
+		acked:  make(chan Message, 1),
+		closed: make(chan struct{}),
+	}
+	failure := errors.New("store unavailable")
+	source := NewIdempotentSource(inner, failingIdempotencyStore{NewMemoryIdempotencyStore(), failure}, payloadKey, 0)
+
+	m1 := message("first")
+	inner.toSend <- &m1
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	acks <- <-msgs
+	assert.Equal(t, failure, <-errs)
+	// The message is not acknowledged, so that it is redelivered.
+	assert.Len(t, inner.acked, 0)
+}
+
+func TestMemoryIdempotencyStoreExpiry(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryIdempotencyStore()
+
+	assert.NoError(t, store.SetProcessed(ctx, "short", time.Millisecond))
+	assert.NoError(t, store.SetProcessed(ctx, "forever", 0))
+	time.Sleep(5 * time.Millisecond)
+
+	processed, err := store.GetProcessed(ctx, "short")
+	assert.NoError(t, err)
+	assert.False(t, processed)
+	processed, err = store.GetProcessed(ctx, "forever")
+	assert.NoError(t, err)
+	assert.True(t, processed)
+	processed, err = store.GetProcessed(ctx, "unknown")
+	assert.NoError(t, err)
+	assert.False(t, processed)
+}
@@ -0,0 +1,141 @@
+package substrate
+
+import (
+	"context"
+	"time"
+
+	"github.com/uw-labs/sync/rungroup"
+)
+
+// gaugesInterval is how often the gauges of an in flight limited source are
+// sampled.
+const gaugesInterval = time.Second
+
+// InFlightLimitOptions is the configuration of NewInFlightLimitedSource.
+type InFlightLimitOptions struct {
+	// MaxInFlight, if positive, is the maximum number of messages in
+	// flight, delivered and not acknowledged yet.
+	MaxInFlight int
+	// Window, if set, adapts the maximum number of messages in flight to
+	// the latency of the acknowledgements instead, see AdaptiveWindow.
+	Window *AdaptiveWindow
+	// Gauges, if set, is sampled with the number of messages in flight and
+	// of pending acknowledgements, and with the current window if it
+	// implements WindowGauges and Window is set.
+	Gauges Gauges
+}
+
+// NewInFlightLimitedSource returns a source that stops consuming messages from
+// source while the number of messages in flight is at the limit set by opts,
+// so that slow consumers don't hold too many messages in memory. When Close
+// is called on the returned source, this is also propagated to source.
+func NewInFlightLimitedSource(source AsyncMessageSource, opts InFlightLimitOptions) AsyncMessageSource {
+	return &inFlightLimitedSource{
+		source: source,
+		opts:   opts,
+		now:    time.Now,
+	}
+}
+
+type inFlightLimitedSource struct {
+	source AsyncMessageSource
+	opts   InFlightLimitOptions
+	now    func() time.Time
+}
+
+// inFlightMessage is a delivered message, along with when it was delivered.
+type inFlightMessage struct {
+	msg       Message
+	delivered time.Time
+}
+
+// limit returns the maximum number of messages in flight, which is 0 for no
+// limit.
+func (s *inFlightLimitedSource) limit() int {
+	if s.opts.Window != nil {
+		return s.opts.Window.Size()
+	}
+	return s.opts.MaxInFlight
+}
+
+func (s *inFlightLimitedSource) ConsumeMessages(ctx context.Context, messages chan<- Message, acks <-chan Message) error {
+	rg, ctx := rungroup.New(ctx)
+
+	fromInner := make(chan Message)
+	toInner := make(chan Message, cap(acks))
+
+	rg.Go(func() error {
+		return s.source.ConsumeMessages(ctx, fromInner, toInner)
+	})
+
+	rg.Go(func() error {
+		var gaugeTicks <-chan time.Time
+		if s.opts.Gauges != nil {
+			ticker := time.NewTicker(gaugesInterval)
+			defer ticker.Stop()
+			gaugeTicks = ticker.C
+		}
+
+		var (
+			inFlight []inFlightMessage
+			// next is the message being delivered, on out.
+			next Message
+			out  chan<- Message
+		)
+		for {
+			in := fromInner
+			if limit := s.limit(); next != nil || (limit > 0 && len(inFlight) >= limit) {
+				in = nil
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-gaugeTicks:
+				s.sampleGauges(len(inFlight), len(acks))
+			case msg := <-in:
+				next, out = msg, messages
+			case out <- next:
+				inFlight = append(inFlight, inFlightMessage{msg: next, delivered: s.now()})
+				next, out = nil, nil
+			case ack := <-acks:
+				switch {
+				case len(inFlight) == 0:
+					return InvalidAckError{Acked: ack}
+				case !SameMessage(ack, inFlight[0].msg):
+					return InvalidAckError{Acked: ack, Expected: inFlight[0].msg}
+				}
+				if s.opts.Window != nil {
+					s.opts.Window.Acked(s.now().Sub(inFlight[0].delivered))
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case toInner <- inFlight[0].msg:
+				}
+				inFlight = inFlight[1:]
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+// sampleGauges sets the gauges to the number of messages in flight, of
+// pending acknowledgements, and to the current window.
+func (s *inFlightLimitedSource) sampleGauges(inFlight, pendingAcks int) {
+	s.opts.Gauges.SetInFlight(inFlight)
+	s.opts.Gauges.SetPendingAcks(pendingAcks)
+	if wg, ok := s.opts.Gauges.(WindowGauges); ok && s.opts.Window != nil {
+		wg.SetWindow(s.opts.Window.Size())
+	}
+}
+
+// Close closes the underlying source.
+func (s *inFlightLimitedSource) Close() error {
+	return s.source.Close()
+}
+
+// Status returns the status of the underlying source.
+func (s *inFlightLimitedSource) Status() (*Status, error) {
+	return s.source.Status()
+}
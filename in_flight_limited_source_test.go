@@ -0,0 +1,74 @@
+package substrate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInFlightLimitedSource(t *testing.T) {
+	m1, m2, m3 := message("one"), message("two"), message("three")
+	inner := newStreamingAsyncSource(&m1, &m2, &m3)
+	source := NewInFlightLimitedSource(inner, InFlightLimitOptions{MaxInFlight: 2})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message, 3)
+	acks := make(chan Message, 3)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	assert.Equal(t, &m1, <-msgs)
+	assert.Equal(t, &m2, <-msgs)
+	select {
+	case msg := <-msgs:
+		t.Fatalf("delivered %s beyond the limit", msg.Data())
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	acks <- &m1
+	assert.Equal(t, &m1, <-inner.acked)
+	assert.Equal(t, &m3, <-msgs)
+
+	acks <- &m3
+	assert.IsType(t, InvalidAckError{}, <-errs)
+}
+
+func TestInFlightLimitedSourceAdaptiveWindow(t *testing.T) {
+	m1, m2, m3 := message("one"), message("two"), message("three")
+	inner := newStreamingAsyncSource(&m1, &m2, &m3)
+	window := NewAdaptiveWindow(AdaptiveWindowOptions{TargetLatency: time.Hour})
+	source := NewInFlightLimitedSource(inner, InFlightLimitOptions{Window: window})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message, 3)
+	acks := make(chan Message, 3)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	assert.Equal(t, &m1, <-msgs)
+	select {
+	case msg := <-msgs:
+		t.Fatalf("delivered %s beyond the window", msg.Data())
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// The acknowledgement is under the target latency, so the window grows.
+	acks <- &m1
+	assert.Equal(t, &m1, <-inner.acked)
+	assert.Equal(t, &m2, <-msgs)
+	assert.Equal(t, &m3, <-msgs)
+	assert.Equal(t, 2, window.Size())
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
@@ -0,0 +1,94 @@
+package inmemory
+
+import (
+	"sync"
+)
+
+// Broker is an in memory message broker, holding any number of topics. Topics
+// are created when first used, and messages are retained for the lifetime of
+// the broker.
+type Broker struct {
+	mu     sync.Mutex
+	topics map[string]*topic
+}
+
+// NewBroker returns a new empty broker.
+func NewBroker() *Broker {
+	return &Broker{topics: make(map[string]*topic)}
+}
+
+func (b *Broker) topic(name string) *topic {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t, ok := b.topics[name]
+	if !ok {
+		t = &topic{
+			offsets: make(map[string]int64),
+			updated: make(chan struct{}),
+		}
+		b.topics[name] = t
+	}
+	return t
+}
+
+// storedMessage is a published message, copied so that later changes by the
+// publisher don't affect it.
+type storedMessage struct {
+	data       []byte
+	key        []byte
+	attributes map[string]string
+}
+
+type topic struct {
+	mu       sync.Mutex
+	messages []*storedMessage
+	// offsets holds the committed offset of every consumer group, which is
+	// the offset of the next message to consume.
+	offsets map[string]int64
+	// updated is closed, and replaced, whenever a message is appended.
+	updated chan struct{}
+}
+
+func (t *topic) append(m *storedMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.messages = append(t.messages, m)
+	close(t.updated)
+	t.updated = make(chan struct{})
+}
+
+// read returns the messages from offset onwards, and a channel that is closed
+// when more messages are available.
+func (t *topic) read(offset int64) ([]*storedMessage, <-chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if offset >= int64(len(t.messages)) {
+		return nil, t.updated
+	}
+	return t.messages[offset:], t.updated
+}
+
+// initialOffset returns the committed offset of the consumer group, or the
+// initial offset for a group that has not committed any.
+func (t *topic) initialOffset(group string, initial int64) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if offset, ok := t.offsets[group]; ok {
+		return offset
+	}
+	if initial == OffsetNewest {
+		return int64(len(t.messages))
+	}
+	return 0
+}
+
+func (t *topic) commit(group string, offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.offsets[group] = offset
+}
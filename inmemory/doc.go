@@ -0,0 +1,28 @@
+// Package inmemory provides an in memory backend for substrate, mainly useful
+// for tests.
+//
+// Usage
+//
+// Sources and sinks are created for a topic of a Broker, which holds all the
+// published messages in memory. Keys and attributes of published messages are
+// retained, and consumer groups commit their offset as messages are
+// acknowledged, so that a new source for the same group resumes after the last
+// acknowledged message.
+//
+//      broker := inmemory.NewBroker()
+//      sink, err := inmemory.NewAsyncMessageSink(inmemory.AsyncMessageSinkConfig{
+//          Broker: broker,
+//          Topic:  "events",
+//      })
+//      ...
+//      source, err := inmemory.NewAsyncMessageSource(inmemory.AsyncMessageSourceConfig{
+//          Broker:        broker,
+//          Topic:         "events",
+//          ConsumerGroup: "consumer",
+//      })
+//
+// Delivered messages implement substrate.Nackable. A nacked message is not
+// committed, and is delivered again once it is acknowledged, along with the
+// messages after it.
+//
+package inmemory
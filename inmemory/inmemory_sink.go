@@ -0,0 +1,69 @@
+package inmemory
+
+import (
+	"context"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/unwrap"
+)
+
+var _ substrate.AsyncMessageSink = (*asyncMessageSink)(nil)
+
+// AsyncMessageSinkConfig is the configuration parameters for an
+// AsyncMessageSink.
+type AsyncMessageSinkConfig struct {
+	Broker *Broker
+	Topic  string
+}
+
+// NewAsyncMessageSink returns a sink publishing to a topic of an in memory
+// broker. The key and attributes of published messages are retained.
+func NewAsyncMessageSink(c AsyncMessageSinkConfig) (substrate.AsyncMessageSink, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &asyncMessageSink{topic: c.Broker.topic(c.Topic)}, nil
+}
+
+type asyncMessageSink struct {
+	topic *topic
+}
+
+func (ams *asyncMessageSink) PublishMessages(ctx context.Context, acks chan<- substrate.Message, messages <-chan substrate.Message) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg := <-messages:
+			sm := &storedMessage{data: append([]byte{}, msg.Data()...)}
+			if km, ok := unwrap.Unwrap(msg).(substrate.KeyedMessage); ok {
+				sm.key = append([]byte{}, km.Key()...)
+			}
+			if attrs := unwrap.Attributes(msg); len(attrs) > 0 {
+				sm.attributes = make(map[string]string, len(attrs))
+				for k, v := range attrs {
+					sm.attributes[k] = v
+				}
+			}
+			ams.topic.append(sm)
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case acks <- msg:
+			}
+		}
+	}
+}
+
+// Close implements the Close method of the substrate.AsyncMessageSink
+// interface.
+func (ams *asyncMessageSink) Close() error {
+	return nil
+}
+
+// Status implements the Status method of the substrate.AsyncMessageSink
+// interface.
+func (ams *asyncMessageSink) Status() (*substrate.Status, error) {
+	return &substrate.Status{Working: true}, nil
+}
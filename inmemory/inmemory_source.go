@@ -0,0 +1,221 @@
+package inmemory
+
+import (
+	"context"
+	"sync"
+
+	"github.com/uw-labs/sync/rungroup"
+
+	"github.com/uw-labs/substrate"
+)
+
+const (
+	// OffsetOldest indicates the oldest message in the topic.
+	OffsetOldest int64 = -2
+	// OffsetNewest indicates the next message published to the topic.
+	OffsetNewest int64 = -1
+)
+
+var (
+	_ substrate.AsyncMessageSource = (*asyncMessageSource)(nil)
+	_ substrate.Nackable           = (*consumerMessage)(nil)
+)
+
+// AsyncMessageSourceConfig is the configuration parameters for an
+// AsyncMessageSource.
+type AsyncMessageSourceConfig struct {
+	Broker        *Broker
+	Topic         string
+	ConsumerGroup string
+	// Offset is the initial offset of a consumer group without a committed
+	// offset. Defaults to OffsetOldest.
+	Offset int64
+}
+
+// NewAsyncMessageSource returns a source consuming from a topic of an in
+// memory broker. Consumption resumes from the offset committed by the
+// consumer group, which is advanced as messages are acknowledged. Messages
+// are not shared out between concurrent consumers of the same group, each of
+// them consumes every message from the committed offset. Nacked messages are
+// delivered again once they are acknowledged, along with the messages after
+// them.
+func NewAsyncMessageSource(c AsyncMessageSourceConfig) (substrate.AsyncMessageSource, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.Offset == 0 {
+		c.Offset = OffsetOldest
+	}
+	return &asyncMessageSource{
+		topic:         c.Broker.topic(c.Topic),
+		consumerGroup: c.ConsumerGroup,
+		offset:        c.Offset,
+	}, nil
+}
+
+type asyncMessageSource struct {
+	topic         *topic
+	consumerGroup string
+	offset        int64
+}
+
+type consumerMessage struct {
+	sm     *storedMessage
+	offset int64
+	// gen is the number of times the source was rewound before the message
+	// was delivered.
+	gen    int
+	reason error
+}
+
+func (cm *consumerMessage) Data() []byte {
+	if cm.sm == nil {
+		panic("attempt to use payload after discarding.")
+	}
+	return cm.sm.data
+}
+
+func (cm *consumerMessage) Key() []byte {
+	if cm.sm == nil {
+		panic("attempt to get the key after discarding.")
+	}
+	return cm.sm.key
+}
+
+func (cm *consumerMessage) Attributes() map[string]string {
+	if cm.sm == nil {
+		panic("attempt to get the attributes after discarding.")
+	}
+	return cm.sm.attributes
+}
+
+func (cm *consumerMessage) DiscardPayload() {
+	cm.sm = nil
+}
+
+// Nack implements the substrate.Nackable interface. A nacked message is
+// delivered again once it is acknowledged.
+func (cm *consumerMessage) Nack(reason error) {
+	if reason == nil {
+		reason = substrate.ErrNacked
+	}
+	cm.reason = reason
+}
+
+// rewinder passes the offset to consume from after a message is nacked, from
+// the acknowledging goroutine to the consuming one, without blocking.
+type rewinder struct {
+	mu     sync.Mutex
+	gen    int
+	offset int64
+	// notify is signalled whenever the source is rewound.
+	notify chan struct{}
+}
+
+func (r *rewinder) rewind(offset int64) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.gen++
+	r.offset = offset
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+	return r.gen
+}
+
+func (r *rewinder) get() (int, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.gen, r.offset
+}
+
+func (ams *asyncMessageSource) ConsumeMessages(ctx context.Context, messages chan<- substrate.Message, acks <-chan substrate.Message) error {
+	rg, ctx := rungroup.New(ctx)
+
+	toAck := make(chan *consumerMessage)
+	rw := &rewinder{notify: make(chan struct{}, 1)}
+
+	rg.Go(func() error {
+		var toAckList []*consumerMessage
+		gen := 0
+		for {
+			select {
+			case ta := <-toAck:
+				toAckList = append(toAckList, ta)
+			case a := <-acks:
+				switch {
+				case len(toAckList) == 0:
+					return substrate.InvalidAckError{Acked: a}
+				case !substrate.SameMessage(a, toAckList[0]):
+					return substrate.InvalidAckError{Acked: a, Expected: toAckList[0]}
+				default:
+					cm := toAckList[0]
+					toAckList = toAckList[1:]
+					switch {
+					case cm.gen != gen:
+						// Delivered before a rewind, so it is delivered again.
+					case cm.reason != nil:
+						gen = rw.rewind(cm.offset)
+					default:
+						ams.topic.commit(ams.consumerGroup, cm.offset+1)
+					}
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+
+	rg.Go(func() error {
+		offset := ams.topic.initialOffset(ams.consumerGroup, ams.offset)
+		gen := 0
+	consume:
+		for {
+			if g, o := rw.get(); g != gen {
+				gen, offset = g, o
+			}
+			available, updated := ams.topic.read(offset)
+			for _, sm := range available {
+				if g, _ := rw.get(); g != gen {
+					continue consume
+				}
+				cm := &consumerMessage{sm: sm, offset: offset, gen: gen}
+				select {
+				case toAck <- cm:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				select {
+				case messages <- cm:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				offset++
+			}
+			if len(available) == 0 {
+				select {
+				case <-updated:
+				case <-rw.notify:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+// Close implements the Close method of the substrate.AsyncMessageSource
+// interface.
+func (ams *asyncMessageSource) Close() error {
+	return nil
+}
+
+// Status implements the Status method of the substrate.AsyncMessageSource
+// interface.
+func (ams *asyncMessageSource) Status() (*substrate.Status, error) {
+	return &substrate.Status{Working: true}, nil
+}
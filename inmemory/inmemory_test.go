@@ -0,0 +1,198 @@
+package inmemory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/testshared"
+)
+
+type testServer struct {
+	broker *Broker
+}
+
+func (ts *testServer) NewConsumer(topic string, groupID string) substrate.AsyncMessageSource {
+	s, err := NewAsyncMessageSource(AsyncMessageSourceConfig{
+		Broker:        ts.broker,
+		Topic:         topic,
+		ConsumerGroup: groupID,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func (ts *testServer) NewProducer(topic string) substrate.AsyncMessageSink {
+	s, err := NewAsyncMessageSink(AsyncMessageSinkConfig{
+		Broker: ts.broker,
+		Topic:  topic,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func (ts *testServer) TestEnd() {}
+
+func (ts *testServer) RedeliversNacked() bool {
+	return true
+}
+
+func TestAll(t *testing.T) {
+	testshared.TestAll(t, &testServer{broker: NewBroker()})
+}
+
+type keyedMessage struct {
+	data       []byte
+	key        []byte
+	attributes map[string]string
+}
+
+func (m *keyedMessage) Data() []byte {
+	return m.data
+}
+
+func (m *keyedMessage) Key() []byte {
+	return m.key
+}
+
+func (m *keyedMessage) Attributes() map[string]string {
+	return m.attributes
+}
+
+func TestKeysAndAttributes(t *testing.T) {
+	ts := &testServer{broker: NewBroker()}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sink := substrate.NewSynchronousMessageSink(ts.NewProducer("topic"))
+	defer sink.Close()
+	attributes := map[string]string{"type": "created"}
+	require.NoError(t, sink.PublishMessage(ctx, &keyedMessage{data: []byte("data"), key: []byte("key"), attributes: attributes}))
+	// Changes after publishing don't affect the published message.
+	attributes["type"] = "changed"
+
+	msgs := make(chan substrate.Message)
+	go func() {
+		_ = ts.NewConsumer("topic", "group").ConsumeMessages(ctx, msgs, make(chan substrate.Message))
+	}()
+
+	m := <-msgs
+	assert.Equal(t, "data", string(m.Data()))
+	assert.Equal(t, "key", string(m.(substrate.KeyedMessage).Key()))
+	assert.Equal(t, map[string]string{"type": "created"}, m.(substrate.AttributedMessage).Attributes())
+}
+
+func TestOffsetNewest(t *testing.T) {
+	broker := NewBroker()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sink, err := NewAsyncMessageSink(AsyncMessageSinkConfig{Broker: broker, Topic: "topic"})
+	require.NoError(t, err)
+	sync := substrate.NewSynchronousMessageSink(sink)
+	require.NoError(t, sync.PublishMessage(ctx, &keyedMessage{data: []byte("old")}))
+
+	source, err := NewAsyncMessageSource(AsyncMessageSourceConfig{Broker: broker, Topic: "topic", ConsumerGroup: "group", Offset: OffsetNewest})
+	require.NoError(t, err)
+	msgs := make(chan substrate.Message)
+	go func() {
+		_ = source.ConsumeMessages(ctx, msgs, make(chan substrate.Message))
+	}()
+
+	// Wait for the source to start before publishing.
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, sync.PublishMessage(ctx, &keyedMessage{data: []byte("new")}))
+	assert.Equal(t, "new", string((<-msgs).Data()))
+}
+
+func TestNackedMessageIsNotCommitted(t *testing.T) {
+	broker := NewBroker()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sink, err := NewAsyncMessageSink(AsyncMessageSinkConfig{Broker: broker, Topic: "topic"})
+	require.NoError(t, err)
+	sync := substrate.NewSynchronousMessageSink(sink)
+	require.NoError(t, sync.PublishMessage(ctx, &keyedMessage{data: []byte("first")}))
+	require.NoError(t, sync.PublishMessage(ctx, &keyedMessage{data: []byte("second")}))
+
+	source, err := NewAsyncMessageSource(AsyncMessageSourceConfig{Broker: broker, Topic: "topic", ConsumerGroup: "group"})
+	require.NoError(t, err)
+	consumeCtx, consumeCancel := context.WithCancel(ctx)
+	msgs := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(consumeCtx, msgs, acks)
+	}()
+
+	m := <-msgs
+	acks <- m
+	m = <-msgs
+	assert.Equal(t, "second", string(m.Data()))
+	m.(substrate.Nackable).Nack(nil)
+	acks <- m
+	assert.Equal(t, "second", string((<-msgs).Data()))
+	consumeCancel()
+	assert.Equal(t, context.Canceled, <-errs)
+
+	// Consumption resumes from the nacked message.
+	assert.Equal(t, int64(1), broker.topic("topic").initialOffset("group", OffsetOldest))
+}
+
+func TestInvalidConfig(t *testing.T) {
+	broker := NewBroker()
+	sinkTests := []struct {
+		config   AsyncMessageSinkConfig
+		expected string
+	}{
+		{
+			config:   AsyncMessageSinkConfig{Topic: "topic"},
+			expected: "inmemory: AsyncMessageSinkConfig.Broker must be set",
+		},
+		{
+			config:   AsyncMessageSinkConfig{Broker: broker},
+			expected: "inmemory: AsyncMessageSinkConfig.Topic must not be empty",
+		},
+		{
+			config: AsyncMessageSinkConfig{},
+			expected: "2 problems: " +
+				"inmemory: AsyncMessageSinkConfig.Broker must be set; " +
+				"inmemory: AsyncMessageSinkConfig.Topic must not be empty",
+		},
+	}
+	for _, tst := range sinkTests {
+		_, err := NewAsyncMessageSink(tst.config)
+		assert.EqualError(t, err, tst.expected)
+	}
+
+	sourceTests := []struct {
+		config   AsyncMessageSourceConfig
+		expected string
+	}{
+		{
+			config:   AsyncMessageSourceConfig{Topic: "topic"},
+			expected: "inmemory: AsyncMessageSourceConfig.Broker must be set",
+		},
+		{
+			config:   AsyncMessageSourceConfig{Broker: broker},
+			expected: "inmemory: AsyncMessageSourceConfig.Topic must not be empty",
+		},
+		{
+			config:   AsyncMessageSourceConfig{Broker: broker, Topic: "topic", Offset: 3},
+			expected: "inmemory: AsyncMessageSourceConfig.Offset must be either OffsetOldest or OffsetNewest",
+		},
+	}
+	for _, tst := range sourceTests {
+		_, err := NewAsyncMessageSource(tst.config)
+		assert.EqualError(t, err, tst.expected)
+	}
+}
@@ -0,0 +1,24 @@
+package inmemory
+
+import "github.com/uw-labs/substrate/internal/validate"
+
+// Validate returns an error listing the problems of the config, if any, such
+// as "inmemory: AsyncMessageSinkConfig.Broker must be set". It is called by
+// NewAsyncMessageSink.
+func (c AsyncMessageSinkConfig) Validate() error {
+	p := validate.New("inmemory", "AsyncMessageSinkConfig")
+	p.Check(c.Broker != nil, "Broker", "must be set")
+	p.NotEmpty(c.Topic, "Topic")
+	return p.Err()
+}
+
+// Validate returns an error listing the problems of the config, if any, such
+// as "inmemory: AsyncMessageSourceConfig.Topic must not be empty". It is
+// called by NewAsyncMessageSource.
+func (c AsyncMessageSourceConfig) Validate() error {
+	p := validate.New("inmemory", "AsyncMessageSourceConfig")
+	p.Check(c.Broker != nil, "Broker", "must be set")
+	p.NotEmpty(c.Topic, "Topic")
+	p.Check(c.Offset == 0 || c.Offset == OffsetOldest || c.Offset == OffsetNewest, "Offset", "must be either OffsetOldest or OffsetNewest")
+	return p.Err()
+}
@@ -0,0 +1,51 @@
+package instrumented
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/uw-labs/substrate/checksum"
+)
+
+var checksumLabels = []string{"result", "topic"}
+
+// NewChecksumCounter returns checksum.Metrics for the Metrics option of the
+// checksummed source config, which counts the verified, unverified and
+// corrupted messages. The counter vector will have the labels "result" and
+// "topic".
+func NewChecksumCounter(counterOpts prometheus.CounterOpts, topic string) checksum.Metrics {
+	counter := prometheus.NewCounterVec(counterOpts, checksumLabels)
+
+	if err := prometheus.Register(counter); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			counter = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			panic(err)
+		}
+	}
+
+	return newChecksumCounter(counter, topic)
+}
+
+func newChecksumCounter(counter *prometheus.CounterVec, topic string) checksum.Metrics {
+	return checksumCounter{
+		verified:   counter.WithLabelValues("verified", topic),
+		unverified: counter.WithLabelValues("unverified", topic),
+		corrupted:  counter.WithLabelValues("corrupted", topic),
+	}
+}
+
+type checksumCounter struct {
+	verified, unverified, corrupted prometheus.Counter
+}
+
+func (c checksumCounter) Verified() {
+	c.verified.Inc()
+}
+
+func (c checksumCounter) Unverified() {
+	c.unverified.Inc()
+}
+
+func (c checksumCounter) Corrupted() {
+	c.corrupted.Inc()
+}
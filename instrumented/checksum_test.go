@@ -0,0 +1,32 @@
+package instrumented
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksumCounter(t *testing.T) {
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Help: "checksums",
+			Name: "checksums",
+		}, checksumLabels)
+	metrics := newChecksumCounter(counter, "testTopic")
+
+	metrics.Verified()
+	metrics.Verified()
+	metrics.Unverified()
+
+	for result, expected := range map[string]int{
+		"verified":   2,
+		"unverified": 1,
+		"corrupted":  0,
+	} {
+		var metric dto.Metric
+		assert.NoError(t, counter.WithLabelValues(result, "testTopic").Write(&metric))
+		assert.Equal(t, expected, int(*metric.Counter.Value), result)
+	}
+}
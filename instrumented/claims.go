@@ -0,0 +1,57 @@
+package instrumented
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/uw-labs/substrate/kafka"
+)
+
+// NewKafkaClaimCollector returns a prometheus collector for the claim metrics
+// reported by a kafka source, see the kafka.ClaimMetricsReporter interface,
+// e.g. to find whether consuming waits on kafka or on the caller. It exports
+// the counters "claim_messages_total", "claim_batches_total",
+// "claim_handoff_blocked_seconds_total" and
+// "claim_delivery_blocked_seconds_total", with the label "partition",
+// prefixed with the namespace. The counters are read as metrics are
+// collected, so the source only updates atomic counters. The collector must
+// be registered by the caller, e.g. with prometheus.MustRegister, with
+// constLabels to tell apart the collectors of different sources.
+func NewKafkaClaimCollector(reporter kafka.ClaimMetricsReporter, namespace string, constLabels prometheus.Labels) prometheus.Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, progressLabels, constLabels)
+	}
+	return &claimCollector{
+		reporter:        reporter,
+		messages:        desc("claim_messages_total", "Messages received from the claims of the partition."),
+		batches:         desc("claim_batches_total", "Runs of messages received from the claims of the partition without waiting."),
+		handoffBlocked:  desc("claim_handoff_blocked_seconds_total", "Time spent waiting to hand the messages of the partition over for delivery."),
+		deliveryBlocked: desc("claim_delivery_blocked_seconds_total", "Time spent waiting for the caller to receive the messages of the partition."),
+	}
+}
+
+type claimCollector struct {
+	reporter kafka.ClaimMetricsReporter
+
+	messages, batches, handoffBlocked, deliveryBlocked *prometheus.Desc
+}
+
+// Describe implements the Describe method of the prometheus.Collector
+// interface.
+func (c *claimCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.messages, c.batches, c.handoffBlocked, c.deliveryBlocked} {
+		ch <- d
+	}
+}
+
+// Collect implements the Collect method of the prometheus.Collector interface.
+func (c *claimCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c.reporter.ClaimMetrics() {
+		partition := strconv.Itoa(int(m.Partition))
+		ch <- prometheus.MustNewConstMetric(c.messages, prometheus.CounterValue, float64(m.Messages), partition)
+		ch <- prometheus.MustNewConstMetric(c.batches, prometheus.CounterValue, float64(m.Batches), partition)
+		ch <- prometheus.MustNewConstMetric(c.handoffBlocked, prometheus.CounterValue, m.HandoffBlocked.Seconds(), partition)
+		ch <- prometheus.MustNewConstMetric(c.deliveryBlocked, prometheus.CounterValue, m.DeliveryBlocked.Seconds(), partition)
+	}
+}
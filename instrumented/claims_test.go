@@ -0,0 +1,52 @@
+package instrumented
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate/kafka"
+)
+
+type claimMetricsReporter []kafka.ClaimMetrics
+
+func (r claimMetricsReporter) ClaimMetrics() []kafka.ClaimMetrics {
+	return r
+}
+
+func TestKafkaClaimCollector(t *testing.T) {
+	collector := NewKafkaClaimCollector(claimMetricsReporter{
+		{Partition: 3, Messages: 100, Batches: 4, HandoffBlocked: 2 * time.Second, DeliveryBlocked: 1500 * time.Millisecond},
+	}, "orders", prometheus.Labels{"topic": "orders"})
+	ch := make(chan prometheus.Metric, 10)
+	collector.Collect(ch)
+	close(ch)
+
+	collected := make(map[string]float64)
+	for m := range ch {
+		var metric dto.Metric
+		require.NoError(t, m.Write(&metric))
+		var partition string
+		for _, l := range metric.GetLabel() {
+			if l.GetName() == "partition" {
+				partition = l.GetValue()
+			}
+		}
+		desc := m.Desc().String()
+		name := desc[strings.Index(desc, `"`)+1:]
+		name = name[:strings.Index(name, `"`)]
+		collected[name+"/"+partition] = metric.GetCounter().GetValue()
+	}
+
+	assert.Equal(t, map[string]float64{
+		"orders_claim_messages_total/3":                 100,
+		"orders_claim_batches_total/3":                  4,
+		"orders_claim_handoff_blocked_seconds_total/3":  2,
+		"orders_claim_delivery_blocked_seconds_total/3": 1.5,
+	}, collected)
+}
@@ -0,0 +1,59 @@
+package instrumented
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/uw-labs/substrate"
+)
+
+var gaugeLabels = []string{"gauge", "topic"}
+
+var _ substrate.WindowGauges = (*Gauges)(nil)
+
+// Gauges implements substrate.Gauges, to be set with the Gauges option of the
+// kafka and proximo source and sink configs.
+// The gauge vector will have the labels "gauge" and "topic", where gauge is
+// either "in_flight", "pending_acks" or "window".
+type Gauges struct {
+	inFlight    prometheus.Gauge
+	pendingAcks prometheus.Gauge
+	window      prometheus.Gauge
+}
+
+// NewGauges returns a pointer to a new Gauges.
+func NewGauges(gaugeOpts prometheus.GaugeOpts, topic string) *Gauges {
+	gauge := prometheus.NewGaugeVec(gaugeOpts, gaugeLabels)
+
+	if err := prometheus.Register(gauge); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			gauge = are.ExistingCollector.(*prometheus.GaugeVec)
+		} else {
+			panic(err)
+		}
+	}
+
+	return newGauges(gauge, topic)
+}
+
+func newGauges(gauge *prometheus.GaugeVec, topic string) *Gauges {
+	return &Gauges{
+		inFlight:    gauge.WithLabelValues("in_flight", topic),
+		pendingAcks: gauge.WithLabelValues("pending_acks", topic),
+		window:      gauge.WithLabelValues("window", topic),
+	}
+}
+
+// SetInFlight implements substrate.Gauges.
+func (g *Gauges) SetInFlight(n int) {
+	g.inFlight.Set(float64(n))
+}
+
+// SetPendingAcks implements substrate.Gauges.
+func (g *Gauges) SetPendingAcks(n int) {
+	g.pendingAcks.Set(float64(n))
+}
+
+// SetWindow implements substrate.WindowGauges.
+func (g *Gauges) SetWindow(n int) {
+	g.window.Set(float64(n))
+}
@@ -0,0 +1,33 @@
+package instrumented
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGauges(t *testing.T) {
+	gauge := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Help: "substrate_gauges",
+			Name: "substrate_gauges",
+		}, gaugeLabels)
+	gauges := newGauges(gauge, "testTopic")
+
+	gauges.SetInFlight(3)
+	gauges.SetPendingAcks(1)
+	gauges.SetInFlight(2)
+	gauges.SetWindow(8)
+
+	for name, expected := range map[string]float64{
+		"in_flight":    2,
+		"pending_acks": 1,
+		"window":       8,
+	} {
+		var metric dto.Metric
+		assert.NoError(t, gauge.WithLabelValues(name, "testTopic").Write(&metric))
+		assert.Equal(t, expected, *metric.Gauge.Value, name)
+	}
+}
@@ -0,0 +1,103 @@
+package instrumented
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+var (
+	saramaLabels    = []string{"broker", "topic"}
+	saramaQuantiles = []float64{0.5, 0.75, 0.95, 0.99}
+	invalidNameChar = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+)
+
+// NewSaramaCollector returns a prometheus collector for the metrics sarama
+// records in the registry, such as the registry of a kafka source or sink
+// returned by the Metrics method of the kafka.MetricsReporter interface. The
+// metric names are prefixed with the namespace. Sarama records some metrics
+// per broker and per topic, suffixing their names with e.g. "-for-broker-1";
+// these are exported with a "broker" or "topic" label instead, which is empty
+// for the other metrics. Meters are exported as counters, histograms and
+// timers as summaries, and counters and gauges as gauges. The collector must
+// be registered by the caller, e.g. with prometheus.MustRegister, with
+// constLabels to tell apart the collectors of different registries.
+func NewSaramaCollector(registry metrics.Registry, namespace string, constLabels prometheus.Labels) prometheus.Collector {
+	return &saramaCollector{
+		registry:    registry,
+		namespace:   namespace,
+		constLabels: constLabels,
+	}
+}
+
+type saramaCollector struct {
+	registry    metrics.Registry
+	namespace   string
+	constLabels prometheus.Labels
+}
+
+// Describe implements the Describe method of the prometheus.Collector
+// interface. It describes no metrics, which makes the collector unchecked, as
+// sarama only registers its metrics as they are first recorded.
+func (c *saramaCollector) Describe(chan<- *prometheus.Desc) {}
+
+// Collect implements the Collect method of the prometheus.Collector interface.
+func (c *saramaCollector) Collect(ch chan<- prometheus.Metric) {
+	c.registry.Each(func(name string, metric interface{}) {
+		base, broker, topic := splitSaramaMetricName(name)
+		desc := func(suffix string) *prometheus.Desc {
+			return prometheus.NewDesc(
+				prometheus.BuildFQName(c.namespace, "", invalidNameChar.ReplaceAllString(base, "_")+suffix),
+				"Sarama metric "+base+".",
+				saramaLabels,
+				c.constLabels,
+			)
+		}
+
+		switch m := metric.(type) {
+		case metrics.Counter:
+			ch <- prometheus.MustNewConstMetric(desc(""), prometheus.GaugeValue, float64(m.Count()), broker, topic)
+		case metrics.Gauge:
+			ch <- prometheus.MustNewConstMetric(desc(""), prometheus.GaugeValue, float64(m.Value()), broker, topic)
+		case metrics.GaugeFloat64:
+			ch <- prometheus.MustNewConstMetric(desc(""), prometheus.GaugeValue, m.Value(), broker, topic)
+		case metrics.Meter:
+			ch <- prometheus.MustNewConstMetric(desc("_total"), prometheus.CounterValue, float64(m.Count()), broker, topic)
+		case metrics.Timer:
+			s := m.Snapshot()
+			ch <- prometheus.MustNewConstSummary(
+				desc("_seconds"), uint64(s.Count()), float64(s.Sum())/float64(time.Second),
+				quantiles(s.Percentiles(saramaQuantiles), float64(time.Second)), broker, topic,
+			)
+		case metrics.Histogram:
+			s := m.Snapshot()
+			ch <- prometheus.MustNewConstSummary(
+				desc(""), uint64(s.Count()), float64(s.Sum()),
+				quantiles(s.Percentiles(saramaQuantiles), 1), broker, topic,
+			)
+		}
+	})
+}
+
+// splitSaramaMetricName splits the broker or topic suffix off the name of a
+// sarama metric.
+func splitSaramaMetricName(name string) (base, broker, topic string) {
+	if i := strings.Index(name, "-for-broker-"); i >= 0 {
+		return name[:i], name[i+len("-for-broker-"):], ""
+	}
+	if i := strings.Index(name, "-for-topic-"); i >= 0 {
+		return name[:i], "", name[i+len("-for-topic-"):]
+	}
+	return name, "", ""
+}
+
+func quantiles(values []float64, unit float64) map[float64]float64 {
+	q := make(map[float64]float64, len(saramaQuantiles))
+	for i, v := range values {
+		q[saramaQuantiles[i]] = v / unit
+	}
+	return q
+}
@@ -0,0 +1,66 @@
+package instrumented
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaramaCollector(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("requests-in-flight", registry).Inc(3)
+	meter := metrics.NewMeter()
+	meter.Mark(5)
+	require.NoError(t, registry.Register("request-rate-for-broker-1", meter))
+	histogram := metrics.NewHistogram(metrics.NewUniformSample(10))
+	for _, v := range []int64{10, 20, 30} {
+		histogram.Update(v)
+	}
+	require.NoError(t, registry.Register("batch-size-for-topic-my.topic", histogram))
+
+	collector := NewSaramaCollector(registry, "kafka", prometheus.Labels{"client": "test"})
+	ch := make(chan prometheus.Metric, 10)
+	collector.Collect(ch)
+	close(ch)
+
+	collected := make(map[string]*dto.Metric)
+	for m := range ch {
+		var metric dto.Metric
+		require.NoError(t, m.Write(&metric))
+		labels := ""
+		for _, l := range metric.GetLabel() {
+			labels += l.GetName() + "=" + l.GetValue() + ","
+		}
+		collected[labels] = &metric
+	}
+	require.Len(t, collected, 3)
+
+	counter := collected["broker=,client=test,topic=,"]
+	require.NotNil(t, counter)
+	assert.Equal(t, 3.0, counter.GetGauge().GetValue())
+
+	rate := collected["broker=1,client=test,topic=,"]
+	require.NotNil(t, rate)
+	assert.Equal(t, 5.0, rate.GetCounter().GetValue())
+
+	batchSize := collected["broker=,client=test,topic=my.topic,"]
+	require.NotNil(t, batchSize)
+	assert.Equal(t, uint64(3), batchSize.GetSummary().GetSampleCount())
+	assert.Equal(t, 60.0, batchSize.GetSummary().GetSampleSum())
+	assert.Len(t, batchSize.GetSummary().GetQuantile(), len(saramaQuantiles))
+}
+
+func TestSplitSaramaMetricName(t *testing.T) {
+	for name, expected := range map[string][3]string{
+		"incoming-byte-rate":                    {"incoming-byte-rate", "", ""},
+		"request-latency-in-ms-for-broker-2":    {"request-latency-in-ms", "2", ""},
+		"record-send-rate-for-topic-some-topic": {"record-send-rate", "", "some-topic"},
+	} {
+		base, broker, topic := splitSaramaMetricName(name)
+		assert.Equal(t, expected, [3]string{base, broker, topic}, name)
+	}
+}
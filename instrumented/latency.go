@@ -0,0 +1,190 @@
+package instrumented
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/unwrap"
+	"github.com/uw-labs/substrate/kafka"
+)
+
+// PublishTimeAttribute is the attribute that the instrumented sink sets to the
+// time a message was published, in RFC 3339 format. It has the same name as
+// the header set by the kafka publish headers interceptor, so that either is
+// used by the instrumented source.
+const PublishTimeAttribute = "publish-time"
+
+var (
+	latencyLabels = []string{"stage", "topic", "timestamp_type"}
+	skewLabels    = []string{"stage", "topic"}
+)
+
+// latencyBuckets range from 1ms to about 9 minutes.
+var latencyBuckets = prometheus.ExponentialBuckets(0.001, 2, 20)
+
+const (
+	stageDelivered = "delivered"
+	stageAcked     = "acked"
+)
+
+// The timestamp types label the time latencies are measured from: the
+// PublishTimeAttribute, or the timestamp of the message, which is the time
+// kafka records were created or appended to the log, or unknown otherwise.
+const (
+	timestampPublishTime   = "publish_time"
+	timestampCreateTime    = "create_time"
+	timestampLogAppendTime = "log_append_time"
+	timestampUnknown       = "unknown"
+)
+
+// stampedMessage is a message published by the instrumented sink, with the
+// PublishTimeAttribute added to the attributes of the original message.
+type stampedMessage struct {
+	original substrate.Message
+	attrs    map[string]string
+}
+
+func stamp(msg substrate.Message, now time.Time) *stampedMessage {
+	attrs := map[string]string{}
+	for k, v := range unwrap.Attributes(msg) {
+		attrs[k] = v
+	}
+	if _, ok := attrs[PublishTimeAttribute]; !ok {
+		attrs[PublishTimeAttribute] = now.UTC().Format(time.RFC3339Nano)
+	}
+	return &stampedMessage{original: msg, attrs: attrs}
+}
+
+func (m *stampedMessage) Data() []byte {
+	return m.original.Data()
+}
+
+func (m *stampedMessage) Attributes() map[string]string {
+	return m.attrs
+}
+
+func (m *stampedMessage) Original() substrate.Message {
+	return m.original
+}
+
+// latencyRecorder records the time from the publishing of messages to their
+// delivery and acknowledgement by the instrumented source. A nil recorder
+// records nothing.
+type latencyRecorder struct {
+	latency *prometheus.HistogramVec
+	// skewed counts the messages published after they were delivered or
+	// acknowledged, going by the clocks of the publisher and consumer, which
+	// are recorded with a latency of zero.
+	skewed *prometheus.CounterVec
+	topic  string
+	now    func() time.Time
+}
+
+// newLatencyRecorder returns a recorder of metrics named after the counter of
+// the source, suffixed with "_latency_seconds" and "_clock_skew_total".
+// The vectors will have the labels "stage" and "topic", where stage is either
+// "delivered" or "acked", and the latency vector the label "timestamp_type",
+// which is "publish_time", "create_time", "log_append_time" or "unknown".
+func newLatencyRecorder(counterOpts prometheus.CounterOpts, topic string) *latencyRecorder {
+	latency := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   counterOpts.Namespace,
+		Subsystem:   counterOpts.Subsystem,
+		Name:        counterOpts.Name + "_latency_seconds",
+		Help:        "Time from the publishing of messages to their delivery and acknowledgement.",
+		ConstLabels: counterOpts.ConstLabels,
+		Buckets:     latencyBuckets,
+	}, latencyLabels)
+	if err := prometheus.Register(latency); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			latency = are.ExistingCollector.(*prometheus.HistogramVec)
+		} else {
+			panic(err)
+		}
+	}
+
+	skewed := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   counterOpts.Namespace,
+		Subsystem:   counterOpts.Subsystem,
+		Name:        counterOpts.Name + "_clock_skew_total",
+		Help:        "Messages with a publish time after their delivery or acknowledgement.",
+		ConstLabels: counterOpts.ConstLabels,
+	}, skewLabels)
+	if err := prometheus.Register(skewed); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			skewed = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			panic(err)
+		}
+	}
+	for _, stage := range []string{stageDelivered, stageAcked} {
+		skewed.WithLabelValues(stage, topic).Add(0)
+	}
+
+	return &latencyRecorder{
+		latency: latency,
+		skewed:  skewed,
+		topic:   topic,
+		now:     time.Now,
+	}
+}
+
+// observe records the latency of the message at the given stage, if its
+// publish time is known.
+func (r *latencyRecorder) observe(stage string, msg substrate.Message) {
+	if r == nil {
+		return
+	}
+	published, typ, ok := publishTime(msg)
+	if !ok {
+		return
+	}
+	latency := r.now().Sub(published)
+	if latency < 0 {
+		r.skewed.WithLabelValues(stage, r.topic).Inc()
+		latency = 0
+	}
+	r.latency.WithLabelValues(stage, r.topic, typ).Observe(latency.Seconds())
+}
+
+// publishTime returns the time a message was published, from its
+// PublishTimeAttribute, or else from its timestamp, such as the kafka record
+// timestamp, along with the type of the timestamp used.
+func publishTime(msg substrate.Message) (time.Time, string, bool) {
+	if v, ok := unwrap.Attributes(msg)[PublishTimeAttribute]; ok {
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, timestampPublishTime, true
+		}
+	}
+	for {
+		if tm, ok := msg.(substrate.TimestampedMessage); ok {
+			if ts := tm.Timestamp(); !ts.IsZero() {
+				return ts, timestampType(tm), true
+			}
+			return time.Time{}, "", false
+		}
+		am, ok := msg.(unwrap.AnnotatedMessage)
+		if !ok {
+			return time.Time{}, "", false
+		}
+		msg = am.Original()
+	}
+}
+
+// timestampType returns the type of the timestamp of a message, which is only
+// known for kafka messages.
+func timestampType(msg substrate.TimestampedMessage) string {
+	km, ok := msg.(interface{ TimestampType() kafka.TimestampType })
+	if !ok {
+		return timestampUnknown
+	}
+	switch km.TimestampType() {
+	case kafka.TimestampCreateTime:
+		return timestampCreateTime
+	case kafka.TimestampLogAppendTime:
+		return timestampLogAppendTime
+	default:
+		return timestampUnknown
+	}
+}
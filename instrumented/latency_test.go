@@ -0,0 +1,186 @@
+package instrumented
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/kafka"
+)
+
+type attributedMessage struct {
+	Message
+	attrs map[string]string
+}
+
+func (m attributedMessage) Attributes() map[string]string {
+	return m.attrs
+}
+
+type timestampedMessage struct {
+	Message
+	ts time.Time
+}
+
+func (m timestampedMessage) Timestamp() time.Time {
+	return m.ts
+}
+
+type kafkaTimestampedMessage struct {
+	timestampedMessage
+	typ kafka.TimestampType
+}
+
+func (m kafkaTimestampedMessage) TimestampType() kafka.TimestampType {
+	return m.typ
+}
+
+func TestStamp(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	msg := attributedMessage{attrs: map[string]string{"type": "created"}}
+	stamped := stamp(msg, now)
+	assert.Equal(t, map[string]string{"type": "created", PublishTimeAttribute: "2021-06-01T12:00:00Z"}, stamped.Attributes())
+	assert.Equal(t, substrate.Message(msg), stamped.Original())
+	assert.Equal(t, map[string]string{"type": "created"}, msg.attrs)
+
+	// An existing publish time is kept.
+	msg = attributedMessage{attrs: map[string]string{PublishTimeAttribute: "2021-06-01T11:00:00Z"}}
+	assert.Equal(t, "2021-06-01T11:00:00Z", stamp(msg, now).Attributes()[PublishTimeAttribute])
+}
+
+func TestLatencyRecorder(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	r := &latencyRecorder{
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "latency_seconds"}, latencyLabels),
+		skewed:  prometheus.NewCounterVec(prometheus.CounterOpts{Name: "clock_skew_total"}, skewLabels),
+		topic:   "testTopic",
+		now:     func() time.Time { return now },
+	}
+
+	r.observe(stageDelivered, stamp(Message{}, now.Add(-2*time.Second)))
+	r.observe(stageDelivered, stamp(timestampedMessage{ts: now.Add(-time.Hour)}, now.Add(-4*time.Second)))
+	r.observe(stageDelivered, timestampedMessage{ts: now.Add(-time.Second)})
+	r.observe(stageDelivered, kafkaTimestampedMessage{timestampedMessage{ts: now.Add(-3 * time.Second)}, kafka.TimestampCreateTime})
+	r.observe(stageDelivered, kafkaTimestampedMessage{timestampedMessage{ts: now.Add(-5 * time.Second)}, kafka.TimestampLogAppendTime})
+	r.observe(stageDelivered, kafkaTimestampedMessage{timestampedMessage{ts: now.Add(-time.Second)}, kafka.TimestampTypeUnknown})
+	// Messages without a publish time are not recorded.
+	r.observe(stageDelivered, Message{})
+	r.observe(stageDelivered, timestampedMessage{})
+	// Messages published in the future are recorded with a latency of zero.
+	r.observe(stageAcked, stamp(Message{}, now.Add(time.Second)))
+
+	for typ, expected := range map[string]struct {
+		count uint64
+		sum   float64
+	}{
+		timestampPublishTime:   {2, 6},
+		timestampCreateTime:    {1, 3},
+		timestampLogAppendTime: {1, 5},
+		timestampUnknown:       {2, 2},
+	} {
+		var metric dto.Metric
+		require.NoError(t, r.latency.WithLabelValues(stageDelivered, "testTopic", typ).(prometheus.Histogram).Write(&metric))
+		assert.Equal(t, expected.count, metric.Histogram.GetSampleCount(), typ)
+		assert.Equal(t, expected.sum, metric.Histogram.GetSampleSum(), typ)
+	}
+
+	var metric dto.Metric
+	require.NoError(t, r.latency.WithLabelValues(stageAcked, "testTopic", timestampPublishTime).(prometheus.Histogram).Write(&metric))
+	assert.Equal(t, uint64(1), metric.Histogram.GetSampleCount())
+	assert.Equal(t, 0.0, metric.Histogram.GetSampleSum())
+	require.NoError(t, r.skewed.WithLabelValues(stageAcked, "testTopic").Write(&metric))
+	assert.Equal(t, 1, int(metric.Counter.GetValue()))
+
+	var none *latencyRecorder
+	none.observe(stageAcked, Message{})
+}
+
+func TestSinkSetsPublishTime(t *testing.T) {
+	published := make(chan substrate.Message, 1)
+	sink := AsyncMessageSink{
+		impl: &asyncMessageSinkMock{
+			publishMessageMock: func(ctx context.Context, acks chan<- substrate.Message, messages <-chan substrate.Message) error {
+				for {
+					select {
+					case <-ctx.Done():
+						return nil
+					case msg := <-messages:
+						published <- msg
+						acks <- msg
+					}
+				}
+			},
+		},
+		counter: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "sink_counter"}, labels),
+		topic:   "testTopic",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	acks := make(chan substrate.Message)
+	messages := make(chan substrate.Message)
+	go func() {
+		_ = sink.PublishMessages(ctx, acks, messages)
+	}()
+
+	msg := Message{data: []byte("data")}
+	messages <- msg
+	m := <-published
+	_, err := time.Parse(time.RFC3339Nano, m.(substrate.AttributedMessage).Attributes()[PublishTimeAttribute])
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("data"), m.Data())
+	// The caller is acknowledged with the message it published.
+	assert.Equal(t, substrate.Message(msg), <-acks)
+}
+
+func TestSourceRecordsLatency(t *testing.T) {
+	now := time.Now()
+	acked := make(chan struct{})
+	source := AsyncMessageSource{
+		impl: &asyncMessageSourceMock{
+			consumerMessagesMock: func(ctx context.Context, messages chan<- substrate.Message, acks <-chan substrate.Message) error {
+				messages <- stamp(Message{}, now.Add(-time.Second))
+				<-acks
+				close(acked)
+				<-ctx.Done()
+				return nil
+			},
+		},
+		counter: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "source_counter"}, labels),
+		topic:   "testTopic",
+		latency: &latencyRecorder{
+			latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "latency_seconds"}, latencyLabels),
+			skewed:  prometheus.NewCounterVec(prometheus.CounterOpts{Name: "clock_skew_total"}, skewLabels),
+			topic:   "testTopic",
+			now:     func() time.Time { return now },
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	messages := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, messages, acks)
+	}()
+
+	acks <- <-messages
+	<-acked
+	cancel()
+	assert.NoError(t, <-errs)
+
+	for _, stage := range []string{stageDelivered, stageAcked} {
+		var metric dto.Metric
+		require.NoError(t, source.latency.latency.WithLabelValues(stage, "testTopic", timestampPublishTime).(prometheus.Histogram).Write(&metric))
+		assert.Equal(t, uint64(1), metric.Histogram.GetSampleCount(), stage)
+		assert.Equal(t, 1.0, metric.Histogram.GetSampleSum(), stage)
+	}
+}
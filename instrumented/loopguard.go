@@ -0,0 +1,38 @@
+package instrumented
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/uw-labs/substrate/loopguard"
+)
+
+var loopLabels = []string{"topic"}
+
+// NewLoopCounter returns loopguard.Metrics for the Metrics option of the loop
+// guard config, which counts the messages dropped as looping. The counter
+// vector will have the label "topic".
+func NewLoopCounter(counterOpts prometheus.CounterOpts, topic string) loopguard.Metrics {
+	counter := prometheus.NewCounterVec(counterOpts, loopLabels)
+
+	if err := prometheus.Register(counter); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			counter = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			panic(err)
+		}
+	}
+
+	return newLoopCounter(counter, topic)
+}
+
+func newLoopCounter(counter *prometheus.CounterVec, topic string) loopguard.Metrics {
+	return loopCounter{dropped: counter.WithLabelValues(topic)}
+}
+
+type loopCounter struct {
+	dropped prometheus.Counter
+}
+
+func (c loopCounter) Dropped() {
+	c.dropped.Inc()
+}
@@ -0,0 +1,25 @@
+package instrumented
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoopCounter(t *testing.T) {
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Help: "loops",
+			Name: "loops",
+		}, loopLabels)
+	metrics := newLoopCounter(counter, "testTopic")
+
+	metrics.Dropped()
+	metrics.Dropped()
+
+	var metric dto.Metric
+	assert.NoError(t, counter.WithLabelValues("testTopic").Write(&metric))
+	assert.Equal(t, 2, int(*metric.Counter.Value))
+}
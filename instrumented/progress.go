@@ -0,0 +1,62 @@
+package instrumented
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/uw-labs/substrate/kafka"
+)
+
+var progressLabels = []string{"partition"}
+
+// NewKafkaProgressCollector returns a prometheus collector for the progress
+// reported by a kafka source, see the kafka.ProgressReporter interface, e.g.
+// to follow a consumer catching up during disaster recovery. It exports the
+// gauges "consumed_offset", "high_water_mark", "remaining_messages",
+// "consumption_rate" and "estimated_completion_timestamp_seconds", with the
+// label "partition", prefixed with the namespace. The estimated completion is
+// omitted while the rate is zero. The collector must be registered by the
+// caller, e.g. with prometheus.MustRegister, with constLabels to tell apart
+// the collectors of different sources.
+func NewKafkaProgressCollector(reporter kafka.ProgressReporter, namespace string, constLabels prometheus.Labels) prometheus.Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, progressLabels, constLabels)
+	}
+	return &progressCollector{
+		reporter:      reporter,
+		offset:        desc("consumed_offset", "Offset of the next message to consume."),
+		highWaterMark: desc("high_water_mark", "Offset of the next message to be produced."),
+		remaining:     desc("remaining_messages", "Number of messages left to consume."),
+		rate:          desc("consumption_rate", "Messages consumed per second over the last minute."),
+		eta:           desc("estimated_completion_timestamp_seconds", "Estimated time at which the remaining messages are consumed."),
+	}
+}
+
+type progressCollector struct {
+	reporter kafka.ProgressReporter
+
+	offset, highWaterMark, remaining, rate, eta *prometheus.Desc
+}
+
+// Describe implements the Describe method of the prometheus.Collector
+// interface.
+func (c *progressCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.offset, c.highWaterMark, c.remaining, c.rate, c.eta} {
+		ch <- d
+	}
+}
+
+// Collect implements the Collect method of the prometheus.Collector interface.
+func (c *progressCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, p := range c.reporter.Progress() {
+		partition := strconv.Itoa(int(p.Partition))
+		ch <- prometheus.MustNewConstMetric(c.offset, prometheus.GaugeValue, float64(p.Offset), partition)
+		ch <- prometheus.MustNewConstMetric(c.highWaterMark, prometheus.GaugeValue, float64(p.HighWaterMark), partition)
+		ch <- prometheus.MustNewConstMetric(c.remaining, prometheus.GaugeValue, float64(p.Remaining), partition)
+		ch <- prometheus.MustNewConstMetric(c.rate, prometheus.GaugeValue, p.Rate, partition)
+		if !p.ETA.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.eta, prometheus.GaugeValue, float64(p.ETA.UnixNano())/1e9, partition)
+		}
+	}
+}
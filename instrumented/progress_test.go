@@ -0,0 +1,59 @@
+package instrumented
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate/kafka"
+)
+
+type progressReporter []kafka.PartitionProgress
+
+func (r progressReporter) Progress() []kafka.PartitionProgress {
+	return r
+}
+
+func TestKafkaProgressCollector(t *testing.T) {
+	eta := time.Unix(1622548800, 0)
+	collector := NewKafkaProgressCollector(progressReporter{
+		{Partition: 0, Offset: 10, HighWaterMark: 100, Remaining: 90, Rate: 9, ETA: eta},
+		{Partition: 1, Offset: 5, HighWaterMark: 7, Remaining: 2},
+	}, "recovery", prometheus.Labels{"topic": "orders"})
+	ch := make(chan prometheus.Metric, 20)
+	collector.Collect(ch)
+	close(ch)
+
+	collected := make(map[string]float64)
+	for m := range ch {
+		var metric dto.Metric
+		require.NoError(t, m.Write(&metric))
+		var partition string
+		for _, l := range metric.GetLabel() {
+			if l.GetName() == "partition" {
+				partition = l.GetValue()
+			}
+		}
+		desc := m.Desc().String()
+		name := desc[strings.Index(desc, `"`)+1:]
+		name = name[:strings.Index(name, `"`)]
+		collected[name+"/"+partition] = metric.GetGauge().GetValue()
+	}
+
+	assert.Equal(t, map[string]float64{
+		"recovery_consumed_offset/0":                        10,
+		"recovery_high_water_mark/0":                        100,
+		"recovery_remaining_messages/0":                     90,
+		"recovery_consumption_rate/0":                       9,
+		"recovery_estimated_completion_timestamp_seconds/0": 1622548800,
+		"recovery_consumed_offset/1":                        5,
+		"recovery_high_water_mark/1":                        7,
+		"recovery_remaining_messages/1":                     2,
+		"recovery_consumption_rate/1":                       0,
+	}, collected)
+}
@@ -0,0 +1,51 @@
+package instrumented
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/uw-labs/substrate/proximo"
+)
+
+var eventLabels = []string{"event", "topic"}
+
+// NewProximoEventCounter returns a callback for the Events option of the
+// proximo source and sink configs, which counts the connection events.
+// The counter vector will have the labels "event" and "topic", and events
+// dropped because of a slow callback are counted with the event "dropped".
+// The returned callback should only be used by a single source or sink.
+func NewProximoEventCounter(counterOpts prometheus.CounterOpts, topic string) func(proximo.Event) {
+	counter := prometheus.NewCounterVec(counterOpts, eventLabels)
+
+	if err := prometheus.Register(counter); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			counter = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			panic(err)
+		}
+	}
+	for _, t := range []proximo.EventType{proximo.EventConnected, proximo.EventDisconnected, proximo.EventRetrying, proximo.EventResumed} {
+		counter.WithLabelValues(t.String(), topic).Add(0)
+	}
+	counter.WithLabelValues("dropped", topic).Add(0)
+
+	return newProximoEventCounter(counter, topic)
+}
+
+func newProximoEventCounter(counter *prometheus.CounterVec, topic string) func(proximo.Event) {
+	var (
+		mu      sync.Mutex
+		dropped uint64
+	)
+	return func(ev proximo.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if ev.Dropped > dropped {
+			counter.WithLabelValues("dropped", topic).Add(float64(ev.Dropped - dropped))
+			dropped = ev.Dropped
+		}
+		counter.WithLabelValues(ev.Type.String(), topic).Inc()
+	}
+}
@@ -0,0 +1,39 @@
+package instrumented
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/uw-labs/substrate/proximo"
+)
+
+func TestProximoEventCounter(t *testing.T) {
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Help: "proximo_events",
+			Name: "proximo_events",
+		}, eventLabels)
+	callback := newProximoEventCounter(counter, "testTopic")
+
+	callback(proximo.Event{Type: proximo.EventConnected})
+	callback(proximo.Event{Type: proximo.EventDisconnected, Err: errors.New("stream failed")})
+	callback(proximo.Event{Type: proximo.EventRetrying, Attempt: 1, Dropped: 2})
+	callback(proximo.Event{Type: proximo.EventRetrying, Attempt: 2, Dropped: 2})
+	callback(proximo.Event{Type: proximo.EventResumed, Attempt: 2, Dropped: 3})
+
+	for event, expected := range map[string]int{
+		"connected":    1,
+		"disconnected": 1,
+		"retrying":     2,
+		"resumed":      1,
+		"dropped":      3,
+	} {
+		var metric dto.Metric
+		assert.NoError(t, counter.WithLabelValues(event, "testTopic").Write(&metric))
+		assert.Equal(t, expected, int(*metric.Counter.Value), event)
+	}
+}
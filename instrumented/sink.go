@@ -3,6 +3,7 @@ package instrumented
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/uw-labs/substrate"
@@ -12,10 +13,14 @@ var labels = []string{"status", "topic"}
 
 // AsyncMessageSink is an instrumented message sink
 // The counter vector will have the labels "status" and "topic"
+// Published messages are given a PublishTimeAttribute, unless they already
+// have one, for the instrumented source to record their latency.
 type AsyncMessageSink struct {
 	impl    substrate.AsyncMessageSink
 	counter *prometheus.CounterVec
 	topic   string
+	// noPublishTime disables setting the PublishTimeAttribute.
+	noPublishTime bool
 }
 
 // NewAsyncMessageSink returns a pointer to a new AsyncMessageSink
@@ -39,10 +44,32 @@ func NewAsyncMessageSink(sink substrate.AsyncMessageSink, counterOpts prometheus
 	}
 }
 
+// SinkMiddleware returns a middleware wrapping sinks with NewAsyncMessageSink,
+// for substrate.ChainSink.
+func SinkMiddleware(counterOpts prometheus.CounterOpts, topic string) substrate.SinkMiddleware {
+	return func(sink substrate.AsyncMessageSink) substrate.AsyncMessageSink {
+		return NewAsyncMessageSink(sink, counterOpts, topic)
+	}
+}
+
+// DisablePublishTime disables setting the PublishTimeAttribute of published
+// messages, e.g. for topics whose attributes must not be changed. It must be
+// called before PublishMessages.
+func (ams *AsyncMessageSink) DisablePublishTime() {
+	ams.noPublishTime = true
+}
+
 // PublishMessages implements message publshing wrapped in instrumentation
 func (ams *AsyncMessageSink) PublishMessages(ctx context.Context, acks chan<- substrate.Message, messages <-chan substrate.Message) (rerr error) {
 	successes := make(chan substrate.Message, cap(acks))
 
+	if !ams.noPublishTime {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		messages = stampMessages(ctx, messages)
+	}
+
 	errs := make(chan error)
 	go func() {
 		defer close(errs)
@@ -52,6 +79,9 @@ func (ams *AsyncMessageSink) PublishMessages(ctx context.Context, acks chan<- su
 	for {
 		select {
 		case success := <-successes:
+			if sm, ok := success.(*stampedMessage); ok {
+				success = sm.original
+			}
 			ams.counter.WithLabelValues("success", ams.topic).Inc()
 			select {
 			case acks <- success:
@@ -74,6 +104,27 @@ func (ams *AsyncMessageSink) PublishMessages(ctx context.Context, acks chan<- su
 	}
 }
 
+// stampMessages returns a channel of the messages received from messages with
+// their PublishTimeAttribute set, until the context is done.
+func stampMessages(ctx context.Context, messages <-chan substrate.Message) <-chan substrate.Message {
+	stamped := make(chan substrate.Message, cap(messages))
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-messages:
+				select {
+				case stamped <- stamp(msg, time.Now()):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return stamped
+}
+
 func isUnexpectedError(err error) bool {
 	switch {
 	case err == nil:
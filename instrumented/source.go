@@ -7,12 +7,28 @@ import (
 	"github.com/uw-labs/substrate"
 )
 
+var _ substrate.Pausable = (*AsyncMessageSource)(nil)
+
 // AsyncMessageSource is an instrumented message source
 // The counter vector will have the labels "status" and "topic"
+// The latency of messages from their publishing to their delivery and
+// acknowledgement is recorded in a histogram vector, named after the counter
+// with the suffix "_latency_seconds", using the PublishTimeAttribute set by the
+// instrumented sink, or else the timestamp of the message, such as the kafka
+// record timestamp. Messages published after their delivery or
+// acknowledgement, going by the clocks of the publisher and consumer, are
+// recorded with a latency of zero, and counted in a counter vector with the
+// suffix "_clock_skew_total". Both vectors will have the labels "stage" and
+// "topic", where stage is either "delivered" or "acked". The histogram vector
+// will also have the label "timestamp_type", telling what the latency was
+// measured from: "publish_time" for the PublishTimeAttribute, "create_time"
+// or "log_append_time" for the timestamps of kafka topics, depending on their
+// message.timestamp.type, or "unknown".
 type AsyncMessageSource struct {
 	impl    substrate.AsyncMessageSource
 	counter *prometheus.CounterVec
 	topic   string
+	latency *latencyRecorder
 }
 
 // NewAsyncMessageSource returns a pointer to a new AsyncMessageSource
@@ -33,17 +49,40 @@ func NewAsyncMessageSource(source substrate.AsyncMessageSource, counterOpts prom
 		impl:    source,
 		counter: counter,
 		topic:   topic,
+		latency: newLatencyRecorder(counterOpts, topic),
+	}
+}
+
+// SourceMiddleware returns a middleware wrapping sources with
+// NewAsyncMessageSource, for substrate.ChainSource.
+func SourceMiddleware(counterOpts prometheus.CounterOpts, topic string) substrate.SourceMiddleware {
+	return func(source substrate.AsyncMessageSource) substrate.AsyncMessageSource {
+		return NewAsyncMessageSource(source, counterOpts, topic)
 	}
 }
 
+// DisableLatency disables the recording of latencies. It must be called
+// before ConsumeMessages.
+func (ams *AsyncMessageSource) DisableLatency() {
+	ams.latency = nil
+}
+
 // ConsumeMessages implements message consuming wrapped in instrumentation
 func (ams *AsyncMessageSource) ConsumeMessages(ctx context.Context, messages chan<- substrate.Message, acks <-chan substrate.Message) error {
 	toBeAcked := make(chan substrate.Message, cap(acks))
 
+	delivered := messages
+	if ams.latency != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		delivered = ams.observeDeliveries(ctx, messages)
+	}
+
 	errs := make(chan error)
 	go func() {
 		defer close(errs)
-		errs <- ams.impl.ConsumeMessages(ctx, messages, toBeAcked)
+		errs <- ams.impl.ConsumeMessages(ctx, delivered, toBeAcked)
 	}()
 
 	for {
@@ -60,6 +99,7 @@ func (ams *AsyncMessageSource) ConsumeMessages(ctx context.Context, messages cha
 				return err
 			}
 			ams.counter.WithLabelValues("success", ams.topic).Inc()
+			ams.latency.observe(stageAcked, ack)
 		case <-ctx.Done():
 			return <-errs
 		case err := <-errs:
@@ -71,6 +111,29 @@ func (ams *AsyncMessageSource) ConsumeMessages(ctx context.Context, messages cha
 	}
 }
 
+// observeDeliveries returns the channel to pass to the wrapped source, whose
+// messages are passed on to messages, recording their latency as they are
+// delivered, until the context is done.
+func (ams *AsyncMessageSource) observeDeliveries(ctx context.Context, messages chan<- substrate.Message) chan<- substrate.Message {
+	delivered := make(chan substrate.Message, cap(messages))
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-delivered:
+				select {
+				case messages <- msg:
+					ams.latency.observe(stageDelivered, msg)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return delivered
+}
+
 // Close closes the message source
 func (ams *AsyncMessageSource) Close() error {
 	return ams.impl.Close()
@@ -80,3 +143,21 @@ func (ams *AsyncMessageSource) Close() error {
 func (ams *AsyncMessageSource) Status() (*substrate.Status, error) {
 	return ams.impl.Status()
 }
+
+// Pause pauses the wrapped source, or returns substrate.ErrPauseNotSupported
+// if it does not implement substrate.Pausable.
+func (ams *AsyncMessageSource) Pause() error {
+	if p, ok := ams.impl.(substrate.Pausable); ok {
+		return p.Pause()
+	}
+	return substrate.ErrPauseNotSupported
+}
+
+// Resume resumes the wrapped source, or returns
+// substrate.ErrPauseNotSupported if it does not implement substrate.Pausable.
+func (ams *AsyncMessageSource) Resume() error {
+	if p, ok := ams.impl.(substrate.Pausable); ok {
+		return p.Resume()
+	}
+	return substrate.ErrPauseNotSupported
+}
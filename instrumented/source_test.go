@@ -173,3 +173,31 @@ func TestConsumeOnBackendShutdown(t *testing.T) {
 		assert.Equal(t, 1, int(*metric.Counter.Value))
 	}
 }
+
+type pausableSourceMock struct {
+	substrate.AsyncMessageSource
+	paused bool
+}
+
+func (m *pausableSourceMock) Pause() error {
+	m.paused = true
+	return nil
+}
+
+func (m *pausableSourceMock) Resume() error {
+	m.paused = false
+	return nil
+}
+
+func TestPause(t *testing.T) {
+	impl := &pausableSourceMock{}
+	source := AsyncMessageSource{impl: impl}
+	assert.NoError(t, source.Pause())
+	assert.True(t, impl.paused)
+	assert.NoError(t, source.Resume())
+	assert.False(t, impl.paused)
+
+	source = AsyncMessageSource{impl: &asyncMessageSourceMock{}}
+	assert.Equal(t, substrate.ErrPauseNotSupported, source.Pause())
+	assert.Equal(t, substrate.ErrPauseNotSupported, source.Resume())
+}
@@ -0,0 +1,68 @@
+// Package clock abstracts the passing of time, so that code waiting for
+// timers can be tested with a fake clock, see testutil.FakeClock.
+package clock
+
+import "time"
+
+// Clock tells the time and creates timers and tickers.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a time.Timer of a Clock.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is a time.Ticker of a Clock.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the clock of the time package.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// Until returns the duration until t, going by the clock.
+func Until(c Clock, t time.Time) time.Duration {
+	return t.Sub(c.Now())
+}
+
+// Since returns the time elapsed since t, going by the clock.
+func Since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
@@ -0,0 +1,156 @@
+// Package flush implements the tracking of published messages that sinks use
+// to implement the substrate.Flushable interface.
+package flush
+
+import (
+	"context"
+	"sync"
+)
+
+// Tracker counts the messages received by a sink and the acknowledgements
+// passed back to the caller, so that Flush can wait for the messages in
+// flight. The zero value is ready to use.
+//
+// The loop receiving the messages of the sink also receives the requests of
+// Flush, and passes them to Mark, so that the messages received before Flush
+// is called are counted before its request is.
+type Tracker struct {
+	mu sync.Mutex
+	// submitted and resolved are the number of messages received, and of
+	// messages either acknowledged or failed, since the sink was created.
+	submitted, resolved uint64
+	running             bool
+	// failures is the number of times publishing terminated with messages
+	// in flight, and err is the error it last terminated with.
+	failures int
+	err      error
+	// changed is closed and replaced whenever the counts change, and
+	// stopped is closed when publishing terminates.
+	changed  chan struct{}
+	stopped  chan struct{}
+	requests chan chan<- uint64
+}
+
+// Start is called when publishing starts, before the receiving loop starts.
+func (t *Tracker) Start() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.requests == nil {
+		t.requests = make(chan chan<- uint64)
+	}
+	t.running = true
+	t.stopped = make(chan struct{})
+}
+
+// Requests returns the channel of the requests of Flush, which the receiving
+// loop passes to Mark.
+func (t *Tracker) Requests() <-chan chan<- uint64 {
+	return t.requests
+}
+
+// Mark marks the messages that a request of Flush waits for, which are the
+// ones received so far.
+func (t *Tracker) Mark(req chan<- uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	req <- t.submitted
+}
+
+// Submitted is called for every message received from the caller.
+func (t *Tracker) Submitted() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.submitted++
+}
+
+// Acked is called for every acknowledgement passed back to the caller.
+func (t *Tracker) Acked() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.resolved++
+	t.notify()
+}
+
+// Stop is called with the error publishing terminated with. The messages in
+// flight are failed with it.
+func (t *Tracker) Stop(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.running = false
+	close(t.stopped)
+	if t.resolved < t.submitted {
+		t.resolved = t.submitted
+		t.failures++
+		t.err = err
+		t.notify()
+	} else {
+		t.err = nil
+	}
+}
+
+func (t *Tracker) notify() {
+	if t.changed != nil {
+		close(t.changed)
+		t.changed = nil
+	}
+}
+
+// Flush blocks until all the messages received before the call have been
+// acknowledged or failed, or until the context is done. It returns the error
+// publishing terminated with if messages were failed, including when
+// publishing already terminated with messages in flight and has not started
+// again.
+func (t *Tracker) Flush(ctx context.Context) error {
+	t.mu.Lock()
+	if !t.running {
+		defer t.mu.Unlock()
+		return t.err
+	}
+	requests, stopped, failures := t.requests, t.stopped, t.failures
+	t.mu.Unlock()
+
+	req := make(chan uint64, 1)
+	var target uint64
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-stopped:
+		return t.failure(failures)
+	case requests <- req:
+		target = <-req
+	}
+
+	t.mu.Lock()
+	for t.resolved < target {
+		if t.changed == nil {
+			t.changed = make(chan struct{})
+		}
+		changed := t.changed
+		t.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		t.mu.Lock()
+	}
+	t.mu.Unlock()
+	return t.failure(failures)
+}
+
+// failure returns the error publishing last terminated with, if it
+// terminated with messages in flight since failures were counted.
+func (t *Tracker) failure(failures int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.failures != failures {
+		return t.err
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package flush
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serve passes the requests of Flush to Mark, as the receiving loop of a sink
+// does, until the test ends.
+func serve(t *testing.T, tr *Tracker) {
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case req := <-tr.Requests():
+				tr.Mark(req)
+			}
+		}
+	}()
+}
+
+func flushAsync(t *Tracker) <-chan error {
+	errs := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		errs <- t.Flush(ctx)
+	}()
+	return errs
+}
+
+func TestFlushWaitsForAcks(t *testing.T) {
+	var tr Tracker
+	tr.Start()
+	serve(t, &tr)
+	tr.Submitted()
+	tr.Submitted()
+
+	errs := flushAsync(&tr)
+	tr.Acked()
+	select {
+	case err := <-errs:
+		t.Fatalf("flush returned before all messages were acknowledged: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Messages submitted after the call are not waited for.
+	tr.Submitted()
+	tr.Acked()
+	assert.NoError(t, <-errs)
+}
+
+func TestFlushDeadline(t *testing.T) {
+	var tr Tracker
+	tr.Start()
+	serve(t, &tr)
+	tr.Submitted()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, tr.Flush(ctx))
+}
+
+func TestFlushWithoutMessages(t *testing.T) {
+	var tr Tracker
+	assert.NoError(t, tr.Flush(context.Background()))
+
+	tr.Start()
+	serve(t, &tr)
+	tr.Submitted()
+	tr.Acked()
+	tr.Stop(context.Canceled)
+	assert.NoError(t, tr.Flush(context.Background()))
+}
+
+func TestFlushFailure(t *testing.T) {
+	failure := errors.New("broker unavailable")
+
+	var tr Tracker
+	tr.Start()
+	serve(t, &tr)
+	tr.Submitted()
+	errs := flushAsync(&tr)
+	tr.Stop(failure)
+	assert.Equal(t, failure, <-errs)
+
+	// The failure is reported until publishing starts again.
+	assert.Equal(t, failure, tr.Flush(context.Background()))
+	tr.Start()
+	assert.NoError(t, tr.Flush(context.Background()))
+}
@@ -0,0 +1,21 @@
+package helper
+
+import (
+	"time"
+
+	"github.com/uw-labs/substrate"
+)
+
+// GaugesInterval is how often the gauges of sources and sinks are sampled.
+var GaugesInterval = time.Second
+
+// GaugeTicks returns a channel that ticks every GaugesInterval, at which the
+// gauges should be sampled, and a function stopping it. If gauges is nil, the
+// returned channel never ticks.
+func GaugeTicks(gauges substrate.Gauges) (<-chan time.Time, func()) {
+	if gauges == nil {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(GaugesInterval)
+	return ticker.C, ticker.Stop
+}
@@ -4,20 +4,33 @@ import (
 	"context"
 
 	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/flush"
 	"golang.org/x/sync/errgroup"
 )
 
-var _ substrate.AsyncMessageSink = (*AckOrderingSink)(nil)
+var (
+	_ substrate.AsyncMessageSink = (*AckOrderingSink)(nil)
+	_ substrate.Flushable        = (*AckOrderingSink)(nil)
+)
 
 func NewAckOrderingSink(sink substrate.AsyncMessageSink) *AckOrderingSink {
-	return &AckOrderingSink{sink}
+	return &AckOrderingSink{innerSink: sink}
 }
 
 type AckOrderingSink struct {
 	innerSink substrate.AsyncMessageSink
+	// Gauges, if set, is sampled with the number of messages awaiting
+	// their acknowledgement, and of the acknowledgements not yet received
+	// by the caller.
+	Gauges substrate.Gauges
+
+	flushes flush.Tracker
 }
 
-func (s *AckOrderingSink) PublishMessages(ctx context.Context, acks chan<- substrate.Message, messages <-chan substrate.Message) error {
+func (s *AckOrderingSink) PublishMessages(ctx context.Context, acks chan<- substrate.Message, messages <-chan substrate.Message) (err error) {
+	s.flushes.Start()
+	defer func() { s.flushes.Stop(err) }()
+
 	eg, ctx := errgroup.WithContext(ctx)
 
 	fromInner := make(chan substrate.Message, 1024)
@@ -32,7 +45,10 @@ func (s *AckOrderingSink) PublishMessages(ctx context.Context, acks chan<- subst
 	eg.Go(func() error {
 		for {
 			select {
+			case req := <-s.flushes.Requests():
+				s.flushes.Mark(req)
 			case m := <-messages:
+				s.flushes.Submitted()
 				select {
 				case needAcks <- m:
 				case <-ctx.Done():
@@ -52,8 +68,13 @@ func (s *AckOrderingSink) PublishMessages(ctx context.Context, acks chan<- subst
 	eg.Go(func() error {
 		needed := make([]substrate.Message, 0, 1024)
 		gotAcks := make(map[substrate.Message]struct{}, 1024)
+		ticks, stop := GaugeTicks(s.Gauges)
+		defer stop()
 		for {
 			select {
+			case <-ticks:
+				s.Gauges.SetInFlight(len(needed) + len(needAcks))
+				s.Gauges.SetPendingAcks(len(gotAcks) + len(fromInner) + len(acks))
 			case m := <-needAcks:
 				needed = append(needed, m)
 			case a, ok := <-fromInner:
@@ -67,9 +88,13 @@ func (s *AckOrderingSink) PublishMessages(ctx context.Context, acks chan<- subst
 
 			for len(gotAcks) > 0 && len(needed) != 0 && contains(gotAcks, needed[0]) {
 				select {
+				case <-ticks:
+					s.Gauges.SetInFlight(len(needed) + len(needAcks))
+					s.Gauges.SetPendingAcks(len(gotAcks) + len(fromInner) + len(acks))
 				case m := <-needAcks:
 					needed = append(needed, m)
 				case acks <- needed[0]:
+					s.flushes.Acked()
 					delete(gotAcks, needed[0])
 					needed = needed[1:]
 				case <-ctx.Done():
@@ -87,6 +112,11 @@ func contains(msgs map[substrate.Message]struct{}, msg substrate.Message) bool {
 	return ok
 }
 
+// Flush implements the substrate.Flushable interface.
+func (s *AckOrderingSink) Flush(ctx context.Context) error {
+	return s.flushes.Flush(ctx)
+}
+
 func (s *AckOrderingSink) Close() error {
 	return s.innerSink.Close()
 }
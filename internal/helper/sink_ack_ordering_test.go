@@ -2,12 +2,14 @@ package helper
 
 import (
 	"context"
+	"errors"
 	"math/rand"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/testshared"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -86,3 +88,113 @@ func (s *mockSink) PublishMessages(ctx context.Context, acks chan<- substrate.Me
 func (s *mockSink) Status() (*substrate.Status, error) {
 	return &substrate.Status{Working: true}, nil
 }
+
+func TestAckOrderingSinkGauges(t *testing.T) {
+	defer func(interval time.Duration) {
+		GaugesInterval = interval
+	}(GaugesInterval)
+	GaugesInterval = 10 * time.Millisecond
+
+	gauges := &testshared.Gauges{}
+	sink := NewAckOrderingSink(&mockSink{})
+	sink.Gauges = gauges
+
+	ctx, cancel := context.WithCancel(context.Background())
+	eg, ctx := errgroup.WithContext(ctx)
+
+	msgs := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+
+	eg.Go(func() error {
+		return sink.PublishMessages(ctx, acks, msgs)
+	})
+
+	var messages []*myMessage
+	for i := 0; i < 5; i++ {
+		m := &myMessage{byte(i)}
+		messages = append(messages, m)
+		msgs <- m
+	}
+
+	// The acknowledgements are pending until they are received.
+	assert.Eventually(t, func() bool {
+		inFlight, pendingAcks := gauges.Values()
+		return inFlight == 5 && pendingAcks == 5
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for _, m := range messages {
+		assert.Equal(t, m, <-acks)
+	}
+	assert.Eventually(t, func() bool {
+		inFlight, pendingAcks := gauges.Values()
+		return inFlight == 0 && pendingAcks == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.Equal(t, context.Canceled, eg.Wait())
+}
+
+// slowSink acknowledges the messages published to it once they are
+// released, and terminates with the error sent on fail.
+type slowSink struct {
+	mockSink
+	release chan struct{}
+	fail    chan error
+}
+
+func (s *slowSink) PublishMessages(ctx context.Context, acks chan<- substrate.Message, messages <-chan substrate.Message) error {
+	var toAck []substrate.Message
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-s.fail:
+			return err
+		case m := <-messages:
+			toAck = append(toAck, m)
+		case <-s.release:
+			for _, a := range toAck {
+				acks <- a
+			}
+			toAck = toAck[:0]
+		}
+	}
+}
+
+func TestAckOrderingSinkFlush(t *testing.T) {
+	inner := &slowSink{release: make(chan struct{}), fail: make(chan error)}
+	sink := NewAckOrderingSink(inner)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgs := make(chan substrate.Message)
+	acks := make(chan substrate.Message, 10)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishMessages(ctx, acks, msgs)
+	}()
+
+	for i := 0; i < 3; i++ {
+		msgs <- &myMessage{byte(i)}
+	}
+
+	// The broker is slow to acknowledge the messages.
+	flushCtx, flushCancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	assert.Equal(t, context.DeadlineExceeded, sink.Flush(flushCtx))
+	flushCancel()
+
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- sink.Flush(ctx)
+	}()
+	inner.release <- struct{}{}
+	assert.NoError(t, <-flushed)
+	assert.Len(t, acks, 3)
+
+	// Messages in flight when publishing fails are failed.
+	msgs <- &myMessage{3}
+	failure := errors.New("broker unavailable")
+	inner.fail <- failure
+	assert.Equal(t, failure, <-errs)
+	assert.Equal(t, failure, sink.Flush(ctx))
+}
@@ -0,0 +1,103 @@
+// Package options resolves the functional options of the backends into their
+// config structs, so that both styles of configuration coexist.
+//
+// Every option records settings, each of which sets a group of fields of a
+// config. Options are order-independent: two settings of the same group, such
+// as a key function and a partition function, conflict rather than the last
+// one winning, unless one of them is an override, which takes precedence.
+package options
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/uw-labs/substrate/internal/validate"
+)
+
+// Setting is a value set by an option.
+type Setting struct {
+	// Option is the name of the option, e.g. "WithTopic".
+	Option string
+	// Group is the group of fields set. Settings of the same group
+	// conflict, unless one of them is an override.
+	Group string
+	// Override marks the settings of the options given to Overrides, which
+	// take precedence over the others of their group.
+	Override bool
+	// Apply sets the value on conf, a pointer to a config struct, and
+	// returns whether the option is an option of that config.
+	Apply func(conf interface{}) bool
+}
+
+// Resolve applies the settings to the config struct pointed to by conf, and
+// returns an error listing the settings that conflict or don't apply to it,
+// if any, in which case conf is left as it is.
+func Resolve(backend string, conf interface{}, settings []Setting) error {
+	config := reflect.TypeOf(conf).Elem().Name()
+	p := validate.New(backend, config)
+
+	// The settings of a group are taken from the overrides if there are
+	// any, and from the other options otherwise.
+	groups := make(map[string][]Setting)
+	for _, s := range settings {
+		current := groups[s.Group]
+		switch {
+		case len(current) == 0 || current[0].Override == s.Override:
+			groups[s.Group] = append(current, s)
+		case s.Override:
+			groups[s.Group] = []Setting{s}
+		}
+	}
+
+	names := make([]string, 0, len(groups))
+	for group := range groups {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+
+	var resolved []Setting
+	for _, group := range names {
+		gs := groups[group]
+		where := ""
+		if gs[0].Override {
+			where = " in Overrides"
+		}
+		switch options := distinctOptions(gs); {
+		case len(options) > 1:
+			p.Add("%s conflicts with %s%s", options[0], options[1], where)
+		case len(gs) > 1:
+			p.Add("%s is given more than once%s", options[0], where)
+		default:
+			resolved = append(resolved, gs[0])
+		}
+	}
+
+	// The settings are applied to a copy, so that conf is left as it is
+	// on error.
+	applied := reflect.New(reflect.TypeOf(conf).Elem())
+	applied.Elem().Set(reflect.ValueOf(conf).Elem())
+	for _, s := range resolved {
+		if !s.Apply(applied.Interface()) {
+			p.Add("%s is not an option of %s", s.Option, config)
+		}
+	}
+	if err := p.Err(); err != nil {
+		return err
+	}
+	reflect.ValueOf(conf).Elem().Set(applied.Elem())
+	return nil
+}
+
+// distinctOptions returns the sorted names of the options of the settings.
+func distinctOptions(settings []Setting) []string {
+	var options []string
+	seen := make(map[string]bool)
+	for _, s := range settings {
+		if !seen[s.Option] {
+			seen[s.Option] = true
+			options = append(options, s.Option)
+		}
+	}
+	sort.Strings(options)
+	return options
+}
@@ -0,0 +1,138 @@
+package options
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testConfig struct {
+	Topic   string
+	Brokers []string
+	Key     string
+	Group   string
+}
+
+type otherConfig struct{}
+
+func set(option, group string, override bool, apply func(*testConfig)) Setting {
+	return Setting{
+		Option:   option,
+		Group:    group,
+		Override: override,
+		Apply: func(conf interface{}) bool {
+			c, ok := conf.(*testConfig)
+			if ok {
+				apply(c)
+			}
+			return ok
+		},
+	}
+}
+
+func withTopic(topic string, override bool) Setting {
+	return set("WithTopic", "Topic", override, func(c *testConfig) { c.Topic = topic })
+}
+
+func withKey(key string, override bool) Setting {
+	return set("WithKey", "partitioning", override, func(c *testConfig) { c.Key = key })
+}
+
+func withGroup(group string, override bool) Setting {
+	return set("WithGroup", "partitioning", override, func(c *testConfig) { c.Group = group })
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings []Setting
+		expected testConfig
+		err      string
+	}{
+		{
+			name:     "settings",
+			settings: []Setting{withTopic("t1", false), withKey("k1", false)},
+			expected: testConfig{Topic: "t1", Key: "k1"},
+		},
+		{
+			name:     "override",
+			settings: []Setting{withTopic("t2", true), withTopic("t1", false)},
+			expected: testConfig{Topic: "t2"},
+		},
+		{
+			name:     "override replaces the group",
+			settings: []Setting{withKey("k1", false), withGroup("g1", true)},
+			expected: testConfig{Group: "g1"},
+		},
+		{
+			name:     "overridden settings don't conflict",
+			settings: []Setting{withKey("k1", false), withGroup("g1", false), withKey("k2", true)},
+			expected: testConfig{Key: "k2"},
+		},
+		{
+			name:     "given twice",
+			settings: []Setting{withTopic("t1", false), withTopic("t2", false)},
+			err:      "test: WithTopic is given more than once",
+		},
+		{
+			name:     "conflict",
+			settings: []Setting{withKey("k1", false), withGroup("g1", false)},
+			err:      "test: WithGroup conflicts with WithKey",
+		},
+		{
+			name:     "conflict in overrides",
+			settings: []Setting{withTopic("t1", true), withTopic("t2", true)},
+			err:      "test: WithTopic is given more than once in Overrides",
+		},
+		{
+			name: "every problem",
+			settings: []Setting{
+				withTopic("t1", false), withTopic("t2", false),
+				withGroup("g1", false), withKey("k1", false),
+			},
+			err: "2 problems: " +
+				"test: WithTopic is given more than once; " +
+				"test: WithGroup conflicts with WithKey",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			// The settings are order-independent.
+			for _, settings := range [][]Setting{tst.settings, reversed(tst.settings)} {
+				var c testConfig
+				err := Resolve("test", &c, settings)
+				if tst.err != "" {
+					assert.EqualError(t, err, tst.err)
+					assert.Equal(t, testConfig{}, c)
+					continue
+				}
+				assert.NoError(t, err)
+				assert.Equal(t, tst.expected, c)
+			}
+		})
+	}
+}
+
+func TestResolveNotAnOption(t *testing.T) {
+	var c otherConfig
+	err := Resolve("test", &c, []Setting{withTopic("t1", false)})
+	assert.EqualError(t, err, "test: WithTopic is not an option of otherConfig")
+}
+
+func TestResolveKeepsSetFields(t *testing.T) {
+	c := testConfig{Topic: "t1", Brokers: []string{"b1"}}
+	assert.NoError(t, Resolve("test", &c, []Setting{withKey("k1", false)}))
+	assert.Equal(t, testConfig{Topic: "t1", Brokers: []string{"b1"}, Key: "k1"}, c)
+
+	assert.Error(t, Resolve("test", &c, []Setting{withKey("k2", false), withKey("k3", false)}))
+	assert.Equal(t, "k1", c.Key)
+}
+
+func reversed(settings []Setting) []Setting {
+	r := make([]Setting, len(settings))
+	for i, s := range settings {
+		r[len(settings)-1-i] = s
+	}
+	return r
+}
@@ -0,0 +1,455 @@
+//go:build faults
+// +build faults
+
+package testshared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/toxiproxy"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/substrate"
+)
+
+// FaultTestServer is a TestServer whose producers and consumers connect
+// through a toxiproxy proxy, so that network faults can be injected.
+type FaultTestServer interface {
+	TestServer
+	Proxy() *toxiproxy.Proxy
+}
+
+const (
+	// faultTestTimeout bounds each fault test, so that a source or sink that
+	// hangs under faults fails the test instead of blocking forever.
+	faultTestTimeout = 3 * time.Minute
+	// partitionDuration is the time the network is cut off for.
+	partitionDuration = 10 * time.Second
+	// ackGrace is the time after an acknowledgement during which a
+	// connection reset may lose it, e.g. before the offset is committed.
+	ackGrace = 2 * time.Second
+	// shutdownTimeout bounds the time a cancelled source or sink takes to
+	// return, or a source or sink takes to close.
+	shutdownTimeout = 30 * time.Second
+)
+
+// TestFaults runs the network fault tests as sub-tests. The proxy is
+// restored and its toxics removed after each of them. The tests are only built
+// with the faults tag, e.g. go test -tags faults ./kafka ./proximo.
+func TestFaults(t *testing.T, ts FaultTestServer) {
+	t.Helper()
+
+	for _, x := range []func(t *testing.T, ts FaultTestServer){
+		testPublishDuringPartition,
+		testConsumeDuringConnectionResets,
+		testStatusDuringPartition,
+	} {
+		f := func(t *testing.T) {
+			x(t, ts)
+		}
+		t.Run(runtime.FuncForPC(reflect.ValueOf(x).Pointer()).Name(), f)
+		restoreProxy(t, ts.Proxy())
+		ts.TestEnd()
+	}
+}
+
+func restoreProxy(t *testing.T, proxy *toxiproxy.Proxy) {
+	proxy.Toxics.ResetToxics()
+	if err := proxy.Start(); err != nil && err != toxiproxy.ErrProxyAlreadyStarted {
+		t.Fatalf("failed to restore proxy: %s", err)
+	}
+}
+
+// testPublishDuringPartition publishes messages while the network is cut off.
+// Every message must either be acknowledged, or the sink must return an error,
+// and no acknowledged message may be lost.
+func testPublishDuringPartition(t *testing.T, ts FaultTestServer) {
+	topic := generateID()
+	proxy := ts.Proxy()
+
+	ctx, cancel := context.WithTimeout(context.Background(), faultTestTimeout)
+	defer cancel()
+
+	prod := ts.NewProducer(topic)
+	defer prod.Close()
+
+	prodCtx, prodCancel := context.WithCancel(ctx)
+	defer prodCancel()
+	prodMsgs := make(chan substrate.Message)
+	prodAcks := make(chan substrate.Message, 1024)
+	prodErrs := make(chan error, 1)
+	go func() {
+		prodErrs <- prod.PublishMessages(prodCtx, prodAcks, prodMsgs)
+	}()
+
+	var (
+		sent     = make(map[substrate.Message]string)
+		acked    = make(map[string]bool)
+		next     substrate.Message
+		prodErr  error
+		ticker   = time.NewTicker(20 * time.Millisecond)
+		cutOff   = time.After(2 * time.Second)
+		restored <-chan time.Time
+		done     = time.After(partitionDuration + 5*time.Second)
+	)
+	defer ticker.Stop()
+
+	ack := func(msg substrate.Message) {
+		payload, ok := sent[msg]
+		switch {
+		case !ok:
+			t.Fatalf("acknowledged a message that was not sent: %v", msg)
+		case acked[payload]:
+			t.Fatalf("message %s acknowledged twice", payload)
+		}
+		acked[payload] = true
+	}
+
+	// Publish a message every tick until done, or until the sink fails.
+publish:
+	for prodErr == nil {
+		var out chan<- substrate.Message
+		if next != nil {
+			out = prodMsgs
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timed out publishing: %d of %d messages acknowledged", len(acked), len(sent))
+		case <-cutOff:
+			t.Log("cutting off the network")
+			proxy.Stop()
+			restored = time.After(partitionDuration)
+		case <-restored:
+			t.Log("restoring the network")
+			require.NoError(t, proxy.Start())
+			restored = nil
+		case <-done:
+			break publish
+		case <-ticker.C:
+			if next == nil {
+				m := testMessage(fmt.Sprintf("message-%d", len(sent)))
+				next = &m
+			}
+		case out <- next:
+			sent[next] = string(next.Data())
+			next = nil
+		case msg := <-prodAcks:
+			ack(msg)
+		case prodErr = <-prodErrs:
+		}
+	}
+	if restored != nil {
+		// The sink failed before the network was restored.
+		require.NoError(t, proxy.Start())
+	}
+
+	// Wait for the outstanding acknowledgements, unless the sink has failed.
+	for prodErr == nil && len(acked) < len(sent) {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("sink hung after the network partition: %d of %d messages neither acknowledged nor failed", len(sent)-len(acked), len(sent))
+		case msg := <-prodAcks:
+			ack(msg)
+		case prodErr = <-prodErrs:
+		}
+	}
+	if prodErr != nil {
+		t.Logf("sink surfaced error after %d of %d messages were acknowledged: %s", len(acked), len(sent), prodErr)
+	} else {
+		prodCancel()
+		if err := stopped(t, "sink", prodErrs); err != context.Canceled {
+			t.Errorf("unexpected error from produce : %s", err)
+		}
+	}
+	// Drain the acknowledgements sent before the sink returned.
+	for len(prodAcks) > 0 {
+		ack(<-prodAcks)
+	}
+
+	consumeAll(ctx, t, ts.NewConsumer(topic, generateID()), acked)
+}
+
+// consumeAll consumes messages until all the expected ones are received.
+func consumeAll(ctx context.Context, t *testing.T, cons substrate.AsyncMessageSource, expected map[string]bool) {
+	t.Helper()
+	defer cons.Close()
+
+	missing := make(map[string]bool, len(expected))
+	for payload := range expected {
+		missing[payload] = true
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	consCtx, consCancel := context.WithCancel(ctx)
+	defer consCancel()
+	consMsgs := make(chan substrate.Message, 1024)
+	consAcks := make(chan substrate.Message, 1024)
+	consErrs := make(chan error, 1)
+	go func() {
+		consErrs <- cons.ConsumeMessages(consCtx, consMsgs, consAcks)
+	}()
+
+	for len(missing) > 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("%d acknowledged messages were lost, e.g. %s", len(missing), anyKey(missing))
+		case err := <-consErrs:
+			t.Fatalf("unexpected error from consume : %s", err)
+		case msg := <-consMsgs:
+			delete(missing, string(msg.Data()))
+			consAcks <- msg
+		}
+	}
+	consCancel()
+	if err := stopped(t, "source", consErrs); err != context.Canceled {
+		t.Errorf("unexpected error from consume : %s", err)
+	}
+}
+
+// stopped returns the error of a cancelled source or sink, failing the test if
+// it does not return within the shutdownTimeout, e.g. because it hangs on a
+// connection that was cut off.
+func stopped(t *testing.T, name string, errs <-chan error) error {
+	t.Helper()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(shutdownTimeout):
+		t.Fatalf("%s did not return within %s of being cancelled", name, shutdownTimeout)
+		return nil
+	}
+}
+
+// closeWithin closes a source or sink, failing the test if closing fails, or
+// takes longer than the shutdownTimeout.
+func closeWithin(t *testing.T, name string, c io.Closer) {
+	t.Helper()
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- c.Close()
+	}()
+	select {
+	case err := <-closed:
+		require.NoError(t, err, "closing %s", name)
+	case <-time.After(shutdownTimeout):
+		t.Fatalf("%s did not close within %s", name, shutdownTimeout)
+	}
+}
+
+func anyKey(m map[string]bool) string {
+	for k := range m {
+		return k
+	}
+	return ""
+}
+
+// testConsumeDuringConnectionResets consumes messages while the connections
+// are repeatedly reset and slowed down. A consumer that fails is replaced with
+// a new one in the same group. Every message must be delivered, the source
+// must accept every acknowledgement, and only messages whose acknowledgement
+// may have been lost by a reset may be delivered again.
+func testConsumeDuringConnectionResets(t *testing.T, ts FaultTestServer) {
+	const numMessages = 200
+	topic := generateID()
+	group := generateID()
+	proxy := ts.Proxy()
+
+	ctx, cancel := context.WithTimeout(context.Background(), faultTestTimeout)
+	defer cancel()
+
+	// Publish the messages before injecting any faults.
+	prod := ts.NewProducer(topic)
+	prodCtx, prodCancel := context.WithCancel(ctx)
+	prodMsgs := make(chan substrate.Message, 1024)
+	prodAcks := make(chan substrate.Message, 1024)
+	prodErrs := make(chan error, 1)
+	go func() {
+		prodErrs <- prod.PublishMessages(prodCtx, prodAcks, prodMsgs)
+	}()
+	for i := 0; i < numMessages; i++ {
+		m := testMessage(fmt.Sprintf("message-%d", i))
+		produceAndCheckAck(prodCtx, t, prodMsgs, prodAcks, &m)
+	}
+	prodCancel()
+	if err := stopped(t, "sink", prodErrs); err != context.Canceled {
+		t.Fatalf("unexpected error from produce : %s", err)
+	}
+	closeWithin(t, "sink", prod)
+
+	_, err := proxy.Toxics.AddToxicJson(strings.NewReader(
+		`{"name": "latency", "type": "latency", "attributes": {"latency": 200, "jitter": 100}}`,
+	))
+	require.NoError(t, err)
+
+	var (
+		mu      sync.Mutex
+		resets  []time.Time
+		ackedAt = make(map[string]time.Time)
+	)
+	// lostAck reports whether the acknowledgement of a message sent at the
+	// given time may have been lost by a reset.
+	lostAck := func(at time.Time) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, r := range resets {
+			if !r.Before(at) && r.Sub(at) <= ackGrace {
+				return true
+			}
+		}
+		return false
+	}
+
+	resetCtx, resetCancel := context.WithCancel(ctx)
+	resetDone := make(chan struct{})
+	go func() {
+		defer close(resetDone)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-resetCtx.Done():
+				return
+			case <-ticker.C:
+				mu.Lock()
+				resets = append(resets, time.Now())
+				mu.Unlock()
+				proxy.Stop()
+				if err := proxy.Start(); err != nil {
+					t.Errorf("failed to restart proxy: %s", err)
+					return
+				}
+			}
+		}
+	}()
+	defer func() {
+		resetCancel()
+		<-resetDone
+	}()
+
+	for consumers := 1; len(ackedAt) < numMessages; consumers++ {
+		if consumers > 20 {
+			t.Fatalf("gave up after %d failed consumers, with %d of %d messages acknowledged", consumers-1, len(ackedAt), numMessages)
+		}
+		cons := ts.NewConsumer(topic, group)
+
+		consCtx, consCancel := context.WithCancel(ctx)
+		consMsgs := make(chan substrate.Message)
+		consAcks := make(chan substrate.Message)
+		consErrs := make(chan error, 1)
+		go func() {
+			consErrs <- cons.ConsumeMessages(consCtx, consMsgs, consAcks)
+		}()
+
+	consume:
+		for len(ackedAt) < numMessages {
+			select {
+			case <-ctx.Done():
+				t.Fatalf("timed out consuming: %d of %d messages acknowledged", len(ackedAt), numMessages)
+			case err := <-consErrs:
+				var invalidAck substrate.InvalidAckError
+				if errors.As(err, &invalidAck) {
+					t.Fatalf("source rejected an acknowledgement: %s", err)
+				}
+				t.Logf("consumer %d failed, replacing it: %s", consumers, err)
+				consErrs <- err
+				break consume
+			case msg := <-consMsgs:
+				payload := string(msg.Data())
+				if at, ok := ackedAt[payload]; ok && !lostAck(at) {
+					t.Fatalf("message %s delivered again after it was acknowledged", payload)
+				}
+				// Process messages slowly enough for the resets to
+				// interleave with consumption.
+				time.Sleep(10 * time.Millisecond)
+				select {
+				case consAcks <- msg:
+					ackedAt[payload] = time.Now()
+				case err := <-consErrs:
+					t.Logf("consumer %d failed before acknowledging, replacing it: %s", consumers, err)
+					consErrs <- err
+					break consume
+				case <-ctx.Done():
+				}
+			}
+		}
+		consCancel()
+		if err := stopped(t, "source", consErrs); err != nil && err != context.Canceled {
+			t.Logf("consumer %d stopped with : %s", consumers, err)
+		}
+		closeWithin(t, "source", cons)
+	}
+}
+
+// testStatusDuringPartition checks that the status of a producer and a
+// consumer reports a problem while the network is cut off, and recovers once
+// it is restored.
+func testStatusDuringPartition(t *testing.T, ts FaultTestServer) {
+	topic := generateID()
+	proxy := ts.Proxy()
+
+	ctx, cancel := context.WithTimeout(context.Background(), faultTestTimeout)
+	defer cancel()
+
+	// Create the topic, as the status of a missing topic is not healthy.
+	prod := ts.NewProducer(topic)
+	defer prod.Close()
+	prodCtx, prodCancel := context.WithCancel(ctx)
+	prodMsgs := make(chan substrate.Message, 1)
+	prodAcks := make(chan substrate.Message, 1)
+	prodErrs := make(chan error, 1)
+	go func() {
+		prodErrs <- prod.PublishMessages(prodCtx, prodAcks, prodMsgs)
+	}()
+	m := testMessage("status")
+	produceAndCheckAck(prodCtx, t, prodMsgs, prodAcks, &m)
+	prodCancel()
+	stopped(t, "sink", prodErrs)
+
+	cons := ts.NewConsumer(topic, generateID())
+	defer cons.Close()
+
+	statusers := map[string]substrate.Statuser{"producer": prod, "consumer": cons}
+	for name, s := range statusers {
+		waitForStatus(ctx, t, name, s, true)
+	}
+
+	proxy.Stop()
+	for name, s := range statusers {
+		waitForStatus(ctx, t, name, s, false)
+	}
+
+	require.NoError(t, proxy.Start())
+	for name, s := range statusers {
+		waitForStatus(ctx, t, name, s, true)
+	}
+}
+
+// waitForStatus polls the status until it is healthy, i.e. working without
+// any problems, or not healthy, as given.
+func waitForStatus(ctx context.Context, t *testing.T, name string, s substrate.Statuser, healthy bool) {
+	t.Helper()
+
+	for {
+		status, err := s.Status()
+		if (err == nil && status.Working && len(status.Problems) == 0) == healthy {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("%s status never became healthy=%t, last status %+v, error %v", name, healthy, status, err)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package testshared
+
+import (
+	"context"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/unwrap"
+)
+
+// Message is a message with a payload only.
+type Message struct {
+	Payload []byte
+}
+
+// Data returns the payload of the message.
+func (m *Message) Data() []byte {
+	return m.Payload
+}
+
+// AttributedMessage is a message with a payload and attributes.
+type AttributedMessage struct {
+	Payload []byte
+	Attrs   map[string]string
+}
+
+// Data returns the payload of the message.
+func (m *AttributedMessage) Data() []byte {
+	return m.Payload
+}
+
+// Attributes returns the attributes of the message.
+func (m *AttributedMessage) Attributes() map[string]string {
+	return m.Attrs
+}
+
+// NewMessage returns a message with the payload, which is an
+// AttributedMessage if attrs is not nil, and a Message otherwise.
+func NewMessage(data string, attrs map[string]string) substrate.Message {
+	if attrs == nil {
+		return &Message{Payload: []byte(data)}
+	}
+	return &AttributedMessage{Payload: []byte(data), Attrs: attrs}
+}
+
+// ChannelSink publishes messages to its channel, which a ChannelSource can
+// consume from. Like backends without attributes, it only keeps payloads,
+// unless KeepAttributes is set.
+type ChannelSink struct {
+	Messages       chan substrate.Message
+	KeepAttributes bool
+}
+
+// PublishMessages implements the PublishMessages method of the
+// substrate.AsyncMessageSink interface.
+func (s ChannelSink) PublishMessages(ctx context.Context, acks chan<- substrate.Message, messages <-chan substrate.Message) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m := <-messages:
+			var attrs map[string]string
+			if s.KeepAttributes {
+				attrs = unwrap.Attributes(m)
+			}
+			s.Messages <- NewMessage(string(m.Data()), attrs)
+			select {
+			case acks <- m:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// Close implements the Close method of the substrate.AsyncMessageSink
+// interface.
+func (s ChannelSink) Close() error {
+	return nil
+}
+
+// Status implements the Status method of the substrate.AsyncMessageSink
+// interface.
+func (s ChannelSink) Status() (*substrate.Status, error) {
+	return &substrate.Status{Working: true}, nil
+}
+
+// ChannelSource delivers the messages sent to its channel, and passes the
+// acknowledged ones to Acked, if it is set.
+type ChannelSource struct {
+	Messages chan substrate.Message
+	Acked    chan substrate.Message
+}
+
+// ConsumeMessages implements the ConsumeMessages method of the
+// substrate.AsyncMessageSource interface.
+func (s ChannelSource) ConsumeMessages(ctx context.Context, messages chan<- substrate.Message, acks <-chan substrate.Message) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m := <-s.Messages:
+			select {
+			case messages <- m:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case m := <-acks:
+			if s.Acked != nil {
+				s.Acked <- m
+			}
+		}
+	}
+}
+
+// Close implements the Close method of the substrate.AsyncMessageSource
+// interface.
+func (s ChannelSource) Close() error {
+	return nil
+}
+
+// Status implements the Status method of the substrate.AsyncMessageSource
+// interface.
+func (s ChannelSource) Status() (*substrate.Status, error) {
+	return &substrate.Status{Working: true}, nil
+}
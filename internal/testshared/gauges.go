@@ -0,0 +1,31 @@
+package testshared
+
+import "sync"
+
+// Gauges implements substrate.Gauges, recording the last sampled values.
+type Gauges struct {
+	mu          sync.Mutex
+	inFlight    int
+	pendingAcks int
+}
+
+// SetInFlight implements substrate.Gauges.
+func (g *Gauges) SetInFlight(n int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.inFlight = n
+}
+
+// SetPendingAcks implements substrate.Gauges.
+func (g *Gauges) SetPendingAcks(n int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.pendingAcks = n
+}
+
+// Values returns the last sampled values.
+func (g *Gauges) Values() (inFlight, pendingAcks int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.inFlight, g.pendingAcks
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"reflect"
 	"runtime"
@@ -23,6 +24,23 @@ type TestServer interface {
 	TestEnd()
 }
 
+// NackRedeliveringServer is implemented by test servers whose sources deliver
+// nacked messages again, along with the messages after them, rather than
+// skipping them.
+type NackRedeliveringServer interface {
+	TestServer
+	RedeliversNacked() bool
+}
+
+// LifecycleEventsServer is implemented by test servers whose sources and sinks
+// emit substrate.LifecycleEvents, which must include at least the connected
+// and closed events.
+type LifecycleEventsServer interface {
+	TestServer
+	NewConsumerWithEvents(topic string, groupID string, events chan<- substrate.LifecycleEvent) substrate.AsyncMessageSource
+	NewProducerWithEvents(topic string, events chan<- substrate.LifecycleEvent) substrate.AsyncMessageSink
+}
+
 // TestAll is the main entrypoint from the backend implmenentation tests to
 // call, and will run each test as a sub-test.
 func TestAll(t *testing.T, ts TestServer) {
@@ -41,7 +59,12 @@ func TestAll(t *testing.T, ts TestServer) {
 		testConsumeStatusOk,
 		testConsumeStatusFail,
 		testPublishMultipleMessagesOneConsumer,
+		testAckWrappedMessage,
 		testOnePublisherOneConsumerConsumeWithoutAckingDiscardedPayload,
+		testNackedMessage,
+		testShutdownReturnsContextError,
+		testBoundedSource,
+		testLifecycleEvents,
 	} {
 		f := func(t *testing.T) {
 			x(t, ts)
@@ -470,6 +493,70 @@ func testPublishMultipleMessagesOneConsumer(t *testing.T, ts TestServer) {
 	}
 }
 
+type wrappedAckKey struct{}
+
+// testAckWrappedMessage acknowledges a message wrapped by the caller, which
+// sources accept as the message it wraps, see substrate.SameMessage.
+func testAckWrappedMessage(t *testing.T, ts TestServer) {
+	assert := assert.New(t)
+
+	topic := generateID()
+	consumerID := generateID()
+
+	cons := ts.NewConsumer(topic, consumerID)
+	prod := ts.NewProducer(topic)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	consMsgs := make(chan substrate.Message, 1024)
+	consAcks := make(chan substrate.Message, 1024)
+	consErrs := make(chan error, 1)
+	go func() {
+		consErrs <- cons.ConsumeMessages(ctx, consMsgs, consAcks)
+		cancel()
+	}()
+
+	prodMsgs := make(chan substrate.Message, 1024)
+	prodAcks := make(chan substrate.Message, 1024)
+	prodErrs := make(chan error, 1)
+	go func() {
+		prodErrs <- prod.PublishMessages(ctx, prodAcks, prodMsgs)
+		cancel()
+	}()
+
+	for i := 0; i < 2; i++ {
+		m := testMessage([]byte(fmt.Sprintf("messageText-%d", i)))
+		produceAndCheckAck(ctx, t, prodMsgs, prodAcks, &m)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-consMsgs:
+			assert.Equal(fmt.Sprintf("messageText-%d", i), string(msg.Data()))
+			consAcks <- substrate.WithValue(msg, wrappedAckKey{}, i)
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+	}
+
+	// The acknowledgements are processed in order, so the source would have
+	// failed by now if it didn't accept them.
+	select {
+	case err := <-consErrs:
+		t.Fatalf("unexpected error from consume : %s", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// we're done
+	cancel()
+	if err := <-consErrs; err != context.Canceled {
+		t.Errorf("unexpected error from consume : %s", err)
+	}
+	if err := <-prodErrs; err != context.Canceled {
+		t.Errorf("unexpected error from produce : %s", err)
+	}
+}
+
 func testOnePublisherOneConsumerConsumeWithoutAckingDiscardedPayload(t *testing.T, ts TestServer) {
 	assert := assert.New(t)
 
@@ -539,8 +626,224 @@ func testOnePublisherOneConsumerConsumeWithoutAckingDiscardedPayload(t *testing.
 	}
 }
 
+func testNackedMessage(t *testing.T, ts TestServer) {
+	assert := assert.New(t)
+
+	topic := generateID()
+	consumerID := generateID()
+
+	cons := ts.NewConsumer(topic, consumerID)
+	for i := 0; i < 3; i++ {
+		connectSendmessageAndClose(t, ts, topic, fmt.Sprintf("messageText-%d", i), generateID())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	consMsgs := make(chan substrate.Message, 1024)
+	consAcks := make(chan substrate.Message, 1024)
+	consErrs := make(chan error, 1)
+	go func() {
+		consErrs <- cons.ConsumeMessages(ctx, consMsgs, consAcks)
+	}()
+
+	var msg substrate.Message
+	select {
+	case msg = <-consMsgs:
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+	assert.Equal("messageText-0", string(msg.Data()))
+	nm, ok := msg.(substrate.Nackable)
+	if !ok {
+		cancel()
+		<-consErrs
+		t.Skip("the messages of the source are not nackable")
+	}
+	nm.Nack(errors.New("failed to process message"))
+	consAcks <- msg
+
+	if rs, ok := ts.(NackRedeliveringServer); ok && rs.RedeliversNacked() {
+		// The messages delivered before the nacked message was
+		// acknowledged are delivered again after it.
+		for i := 0; i < 3; i++ {
+			if consumeAndAck(ctx, t, consMsgs, consAcks) == "messageText-0" {
+				break
+			}
+		}
+	}
+	for i := 1; i < 3; i++ {
+		assert.Equal(fmt.Sprintf("messageText-%d", i), consumeAndAck(ctx, t, consMsgs, consAcks))
+	}
+
+	cancel()
+	if err := <-consErrs; err != context.Canceled {
+		t.Errorf("unexpected error from consume : %s", err)
+	}
+	if err := cons.Close(); err != nil {
+		t.Errorf("unexpected error closing consumer: %s", err)
+	}
+}
+
 // Helper functions below here
 
+// testShutdownReturnsContextError checks that consuming and publishing return
+// the error of their context once it is done, rather than nil or an error of
+// the client, whether the context is cancelled after messages went through, or
+// its deadline passes, possibly while still connecting.
+func testShutdownReturnsContextError(t *testing.T, ts TestServer) {
+	for _, tst := range []struct {
+		name      string
+		newCtx    func() (context.Context, context.CancelFunc)
+		exchanges bool
+	}{
+		{
+			name:      "cancelled",
+			newCtx:    func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+			exchanges: true,
+		},
+		{
+			name: "deadline exceeded",
+			newCtx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 500*time.Millisecond)
+			},
+		},
+	} {
+		t.Run(tst.name, func(t *testing.T) {
+			topic := generateID()
+			cons := ts.NewConsumer(topic, generateID())
+			prod := ts.NewProducer(topic)
+			defer cons.Close()
+			defer prod.Close()
+
+			ctx, cancel := tst.newCtx()
+			defer cancel()
+
+			consMsgs := make(chan substrate.Message, 1024)
+			consAcks := make(chan substrate.Message, 1024)
+			consErrs := make(chan error, 1)
+			go func() {
+				consErrs <- cons.ConsumeMessages(ctx, consMsgs, consAcks)
+			}()
+
+			prodMsgs := make(chan substrate.Message, 1024)
+			prodAcks := make(chan substrate.Message, 1024)
+			prodErrs := make(chan error, 1)
+			go func() {
+				prodErrs <- prod.PublishMessages(ctx, prodAcks, prodMsgs)
+			}()
+
+			if tst.exchanges {
+				m := testMessage([]byte("shutdown"))
+				produceAndCheckAck(ctx, t, prodMsgs, prodAcks, &m)
+				assert.Equal(t, "shutdown", consumeAndAck(ctx, t, consMsgs, consAcks))
+				cancel()
+			}
+			<-ctx.Done()
+
+			assert.Equal(t, ctx.Err(), <-consErrs, "consume")
+			assert.Equal(t, ctx.Err(), <-prodErrs, "produce")
+		})
+	}
+}
+
+// testBoundedSource checks that a bounded source returns nil once the
+// delivered messages are acknowledged, without delivering more.
+func testBoundedSource(t *testing.T, ts TestServer) {
+	topic := generateID()
+	cons := substrate.NewBoundedSource(ts.NewConsumer(topic, generateID()), substrate.BoundedSourceOptions{MaxMessages: 3})
+	prod := ts.NewProducer(topic)
+	defer cons.Close()
+	defer prod.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	consMsgs := make(chan substrate.Message, 1024)
+	consAcks := make(chan substrate.Message, 1024)
+	consErrs := make(chan error, 1)
+	go func() {
+		consErrs <- cons.ConsumeMessages(ctx, consMsgs, consAcks)
+	}()
+
+	prodMsgs := make(chan substrate.Message, 1024)
+	prodAcks := make(chan substrate.Message, 1024)
+	go func() {
+		_ = prod.PublishMessages(ctx, prodAcks, prodMsgs)
+	}()
+
+	for i := 0; i < 5; i++ {
+		m := testMessage([]byte(fmt.Sprintf("bounded-%d", i)))
+		produceAndCheckAck(ctx, t, prodMsgs, prodAcks, &m)
+	}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, fmt.Sprintf("bounded-%d", i), consumeAndAck(ctx, t, consMsgs, consAcks))
+	}
+
+	select {
+	case err := <-consErrs:
+		assert.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatal("bounded source did not stop")
+	}
+	assert.Len(t, consMsgs, 0)
+}
+
+// testLifecycleEvents checks that sources and sinks emit connected events once
+// they exchange messages, and closed events once they are closed.
+func testLifecycleEvents(t *testing.T, ts TestServer) {
+	es, ok := ts.(LifecycleEventsServer)
+	if !ok {
+		t.Skip("lifecycle events are not supported")
+	}
+
+	topic := generateID()
+	consEvents := make(chan substrate.LifecycleEvent, 64)
+	prodEvents := make(chan substrate.LifecycleEvent, 64)
+	cons := es.NewConsumerWithEvents(topic, generateID(), consEvents)
+	prod := es.NewProducerWithEvents(topic, prodEvents)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	pctx, pcancel := context.WithCancel(ctx)
+
+	consMsgs := make(chan substrate.Message, 1024)
+	consAcks := make(chan substrate.Message, 1024)
+	consErrs := make(chan error, 1)
+	go func() {
+		consErrs <- cons.ConsumeMessages(pctx, consMsgs, consAcks)
+	}()
+
+	prodMsgs := make(chan substrate.Message, 1024)
+	prodAcks := make(chan substrate.Message, 1024)
+	prodErrs := make(chan error, 1)
+	go func() {
+		prodErrs <- prod.PublishMessages(pctx, prodAcks, prodMsgs)
+	}()
+
+	m := testMessage([]byte("lifecycle"))
+	produceAndCheckAck(ctx, t, prodMsgs, prodAcks, &m)
+	assert.Equal(t, "lifecycle", consumeAndAck(ctx, t, consMsgs, consAcks))
+
+	pcancel()
+	<-consErrs
+	<-prodErrs
+	assert.NoError(t, cons.Close())
+	assert.NoError(t, prod.Close())
+
+	for name, events := range map[string]chan substrate.LifecycleEvent{"consumer": consEvents, "producer": prodEvents} {
+		close(events)
+		var types []substrate.LifecycleEventType
+		for ev := range events {
+			types = append(types, ev.Type)
+		}
+		if assert.NotEmpty(t, types, name) {
+			assert.Contains(t, types, substrate.LifecycleConnected, name)
+			assert.Equal(t, substrate.LifecycleClosed, types[len(types)-1], name)
+		}
+	}
+}
+
 func connectSendmessageAndClose(t *testing.T, ts TestServer, topic string, messageText string, msgID string) {
 	ctx, cancel := context.WithCancel(context.Background())
 	prod := ts.NewProducer(topic)
@@ -0,0 +1,166 @@
+// Package testutil provides helpers shared by the tests of the substrate packages.
+package testutil
+
+import (
+	"sync"
+	"time"
+
+	"github.com/uw-labs/substrate/internal/clock"
+)
+
+var _ clock.Clock = (*FakeClock)(nil)
+
+// FakeClock is a clock.Clock whose time only passes when Advance is called,
+// firing the timers and tickers that are due, so that tests of time dependent
+// code are deterministic.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+	// waiters are the active timers and tickers.
+	waiters map[*fakeWaiter]struct{}
+	seq     int
+	// changed is broadcast when timers or tickers are started or stopped.
+	changed *sync.Cond
+}
+
+// NewFakeClock returns a fake clock set to now.
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now, waiters: make(map[*fakeWaiter]struct{})}
+	c.changed = sync.NewCond(&c.mu)
+	return c
+}
+
+// fakeWaiter is a timer, or a ticker if it has a period.
+type fakeWaiter struct {
+	clock    *FakeClock
+	c        chan time.Time
+	deadline time.Time
+	period   time.Duration
+	// seq orders the waiters with the same deadline by creation.
+	seq int
+}
+
+// Now returns the time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// NewTimer returns a timer firing once the clock has advanced by d.
+func (c *FakeClock) NewTimer(d time.Duration) clock.Timer {
+	return c.start(d, 0)
+}
+
+// NewTicker returns a ticker firing every time the clock has advanced by d.
+func (c *FakeClock) NewTicker(d time.Duration) clock.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return fakeTicker{c.start(d, d)}
+}
+
+func (c *FakeClock) start(d, period time.Duration) *fakeWaiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	w := &fakeWaiter{clock: c, c: make(chan time.Time, 1), period: period, seq: c.seq}
+	w.reset(d)
+	return w
+}
+
+// Advance moves the clock forward by d, firing the timers and tickers that
+// are due along the way, in order.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	end := c.now.Add(d)
+	for {
+		due := c.due(end)
+		if due == nil {
+			break
+		}
+		c.now = due.deadline
+		// Like the time package, a tick is dropped if the previous one
+		// hasn't been received.
+		select {
+		case due.c <- c.now:
+		default:
+		}
+		if due.period > 0 {
+			due.deadline = due.deadline.Add(due.period)
+		} else {
+			delete(c.waiters, due)
+		}
+	}
+	c.now = end
+	c.changed.Broadcast()
+}
+
+// due returns the active waiter with the earliest deadline not after end.
+func (c *FakeClock) due(end time.Time) *fakeWaiter {
+	var due *fakeWaiter
+	for w := range c.waiters {
+		if w.deadline.After(end) {
+			continue
+		}
+		if due == nil || w.deadline.Before(due.deadline) || (w.deadline.Equal(due.deadline) && w.seq < due.seq) {
+			due = w
+		}
+	}
+	return due
+}
+
+// BlockUntil blocks until at least n timers and tickers are active, that is
+// started and neither stopped nor fired, so that a test can advance the clock
+// once the code under test is waiting for it.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.waiters) < n {
+		c.changed.Wait()
+	}
+}
+
+func (w *fakeWaiter) C() <-chan time.Time {
+	return w.c
+}
+
+// reset must be called with the lock of the clock held.
+func (w *fakeWaiter) reset(d time.Duration) bool {
+	_, active := w.clock.waiters[w]
+	w.deadline = w.clock.now.Add(d)
+	w.clock.waiters[w] = struct{}{}
+	w.clock.changed.Broadcast()
+	return active
+}
+
+func (w *fakeWaiter) Reset(d time.Duration) bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+
+	return w.reset(d)
+}
+
+func (w *fakeWaiter) Stop() bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+
+	_, active := w.clock.waiters[w]
+	delete(w.clock.waiters, w)
+	w.clock.changed.Broadcast()
+	return active
+}
+
+// fakeTicker is a ticker of a FakeClock.
+type fakeTicker struct {
+	*fakeWaiter
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeWaiter.Stop()
+}
@@ -0,0 +1,34 @@
+package testutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFakeClock(start)
+
+	timer := c.NewTimer(time.Second)
+	ticker := c.NewTicker(400 * time.Millisecond)
+	c.BlockUntil(2)
+
+	c.Advance(999 * time.Millisecond)
+	assert.Equal(t, start.Add(999*time.Millisecond), c.Now())
+	assert.Empty(t, timer.C())
+	// Ticks that aren't received are dropped.
+	assert.Equal(t, start.Add(400*time.Millisecond), <-ticker.C())
+
+	c.Advance(time.Millisecond)
+	assert.Equal(t, start.Add(time.Second), <-timer.C())
+	assert.False(t, timer.Stop())
+
+	assert.False(t, timer.Reset(time.Second))
+	assert.True(t, timer.Stop())
+	ticker.Stop()
+	c.Advance(time.Hour)
+	assert.Empty(t, timer.C())
+	assert.Empty(t, ticker.C())
+}
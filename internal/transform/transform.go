@@ -0,0 +1,257 @@
+// Package transform implements sink and source wrappers that transform the
+// payload of every message, such as compressing or encrypting it, and
+// optionally its attributes.
+package transform
+
+import (
+	"context"
+
+	"github.com/uw-labs/sync/rungroup"
+
+	"github.com/uw-labs/substrate"
+)
+
+// Func returns the transformed payload of a message.
+type Func func(data []byte) ([]byte, error)
+
+// MessageFunc returns the transformed payload of a message, along with its
+// transformed attributes. If attrs is nil, the attributes of the message are
+// left unchanged.
+type MessageFunc func(msg substrate.Message) (data []byte, attrs map[string]string, err error)
+
+// payloadFunc returns a MessageFunc that only transforms payloads.
+func payloadFunc(fn Func) MessageFunc {
+	return func(msg substrate.Message) ([]byte, map[string]string, error) {
+		data, err := fn(msg.Data())
+		return data, nil, err
+	}
+}
+
+var (
+	_ substrate.AsyncMessageSink   = (*sink)(nil)
+	_ substrate.AsyncMessageSource = (*source)(nil)
+)
+
+// message is a message with a transformed payload. It keeps the message it was
+// created from, so that it can be acknowledged and unwrapped.
+type message struct {
+	data     []byte
+	original substrate.Message
+}
+
+func (m *message) Data() []byte {
+	if m.data == nil {
+		panic("attempt to use payload after discarding.")
+	}
+	return m.data
+}
+
+func (m *message) Original() substrate.Message {
+	return m.original
+}
+
+// DiscardPayload discards the transformed payload, along with the payload of
+// the original message if it is discardable.
+func (m *message) DiscardPayload() {
+	m.data = nil
+	if dm, ok := m.original.(substrate.DiscardableMessage); ok {
+		dm.DiscardPayload()
+	}
+}
+
+// attributedMessage is a message with transformed attributes.
+type attributedMessage struct {
+	*message
+	attrs map[string]string
+}
+
+func (m *attributedMessage) Attributes() map[string]string {
+	return m.attrs
+}
+
+// original returns the message a transformed message was created from. The
+// acknowledged message may wrap the transformed message.
+func original(ack substrate.Message) (substrate.Message, error) {
+	for msg := ack; ; {
+		switch m := msg.(type) {
+		case *message:
+			return m.original, nil
+		case *attributedMessage:
+			return m.original, nil
+		case interface{ Original() substrate.Message }:
+			msg = m.Original()
+		default:
+			return nil, substrate.InvalidAckError{Acked: ack}
+		}
+	}
+}
+
+func transform(fn MessageFunc, msg substrate.Message) (substrate.Message, error) {
+	data, attrs, err := fn(msg)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		// A nil payload is indistinguishable from a discarded one.
+		data = []byte{}
+	}
+	m := &message{data: data, original: msg}
+	if attrs != nil {
+		return &attributedMessage{message: m, attrs: attrs}, nil
+	}
+	return m, nil
+}
+
+// NewSink returns a sink that publishes messages to s with their payload
+// transformed by fn. Publishing terminates if fn returns an error.
+func NewSink(s substrate.AsyncMessageSink, fn Func) substrate.AsyncMessageSink {
+	return NewMessageSink(s, payloadFunc(fn))
+}
+
+// NewMessageSink is like NewSink, but fn may also transform the attributes
+// of the messages.
+func NewMessageSink(s substrate.AsyncMessageSink, fn MessageFunc) substrate.AsyncMessageSink {
+	return &sink{sink: s, fn: fn}
+}
+
+type sink struct {
+	sink substrate.AsyncMessageSink
+	fn   MessageFunc
+}
+
+func (s *sink) PublishMessages(ctx context.Context, acks chan<- substrate.Message, messages <-chan substrate.Message) error {
+	rg, ctx := rungroup.New(ctx)
+
+	toInner := make(chan substrate.Message, cap(messages))
+	fromInner := make(chan substrate.Message, cap(acks))
+
+	rg.Go(func() error {
+		return s.sink.PublishMessages(ctx, fromInner, toInner)
+	})
+
+	rg.Go(func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case msg := <-messages:
+				tm, err := transform(s.fn, msg)
+				if err != nil {
+					return err
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case toInner <- tm:
+				}
+			}
+		}
+	})
+
+	rg.Go(func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case ack := <-fromInner:
+				msg, err := original(ack)
+				if err != nil {
+					return err
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case acks <- msg:
+				}
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+func (s *sink) Close() error {
+	return s.sink.Close()
+}
+
+func (s *sink) Status() (*substrate.Status, error) {
+	return s.sink.Status()
+}
+
+// NewSource returns a source that delivers the messages consumed from s with
+// their payload transformed by fn. Consuming terminates if fn returns an
+// error. The delivered messages can be unwrapped to the messages of s, and
+// are discardable.
+func NewSource(s substrate.AsyncMessageSource, fn Func) substrate.AsyncMessageSource {
+	return NewMessageSource(s, payloadFunc(fn))
+}
+
+// NewMessageSource is like NewSource, but fn may also transform the
+// attributes of the messages.
+func NewMessageSource(s substrate.AsyncMessageSource, fn MessageFunc) substrate.AsyncMessageSource {
+	return &source{source: s, fn: fn}
+}
+
+type source struct {
+	source substrate.AsyncMessageSource
+	fn     MessageFunc
+}
+
+func (s *source) ConsumeMessages(ctx context.Context, messages chan<- substrate.Message, acks <-chan substrate.Message) error {
+	rg, ctx := rungroup.New(ctx)
+
+	fromInner := make(chan substrate.Message, cap(messages))
+	toInner := make(chan substrate.Message, cap(acks))
+
+	rg.Go(func() error {
+		return s.source.ConsumeMessages(ctx, fromInner, toInner)
+	})
+
+	rg.Go(func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case msg := <-fromInner:
+				tm, err := transform(s.fn, msg)
+				if err != nil {
+					return err
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case messages <- tm:
+				}
+			}
+		}
+	})
+
+	rg.Go(func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case ack := <-acks:
+				msg, err := original(ack)
+				if err != nil {
+					return err
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case toInner <- msg:
+				}
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+func (s *source) Close() error {
+	return s.source.Close()
+}
+
+func (s *source) Status() (*substrate.Status, error) {
+	return s.source.Status()
+}
@@ -0,0 +1,249 @@
+package transform
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/unwrap"
+)
+
+type testMessage struct {
+	data      []byte
+	discarded bool
+}
+
+func (m *testMessage) Data() []byte {
+	return m.data
+}
+
+func (m *testMessage) DiscardPayload() {
+	m.discarded = true
+}
+
+// recordingSink acknowledges every message after recording it.
+type recordingSink struct {
+	published []substrate.Message
+}
+
+func (s *recordingSink) PublishMessages(ctx context.Context, acks chan<- substrate.Message, messages <-chan substrate.Message) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m := <-messages:
+			s.published = append(s.published, m)
+			select {
+			case acks <- m:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+func (s *recordingSink) Close() error {
+	return nil
+}
+
+func (s *recordingSink) Status() (*substrate.Status, error) {
+	return &substrate.Status{Working: true}, nil
+}
+
+// fixedSource delivers its messages and records the acknowledgements.
+type fixedSource struct {
+	messages []substrate.Message
+	acked    chan substrate.Message
+}
+
+func (s *fixedSource) ConsumeMessages(ctx context.Context, messages chan<- substrate.Message, acks <-chan substrate.Message) error {
+	for _, m := range s.messages {
+		select {
+		case messages <- m:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for {
+		select {
+		case a := <-acks:
+			s.acked <- a
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *fixedSource) Close() error {
+	return nil
+}
+
+func (s *fixedSource) Status() (*substrate.Status, error) {
+	return &substrate.Status{Working: true}, nil
+}
+
+func upper(data []byte) ([]byte, error) {
+	return bytes.ToUpper(data), nil
+}
+
+func TestSink(t *testing.T) {
+	inner := &recordingSink{}
+	sink := NewSink(inner, upper)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishMessages(ctx, acks, msgs)
+	}()
+
+	sent := []*testMessage{{data: []byte("one")}, {data: []byte("two")}}
+	for _, m := range sent {
+		msgs <- m
+		assert.Equal(t, m, <-acks)
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+
+	require.Len(t, inner.published, 2)
+	assert.Equal(t, "ONE", string(inner.published[0].Data()))
+	assert.Equal(t, "TWO", string(inner.published[1].Data()))
+	assert.Equal(t, sent[0], unwrap.Unwrap(inner.published[0]))
+}
+
+func TestSinkTransformError(t *testing.T) {
+	failure := errors.New("failure")
+	sink := NewSink(&recordingSink{}, func([]byte) ([]byte, error) {
+		return nil, failure
+	})
+
+	msgs := make(chan substrate.Message, 1)
+	msgs <- &testMessage{data: []byte("one")}
+	assert.Equal(t, failure, sink.PublishMessages(context.Background(), make(chan substrate.Message), msgs))
+}
+
+func TestSource(t *testing.T) {
+	consumed := []substrate.Message{&testMessage{data: []byte("one")}, &testMessage{data: []byte("two")}}
+	inner := &fixedSource{messages: consumed, acked: make(chan substrate.Message, 2)}
+	source := NewSource(inner, upper)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	for i, expected := range []string{"ONE", "TWO"} {
+		m := <-msgs
+		assert.Equal(t, expected, string(m.Data()))
+		assert.Equal(t, consumed[i], unwrap.Unwrap(m))
+
+		dm, ok := m.(substrate.DiscardableMessage)
+		require.True(t, ok)
+		dm.DiscardPayload()
+		assert.True(t, consumed[i].(*testMessage).discarded)
+		assert.Panics(t, func() { m.Data() })
+
+		acks <- m
+		assert.Equal(t, consumed[i], <-inner.acked)
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+func TestSourceInvalidAck(t *testing.T) {
+	inner := &fixedSource{messages: []substrate.Message{&testMessage{data: []byte("one")}}, acked: make(chan substrate.Message, 1)}
+	source := NewSource(inner, upper)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	<-msgs
+	other := &testMessage{data: []byte("other")}
+	acks <- other
+	assert.Equal(t, substrate.InvalidAckError{Acked: other}, <-errs)
+}
+
+// callerWrapped is a message wrapped by a caller, which exposes the message it
+// wraps.
+type callerWrapped struct {
+	substrate.Message
+}
+
+func (m callerWrapped) Original() substrate.Message {
+	return m.Message
+}
+
+func TestSourceAckWrapped(t *testing.T) {
+	consumed := &testMessage{data: []byte("one")}
+	inner := &fixedSource{messages: []substrate.Message{consumed}, acked: make(chan substrate.Message, 1)}
+	source := NewSource(inner, upper)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	go func() {
+		_ = source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	acks <- callerWrapped{<-msgs}
+	assert.Equal(t, consumed, <-inner.acked)
+}
+
+func TestMessageSourceAttributes(t *testing.T) {
+	consumed := []substrate.Message{&testMessage{data: []byte("one")}, &testMessage{data: []byte("two")}}
+	inner := &fixedSource{messages: consumed, acked: make(chan substrate.Message, 2)}
+	source := NewMessageSource(inner, func(msg substrate.Message) ([]byte, map[string]string, error) {
+		if string(msg.Data()) == "one" {
+			return msg.Data(), map[string]string{"k": "v"}, nil
+		}
+		return msg.Data(), nil, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	go func() {
+		_ = source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	m := <-msgs
+	assert.Equal(t, map[string]string{"k": "v"}, unwrap.Attributes(m))
+	dm, ok := m.(substrate.DiscardableMessage)
+	require.True(t, ok)
+	dm.DiscardPayload()
+	acks <- m
+	assert.Equal(t, consumed[0], <-inner.acked)
+
+	// Without transformed attributes, the message is not attributed.
+	m = <-msgs
+	_, ok = m.(substrate.AttributedMessage)
+	assert.False(t, ok)
+	acks <- m
+	assert.Equal(t, consumed[1], <-inner.acked)
+}
@@ -22,3 +22,19 @@ func Unwrap(msg substrate.Message) substrate.Message {
 		msg = aMsg.Original()
 	}
 }
+
+// Attributes returns the attributes of the outermost message in a chain of
+// annotated messages that implements substrate.AttributedMessage, so that
+// wrappers can override the attributes of the messages they wrap.
+func Attributes(msg substrate.Message) map[string]string {
+	for {
+		if am, ok := msg.(substrate.AttributedMessage); ok {
+			return am.Attributes()
+		}
+		aMsg, ok := msg.(AnnotatedMessage)
+		if !ok {
+			return nil
+		}
+		msg = aMsg.Original()
+	}
+}
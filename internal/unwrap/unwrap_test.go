@@ -28,6 +28,24 @@ func TestUnwrap(t *testing.T) {
 	require.Equal(t, originalMsg, unwrappedMsg)
 }
 
+func TestAttributes(t *testing.T) {
+	plain := &annotatedMessage{original: &message{data: []byte("data")}}
+	require.Nil(t, unwrap.Attributes(plain))
+
+	attributed := &annotatedMessage{
+		original: &attributedMessage{
+			message:    message{data: []byte("data")},
+			attributes: map[string]string{"outer": "true"},
+			original: &attributedMessage{
+				message:    message{data: []byte("data")},
+				attributes: map[string]string{"inner": "true"},
+				original:   &message{data: []byte("data")},
+			},
+		},
+	}
+	require.Equal(t, map[string]string{"outer": "true"}, unwrap.Attributes(attributed))
+}
+
 type message struct {
 	data []byte
 }
@@ -48,3 +66,17 @@ func (msg *annotatedMessage) Data() []byte {
 func (msg *annotatedMessage) Original() substrate.Message {
 	return msg.original
 }
+
+type attributedMessage struct {
+	message
+	attributes map[string]string
+	original   substrate.Message
+}
+
+func (msg *attributedMessage) Attributes() map[string]string {
+	return msg.attributes
+}
+
+func (msg *attributedMessage) Original() substrate.Message {
+	return msg.original
+}
@@ -0,0 +1,79 @@
+// Package validate collects the problems of the config of a source or sink, so
+// that they are all reported at once when it is created, rather than as
+// obscure errors of the client libraries once messages flow.
+package validate
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// Problems collects the problems of a config. Each problem is reported with
+// the name of the backend, the config and the field, e.g.
+// "kafka: AsyncMessageSourceConfig.ConsumerGroup must not be empty".
+type Problems struct {
+	backend string
+	config  string
+	err     *multierror.Error
+}
+
+// New returns the problems of the config of the backend.
+func New(backend, config string) *Problems {
+	return &Problems{backend: backend, config: config}
+}
+
+// Check records the problem of the field, unless ok.
+func (p *Problems) Check(ok bool, field, problem string, args ...interface{}) {
+	if ok {
+		return
+	}
+	p.Add(p.config+"."+field+" "+problem, args...)
+}
+
+// Add records a problem that isn't about a single field, which is only
+// prefixed with the name of the backend.
+func (p *Problems) Add(problem string, args ...interface{}) {
+	p.err = multierror.Append(p.err, fmt.Errorf(p.backend+": "+problem, args...))
+}
+
+// NotEmpty records a problem if the value of the field is empty.
+func (p *Problems) NotEmpty(value, field string) {
+	p.Check(value != "", field, "must not be empty")
+}
+
+// NotNegative records a problem if the value of the field is negative.
+func (p *Problems) NotNegative(value int, field string) {
+	p.Check(value >= 0, field, "must not be negative")
+}
+
+// NotNegativeDuration records a problem if the duration of the field is
+// negative.
+func (p *Problems) NotNegativeDuration(d time.Duration, field string) {
+	p.Check(d >= 0, field, "must not be negative")
+}
+
+// Err returns a *multierror.Error listing the problems, or nil if there is
+// none.
+func (p *Problems) Err() error {
+	if p.err == nil {
+		return nil
+	}
+	p.err.ErrorFormat = formatProblems
+	return p.err
+}
+
+// formatProblems lists the problems on a single line, which is the problem
+// itself when there is only one.
+func formatProblems(errs []error) string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	if len(msgs) == 1 {
+		return msgs[0]
+	}
+	return fmt.Sprintf("%d problems: %s", len(msgs), strings.Join(msgs, "; "))
+}
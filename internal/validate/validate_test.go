@@ -0,0 +1,37 @@
+package validate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProblems(t *testing.T) {
+	p := New("kafka", "AsyncMessageSourceConfig")
+	p.NotEmpty("topic", "Topic")
+	p.NotNegative(0, "ReadAhead")
+	p.NotNegativeDuration(time.Second, "SessionTimeout")
+	assert.NoError(t, p.Err())
+
+	p.NotEmpty("", "ConsumerGroup")
+	assert.EqualError(t, p.Err(), "kafka: AsyncMessageSourceConfig.ConsumerGroup must not be empty")
+
+	p.NotNegativeDuration(-time.Second, "SessionTimeout")
+	p.Check(false, "Offset", "must be either OffsetOldest or OffsetNewest, not %d", 3)
+	err := p.Err()
+	assert.EqualError(t, err, "3 problems: "+
+		"kafka: AsyncMessageSourceConfig.ConsumerGroup must not be empty; "+
+		"kafka: AsyncMessageSourceConfig.SessionTimeout must not be negative; "+
+		"kafka: AsyncMessageSourceConfig.Offset must be either OffsetOldest or OffsetNewest, not 3")
+	require.IsType(t, &multierror.Error{}, err)
+	assert.Len(t, err.(*multierror.Error).Errors, 3)
+}
+
+func TestProblemsAdd(t *testing.T) {
+	p := New("kafka", "AsyncMessageSinkConfig")
+	p.Add("%s conflicts with %s", "WithKeyFunc", "WithPartitionFunc")
+	assert.EqualError(t, p.Err(), "kafka: WithKeyFunc conflicts with WithPartitionFunc")
+}
@@ -0,0 +1,25 @@
+// Package iostream provides substrate sources reading from an io.Reader and
+// sinks writing to an io.Writer, for command line tooling and debugging.
+//
+// Usage
+//
+// This package support two methods of use.  The first is to directly use this package. See the function documentation for more details.
+//
+// The second method is to use the suburl package. See https://godoc.org/github.com/uw-labs/substrate/suburl for more information.
+//
+// Using suburl
+//
+// The url structure is stdin:// for a source reading newline delimited
+// messages from standard input, and stdout:// for a sink writing them to
+// standard output.
+//
+// For sources, the following url parameters are available
+//
+//      max-message-bytes - The maximum size in bytes of a single message.
+//
+// For sinks, the following url parameters are available
+//
+//      delimiter         - The delimiter written after each message. Defaults to a newline.
+//      flush-per-message - Boolean indicating if each message should be flushed before it is acknowledged.
+//
+package iostream
@@ -0,0 +1,110 @@
+package iostream
+
+import (
+	"bufio"
+	"context"
+	"io"
+
+	"github.com/uw-labs/substrate"
+)
+
+var _ substrate.AsyncMessageSink = (*asyncMessageSink)(nil)
+
+// AsyncMessageSinkConfig is the configuration parameters for an
+// AsyncMessageSink.
+type AsyncMessageSinkConfig struct {
+	// Writer is the stream messages are written to.
+	Writer io.Writer
+	// Delimiter is written after every message.
+	Delimiter []byte
+	// FlushPerMessage flushes every message to the writer before it is
+	// acknowledged, rather than flushing once no more messages are waiting
+	// to be published. This suits line buffered output to a terminal.
+	FlushPerMessage bool
+}
+
+// NewSinkFromWriter returns a new sink writing messages to w, each followed by
+// delimiter.
+func NewSinkFromWriter(w io.Writer, delimiter []byte) substrate.AsyncMessageSink {
+	return &asyncMessageSink{conf: AsyncMessageSinkConfig{Writer: w, Delimiter: delimiter}}
+}
+
+// NewAsyncMessageSink returns a new sink writing messages to the configured
+// writer. Messages are acknowledged once they have been written to it.
+func NewAsyncMessageSink(c AsyncMessageSinkConfig) (substrate.AsyncMessageSink, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &asyncMessageSink{conf: c}, nil
+}
+
+type asyncMessageSink struct {
+	conf AsyncMessageSinkConfig
+}
+
+func (ams *asyncMessageSink) PublishMessages(ctx context.Context, acks chan<- substrate.Message, messages <-chan substrate.Message) error {
+	w := bufio.NewWriter(ams.conf.Writer)
+	var written []substrate.Message
+
+	for {
+		var msg substrate.Message
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg = <-messages:
+		default:
+			// Nothing else is waiting, so flush and acknowledge what has
+			// been written so far before blocking.
+			if err := ams.flush(ctx, w, acks, &written); err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case msg = <-messages:
+			}
+		}
+
+		if _, err := w.Write(msg.Data()); err != nil {
+			return err
+		}
+		if _, err := w.Write(ams.conf.Delimiter); err != nil {
+			return err
+		}
+		written = append(written, msg)
+
+		if ams.conf.FlushPerMessage {
+			if err := ams.flush(ctx, w, acks, &written); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (ams *asyncMessageSink) flush(ctx context.Context, w *bufio.Writer, acks chan<- substrate.Message, written *[]substrate.Message) error {
+	if len(*written) == 0 {
+		return nil
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for _, msg := range *written {
+		select {
+		case acks <- msg:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	*written = (*written)[:0]
+	return nil
+}
+
+func (ams *asyncMessageSink) Status() (*substrate.Status, error) {
+	return &substrate.Status{Working: true}, nil
+}
+
+// Close implements the Close method of the substrate.AsyncMessageSink
+// interface. The writer is not closed.
+func (ams *asyncMessageSink) Close() error {
+	return nil
+}
@@ -0,0 +1,163 @@
+package iostream
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/uw-labs/substrate"
+)
+
+var _ substrate.AsyncMessageSource = (*asyncMessageSource)(nil)
+
+const defaultMaxMessageBytes = 64 * 1024 * 1024
+
+// AsyncMessageSourceConfig is the configuration parameters for an
+// AsyncMessageSource.
+type AsyncMessageSourceConfig struct {
+	// Reader is the stream messages are read from.
+	Reader io.Reader
+	// Split splits the stream into messages. Defaults to bufio.ScanLines.
+	Split bufio.SplitFunc
+	// MaxMessageBytes is the maximum size of a message. Defaults to 64MiB.
+	MaxMessageBytes int
+}
+
+// NewSourceFromReader returns a new source delivering the tokens produced by
+// splitter from r as messages.
+func NewSourceFromReader(r io.Reader, splitter bufio.SplitFunc) substrate.AsyncMessageSource {
+	return &asyncMessageSource{conf: AsyncMessageSourceConfig{Reader: r, Split: splitter}}
+}
+
+// NewAsyncMessageSource returns a new source reading messages from the
+// configured reader.
+//
+// ConsumeMessages returns nil once the reader is exhausted and all delivered
+// messages have been acknowledged. Acknowledgements have no effect on the
+// reader, but are still required in order. A pending read can not be
+// interrupted, so the reader may still be read from after ConsumeMessages has
+// returned because its context was done, and any message read is delivered on
+// the next call.
+func NewAsyncMessageSource(c AsyncMessageSourceConfig) (substrate.AsyncMessageSource, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &asyncMessageSource{conf: c}, nil
+}
+
+type asyncMessageSource struct {
+	conf AsyncMessageSourceConfig
+
+	startReading sync.Once
+	tokens       chan []byte
+	readErr      error
+	exhausted    bool
+	// undelivered holds a message read but not delivered before the last
+	// call to ConsumeMessages returned.
+	undelivered *consumerMessage
+}
+
+type consumerMessage struct {
+	data []byte
+}
+
+func (cm *consumerMessage) Data() []byte {
+	if cm.data == nil {
+		panic("attempt to use payload after discarding.")
+	}
+	return cm.data
+}
+
+func (cm *consumerMessage) DiscardPayload() {
+	cm.data = nil
+}
+
+// read scans the reader until it is exhausted, sending each token to the
+// tokens channel, which is closed once done.
+func (ams *asyncMessageSource) read() {
+	defer close(ams.tokens)
+
+	scanner := bufio.NewScanner(ams.conf.Reader)
+	maxBytes := ams.conf.MaxMessageBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxMessageBytes
+	}
+	scanner.Buffer(nil, maxBytes)
+	if ams.conf.Split != nil {
+		scanner.Split(ams.conf.Split)
+	}
+
+	for scanner.Scan() {
+		// The scanner reuses its buffer, so the token must be copied.
+		token := append([]byte{}, scanner.Bytes()...)
+		ams.tokens <- token
+	}
+	// Written before the channel is closed, so it is visible to readers of
+	// the closed channel.
+	ams.readErr = scanner.Err()
+}
+
+func (ams *asyncMessageSource) ConsumeMessages(ctx context.Context, messages chan<- substrate.Message, acks <-chan substrate.Message) error {
+	ams.startReading.Do(func() {
+		ams.tokens = make(chan []byte)
+		go ams.read()
+	})
+
+	var (
+		inFlight []*consumerMessage
+		next     = ams.undelivered
+		tokens   = ams.tokens
+	)
+	ams.undelivered = nil
+	if ams.exhausted {
+		tokens = nil
+	}
+	for {
+		if tokens == nil && next == nil && len(inFlight) == 0 {
+			return ams.readErr
+		}
+
+		var toClient chan<- substrate.Message
+		var msg substrate.Message
+		fromReader := tokens
+		if next != nil {
+			toClient, msg = messages, next
+			fromReader = nil
+		}
+
+		select {
+		case token, ok := <-fromReader:
+			if !ok {
+				ams.exhausted = true
+				tokens = nil
+				continue
+			}
+			next = &consumerMessage{data: token}
+		case toClient <- msg:
+			inFlight = append(inFlight, next)
+			next = nil
+		case ack := <-acks:
+			if len(inFlight) == 0 {
+				return substrate.InvalidAckError{Acked: ack, Expected: nil}
+			}
+			if !substrate.SameMessage(ack, inFlight[0]) {
+				return substrate.InvalidAckError{Acked: ack, Expected: inFlight[0]}
+			}
+			inFlight = inFlight[1:]
+		case <-ctx.Done():
+			ams.undelivered = next
+			return ctx.Err()
+		}
+	}
+}
+
+func (ams *asyncMessageSource) Status() (*substrate.Status, error) {
+	return &substrate.Status{Working: true}, nil
+}
+
+// Close implements the Close method of the substrate.AsyncMessageSource
+// interface. The reader is not closed.
+func (ams *asyncMessageSource) Close() error {
+	return nil
+}
@@ -0,0 +1,237 @@
+package iostream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+)
+
+type message struct {
+	data []byte
+}
+
+func (m *message) Data() []byte {
+	return m.data
+}
+
+func TestSourceReadsUntilEOF(t *testing.T) {
+	source := NewSourceFromReader(strings.NewReader("{\"n\":1}\n{\"n\":2}\n\n{\"n\":3}"), bufio.ScanLines)
+	defer source.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	var received []string
+	for i := 0; i < 4; i++ {
+		m := <-msgs
+		received = append(received, string(m.Data()))
+		acks <- m
+	}
+	assert.Equal(t, []string{`{"n":1}`, `{"n":2}`, ``, `{"n":3}`}, received)
+	assert.NoError(t, <-errs)
+}
+
+func TestSourceWaitsForAcksAtEOF(t *testing.T) {
+	source := NewSourceFromReader(strings.NewReader("one\ntwo\n"), bufio.ScanLines)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan substrate.Message, 2)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	one, two := <-msgs, <-msgs
+	acks <- one
+	select {
+	case err := <-errs:
+		t.Fatalf("returned before all messages were acknowledged: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	acks <- two
+	assert.NoError(t, <-errs)
+}
+
+func TestSourceInvalidAck(t *testing.T) {
+	source := NewSourceFromReader(strings.NewReader("one\ntwo\n"), bufio.ScanLines)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan substrate.Message, 2)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	one, two := <-msgs, <-msgs
+	acks <- two
+	assert.Equal(t, substrate.InvalidAckError{Acked: two, Expected: one}, <-errs)
+}
+
+type ackKey struct{}
+
+func TestSourceAckWrappedMessage(t *testing.T) {
+	source := NewSourceFromReader(strings.NewReader("one\ntwo\n"), bufio.ScanLines)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan substrate.Message, 2)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	// Wrappers are acknowledged as the messages they wrap.
+	acks <- substrate.WithValue(<-msgs, ackKey{}, 1)
+	acks <- substrate.WithValue(<-msgs, ackKey{}, 2)
+	assert.NoError(t, <-errs)
+}
+
+func TestSourceResumesAfterCancel(t *testing.T) {
+	r, w := io.Pipe()
+	source := NewSourceFromReader(r, bufio.ScanWords)
+
+	go func() {
+		_, _ = w.Write([]byte("one two "))
+		_, _ = w.Write([]byte("three"))
+		_ = w.Close()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	msgs := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+	one := <-msgs
+	assert.Equal(t, "one", string(one.Data()))
+	acks <- one
+	// Give the source time to read the next token without delivering it.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+	for _, expected := range []string{"two", "three"} {
+		m := <-msgs
+		assert.Equal(t, expected, string(m.Data()))
+		acks <- m
+	}
+	assert.NoError(t, <-errs)
+}
+
+func TestSourceMessageTooLarge(t *testing.T) {
+	source, err := NewAsyncMessageSource(AsyncMessageSourceConfig{
+		Reader:          strings.NewReader(strings.Repeat("x", 100) + "\n"),
+		MaxMessageBytes: 10,
+	})
+	require.NoError(t, err)
+
+	err = source.ConsumeMessages(context.Background(), make(chan substrate.Message), make(chan substrate.Message))
+	assert.Equal(t, bufio.ErrTooLong, err)
+}
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use and counts
+// writes.
+type syncBuffer struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	writes int
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.writes++
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.String()
+}
+
+func TestSinkWritesDelimitedMessages(t *testing.T) {
+	for _, flush := range []bool{false, true} {
+		var out syncBuffer
+		sink, err := NewAsyncMessageSink(AsyncMessageSinkConfig{
+			Writer:          &out,
+			Delimiter:       []byte("\n"),
+			FlushPerMessage: flush,
+		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		msgs := make(chan substrate.Message, 3)
+		acks := make(chan substrate.Message)
+		errs := make(chan error, 1)
+		go func() {
+			errs <- sink.PublishMessages(ctx, acks, msgs)
+		}()
+
+		sent := []substrate.Message{
+			&message{data: []byte(`{"n":1}`)},
+			&message{data: []byte(`{"n":2}`)},
+			&message{data: []byte(`{"n":3}`)},
+		}
+		for _, m := range sent {
+			msgs <- m
+		}
+		for _, m := range sent {
+			assert.Equal(t, m, <-acks)
+		}
+		// Everything acknowledged has been written.
+		assert.Equal(t, "{\"n\":1}\n{\"n\":2}\n{\"n\":3}\n", out.String())
+		if flush {
+			assert.Equal(t, 3, out.writes)
+		}
+
+		cancel()
+		assert.Equal(t, context.Canceled, <-errs)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestSinkWriteError(t *testing.T) {
+	sink := NewSinkFromWriter(failingWriter{}, []byte("\n"))
+
+	msgs := make(chan substrate.Message, 1)
+	msgs <- &message{data: []byte("lost")}
+	err := sink.PublishMessages(context.Background(), make(chan substrate.Message), msgs)
+	assert.Equal(t, io.ErrClosedPipe, err)
+}
@@ -0,0 +1,63 @@
+package iostream
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/suburl"
+)
+
+func init() {
+	suburl.RegisterSink("stdout", newStdoutSink)
+	suburl.RegisterSource("stdin", newStdinSource)
+}
+
+func newStdoutSink(u *url.URL) (substrate.AsyncMessageSink, error) {
+	q := u.Query()
+
+	conf := AsyncMessageSinkConfig{
+		Writer:    os.Stdout,
+		Delimiter: []byte("\n"),
+	}
+
+	if d, ok := q["delimiter"]; ok {
+		conf.Delimiter = []byte(d[0])
+	}
+
+	if v := q.Get("flush-per-message"); v != "" {
+		flush, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse flush-per-message value '%s'", v)
+		}
+		conf.FlushPerMessage = flush
+	}
+
+	return iostreamSinker(conf)
+}
+
+var iostreamSinker = NewAsyncMessageSink
+
+func newStdinSource(u *url.URL) (substrate.AsyncMessageSource, error) {
+	q := u.Query()
+
+	conf := AsyncMessageSourceConfig{
+		Reader: os.Stdin,
+		Split:  bufio.ScanLines,
+	}
+
+	if v := q.Get("max-message-bytes"); v != "" {
+		maxBytes, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse max-message-bytes value '%s'", v)
+		}
+		conf.MaxMessageBytes = maxBytes
+	}
+
+	return iostreamSourcer(conf)
+}
+
+var iostreamSourcer = NewAsyncMessageSource
@@ -0,0 +1,96 @@
+package iostream
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/suburl"
+)
+
+func TestStdoutSink(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		expected    AsyncMessageSinkConfig
+		expectedErr bool
+	}{
+		{
+			name:     "simple",
+			input:    "stdout://",
+			expected: AsyncMessageSinkConfig{Writer: os.Stdout, Delimiter: []byte("\n")},
+		},
+		{
+			name:     "everything",
+			input:    "stdout://?delimiter=%00&flush-per-message=true",
+			expected: AsyncMessageSinkConfig{Writer: os.Stdout, Delimiter: []byte{0}, FlushPerMessage: true},
+		},
+		{
+			name:        "invalid flush",
+			input:       "stdout://?flush-per-message=sometimes",
+			expectedErr: true,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			var conf AsyncMessageSinkConfig
+			iostreamSinker = func(c AsyncMessageSinkConfig) (substrate.AsyncMessageSink, error) {
+				conf = c
+				return nil, nil
+			}
+			_, err := suburl.NewSink(tst.input)
+
+			if tst.expectedErr == (err == nil) {
+				t.Errorf("expected error %v but got %v", tst.expectedErr, err)
+			}
+			assert.Equal(t, tst.expected, conf)
+		})
+	}
+}
+
+func TestStdinSource(t *testing.T) {
+	tests := []struct {
+		name             string
+		input            string
+		expectedMaxBytes int
+		expectedErr      bool
+	}{
+		{
+			name:  "simple",
+			input: "stdin://",
+		},
+		{
+			name:             "everything",
+			input:            "stdin://?max-message-bytes=1024",
+			expectedMaxBytes: 1024,
+		},
+		{
+			name:        "invalid max message bytes",
+			input:       "stdin://?max-message-bytes=big",
+			expectedErr: true,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			var conf AsyncMessageSourceConfig
+			iostreamSourcer = func(c AsyncMessageSourceConfig) (substrate.AsyncMessageSource, error) {
+				conf = c
+				return nil, nil
+			}
+			_, err := suburl.NewSource(tst.input)
+
+			if tst.expectedErr == (err == nil) {
+				t.Errorf("expected error %v but got %v", tst.expectedErr, err)
+			}
+			if err == nil {
+				assert.Equal(t, os.Stdin, conf.Reader)
+				assert.NotNil(t, conf.Split)
+				assert.Equal(t, tst.expectedMaxBytes, conf.MaxMessageBytes)
+			}
+		})
+	}
+}
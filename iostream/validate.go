@@ -0,0 +1,22 @@
+package iostream
+
+import "github.com/uw-labs/substrate/internal/validate"
+
+// Validate returns an error listing the problems of the config, if any, such
+// as "iostream: AsyncMessageSinkConfig.Writer must be set". It is called by
+// NewAsyncMessageSink.
+func (c AsyncMessageSinkConfig) Validate() error {
+	p := validate.New("iostream", "AsyncMessageSinkConfig")
+	p.Check(c.Writer != nil, "Writer", "must be set")
+	return p.Err()
+}
+
+// Validate returns an error listing the problems of the config, if any, such
+// as "iostream: AsyncMessageSourceConfig.Reader must be set". It is called by
+// NewAsyncMessageSource.
+func (c AsyncMessageSourceConfig) Validate() error {
+	p := validate.New("iostream", "AsyncMessageSourceConfig")
+	p.Check(c.Reader != nil, "Reader", "must be set")
+	p.NotNegative(c.MaxMessageBytes, "MaxMessageBytes")
+	return p.Err()
+}
@@ -0,0 +1,58 @@
+package iostream
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsyncMessageSinkConfigValidate(t *testing.T) {
+	assert.NoError(t, AsyncMessageSinkConfig{Writer: &bytes.Buffer{}}.Validate())
+
+	_, err := NewAsyncMessageSink(AsyncMessageSinkConfig{})
+	assert.EqualError(t, err, "iostream: AsyncMessageSinkConfig.Writer must be set")
+}
+
+func TestAsyncMessageSourceConfigValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   AsyncMessageSourceConfig
+		expected string
+	}{
+		{
+			name:   "valid",
+			config: AsyncMessageSourceConfig{Reader: &bytes.Buffer{}, MaxMessageBytes: 1024},
+		},
+		{
+			name:     "no reader",
+			config:   AsyncMessageSourceConfig{},
+			expected: "iostream: AsyncMessageSourceConfig.Reader must be set",
+		},
+		{
+			name:     "max message bytes",
+			config:   AsyncMessageSourceConfig{Reader: &bytes.Buffer{}, MaxMessageBytes: -1},
+			expected: "iostream: AsyncMessageSourceConfig.MaxMessageBytes must not be negative",
+		},
+		{
+			name:   "every problem",
+			config: AsyncMessageSourceConfig{MaxMessageBytes: -1},
+			expected: "2 problems: " +
+				"iostream: AsyncMessageSourceConfig.Reader must be set; " +
+				"iostream: AsyncMessageSourceConfig.MaxMessageBytes must not be negative",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			err := tst.config.Validate()
+			if tst.expected == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tst.expected)
+			_, err = NewAsyncMessageSource(tst.config)
+			assert.EqualError(t, err, tst.expected)
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// OffsetResetTarget is the target of ResetConsumerGroupOffsets. Exactly one of
+// its fields must be set.
+type OffsetResetTarget struct {
+	// Offset resets all the partitions to either OffsetOldest or
+	// OffsetNewest.
+	Offset int64
+	// Time resets all the partitions to the first message at or after it,
+	// or to the newest offset if there is none.
+	Time time.Time
+	// Offsets resets the given partitions to the given offsets. Other
+	// partitions are left as they are.
+	Offsets map[int32]int64
+}
+
+func (t OffsetResetTarget) validate() error {
+	set := 0
+	if t.Offset != 0 {
+		if t.Offset != OffsetOldest && t.Offset != OffsetNewest {
+			return fmt.Errorf("invalid offset reset target offset %d", t.Offset)
+		}
+		set++
+	}
+	if !t.Time.IsZero() {
+		set++
+	}
+	if t.Offsets != nil {
+		set++
+	}
+	if set != 1 {
+		return errors.New("exactly one of the offset reset target fields must be set")
+	}
+	return nil
+}
+
+// OffsetChange is the committed offset of a partition before and after a
+// reset. Before is -1 if the consumer group had no committed offset.
+type OffsetChange struct {
+	Before int64
+	After  int64
+}
+
+// ResetConsumerGroupOffsets commits new offsets for the consumer group on the
+// topic, as given by target, and returns the offsets before and after the
+// reset by partition. Version is the version of the brokers, as in the source
+// and sink configs. It refuses to reset the offsets while the group has active
+// members, as they would overwrite the new offsets with their own commits.
+func ResetConsumerGroupOffsets(ctx context.Context, brokers []string, version string, group, topic string, target OffsetResetTarget) (map[int32]OffsetChange, error) {
+	if err := target.validate(); err != nil {
+		return nil, err
+	}
+	r, err := newOffsetResetter(brokers, version, group, topic)
+	if err != nil {
+		return nil, err
+	}
+	defer r.client.Close()
+	return r.reset(ctx, target)
+}
+
+// groupOffsetsFormat is the version of the format of GroupOffsets.
+const groupOffsetsFormat = 1
+
+// GroupOffsets are the committed offsets of a consumer group on a topic, as
+// exported by ExportGroupOffsets. They marshal to JSON with the fields and
+// partitions in a fixed order, so that they can be stored and compared, e.g.
+// as build artifacts.
+type GroupOffsets struct {
+	// Format is the version of the format, which is checked when the
+	// offsets are imported.
+	Format int    `json:"format"`
+	Group  string `json:"group"`
+	Topic  string `json:"topic"`
+	// Offsets holds the committed offsets by partition. Partitions without
+	// a committed offset are omitted.
+	Offsets map[int32]int64 `json:"offsets"`
+}
+
+// ExportGroupOffsets returns the committed offsets of the consumer group on
+// the topic, so that another consumer group can be started from them with
+// ImportGroupOffsets, e.g. when a service is deployed with a new group id.
+// Version is the version of the brokers, as in the source and sink configs.
+func ExportGroupOffsets(ctx context.Context, brokers []string, version string, group, topic string) (*GroupOffsets, error) {
+	r, err := newOffsetResetter(brokers, version, group, topic)
+	if err != nil {
+		return nil, err
+	}
+	defer r.client.Close()
+	return r.export(ctx)
+}
+
+// ImportGroupOffsets commits the exported offsets for the consumer group,
+// which may differ from the exported one, on the topic of the offsets, and
+// returns the offsets before and after the import by partition. It refuses to
+// overwrite the committed offsets of the group, unless force is set, and to
+// import offsets while the group has active members.
+func ImportGroupOffsets(ctx context.Context, brokers []string, version string, group string, offsets *GroupOffsets, force bool) (map[int32]OffsetChange, error) {
+	if offsets.Format != groupOffsetsFormat {
+		return nil, fmt.Errorf("unsupported group offsets format %d", offsets.Format)
+	}
+	r, err := newOffsetResetter(brokers, version, group, offsets.Topic)
+	if err != nil {
+		return nil, err
+	}
+	defer r.client.Close()
+	r.keepCommitted = !force
+	return r.reset(ctx, OffsetResetTarget{Offsets: offsets.Offsets})
+}
+
+// newOffsetResetter returns a resetter of the offsets of the consumer group on
+// the topic, whose client must be closed once done.
+func newOffsetResetter(brokers []string, version string, group, topic string) (*offsetResetter, error) {
+	conf := sarama.NewConfig()
+	if version != "" {
+		v, err := sarama.ParseKafkaVersion(version)
+		if err != nil {
+			return nil, err
+		}
+		conf.Version = v
+	}
+
+	client, err := sarama.NewClient(brokers, conf)
+	if err != nil {
+		return nil, err
+	}
+	// The admin is not closed, as that would close the client a second time.
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	coordinator, err := client.Coordinator(group)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+
+	return &offsetResetter{
+		client: client,
+		admin:  admin,
+		commit: coordinator.CommitOffset,
+		group:  group,
+		topic:  topic,
+	}, nil
+}
+
+// offsetResetter resets the offsets of a consumer group on a topic. Sarama
+// doesn't support contexts, so the context is checked between requests.
+type offsetResetter struct {
+	client sarama.Client
+	admin  sarama.ClusterAdmin
+	commit func(*sarama.OffsetCommitRequest) (*sarama.OffsetCommitResponse, error)
+	group  string
+	topic  string
+	// keepCommitted is set to refuse resetting partitions that have a
+	// committed offset.
+	keepCommitted bool
+}
+
+// export returns the committed offsets.
+func (r *offsetResetter) export(ctx context.Context) (*GroupOffsets, error) {
+	partitions, err := r.client.Partitions(r.topic)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	committed, err := r.committedOffsets(partitions)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := &GroupOffsets{
+		Format:  groupOffsetsFormat,
+		Group:   r.group,
+		Topic:   r.topic,
+		Offsets: make(map[int32]int64, len(committed)),
+	}
+	for p, offset := range committed {
+		if offset >= 0 {
+			offsets.Offsets[p] = offset
+		}
+	}
+	return offsets, nil
+}
+
+func (r *offsetResetter) reset(ctx context.Context, target OffsetResetTarget) (map[int32]OffsetChange, error) {
+	descs, err := r.admin.DescribeConsumerGroups([]string{r.group})
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range descs {
+		if desc.Err != sarama.ErrNoError {
+			return nil, desc.Err
+		}
+		if len(desc.Members) > 0 {
+			return nil, fmt.Errorf("consumer group %s has %d active members", r.group, len(desc.Members))
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	partitions, err := r.client.Partitions(r.topic)
+	if err != nil {
+		return nil, err
+	}
+	after, err := r.targetOffsets(ctx, partitions, target)
+	if err != nil {
+		return nil, err
+	}
+	ps := make([]int32, 0, len(after))
+	for p := range after {
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i] < ps[j] })
+	before, err := r.committedOffsets(ps)
+	if err != nil {
+		return nil, err
+	}
+	if r.keepCommitted {
+		for _, p := range ps {
+			if before[p] >= 0 {
+				return nil, fmt.Errorf("consumer group %s has a committed offset for partition %d", r.group, p)
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	req := &sarama.OffsetCommitRequest{
+		Version:                 1,
+		ConsumerGroup:           r.group,
+		ConsumerGroupGeneration: sarama.GroupGenerationUndefined,
+		RetentionTime:           -1,
+	}
+	if r.client.Config().Version.IsAtLeast(sarama.V0_9_0_0) {
+		req.Version = 2
+	}
+	for p, offset := range after {
+		req.AddBlock(r.topic, p, offset, sarama.ReceiveTime, "")
+	}
+	resp, err := r.commit(req)
+	if err != nil {
+		return nil, err
+	}
+	for p, kerr := range resp.Errors[r.topic] {
+		if kerr != sarama.ErrNoError {
+			return nil, fmt.Errorf("failed to commit offset of partition %d: %w", p, kerr)
+		}
+	}
+
+	changes := make(map[int32]OffsetChange, len(after))
+	for p, offset := range after {
+		changes[p] = OffsetChange{Before: before[p], After: offset}
+	}
+	return changes, nil
+}
+
+// targetOffsets returns the offsets to reset the partitions to.
+func (r *offsetResetter) targetOffsets(ctx context.Context, partitions []int32, target OffsetResetTarget) (map[int32]int64, error) {
+	if target.Offsets != nil {
+		known := make(map[int32]bool, len(partitions))
+		for _, p := range partitions {
+			known[p] = true
+		}
+		for p := range target.Offsets {
+			if !known[p] {
+				return nil, fmt.Errorf("topic %s has no partition %d", r.topic, p)
+			}
+		}
+		return target.Offsets, nil
+	}
+
+	offsets := make(map[int32]int64, len(partitions))
+	for _, p := range partitions {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var (
+			offset int64
+			err    error
+		)
+		if target.Time.IsZero() {
+			offset, err = r.client.GetOffset(r.topic, p, target.Offset)
+		} else {
+			offset, err = r.client.GetOffset(r.topic, p, target.Time.UnixNano()/int64(time.Millisecond))
+			if err == nil && offset == sarama.OffsetNewest {
+				// There are no messages after the time.
+				offset, err = r.client.GetOffset(r.topic, p, sarama.OffsetNewest)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		offsets[p] = offset
+	}
+	return offsets, nil
+}
+
+// committedOffsets returns the committed offsets of the partitions, which are
+// -1 when there is none.
+func (r *offsetResetter) committedOffsets(partitions []int32) (map[int32]int64, error) {
+	resp, err := r.admin.ListConsumerGroupOffsets(r.group, map[string][]int32{r.topic: partitions})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Err != sarama.ErrNoError {
+		return nil, resp.Err
+	}
+
+	offsets := make(map[int32]int64, len(partitions))
+	for _, p := range partitions {
+		offsets[p] = -1
+		block := resp.GetBlock(r.topic, p)
+		if block == nil {
+			continue
+		}
+		if block.Err != sarama.ErrNoError {
+			return nil, block.Err
+		}
+		if block.Offset >= 0 {
+			offsets[p] = block.Offset
+		}
+	}
+	return offsets, nil
+}
@@ -0,0 +1,203 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type resetClient struct {
+	sarama.Client
+
+	config     *sarama.Config
+	partitions []int32
+	// offsets holds the offsets by time and partition.
+	offsets map[int64]map[int32]int64
+}
+
+func (c *resetClient) Config() *sarama.Config {
+	return c.config
+}
+
+func (c *resetClient) Partitions(string) ([]int32, error) {
+	return c.partitions, nil
+}
+
+func (c *resetClient) GetOffset(_ string, partition int32, time int64) (int64, error) {
+	return c.offsets[time][partition], nil
+}
+
+type resetAdmin struct {
+	sarama.ClusterAdmin
+
+	members   int
+	committed map[int32]int64
+}
+
+func (a *resetAdmin) DescribeConsumerGroups(groups []string) ([]*sarama.GroupDescription, error) {
+	desc := &sarama.GroupDescription{GroupId: groups[0], Members: make(map[string]*sarama.GroupMemberDescription)}
+	for i := 0; i < a.members; i++ {
+		desc.Members[string(rune('a'+i))] = &sarama.GroupMemberDescription{}
+	}
+	return []*sarama.GroupDescription{desc}, nil
+}
+
+func (a *resetAdmin) ListConsumerGroupOffsets(_ string, topicPartitions map[string][]int32) (*sarama.OffsetFetchResponse, error) {
+	resp := &sarama.OffsetFetchResponse{Blocks: make(map[string]map[int32]*sarama.OffsetFetchResponseBlock)}
+	for topic, partitions := range topicPartitions {
+		resp.Blocks[topic] = make(map[int32]*sarama.OffsetFetchResponseBlock)
+		for _, p := range partitions {
+			offset, ok := a.committed[p]
+			if !ok {
+				offset = -1
+			}
+			resp.Blocks[topic][p] = &sarama.OffsetFetchResponseBlock{Offset: offset}
+		}
+	}
+	return resp, nil
+}
+
+func newTestResetter(admin *resetAdmin) (*offsetResetter, *[]*sarama.OffsetCommitRequest) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var commits []*sarama.OffsetCommitRequest
+	r := &offsetResetter{
+		client: &resetClient{
+			config:     sarama.NewConfig(),
+			partitions: []int32{0, 1},
+			offsets: map[int64]map[int32]int64{
+				sarama.OffsetOldest:                        {0: 2, 1: 3},
+				sarama.OffsetNewest:                        {0: 20, 1: 30},
+				start.UnixNano() / int64(time.Millisecond): {0: 12, 1: sarama.OffsetNewest},
+			},
+		},
+		admin: admin,
+		commit: func(req *sarama.OffsetCommitRequest) (*sarama.OffsetCommitResponse, error) {
+			commits = append(commits, req)
+			return &sarama.OffsetCommitResponse{}, nil
+		},
+		group: "group",
+		topic: "topic",
+	}
+	return r, &commits
+}
+
+func TestResetConsumerGroupOffsets(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		target   OffsetResetTarget
+		expected map[int32]OffsetChange
+	}{
+		{
+			name:     "oldest",
+			target:   OffsetResetTarget{Offset: OffsetOldest},
+			expected: map[int32]OffsetChange{0: {Before: 15, After: 2}, 1: {Before: -1, After: 3}},
+		},
+		{
+			name:     "newest",
+			target:   OffsetResetTarget{Offset: OffsetNewest},
+			expected: map[int32]OffsetChange{0: {Before: 15, After: 20}, 1: {Before: -1, After: 30}},
+		},
+		{
+			name:     "time",
+			target:   OffsetResetTarget{Time: start},
+			expected: map[int32]OffsetChange{0: {Before: 15, After: 12}, 1: {Before: -1, After: 30}},
+		},
+		{
+			name:     "offsets",
+			target:   OffsetResetTarget{Offsets: map[int32]int64{0: 7}},
+			expected: map[int32]OffsetChange{0: {Before: 15, After: 7}},
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			r, commits := newTestResetter(&resetAdmin{committed: map[int32]int64{0: 15}})
+			changes, err := r.reset(ctx, tst.target)
+			require.NoError(t, err)
+			assert.Equal(t, tst.expected, changes)
+
+			require.Len(t, *commits, 1)
+			req := (*commits)[0]
+			assert.Equal(t, "group", req.ConsumerGroup)
+			assert.Equal(t, int32(sarama.GroupGenerationUndefined), req.ConsumerGroupGeneration)
+		})
+	}
+}
+
+func TestResetConsumerGroupOffsetsErrors(t *testing.T) {
+	ctx := context.Background()
+
+	r, commits := newTestResetter(&resetAdmin{members: 2})
+	_, err := r.reset(ctx, OffsetResetTarget{Offset: OffsetOldest})
+	assert.EqualError(t, err, "consumer group group has 2 active members")
+	assert.Empty(t, *commits)
+
+	r, commits = newTestResetter(&resetAdmin{})
+	_, err = r.reset(ctx, OffsetResetTarget{Offsets: map[int32]int64{5: 1}})
+	assert.EqualError(t, err, "topic topic has no partition 5")
+	assert.Empty(t, *commits)
+
+	r, _ = newTestResetter(&resetAdmin{})
+	r.commit = func(*sarama.OffsetCommitRequest) (*sarama.OffsetCommitResponse, error) {
+		return &sarama.OffsetCommitResponse{Errors: map[string]map[int32]sarama.KError{
+			"topic": {0: sarama.ErrRebalanceInProgress},
+		}}, nil
+	}
+	_, err = r.reset(ctx, OffsetResetTarget{Offset: OffsetNewest})
+	assert.Error(t, err)
+
+	_, err = ResetConsumerGroupOffsets(ctx, nil, "", "group", "topic", OffsetResetTarget{})
+	assert.EqualError(t, err, "exactly one of the offset reset target fields must be set")
+	_, err = ResetConsumerGroupOffsets(ctx, nil, "", "group", "topic", OffsetResetTarget{Offset: OffsetOldest, Time: time.Now()})
+	assert.EqualError(t, err, "exactly one of the offset reset target fields must be set")
+	_, err = ResetConsumerGroupOffsets(ctx, nil, "", "group", "topic", OffsetResetTarget{Offset: 5})
+	assert.EqualError(t, err, "invalid offset reset target offset 5")
+}
+
+func TestExportGroupOffsets(t *testing.T) {
+	r, _ := newTestResetter(&resetAdmin{committed: map[int32]int64{0: 15}})
+	offsets, err := r.export(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, &GroupOffsets{Format: 1, Group: "group", Topic: "topic", Offsets: map[int32]int64{0: 15}}, offsets)
+
+	// The format is stable.
+	data, err := json.Marshal(&GroupOffsets{Format: 1, Group: "group", Topic: "topic", Offsets: map[int32]int64{1: 7, 0: 15}})
+	require.NoError(t, err)
+	assert.Equal(t, `{"format":1,"group":"group","topic":"topic","offsets":{"0":15,"1":7}}`, string(data))
+}
+
+func TestImportGroupOffsets(t *testing.T) {
+	ctx := context.Background()
+	imported := OffsetResetTarget{Offsets: map[int32]int64{0: 15, 1: 7}}
+
+	r, commits := newTestResetter(&resetAdmin{})
+	r.keepCommitted = true
+	changes, err := r.reset(ctx, imported)
+	require.NoError(t, err)
+	assert.Equal(t, map[int32]OffsetChange{0: {Before: -1, After: 15}, 1: {Before: -1, After: 7}}, changes)
+	assert.Len(t, *commits, 1)
+
+	// Committed offsets are only overwritten when forced.
+	r, commits = newTestResetter(&resetAdmin{committed: map[int32]int64{1: 3}})
+	r.keepCommitted = true
+	_, err = r.reset(ctx, imported)
+	assert.EqualError(t, err, "consumer group group has a committed offset for partition 1")
+	assert.Empty(t, *commits)
+
+	r, commits = newTestResetter(&resetAdmin{committed: map[int32]int64{1: 3}})
+	changes, err = r.reset(ctx, imported)
+	require.NoError(t, err)
+	assert.Equal(t, OffsetChange{Before: 3, After: 7}, changes[1])
+	assert.Len(t, *commits, 1)
+
+	_, err = ImportGroupOffsets(ctx, nil, "", "group", &GroupOffsets{Format: 2}, false)
+	assert.EqualError(t, err, "unsupported group offsets format 2")
+}
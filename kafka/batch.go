@@ -0,0 +1,35 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+
+	"github.com/Shopify/sarama"
+	"github.com/uw-labs/substrate"
+)
+
+var _ substrate.AsyncMessageBatchSink = (*orderedSink)(nil)
+
+// PublishBatches implements the substrate.AsyncMessageBatchSink interface.
+// The messages of every batch are produced back to back, so that they are
+// sent together, in a single request per broker when FlushMessages is set to
+// the size of the batches. A message failing a batch is reported in a
+// *substrate.BatchError, which wraps its *sarama.ProducerError. It returns
+// ErrConcurrentPublish if the sink is already publishing.
+func (s *orderedSink) PublishBatches(ctx context.Context, acks chan<- []substrate.Message, batches <-chan []substrate.Message) error {
+	if !atomic.CompareAndSwapInt32(&s.publishing, 0, 1) {
+		return ErrConcurrentPublish
+	}
+	defer atomic.StoreInt32(&s.publishing, 0)
+	return substrate.PublishBatches(ctx, s.AckOrderingSink, acks, batches, failedMessage)
+}
+
+// failedMessage returns the message a produce error is about, if any.
+func failedMessage(err error) substrate.Message {
+	var perr *sarama.ProducerError
+	if !errors.As(err, &perr) || perr.Msg == nil {
+		return nil
+	}
+	return publishedMessage(perr.Msg)
+}
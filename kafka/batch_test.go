@@ -0,0 +1,59 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/helper"
+)
+
+func TestPublishBatches(t *testing.T) {
+	producer := newFakeProducer()
+	sink := &orderedSink{AckOrderingSink: helper.NewAckOrderingSink(&asyncMessageSink{Topic: "t1", producer: producer})}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	batches := make(chan []substrate.Message)
+	acks := make(chan []substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishBatches(ctx, acks, batches)
+	}()
+
+	m1, m2, m3 := &reusedBufferMessage{data: []byte("1")}, &reusedBufferMessage{data: []byte("2")}, &reusedBufferMessage{data: []byte("3")}
+	batch := []substrate.Message{m1, m2}
+	batches <- batch
+	produced := []*sarama.ProducerMessage{<-producer.input, <-producer.input}
+	// The messages are acknowledged in order, as a batch.
+	producer.successes <- produced[1]
+	producer.successes <- produced[0]
+	assert.Equal(t, batch, <-acks)
+
+	batches <- []substrate.Message{m1, m2, m3}
+	produced = []*sarama.ProducerMessage{<-producer.input, <-producer.input, <-producer.input}
+	producer.successes <- produced[0]
+	producer.errors <- &sarama.ProducerError{Msg: produced[2], Err: sarama.ErrMessageSizeTooLarge}
+
+	err := <-errs
+	var berr *substrate.BatchError
+	require.True(t, errors.As(err, &berr))
+	require.Len(t, berr.Errs, 1)
+	require.IsType(t, &sarama.ProducerError{}, berr.Errs[2])
+	assert.Equal(t, sarama.ErrMessageSizeTooLarge, berr.Errs[2].(*sarama.ProducerError).Err)
+}
+
+func TestFailedMessage(t *testing.T) {
+	msg := &reusedBufferMessage{data: []byte("1")}
+	for _, metadata := range []interface{}{msg, &retriedMessage{msg: msg, attempt: 2}} {
+		perr := &sarama.ProducerError{Msg: &sarama.ProducerMessage{Metadata: metadata}, Err: sarama.ErrNotEnoughReplicas}
+		assert.Equal(t, substrate.Message(msg), failedMessage(perr))
+	}
+	assert.Nil(t, failedMessage(errors.New("not a produce error")))
+	assert.Nil(t, failedMessage(&sarama.ProducerError{Err: sarama.ErrOutOfBrokers}))
+}
@@ -0,0 +1,129 @@
+package kafka
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/uw-labs/substrate"
+)
+
+// brokerStatusTTL is how long the broker metadata reported by Status is
+// cached, so that health checks polling Status often don't query the cluster
+// every time.
+const brokerStatusTTL = 10 * time.Second
+
+// brokerReport is the broker metadata reported by Status.
+type brokerReport struct {
+	details  map[string]string
+	problems []string
+}
+
+// brokerStatus reports the state of the configured brokers, the controller,
+// and the leaders of the partitions of a topic, so that Status says which
+// broker a problem comes from.
+type brokerStatus struct {
+	client  sarama.Client
+	brokers []string
+	topic   string
+	// lookupHost resolves the host of the brokers that are not connected.
+	lookupHost func(host string) ([]string, error)
+	now        func() time.Time
+
+	mu        sync.Mutex
+	report    *brokerReport
+	expiresAt time.Time
+}
+
+func newBrokerStatus(client sarama.Client, brokers []string, topic string) *brokerStatus {
+	return &brokerStatus{
+		client:     client,
+		brokers:    brokers,
+		topic:      topic,
+		lookupHost: net.LookupHost,
+		now:        time.Now,
+	}
+}
+
+// addTo adds the broker metadata to the details and problems of a status. A
+// nil brokerStatus adds nothing.
+func (s *brokerStatus) addTo(st *substrate.Status) {
+	if s == nil {
+		return
+	}
+	r := s.get()
+	if st.Details == nil {
+		st.Details = make(map[string]string, len(r.details))
+	}
+	for k, v := range r.details {
+		st.Details[k] = v
+	}
+	st.Problems = append(st.Problems, r.problems...)
+}
+
+// get returns the cached report, or a new one once it expired.
+func (s *brokerStatus) get() *brokerReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.report == nil || !s.now().Before(s.expiresAt) {
+		s.report = s.fetch()
+		s.expiresAt = s.now().Add(brokerStatusTTL)
+	}
+	return s.report
+}
+
+func (s *brokerStatus) fetch() *brokerReport {
+	r := &brokerReport{details: make(map[string]string)}
+
+	connected := make(map[string]bool)
+	for _, b := range s.client.Brokers() {
+		if ok, _ := b.Connected(); ok {
+			connected[b.Addr()] = true
+		}
+	}
+	for _, addr := range s.brokers {
+		key := "broker-" + addr
+		if connected[addr] {
+			r.details[key] = "connected"
+			continue
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		if _, err := s.lookupHost(host); err != nil {
+			r.details[key] = "unresolvable"
+			r.problems = append(r.problems, fmt.Sprintf("broker %s is unresolvable: %s", addr, err))
+			continue
+		}
+		r.details[key] = "not connected"
+	}
+
+	if controller, err := s.client.Controller(); err != nil {
+		r.problems = append(r.problems, fmt.Sprintf("no controller: %s", err))
+	} else {
+		r.details["controller"] = strconv.Itoa(int(controller.ID()))
+	}
+
+	cached, err := s.client.Partitions(s.topic)
+	if err != nil {
+		return r
+	}
+	// The partitions are copied, as sarama returns the slice it caches.
+	partitions := append([]int32(nil), cached...)
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+	for _, p := range partitions {
+		leader, err := s.client.Leader(s.topic, p)
+		if err != nil {
+			r.details[fmt.Sprintf("partition-%d-leader", p)] = "none"
+			r.problems = append(r.problems, fmt.Sprintf("partition %d has no leader: %s", p, err))
+			continue
+		}
+		r.details[fmt.Sprintf("partition-%d-leader", p)] = fmt.Sprintf("%d (%s)", leader.ID(), leader.Addr())
+	}
+	return r
+}
@@ -0,0 +1,107 @@
+package kafka
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultOnAckedInterval = time.Second
+
+// checkpointer passes the offsets marked for acknowledged messages to the
+// OnAcked callback, coalesced to at most one call per partition per interval.
+type checkpointer struct {
+	topic    string
+	onAcked  func(topic string, partition int32, offset int64) error
+	onError  func(error) error
+	interval time.Duration
+
+	mu sync.Mutex
+	// pending holds the offsets marked since the last calls, by partition.
+	pending map[int32]int64
+	notify  chan struct{}
+}
+
+func newCheckpointer(c AsyncMessageSourceConfig) *checkpointer {
+	if c.OnAcked == nil {
+		return nil
+	}
+	interval := defaultOnAckedInterval
+	if c.OnAckedInterval > 0 {
+		interval = c.OnAckedInterval
+	}
+	return &checkpointer{
+		topic:    c.Topic,
+		onAcked:  c.OnAcked,
+		onError:  c.OnAckedError,
+		interval: interval,
+		pending:  make(map[int32]int64),
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// acked records the offset marked for the partition, which is the offset of
+// the next message to consume.
+func (c *checkpointer) acked(partition int32, offset int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.pending[partition] = offset
+	c.mu.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run calls the callback with the pending offsets as they are marked, waiting
+// for the interval between calls, until the context is done or the callback
+// fails.
+func (c *checkpointer) run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.notify:
+		}
+		if err := c.flush(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.interval):
+		}
+	}
+}
+
+// flush calls the callback with the pending offsets, in partition order.
+func (c *checkpointer) flush() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = make(map[int32]int64)
+	c.mu.Unlock()
+
+	partitions := make([]int32, 0, len(pending))
+	for p := range pending {
+		partitions = append(partitions, p)
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+
+	for _, p := range partitions {
+		err := c.onAcked(c.topic, p, pending[p])
+		if err != nil && c.onError != nil {
+			err = c.onError(err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
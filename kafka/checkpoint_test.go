@@ -0,0 +1,113 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type checkpoint struct {
+	partition int32
+	offset    int64
+}
+
+func TestCheckpointerCoalescesOffsets(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	calls := make(chan checkpoint, 10)
+	cp := newCheckpointer(AsyncMessageSourceConfig{
+		Topic: "topic",
+		OnAcked: func(topic string, partition int32, offset int64) error {
+			assert.Equal(t, "topic", topic)
+			calls <- checkpoint{partition, offset}
+			return nil
+		},
+		OnAckedInterval: 100 * time.Millisecond,
+	})
+	cp.acked(1, 5)
+	cp.acked(0, 1)
+	cp.acked(0, 2)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- cp.run(ctx)
+	}()
+	assert.Equal(t, checkpoint{0, 2}, <-calls)
+	assert.Equal(t, checkpoint{1, 5}, <-calls)
+
+	start := time.Now()
+	cp.acked(0, 3)
+	cp.acked(0, 4)
+	assert.Equal(t, checkpoint{0, 4}, <-calls)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond, "called before the interval")
+	select {
+	case c := <-calls:
+		t.Fatalf("unexpected call %v", c)
+	case <-time.After(150 * time.Millisecond):
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+
+	// Offsets marked after run returns are passed on by flush.
+	cp.acked(2, 7)
+	require.NoError(t, cp.flush())
+	assert.Equal(t, checkpoint{2, 7}, <-calls)
+}
+
+func TestCheckpointerErrors(t *testing.T) {
+	callbackErr := errors.New("job table unavailable")
+	onAcked := func(string, int32, int64) error { return callbackErr }
+
+	cp := newCheckpointer(AsyncMessageSourceConfig{OnAcked: onAcked})
+	cp.acked(0, 1)
+	assert.Equal(t, callbackErr, cp.run(context.Background()))
+
+	var handled []error
+	cp = newCheckpointer(AsyncMessageSourceConfig{
+		OnAcked: onAcked,
+		OnAckedError: func(err error) error {
+			handled = append(handled, err)
+			return nil
+		},
+	})
+	cp.acked(0, 1)
+	cp.acked(1, 1)
+	require.NoError(t, cp.flush())
+	assert.Equal(t, []error{callbackErr, callbackErr}, handled)
+
+	terminateErr := errors.New("terminate")
+	cp = newCheckpointer(AsyncMessageSourceConfig{
+		OnAcked:      onAcked,
+		OnAckedError: func(error) error { return terminateErr },
+	})
+	cp.acked(0, 1)
+	assert.Equal(t, terminateErr, cp.flush())
+}
+
+func TestAcksProcessorCheckpoints(t *testing.T) {
+	cp := newCheckpointer(AsyncMessageSourceConfig{
+		OnAcked: func(string, int32, int64) error { return nil },
+	})
+	msg := &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "topic", Partition: 3, Offset: 41}}
+	ap := &kafkaAcksProcessor{
+		sess:        newClaimsSession(3),
+		marked:      make(map[int32]int64),
+		forAcking:   []*consumerMessage{msg},
+		checkpoints: cp,
+	}
+	require.NoError(t, ap.processAck(msg))
+	assert.Equal(t, map[int32]int64{3: 42}, cp.pending)
+
+	// Messages consumed before a rebalance are not marked.
+	discarded := &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "topic", Partition: 3, Offset: 42}, discard: true}
+	ap.forAcking = []*consumerMessage{discarded}
+	require.NoError(t, ap.processAck(discarded))
+	assert.Equal(t, map[int32]int64{3: 42}, cp.pending)
+}
@@ -0,0 +1,202 @@
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+var (
+	_ Checkpointer = (*FileCheckpointer)(nil)
+	_ Checkpointer = (*KafkaCheckpointer)(nil)
+)
+
+// FileCheckpointer is a Checkpointer saving the offsets to a JSON file, by
+// topic and partition, e.g. on a volume of the instance consuming the
+// partitions.
+type FileCheckpointer struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileCheckpointer returns a checkpointer saving the offsets to the file at
+// path, which is created on the first save.
+func NewFileCheckpointer(path string) *FileCheckpointer {
+	return &FileCheckpointer{path: path}
+}
+
+// Load implements the Load method of the Checkpointer interface.
+func (c *FileCheckpointer) Load(topic string, partitions []int32) (map[int32]int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	saved, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[int32]int64, len(partitions))
+	for _, p := range partitions {
+		if offset, ok := saved[topic][p]; ok {
+			offsets[p] = offset
+		}
+	}
+	return offsets, nil
+}
+
+// Save implements the Save method of the Checkpointer interface. The file is
+// replaced atomically, so that it is never left partly written.
+func (c *FileCheckpointer) Save(topic string, offsets map[int32]int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	saved, err := c.read()
+	if err != nil {
+		return err
+	}
+	if saved[topic] == nil {
+		saved[topic] = make(map[int32]int64, len(offsets))
+	}
+	for p, offset := range offsets {
+		saved[topic][p] = offset
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
+
+// read returns the saved offsets by topic and partition.
+func (c *FileCheckpointer) read() (map[string]map[int32]int64, error) {
+	saved := make(map[string]map[int32]int64)
+	data, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return saved, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint file %s: %w", c.path, err)
+	}
+	return saved, nil
+}
+
+// KafkaCheckpointer is a Checkpointer committing the offsets for a consumer
+// group, which is only used to store them, to the offsets topic of the
+// cluster, as consumer groups do. The group must not be used by consumer group
+// sources, whose commits would overwrite the offsets.
+type KafkaCheckpointer struct {
+	client sarama.Client
+	admin  sarama.ClusterAdmin
+	group  string
+}
+
+// NewKafkaCheckpointer returns a checkpointer committing the offsets for the
+// consumer group. Version is the version of the brokers, as in the source and
+// sink configs. It must be closed once done.
+func NewKafkaCheckpointer(brokers []string, version string, group string) (*KafkaCheckpointer, error) {
+	conf := sarama.NewConfig()
+	if version != "" {
+		v, err := sarama.ParseKafkaVersion(version)
+		if err != nil {
+			return nil, err
+		}
+		conf.Version = v
+	}
+
+	client, err := sarama.NewClient(brokers, conf)
+	if err != nil {
+		return nil, err
+	}
+	// The admin is not closed, as that would close the client a second time.
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return &KafkaCheckpointer{client: client, admin: admin, group: group}, nil
+}
+
+// Load implements the Load method of the Checkpointer interface.
+func (c *KafkaCheckpointer) Load(topic string, partitions []int32) (map[int32]int64, error) {
+	resp, err := c.admin.ListConsumerGroupOffsets(c.group, map[string][]int32{topic: partitions})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Err != sarama.ErrNoError {
+		return nil, resp.Err
+	}
+
+	offsets := make(map[int32]int64, len(partitions))
+	for _, p := range partitions {
+		block := resp.GetBlock(topic, p)
+		if block == nil {
+			continue
+		}
+		if block.Err != sarama.ErrNoError {
+			return nil, block.Err
+		}
+		if block.Offset >= 0 {
+			offsets[p] = block.Offset
+		}
+	}
+	return offsets, nil
+}
+
+// Save implements the Save method of the Checkpointer interface.
+func (c *KafkaCheckpointer) Save(topic string, offsets map[int32]int64) error {
+	coordinator, err := c.client.Coordinator(c.group)
+	if err != nil {
+		return err
+	}
+	req := &sarama.OffsetCommitRequest{
+		Version:                 1,
+		ConsumerGroup:           c.group,
+		ConsumerGroupGeneration: sarama.GroupGenerationUndefined,
+		RetentionTime:           -1,
+	}
+	if c.client.Config().Version.IsAtLeast(sarama.V0_9_0_0) {
+		req.Version = 2
+	}
+	for p, offset := range offsets {
+		req.AddBlock(topic, p, offset, sarama.ReceiveTime, "")
+	}
+	resp, err := coordinator.CommitOffset(req)
+	if err != nil {
+		return err
+	}
+	for p, kerr := range resp.Errors[topic] {
+		if kerr != sarama.ErrNoError {
+			return fmt.Errorf("failed to commit offset of partition %d: %w", p, kerr)
+		}
+	}
+	return nil
+}
+
+// Close closes the client of the checkpointer.
+func (c *KafkaCheckpointer) Close() error {
+	return c.client.Close()
+}
@@ -0,0 +1,137 @@
+package kafka
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClaimMetricsReporter is implemented by the sources returned by
+// NewAsyncMessageSource, to report where the messages of every partition
+// wait on their way from sarama to the caller, e.g. to tell whether
+// ReadAhead helps. The instrumented package provides a prometheus collector
+// for them.
+type ClaimMetricsReporter interface {
+	// ClaimMetrics returns the metrics of the partitions claimed since the
+	// source was created, ordered by partition.
+	ClaimMetrics() []ClaimMetrics
+}
+
+// ClaimMetrics are the counters of a partition, which are cumulative over the
+// sessions that claimed it.
+type ClaimMetrics struct {
+	Partition int32
+	// Messages is the number of messages received from the claims of the
+	// partition.
+	Messages int64
+	// Batches is the number of runs of messages received from the claims
+	// without waiting, which roughly follows the fetches of the partition.
+	Batches int64
+	// HandoffBlocked is the time spent waiting to hand the messages over
+	// to the goroutine delivering them, which is busy delivering the
+	// messages of every partition.
+	HandoffBlocked time.Duration
+	// DeliveryBlocked is the time spent waiting for the caller to receive
+	// the messages from the messages channel.
+	DeliveryBlocked time.Duration
+}
+
+var _ ClaimMetricsReporter = (*asyncMessageSource)(nil)
+
+// ClaimMetrics implements the ClaimMetricsReporter interface.
+func (ams *asyncMessageSource) ClaimMetrics() []ClaimMetrics {
+	return ams.claimMetrics.report()
+}
+
+// partitionCounters are the counters of a partition, which are updated
+// atomically, so that recording them costs little more than an addition.
+type partitionCounters struct {
+	messages        int64
+	batches         int64
+	handoffBlocked  int64
+	deliveryBlocked int64
+}
+
+// received records a message received from a claim, which ends a batch if no
+// other message is buffered after it. Like the other methods, it records
+// nothing on nil counters.
+func (pc *partitionCounters) received(buffered int) {
+	if pc == nil {
+		return
+	}
+	atomic.AddInt64(&pc.messages, 1)
+	if buffered == 0 {
+		atomic.AddInt64(&pc.batches, 1)
+	}
+}
+
+// handedOff records the time blocked handing a message over since start.
+func (pc *partitionCounters) handedOff(start time.Time) {
+	if pc == nil {
+		return
+	}
+	atomic.AddInt64(&pc.handoffBlocked, int64(time.Since(start)))
+}
+
+// delivered records the time blocked delivering a message since start.
+func (pc *partitionCounters) delivered(start time.Time) {
+	if pc == nil {
+		return
+	}
+	atomic.AddInt64(&pc.deliveryBlocked, int64(time.Since(start)))
+}
+
+// claimMetrics holds the counters of the claimed partitions. A nil
+// claimMetrics records nothing.
+type claimMetrics struct {
+	mu         sync.RWMutex
+	partitions map[int32]*partitionCounters
+}
+
+func newClaimMetrics() *claimMetrics {
+	return &claimMetrics{partitions: make(map[int32]*partitionCounters)}
+}
+
+// partition returns the counters of a partition, or nil if nothing is
+// recorded.
+func (m *claimMetrics) partition(p int32) *partitionCounters {
+	if m == nil {
+		return nil
+	}
+	m.mu.RLock()
+	pc, ok := m.partitions[p]
+	m.mu.RUnlock()
+	if ok {
+		return pc
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if pc, ok = m.partitions[p]; !ok {
+		pc = &partitionCounters{}
+		m.partitions[p] = pc
+	}
+	return pc
+}
+
+func (m *claimMetrics) report() []ClaimMetrics {
+	if m == nil {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	report := make([]ClaimMetrics, 0, len(m.partitions))
+	for p, pc := range m.partitions {
+		report = append(report, ClaimMetrics{
+			Partition:       p,
+			Messages:        atomic.LoadInt64(&pc.messages),
+			Batches:         atomic.LoadInt64(&pc.batches),
+			HandoffBlocked:  time.Duration(atomic.LoadInt64(&pc.handoffBlocked)),
+			DeliveryBlocked: time.Duration(atomic.LoadInt64(&pc.deliveryBlocked)),
+		})
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Partition < report[j].Partition })
+	return report
+}
@@ -0,0 +1,88 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimMetrics(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	metrics := newClaimMetrics()
+	toAck := make(chan *consumerMessage)
+	handler := &consumerGroupHandler{
+		ctx:          ctx,
+		topic:        "topic",
+		toAck:        toAck,
+		claimMetrics: metrics,
+	}
+	// The messages of a single fetch are buffered.
+	claim := &fakeClaim{partition: 2, messages: make(chan *sarama.ConsumerMessage, 3)}
+	for offset := int64(0); offset < 3; offset++ {
+		claim.messages <- &sarama.ConsumerMessage{Topic: "topic", Partition: 2, Offset: offset}
+	}
+	close(claim.messages)
+	claimDone := make(chan error, 1)
+	go func() {
+		claimDone <- handler.ConsumeClaim(&fakeSession{marked: make(map[int32]int64)}, claim)
+	}()
+
+	// Handing the first message over waits for it to be received.
+	time.Sleep(20 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		<-toAck
+	}
+	require.NoError(t, <-claimDone)
+
+	report := metrics.report()
+	require.Len(t, report, 1)
+	assert.Equal(t, int32(2), report[0].Partition)
+	assert.Equal(t, int64(3), report[0].Messages)
+	assert.Equal(t, int64(1), report[0].Batches)
+	assert.True(t, report[0].HandoffBlocked >= 20*time.Millisecond, report[0].HandoffBlocked)
+	assert.Zero(t, report[0].DeliveryBlocked)
+}
+
+func BenchmarkClaimMetrics(b *testing.B) {
+	for _, tst := range []struct {
+		name    string
+		metrics *claimMetrics
+	}{
+		{name: "without metrics"},
+		{name: "with metrics", metrics: newClaimMetrics()},
+	} {
+		b.Run(tst.name, func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			toAck := make(chan *consumerMessage, 100)
+			handler := &consumerGroupHandler{
+				ctx:          ctx,
+				topic:        "topic",
+				toAck:        toAck,
+				claimMetrics: tst.metrics,
+			}
+			claim := &fakeClaim{messages: make(chan *sarama.ConsumerMessage, 100)}
+			go func() {
+				defer close(claim.messages)
+				for i := 0; i < b.N; i++ {
+					claim.messages <- &sarama.ConsumerMessage{Topic: "topic", Offset: int64(i)}
+				}
+			}()
+			b.ResetTimer()
+
+			go func() {
+				_ = handler.ConsumeClaim(&fakeSession{marked: make(map[int32]int64)}, claim)
+			}()
+			for i := 0; i < b.N; i++ {
+				<-toAck
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+package kafka
+
+import "strings"
+
+// clientID returns the configured client id, or a default derived from the
+// topic. Sarama only accepts alphanumeric characters, '.', '_' and '-' in
+// client ids, so any other character of the topic is replaced by '_'.
+func clientID(configured, topic string) string {
+	if configured != "" {
+		return configured
+	}
+	return "substrate-" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, topic)
+}
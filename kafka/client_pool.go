@@ -0,0 +1,119 @@
+package kafka
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// ClientPool shares sarama clients, and so their connections and metadata
+// refreshes, between the sources and sinks created with the pool set on their
+// configs. Sinks share a client with the sinks with the same brokers and
+// options, and sources with the sources with the same brokers and options,
+// apart from the topic and the options that are handled by the source or sink
+// itself, such as the consumer group. Since ClientID defaults to a client id
+// derived from the topic, it must be set for sources or sinks of different
+// topics to share a client. Clients are reference counted, so closing a source
+// or sink doesn't affect the others, and a client is closed once all the
+// sources and sinks using it are closed. A pool is safe for concurrent use.
+type ClientPool struct {
+	mu      sync.Mutex
+	clients map[string]*pooledClient
+
+	newClient func(brokers []string, conf *sarama.Config) (sarama.Client, error)
+}
+
+// NewClientPool returns a new, empty, client pool.
+func NewClientPool() *ClientPool {
+	return &ClientPool{
+		clients:   make(map[string]*pooledClient),
+		newClient: sarama.NewClient,
+	}
+}
+
+type pooledClient struct {
+	client sarama.Client
+	refs   int
+}
+
+// acquire returns a client for the key, which is created with brokers and
+// conf if the pool holds none. The returned client releases its reference
+// when it is closed.
+func (p *ClientPool) acquire(key string, brokers []string, conf *sarama.Config) (sarama.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pc, ok := p.clients[key]
+	if !ok {
+		client, err := p.newClient(brokers, conf)
+		if err != nil {
+			return nil, err
+		}
+		pc = &pooledClient{client: client}
+		p.clients[key] = pc
+	}
+	pc.refs++
+	return &sharedClient{Client: pc.client, pool: p, key: key}, nil
+}
+
+// release drops a reference to the client for the key, which is closed once
+// it is no longer referenced.
+func (p *ClientPool) release(key string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pc := p.clients[key]
+	pc.refs--
+	if pc.refs > 0 {
+		return nil
+	}
+	delete(p.clients, key)
+	return pc.client.Close()
+}
+
+// sharedClient is a reference to a pooled client.
+type sharedClient struct {
+	sarama.Client
+	pool *ClientPool
+	key  string
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Close releases the reference to the pooled client, closing it if it is the
+// last one.
+func (c *sharedClient) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.pool.release(c.key)
+	})
+	return c.closeErr
+}
+
+// newClient returns a client from the pool if it is set, or a new one.
+func newClient(pool *ClientPool, kind string, brokers []string, conf *sarama.Config, options ...interface{}) (sarama.Client, error) {
+	if pool == nil {
+		return sarama.NewClient(brokers, conf)
+	}
+	return pool.acquire(clientKey(kind, brokers, conf, options...), brokers, conf)
+}
+
+// clientKey returns the key identifying the clients that can be shared, from
+// the sarama options set by the sources and sinks, and the options whose
+// identity matters, such as the metric registry.
+func clientKey(kind string, brokers []string, conf *sarama.Config, options ...interface{}) string {
+	sorted := append([]string(nil), brokers...)
+	sort.Strings(sorted)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s|%q|%q|%s|%d|%t|%p|%s", kind, sorted, conf.ClientID, conf.Version, conf.Net.MaxOpenRequests, conf.Net.TLS.Enable, conf.Net.TLS.Config, conf.Metadata.RefreshFrequency)
+	fmt.Fprintf(&b, "|%d|%t|%p", conf.Producer.MaxMessageBytes, conf.Producer.Idempotent, conf.Producer.Partitioner)
+	fmt.Fprintf(&b, "|%d|%s|%s", conf.Consumer.Offsets.Initial, conf.Consumer.Offsets.Retention, conf.Consumer.Group.Session.Timeout)
+	for _, o := range options {
+		fmt.Fprintf(&b, "|%p", o)
+	}
+	return b.String()
+}
@@ -0,0 +1,94 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// closingClient records whether it was closed.
+type closingClient struct {
+	sarama.Client
+	closed bool
+}
+
+func (c *closingClient) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *closingClient) Closed() bool {
+	return c.closed
+}
+
+func TestClientPoolSharesClients(t *testing.T) {
+	pool := NewClientPool()
+	var created []*closingClient
+	pool.newClient = func([]string, *sarama.Config) (sarama.Client, error) {
+		c := &closingClient{}
+		created = append(created, c)
+		return c, nil
+	}
+
+	sinkConfig := func(brokers []string, version string) *sarama.Config {
+		conf, err := (&AsyncMessageSinkConfig{Brokers: brokers, ClientID: "svc", Version: version}).buildSaramaProducerConfig()
+		require.NoError(t, err)
+		return conf
+	}
+
+	c1, err := newClient(pool, "sink", []string{"b1", "b2"}, sinkConfig([]string{"b1", "b2"}, "2.4.0"), nil)
+	require.NoError(t, err)
+	c2, err := newClient(pool, "sink", []string{"b2", "b1"}, sinkConfig([]string{"b2", "b1"}, "2.4.0"), nil)
+	require.NoError(t, err)
+	require.Len(t, created, 1)
+
+	// Incompatible configs get separate clients.
+	c3, err := newClient(pool, "sink", []string{"b1", "b2"}, sinkConfig([]string{"b1", "b2"}, "2.3.0"), nil)
+	require.NoError(t, err)
+	require.Len(t, created, 2)
+
+	// The client is closed once the last reference is closed.
+	require.NoError(t, c1.Close())
+	require.NoError(t, c1.Close())
+	assert.False(t, created[0].closed)
+	assert.False(t, c2.Closed())
+	require.NoError(t, c2.Close())
+	assert.True(t, created[0].closed)
+	assert.False(t, created[1].closed)
+
+	require.NoError(t, c3.Close())
+	assert.True(t, created[1].closed)
+	assert.Empty(t, pool.clients)
+}
+
+func TestClientKey(t *testing.T) {
+	sinkConf, err := (&AsyncMessageSinkConfig{Topic: "t1", ClientID: "svc"}).buildSaramaProducerConfig()
+	require.NoError(t, err)
+	sourceConf, err := (&AsyncMessageSourceConfig{Topic: "t1", ClientID: "svc"}).buildSaramaConsumerConfig()
+	require.NoError(t, err)
+	brokers := []string{"localhost:9092"}
+
+	key := clientKey("sink", brokers, sinkConf, nil)
+	otherTopicConf, err := (&AsyncMessageSinkConfig{Topic: "t2", ClientID: "svc"}).buildSaramaProducerConfig()
+	require.NoError(t, err)
+	assert.Equal(t, key, clientKey("sink", brokers, otherTopicConf, nil))
+
+	assert.NotEqual(t, key, clientKey("source", brokers, sourceConf, nil))
+	assert.NotEqual(t, key, clientKey("sink", []string{"localhost:9093"}, sinkConf, nil))
+
+	tlsConf, err := (&AsyncMessageSinkConfig{Topic: "t1", ClientID: "svc"}).buildSaramaProducerConfig()
+	require.NoError(t, err)
+	tlsConf.Net.TLS.Enable = true
+	assert.NotEqual(t, key, clientKey("sink", brokers, tlsConf, nil))
+
+	registryConf, err := (&AsyncMessageSinkConfig{Topic: "t1", ClientID: "svc"}).buildSaramaProducerConfig()
+	require.NoError(t, err)
+	assert.NotEqual(t, key, clientKey("sink", brokers, registryConf, registryConf.MetricRegistry))
+
+	// Producers take their partitioner from the config of the client.
+	manualConf, err := (&AsyncMessageSinkConfig{Topic: "t1", ClientID: "svc", PartitionFunc: SourcePartition}).buildSaramaProducerConfig()
+	require.NoError(t, err)
+	assert.NotEqual(t, key, clientKey("sink", brokers, manualConf, nil))
+}
@@ -2,11 +2,16 @@ package kafka
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
+	"strconv"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/hashicorp/go-multierror"
+	metrics "github.com/rcrowley/go-metrics"
 	"github.com/uw-labs/substrate"
 	"github.com/uw-labs/substrate/internal/debug"
 	"github.com/uw-labs/sync/rungroup"
@@ -22,17 +27,241 @@ const (
 	defaultConsumerSessionTimeout   = 10 * time.Second
 )
 
+// OffsetCommitter is implemented by the sources returned by
+// NewAsyncMessageSource, to commit and inspect the offsets of the consumer
+// group. Offsets are marked as messages are acknowledged, and marked offsets
+// are committed periodically by sarama, or when Commit is called.
+type OffsetCommitter interface {
+	// Commit synchronously commits all the marked offsets. It blocks until
+	// ConsumeMessages is running.
+	Commit(ctx context.Context) error
+	// MarkedOffsets returns the offsets marked in the current consumer
+	// group session, by partition. Like committed offsets, they are the
+	// offsets of the next messages to consume. It blocks until
+	// ConsumeMessages is running.
+	MarkedOffsets(ctx context.Context) (map[int32]int64, error)
+	// CommittedOffsets returns the offsets committed for the consumer
+	// group by partition, as fetched from the broker. Partitions without a
+	// committed offset are omitted.
+	CommittedOffsets(ctx context.Context) (map[int32]int64, error)
+}
+
 // AsyncMessageSource represents a kafka message source and implements the
 // substrate.AsyncMessageSource interface.
 type AsyncMessageSourceConfig struct {
-	ConsumerGroup            string
-	Topic                    string
+	ConsumerGroup string
+	Topic         string
+	// Namespace, if set, is prepended as it is to Topic, e.g. "billing."
+	// for the topics of a team on a shared cluster. The namespaced topic is
+	// the one reported by Status and errors.
+	Namespace                string
 	Brokers                  []string
 	Offset                   int64
 	MetadataRefreshFrequency time.Duration
 	OffsetsRetention         time.Duration
 	SessionTimeout           time.Duration
 	Version                  string
+	// ClientID is the client id reported to the brokers, which shows up in
+	// their logs and metrics. Defaults to "substrate-" followed by the
+	// topic.
+	ClientID string
+	// RackID, if set, is the rack the source runs in, as set with
+	// broker.rack on the brokers, e.g. the availability zone. Brokers then
+	// let the source fetch from the closest in-sync replica of each
+	// partition, instead of the leader, which avoids cross zone traffic.
+	// It requires a Version of at least 2.4.0, and only takes effect once
+	// the brokers set replica.selector.class to
+	// org.apache.kafka.common.replica.RackAwareReplicaSelector. The status
+	// of the source reports the broker each partition is fetched from.
+	RackID string
+	// NewPartitionOffset, if set, is the initial offset, OffsetOldest or
+	// OffsetNewest, of the partitions without a committed offset when the
+	// consumer group has committed offsets for other partitions of the
+	// topic, such as partitions added to the topic. Defaults to Offset,
+	// which otherwise applies to all the partitions without a committed
+	// offset.
+	NewPartitionOffset int64
+	// OnPartitionCountChange, if set, is called with the old and new number
+	// of partitions when the number of partitions of the topic changes.
+	// The metadata of the topic is refreshed every PartitionWatchInterval
+	// to detect changes, which also lets the consumer group notice them
+	// earlier.
+	OnPartitionCountChange func(old, new int)
+	// PartitionWatchInterval is the interval at which the metadata of the
+	// topic is refreshed to detect partition count changes. Setting it
+	// watches the partitions without OnPartitionCountChange. Defaults to
+	// the metadata refresh frequency.
+	PartitionWatchInterval time.Duration
+
+	// StartTime, if set, resets the offset of each partition to the first
+	// message at or after it, the first time the partition is claimed by
+	// the source. It is intended for replays with a dedicated consumer
+	// group, as rebalances across sources may still restart a replay.
+	StartTime time.Time
+	// EndTime, if set, is the timestamp after which messages are not
+	// delivered. Once a partition passes it, its later messages are
+	// acknowledged and dropped. Message timestamps require a broker Version
+	// of at least 0.10.0.
+	EndTime time.Time
+	// StopAtEndTime makes ConsumeMessages return nil once all the claimed
+	// partitions have passed EndTime, and all the delivered messages have
+	// been acknowledged, instead of dropping messages.
+	StopAtEndTime bool
+	// MaxIdle, if set along with EndTime, is how long a partition may go
+	// without messages before it is considered to have passed EndTime, so
+	// that replays of idle partitions terminate. Along with CaughtUp, it is
+	// how long a partition may go without messages before it is considered
+	// caught up, e.g. when compaction removed its newest messages.
+	MaxIdle time.Duration
+	// PartitionCompleted is an optional callback that is called once for
+	// each partition that passes EndTime. It may be called concurrently for
+	// different partitions.
+	PartitionCompleted func(partition int32)
+
+	// CaughtUp, if set, is called once all the claimed partitions have been
+	// consumed up to the newest offset they had when first claimed, that is
+	// once the message before that offset has been acknowledged, or the
+	// partition was empty. Consuming then continues with live updates.
+	// Along with Offset set to OffsetOldest and a consumer group without
+	// committed offsets, this allows reading a compacted topic as a
+	// snapshot. It is called from a separate goroutine, and must not block.
+	CaughtUp func()
+
+	// TLS, if set, enables TLS connections to the brokers. Setting its
+	// GetClientCertificate field to the method of a CertificateReloader
+	// picks up rotated client certificates.
+	TLS *tls.Config
+	// SASL, if set, enables SASL authentication with the brokers.
+	SASL *SASLConfig
+	// StartupChecks enables checking, when the source is created, that its
+	// credentials may describe and read the topic. Creating the source
+	// fails if they are not authorized to describe the topic, or if an ACL
+	// of the SASL user denies reading it. If no ACL allows reading it, or
+	// the ACLs can't be described, e.g. without the permission to describe
+	// them, Status reports it as a problem instead.
+	StartupChecks bool
+	// ExpectedTimestampType, if set, is the type of the timestamps the
+	// consumer relies on, e.g. TimestampCreateTime to measure latencies
+	// from the time messages were produced. It is compared with the
+	// message.timestamp.type config of the topic, described when the
+	// source is created, and Status reports it as a problem if they differ,
+	// or if the config can't be described. The described type is exposed
+	// by the TimestampType method of the delivered messages either way.
+	ExpectedTimestampType TimestampType
+	// MetricRegistry is the registry sarama records its metrics in, e.g. to
+	// share one across sources and sinks. Defaults to a new registry. The
+	// registry is available through the MetricsReporter interface.
+	MetricRegistry metrics.Registry
+	// Interceptors are called with every message as it is consumed, before
+	// it is delivered.
+	Interceptors []sarama.ConsumerInterceptor
+
+	// OnAcked, if set, is called with the offset marked on a partition as
+	// messages are acknowledged, which is the offset of the next message to
+	// consume, e.g. to record the progress of a job. Calls are coalesced to
+	// at most one per partition per OnAckedInterval, which defaults to a
+	// second, and are made from a separate goroutine, so that a slow
+	// callback doesn't delay consuming. The offsets marked since the last
+	// calls are passed once more when ConsumeMessages returns.
+	OnAcked         func(topic string, partition int32, offset int64) error
+	OnAckedInterval time.Duration
+	// OnAckedError, if set, is called with the errors returned by OnAcked,
+	// e.g. to log them, and ConsumeMessages terminates with the error it
+	// returns, if any. Otherwise, errors returned by OnAcked terminate
+	// ConsumeMessages.
+	OnAckedError func(error) error
+
+	// MaxMessageBytes, if set, is the maximum size of the payload of the
+	// delivered messages, to guard consumers against malformed giant
+	// messages. Larger messages are not delivered, and are passed to
+	// OnOversize along with a substrate.OversizeError instead, which may
+	// for example publish them to a dead letter sink. The messages passed
+	// implement Message, which exposes their partition and offset. If
+	// OnOversize returns nil, the message is acknowledged once the messages
+	// before it are, so that it doesn't block its partition. If OnOversize
+	// is nil or returns an error, ConsumeMessages terminates with that
+	// error.
+	MaxMessageBytes int
+	OnOversize      substrate.MessageErrorHandler
+	// OnNack, if set, is called with the messages that are nacked, see
+	// substrate.Nackable, along with the reason, once they are
+	// acknowledged, e.g. to publish them to a dead letter topic. If it
+	// returns nil, the offset of the message is committed. If it returns an
+	// error, ConsumeMessages terminates with that error. Without OnNack,
+	// the offsets of nacked messages are committed, skipping them.
+	OnNack substrate.MessageErrorHandler
+	// HeaderFilter, if set, restricts the delivered messages to the ones
+	// whose headers match it: for every key of the filter, the message must
+	// have a header with that key and one of the listed values. Other
+	// messages are not delivered, and are acknowledged once the messages
+	// before them are, with their payload discarded straight away. They are
+	// passed to OnFiltered first, if it is set, e.g. to count them.
+	HeaderFilter map[string][]string
+	OnFiltered   func(substrate.Message)
+	// SkipOffsets lists the offsets of the messages to skip by partition,
+	// e.g. to get past a poison message that blocks its partition. Skipped
+	// messages are not delivered, and are acknowledged once the messages
+	// before them are, with their payload discarded straight away.
+	// ShouldSkip, if set, is also consulted before every message is
+	// delivered, and skips the messages for which it returns true. Skipped
+	// messages are passed to OnSkipped first, if it is set, e.g. to log
+	// them. Messages can also be skipped while the source is running, see
+	// OffsetSkipper.
+	SkipOffsets map[int32][]int64
+	ShouldSkip  func(partition int32, offset int64) bool
+	OnSkipped   func(Message)
+	// TombstoneHandling is how tombstones, the records without a value,
+	// are handled. Skipped tombstones are acknowledged once the messages
+	// before them are. Defaults to TombstonesDelivered.
+	TombstoneHandling TombstoneHandling
+	// PayloadTransform, if set, is applied to the payload of every message
+	// before it is delivered, e.g. to decrypt it. Up to TransformWorkers
+	// payloads, which defaults to 1, are transformed concurrently across
+	// the claimed partitions, while messages are still delivered in order.
+	// Messages whose transform fails are not delivered, and are nacked with
+	// a PayloadTransformError once the messages before them are
+	// acknowledged, so they are passed to OnNack with their original
+	// payload, e.g. to publish them to a dead letter topic, or skipped
+	// without OnNack. Tombstones are not transformed.
+	PayloadTransform func([]byte) ([]byte, error)
+	TransformWorkers int
+	// ReadAhead, if set, is the number of messages read ahead from each
+	// claimed partition while the messages before them wait to be
+	// delivered, so that sarama keeps fetching the partition meanwhile. The
+	// messages are still delivered in order. Messages are also read ahead
+	// while the source is paused.
+	ReadAhead int
+	// Gauges, if set, is sampled with the number of messages delivered and
+	// not acknowledged yet, and of the acknowledgements not processed yet,
+	// e.g. to find where consuming backs up. Gauges implementing
+	// substrate.WindowGauges are also sampled with the AdaptiveWindow.
+	Gauges substrate.Gauges
+	// LifecycleEvents, if set, receives the connected and closed events of
+	// the source, and the consumer group sessions started and ended along
+	// with the partitions assigned. Events are dropped when the channel is
+	// full. See substrate.LifecycleEvent.
+	LifecycleEvents chan<- substrate.LifecycleEvent
+	// MaxInFlight, if positive, is the maximum number of messages delivered
+	// and not acknowledged yet. Consuming pauses while it is reached.
+	// AdaptiveWindow, if set, adapts that maximum to the latency of the
+	// acknowledgements instead. See substrate.AdaptiveWindow.
+	MaxInFlight    int
+	AdaptiveWindow *substrate.AdaptiveWindow
+	// ClientPool, if set, is used to share the client of the source with the
+	// other sources created with the same brokers and options.
+	ClientPool *ClientPool
+	// StallTimeout, if set, is how long the source waits for a message to
+	// be acknowledged, while messages are in flight, before reporting the
+	// stall: OnStall, if set, is called with the partitions and offsets of
+	// the in-flight messages, e.g. to find a stuck consumer, and the report
+	// is logged if Debug is set. A stall is reported once, until a message
+	// is acknowledged again. OnStall is called from a separate goroutine.
+	StallTimeout time.Duration
+	OnStall      func(StallReport)
+	// UseRegisteredDefaults enables applying the defaults registered for
+	// the kafka scheme with the config package to the options that are not
+	// set. It is always set for the sources obtained from suburl.
+	UseRegisteredDefaults bool
 
 	Debug bool
 }
@@ -57,6 +286,15 @@ func (ams *AsyncMessageSourceConfig) buildSaramaConsumerConfig() (*sarama.Config
 	config.Metadata.RefreshFrequency = mrf
 	config.Consumer.Group.Session.Timeout = st
 	config.Consumer.Offsets.Retention = ams.OffsetsRetention
+	config.ClientID = clientID(ams.ClientID, ams.Topic)
+	config.RackID = ams.RackID
+	if ams.MetricRegistry != nil {
+		config.MetricRegistry = ams.MetricRegistry
+	}
+	config.Consumer.Interceptors = ams.Interceptors
+	if err := applySecurity(config, ams.TLS, ams.SASL); err != nil {
+		return nil, err
+	}
 
 	if ams.Version != "" {
 		version, err := sarama.ParseKafkaVersion(ams.Version)
@@ -70,48 +308,197 @@ func (ams *AsyncMessageSourceConfig) buildSaramaConsumerConfig() (*sarama.Config
 }
 
 func NewAsyncMessageSource(c AsyncMessageSourceConfig) (substrate.AsyncMessageSource, error) {
+	if err := c.applyRegisteredDefaults(); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	c.resolveTopic()
 	config, err := c.buildSaramaConsumerConfig()
 	if err != nil {
 		return nil, err
 	}
 
-	client, err := sarama.NewClient(c.Brokers, config)
+	client, err := newClient(c.ClientPool, "source", c.Brokers, config, c.MetricRegistry, c.Interceptors, c.SASL)
 	if err != nil {
 		return nil, err
 	}
+	var warnings []string
+	if c.StartupChecks {
+		warnings, err = newStartupChecker(c.Topic, c.SASL, sarama.AclOperationDescribe, sarama.AclOperationRead).check(client)
+		if err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+	}
+	timestampType, timestampWarnings := newTimestampTypeChecker(c).check(client)
+	warnings = append(warnings, timestampWarnings...)
 	consumerGroup, err := sarama.NewConsumerGroupFromClient(c.ConsumerGroup, client)
 	if err != nil {
 		_ = client.Close()
 		return nil, err
 	}
 
+	debugger := debug.Debugger{
+		Enabled: c.Debug,
+	}
+	events := substrate.NewLifecycleEmitter(c.LifecycleEvents, "kafka", c.Topic)
+	events.Emit(substrate.LifecycleEvent{Type: substrate.LifecycleConnected})
 	return &asyncMessageSource{
-		client:        client,
-		consumerGroup: consumerGroup,
-		topic:         c.Topic,
+		client:           client,
+		consumerGroup:    consumerGroup,
+		groupID:          c.ConsumerGroup,
+		topic:            c.Topic,
+		rebalanceBackoff: config.Consumer.Group.Rebalance.Retry.Backoff,
+		requests:         make(chan sessionRequest),
+		window:           newTimeWindow(c),
+		snapshot:         newSnapshot(c),
+		checkpoints:      newCheckpointer(c),
+		newPartitions:    newNewPartitions(c),
+		maxMessageBytes:  c.MaxMessageBytes,
+		onOversize:       c.OnOversize,
+		onNack:           c.OnNack,
+		headerFilter:     newHeaderFilter(c),
+		onFiltered:       c.OnFiltered,
+		skips:            newOffsetSkips(c),
+		onSkipped:        c.OnSkipped,
+		tombstones:       c.TombstoneHandling,
+		transformer:      newPayloadTransformer(c.PayloadTransform, c.TransformWorkers),
+		readAhead:        c.ReadAhead,
+		gauges:           c.Gauges,
+		maxInFlight:      c.MaxInFlight,
+		adaptiveWindow:   c.AdaptiveWindow,
+		partitions:       newPartitionWatcher(client, c.Topic, c.PartitionWatchInterval, c.OnPartitionCountChange, debugger),
+		progress:         newProgressTracker(),
+		membership:       newMembershipTracker(config.ClientID),
+		events:           events,
+		claimMetrics:     newClaimMetrics(),
+		replicas:         newReplicaLocator(client, c.Topic, c.RackID),
+		brokers:          newBrokerStatus(client, c.Brokers, c.Topic),
+		stalls:           newStallDetector(c, debugger),
+		warnings:         warnings,
+		timestampType:    timestampType,
 
-		debugger: debug.Debugger{
-			Enabled: c.Debug,
-		},
+		debugger: debugger,
 	}, nil
 }
 
+var _ OffsetCommitter = (*asyncMessageSource)(nil)
+
 type asyncMessageSource struct {
-	client        sarama.Client
-	consumerGroup sarama.ConsumerGroup
-	topic         string
+	client           sarama.Client
+	consumerGroup    sarama.ConsumerGroup
+	groupID          string
+	topic            string
+	rebalanceBackoff time.Duration
+	// requests are served by the acks processor, which owns the session.
+	requests      chan sessionRequest
+	window        *timeWindow
+	snapshot      *snapshot
+	checkpoints   *checkpointer
+	newPartitions *newPartitions
+	// maxMessageBytes is the maximum size of the delivered messages, if set.
+	maxMessageBytes int
+	onOversize      substrate.MessageErrorHandler
+	onNack          substrate.MessageErrorHandler
+	headerFilter    headerFilter
+	onFiltered      func(substrate.Message)
+	skips           *offsetSkips
+	onSkipped       func(Message)
+	tombstones      TombstoneHandling
+	transformer     *payloadTransformer
+	readAhead       int
+	gauges          substrate.Gauges
+	maxInFlight     int
+	adaptiveWindow  *substrate.AdaptiveWindow
+	partitions      *partitionWatcher
+	progress        *progressTracker
+	membership      *membershipTracker
+	events          *substrate.LifecycleEmitter
+	claimMetrics    *claimMetrics
+	replicas        *replicaLocator
+	brokers         *brokerStatus
+	stalls          *stallDetector
+	pauser          pauser
+	// warnings are the problems found by the startup checks, and the
+	// check of the timestamp type.
+	warnings []string
+	// timestampType is the timestamp type of the topic.
+	timestampType TimestampType
 
 	debugger debug.Debugger
 }
 
+// Message is implemented by the messages consumed from kafka sources, and
+// exposes where they were consumed from, e.g. to investigate messages that
+// could not be processed.
+type Message interface {
+	substrate.Message
+	Topic() string
+	Partition() int32
+	Offset() int64
+	// Timestamp returns the timestamp of the record, which is zero for
+	// brokers older than 0.10.0.
+	Timestamp() time.Time
+	// BlockTimestamp returns the timestamp of the batch the record was
+	// written in, which is the latest timestamp of its records, or the time
+	// the batch was appended to the log for TimestampLogAppendTime.
+	BlockTimestamp() time.Time
+	// TimestampType returns the type of the timestamp of the record, as
+	// described when the source was created, which is unknown if the
+	// config of the topic couldn't be described.
+	TimestampType() TimestampType
+	// Context returns a context that is cancelled when the consumer group
+	// session the message was consumed in ends, such as when its partition
+	// is revoked by a rebalance. Once it is cancelled, the offset of the
+	// message is no longer committed when it is acknowledged, so long
+	// running handlers can abort early.
+	Context() context.Context
+}
+
+var (
+	_ Message                      = (*consumerMessage)(nil)
+	_ substrate.TimestampedMessage = (*consumerMessage)(nil)
+	_ substrate.PartitionedMessage = (*consumerMessage)(nil)
+	_ substrate.Nackable           = (*consumerMessage)(nil)
+)
+
 type consumerMessage struct {
 	cm *sarama.ConsumerMessage
+	// ctx is the context of the session the message was consumed in.
+	ctx context.Context
 
 	discard bool
-	offset  *struct {
-		topic     string
-		partition int32
-		offset    int64
+	// pastEnd is set for messages after the end time, which are dropped.
+	pastEnd bool
+	// oversize is set for messages over the size limit, which are dropped.
+	oversize bool
+	// filtered is set for messages not matching the header filter, which
+	// are dropped.
+	filtered bool
+	// skipped is set for tombstones skipped by TombstonesSkipped.
+	skipped bool
+	// skippedOffset is set for messages at skipped offsets, which are
+	// dropped.
+	skippedOffset bool
+	// transformErr is the error of the payload transform, if it failed.
+	transformErr error
+	// untransformed is set for messages whose transform failed, which are
+	// nacked and dropped.
+	untransformed bool
+	// reason is set for nacked messages.
+	reason error
+	// delivered is when the message was delivered, if stalls are detected.
+	delivered time.Time
+	// timestampType is the timestamp type of the topic.
+	timestampType TimestampType
+	offset        *struct {
+		topic          string
+		partition      int32
+		offset         int64
+		timestamp      time.Time
+		blockTimestamp time.Time
 	}
 }
 
@@ -129,69 +516,347 @@ func (cm *consumerMessage) Key() []byte {
 	return cm.cm.Key
 }
 
+// Attributes returns the record headers of the message.
+func (cm *consumerMessage) Attributes() map[string]string {
+	if cm.cm == nil {
+		panic("attempt to get the attributes after discarding.")
+	}
+	if len(cm.cm.Headers) == 0 {
+		return nil
+	}
+	attrs := make(map[string]string, len(cm.cm.Headers))
+	for _, h := range cm.cm.Headers {
+		attrs[string(h.Key)] = string(h.Value)
+	}
+	return attrs
+}
+
+// Topic returns the topic the message was consumed from.
+func (cm *consumerMessage) Topic() string {
+	if cm.cm == nil {
+		return cm.offset.topic
+	}
+	return cm.cm.Topic
+}
+
+// Partition returns the partition the message was consumed from.
+func (cm *consumerMessage) Partition() int32 {
+	if cm.cm == nil {
+		return cm.offset.partition
+	}
+	return cm.cm.Partition
+}
+
+// Offset returns the offset of the message in its partition.
+func (cm *consumerMessage) Offset() int64 {
+	if cm.cm == nil {
+		return cm.offset.offset
+	}
+	return cm.cm.Offset
+}
+
+// Timestamp returns the timestamp of the record.
+func (cm *consumerMessage) Timestamp() time.Time {
+	if cm.cm == nil {
+		return cm.offset.timestamp
+	}
+	return cm.cm.Timestamp
+}
+
+// BlockTimestamp returns the timestamp of the batch the record was written in.
+func (cm *consumerMessage) BlockTimestamp() time.Time {
+	if cm.cm == nil {
+		return cm.offset.blockTimestamp
+	}
+	return cm.cm.BlockTimestamp
+}
+
+// TimestampType returns the type of the timestamp of the record.
+func (cm *consumerMessage) TimestampType() TimestampType {
+	return cm.timestampType
+}
+
+// Context returns the context of the session the message was consumed in.
+func (cm *consumerMessage) Context() context.Context {
+	if cm.ctx == nil {
+		return context.Background()
+	}
+	return cm.ctx
+}
+
+// dropped reports whether the message is acknowledged without being
+// delivered.
+func (cm *consumerMessage) dropped() bool {
+	return cm.pastEnd || cm.oversize || cm.filtered || cm.skipped || cm.skippedOffset || cm.untransformed
+}
+
 func (cm *consumerMessage) DiscardPayload() {
 	if cm.offset != nil {
 		// already discarded
 		return
 	}
 	cm.offset = &struct {
-		topic     string
-		partition int32
-		offset    int64
+		topic          string
+		partition      int32
+		offset         int64
+		timestamp      time.Time
+		blockTimestamp time.Time
 	}{
 		cm.cm.Topic,
 		cm.cm.Partition,
 		cm.cm.Offset,
+		cm.cm.Timestamp,
+		cm.cm.BlockTimestamp,
 	}
 	cm.cm = nil
 }
 
+// Nack implements the substrate.Nackable interface. A nacked message is
+// passed to OnNack once it is acknowledged.
+func (cm *consumerMessage) Nack(reason error) {
+	if reason == nil {
+		reason = substrate.ErrNacked
+	}
+	cm.reason = reason
+}
+
+// ConsumeMessages consumes messages from the topic until the context is done,
+// an error occurs, or all the claimed partitions have passed the end time if
+// StopAtEndTime is set. Rebalances of the consumer group are handled internally
+// by starting a new session, so they are invisible to the caller. Messages
+// that were delivered but not acknowledged before a rebalance must still be
+// acknowledged in order, but their offsets are not committed, as the partition
+// may now be owned by another consumer that will redeliver them.
 func (ams *asyncMessageSource) ConsumeMessages(ctx context.Context, messages chan<- substrate.Message, acks <-chan substrate.Message) error {
 	rg, ctx := rungroup.New(ctx)
 	toAck := make(chan *consumerMessage)
 	sessCh := make(chan sarama.ConsumerGroupSession)
 	rebalanceCh := make(chan struct{})
+	completeCh := make(chan struct{})
 
 	rg.Go(func() error {
 		ap := &kafkaAcksProcessor{
-			toClient:    messages,
-			fromKafka:   toAck,
-			acks:        acks,
-			sessCh:      sessCh,
-			rebalanceCh: rebalanceCh,
-			debugger:    ams.debugger,
+			toClient:       messages,
+			fromKafka:      toAck,
+			acks:           acks,
+			sessCh:         sessCh,
+			rebalanceCh:    rebalanceCh,
+			requests:       ams.requests,
+			completeCh:     completeCh,
+			topic:          ams.topic,
+			window:         ams.window,
+			snapshot:       ams.snapshot,
+			checkpoints:    ams.checkpoints,
+			progress:       ams.progress,
+			maxBytes:       ams.maxMessageBytes,
+			onOversize:     ams.onOversize,
+			onNack:         ams.onNack,
+			filter:         ams.headerFilter,
+			onFiltered:     ams.onFiltered,
+			skips:          ams.skips,
+			onSkipped:      ams.onSkipped,
+			tombstones:     ams.tombstones,
+			gauges:         ams.gauges,
+			maxInFlight:    ams.maxInFlight,
+			adaptiveWindow: ams.adaptiveWindow,
+			stalls:         ams.stalls,
+			claimMetrics:   ams.claimMetrics,
+			debugger:       ams.debugger,
 		}
 		return ap.run(ctx)
 	})
+	if ams.checkpoints != nil {
+		rg.Go(func() error {
+			return ams.checkpoints.run(ctx)
+		})
+	}
+	if ams.partitions != nil {
+		rg.Go(func() error {
+			return ams.partitions.run(ctx)
+		})
+	}
 	rg.Go(func() error {
-		// We need to run consume in infinite loop to handle rebalances.
+		// Consume returns at the end of every session, so we need to run it
+		// in an infinite loop, with a new handler per session, to handle rebalances.
 		for {
 			err := ams.consumerGroup.Consume(ctx, []string{ams.topic}, &consumerGroupHandler{
-				ctx:         ctx,
-				toAck:       toAck,
-				sessCh:      sessCh,
-				rebalanceCh: rebalanceCh,
-				debugger:    ams.debugger,
+				ctx:           ctx,
+				client:        ams.client,
+				topic:         ams.topic,
+				toAck:         toAck,
+				sessCh:        sessCh,
+				rebalanceCh:   rebalanceCh,
+				completeCh:    completeCh,
+				window:        ams.window,
+				snapshot:      ams.snapshot,
+				newParts:      ams.newPartitions,
+				pauser:        &ams.pauser,
+				progress:      ams.progress,
+				membership:    ams.membership,
+				events:        ams.events,
+				claimMetrics:  ams.claimMetrics,
+				readAhead:     ams.readAhead,
+				transformer:   ams.transformer,
+				timestampType: ams.timestampType,
+				debugger:      ams.debugger,
 			})
-			if err != nil {
-				return err
-			}
-			if ctx.Err() != nil {
+			switch {
+			case ctx.Err() != nil:
 				return ctx.Err()
+			case err == nil:
+			case isRebalanceError(err):
+				ams.debugger.Logf("substrate : consumer - failed to join the consumer group, retrying : %s\n", err)
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(ams.rebalanceBackoff):
+				}
+			default:
+				return err
 			}
 		}
 	})
 
-	return rg.Wait()
+	err := rg.Wait()
+	if err == errEndTimeReached {
+		err = nil
+	}
+	// Pass on the offsets marked since OnAcked was last called.
+	if cerr := ams.checkpoints.flush(); cerr != nil {
+		err = multierror.Append(err, cerr).ErrorOrNil()
+	}
+	return err
+}
+
+// isRebalanceError reports whether the error returned from joining the
+// consumer group is caused by a rebalance that is still in progress, in which
+// case joining the group should be retried.
+func isRebalanceError(err error) bool {
+	var kerr sarama.KError
+	if !errors.As(err, &kerr) {
+		return false
+	}
+	switch kerr {
+	case sarama.ErrRebalanceInProgress,
+		sarama.ErrUnknownMemberId,
+		sarama.ErrIllegalGeneration,
+		sarama.ErrNotCoordinatorForConsumer,
+		sarama.ErrConsumerCoordinatorNotAvailable:
+		return true
+	default:
+		return false
+	}
+}
+
+// Commit implements the Commit method of the OffsetCommitter interface.
+func (ams *asyncMessageSource) Commit(ctx context.Context) error {
+	_, err := ams.request(ctx, true)
+	return err
+}
+
+// MarkedOffsets implements the MarkedOffsets method of the OffsetCommitter
+// interface.
+func (ams *asyncMessageSource) MarkedOffsets(ctx context.Context) (map[int32]int64, error) {
+	return ams.request(ctx, false)
+}
+
+func (ams *asyncMessageSource) request(ctx context.Context, commit bool) (map[int32]int64, error) {
+	req := sessionRequest{commit: commit, marked: make(chan map[int32]int64, 1)}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case ams.requests <- req:
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case marked := <-req.marked:
+		return marked, nil
+	}
 }
 
+// CommittedOffsets implements the CommittedOffsets method of the
+// OffsetCommitter interface.
+func (ams *asyncMessageSource) CommittedOffsets(ctx context.Context) (map[int32]int64, error) {
+	partitions, err := ams.client.Partitions(ams.topic)
+	if err != nil {
+		return nil, err
+	}
+	// The admin is not closed, as that would close the shared client.
+	admin, err := sarama.NewClusterAdminFromClient(ams.client)
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		resp *sarama.OffsetFetchResponse
+		err  error
+	}
+	// The admin doesn't support contexts, so the request is abandoned
+	// when the context is done.
+	results := make(chan result, 1)
+	go func() {
+		resp, err := admin.ListConsumerGroupOffsets(ams.groupID, map[string][]int32{ams.topic: partitions})
+		results <- result{resp, err}
+	}()
+
+	var res result
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res = <-results:
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	if res.resp.Err != sarama.ErrNoError {
+		return nil, res.resp.Err
+	}
+
+	offsets := make(map[int32]int64)
+	for _, p := range partitions {
+		block := res.resp.GetBlock(ams.topic, p)
+		if block == nil {
+			continue
+		}
+		if block.Err != sarama.ErrNoError {
+			return nil, block.Err
+		}
+		if block.Offset >= 0 {
+			offsets[p] = block.Offset
+		}
+	}
+	return offsets, nil
+}
+
+// Status returns the status of the topic, along with the lag of the consumer
+// group, which is unknown if it can't be fetched.
 func (ams *asyncMessageSource) Status() (*substrate.Status, error) {
-	return status(ams.client, ams.topic)
+	st, err := status(ams.client, ams.topic)
+	if err != nil {
+		return nil, err
+	}
+	st.Details["group"] = ams.groupID
+	ams.brokers.addTo(st)
+	st.Problems = append(st.Problems, ams.warnings...)
+	if paused, _ := ams.pauser.paused(); paused {
+		st.Problems = append(st.Problems, pausedProblem)
+	}
+	if st.Working {
+		if lag, err := ams.lag(); err == nil {
+			st.Lag = &lag
+		}
+		for p, broker := range ams.replicas.fetchBrokers(ams.progress.report()) {
+			st.Details[fmt.Sprintf("partition-%d-broker", p)] = strconv.Itoa(int(broker))
+		}
+	}
+	return st, nil
 }
 
 func (ams *asyncMessageSource) Close() (err error) {
 	for _, closer := range []io.Closer{ams.consumerGroup, ams.client} {
 		err = multierror.Append(err, closer.Close()).ErrorOrNil()
 	}
+	ams.events.Emit(substrate.LifecycleEvent{Type: substrate.LifecycleClosed, Err: err})
 	return err
 }
@@ -2,23 +2,60 @@ package kafka
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/uw-labs/substrate"
 	"github.com/uw-labs/substrate/internal/debug"
+	"github.com/uw-labs/substrate/internal/helper"
 )
 
+// errEndTimeReached is returned by the acks processor once all the claimed
+// partitions have passed the end time and StopAtEndTime is set.
+var errEndTimeReached = errors.New("end time reached")
+
 type consumerGroupHandler struct {
 	ctx         context.Context
+	client      sarama.Client
+	topic       string
 	toAck       chan<- *consumerMessage
 	sessCh      chan<- sarama.ConsumerGroupSession
 	rebalanceCh chan<- struct{}
+	completeCh  chan<- struct{}
+	window      *timeWindow
+	snapshot    *snapshot
+	newParts    *newPartitions
+	pauser      *pauser
+	progress    *progressTracker
+	membership  *membershipTracker
+	events      *substrate.LifecycleEmitter
+	// claimMetrics records the metrics of every claim.
+	claimMetrics *claimMetrics
+	// readAhead is the number of messages read ahead from each claim.
+	readAhead   int
+	transformer *payloadTransformer
+	// timestampType is the timestamp type of the topic, set on the
+	// messages.
+	timestampType TimestampType
 
 	debugger debug.Debugger
 }
 
 // Setup is run at the beginning of a new session, before ConsumeClaim.
 func (c *consumerGroupHandler) Setup(sess sarama.ConsumerGroupSession) error {
+	if err := c.newParts.setOffsets(c.client, c.topic, sess); err != nil {
+		return err
+	}
+	if err := c.window.resetOffsets(c.client, c.topic, sess); err != nil {
+		return err
+	}
+	if err := c.snapshot.recordTargets(c.client, c.topic, sess); err != nil {
+		return err
+	}
+	c.progress.claimed(c.topic, sess)
+	c.membership.started(sess)
+	c.events.Emit(substrate.LifecycleEvent{Type: substrate.LifecycleSessionStarted, Partitions: sess.Claims()[c.topic]})
 	// send session to the ack processor
 	select {
 	case <-c.ctx.Done():
@@ -30,6 +67,8 @@ func (c *consumerGroupHandler) Setup(sess sarama.ConsumerGroupSession) error {
 // Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
 // but before the offsets are committed for the very last time.
 func (c *consumerGroupHandler) Cleanup(_ sarama.ConsumerGroupSession) error {
+	c.membership.ended()
+	c.events.Emit(substrate.LifecycleEvent{Type: substrate.LifecycleSessionEnded})
 	// signal to ack processor that rebalance might be happening
 	select {
 	case <-c.ctx.Done():
@@ -41,22 +80,92 @@ func (c *consumerGroupHandler) Cleanup(_ sarama.ConsumerGroupSession) error {
 // ConsumeClaim must start a consumer loop of ConsumerGroupClaim's Messages().
 // Once the Messages() channel is closed, the Handler must finish its processing
 // loop and exit.
-func (c *consumerGroupHandler) ConsumeClaim(_ sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+func (c *consumerGroupHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
 	// This function can be called concurrently for multiple claims, so the code
 	// below, absent locking etc may seem wrong, but it's actually fine.
 	// Different partition claims can be processed concurrently, but we funnel
 	// them all into c.toAck, which is consumed and processed by a single goroutine.
+	var (
+		idleTimer *time.Timer
+		idle      <-chan time.Time
+	)
+	c.snapshot.started(claim.Partition(), claim.InitialOffset())
+	counters := c.claimMetrics.partition(claim.Partition())
+
+	stop := make(chan struct{})
+	defer close(stop)
+	claimed, failures := c.transformer.transformMessages(c.readAheadMessages(claim, stop), stop)
+
+	idleTimeout := c.idleTimeout()
+	if idleTimeout > 0 {
+		idleTimer = time.NewTimer(idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
 	for {
+		messages, idleTimeouts := claimed, idle
+		var sessDone <-chan struct{}
+		paused, pauseChanged := c.pauser.paused()
+		if paused {
+			// The session must still end when the partitions are revoked.
+			messages, idleTimeouts, sessDone = nil, nil, sess.Context().Done()
+		}
 		select {
 		case <-c.ctx.Done():
 			return nil
-		case m, ok := <-claim.Messages():
+		case <-sessDone:
+			return nil
+		case <-pauseChanged:
+			if paused && idle != nil {
+				// Partitions are not idle while paused.
+				if !idleTimer.Stop() {
+					select {
+					case <-idleTimer.C:
+					default:
+					}
+				}
+				idleTimer.Reset(idleTimeout)
+			}
+		case <-idleTimeouts:
+			idle = nil
+			c.debugger.Logf("substrate : consumer - partition %d idle\n", claim.Partition())
+			if c.window.idleTimeout() > 0 {
+				c.completePartition(claim.Partition())
+			}
+			c.snapshot.reach(claim.Partition())
+		case m, ok := <-messages:
 			if !ok {
 				return nil
 			}
-			cm := &consumerMessage{cm: m}
+			counters.received(len(messages))
+			cm := &consumerMessage{cm: m, ctx: sess.Context(), transformErr: failures.take(m), timestampType: c.timestampType}
+			c.progress.consumed(m, claim)
+			if c.window.pastEnd(m) {
+				cm.pastEnd = true
+				idle = nil
+				c.completePartition(claim.Partition())
+				if c.window.stop {
+					// The message is neither delivered nor acknowledged.
+					continue
+				}
+			} else if idle != nil {
+				if !idleTimer.Stop() {
+					<-idleTimer.C
+				}
+				idleTimer.Reset(idleTimeout)
+			}
+			// The time blocked is only measured when the message can't
+			// be handed over straight away, which is cheaper.
 			select {
 			case c.toAck <- cm:
+				continue
+			default:
+			}
+			start := time.Now()
+			select {
+			case c.toAck <- cm:
+				counters.handedOff(start)
 			case <-c.ctx.Done():
 				return nil
 			}
@@ -64,43 +173,150 @@ func (c *consumerGroupHandler) ConsumeClaim(_ sarama.ConsumerGroupSession, claim
 	}
 }
 
+// readAheadMessages returns the messages of the claim. If readAhead is set,
+// they are read by a separate goroutine into a buffer of that many messages,
+// until stop is closed, so that the claim is read while the messages before
+// them are delivered.
+func (c *consumerGroupHandler) readAheadMessages(claim sarama.ConsumerGroupClaim, stop <-chan struct{}) <-chan *sarama.ConsumerMessage {
+	if c.readAhead <= 0 {
+		return claim.Messages()
+	}
+	buffered := make(chan *sarama.ConsumerMessage, c.readAhead)
+	go func() {
+		defer close(buffered)
+		for {
+			select {
+			case <-stop:
+				return
+			case m, ok := <-claim.Messages():
+				if !ok {
+					return
+				}
+				select {
+				case buffered <- m:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+	return buffered
+}
+
+// idleTimeout returns the time after which an idle partition has passed the
+// end time or caught up, or zero if idle partitions are not tracked.
+func (c *consumerGroupHandler) idleTimeout() time.Duration {
+	if d := c.window.idleTimeout(); d > 0 {
+		return d
+	}
+	return c.snapshot.idleTimeout()
+}
+
+// completePartition marks the partition as having passed the end time, and
+// notifies the ack processor when it should stop.
+func (c *consumerGroupHandler) completePartition(partition int32) {
+	if !c.window.complete(partition) || !c.window.stop {
+		return
+	}
+	select {
+	case c.completeCh <- struct{}{}:
+	case <-c.ctx.Done():
+	}
+}
+
+// sessionRequest is a request to commit the marked offsets, if commit is set,
+// and return them.
+type sessionRequest struct {
+	commit bool
+	marked chan map[int32]int64
+}
+
 type kafkaAcksProcessor struct {
 	toClient    chan<- substrate.Message
 	fromKafka   <-chan *consumerMessage
 	acks        <-chan substrate.Message
 	sessCh      <-chan sarama.ConsumerGroupSession
 	rebalanceCh <-chan struct{}
+	requests    <-chan sessionRequest
+	completeCh  <-chan struct{}
+	topic       string
+	window      *timeWindow
+	snapshot    *snapshot
+	checkpoints *checkpointer
+	progress    *progressTracker
+	maxBytes    int
+	onOversize  substrate.MessageErrorHandler
+	onNack      substrate.MessageErrorHandler
+	filter      headerFilter
+	onFiltered  func(substrate.Message)
+	skips       *offsetSkips
+	onSkipped   func(Message)
+	tombstones  TombstoneHandling
+	gauges      substrate.Gauges
+	maxInFlight int
+	// adaptiveWindow, if set, adapts the limit of messages in flight.
+	adaptiveWindow *substrate.AdaptiveWindow
+	// gaugeTicks ticks when the gauges should be sampled.
+	gaugeTicks <-chan time.Time
+	stalls     *stallDetector
+	// stallTicks ticks when stalls should be checked for.
+	stallTicks <-chan time.Time
+	// claimMetrics records the time blocked delivering messages.
+	claimMetrics *claimMetrics
 
 	sess      sarama.ConsumerGroupSession
 	forAcking []*consumerMessage
+	// marked holds the offsets marked in the current session, by partition.
+	marked map[int32]int64
+	// stopping is set once all the claimed partitions have passed the end
+	// time, and StopAtEndTime is set.
+	stopping bool
 
 	debugger debug.Debugger
 }
 
 func (ap *kafkaAcksProcessor) run(ctx context.Context) error {
 	// First set session, so that we can acknowledge messages.
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case ap.sess = <-ap.sessCh:
+	if err := ap.waitForSession(ctx); err != nil {
+		return err
 	}
 
+	var stop func()
+	ap.gaugeTicks, stop = helper.GaugeTicks(ap.gauges)
+	defer stop()
+	var stopStalls func()
+	ap.stallTicks, stopStalls = ap.stalls.ticks()
+	defer stopStalls()
+
 	for {
+		if ap.stopping && len(ap.forAcking) == 0 {
+			return errEndTimeReached
+		}
+		fromKafka := ap.fromKafka
+		if ap.atInFlightLimit() {
+			fromKafka = nil
+		}
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
+		case <-ap.completeCh:
+			ap.checkStopping()
+		case <-ap.gaugeTicks:
+			ap.sampleGauges()
+		case <-ap.stallTicks:
+			ap.stalls.check(ap.forAcking)
 		case <-ap.rebalanceCh:
 			// Mark all pending messages to be discarded, as rebalance happened.
 			for _, msg := range ap.forAcking {
 				msg.discard = true
 			}
-			// Wait for the new session.
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case ap.sess = <-ap.sessCh:
+			if err := ap.waitForSession(ctx); err != nil {
+				return err
 			}
-		case msg := <-ap.fromKafka:
+			ap.checkStopping()
+		case req := <-ap.requests:
+			ap.processRequest(req)
+		case msg := <-fromKafka:
 			ap.debugger.Logf("substrate : consumer - got message from kafka : %s\n", msg)
 			if err := ap.processMessage(ctx, msg); err != nil {
 				return err
@@ -115,29 +331,63 @@ func (ap *kafkaAcksProcessor) run(ctx context.Context) error {
 }
 
 func (ap *kafkaAcksProcessor) processMessage(ctx context.Context, msg *consumerMessage) error {
+	ap.checkSkip(msg)
+	ap.checkHeaders(msg)
+	ap.checkTombstone(msg)
+	ap.checkTransform(msg)
+	if err := ap.checkSize(msg); err != nil {
+		return err
+	}
+	if msg.dropped() {
+		// The message is dropped, so it's acknowledged once all the
+		// messages before it are.
+		ap.stalls.delivered(msg)
+		ap.forAcking = append(ap.forAcking, msg)
+		return ap.ackDropped()
+	}
 	var pl []byte
 	if ap.debugger.Enabled {
 		// grab the data now, because it may be discarded later.
 		pl = msg.Data()
 	}
+	var out substrate.Message = msg
+	if ap.tombstones == TombstonesMarked && msg.cm.Value == nil {
+		out = &markedTombstone{msg}
+	}
+	// The time blocked is only measured when the message can't be
+	// delivered straight away, which is cheaper.
+	select {
+	case ap.toClient <- out:
+		ap.delivered(msg, pl)
+		return nil
+	default:
+	}
+	start := time.Now()
 	for {
 		select {
 		case <-ctx.Done():
-			return context.Canceled
+			return ctx.Err()
 		case <-ap.rebalanceCh:
 			// Mark all pending messages to be discarded, as rebalance happened.
 			for _, msg := range ap.forAcking {
 				msg.discard = true
 			}
-			// Wait for the new session.
-			select {
-			case <-ctx.Done():
-			case ap.sess = <-ap.sessCh:
+			if err := ap.waitForSession(ctx); err != nil {
+				return err
 			}
+			ap.checkStopping()
 			return nil // We can return immediately as the current message can be discarded.
-		case ap.toClient <- msg:
-			ap.debugger.Logf("substrate : consumer - sent message to caller : %s\n", pl)
-			ap.forAcking = append(ap.forAcking, msg)
+		case <-ap.completeCh:
+			ap.checkStopping()
+		case <-ap.gaugeTicks:
+			ap.sampleGauges()
+		case <-ap.stallTicks:
+			ap.stalls.check(ap.forAcking)
+		case req := <-ap.requests:
+			ap.processRequest(req)
+		case ap.toClient <- out:
+			ap.claimMetrics.partition(msg.cm.Partition).delivered(start)
+			ap.delivered(msg, pl)
 			return nil // We have passed the message to the client, so we can exit this loop.
 		case ack := <-ap.acks:
 			ap.debugger.Logf("substrate : consumer - got ack from caller for message : %s\n", msg)
@@ -149,6 +399,128 @@ func (ap *kafkaAcksProcessor) processMessage(ctx context.Context, msg *consumerM
 	}
 }
 
+// delivered records a message delivered to the caller, which is then awaiting
+// its acknowledgement.
+func (ap *kafkaAcksProcessor) delivered(msg *consumerMessage, pl []byte) {
+	ap.debugger.Logf("substrate : consumer - sent message to caller : %s\n", pl)
+	ap.stalls.delivered(msg)
+	if ap.adaptiveWindow != nil && msg.delivered.IsZero() {
+		msg.delivered = time.Now()
+	}
+	ap.forAcking = append(ap.forAcking, msg)
+}
+
+// checkHeaders sets filtered if the headers of the message don't match the
+// header filter, and discards its payload.
+func (ap *kafkaAcksProcessor) checkHeaders(msg *consumerMessage) {
+	if ap.filter == nil || msg.dropped() || ap.filter.matches(msg.cm.Headers) {
+		return
+	}
+	ap.debugger.Logf("substrate : consumer - filtered message at offset %d of partition %d\n", msg.cm.Offset, msg.cm.Partition)
+	msg.filtered = true
+	if ap.onFiltered != nil {
+		ap.onFiltered(msg)
+	}
+	msg.DiscardPayload()
+}
+
+// checkTombstone sets skipped if the message is a tombstone, and tombstones are
+// skipped.
+func (ap *kafkaAcksProcessor) checkTombstone(msg *consumerMessage) {
+	if ap.tombstones != TombstonesSkipped || msg.dropped() || msg.cm.Value != nil {
+		return
+	}
+	ap.debugger.Logf("substrate : consumer - skipped tombstone at offset %d of partition %d\n", msg.cm.Offset, msg.cm.Partition)
+	msg.skipped = true
+}
+
+// checkTransform sets untransformed if the payload transform of the message
+// failed, and nacks it.
+func (ap *kafkaAcksProcessor) checkTransform(msg *consumerMessage) {
+	if msg.transformErr == nil || msg.dropped() {
+		return
+	}
+	ap.debugger.Logf("substrate : consumer - failed to transform message at offset %d of partition %d : %s\n", msg.cm.Offset, msg.cm.Partition, msg.transformErr)
+	msg.untransformed = true
+	msg.reason = PayloadTransformError{Err: msg.transformErr}
+}
+
+// checkSize sets oversize if the message is over the size limit, and was
+// handled by OnOversize.
+func (ap *kafkaAcksProcessor) checkSize(msg *consumerMessage) error {
+	if ap.maxBytes <= 0 || msg.dropped() {
+		return nil
+	}
+	size := len(msg.cm.Value)
+	if size <= ap.maxBytes {
+		return nil
+	}
+	oerr := substrate.OversizeError{Size: size, MaxBytes: ap.maxBytes}
+	if ap.onOversize == nil {
+		return oerr
+	}
+	if err := ap.onOversize(msg, oerr); err != nil {
+		return err
+	}
+	ap.debugger.Logf("substrate : consumer - dropped message of %d bytes at offset %d of partition %d\n", size, msg.cm.Offset, msg.cm.Partition)
+	msg.oversize = true
+	return nil
+}
+
+// sampleGauges sets the gauges to the number of messages awaiting their
+// acknowledgement, and of the acknowledgements not processed yet.
+func (ap *kafkaAcksProcessor) sampleGauges() {
+	ap.gauges.SetInFlight(len(ap.forAcking))
+	ap.gauges.SetPendingAcks(len(ap.acks))
+	if wg, ok := ap.gauges.(substrate.WindowGauges); ok && ap.adaptiveWindow != nil {
+		wg.SetWindow(ap.adaptiveWindow.Size())
+	}
+}
+
+// atInFlightLimit reports whether the number of messages waiting for their
+// acknowledgement has reached MaxInFlight, or the adaptive window.
+func (ap *kafkaAcksProcessor) atInFlightLimit() bool {
+	limit := ap.maxInFlight
+	if ap.adaptiveWindow != nil {
+		limit = ap.adaptiveWindow.Size()
+	}
+	return limit > 0 && len(ap.forAcking) >= limit
+}
+
+// waitForSession waits for a new session, which starts with no marked
+// offsets.
+func (ap *kafkaAcksProcessor) waitForSession(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case ap.sess = <-ap.sessCh:
+		ap.marked = make(map[int32]int64)
+		return nil
+	}
+}
+
+// checkStopping sets stopping if all the claimed partitions have passed the
+// end time.
+func (ap *kafkaAcksProcessor) checkStopping() {
+	if ap.window == nil || !ap.window.stop {
+		return
+	}
+	claims := ap.sess.Claims()[ap.topic]
+	ap.stopping = len(claims) > 0 && ap.window.allComplete(claims)
+}
+
+func (ap *kafkaAcksProcessor) processRequest(req sessionRequest) {
+	if req.commit {
+		ap.sess.Commit()
+		ap.debugger.Logf("substrate : consumer - committed marked offsets : %v\n", ap.marked)
+	}
+	marked := make(map[int32]int64, len(ap.marked))
+	for p, o := range ap.marked {
+		marked[p] = o
+	}
+	req.marked <- marked
+}
+
 func (ap *kafkaAcksProcessor) processAck(ack substrate.Message) error {
 	switch {
 	case len(ap.forAcking) == 0:
@@ -156,28 +528,70 @@ func (ap *kafkaAcksProcessor) processAck(ack substrate.Message) error {
 			Acked:    ack,
 			Expected: nil,
 		}
-	case ack != ap.forAcking[0]:
+	case !substrate.SameMessage(ack, ap.forAcking[0]):
 		return substrate.InvalidAckError{
 			Acked:    ack,
 			Expected: ap.forAcking[0],
 		}
-	case ap.forAcking[0].discard:
-		// Discard pending message that was consumed before a rebalance.
-		ap.forAcking = ap.forAcking[1:]
 	default:
-		// Acknowledge the message.
-		if ap.forAcking[0].cm != nil {
-			ap.sess.MarkMessage(ap.forAcking[0].cm, "")
-			ap.debugger.Logf("substrate : consumer - sent ack to kafka for message : %s\n", ap.forAcking[0])
-		} else {
-			off := ap.forAcking[0].offset
-			// MarkOffset marks the next message to consume, so we need to add 1
-			// to the offset to mark this message as consumed. Note that the bsm cluster
-			// did this when committing offsets, so that's why it worked without this before.
-			ap.sess.MarkOffset(off.topic, off.partition, off.offset+1, "")
-			ap.debugger.Logf("substrate : consumer - sent ack to kafka for message : [payload not available]\n")
+		if ap.adaptiveWindow != nil && !ap.forAcking[0].delivered.IsZero() {
+			ap.adaptiveWindow.Acked(time.Since(ap.forAcking[0].delivered))
+		}
+		if err := ap.nacked(ap.forAcking[0]); err != nil {
+			return err
 		}
+		ap.mark(ap.forAcking[0])
+		ap.forAcking = ap.forAcking[1:]
+		ap.stalls.acked()
+	}
+	return ap.ackDropped()
+}
+
+// nacked passes a nacked message to OnNack, unless it was consumed before a
+// rebalance, as it is then consumed again.
+func (ap *kafkaAcksProcessor) nacked(msg *consumerMessage) error {
+	if msg.reason == nil || msg.discard || ap.onNack == nil {
+		return nil
+	}
+	return ap.onNack(msg, msg.reason)
+}
+
+// ackDropped acknowledges the dropped messages at the head of the pending
+// messages, passing the nacked ones to OnNack.
+func (ap *kafkaAcksProcessor) ackDropped() error {
+	for len(ap.forAcking) > 0 && ap.forAcking[0].dropped() {
+		if err := ap.nacked(ap.forAcking[0]); err != nil {
+			return err
+		}
+		ap.mark(ap.forAcking[0])
 		ap.forAcking = ap.forAcking[1:]
 	}
 	return nil
 }
+
+// mark marks the offset of an acknowledged message, unless the message was
+// consumed before a rebalance.
+func (ap *kafkaAcksProcessor) mark(msg *consumerMessage) {
+	switch {
+	case msg.discard:
+		// Discard pending message that was consumed before a rebalance.
+	case msg.cm != nil:
+		ap.sess.MarkMessage(msg.cm, "")
+		ap.marked[msg.cm.Partition] = msg.cm.Offset + 1
+		ap.snapshot.acked(msg.cm.Partition, msg.cm.Offset)
+		ap.checkpoints.acked(msg.cm.Partition, msg.cm.Offset+1)
+		ap.progress.acked(msg.cm.Partition, msg.cm.Offset+1)
+		ap.debugger.Logf("substrate : consumer - sent ack to kafka for message : %s\n", msg)
+	default:
+		off := msg.offset
+		// MarkOffset marks the next message to consume, so we need to add 1
+		// to the offset to mark this message as consumed. Note that the bsm cluster
+		// did this when committing offsets, so that's why it worked without this before.
+		ap.sess.MarkOffset(off.topic, off.partition, off.offset+1, "")
+		ap.marked[off.partition] = off.offset + 1
+		ap.snapshot.acked(off.partition, off.offset)
+		ap.checkpoints.acked(off.partition, off.offset+1)
+		ap.progress.acked(off.partition, off.offset+1)
+		ap.debugger.Logf("substrate : consumer - sent ack to kafka for message : [payload not available]\n")
+	}
+}
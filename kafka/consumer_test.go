@@ -0,0 +1,554 @@
+package kafka
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/helper"
+	"github.com/uw-labs/substrate/internal/testshared"
+)
+
+func TestIsRebalanceError(t *testing.T) {
+	assert.True(t, isRebalanceError(sarama.ErrRebalanceInProgress))
+	assert.True(t, isRebalanceError(sarama.ErrUnknownMemberId))
+	assert.True(t, isRebalanceError(fmt.Errorf("joining group: %w", sarama.ErrIllegalGeneration)))
+	assert.False(t, isRebalanceError(sarama.ErrGroupAuthorizationFailed))
+	assert.False(t, isRebalanceError(sarama.ErrClosedConsumerGroup))
+	assert.False(t, isRebalanceError(errors.New("failure")))
+}
+
+type fakeSession struct {
+	sarama.ConsumerGroupSession
+
+	ctx     context.Context
+	mu      sync.Mutex
+	marked  map[int32]int64
+	commits int
+}
+
+func (s *fakeSession) Context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+func (s *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, _ string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, "")
+}
+
+func (s *fakeSession) MarkOffset(_ string, partition int32, offset int64, _ string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.marked[partition] = offset
+}
+
+func (s *fakeSession) Commit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commits++
+}
+
+func TestCommitAndMarkedOffsets(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	fromKafka := make(chan *consumerMessage)
+	toClient := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	sessCh := make(chan sarama.ConsumerGroupSession)
+	source := &asyncMessageSource{requests: make(chan sessionRequest)}
+
+	ap := &kafkaAcksProcessor{
+		toClient:    toClient,
+		fromKafka:   fromKafka,
+		acks:        acks,
+		sessCh:      sessCh,
+		rebalanceCh: make(chan struct{}),
+		requests:    source.requests,
+	}
+	go func() {
+		_ = ap.run(ctx)
+	}()
+	sess := &fakeSession{marked: make(map[int32]int64)}
+	sessCh <- sess
+
+	marked, err := source.MarkedOffsets(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, marked)
+
+	for _, m := range []*sarama.ConsumerMessage{
+		{Topic: "topic", Partition: 0, Offset: 4},
+		{Topic: "topic", Partition: 1, Offset: 7},
+		{Topic: "topic", Partition: 0, Offset: 5},
+	} {
+		fromKafka <- &consumerMessage{cm: m}
+		acks <- <-toClient
+	}
+
+	require.NoError(t, source.Commit(ctx))
+	marked, err = source.MarkedOffsets(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[int32]int64{0: 6, 1: 8}, marked)
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	assert.Equal(t, 1, sess.commits)
+	assert.Equal(t, map[int32]int64{0: 6, 1: 8}, sess.marked)
+}
+
+// callerWrapped is a message wrapped by a caller, which exposes the message it
+// wraps.
+type callerWrapped struct {
+	substrate.Message
+}
+
+func (m callerWrapped) Original() substrate.Message {
+	return m.Message
+}
+
+func TestAckWrappedMessage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	fromKafka := make(chan *consumerMessage)
+	toClient := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	sessCh := make(chan sarama.ConsumerGroupSession)
+	source := &asyncMessageSource{requests: make(chan sessionRequest)}
+
+	ap := &kafkaAcksProcessor{
+		toClient:    toClient,
+		fromKafka:   fromKafka,
+		acks:        acks,
+		sessCh:      sessCh,
+		rebalanceCh: make(chan struct{}),
+		requests:    source.requests,
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ap.run(ctx)
+	}()
+	sessCh <- &fakeSession{marked: make(map[int32]int64)}
+
+	fromKafka <- &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "topic", Partition: 0, Offset: 4}}
+	acks <- callerWrapped{<-toClient}
+	marked, err := source.MarkedOffsets(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[int32]int64{0: 5}, marked)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+func TestSaramaConfigClientID(t *testing.T) {
+	consumerConf, err := (&AsyncMessageSourceConfig{Topic: "orders/v1"}).buildSaramaConsumerConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "substrate-orders_v1", consumerConf.ClientID)
+	assert.NoError(t, consumerConf.Validate())
+
+	consumerConf, err = (&AsyncMessageSourceConfig{Topic: "orders", ClientID: "billing"}).buildSaramaConsumerConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "billing", consumerConf.ClientID)
+
+	producerConf, err := (&AsyncMessageSinkConfig{Topic: "orders"}).buildSaramaProducerConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "substrate-orders", producerConf.ClientID)
+
+	producerConf, err = (&AsyncMessageSinkConfig{Topic: "orders", ClientID: "billing"}).buildSaramaProducerConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "billing", producerConf.ClientID)
+}
+
+func TestSaramaConfigRackID(t *testing.T) {
+	consumerConf, err := (&AsyncMessageSourceConfig{Topic: "orders", RackID: "eu-west-1a", Version: "2.4.0"}).buildSaramaConsumerConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "eu-west-1a", consumerConf.RackID)
+}
+
+func TestSaramaConfigMetricRegistry(t *testing.T) {
+	consumerConf, err := (&AsyncMessageSourceConfig{Topic: "orders"}).buildSaramaConsumerConfig()
+	require.NoError(t, err)
+	assert.NotNil(t, consumerConf.MetricRegistry)
+
+	registry := metrics.NewRegistry()
+	consumerConf, err = (&AsyncMessageSourceConfig{Topic: "orders", MetricRegistry: registry}).buildSaramaConsumerConfig()
+	require.NoError(t, err)
+	assert.True(t, registry == consumerConf.MetricRegistry)
+
+	producerConf, err := (&AsyncMessageSinkConfig{Topic: "orders", MetricRegistry: registry}).buildSaramaProducerConfig()
+	require.NoError(t, err)
+	assert.True(t, registry == producerConf.MetricRegistry)
+}
+
+func TestOversizeMessagesAreDropped(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	fromKafka := make(chan *consumerMessage)
+	toClient := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	sessCh := make(chan sarama.ConsumerGroupSession)
+	source := &asyncMessageSource{requests: make(chan sessionRequest)}
+
+	var skipped []Message
+	ap := &kafkaAcksProcessor{
+		toClient:    toClient,
+		fromKafka:   fromKafka,
+		acks:        acks,
+		sessCh:      sessCh,
+		rebalanceCh: make(chan struct{}),
+		requests:    source.requests,
+		maxBytes:    5,
+		onOversize: func(msg substrate.Message, err error) error {
+			assert.Equal(t, substrate.OversizeError{Size: 6, MaxBytes: 5}, err)
+			skipped = append(skipped, msg.(Message))
+			return nil
+		},
+	}
+	go func() {
+		_ = ap.run(ctx)
+	}()
+	sessCh <- &fakeSession{marked: make(map[int32]int64)}
+
+	small := &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "topic", Partition: 0, Offset: 4, Value: []byte("small")}}
+	fromKafka <- small
+	delivered := <-toClient
+	assert.Equal(t, small, delivered)
+
+	// The oversize message is acknowledged once the message before it is.
+	fromKafka <- &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "topic", Partition: 0, Offset: 5, Value: []byte("larger")}}
+	marked, err := source.MarkedOffsets(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, marked)
+
+	acks <- delivered
+	marked, err = source.MarkedOffsets(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[int32]int64{0: 6}, marked)
+
+	require.Len(t, skipped, 1)
+	assert.Equal(t, "topic", skipped[0].Topic())
+	assert.Equal(t, int32(0), skipped[0].Partition())
+	assert.Equal(t, int64(5), skipped[0].Offset())
+}
+
+func TestOversizeMessageWithoutHandler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	fromKafka := make(chan *consumerMessage, 1)
+	sessCh := make(chan sarama.ConsumerGroupSession, 1)
+	ap := &kafkaAcksProcessor{
+		fromKafka:   fromKafka,
+		sessCh:      sessCh,
+		rebalanceCh: make(chan struct{}),
+		maxBytes:    5,
+	}
+	sessCh <- &fakeSession{marked: make(map[int32]int64)}
+	fromKafka <- &consumerMessage{cm: &sarama.ConsumerMessage{Value: []byte("larger")}}
+
+	assert.Equal(t, substrate.OversizeError{Size: 6, MaxBytes: 5}, ap.run(ctx))
+}
+
+func TestNackedMessages(t *testing.T) {
+	failure := errors.New("cannot process")
+	for _, tst := range []struct {
+		name     string
+		onNack   substrate.MessageErrorHandler
+		err      error
+		expected map[int32]int64
+	}{
+		{name: "skipped"},
+		{
+			name:   "handled",
+			onNack: func(substrate.Message, error) error { return nil },
+		},
+		{
+			name:   "failed",
+			onNack: func(substrate.Message, error) error { return failure },
+			err:    failure,
+		},
+	} {
+		t.Run(tst.name, func(t *testing.T) {
+			var nacked []error
+			ap := &kafkaAcksProcessor{sess: &fakeSession{marked: make(map[int32]int64)}, marked: make(map[int32]int64)}
+			if tst.onNack != nil {
+				ap.onNack = func(msg substrate.Message, reason error) error {
+					assert.Equal(t, int64(4), msg.(Message).Offset())
+					nacked = append(nacked, reason)
+					return tst.onNack(msg, reason)
+				}
+			}
+
+			msg := &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "topic", Partition: 0, Offset: 4}}
+			ap.forAcking = []*consumerMessage{msg}
+			msg.Nack(failure)
+
+			err := ap.processAck(msg)
+			assert.Equal(t, tst.err, err)
+			if tst.onNack != nil {
+				assert.Equal(t, []error{failure}, nacked)
+			}
+			if err == nil {
+				assert.Equal(t, map[int32]int64{0: 5}, ap.marked)
+			} else {
+				assert.Empty(t, ap.marked)
+			}
+		})
+	}
+}
+
+func TestMessageContextCancelledOnRevocation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	toAck := make(chan *consumerMessage)
+	toClient := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	sessCh := make(chan sarama.ConsumerGroupSession, 1)
+	rebalanceCh := make(chan struct{})
+	ap := &kafkaAcksProcessor{
+		toClient:    toClient,
+		fromKafka:   toAck,
+		acks:        acks,
+		sessCh:      sessCh,
+		rebalanceCh: rebalanceCh,
+		topic:       "topic",
+	}
+	go func() {
+		_ = ap.run(ctx)
+	}()
+	handler := &consumerGroupHandler{
+		ctx:         ctx,
+		topic:       "topic",
+		toAck:       toAck,
+		sessCh:      sessCh,
+		rebalanceCh: rebalanceCh,
+	}
+
+	sessCtx, endSession := context.WithCancel(ctx)
+	sess := &fakeSession{ctx: sessCtx, marked: make(map[int32]int64)}
+	require.NoError(t, handler.Setup(sess))
+	claim := &fakeClaim{messages: make(chan *sarama.ConsumerMessage)}
+	claimDone := make(chan error, 1)
+	go func() {
+		claimDone <- handler.ConsumeClaim(sess, claim)
+	}()
+
+	claim.messages <- &sarama.ConsumerMessage{Topic: "topic", Offset: 4}
+	m := <-toClient
+	msgCtx := m.(Message).Context()
+	assert.NoError(t, msgCtx.Err())
+
+	// The partition is revoked while the message is being handled, which
+	// ends the session.
+	endSession()
+	close(claim.messages)
+	require.NoError(t, <-claimDone)
+	require.NoError(t, handler.Cleanup(sess))
+	select {
+	case <-msgCtx.Done():
+	case <-ctx.Done():
+		t.Fatal("message context not cancelled")
+	}
+
+	// The handler aborts, and the offset of the message is not marked.
+	next := &fakeSession{marked: make(map[int32]int64)}
+	require.NoError(t, handler.Setup(next))
+	acks <- m
+	next.mu.Lock()
+	defer next.mu.Unlock()
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	assert.Empty(t, sess.marked)
+	assert.Empty(t, next.marked)
+}
+
+func TestAcksProcessorGauges(t *testing.T) {
+	defer func(interval time.Duration) {
+		helper.GaugesInterval = interval
+	}(helper.GaugesInterval)
+	helper.GaugesInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	fromKafka := make(chan *consumerMessage)
+	toClient := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	sessCh := make(chan sarama.ConsumerGroupSession, 1)
+	gauges := &testshared.Gauges{}
+	ap := &kafkaAcksProcessor{
+		toClient:    toClient,
+		fromKafka:   fromKafka,
+		acks:        acks,
+		sessCh:      sessCh,
+		rebalanceCh: make(chan struct{}),
+		gauges:      gauges,
+	}
+	sessCh <- &fakeSession{marked: make(map[int32]int64)}
+	go func() {
+		_ = ap.run(ctx)
+	}()
+
+	var delivered []substrate.Message
+	for offset := int64(0); offset < 2; offset++ {
+		fromKafka <- &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "topic", Offset: offset}}
+		delivered = append(delivered, <-toClient)
+	}
+	assert.Eventually(t, func() bool {
+		inFlight, pendingAcks := gauges.Values()
+		return inFlight == 2 && pendingAcks == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	acks <- delivered[0]
+	assert.Eventually(t, func() bool {
+		inFlight, _ := gauges.Values()
+		return inFlight == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestAcksProcessorInFlightLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	fromKafka := make(chan *consumerMessage)
+	toClient := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	sessCh := make(chan sarama.ConsumerGroupSession, 1)
+	window := substrate.NewAdaptiveWindow(substrate.AdaptiveWindowOptions{TargetLatency: time.Hour})
+	ap := &kafkaAcksProcessor{
+		toClient:       toClient,
+		fromKafka:      fromKafka,
+		acks:           acks,
+		sessCh:         sessCh,
+		rebalanceCh:    make(chan struct{}),
+		adaptiveWindow: window,
+	}
+	sessCh <- &fakeSession{marked: make(map[int32]int64)}
+	go func() {
+		_ = ap.run(ctx)
+	}()
+
+	fromKafka <- &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "topic", Offset: 0}}
+	delivered := <-toClient
+	select {
+	case fromKafka <- &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "topic", Offset: 1}}:
+		t.Fatal("message consumed beyond the window")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// The acknowledgement is under the target latency, so the window grows.
+	acks <- delivered
+	for offset := int64(1); offset < 3; offset++ {
+		fromKafka <- &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "topic", Offset: offset}}
+		assert.Equal(t, offset, (<-toClient).(Message).Offset())
+	}
+	assert.Equal(t, 2, window.Size())
+}
+
+func TestReadAhead(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	toAck := make(chan *consumerMessage)
+	handler := &consumerGroupHandler{
+		ctx:       ctx,
+		topic:     "topic",
+		toAck:     toAck,
+		readAhead: 3,
+	}
+	claim := &fakeClaim{messages: make(chan *sarama.ConsumerMessage)}
+	claimDone := make(chan error, 1)
+	go func() {
+		claimDone <- handler.ConsumeClaim(&fakeSession{marked: make(map[int32]int64)}, claim)
+	}()
+
+	// The first message waits to be delivered, the next three are read
+	// ahead, and the one after them waits to be read ahead.
+	for offset := int64(0); offset < 5; offset++ {
+		select {
+		case claim.messages <- &sarama.ConsumerMessage{Topic: "topic", Offset: offset}:
+		case <-time.After(time.Second):
+			t.Fatalf("message %d not read ahead", offset)
+		}
+	}
+	select {
+	case claim.messages <- &sarama.ConsumerMessage{Topic: "topic", Offset: 5}:
+		t.Fatal("message read beyond the read ahead")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	go func() {
+		claim.messages <- &sarama.ConsumerMessage{Topic: "topic", Offset: 5}
+		close(claim.messages)
+	}()
+	for offset := int64(0); offset < 6; offset++ {
+		assert.Equal(t, offset, (<-toAck).cm.Offset)
+	}
+	require.NoError(t, <-claimDone)
+}
+
+// newFetchingClaim returns a claim simulating the fetches of sarama, which
+// fetches the next batch of 1KB messages of a partition once the previous one
+// has been read.
+func newFetchingClaim(batches, batchSize int, latency time.Duration) *fakeClaim {
+	c := &fakeClaim{messages: make(chan *sarama.ConsumerMessage)}
+	value := make([]byte, 1024)
+	go func() {
+		defer close(c.messages)
+		var offset int64
+		for i := 0; i < batches; i++ {
+			time.Sleep(latency)
+			for j := 0; j < batchSize; j++ {
+				c.messages <- &sarama.ConsumerMessage{Topic: "topic", Offset: offset, Value: value}
+				offset++
+			}
+		}
+	}()
+	return c
+}
+
+func BenchmarkReadAhead(b *testing.B) {
+	const batchSize = 100
+	for _, readAhead := range []int{0, batchSize} {
+		b.Run(fmt.Sprintf("read ahead %d", readAhead), func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			toAck := make(chan *consumerMessage)
+			handler := &consumerGroupHandler{
+				ctx:       ctx,
+				topic:     "topic",
+				toAck:     toAck,
+				readAhead: readAhead,
+			}
+			batches := b.N/batchSize + 1
+			claim := newFetchingClaim(batches, batchSize, time.Millisecond)
+			b.SetBytes(1024)
+			b.ResetTimer()
+
+			go func() {
+				_ = handler.ConsumeClaim(&fakeSession{marked: make(map[int32]int64)}, claim)
+			}()
+			// Handling the messages takes about as long as fetching them.
+			for i := 0; i < batches*batchSize; i++ {
+				cm := <-toAck
+				for start := time.Now(); time.Since(start) < 10*time.Microsecond; {
+					_ = sha256.Sum256(cm.cm.Value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package kafka
+
+import "github.com/uw-labs/substrate/config"
+
+// applyRegisteredDefaults sets the options that are not set to the defaults
+// registered for the kafka scheme, if UseRegisteredDefaults is set.
+func (c *AsyncMessageSinkConfig) applyRegisteredDefaults() error {
+	if !c.UseRegisteredDefaults {
+		return nil
+	}
+	return config.Apply("kafka", c)
+}
+
+// applyRegisteredDefaults sets the options that are not set to the defaults
+// registered for the kafka scheme, if UseRegisteredDefaults is set.
+func (c *AsyncMessageSourceConfig) applyRegisteredDefaults() error {
+	if !c.UseRegisteredDefaults {
+		return nil
+	}
+	return config.Apply("kafka", c)
+}
+
+// resolveTopic prepends the namespace to the topic, see Namespace.
+func (c *AsyncMessageSinkConfig) resolveTopic() {
+	c.Topic = config.Namespaced(c.Namespace, c.Topic)
+}
+
+// resolveTopic prepends the namespace to the topic, see Namespace.
+func (c *AsyncMessageSourceConfig) resolveTopic() {
+	c.Topic = config.Namespaced(c.Namespace, c.Topic)
+}
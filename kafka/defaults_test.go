@@ -0,0 +1,85 @@
+package kafka
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/config"
+	"github.com/uw-labs/substrate/suburl"
+)
+
+var registerTestDefaults sync.Once
+
+// useTestDefaults registers defaults for the kafka scheme that match the
+// sarama defaults, so that they don't affect other tests.
+func useTestDefaults() {
+	registerTestDefaults.Do(func() {
+		config.RegisterDefaults("kafka", func(c interface{}) error {
+			switch c := c.(type) {
+			case *AsyncMessageSinkConfig:
+				c.ClientID = "platform"
+			case *AsyncMessageSourceConfig:
+				c.ClientID = "platform"
+				c.SessionTimeout = 10 * time.Second
+			}
+			return nil
+		})
+	})
+}
+
+func TestRegisteredDefaultsPrecedence(t *testing.T) {
+	useTestDefaults()
+
+	// Explicit options take precedence over the defaults, which are only
+	// applied when enabled.
+	sinkConf := AsyncMessageSinkConfig{Topic: "t1", ClientID: "svc", UseRegisteredDefaults: true}
+	require.NoError(t, sinkConf.applyRegisteredDefaults())
+	assert.Equal(t, "svc", sinkConf.ClientID)
+
+	sinkConf = AsyncMessageSinkConfig{Topic: "t1"}
+	require.NoError(t, sinkConf.applyRegisteredDefaults())
+	assert.Empty(t, sinkConf.ClientID)
+
+	sourceConf := AsyncMessageSourceConfig{Topic: "t1", SessionTimeout: time.Minute, UseRegisteredDefaults: true}
+	require.NoError(t, sourceConf.applyRegisteredDefaults())
+	assert.Equal(t, "platform", sourceConf.ClientID)
+	assert.Equal(t, time.Minute, sourceConf.SessionTimeout)
+
+	// Url parameters take precedence over the defaults.
+	defer func() {
+		kafkaSinker = NewAsyncMessageSink
+	}()
+	kafkaSinker = func(c AsyncMessageSinkConfig) (substrate.AsyncMessageSink, error) {
+		sinkConf = c
+		return nil, nil
+	}
+	for url, clientID := range map[string]string{
+		"kafka://localhost:9092/t1":               "platform",
+		"kafka://localhost:9092/t1?client-id=svc": "svc",
+	} {
+		_, err := suburl.NewSink(url)
+		require.NoError(t, err)
+		require.NoError(t, sinkConf.applyRegisteredDefaults())
+		assert.Equal(t, clientID, sinkConf.ClientID, url)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	sinkConf := AsyncMessageSinkConfig{Topic: "t1"}
+	require.NoError(t, config.WithNamespace(&sinkConf, "billing."))
+	sinkConf.resolveTopic()
+	assert.Equal(t, "billing.t1", sinkConf.Topic)
+
+	sourceConf := AsyncMessageSourceConfig{Topic: "t1", Namespace: "billing."}
+	assert.Error(t, config.WithNamespace(&sourceConf, "shipping."))
+	sourceConf.resolveTopic()
+	assert.Equal(t, "billing.t1", sourceConf.Topic)
+
+	// A missing topic is still reported as missing.
+	_, err := NewFailoverAsyncMessageSink(AsyncMessageSinkConfig{Namespace: "billing."}, sinkConf, FailoverOptions{})
+	assert.EqualError(t, err, "the topic must be set for both clusters")
+}
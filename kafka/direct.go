@@ -0,0 +1,280 @@
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/hashicorp/go-multierror"
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/debug"
+	"golang.org/x/sync/errgroup"
+)
+
+const defaultCheckpointInterval = time.Second
+
+// Checkpointer persists the offsets of the partitions consumed by the sources
+// returned by NewDirectAsyncMessageSource. Offsets are the offsets of the next
+// messages to consume. See NewFileCheckpointer and NewKafkaCheckpointer.
+type Checkpointer interface {
+	// Load returns the saved offsets of the partitions of the topic.
+	// Partitions without a saved offset are omitted.
+	Load(topic string, partitions []int32) (map[int32]int64, error)
+	// Save saves the offsets of the partitions of the topic. Partitions
+	// that are not passed keep their saved offset.
+	Save(topic string, offsets map[int32]int64) error
+}
+
+// DirectAsyncMessageSourceConfig is the configuration of the sources returned
+// by NewDirectAsyncMessageSource.
+type DirectAsyncMessageSourceConfig struct {
+	Brokers []string
+	Topic   string
+	// Partitions are the partitions of the topic to consume, which must
+	// all exist.
+	Partitions []int32
+	// Offset is the initial offset, OffsetOldest or OffsetNewest, of the
+	// partitions without a saved offset. Defaults to OffsetNewest.
+	Offset int64
+	// Checkpointer, if set, saves the offsets of the acknowledged messages
+	// every CheckpointInterval, which defaults to a second, and when
+	// ConsumeMessages returns, and consumption resumes from the saved
+	// offsets. Without it, consumption always starts from Offset.
+	Checkpointer       Checkpointer
+	CheckpointInterval time.Duration
+	Version            string
+	// ClientID is the client id reported to the brokers. Defaults to
+	// "substrate-" followed by the topic.
+	ClientID string
+	TLS      *tls.Config
+	SASL     *SASLConfig
+
+	Debug bool
+}
+
+// NewDirectAsyncMessageSource returns a source consuming the listed partitions
+// of a topic directly, without a consumer group, so that the partitions are
+// never moved to another consumer, e.g. to shard a consumer with a large
+// state per partition over dedicated instances. It returns an error if one of
+// the partitions doesn't exist on the topic. Nacked messages are skipped.
+func NewDirectAsyncMessageSource(c DirectAsyncMessageSourceConfig) (substrate.AsyncMessageSource, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	config := sarama.NewConfig()
+	config.Consumer.Return.Errors = true
+	config.ClientID = clientID(c.ClientID, c.Topic)
+	if err := applySecurity(config, c.TLS, c.SASL); err != nil {
+		return nil, err
+	}
+	if c.Version != "" {
+		version, err := sarama.ParseKafkaVersion(c.Version)
+		if err != nil {
+			return nil, err
+		}
+		config.Version = version
+	}
+
+	client, err := sarama.NewClient(c.Brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPartitions(client, c.Topic, c.Partitions); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+
+	offset := OffsetNewest
+	if c.Offset != 0 {
+		offset = c.Offset
+	}
+	interval := defaultCheckpointInterval
+	if c.CheckpointInterval > 0 {
+		interval = c.CheckpointInterval
+	}
+	return &directMessageSource{
+		client:       client,
+		consumer:     consumer,
+		topic:        c.Topic,
+		partitions:   c.Partitions,
+		offset:       offset,
+		checkpointer: c.Checkpointer,
+		interval:     interval,
+		brokers:      newBrokerStatus(client, c.Brokers, c.Topic),
+		debugger: debug.Debugger{
+			Enabled: c.Debug,
+		},
+	}, nil
+}
+
+// checkPartitions returns an error if one of the partitions doesn't exist on
+// the topic.
+func checkPartitions(client sarama.Client, topic string, partitions []int32) error {
+	existing, err := client.Partitions(topic)
+	if err != nil {
+		return err
+	}
+	known := make(map[int32]bool, len(existing))
+	for _, p := range existing {
+		known[p] = true
+	}
+	for _, p := range partitions {
+		if !known[p] {
+			return fmt.Errorf("topic %s has no partition %d", topic, p)
+		}
+	}
+	return nil
+}
+
+var (
+	_ substrate.AsyncMessageSource = (*directMessageSource)(nil)
+)
+
+type directMessageSource struct {
+	client       sarama.Client
+	consumer     sarama.Consumer
+	topic        string
+	partitions   []int32
+	offset       int64
+	checkpointer Checkpointer
+	interval     time.Duration
+	brokers      *brokerStatus
+
+	debugger debug.Debugger
+}
+
+func (s *directMessageSource) ConsumeMessages(ctx context.Context, messages chan<- substrate.Message, acks <-chan substrate.Message) error {
+	var saved map[int32]int64
+	if s.checkpointer != nil {
+		var err error
+		saved, err = s.checkpointer.Load(s.topic, s.partitions)
+		if err != nil {
+			return fmt.Errorf("failed to load the saved offsets: %w", err)
+		}
+	}
+
+	// The partitions consumed so far are stopped if consuming the next one
+	// fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	eg, ctx := errgroup.WithContext(ctx)
+	fromKafka := make(chan *sarama.ConsumerMessage)
+	for _, p := range s.partitions {
+		offset, ok := saved[p]
+		if !ok {
+			offset = s.offset
+		}
+		pc, err := s.consumer.ConsumePartition(s.topic, p, offset)
+		if err != nil {
+			return fmt.Errorf("failed to consume partition %d from offset %d: %w", p, offset, err)
+		}
+		defer pc.AsyncClose()
+		s.debugger.Logf("substrate : direct consumer - consuming partition %d from offset %d\n", p, offset)
+
+		eg.Go(func() error {
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case err := <-pc.Errors():
+					return err
+				case m := <-pc.Messages():
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case fromKafka <- m:
+					}
+				}
+			}
+		})
+	}
+	eg.Go(func() error {
+		return s.deliver(ctx, fromKafka, messages, acks)
+	})
+	return eg.Wait()
+}
+
+// deliver delivers the consumed messages to the client and saves the offsets
+// of the acknowledged ones, until the context is done.
+func (s *directMessageSource) deliver(ctx context.Context, fromKafka <-chan *sarama.ConsumerMessage, messages chan<- substrate.Message, acks <-chan substrate.Message) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	var (
+		next      *consumerMessage
+		forAcking []*consumerMessage
+		// acked holds the offsets of the acknowledged messages that are
+		// not saved yet, by partition.
+		acked = make(map[int32]int64)
+	)
+	save := func() error {
+		if s.checkpointer == nil || len(acked) == 0 {
+			return nil
+		}
+		if err := s.checkpointer.Save(s.topic, acked); err != nil {
+			return fmt.Errorf("failed to save the offsets: %w", err)
+		}
+		s.debugger.Logf("substrate : direct consumer - saved offsets : %v\n", acked)
+		acked = make(map[int32]int64)
+		return nil
+	}
+
+	for {
+		in, out := fromKafka, messages
+		if next == nil {
+			out = nil
+		} else {
+			in = nil
+		}
+		select {
+		case <-ctx.Done():
+			if err := save(); err != nil {
+				return err
+			}
+			return ctx.Err()
+		case m := <-in:
+			next = &consumerMessage{cm: m, ctx: ctx}
+		case out <- next:
+			forAcking = append(forAcking, next)
+			next = nil
+		case ack := <-acks:
+			switch {
+			case len(forAcking) == 0:
+				return substrate.InvalidAckError{Acked: ack, Expected: nil}
+			case !substrate.SameMessage(ack, forAcking[0]):
+				return substrate.InvalidAckError{Acked: ack, Expected: forAcking[0]}
+			}
+			acked[forAcking[0].Partition()] = forAcking[0].Offset() + 1
+			forAcking = forAcking[1:]
+		case <-ticker.C:
+			if err := save(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *directMessageSource) Status() (*substrate.Status, error) {
+	st, err := status(s.client, s.topic)
+	if err != nil {
+		return nil, err
+	}
+	st.Details["partitions"] = fmt.Sprint(s.partitions)
+	s.brokers.addTo(st)
+	return st, nil
+}
+
+func (s *directMessageSource) Close() (err error) {
+	for _, closer := range []io.Closer{s.consumer, s.client} {
+		err = multierror.Append(err, closer.Close()).ErrorOrNil()
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+package kafka
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+)
+
+// fakeConsumer serves partition consumers fed by the test, recording the
+// offsets they are started from.
+type fakeConsumer struct {
+	sarama.Consumer
+	partitions map[int32]*fakePartitionConsumer
+	started    map[int32]int64
+}
+
+func (c *fakeConsumer) ConsumePartition(_ string, p int32, offset int64) (sarama.PartitionConsumer, error) {
+	c.started[p] = offset
+	return c.partitions[p], nil
+}
+
+type fakePartitionConsumer struct {
+	sarama.PartitionConsumer
+	messages chan *sarama.ConsumerMessage
+	errors   chan *sarama.ConsumerError
+}
+
+func newFakePartitionConsumer() *fakePartitionConsumer {
+	return &fakePartitionConsumer{
+		messages: make(chan *sarama.ConsumerMessage),
+		errors:   make(chan *sarama.ConsumerError),
+	}
+}
+
+func (pc *fakePartitionConsumer) Messages() <-chan *sarama.ConsumerMessage { return pc.messages }
+func (pc *fakePartitionConsumer) Errors() <-chan *sarama.ConsumerError     { return pc.errors }
+func (pc *fakePartitionConsumer) AsyncClose()                              {}
+
+func TestCheckPartitions(t *testing.T) {
+	client := &metadataClient{}
+	assert.NoError(t, checkPartitions(client, "topic", []int32{0, 1}))
+	assert.EqualError(t, checkPartitions(client, "topic", []int32{1, 2}), "topic topic has no partition 2")
+}
+
+func TestFileCheckpointer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoints")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := NewFileCheckpointer(filepath.Join(dir, "offsets.json"))
+	offsets, err := c.Load("t1", []int32{0, 1})
+	require.NoError(t, err)
+	assert.Empty(t, offsets)
+
+	require.NoError(t, c.Save("t1", map[int32]int64{0: 10, 1: 20}))
+	require.NoError(t, c.Save("t1", map[int32]int64{1: 25}))
+	require.NoError(t, c.Save("t2", map[int32]int64{0: 5}))
+
+	// The offsets are read back from the file.
+	c = NewFileCheckpointer(filepath.Join(dir, "offsets.json"))
+	offsets, err = c.Load("t1", []int32{1, 0, 7})
+	require.NoError(t, err)
+	assert.Equal(t, map[int32]int64{0: 10, 1: 25}, offsets)
+	offsets, err = c.Load("t2", []int32{0})
+	require.NoError(t, err)
+	assert.Equal(t, map[int32]int64{0: 5}, offsets)
+}
+
+func TestDirectMessageSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoints")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	checkpointer := NewFileCheckpointer(filepath.Join(dir, "offsets.json"))
+	require.NoError(t, checkpointer.Save("topic", map[int32]int64{2: 40}))
+
+	consumer := &fakeConsumer{
+		partitions: map[int32]*fakePartitionConsumer{
+			2: newFakePartitionConsumer(),
+			3: newFakePartitionConsumer(),
+		},
+		started: make(map[int32]int64),
+	}
+	source := &directMessageSource{
+		consumer:     consumer,
+		topic:        "topic",
+		partitions:   []int32{2, 3},
+		offset:       OffsetOldest,
+		checkpointer: checkpointer,
+		interval:     time.Hour,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	messages := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, messages, acks)
+	}()
+
+	consumer.partitions[2].messages <- &sarama.ConsumerMessage{Topic: "topic", Partition: 2, Offset: 40, Value: []byte("m1")}
+	m1 := <-messages
+	assert.Equal(t, []byte("m1"), m1.Data())
+	consumer.partitions[3].messages <- &sarama.ConsumerMessage{Topic: "topic", Partition: 3, Offset: 0, Value: []byte("m2")}
+	m2 := <-messages
+	assert.Equal(t, int32(3), m2.(Message).Partition())
+
+	// Partition 2 resumes from its saved offset.
+	assert.Equal(t, map[int32]int64{2: 40, 3: OffsetOldest}, consumer.started)
+
+	acks <- m1
+	acks <- m2
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+
+	// The offsets of the acknowledged messages are saved when
+	// ConsumeMessages returns.
+	offsets, err := checkpointer.Load("topic", []int32{2, 3})
+	require.NoError(t, err)
+	assert.Equal(t, map[int32]int64{2: 41, 3: 1}, offsets)
+}
+
+func TestDirectMessageSourceInvalidAck(t *testing.T) {
+	consumer := &fakeConsumer{
+		partitions: map[int32]*fakePartitionConsumer{0: newFakePartitionConsumer()},
+		started:    make(map[int32]int64),
+	}
+	source := &directMessageSource{
+		consumer:   consumer,
+		topic:      "topic",
+		partitions: []int32{0},
+		offset:     OffsetNewest,
+		interval:   time.Hour,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, make(chan substrate.Message), acks)
+	}()
+
+	acks <- &consumerMessage{cm: &sarama.ConsumerMessage{}}
+	assert.IsType(t, substrate.InvalidAckError{}, <-errs)
+}
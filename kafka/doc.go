@@ -14,16 +14,528 @@
 //
 //      broker - Specifies additional broker addresses in the form host%3Aport (where %3A is a url encoded ':')
 //      version - Specifies the version of the broker
+//      client-id - The client id reported to the brokers. Defaults to substrate-<topic>
+//      namespace - Prepended to the topic, e.g. `billing.`
 //
 // Additionally, for sources, the following url parameters are available
 //
 //      offset           - The initial offset. Valid values are `newest` and `oldest`.
 //      consumer-group   - The consumer group id
+//      rack-id          - The rack of the consumer, to fetch from the closest replica
 //      metadata-refresh - How frequently to refresh the cluster metadata. E.g., '10s' '2m'
 //
 // Additionally, for sinks, the following url parameters are available
 //
 //      debug               - Boolean indicating if debug logs should be written.
 //      max-message-bytes   - The maximum size in bytes for the produced messages.
+//      strict-ordering     - Boolean indicating if messages must be written in order, even when retried.
+//
+// Default options
+//
+// Defaults registered for the kafka scheme with the config package apply to
+// the options that are not set by the url parameters. The configs passed to
+// the constructors use them when UseRegisteredDefaults is set. See
+// https://godoc.org/github.com/uw-labs/substrate/config for the precedence.
+//
+// Functional options
+//
+// Sinks and sources can also be created from options with NewSink and
+// NewSource, which populate the config structs:
+//
+//      sink, err := kafka.NewSink(kafka.WithBrokers("localhost:9092"), kafka.WithTopic("invoices"))
+//
+// Options are order-independent, so options setting the same fields, such as
+// WithKeyFunc and WithPartitionFunc, conflict. The options of an environment
+// are given to Overrides, which take precedence over the others. The fields
+// that have no option are set on the config returned by NewSinkConfig or
+// NewSourceConfig.
+//
+// Attributes
+//
+// The attributes of messages implementing substrate.AttributedMessage are
+// published as record headers, and consumed messages expose the record headers
+// as attributes. Headers require a broker Version of at least 0.11.0, so sinks
+// configured with an older Version don't publish attributes, rather than fail
+// to produce the messages that have some.
+//
+// Sarama interceptors can be set with Interceptors on the source and sink
+// configs, e.g. to add standard headers to every message. The interceptor
+// returned by NewPublishHeadersInterceptor adds the publish time and hostname:
+//
+//      interceptor, err := kafka.NewPublishHeadersInterceptor()
+//      ...
+//      sink, err := kafka.NewAsyncMessageSink(kafka.AsyncMessageSinkConfig{
+//          ...
+//          Interceptors: []sarama.ProducerInterceptor{interceptor},
+//      })
+//
+// Rebalances
+//
+// Sources handle consumer group rebalances internally, so ConsumeMessages only
+// returns when its context is done or on an error that is not caused by a
+// rebalance. Messages delivered before a rebalance that have not been
+// acknowledged yet are dropped from the session: acknowledging them is still
+// required, but their offsets are not committed, and they will be redelivered
+// to the consumer that is assigned their partition.
+//
+// Long running handlers can abort once the partition of a message is revoked,
+// as the context of the delivered messages is cancelled when the session they
+// were consumed in ends:
+//
+//      if m, ok := msg.(kafka.Message); ok {
+//          ctx = m.Context()
+//      }
+//
+// Replaying a time window
+//
+// Sources can be restricted to the messages between StartTime and EndTime. The
+// offset of each partition is reset to the first message at or after
+// StartTime when the partition is first claimed, so a dedicated consumer group
+// should be used for the replay. Messages after EndTime are acknowledged and
+// dropped, or, with StopAtEndTime, ConsumeMessages returns nil once every
+// claimed partition has passed EndTime. MaxIdle bounds how long an idle
+// partition is waited for, and PartitionCompleted reports the progress:
+//
+//      source, err := kafka.NewAsyncMessageSource(kafka.AsyncMessageSourceConfig{
+//          ...
+//          StartTime:     start,
+//          EndTime:       end,
+//          StopAtEndTime: true,
+//          MaxIdle:       time.Minute,
+//      })
+//
+// Reading compacted topics
+//
+// A compacted topic can be read as a snapshot before consuming live updates.
+// The newest offset of each partition is recorded when the partition is first
+// claimed, and CaughtUp is called once the messages up to those offsets have
+// been acknowledged. Empty partitions are caught up straight away, and MaxIdle
+// bounds how long a partition whose newest messages were removed by compaction
+// is waited for:
+//
+//      source, err := kafka.NewAsyncMessageSource(kafka.AsyncMessageSourceConfig{
+//          ...
+//          Offset:   kafka.OffsetOldest,
+//          CaughtUp: func() { close(ready) },
+//          MaxIdle:  10 * time.Second,
+//      })
+//
+// Committing offsets
+//
+// Acknowledged messages have their offsets marked, and marked offsets are
+// committed periodically. Sources implement OffsetCommitter, which allows
+// committing the marked offsets synchronously, for example before a controlled
+// failover, and inspecting the marked and committed offsets:
+//
+//      if committer, ok := source.(kafka.OffsetCommitter); ok {
+//          err := committer.Commit(ctx)
+//          ...
+//      }
+//
+// Jobs recording their own progress can set OnAcked on the source config,
+// which is called with the marked offsets independently of the commits, at
+// most once per partition per OnAckedInterval.
+//
+// Catch-up progress
+//
+// Sources implement ProgressReporter, which reports for every claimed partition
+// the consumed offset, the high water mark, the number of remaining messages,
+// and the consumption rate over the last minute, along with an estimated
+// completion time, e.g. to follow a consumer restored far behind. The
+// instrumented package exports it to prometheus:
+//
+//      prometheus.MustRegister(instrumented.NewKafkaProgressCollector(
+//          source.(kafka.ProgressReporter), "orders_consumer", prometheus.Labels{"topic": "orders"}))
+//
+// Sources also implement MembershipReporter, which reports the partitions
+// assigned to them in the current session. DescribeConsumerGroup reports the
+// members of a whole consumer group, along with their client ids, hosts and
+// assigned partitions, e.g. to find which replicas consume which partitions:
+//
+//      group, err := kafka.DescribeConsumerGroup(ctx, brokers, "2.6.0", "orders-consumer")
+//
+// Sources also implement ClaimMetricsReporter, which reports for every
+// partition the messages and batches received from sarama, and the time spent
+// waiting to deliver them, either to the goroutine delivering the messages of
+// every partition, or to the caller, e.g. to tell whether ReadAhead helps. The
+// counters are atomic, and only measure time when a message can't be handed
+// over straight away. The instrumented package exports them to prometheus with
+// NewKafkaClaimCollector.
+//
+// The Status of a source also reports the lag of the whole consumer group, the
+// number of messages after its committed offsets, which is nil if the offsets
+// can't be fetched.
+//
+// Partition count changes
+//
+// Clients only refresh the metadata of a topic periodically, every 10 minutes
+// by default, so sinks keep hashing keys over the old partitions for a while
+// after partitions are added to a topic. Setting OnPartitionCountChange, or
+// PartitionWatchInterval, on the source or sink config refreshes the metadata
+// of the topic at that interval, and calls the callback with the old and new
+// number of partitions when it changes. Keyed messages published to the sink
+// use the new partitions as soon as the change is detected.
+//
+// Mirroring partitions
+//
+// Sinks hash the key of messages to choose their partition, unless their
+// config sets a PartitionFunc. To mirror a topic while keeping the partition of
+// every message, e.g. for consumers relying on it, NewMirrorSink returns a sink
+// producing the messages to the partition they were consumed from, checking
+// that both topics have the same number of partitions, and MirrorPipeOptions
+// keeps the partition of the messages returned by a Transform:
+//
+//      sink, err := kafka.NewMirrorSink(sourceConf, sinkConf)
+//      ...
+//      err = substrate.Pipe(ctx, source, sink, kafka.MirrorPipeOptions(substrate.PipeOptions{}))
+//
+// Consuming partitions directly
+//
+// NewDirectAsyncMessageSource returns a source consuming the listed partitions
+// of a topic without a consumer group, so that partitions are never moved by a
+// rebalance, e.g. to shard a consumer whose state per partition is too large to
+// move over dedicated instances. The offsets of the acknowledged messages are
+// saved with a Checkpointer, either to a file with NewFileCheckpointer, or to
+// the offsets topic of the cluster with NewKafkaCheckpointer:
+//
+//      source, err := kafka.NewDirectAsyncMessageSource(kafka.DirectAsyncMessageSourceConfig{
+//          Brokers:      brokers,
+//          Topic:        "orders",
+//          Partitions:   []int32{0, 1, 2, 3, 4, 5, 6, 7},
+//          Offset:       kafka.OffsetOldest,
+//          Checkpointer: kafka.NewFileCheckpointer("/data/offsets.json"),
+//      })
+//
+// Creating the source fails if one of the partitions doesn't exist.
+//
+// Resetting offsets
+//
+// ResetConsumerGroupOffsets commits new offsets for a consumer group, without
+// the kafka command line tools. The group must have no active members, and the
+// offsets before and after the reset are returned for logging:
+//
+//      changes, err := kafka.ResetConsumerGroupOffsets(ctx, brokers, "2.4.0", "group", "topic",
+//          kafka.OffsetResetTarget{Time: time.Now().Add(-time.Hour)})
+//
+// A new consumer group, e.g. of a service deployed with a new group id, can
+// start where an old group left off: ExportGroupOffsets returns the committed
+// offsets of the old group, which marshal to stable JSON, and
+// ImportGroupOffsets commits them for the new group, unless it already has
+// committed offsets:
+//
+//      offsets, err := kafka.ExportGroupOffsets(ctx, brokers, "2.4.0", "orders-v1", "orders")
+//      ...
+//      changes, err := kafka.ImportGroupOffsets(ctx, brokers, "2.4.0", "orders-v2", offsets, false)
+//
+// Oversize messages
+//
+// MaxMessageBytes guards sources against malformed giant messages. Larger
+// messages are not delivered, and are passed to OnOversize instead, which can
+// log their partition and offset, or publish them to a dead letter sink, before
+// they are acknowledged:
+//
+//      source, err := kafka.NewAsyncMessageSource(kafka.AsyncMessageSourceConfig{
+//          ...
+//          MaxMessageBytes: 1 << 20,
+//          OnOversize: func(msg substrate.Message, err error) error {
+//              m := msg.(kafka.Message)
+//              log.Printf("skipped message at offset %d of partition %d: %s", m.Offset(), m.Partition(), err)
+//              return nil
+//          },
+//      })
+//
+// Filtering by header
+//
+// HeaderFilter restricts the delivered messages to the ones with matching
+// headers, e.g. to consume only a few of the event types published to a topic.
+// Other messages are acknowledged without being delivered, and their payload is
+// released straight away. OnFiltered is called with them first, e.g. to count
+// them:
+//
+//      source, err := kafka.NewAsyncMessageSource(kafka.AsyncMessageSourceConfig{
+//          ...
+//          HeaderFilter: map[string][]string{"event-type": {"order-created", "order-cancelled"}},
+//          OnFiltered: func(msg substrate.Message) {
+//              filtered.Inc()
+//          },
+//      })
+//
+// Tombstones
+//
+// Tombstones, the records without a value that delete their key from compacted
+// topics, are delivered with a nil payload by default. With TombstoneHandling
+// set to TombstonesSkipped, they are acknowledged without being delivered, and
+// with TombstonesMarked, they are delivered as messages implementing
+// TombstoneMessage, so that handlers can tell them apart:
+//
+//      if tm, ok := msg.(kafka.TombstoneMessage); ok && tm.IsTombstone() {
+//          return store.Delete(ctx, tm.(substrate.KeyedMessage).Key())
+//      }
+//
+// Sinks publish the messages returned by Tombstone, and the marked tombstones
+// of sources, as tombstones. Other messages are published with a value, which
+// is empty for a nil payload, so compaction doesn't delete their key.
+//
+// Transforming payloads
+//
+// PayloadTransform, if set on a source, is applied to every payload before it
+// is delivered, and if set on a sink, before it is produced, e.g. to decrypt
+// and encrypt them. Expensive transforms run on TransformWorkers goroutines,
+// while messages are still delivered and produced in order:
+//
+//      source, err := kafka.NewAsyncMessageSource(kafka.AsyncMessageSourceConfig{
+//          ...
+//          PayloadTransform: decrypt,
+//          TransformWorkers: runtime.NumCPU(),
+//          OnNack:           publishToDeadLetterTopic,
+//      })
+//
+// Consumed messages whose transform fails are not delivered. They are nacked
+// with a PayloadTransformError, so they are passed to OnNack with their
+// original payload, or skipped without it. Sinks terminate with a
+// PayloadTransformError instead. Tombstones are not transformed.
+//
+// Skipping poison messages
+//
+// A message that can't be processed blocks its partition, as its offset is
+// never committed. SkipOffsets lists the offsets of the messages to skip by
+// partition, which are acknowledged without being delivered, and passed to
+// OnSkipped to be logged:
+//
+//      source, err := kafka.NewAsyncMessageSource(kafka.AsyncMessageSourceConfig{
+//          ...
+//          SkipOffsets: map[int32][]int64{3: {1042}},
+//          OnSkipped: func(msg kafka.Message) {
+//              log.Printf("skipped offset %d of partition %d", msg.Offset(), msg.Partition())
+//          },
+//      })
+//
+// ShouldSkip decides which messages to skip instead, and the sources implement
+// OffsetSkipper, to skip the messages that are not delivered yet while they
+// are running, e.g. from an admin endpoint.
+//
+// Nacking messages
+//
+// Delivered messages implement substrate.Nackable. A message nacked before it is
+// acknowledged is passed to OnNack once it is acknowledged, which can publish it
+// to a dead letter topic before its offset is committed. Without OnNack, the
+// offsets of nacked messages are committed, skipping them:
+//
+//      source, err := kafka.NewAsyncMessageSource(kafka.AsyncMessageSourceConfig{
+//          ...
+//          OnNack: func(msg substrate.Message, reason error) error {
+//              return deadLetters.PublishMessage(ctx, msg)
+//          },
+//      })
+//
+// Pausing consumption
+//
+// Sources implement substrate.Pausable. While paused, no messages are read from
+// the claimed partitions, so sarama stops fetching once its buffers are full,
+// but the consumer keeps its membership of the consumer group, and the messages
+// already delivered can still be acknowledged. The status of a paused source
+// reports it as a problem.
+//
+// Failing over to another cluster
+//
+// NewFailoverAsyncMessageSink publishes to a primary cluster, and switches to a
+// secondary cluster when publishing to the primary fails repeatedly. The
+// messages in flight are published again to the secondary before new ones, and
+// the sink switches back once probing the primary succeeds:
+//
+//      sink, err := kafka.NewFailoverAsyncMessageSink(primaryConfig, secondaryConfig, kafka.FailoverOptions{
+//          ErrorThreshold: 5,
+//          ErrorWindow:    time.Minute,
+//          OnSwitch:       func(c kafka.Cluster) { log.Printf("publishing to the %s cluster", c) },
+//      })
+//
+// Metrics
+//
+// Sarama records metrics such as request latencies, batch sizes and record send
+// rates in a go-metrics registry, which is set with MetricRegistry on the source
+// and sink configs, or is otherwise available through the MetricsReporter
+// interface. The instrumented package bridges it into prometheus:
+//
+//      prometheus.MustRegister(instrumented.NewSaramaCollector(
+//          sink.(kafka.MetricsReporter).Metrics(), "kafka", prometheus.Labels{"topic": "orders"}))
+//
+// Limiting messages in flight
+//
+// MaxInFlight pauses consuming while that many messages are delivered and not
+// acknowledged yet. As a fixed limit either throttles fast consumers or lets
+// slow ones hold too many messages, AdaptiveWindow adapts the limit to the
+// latency of the acknowledgements instead, growing it while they stay under
+// the target latency, and shrinking it when they don't:
+//
+//      window := substrate.NewAdaptiveWindow(substrate.AdaptiveWindowOptions{
+//          TargetLatency: 500 * time.Millisecond,
+//          Max:           5000,
+//      })
+//      source, err := kafka.NewAsyncMessageSource(kafka.AsyncMessageSourceConfig{
+//          ...
+//          AdaptiveWindow: window,
+//          Gauges:         instrumented.NewGauges(gaugeOpts, "orders"),
+//      })
+//
+// Calling Shrink on the window, e.g. on memory pressure, shrinks it straight
+// away. Gauges implementing substrate.WindowGauges are sampled with the window.
+//
+// Detecting stalls
+//
+// A consumer that stops acknowledging messages stops its partitions from being
+// committed. With StallTimeout set on the source config, once no message has
+// been acknowledged for that long while messages are in flight, OnStall is
+// called with the partition, offset and age of every in-flight message, so
+// that the stuck message can be found:
+//
+//      StallTimeout: time.Minute,
+//      OnStall:      func(r kafka.StallReport) { log.Print(r) },
+//
+// Sharing clients
+//
+// Each source and sink opens its own client, with its own broker connections.
+// Services consuming or publishing to many topics can set the same ClientPool on
+// their configs to share one client between the sources, or sinks, created with
+// the same brokers and options. The client is closed once the last source or
+// sink using it is closed. Since ClientID defaults to a value derived from the
+// topic, it needs to be set for sources or sinks of different topics to share a
+// client. Sources never share a client with sinks.
+//
+//      pool := kafka.NewClientPool()
+//      orders, err := kafka.NewAsyncMessageSource(kafka.AsyncMessageSourceConfig{
+//          ...
+//          ClientID:   "billing",
+//          ClientPool: pool,
+//      })
+//
+// Fetching from the closest replica
+//
+// Sources with a RackID fetch each partition from the in-sync replica in the
+// same rack, e.g. the same availability zone, rather than from the leader, to
+// avoid cross zone traffic. It requires a broker Version of at least 2.4.0, and
+// the brokers must set broker.rack and
+//
+//      replica.selector.class=org.apache.kafka.common.replica.RackAwareReplicaSelector
+//
+// otherwise partitions are still fetched from their leader. The status of the
+// source reports the id of the broker each claimed partition is fetched from,
+// in the partition-<n>-broker details, to check the locality in production.
+//
+// Retrying produce errors
+//
+// Sarama retries failed requests a few times, after which a failed message
+// terminates PublishMessages. With RetryProduceErrors, messages failing with a
+// retriable error, such as ErrNotEnoughReplicas during a broker restart, are
+// published again by the sink, up to ProduceRetryAttempts times, and only the
+// other errors terminate PublishMessages. Retried messages are written after the
+// messages published after them, so RetryProduceErrors can't be combined with
+// StrictOrdering.
+//
+// Shared producers
+//
+// Sinks create a producer for every PublishMessages call, which is costly for
+// callers that call it in a loop, e.g. to reconnect after failures. With
+// SharedProducer, a single producer is created along with the sink and closed
+// by Close. Calling PublishMessages while another call is running on the same
+// sink returns ErrConcurrentPublish, whether the producer is shared or not.
+//
+// Broker quotas
+//
+// Brokers enforcing a produce quota delay their responses to the sinks
+// exceeding it, which backs up every message in flight without failing any.
+// OnThrottled, if set on the sink config, is called with the throttle time
+// recorded by sarama whenever the brokers throttled the sink. With
+// AdaptToQuota, the sink also limits the bytes it produces to just under its
+// throughput while throttled, raising the limit again while it isn't, and
+// Status details the current limit:
+//
+//      sink, err := kafka.NewAsyncMessageSink(kafka.AsyncMessageSinkConfig{
+//          ...
+//          OnThrottled:  func(d time.Duration) { throttled.Observe(d.Seconds()) },
+//          AdaptToQuota: true,
+//      })
+//
+// Publishing batches
+//
+// Sinks implement substrate.AsyncMessageBatchSink, publishing the messages of
+// every batch back to back. With FlushMessages set to the size of the batches,
+// and FlushFrequency bounding the wait for a partial one, the producer sends
+// every batch in a single request per broker. A failed message fails its
+// batch with a *substrate.BatchError giving its index in the batch, so that
+// the caller can tell which one to fix or drop before publishing the batch
+// again. substrate.NewBatchingSink batches the messages of PublishMessages
+// into such batches.
+//
+// Produce confirmations
+//
+// Sinks acknowledge messages without saying where they were written. OnAck,
+// if set on the sink config, is called with the partition, offset and
+// timestamp of every message before it is acknowledged, e.g. to build an
+// index of the records. It is called on the acknowledgement path, so it must
+// not block.
+//
+// TLS and SASL
+//
+// Sources and sinks connect to the brokers over TLS when TLS is set, and
+// authenticate with SASL when SASL is set. Certificates rotated on disk, e.g.
+// by a sidecar, are picked up without a restart by a CertificateReloader, and
+// rotated SCRAM passwords by a PasswordFunc, which is called whenever a broker
+// connection is authenticated. Established connections keep the credentials
+// they were opened with.
+//
+//      reloader, err := kafka.NewCertificateReloader("/certs/tls.crt", "/certs/tls.key")
+//      ...
+//      source, err := kafka.NewAsyncMessageSource(kafka.AsyncMessageSourceConfig{
+//          ...
+//          TLS: &tls.Config{GetClientCertificate: reloader.GetClientCertificate},
+//      })
+//
+// Broker status
+//
+// The Status of sources and sinks details the state of every configured broker,
+// which is either connected, not connected, or unresolvable, the id of the
+// controller, and the leader of every partition of the topic, so that
+// problems point at the broker involved. Unresolvable brokers and partitions
+// without a leader are reported as problems. The broker metadata is cached for
+// 10 seconds, so that health checks can poll Status often.
+//
+// Startup checks
+//
+// With StartupChecks set, sources and sinks check that their credentials can
+// use the topic when they are created, rather than failing on the first fetch
+// or produce. Creation fails if the topic can't be described, or if an ACL
+// denies the SASL user Read access for sources or Write access for sinks.
+// Their Status reports a problem if no ACL allows the access, which is
+// expected for super users, or if the ACLs can't be described, as when the
+// user isn't allowed to describe the ACLs of the cluster.
+//
+// Timestamp types
+//
+// The timestamps of the records are the time they were created by the
+// producers, or the time they were appended to the log if the topic sets
+// message.timestamp.type to LogAppendTime, which makes latencies measured from
+// them meaningless. Sources describe the timestamp type of their topic when
+// they are created, and the delivered messages expose it along with their
+// Timestamp and BlockTimestamp, see Message. Setting ExpectedTimestampType on
+// the source config makes Status report a problem if the topic has another
+// type, or if it can't be described, e.g. without the permission to describe
+// the configs of the topic. The latency histogram of the instrumented source
+// labels the timestamp type it used.
+//
+// Lifecycle events
+//
+// Setting LifecycleEvents on the source or sink config emits
+// substrate.LifecycleEvents to the channel, such as connected and closed
+// events, the consumer group sessions of sources along with their assigned
+// partitions, and the flushes of the producers of sinks. Failover sinks emit
+// an event whenever they switch cluster. Events are never waited for: they
+// are dropped when the channel is full, and counted in Dropped.
+//
+//      events := make(chan substrate.LifecycleEvent, 64)
+//      go func() {
+//          for ev := range events {
+//              log.Printf("kafka %s on %s: partitions=%v err=%v", ev.Type, ev.Topic, ev.Partitions, ev.Err)
+//          }
+//      }()
 //
 package kafka
@@ -0,0 +1,101 @@
+package kafka_test
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"time"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/kafka"
+)
+
+// A sink created from a config struct:
+//
+//      sink, err := kafka.NewAsyncMessageSink(kafka.AsyncMessageSinkConfig{
+//          Brokers: []string{"localhost:9092"},
+//          Topic:   "invoices",
+//          Version: "2.4.0",
+//          KeyFunc: invoiceID,
+//      })
+//
+// is created with options as follows.
+func ExampleNewSink() {
+	sink, err := kafka.NewSink(
+		kafka.WithBrokers("localhost:9092"),
+		kafka.WithTopic("invoices"),
+		kafka.WithVersion("2.4.0"),
+		kafka.WithKeyFunc(func(msg substrate.Message) []byte { return msg.Data()[:8] }),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sink.Close()
+}
+
+// A source created from a config struct:
+//
+//      source, err := kafka.NewAsyncMessageSource(kafka.AsyncMessageSourceConfig{
+//          Brokers:       []string{"localhost:9092"},
+//          Topic:         "invoices",
+//          ConsumerGroup: "billing",
+//          Offset:        kafka.OffsetOldest,
+//      })
+//
+// is created with options as follows.
+func ExampleNewSource() {
+	source, err := kafka.NewSource(
+		kafka.WithBrokers("localhost:9092"),
+		kafka.WithTopic("invoices"),
+		kafka.WithConsumerGroup("billing"),
+		kafka.WithOffset(kafka.OffsetOldest),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer source.Close()
+}
+
+// The settings of an environment are given to Overrides, on top of the ones
+// shared by every environment, whatever the order of the options.
+func ExampleOverrides() {
+	opts := []kafka.Option{
+		kafka.WithBrokers("localhost:9092"),
+		kafka.WithTopic("invoices"),
+		kafka.WithConsumerGroup("billing"),
+	}
+	if os.Getenv("ENVIRONMENT") == "production" {
+		opts = append(opts, kafka.Overrides(
+			kafka.WithBrokers("kafka-1.prod:9093", "kafka-2.prod:9093"),
+			kafka.WithTLS(&tls.Config{}),
+			kafka.WithSessionTimeout(30*time.Second),
+		))
+	}
+
+	source, err := kafka.NewSource(opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer source.Close()
+}
+
+// The fields of the config structs that have no option are set on the config
+// returned by NewSinkConfig, which is then passed to NewAsyncMessageSink.
+func ExampleNewSinkConfig() {
+	conf, err := kafka.NewSinkConfig(
+		kafka.WithBrokers("localhost:9092"),
+		kafka.WithTopic("invoices"),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conf.OnPartitionCountChange = func(old, new int) {
+		log.Printf("invoices has %d partitions, not %d", new, old)
+	}
+
+	sink, err := kafka.NewAsyncMessageSink(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sink.Close()
+}
@@ -0,0 +1,408 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/flush"
+)
+
+const (
+	defaultFailoverErrorThreshold = 3
+	defaultFailoverErrorWindow    = time.Minute
+	defaultFailoverProbeInterval  = 30 * time.Second
+	defaultFailoverRetryBackoff   = time.Second
+)
+
+// errSwitchBack ends a session on the secondary cluster once the primary is
+// reachable again and the messages in flight have been acknowledged.
+var errSwitchBack = errors.New("switching back to the primary cluster")
+
+// Cluster identifies a cluster of a failover sink.
+type Cluster int
+
+const (
+	// PrimaryCluster is the cluster published to unless it is failing.
+	PrimaryCluster Cluster = iota
+	// SecondaryCluster is the cluster published to while the primary is
+	// failing.
+	SecondaryCluster
+)
+
+func (c Cluster) String() string {
+	switch c {
+	case PrimaryCluster:
+		return "primary"
+	case SecondaryCluster:
+		return "secondary"
+	default:
+		return fmt.Sprintf("cluster(%d)", int(c))
+	}
+}
+
+// ClusterReporter is implemented by the sinks returned by
+// NewFailoverAsyncMessageSink, to report the cluster they publish to.
+type ClusterReporter interface {
+	// ActiveCluster returns the cluster messages are published to.
+	ActiveCluster() Cluster
+}
+
+// FailoverOptions are the options of a failover sink.
+type FailoverOptions struct {
+	// ErrorThreshold is the number of publishing failures within
+	// ErrorWindow after which the sink switches to the other cluster.
+	// Defaults to 3 failures within a minute.
+	ErrorThreshold int
+	ErrorWindow    time.Duration
+	// RetryBackoff is how long to wait before retrying to publish to the
+	// same cluster after a failure. Defaults to a second.
+	RetryBackoff time.Duration
+	// ProbeInterval is how often the primary cluster is probed while
+	// publishing to the secondary, to switch back once it is reachable.
+	// Defaults to 30 seconds.
+	ProbeInterval time.Duration
+	// OnSwitch, if set, is called with the cluster switched to, e.g. to
+	// alert operators. It must not block.
+	OnSwitch func(active Cluster)
+	// LifecycleEvents, if set, receives a switched event whenever the sink
+	// switches cluster, whose detail is the cluster switched to, and a
+	// closed event once the sink is closed. The events of the sinks of
+	// each cluster are set in their configs. Events are dropped when the
+	// channel is full.
+	LifecycleEvents chan<- substrate.LifecycleEvent
+	// PublishedRegistry, if set, is set along with IDFunc on the sinks of
+	// both clusters that don't set their own, so that they mark the
+	// messages written. The messages in flight that are published again
+	// after a failure are acknowledged without being published if their
+	// ID is seen in the registry, so they are not written twice.
+	PublishedRegistry substrate.PublishedRegistry
+	IDFunc            func(substrate.Message) string
+}
+
+// NewFailoverAsyncMessageSink returns a sink that publishes to the primary
+// cluster, and fails over to the secondary cluster when publishing to the
+// primary fails ErrorThreshold times within ErrorWindow, for example when it
+// is unreachable. A failure is an error from the producer of a cluster, once
+// sarama has given up retrying, after which publishing is retried on the same
+// cluster after RetryBackoff, until the failures are sustained. While
+// publishing to the secondary cluster, the primary is probed every
+// ProbeInterval, and once it is reachable, the sink stops publishing new
+// messages until the messages in flight are acknowledged, and switches back
+// to it.
+//
+// The messages that were in flight when publishing fails are published again
+// before any new message, in the order they were published, so they may be
+// written twice, to either cluster. Messages are acknowledged in order.
+// Status reports the status of the active cluster, and the sink implements
+// ClusterReporter. When Close is called on the returned sink, the sinks of
+// both clusters are closed.
+func NewFailoverAsyncMessageSink(primary, secondary AsyncMessageSinkConfig, opts FailoverOptions) (substrate.AsyncMessageSink, error) {
+	if primary.Topic == "" || secondary.Topic == "" {
+		return nil, errors.New("the topic must be set for both clusters")
+	}
+	if opts.PublishedRegistry != nil {
+		for _, c := range []*AsyncMessageSinkConfig{&primary, &secondary} {
+			if c.PublishedRegistry == nil {
+				c.PublishedRegistry, c.IDFunc = opts.PublishedRegistry, opts.IDFunc
+			}
+		}
+	}
+	p, err := NewAsyncMessageSink(primary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the sink of the primary cluster: %w", err)
+	}
+	s, err := NewAsyncMessageSink(secondary)
+	if err != nil {
+		_ = p.Close()
+		return nil, fmt.Errorf("failed to create the sink of the secondary cluster: %w", err)
+	}
+
+	ps := p.(*orderedSink)
+	sink := newFailoverSink(p, s, func(ctx context.Context) error {
+		return ready(ctx, ps.sink.client, ps.sink.Topic)
+	}, opts)
+	sink.events = substrate.NewLifecycleEmitter(opts.LifecycleEvents, "kafka-failover", primary.Topic)
+	return sink, nil
+}
+
+func newFailoverSink(primary, secondary substrate.AsyncMessageSink, probe func(context.Context) error, opts FailoverOptions) *failoverSink {
+	if opts.ErrorThreshold <= 0 {
+		opts.ErrorThreshold = defaultFailoverErrorThreshold
+	}
+	if opts.ErrorWindow <= 0 {
+		opts.ErrorWindow = defaultFailoverErrorWindow
+	}
+	if opts.ProbeInterval <= 0 {
+		opts.ProbeInterval = defaultFailoverProbeInterval
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = defaultFailoverRetryBackoff
+	}
+	return &failoverSink{
+		sinks:     [2]substrate.AsyncMessageSink{primary, secondary},
+		probe:     probe,
+		opts:      opts,
+		published: newPublishedMarker(opts.PublishedRegistry, opts.IDFunc),
+	}
+}
+
+var (
+	_ substrate.AsyncMessageSink = (*failoverSink)(nil)
+	_ ClusterReporter            = (*failoverSink)(nil)
+	_ substrate.Flushable        = (*failoverSink)(nil)
+)
+
+type failoverSink struct {
+	sinks [2]substrate.AsyncMessageSink
+	// probe checks whether the primary cluster is reachable.
+	probe func(context.Context) error
+	opts  FailoverOptions
+	// published checks whether the messages published again were written.
+	published *publishedMarker
+	// events emits the lifecycle events of the sink, if enabled.
+	events *substrate.LifecycleEmitter
+
+	mu     sync.Mutex
+	active Cluster
+	// failures holds the times of the recent failures of the active
+	// cluster.
+	failures []time.Time
+
+	flushes flush.Tracker
+}
+
+// ActiveCluster implements the ClusterReporter interface.
+func (s *failoverSink) ActiveCluster() Cluster {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active
+}
+
+func (s *failoverSink) switchTo(c Cluster) {
+	s.mu.Lock()
+	s.active = c
+	s.failures = nil
+	s.mu.Unlock()
+
+	if s.opts.OnSwitch != nil {
+		s.opts.OnSwitch(c)
+	}
+	s.events.Emit(substrate.LifecycleEvent{Type: substrate.LifecycleSwitched, Detail: c.String()})
+}
+
+// failed records a failure of the active cluster, and reports whether the
+// failures are sustained.
+func (s *failoverSink) failed(at time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recent := s.failures[:0]
+	for _, f := range s.failures {
+		if at.Sub(f) < s.opts.ErrorWindow {
+			recent = append(recent, f)
+		}
+	}
+	s.failures = append(recent, at)
+	return len(s.failures) >= s.opts.ErrorThreshold
+}
+
+func (s *failoverSink) PublishMessages(ctx context.Context, acks chan<- substrate.Message, messages <-chan substrate.Message) (err error) {
+	s.flushes.Start()
+	defer func() { s.flushes.Stop(err) }()
+
+	// pending holds the messages that have not been acknowledged yet, in
+	// the order they were published.
+	var pending []failoverMessage
+	for {
+		active := s.ActiveCluster()
+		failed, err := s.session(ctx, active, acks, messages, &pending)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err == errSwitchBack:
+			s.switchTo(PrimaryCluster)
+		case !failed:
+			return err
+		case s.failed(time.Now()):
+			s.switchTo(1 - active)
+		default:
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(s.opts.RetryBackoff):
+			}
+		}
+	}
+}
+
+// failoverMessage is a message published to a failover sink, which is written
+// if it is seen in the registry when it is about to be published again.
+type failoverMessage struct {
+	msg     substrate.Message
+	written bool
+}
+
+// session publishes messages to the active cluster until publishing fails,
+// which is reported by failed, or until the secondary cluster can switch back
+// to the primary. The pending messages are published first, except the ones
+// that were written.
+func (s *failoverSink) session(ctx context.Context, active Cluster, acks chan<- substrate.Message, messages <-chan substrate.Message, pending *[]failoverMessage) (failed bool, err error) {
+	sctx, cancel := context.WithCancel(ctx)
+	toInner := make(chan substrate.Message, cap(messages))
+	fromInner := make(chan substrate.Message, cap(acks))
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.sinks[active].PublishMessages(sctx, fromInner, toInner)
+	}()
+	exited := false
+	defer func() {
+		cancel()
+		if !exited {
+			<-errs
+		}
+	}()
+
+	var (
+		probeTicks <-chan time.Time
+		probes     = make(chan error, 1)
+		probing    bool
+		draining   bool
+	)
+	if active == SecondaryCluster {
+		ticker := time.NewTicker(s.opts.ProbeInterval)
+		defer ticker.Stop()
+		probeTicks = ticker.C
+	}
+
+	// unsent holds the pending messages that have not been sent to the sink
+	// of the active cluster, which are the last ones.
+	var unsent []substrate.Message
+	for i, fm := range *pending {
+		written, err := s.published.seen(fm.msg)
+		if err != nil {
+			return false, err
+		}
+		if written {
+			(*pending)[i].written = true
+			continue
+		}
+		unsent = append(unsent, fm.msg)
+	}
+	if err := s.ackWritten(ctx, acks, pending); err != nil {
+		return false, err
+	}
+	for {
+		if draining && len(*pending) == 0 {
+			return false, errSwitchBack
+		}
+
+		var (
+			in   <-chan substrate.Message
+			out  chan<- substrate.Message
+			next substrate.Message
+		)
+		switch {
+		case len(unsent) > 0:
+			out, next = toInner, unsent[0]
+		case !draining:
+			in = messages
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case err := <-errs:
+			exited = true
+			if err == nil {
+				err = fmt.Errorf("publishing to the %s cluster stopped", active)
+			}
+			return true, err
+		case req := <-s.flushes.Requests():
+			s.flushes.Mark(req)
+		case msg := <-in:
+			s.flushes.Submitted()
+			*pending = append(*pending, failoverMessage{msg: msg})
+			unsent = append(unsent, msg)
+		case out <- next:
+			unsent = unsent[1:]
+		case ack := <-fromInner:
+			if len(*pending) == 0 || !substrate.SameMessage(ack, (*pending)[0].msg) {
+				var expected substrate.Message
+				if len(*pending) > 0 {
+					expected = (*pending)[0].msg
+				}
+				return false, substrate.InvalidAckError{Acked: ack, Expected: expected}
+			}
+			select {
+			case <-ctx.Done():
+				return false, ctx.Err()
+			case acks <- ack:
+				s.flushes.Acked()
+			}
+			*pending = (*pending)[1:]
+			if err := s.ackWritten(ctx, acks, pending); err != nil {
+				return false, err
+			}
+		case <-probeTicks:
+			if probing || draining {
+				continue
+			}
+			probing = true
+			go func() {
+				probes <- s.probe(sctx)
+			}()
+		case err := <-probes:
+			probing = false
+			draining = err == nil
+		}
+	}
+}
+
+// ackWritten acknowledges the written messages at the head of the pending
+// messages, which are not published again.
+func (s *failoverSink) ackWritten(ctx context.Context, acks chan<- substrate.Message, pending *[]failoverMessage) error {
+	for len(*pending) > 0 && (*pending)[0].written {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case acks <- (*pending)[0].msg:
+			s.flushes.Acked()
+		}
+		*pending = (*pending)[1:]
+	}
+	return nil
+}
+
+// Flush implements the substrate.Flushable interface. Messages are waited for
+// across switches between the clusters.
+func (s *failoverSink) Flush(ctx context.Context) error {
+	return s.flushes.Flush(ctx)
+}
+
+// Close closes the sinks of both clusters.
+func (s *failoverSink) Close() (err error) {
+	for _, sink := range s.sinks {
+		err = multierror.Append(err, sink.Close()).ErrorOrNil()
+	}
+	s.events.Emit(substrate.LifecycleEvent{Type: substrate.LifecycleClosed, Err: err})
+	return err
+}
+
+// Status returns the status of the active cluster, with a problem reported
+// while publishing to the secondary cluster.
+func (s *failoverSink) Status() (*substrate.Status, error) {
+	active := s.ActiveCluster()
+	status, err := s.sinks[active].Status()
+	if err != nil {
+		return nil, err
+	}
+	if active == SecondaryCluster {
+		status.Problems = append(status.Problems, "failed over to the secondary cluster")
+	}
+	return status, nil
+}
@@ -0,0 +1,246 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/substrate"
+)
+
+var errClusterDown = errors.New("cluster down")
+
+// fakeClusterSink acknowledges every message, unless it is down, in which
+// case publishing fails as messages are published.
+type fakeClusterSink struct {
+	mu        sync.Mutex
+	down      bool
+	failures  int
+	published []string
+}
+
+func (s *fakeClusterSink) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+func (s *fakeClusterSink) isDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.down
+}
+
+func (s *fakeClusterSink) publish(msg substrate.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		s.failures++
+		return errClusterDown
+	}
+	s.published = append(s.published, string(msg.Data()))
+	return nil
+}
+
+func (s *fakeClusterSink) PublishMessages(ctx context.Context, acks chan<- substrate.Message, messages <-chan substrate.Message) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg := <-messages:
+			if err := s.publish(msg); err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case acks <- msg:
+			}
+		}
+	}
+}
+
+func (s *fakeClusterSink) Close() error {
+	return nil
+}
+
+func (s *fakeClusterSink) Status() (*substrate.Status, error) {
+	return &substrate.Status{Working: !s.isDown()}, nil
+}
+
+func (s *fakeClusterSink) state() ([]string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.published...), s.failures
+}
+
+func TestFailoverSink(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	primary, secondary := &fakeClusterSink{down: true}, &fakeClusterSink{}
+	switches := make(chan Cluster, 2)
+	sink := newFailoverSink(primary, secondary, func(context.Context) error {
+		if primary.isDown() {
+			return errClusterDown
+		}
+		return nil
+	}, FailoverOptions{
+		ErrorThreshold: 2,
+		RetryBackoff:   time.Millisecond,
+		ProbeInterval:  10 * time.Millisecond,
+		OnSwitch:       func(c Cluster) { switches <- c },
+	})
+	events := make(chan substrate.LifecycleEvent, 4)
+	sink.events = substrate.NewLifecycleEmitter(events, "kafka-failover", "t1")
+
+	msgs := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishMessages(ctx, acks, msgs)
+	}()
+
+	// The primary cluster fails twice, and the message in flight is then
+	// published to the secondary.
+	m1, m2 := &message{data: []byte("1")}, &message{data: []byte("2")}
+	msgs <- m1
+	assert.Equal(t, SecondaryCluster, <-switches)
+	assert.Equal(t, substrate.Message(m1), <-acks)
+	msgs <- m2
+	assert.Equal(t, substrate.Message(m2), <-acks)
+	assert.Equal(t, SecondaryCluster, sink.ActiveCluster())
+
+	status, err := sink.Status()
+	require.NoError(t, err)
+	assert.True(t, status.Working)
+	assert.Equal(t, []string{"failed over to the secondary cluster"}, status.Problems)
+
+	// Once the primary cluster is reachable, the sink switches back.
+	primary.setDown(false)
+	assert.Equal(t, PrimaryCluster, <-switches)
+	m3 := &message{data: []byte("3")}
+	msgs <- m3
+	assert.Equal(t, substrate.Message(m3), <-acks)
+
+	published, failures := primary.state()
+	assert.Equal(t, []string{"3"}, published)
+	assert.Equal(t, 2, failures)
+	published, _ = secondary.state()
+	assert.Equal(t, []string{"1", "2"}, published)
+
+	status, err = sink.Status()
+	require.NoError(t, err)
+	assert.Equal(t, &substrate.Status{Working: true}, status)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+
+	require.NoError(t, sink.Close())
+	for _, expected := range []substrate.LifecycleEvent{
+		{Type: substrate.LifecycleSwitched, Detail: "secondary"},
+		{Type: substrate.LifecycleSwitched, Detail: "primary"},
+		{Type: substrate.LifecycleClosed},
+	} {
+		ev := <-events
+		assert.Equal(t, expected.Type, ev.Type)
+		assert.Equal(t, expected.Detail, ev.Detail)
+	}
+}
+
+func TestFailoverSinkRetriesBelowThreshold(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	primary, secondary := &fakeClusterSink{down: true}, &fakeClusterSink{}
+	sink := newFailoverSink(primary, secondary, nil, FailoverOptions{
+		ErrorThreshold: 2,
+		ErrorWindow:    time.Hour,
+		RetryBackoff:   100 * time.Millisecond,
+	})
+
+	msgs := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	go func() {
+		_ = sink.PublishMessages(ctx, acks, msgs)
+	}()
+
+	m := &message{data: []byte("1")}
+	msgs <- m
+	// The primary cluster recovers after failing once, before publishing
+	// is retried.
+	for _, failures := primary.state(); failures == 0; _, failures = primary.state() {
+		time.Sleep(time.Millisecond)
+	}
+	primary.setDown(false)
+	assert.Equal(t, substrate.Message(m), <-acks)
+
+	assert.Equal(t, PrimaryCluster, sink.ActiveCluster())
+	published, failures := primary.state()
+	assert.Equal(t, []string{"1"}, published)
+	assert.Equal(t, 1, failures)
+	published, _ = secondary.state()
+	assert.Empty(t, published)
+}
+
+// crashingClusterSink writes the first message and marks it in the
+// registry, as the sink of a cluster does once the broker acknowledges it,
+// but fails before acknowledging it to the caller.
+type crashingClusterSink struct {
+	fakeClusterSink
+	registry substrate.PublishedRegistry
+}
+
+func (s *crashingClusterSink) PublishMessages(ctx context.Context, acks chan<- substrate.Message, messages <-chan substrate.Message) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case msg := <-messages:
+		if err := s.publish(msg); err != nil {
+			return err
+		}
+		if err := s.registry.Mark(string(msg.Data())); err != nil {
+			return err
+		}
+		s.setDown(true)
+		return errClusterDown
+	}
+}
+
+func TestFailoverSinkSkipsPublishedMessages(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	registry := substrate.NewLRUPublishedRegistry(10)
+	primary, secondary := &crashingClusterSink{registry: registry}, &fakeClusterSink{}
+	sink := newFailoverSink(primary, secondary, nil, FailoverOptions{
+		ErrorThreshold:    1,
+		RetryBackoff:      time.Millisecond,
+		PublishedRegistry: registry,
+		IDFunc:            func(msg substrate.Message) string { return string(msg.Data()) },
+	})
+
+	msgs := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	go func() {
+		_ = sink.PublishMessages(ctx, acks, msgs)
+	}()
+
+	// The message written by the primary cluster before it failed is
+	// acknowledged without being published to the secondary.
+	m1, m2 := &message{data: []byte("1")}, &message{data: []byte("2")}
+	msgs <- m1
+	assert.Equal(t, substrate.Message(m1), <-acks)
+	assert.Equal(t, SecondaryCluster, sink.ActiveCluster())
+	msgs <- m2
+	assert.Equal(t, substrate.Message(m2), <-acks)
+
+	published, _ := primary.state()
+	assert.Equal(t, []string{"1"}, published)
+	published, _ = secondary.state()
+	assert.Equal(t, []string{"2"}, published)
+}
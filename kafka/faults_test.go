@@ -0,0 +1,274 @@
+//go:build faults
+// +build faults
+
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/toxiproxy"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/testshared"
+)
+
+const (
+	// faultBrokerPort is the port the broker listens on.
+	faultBrokerPort = 9092
+	// faultProxyPort is the port of the proxy, which is advertised by the
+	// broker, so that every connection, including the broker's own, passes
+	// through the proxy.
+	faultProxyPort = 19092
+)
+
+func TestFaults(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	ks, err := runFaultServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Kill()
+
+	t.Run("Kafka Strict Ordering During Connection Resets", func(t *testing.T) {
+		ks.testStrictOrderingDuringResets(t)
+	})
+	ks.proxy.Toxics.ResetToxics()
+	if err := ks.proxy.Start(); err != nil && err != toxiproxy.ErrProxyAlreadyStarted {
+		t.Fatalf("failed to restore proxy: %s", err)
+	}
+	testshared.TestFaults(t, ks)
+}
+
+type faultServer struct {
+	*testServer
+	proxy *toxiproxy.Proxy
+}
+
+func (ks *faultServer) Proxy() *toxiproxy.Proxy {
+	return ks.proxy
+}
+
+func (ks *faultServer) Kill() error {
+	ks.proxy.Stop()
+	return ks.testServer.Kill()
+}
+
+// testStrictOrderingDuringResets publishes keyed messages with StrictOrdering
+// while the connections are slowed down and repeatedly reset, so that the
+// requests in flight at every reset are retried by sarama. The messages of
+// every key must be written in the order they were published, without
+// duplicates, and none of the acknowledged ones may be lost.
+func (ks *faultServer) testStrictOrderingDuringResets(t *testing.T) {
+	const (
+		numKeys  = 5
+		duration = 10 * time.Second
+	)
+	topic := uuid.New().String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V2_4_0_0
+	admin, err := sarama.NewClusterAdmin(ks.brokers(), cfg)
+	require.NoError(t, err)
+	require.NoError(t, admin.CreateTopic(topic, &sarama.TopicDetail{
+		NumPartitions:     6,
+		ReplicationFactor: 1,
+	}, false))
+	require.NoError(t, admin.Close())
+
+	prod, err := NewAsyncMessageSink(AsyncMessageSinkConfig{
+		Brokers:        ks.brokers(),
+		Topic:          topic,
+		Version:        "2.4.0",
+		StrictOrdering: true,
+	})
+	require.NoError(t, err)
+	defer prod.Close()
+
+	_, err = ks.proxy.Toxics.AddToxicJson(strings.NewReader(
+		`{"name": "latency", "type": "latency", "attributes": {"latency": 100, "jitter": 50}}`,
+	))
+	require.NoError(t, err)
+
+	prodCtx, prodCancel := context.WithCancel(ctx)
+	defer prodCancel()
+	prodMsgs := make(chan substrate.Message)
+	prodAcks := make(chan substrate.Message, 1024)
+	prodErrs := make(chan error, 1)
+	go func() {
+		prodErrs <- prod.PublishMessages(prodCtx, prodAcks, prodMsgs)
+	}()
+
+	var (
+		sent    int
+		acked   = make(map[string]bool)
+		seqs    [numKeys]int
+		next    substrate.Message
+		prodErr error
+		// retriedResets counts the resets with messages in flight, whose
+		// requests sarama had to retry.
+		retriedResets int
+		resets        = time.NewTicker(500 * time.Millisecond)
+		done          = time.After(duration)
+	)
+	defer resets.Stop()
+
+publish:
+	for prodErr == nil {
+		if next == nil {
+			k := sent % numKeys
+			next = &reusedBufferMessage{
+				data: []byte(fmt.Sprintf("key-%d/%d", k, seqs[k])),
+				key:  []byte(fmt.Sprintf("key-%d", k)),
+			}
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timed out publishing: %d of %d messages acknowledged", len(acked), sent)
+		case <-done:
+			break publish
+		case <-resets.C:
+			if sent > len(acked) {
+				retriedResets++
+			}
+			ks.proxy.Stop()
+			require.NoError(t, ks.proxy.Start())
+		case prodMsgs <- next:
+			seqs[sent%numKeys]++
+			sent++
+			next = nil
+		case msg := <-prodAcks:
+			acked[string(msg.Data())] = true
+		case prodErr = <-prodErrs:
+		}
+	}
+	require.NotZero(t, retriedResets, "no connection was reset with messages in flight")
+
+	// Wait for the outstanding acknowledgements, unless the sink has failed.
+	for prodErr == nil && len(acked) < sent {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("sink hung after the resets: %d of %d messages neither acknowledged nor failed", sent-len(acked), sent)
+		case msg := <-prodAcks:
+			acked[string(msg.Data())] = true
+		case prodErr = <-prodErrs:
+		}
+	}
+	if prodErr != nil {
+		t.Logf("sink surfaced error after %d of %d messages were acknowledged: %s", len(acked), sent, prodErr)
+	} else {
+		prodCancel()
+		select {
+		case err := <-prodErrs:
+			require.Equal(t, context.Canceled, err)
+		case <-time.After(30 * time.Second):
+			t.Fatal("sink did not return after being cancelled")
+		}
+	}
+	for len(prodAcks) > 0 {
+		acked[string((<-prodAcks).Data())] = true
+	}
+	t.Logf("%d of %d messages acknowledged, %d resets with messages in flight", len(acked), sent, retriedResets)
+
+	// Consume the topic without faults, checking the order of every key.
+	ks.proxy.Toxics.ResetToxics()
+	cons := ks.NewConsumer(topic, uuid.New().String())
+	defer cons.Close()
+	consCtx, consCancel := context.WithCancel(ctx)
+	defer consCancel()
+	consMsgs := make(chan substrate.Message, 1024)
+	consAcks := make(chan substrate.Message, 1024)
+	consErrs := make(chan error, 1)
+	go func() {
+		consErrs <- cons.ConsumeMessages(consCtx, consMsgs, consAcks)
+	}()
+
+	var last [numKeys]int
+	for i := range last {
+		last[i] = -1
+	}
+	missing := len(acked)
+	for missing > 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("%d acknowledged messages were lost", missing)
+		case err := <-consErrs:
+			t.Fatalf("unexpected error from consume : %s", err)
+		case msg := <-consMsgs:
+			payload := string(msg.Data())
+			var k, seq int
+			_, err := fmt.Sscanf(payload, "key-%d/%d", &k, &seq)
+			require.NoError(t, err, payload)
+			if seq <= last[k] {
+				t.Fatalf("message %s written after key-%d/%d", payload, k, last[k])
+			}
+			last[k] = seq
+			if acked[payload] {
+				missing--
+			}
+			consAcks <- msg
+		}
+	}
+}
+
+// runFaultServer runs a broker whose advertised address is a proxy. The
+// container uses the host network, as the broker must be able to reach the
+// proxy at the advertised address.
+func runFaultServer() (*faultServer, error) {
+	proxy := toxiproxy.NewProxy()
+	proxy.Name = "kafka"
+	proxy.Listen = fmt.Sprintf("127.0.0.1:%d", faultProxyPort)
+	proxy.Upstream = fmt.Sprintf("127.0.0.1:%d", faultBrokerPort)
+	if err := proxy.Start(); err != nil {
+		return nil, err
+	}
+
+	containerName := uuid.New().String()
+	cmd := exec.CommandContext(
+		context.Background(),
+		"docker",
+		"run",
+		"-d",
+		"--rm",
+		"--name", containerName,
+		"--network", "host",
+		"--env", "ADVERTISED_HOST=127.0.0.1",
+		"--env", fmt.Sprintf("ADVERTISED_PORT=%d", faultProxyPort),
+		"uwdev/docker-kafka",
+	)
+	if err := cmd.Run(); err != nil {
+		proxy.Stop()
+		return nil, err
+	}
+	ks := &faultServer{
+		testServer: &testServer{containerName, faultProxyPort},
+		proxy:      proxy,
+	}
+
+	// wait for cluster to be ready
+	deadline := time.Now().Add(time.Minute)
+	for {
+		c, err := sarama.NewConsumer(ks.brokers(), sarama.NewConfig())
+		if err == nil {
+			c.Close()
+			return ks, nil
+		}
+		if time.Now().After(deadline) {
+			ks.Kill()
+			return nil, fmt.Errorf("kafka did not start: %s", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,46 @@
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+)
+
+// headerFilter holds the accepted values of every filtered header.
+type headerFilter map[string]map[string]struct{}
+
+// newHeaderFilter returns the filter of the HeaderFilter option, or nil if it
+// is not set.
+func newHeaderFilter(c AsyncMessageSourceConfig) headerFilter {
+	if len(c.HeaderFilter) == 0 {
+		return nil
+	}
+	f := make(headerFilter, len(c.HeaderFilter))
+	for key, values := range c.HeaderFilter {
+		accepted := make(map[string]struct{}, len(values))
+		for _, v := range values {
+			accepted[v] = struct{}{}
+		}
+		f[key] = accepted
+	}
+	return f
+}
+
+// matches reports whether every filtered header is set to one of its accepted
+// values. Every message matches a nil filter.
+func (f headerFilter) matches(headers []*sarama.RecordHeader) bool {
+	for key, accepted := range f {
+		found := false
+		for _, h := range headers {
+			if string(h.Key) != key {
+				continue
+			}
+			if _, ok := accepted[string(h.Value)]; ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
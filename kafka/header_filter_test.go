@@ -0,0 +1,86 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+)
+
+func headers(kv ...string) []*sarama.RecordHeader {
+	var hs []*sarama.RecordHeader
+	for i := 0; i < len(kv); i += 2 {
+		hs = append(hs, &sarama.RecordHeader{Key: []byte(kv[i]), Value: []byte(kv[i+1])})
+	}
+	return hs
+}
+
+func TestHeaderFilter(t *testing.T) {
+	assert.Nil(t, newHeaderFilter(AsyncMessageSourceConfig{}))
+	assert.True(t, headerFilter(nil).matches(nil))
+
+	f := newHeaderFilter(AsyncMessageSourceConfig{HeaderFilter: map[string][]string{
+		"type":    {"created", "deleted"},
+		"version": {"2"},
+	}})
+	assert.True(t, f.matches(headers("type", "created", "version", "2")))
+	assert.True(t, f.matches(headers("version", "2", "other", "x", "type", "deleted")))
+	assert.False(t, f.matches(headers("type", "updated", "version", "2")))
+	assert.False(t, f.matches(headers("type", "created")))
+	assert.False(t, f.matches(nil))
+}
+
+func TestFilteredMessagesAreDropped(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	fromKafka := make(chan *consumerMessage)
+	toClient := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	sessCh := make(chan sarama.ConsumerGroupSession)
+	source := &asyncMessageSource{requests: make(chan sessionRequest)}
+
+	var filtered []int64
+	ap := &kafkaAcksProcessor{
+		toClient:    toClient,
+		fromKafka:   fromKafka,
+		acks:        acks,
+		sessCh:      sessCh,
+		rebalanceCh: make(chan struct{}),
+		requests:    source.requests,
+		filter:      newHeaderFilter(AsyncMessageSourceConfig{HeaderFilter: map[string][]string{"type": {"created"}}}),
+		onFiltered: func(msg substrate.Message) {
+			assert.Equal(t, []byte("updated"), msg.Data())
+			filtered = append(filtered, msg.(Message).Offset())
+		},
+	}
+	go func() {
+		_ = ap.run(ctx)
+	}()
+	sessCh <- &fakeSession{marked: make(map[int32]int64)}
+
+	created := &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "topic", Offset: 4, Value: []byte("created"), Headers: headers("type", "created")}}
+	fromKafka <- created
+	delivered := <-toClient
+	assert.Equal(t, created, delivered)
+
+	// The filtered message is acknowledged once the message before it is.
+	updated := &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "topic", Offset: 5, Value: []byte("updated"), Headers: headers("type", "updated")}}
+	fromKafka <- updated
+	marked, err := source.MarkedOffsets(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, marked)
+
+	acks <- delivered
+	marked, err = source.MarkedOffsets(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[int32]int64{0: 6}, marked)
+	assert.Equal(t, []int64{5}, filtered)
+	// The payload of the filtered message is released.
+	assert.Nil(t, updated.cm)
+}
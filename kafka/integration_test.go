@@ -3,6 +3,7 @@ package kafka
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"os/exec"
 	"strconv"
@@ -28,6 +29,15 @@ func TestAll(t *testing.T) {
 	t.Run("Kafka Rebalance", func(t *testing.T) {
 		k.testRebalance(t)
 	})
+	t.Run("Kafka New Partitions", func(t *testing.T) {
+		k.testNewPartitions(t)
+	})
+	t.Run("Kafka Record And Replay", func(t *testing.T) {
+		k.testRecordAndReplay(t)
+	})
+	t.Run("Kafka Export And Import Group Offsets", func(t *testing.T) {
+		k.testExportImportGroupOffsets(t)
+	})
 	testshared.TestAll(t, k)
 }
 
@@ -92,6 +102,13 @@ func (ks *testServer) testRebalance(t *testing.T) {
 	}()
 	time.Sleep(time.Second * 20) // Sleep to wait for rebalance.
 
+	// The first consumer must survive the rebalance caused by the second one joining.
+	select {
+	case err := <-c1Err:
+		t.Fatalf("first consumer stopped after rebalance: %v", err)
+	default:
+	}
+
 	for i := 5; i < 10; i++ {
 		payload := fmt.Sprintf("message-%v", i)
 		expectedMsgs = append(expectedMsgs, payload)
@@ -124,6 +141,167 @@ func (ks *testServer) testRebalance(t *testing.T) {
 	require.ElementsMatch(t, expectedMsgs, actualMsgs)
 }
 
+func (ks *testServer) testNewPartitions(t *testing.T) {
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V2_4_0_0
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*2)
+	defer cancel()
+	admin, err := sarama.NewClusterAdmin(ks.brokers(), cfg)
+	require.NoError(t, err)
+	defer admin.Close()
+
+	topic := "new-partitions-test"
+	consumerGroup := "new-partitions-consumers"
+	require.NoError(t, admin.CreateTopic(topic, &sarama.TopicDetail{
+		NumPartitions:     1,
+		ReplicationFactor: 1,
+	}, false))
+
+	// Consume a first message, so that the group has a committed offset.
+	p := substrate.NewSynchronousMessageSink(ks.NewProducer(topic))
+	require.NoError(t, p.PublishMessage(ctx, &message{data: []byte("before")}))
+	require.NoError(t, p.Close())
+
+	c1Ctx, c1Cancel := context.WithCancel(ctx)
+	c1 := substrate.NewSynchronousMessageSource(ks.NewConsumer(topic, consumerGroup))
+	require.Equal(t, context.Canceled, c1.ConsumeMessages(c1Ctx, func(context.Context, substrate.Message) error {
+		c1Cancel()
+		return nil
+	}))
+	require.NoError(t, c1.Close())
+
+	require.NoError(t, admin.CreatePartitions(topic, 2, nil, false))
+
+	var expectedMsgs []string
+	p = substrate.NewSynchronousMessageSink(ks.NewProducer(topic))
+	for i := 0; i < 10; i++ {
+		payload := fmt.Sprintf("after-%v", i)
+		expectedMsgs = append(expectedMsgs, payload)
+		require.NoError(t, p.PublishMessage(ctx, &message{data: []byte(payload)}))
+	}
+	require.NoError(t, p.Close())
+
+	// Consuming from the newest offset would skip the messages published to
+	// the new partition before the consumer joined.
+	source, err := NewAsyncMessageSource(AsyncMessageSourceConfig{
+		Brokers:            ks.brokers(),
+		ConsumerGroup:      consumerGroup,
+		Topic:              topic,
+		Offset:             OffsetNewest,
+		NewPartitionOffset: OffsetOldest,
+		Version:            "2.4.0",
+	})
+	require.NoError(t, err)
+	c2 := substrate.NewSynchronousMessageSource(source)
+	defer func() { require.NoError(t, c2.Close()) }()
+
+	var actualMsgs []string
+	c2Ctx, c2Cancel := context.WithCancel(ctx)
+	require.Equal(t, context.Canceled, c2.ConsumeMessages(c2Ctx, func(_ context.Context, msg substrate.Message) error {
+		actualMsgs = append(actualMsgs, string(msg.Data()))
+		if len(actualMsgs) == len(expectedMsgs) {
+			c2Cancel()
+		}
+		return nil
+	}))
+	require.ElementsMatch(t, expectedMsgs, actualMsgs)
+}
+
+func (ks *testServer) testRecordAndReplay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*2)
+	defer cancel()
+
+	topic := "record-and-replay-test"
+	p := substrate.NewSynchronousMessageSink(ks.NewProducer(topic))
+	var expectedMsgs []string
+	for i := 0; i < 10; i++ {
+		payload := fmt.Sprintf("message-%v", i)
+		expectedMsgs = append(expectedMsgs, payload)
+		require.NoError(t, p.PublishMessage(ctx, &message{data: []byte(payload)}))
+	}
+	require.NoError(t, p.Close())
+
+	var recording bytes.Buffer
+	c := substrate.NewSynchronousMessageSource(substrate.NewRecordingSource(ks.NewConsumer(topic, "record-and-replay-consumers"), &recording))
+	var consumedMsgs []string
+	cCtx, cCancel := context.WithCancel(ctx)
+	require.Equal(t, context.Canceled, c.ConsumeMessages(cCtx, func(_ context.Context, msg substrate.Message) error {
+		consumedMsgs = append(consumedMsgs, string(msg.Data()))
+		if len(consumedMsgs) == len(expectedMsgs) {
+			cCancel()
+		}
+		return nil
+	}))
+	require.NoError(t, c.Close())
+	require.ElementsMatch(t, expectedMsgs, consumedMsgs)
+
+	// The replayed stream is the one the consumer saw, in the same order.
+	var replayedMsgs []string
+	r := substrate.NewSynchronousMessageSource(substrate.NewReplaySource(&recording, substrate.ReplayOptions{OriginalTiming: true}))
+	require.NoError(t, r.ConsumeMessages(ctx, func(_ context.Context, msg substrate.Message) error {
+		replayedMsgs = append(replayedMsgs, string(msg.Data()))
+		return nil
+	}))
+	require.Equal(t, consumedMsgs, replayedMsgs)
+}
+
+func (ks *testServer) testExportImportGroupOffsets(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*2)
+	defer cancel()
+
+	topic := "export-import-offsets-test"
+	p := substrate.NewSynchronousMessageSink(ks.NewProducer(topic))
+	for i := 0; i < 10; i++ {
+		require.NoError(t, p.PublishMessage(ctx, &message{data: []byte(fmt.Sprintf("message-%v", i))}))
+	}
+	require.NoError(t, p.Close())
+
+	// The old group consumes about half of the messages, and commits their
+	// offsets when it is closed.
+	c1 := substrate.NewSynchronousMessageSource(ks.NewConsumer(topic, "export-consumers"))
+	var consumed int
+	c1Ctx, c1Cancel := context.WithCancel(ctx)
+	require.Equal(t, context.Canceled, c1.ConsumeMessages(c1Ctx, func(context.Context, substrate.Message) error {
+		if consumed++; consumed == 5 {
+			c1Cancel()
+		}
+		return nil
+	}))
+	require.NoError(t, c1.Close())
+
+	offsets, err := ExportGroupOffsets(ctx, ks.brokers(), "2.4.0", "export-consumers", topic)
+	require.NoError(t, err)
+	exported, ok := offsets.Offsets[0]
+	require.True(t, ok)
+	require.True(t, exported > 0 && exported < 10)
+
+	data, err := json.Marshal(offsets)
+	require.NoError(t, err)
+	var imported GroupOffsets
+	require.NoError(t, json.Unmarshal(data, &imported))
+	_, err = ImportGroupOffsets(ctx, ks.brokers(), "2.4.0", "import-consumers", &imported, false)
+	require.NoError(t, err)
+	// The offsets of the new group are not overwritten.
+	_, err = ImportGroupOffsets(ctx, ks.brokers(), "2.4.0", "import-consumers", &imported, false)
+	require.Error(t, err)
+
+	// The new group starts where the old one left off.
+	c2 := substrate.NewSynchronousMessageSource(ks.NewConsumer(topic, "import-consumers"))
+	defer func() { require.NoError(t, c2.Close()) }()
+	var offsetsConsumed []int64
+	c2Ctx, c2Cancel := context.WithCancel(ctx)
+	require.Equal(t, context.Canceled, c2.ConsumeMessages(c2Ctx, func(_ context.Context, msg substrate.Message) error {
+		offsetsConsumed = append(offsetsConsumed, msg.(Message).Offset())
+		if string(msg.Data()) == "message-9" {
+			c2Cancel()
+		}
+		return nil
+	}))
+	require.Equal(t, exported, offsetsConsumed[0])
+	require.Len(t, offsetsConsumed, int(10-exported))
+}
+
 func (ks *testServer) NewConsumer(topic string, groupID string) substrate.AsyncMessageSource {
 	s, err := NewAsyncMessageSource(AsyncMessageSourceConfig{
 		Brokers:       ks.brokers(),
@@ -149,6 +327,33 @@ func (ks *testServer) NewProducer(topic string) substrate.AsyncMessageSink {
 	return s
 }
 
+func (ks *testServer) NewConsumerWithEvents(topic string, groupID string, events chan<- substrate.LifecycleEvent) substrate.AsyncMessageSource {
+	s, err := NewAsyncMessageSource(AsyncMessageSourceConfig{
+		Brokers:         ks.brokers(),
+		ConsumerGroup:   groupID,
+		Topic:           topic,
+		Offset:          OffsetOldest,
+		Version:         "2.4.0",
+		LifecycleEvents: events,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func (ks *testServer) NewProducerWithEvents(topic string, events chan<- substrate.LifecycleEvent) substrate.AsyncMessageSink {
+	s, err := NewAsyncMessageSink(AsyncMessageSinkConfig{
+		Brokers:         ks.brokers(),
+		Topic:           topic,
+		LifecycleEvents: events,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
 func (ks *testServer) TestEnd() {}
 
 func (ks *testServer) Kill() error {
@@ -0,0 +1,65 @@
+package kafka
+
+import (
+	"os"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+const (
+	// PublishTimeHeader is the header set by the publish headers interceptor
+	// to the time a message was published, in RFC 3339 format.
+	PublishTimeHeader = "publish-time"
+	// PublishHostHeader is the header set by the publish headers interceptor
+	// to the hostname of the publisher.
+	PublishHostHeader = "publish-host"
+)
+
+var _ sarama.ProducerInterceptor = (*publishHeadersInterceptor)(nil)
+
+// NewPublishHeadersInterceptor returns a producer interceptor, for the
+// Interceptors field of the sink config, that sets the PublishTimeHeader and
+// PublishHostHeader headers of every message, unless the message already has
+// them, e.g. from the attributes of the published message. Headers require a
+// broker Version of at least 0.11.0.
+func NewPublishHeadersInterceptor() (sarama.ProducerInterceptor, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return &publishHeadersInterceptor{
+		hostname: []byte(hostname),
+		now:      time.Now,
+	}, nil
+}
+
+type publishHeadersInterceptor struct {
+	hostname []byte
+	now      func() time.Time
+}
+
+// OnSend implements the sarama.ProducerInterceptor interface.
+func (i *publishHeadersInterceptor) OnSend(msg *sarama.ProducerMessage) {
+	var hasTime, hasHost bool
+	for _, h := range msg.Headers {
+		switch string(h.Key) {
+		case PublishTimeHeader:
+			hasTime = true
+		case PublishHostHeader:
+			hasHost = true
+		}
+	}
+	if !hasTime {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{
+			Key:   []byte(PublishTimeHeader),
+			Value: []byte(i.now().UTC().Format(time.RFC3339Nano)),
+		})
+	}
+	if !hasHost {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{
+			Key:   []byte(PublishHostHeader),
+			Value: i.hostname,
+		})
+	}
+}
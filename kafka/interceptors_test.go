@@ -0,0 +1,61 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishHeadersInterceptor(t *testing.T) {
+	interceptor := &publishHeadersInterceptor{
+		hostname: []byte("host-1"),
+		now: func() time.Time {
+			return time.Date(2021, 3, 4, 5, 6, 7, 8, time.FixedZone("", 3600))
+		},
+	}
+
+	msg := &sarama.ProducerMessage{
+		Headers: []sarama.RecordHeader{{Key: []byte("trace-id"), Value: []byte("abc")}},
+	}
+	interceptor.OnSend(msg)
+	assert.Equal(t, []sarama.RecordHeader{
+		{Key: []byte("trace-id"), Value: []byte("abc")},
+		{Key: []byte(PublishTimeHeader), Value: []byte("2021-03-04T04:06:07.000000008Z")},
+		{Key: []byte(PublishHostHeader), Value: []byte("host-1")},
+	}, msg.Headers)
+
+	// Headers set from the message attributes are kept.
+	msg = &sarama.ProducerMessage{
+		Headers: []sarama.RecordHeader{{Key: []byte(PublishHostHeader), Value: []byte("host-2")}},
+	}
+	interceptor.OnSend(msg)
+	assert.Equal(t, []sarama.RecordHeader{
+		{Key: []byte(PublishHostHeader), Value: []byte("host-2")},
+		{Key: []byte(PublishTimeHeader), Value: []byte("2021-03-04T04:06:07.000000008Z")},
+	}, msg.Headers)
+}
+
+type consumerInterceptorFunc func(*sarama.ConsumerMessage)
+
+func (f consumerInterceptorFunc) OnConsume(msg *sarama.ConsumerMessage) { f(msg) }
+
+func TestSaramaConfigInterceptors(t *testing.T) {
+	producerInterceptor, err := NewPublishHeadersInterceptor()
+	require.NoError(t, err)
+	producerConf, err := (&AsyncMessageSinkConfig{
+		Topic:        "orders",
+		Interceptors: []sarama.ProducerInterceptor{producerInterceptor},
+	}).buildSaramaProducerConfig()
+	require.NoError(t, err)
+	assert.Equal(t, []sarama.ProducerInterceptor{producerInterceptor}, producerConf.Producer.Interceptors)
+
+	consumerConf, err := (&AsyncMessageSourceConfig{
+		Topic:        "orders",
+		Interceptors: []sarama.ConsumerInterceptor{consumerInterceptorFunc(func(*sarama.ConsumerMessage) {})},
+	}).buildSaramaConsumerConfig()
+	require.NoError(t, err)
+	assert.Len(t, consumerConf.Consumer.Interceptors, 1)
+}
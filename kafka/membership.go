@@ -0,0 +1,195 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// ConsumerGroup is the membership of a consumer group, as returned by
+// DescribeConsumerGroup. It marshals to JSON, so that tools can emit it
+// directly.
+type ConsumerGroup struct {
+	Group string `json:"group"`
+	// State is the state of the group reported by the coordinator, such as
+	// Stable, PreparingRebalance or Empty.
+	State string `json:"state"`
+	// Members are the active members of the group, ordered by member id.
+	Members []ConsumerGroupMember `json:"members"`
+}
+
+// ConsumerGroupMember is an active member of a consumer group, along with the
+// partitions assigned to it.
+type ConsumerGroupMember struct {
+	MemberID string `json:"member_id"`
+	ClientID string `json:"client_id"`
+	// ClientHost is the host the member connected from, as seen by the
+	// coordinator. It is empty for the assignment of a running source.
+	ClientHost string `json:"client_host,omitempty"`
+	// Assignment holds the partitions assigned to the member by topic,
+	// ordered by partition.
+	Assignment map[string][]int32 `json:"assignment"`
+}
+
+// MembershipReporter is implemented by the sources returned by
+// NewAsyncMessageSource, to report the partitions they were assigned, e.g.
+// to show which replica consumes which partitions.
+type MembershipReporter interface {
+	// Membership returns the membership of the source in the current
+	// consumer group session, or nil if there is none, e.g. while the group
+	// is rebalancing.
+	Membership() *ConsumerGroupMember
+}
+
+// DescribeConsumerGroup returns the active members of the consumer group,
+// along with their assigned partitions. Version is the version of the
+// brokers, as in the source and sink configs.
+func DescribeConsumerGroup(ctx context.Context, brokers []string, version string, group string) (*ConsumerGroup, error) {
+	conf := sarama.NewConfig()
+	if version != "" {
+		v, err := sarama.ParseKafkaVersion(version)
+		if err != nil {
+			return nil, err
+		}
+		conf.Version = v
+	}
+	admin, err := sarama.NewClusterAdmin(brokers, conf)
+	if err != nil {
+		return nil, err
+	}
+	defer admin.Close()
+
+	type result struct {
+		desc *ConsumerGroup
+		err  error
+	}
+	// The admin doesn't support contexts, so the request is abandoned
+	// when the context is done.
+	results := make(chan result, 1)
+	go func() {
+		desc, err := describeConsumerGroup(admin, group)
+		results <- result{desc, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-results:
+		return res.desc, res.err
+	}
+}
+
+func describeConsumerGroup(admin sarama.ClusterAdmin, group string) (*ConsumerGroup, error) {
+	descs, err := admin.DescribeConsumerGroups([]string{group})
+	if err != nil {
+		return nil, err
+	}
+	if len(descs) != 1 {
+		return nil, fmt.Errorf("expected the description of consumer group %s, got %d", group, len(descs))
+	}
+	desc := descs[0]
+	if desc.Err != sarama.ErrNoError {
+		return nil, desc.Err
+	}
+
+	cg := &ConsumerGroup{
+		Group:   desc.GroupId,
+		State:   desc.State,
+		Members: make([]ConsumerGroupMember, 0, len(desc.Members)),
+	}
+	for id, m := range desc.Members {
+		member := ConsumerGroupMember{
+			MemberID:   id,
+			ClientID:   m.ClientId,
+			ClientHost: m.ClientHost,
+			Assignment: make(map[string][]int32),
+		}
+		// Members have no assignment while the group is rebalancing.
+		if len(m.MemberAssignment) > 0 {
+			assignment, err := m.GetMemberAssignment()
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode the assignment of member %s: %w", id, err)
+			}
+			for topic, partitions := range assignment.Topics {
+				member.Assignment[topic] = sortedPartitions(partitions)
+			}
+		}
+		cg.Members = append(cg.Members, member)
+	}
+	sort.Slice(cg.Members, func(i, j int) bool { return cg.Members[i].MemberID < cg.Members[j].MemberID })
+	return cg, nil
+}
+
+func sortedPartitions(partitions []int32) []int32 {
+	sorted := append([]int32(nil), partitions...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+var _ MembershipReporter = (*asyncMessageSource)(nil)
+
+// Membership implements the MembershipReporter interface.
+func (ams *asyncMessageSource) Membership() *ConsumerGroupMember {
+	return ams.membership.report()
+}
+
+// membershipTracker records the membership of a source as consumer group
+// sessions start and end. A nil tracker records nothing.
+type membershipTracker struct {
+	clientID string
+
+	mu     sync.Mutex
+	member *ConsumerGroupMember
+}
+
+func newMembershipTracker(clientID string) *membershipTracker {
+	return &membershipTracker{clientID: clientID}
+}
+
+// started records the membership of a session that started.
+func (t *membershipTracker) started(sess sarama.ConsumerGroupSession) {
+	if t == nil {
+		return
+	}
+	member := &ConsumerGroupMember{
+		MemberID:   sess.MemberID(),
+		ClientID:   t.clientID,
+		Assignment: make(map[string][]int32),
+	}
+	for topic, partitions := range sess.Claims() {
+		member.Assignment[topic] = sortedPartitions(partitions)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.member = member
+}
+
+// ended drops the membership once a session ends.
+func (t *membershipTracker) ended() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.member = nil
+}
+
+func (t *membershipTracker) report() *ConsumerGroupMember {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.member == nil {
+		return nil
+	}
+	member := *t.member
+	member.Assignment = make(map[string][]int32, len(t.member.Assignment))
+	for topic, partitions := range t.member.Assignment {
+		member.Assignment[topic] = append([]int32(nil), partitions...)
+	}
+	return &member
+}
@@ -0,0 +1,87 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type membershipAdmin struct {
+	sarama.ClusterAdmin
+
+	desc *sarama.GroupDescription
+}
+
+func (a *membershipAdmin) DescribeConsumerGroups([]string) ([]*sarama.GroupDescription, error) {
+	return []*sarama.GroupDescription{a.desc}, nil
+}
+
+// encodeAssignment encodes an assignment of a single topic, as sent by the
+// coordinator, whose null user data is encoded as a length of -1.
+func encodeAssignment(topic string, partitions ...int32) []byte {
+	var buf bytes.Buffer
+	for _, v := range []interface{}{int16(0), int32(1), int16(len(topic)), []byte(topic), int32(len(partitions)), partitions, int32(-1)} {
+		_ = binary.Write(&buf, binary.BigEndian, v)
+	}
+	return buf.Bytes()
+}
+
+func TestDescribeConsumerGroup(t *testing.T) {
+	admin := &membershipAdmin{desc: &sarama.GroupDescription{
+		GroupId: "group",
+		State:   "Stable",
+		Members: map[string]*sarama.GroupMemberDescription{
+			"m2": {ClientId: "pod-2", ClientHost: "/10.0.0.2", MemberAssignment: encodeAssignment("topic", 3, 1)},
+			"m1": {ClientId: "pod-1", ClientHost: "/10.0.0.1", MemberAssignment: encodeAssignment("topic", 0, 2)},
+		},
+	}}
+
+	cg, err := describeConsumerGroup(admin, "group")
+	require.NoError(t, err)
+	assert.Equal(t, &ConsumerGroup{
+		Group: "group",
+		State: "Stable",
+		Members: []ConsumerGroupMember{
+			{MemberID: "m1", ClientID: "pod-1", ClientHost: "/10.0.0.1", Assignment: map[string][]int32{"topic": {0, 2}}},
+			{MemberID: "m2", ClientID: "pod-2", ClientHost: "/10.0.0.2", Assignment: map[string][]int32{"topic": {1, 3}}},
+		},
+	}, cg)
+
+	b, err := json.Marshal(cg.Members[0])
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"member_id":"m1","client_id":"pod-1","client_host":"/10.0.0.1","assignment":{"topic":[0,2]}}`, string(b))
+}
+
+func TestDescribeConsumerGroupError(t *testing.T) {
+	admin := &membershipAdmin{desc: &sarama.GroupDescription{Err: sarama.ErrGroupAuthorizationFailed}}
+	_, err := describeConsumerGroup(admin, "group")
+	assert.Equal(t, sarama.ErrGroupAuthorizationFailed, err)
+}
+
+type memberSession struct {
+	*claimsSession
+}
+
+func (s memberSession) MemberID() string {
+	return "m1"
+}
+
+func TestMembershipTracker(t *testing.T) {
+	tracker := newMembershipTracker("pod-1")
+	assert.Nil(t, tracker.report())
+
+	tracker.started(memberSession{newClaimsSession(2, 0)})
+	assert.Equal(t, &ConsumerGroupMember{
+		MemberID:   "m1",
+		ClientID:   "pod-1",
+		Assignment: map[string][]int32{"topic": {0, 2}},
+	}, tracker.report())
+
+	tracker.ended()
+	assert.Nil(t, tracker.report())
+}
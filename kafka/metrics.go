@@ -0,0 +1,40 @@
+package kafka
+
+import (
+	metrics "github.com/rcrowley/go-metrics"
+
+	"github.com/uw-labs/substrate/internal/helper"
+)
+
+// MetricsReporter is implemented by the sources and sinks returned by
+// NewAsyncMessageSource and NewAsyncMessageSink, to expose the metrics sarama
+// collects, such as request latencies, batch sizes and record send rates. The
+// instrumented package provides a prometheus collector for them.
+type MetricsReporter interface {
+	// Metrics returns the registry sarama records its metrics in.
+	Metrics() metrics.Registry
+}
+
+var (
+	_ MetricsReporter = (*asyncMessageSource)(nil)
+	_ MetricsReporter = (*orderedSink)(nil)
+)
+
+// orderedSink is the sink wrapped to acknowledge messages in order, which
+// still exposes the metrics of the sink.
+type orderedSink struct {
+	*helper.AckOrderingSink
+	sink *asyncMessageSink
+	// publishing is set while PublishMessages runs.
+	publishing int32
+}
+
+// Metrics implements the MetricsReporter interface.
+func (s *orderedSink) Metrics() metrics.Registry {
+	return s.sink.client.Config().MetricRegistry
+}
+
+// Metrics implements the MetricsReporter interface.
+func (ams *asyncMessageSource) Metrics() metrics.Registry {
+	return ams.client.Config().MetricRegistry
+}
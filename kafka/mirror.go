@@ -0,0 +1,129 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/unwrap"
+)
+
+// ErrNoSourcePartition is returned by SourcePartition for messages that were
+// not consumed from kafka.
+var ErrNoSourcePartition = errors.New("message has no source partition")
+
+// partitionedMessage is implemented by the messages consumed from kafka, and
+// by the messages returned by the Transform of MirrorPipeOptions.
+type partitionedMessage interface {
+	Partition() int32
+}
+
+// SourcePartition is a PartitionFunc that produces the messages consumed from
+// kafka sources to the partition they were consumed from, e.g. to mirror a
+// topic to another one with the same number of partitions. It returns
+// ErrNoSourcePartition for other messages.
+func SourcePartition(msg substrate.Message) (int32, error) {
+	pm, ok := msg.(partitionedMessage)
+	if !ok {
+		return 0, ErrNoSourcePartition
+	}
+	return pm.Partition(), nil
+}
+
+// NewMirrorSink returns a sink producing the messages consumed from the topic
+// of sourceConf to the partition they were consumed from, rather than hashing
+// their key, so that the consumers of the topic of sinkConf see the same
+// partitions. It returns an error if the topics don't have the same number of
+// partitions. The messages are to be piped from the source with
+// MirrorPipeOptions.
+func NewMirrorSink(sourceConf AsyncMessageSourceConfig, sinkConf AsyncMessageSinkConfig) (substrate.AsyncMessageSink, error) {
+	if err := sourceConf.applyRegisteredDefaults(); err != nil {
+		return nil, err
+	}
+	sourceConf.resolveTopic()
+	conf, err := sourceConf.buildSaramaConsumerConfig()
+	if err != nil {
+		return nil, err
+	}
+	sourceClient, err := newClient(sourceConf.ClientPool, "source", sourceConf.Brokers, conf, sourceConf.MetricRegistry, sourceConf.Interceptors, sourceConf.SASL)
+	if err != nil {
+		return nil, err
+	}
+	defer sourceClient.Close()
+
+	sinkConf.PartitionFunc = SourcePartition
+	sink, err := NewAsyncMessageSink(sinkConf)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPartitionCounts(sourceClient, sourceConf.Topic, sink.(*orderedSink).sink.client, sink.(*orderedSink).sink.Topic); err != nil {
+		_ = sink.Close()
+		return nil, err
+	}
+	return sink, nil
+}
+
+// checkPartitionCounts returns an error unless the topics have the same
+// number of partitions.
+func checkPartitionCounts(sourceClient sarama.Client, sourceTopic string, sinkClient sarama.Client, sinkTopic string) error {
+	sourcePartitions, err := sourceClient.Partitions(sourceTopic)
+	if err != nil {
+		return err
+	}
+	sinkPartitions, err := sinkClient.Partitions(sinkTopic)
+	if err != nil {
+		return err
+	}
+	if len(sourcePartitions) != len(sinkPartitions) {
+		return fmt.Errorf("mirroring partitions requires topics with the same number of partitions, but %s has %d partitions and %s has %d",
+			sourceTopic, len(sourcePartitions), sinkTopic, len(sinkPartitions))
+	}
+	return nil
+}
+
+// MirrorPipeOptions returns the options of a Pipe from a kafka source to a
+// sink returned by NewMirrorSink. The messages returned by the Transform of
+// opts, if any, are produced to the partition of the message they were
+// transformed from. Their key, as given to the KeyFunc of the sink, is the key
+// of the transformed message if it is a KeyedMessage, or its payload.
+func MirrorPipeOptions(opts substrate.PipeOptions) substrate.PipeOptions {
+	transform := opts.Transform
+	if transform == nil {
+		return opts
+	}
+	opts.Transform = func(msg substrate.Message) (substrate.Message, error) {
+		published, err := transform(msg)
+		if err != nil || published == nil {
+			return published, err
+		}
+		partition, err := SourcePartition(unwrap.Unwrap(msg))
+		if err != nil {
+			return nil, err
+		}
+		return &mirroredMessage{Message: published, partition: partition}, nil
+	}
+	return opts
+}
+
+// mirroredMessage is a transformed message, keeping the partition of the
+// message it was transformed from.
+type mirroredMessage struct {
+	substrate.Message
+	partition int32
+}
+
+func (m *mirroredMessage) Partition() int32 {
+	return m.partition
+}
+
+func (m *mirroredMessage) Key() []byte {
+	if km, ok := unwrap.Unwrap(m.Message).(substrate.KeyedMessage); ok {
+		return km.Key()
+	}
+	return m.Message.Data()
+}
+
+func (m *mirroredMessage) Attributes() map[string]string {
+	return unwrap.Attributes(m.Message)
+}
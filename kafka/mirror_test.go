@@ -0,0 +1,93 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/substrate"
+)
+
+type plainMessage []byte
+
+func (m plainMessage) Data() []byte { return m }
+
+func TestPartitionFunc(t *testing.T) {
+	producer := newFakeProducer()
+	sink := &asyncMessageSink{Topic: "t1", partitionFunc: SourcePartition}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	messages := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.doPublishMessages(ctx, producer, make(chan substrate.Message), messages)
+	}()
+
+	messages <- &consumerMessage{cm: &sarama.ConsumerMessage{Partition: 3, Key: []byte("key"), Value: []byte("data")}}
+	pm := <-producer.input
+	assert.Equal(t, int32(3), pm.Partition)
+	assert.Equal(t, sarama.ByteEncoder("key"), pm.Key)
+
+	// Messages without a partition terminate publishing.
+	messages <- plainMessage("data")
+	assert.Equal(t, ErrNoSourcePartition, <-errs)
+}
+
+func TestMirrorPipeOptions(t *testing.T) {
+	consumed := &consumerMessage{cm: &sarama.ConsumerMessage{Partition: 3, Value: []byte("data")}}
+
+	opts := MirrorPipeOptions(substrate.PipeOptions{})
+	assert.Nil(t, opts.Transform)
+
+	opts = MirrorPipeOptions(substrate.PipeOptions{
+		Transform: func(msg substrate.Message) (substrate.Message, error) {
+			if string(msg.Data()) == "drop" {
+				return nil, nil
+			}
+			return &reusedBufferMessage{data: []byte("transformed"), key: []byte("key")}, nil
+		},
+	})
+	published, err := opts.Transform(consumed)
+	require.NoError(t, err)
+	partition, err := SourcePartition(published)
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), partition)
+	assert.Equal(t, "transformed", string(published.Data()))
+	assert.Equal(t, "key", string(published.(substrate.KeyedMessage).Key()))
+
+	published, err = opts.Transform(&consumerMessage{cm: &sarama.ConsumerMessage{Value: []byte("drop")}})
+	require.NoError(t, err)
+	assert.Nil(t, published)
+
+	_, err = opts.Transform(plainMessage("data"))
+	assert.Equal(t, ErrNoSourcePartition, err)
+}
+
+// topicsClient serves the partitions of topics.
+type topicsClient struct {
+	sarama.Client
+
+	partitions map[string]int
+}
+
+func (c *topicsClient) Partitions(topic string) ([]int32, error) {
+	n, ok := c.partitions[topic]
+	if !ok {
+		return nil, sarama.ErrUnknownTopicOrPartition
+	}
+	return make([]int32, n), nil
+}
+
+func TestCheckPartitionCounts(t *testing.T) {
+	source := &topicsClient{partitions: map[string]int{"orders": 12}}
+	sink := &topicsClient{partitions: map[string]int{"orders-mirror": 12, "orders-small": 6}}
+
+	assert.NoError(t, checkPartitionCounts(source, "orders", sink, "orders-mirror"))
+	assert.EqualError(t, checkPartitionCounts(source, "orders", sink, "orders-small"),
+		"mirroring partitions requires topics with the same number of partitions, but orders has 12 partitions and orders-small has 6")
+	assert.Equal(t, sarama.ErrUnknownTopicOrPartition, checkPartitionCounts(source, "orders", sink, "missing"))
+}
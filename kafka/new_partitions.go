@@ -0,0 +1,71 @@
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+)
+
+// newPartitions sets the initial offset of the partitions without a committed
+// offset, when the consumer group has committed offsets for other partitions
+// of the topic.
+type newPartitions struct {
+	offset   int64
+	group    string
+	newAdmin func(sarama.Client) (sarama.ClusterAdmin, error)
+}
+
+func newNewPartitions(c AsyncMessageSourceConfig) *newPartitions {
+	if c.NewPartitionOffset == 0 {
+		return nil
+	}
+	return &newPartitions{
+		offset:   c.NewPartitionOffset,
+		group:    c.ConsumerGroup,
+		newAdmin: sarama.NewClusterAdminFromClient,
+	}
+}
+
+// setOffsets sets the offsets of the claimed partitions that have no committed
+// offset. The offsets are marked rather than reset, as sarama only resets
+// offsets backwards.
+func (n *newPartitions) setOffsets(client sarama.Client, topic string, sess sarama.ConsumerGroupSession) error {
+	if n == nil || len(sess.Claims()[topic]) == 0 {
+		return nil
+	}
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return err
+	}
+	// The admin is not closed, as that would close the shared client.
+	admin, err := n.newAdmin(client)
+	if err != nil {
+		return err
+	}
+	r := offsetResetter{client: client, admin: admin, group: n.group, topic: topic}
+	committed, err := r.committedOffsets(partitions)
+	if err != nil {
+		return err
+	}
+
+	groupCommitted := false
+	for _, offset := range committed {
+		if offset >= 0 {
+			groupCommitted = true
+			break
+		}
+	}
+	if !groupCommitted {
+		// The consumer group is new, so the initial offset applies.
+		return nil
+	}
+	for _, partition := range sess.Claims()[topic] {
+		if committed[partition] >= 0 {
+			continue
+		}
+		offset, err := client.GetOffset(topic, partition, n.offset)
+		if err != nil {
+			return err
+		}
+		sess.MarkOffset(topic, partition, offset, "")
+	}
+	return nil
+}
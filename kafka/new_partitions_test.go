@@ -0,0 +1,43 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPartitionsSetOffsets(t *testing.T) {
+	// The topic grew from two to four partitions.
+	client := &resetClient{
+		config:     sarama.NewConfig(),
+		partitions: []int32{0, 1, 2, 3},
+		offsets: map[int64]map[int32]int64{
+			sarama.OffsetOldest: {0: 0, 1: 0, 2: 4, 3: 0},
+			sarama.OffsetNewest: {0: 10, 1: 10, 2: 9, 3: 9},
+		},
+	}
+	admin := &resetAdmin{committed: map[int32]int64{0: 8, 1: 7}}
+	n := newNewPartitions(AsyncMessageSourceConfig{ConsumerGroup: "group", Offset: OffsetNewest, NewPartitionOffset: OffsetOldest})
+	n.newAdmin = func(sarama.Client) (sarama.ClusterAdmin, error) { return admin, nil }
+
+	sess := newClaimsSession(1, 2, 3)
+	require.NoError(t, n.setOffsets(client, "topic", sess))
+	assert.Equal(t, map[int32]int64{2: 4, 3: 0}, sess.marked)
+
+	// A new consumer group uses the initial offset for all the partitions.
+	admin.committed = nil
+	sess = newClaimsSession(0, 1, 2, 3)
+	require.NoError(t, n.setOffsets(client, "topic", sess))
+	assert.Empty(t, sess.marked)
+
+	assert.Nil(t, newNewPartitions(AsyncMessageSourceConfig{}))
+	_, err := NewAsyncMessageSource(AsyncMessageSourceConfig{
+		Brokers:            []string{"localhost:9092"},
+		Topic:              "topic",
+		ConsumerGroup:      "group",
+		NewPartitionOffset: 5,
+	})
+	assert.EqualError(t, err, "kafka: AsyncMessageSourceConfig.NewPartitionOffset must be either OffsetOldest or OffsetNewest")
+}
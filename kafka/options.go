@@ -0,0 +1,437 @@
+package kafka
+
+import (
+	"crypto/tls"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/options"
+)
+
+// Option is a functional option of a sink or a source, an alternative to
+// setting the fields of their config structs, see NewSink and NewSource.
+// Options shared by sinks and sources, such as WithBrokers, can be given to
+// either. Options are order-independent: an option conflicts with itself, and
+// with options setting the same fields, such as WithKeyFunc and
+// WithPartitionFunc, unless it is given to Overrides. A nil Option is ignored,
+// so that options can be chosen conditionally.
+type Option func(*settings)
+
+type settings []options.Setting
+
+func (s *settings) add(opts []Option) {
+	for _, opt := range opts {
+		if opt != nil {
+			opt(s)
+		}
+	}
+}
+
+// setting returns an option setting the group of fields of a sink config with
+// sink, and of a source config with source, either of which is nil if the
+// option doesn't apply to it.
+func setting(option, group string, sink func(*AsyncMessageSinkConfig), source func(*AsyncMessageSourceConfig)) Option {
+	return func(s *settings) {
+		*s = append(*s, options.Setting{
+			Option: option,
+			Group:  group,
+			Apply: func(conf interface{}) bool {
+				switch c := conf.(type) {
+				case *AsyncMessageSinkConfig:
+					if sink != nil {
+						sink(c)
+						return true
+					}
+				case *AsyncMessageSourceConfig:
+					if source != nil {
+						source(c)
+						return true
+					}
+				}
+				return false
+			},
+		})
+	}
+}
+
+// Overrides returns an option giving precedence to opts over the other
+// options setting the same fields, e.g. for the settings of an environment
+// on top of the ones shared by every environment:
+//
+//      opts := []kafka.Option{kafka.WithBrokers("localhost:9092"), kafka.WithTopic("invoices")}
+//      if env == "production" {
+//          opts = append(opts, kafka.Overrides(kafka.WithBrokers(brokers...), kafka.WithTLS(tlsConfig)))
+//      }
+//
+// The options given to Overrides still conflict with each other.
+func Overrides(opts ...Option) Option {
+	return func(s *settings) {
+		var overrides settings
+		overrides.add(opts)
+		for i := range overrides {
+			overrides[i].Override = true
+		}
+		*s = append(*s, overrides...)
+	}
+}
+
+// NewSinkConfig returns the config of a sink set by opts, e.g. to set the
+// fields that have no option before calling NewAsyncMessageSink. It returns an
+// error listing the options that conflict, or are not options of a sink.
+func NewSinkConfig(opts ...Option) (AsyncMessageSinkConfig, error) {
+	var s settings
+	s.add(opts)
+	var c AsyncMessageSinkConfig
+	err := options.Resolve("kafka", &c, s)
+	return c, err
+}
+
+// NewSourceConfig returns the config of a source set by opts, e.g. to set the
+// fields that have no option before calling NewAsyncMessageSource. It returns
+// an error listing the options that conflict, or are not options of a source.
+func NewSourceConfig(opts ...Option) (AsyncMessageSourceConfig, error) {
+	var s settings
+	s.add(opts)
+	var c AsyncMessageSourceConfig
+	err := options.Resolve("kafka", &c, s)
+	return c, err
+}
+
+// NewSink returns a new sink configured by opts, see NewAsyncMessageSink.
+func NewSink(opts ...Option) (substrate.AsyncMessageSink, error) {
+	c, err := NewSinkConfig(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewAsyncMessageSink(c)
+}
+
+// NewSource returns a new source configured by opts, see
+// NewAsyncMessageSource.
+func NewSource(opts ...Option) (substrate.AsyncMessageSource, error) {
+	c, err := NewSourceConfig(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewAsyncMessageSource(c)
+}
+
+// WithBrokers sets the Brokers of a sink or a source.
+func WithBrokers(brokers ...string) Option {
+	return setting("WithBrokers", "Brokers",
+		func(c *AsyncMessageSinkConfig) { c.Brokers = brokers },
+		func(c *AsyncMessageSourceConfig) { c.Brokers = brokers },
+	)
+}
+
+// WithTopic sets the Topic of a sink or a source.
+func WithTopic(topic string) Option {
+	return setting("WithTopic", "Topic",
+		func(c *AsyncMessageSinkConfig) { c.Topic = topic },
+		func(c *AsyncMessageSourceConfig) { c.Topic = topic },
+	)
+}
+
+// WithNamespace sets the Namespace of a sink or a source.
+func WithNamespace(namespace string) Option {
+	return setting("WithNamespace", "Namespace",
+		func(c *AsyncMessageSinkConfig) { c.Namespace = namespace },
+		func(c *AsyncMessageSourceConfig) { c.Namespace = namespace },
+	)
+}
+
+// WithVersion sets the kafka Version of a sink or a source.
+func WithVersion(version string) Option {
+	return setting("WithVersion", "Version",
+		func(c *AsyncMessageSinkConfig) { c.Version = version },
+		func(c *AsyncMessageSourceConfig) { c.Version = version },
+	)
+}
+
+// WithClientID sets the ClientID of a sink or a source.
+func WithClientID(id string) Option {
+	return setting("WithClientID", "ClientID",
+		func(c *AsyncMessageSinkConfig) { c.ClientID = id },
+		func(c *AsyncMessageSourceConfig) { c.ClientID = id },
+	)
+}
+
+// WithTLS sets the TLS config of a sink or a source.
+func WithTLS(cfg *tls.Config) Option {
+	return setting("WithTLS", "TLS",
+		func(c *AsyncMessageSinkConfig) { c.TLS = cfg },
+		func(c *AsyncMessageSourceConfig) { c.TLS = cfg },
+	)
+}
+
+// WithSASL sets the SASL config of a sink or a source.
+func WithSASL(cfg *SASLConfig) Option {
+	return setting("WithSASL", "SASL",
+		func(c *AsyncMessageSinkConfig) { c.SASL = cfg },
+		func(c *AsyncMessageSourceConfig) { c.SASL = cfg },
+	)
+}
+
+// WithMaxMessageBytes sets the MaxMessageBytes of a sink or a source.
+func WithMaxMessageBytes(n int) Option {
+	return setting("WithMaxMessageBytes", "MaxMessageBytes",
+		func(c *AsyncMessageSinkConfig) { c.MaxMessageBytes = n },
+		func(c *AsyncMessageSourceConfig) { c.MaxMessageBytes = n },
+	)
+}
+
+// WithPayloadTransform sets the PayloadTransform of a sink or a source, and
+// the number of TransformWorkers.
+func WithPayloadTransform(transform func([]byte) ([]byte, error), workers int) Option {
+	return setting("WithPayloadTransform", "PayloadTransform",
+		func(c *AsyncMessageSinkConfig) { c.PayloadTransform, c.TransformWorkers = transform, workers },
+		func(c *AsyncMessageSourceConfig) { c.PayloadTransform, c.TransformWorkers = transform, workers },
+	)
+}
+
+// WithStartupChecks sets StartupChecks on a sink or a source.
+func WithStartupChecks() Option {
+	return setting("WithStartupChecks", "StartupChecks",
+		func(c *AsyncMessageSinkConfig) { c.StartupChecks = true },
+		func(c *AsyncMessageSourceConfig) { c.StartupChecks = true },
+	)
+}
+
+// WithMetricRegistry sets the MetricRegistry of a sink or a source.
+func WithMetricRegistry(r metrics.Registry) Option {
+	return setting("WithMetricRegistry", "MetricRegistry",
+		func(c *AsyncMessageSinkConfig) { c.MetricRegistry = r },
+		func(c *AsyncMessageSourceConfig) { c.MetricRegistry = r },
+	)
+}
+
+// WithGauges sets the Gauges of a sink or a source.
+func WithGauges(g substrate.Gauges) Option {
+	return setting("WithGauges", "Gauges",
+		func(c *AsyncMessageSinkConfig) { c.Gauges = g },
+		func(c *AsyncMessageSourceConfig) { c.Gauges = g },
+	)
+}
+
+// WithLifecycleEvents sets the LifecycleEvents channel of a sink or a source.
+func WithLifecycleEvents(events chan<- substrate.LifecycleEvent) Option {
+	return setting("WithLifecycleEvents", "LifecycleEvents",
+		func(c *AsyncMessageSinkConfig) { c.LifecycleEvents = events },
+		func(c *AsyncMessageSourceConfig) { c.LifecycleEvents = events },
+	)
+}
+
+// WithClientPool sets the ClientPool of a sink or a source.
+func WithClientPool(p *ClientPool) Option {
+	return setting("WithClientPool", "ClientPool",
+		func(c *AsyncMessageSinkConfig) { c.ClientPool = p },
+		func(c *AsyncMessageSourceConfig) { c.ClientPool = p },
+	)
+}
+
+// WithRegisteredDefaults sets UseRegisteredDefaults on a sink or a source.
+func WithRegisteredDefaults() Option {
+	return setting("WithRegisteredDefaults", "UseRegisteredDefaults",
+		func(c *AsyncMessageSinkConfig) { c.UseRegisteredDefaults = true },
+		func(c *AsyncMessageSourceConfig) { c.UseRegisteredDefaults = true },
+	)
+}
+
+// WithDebug sets Debug on a sink or a source.
+func WithDebug() Option {
+	return setting("WithDebug", "Debug",
+		func(c *AsyncMessageSinkConfig) { c.Debug = true },
+		func(c *AsyncMessageSourceConfig) { c.Debug = true },
+	)
+}
+
+// WithKeyFunc sets the KeyFunc of a sink. It conflicts with
+// WithPartitionFunc, as the key would not choose the partition.
+func WithKeyFunc(f func(substrate.Message) []byte) Option {
+	return setting("WithKeyFunc", "partitioning",
+		func(c *AsyncMessageSinkConfig) { c.KeyFunc = f },
+		nil,
+	)
+}
+
+// WithPartitionFunc sets the PartitionFunc of a sink. It conflicts with
+// WithKeyFunc.
+func WithPartitionFunc(f func(substrate.Message) (int32, error)) Option {
+	return setting("WithPartitionFunc", "partitioning",
+		func(c *AsyncMessageSinkConfig) { c.PartitionFunc = f },
+		nil,
+	)
+}
+
+// WithStrictOrdering sets StrictOrdering on a sink. It conflicts with
+// WithProduceRetries.
+func WithStrictOrdering() Option {
+	return setting("WithStrictOrdering", "ordering",
+		func(c *AsyncMessageSinkConfig) { c.StrictOrdering = true },
+		nil,
+	)
+}
+
+// WithProduceRetries sets RetryProduceErrors on a sink, along with the
+// ProduceRetryAttempts and ProduceRetryBackoff, which default when zero. It
+// conflicts with WithStrictOrdering, as retried messages are written out of
+// order.
+func WithProduceRetries(attempts int, backoff time.Duration) Option {
+	return setting("WithProduceRetries", "ordering",
+		func(c *AsyncMessageSinkConfig) {
+			c.RetryProduceErrors = true
+			c.ProduceRetryAttempts, c.ProduceRetryBackoff = attempts, backoff
+		},
+		nil,
+	)
+}
+
+// WithFlush sets the FlushMessages and FlushFrequency of a sink.
+func WithFlush(messages int, frequency time.Duration) Option {
+	return setting("WithFlush", "Flush",
+		func(c *AsyncMessageSinkConfig) { c.FlushMessages, c.FlushFrequency = messages, frequency },
+		nil,
+	)
+}
+
+// WithPerMessageTimeout sets the PerMessageTimeout of a sink.
+func WithPerMessageTimeout(d time.Duration) Option {
+	return setting("WithPerMessageTimeout", "PerMessageTimeout",
+		func(c *AsyncMessageSinkConfig) { c.PerMessageTimeout = d },
+		nil,
+	)
+}
+
+// WithOnError sets the OnError handler of a sink.
+func WithOnError(h substrate.MessageErrorHandler) Option {
+	return setting("WithOnError", "OnError",
+		func(c *AsyncMessageSinkConfig) { c.OnError = h },
+		nil,
+	)
+}
+
+// WithThrottling sets the OnThrottled callback of a sink, which may be nil,
+// and AdaptToQuota.
+func WithThrottling(onThrottled func(time.Duration), adaptToQuota bool) Option {
+	return setting("WithThrottling", "Throttling",
+		func(c *AsyncMessageSinkConfig) { c.OnThrottled, c.AdaptToQuota = onThrottled, adaptToQuota },
+		nil,
+	)
+}
+
+// WithCopyOnPublish sets CopyOnPublish on a sink.
+func WithCopyOnPublish() Option {
+	return setting("WithCopyOnPublish", "CopyOnPublish",
+		func(c *AsyncMessageSinkConfig) { c.CopyOnPublish = true },
+		nil,
+	)
+}
+
+// WithSharedProducer sets SharedProducer on a sink.
+func WithSharedProducer() Option {
+	return setting("WithSharedProducer", "SharedProducer",
+		func(c *AsyncMessageSinkConfig) { c.SharedProducer = true },
+		nil,
+	)
+}
+
+// WithOnAck sets the OnAck callback of a sink.
+func WithOnAck(f func(ProduceConfirmation)) Option {
+	return setting("WithOnAck", "OnAck",
+		func(c *AsyncMessageSinkConfig) { c.OnAck = f },
+		nil,
+	)
+}
+
+// WithConsumerGroup sets the ConsumerGroup of a source.
+func WithConsumerGroup(group string) Option {
+	return setting("WithConsumerGroup", "ConsumerGroup",
+		nil,
+		func(c *AsyncMessageSourceConfig) { c.ConsumerGroup = group },
+	)
+}
+
+// WithOffset sets the Offset a source starts from, such as OffsetOldest. It
+// conflicts with WithStartTime.
+func WithOffset(offset int64) Option {
+	return setting("WithOffset", "start",
+		nil,
+		func(c *AsyncMessageSourceConfig) { c.Offset = offset },
+	)
+}
+
+// WithStartTime sets the StartTime of a source. It conflicts with
+// WithOffset, as the start time takes precedence over the offset.
+func WithStartTime(t time.Time) Option {
+	return setting("WithStartTime", "start",
+		nil,
+		func(c *AsyncMessageSourceConfig) { c.StartTime = t },
+	)
+}
+
+// WithRackID sets the RackID of a source.
+func WithRackID(id string) Option {
+	return setting("WithRackID", "RackID",
+		nil,
+		func(c *AsyncMessageSourceConfig) { c.RackID = id },
+	)
+}
+
+// WithSessionTimeout sets the SessionTimeout of a source.
+func WithSessionTimeout(d time.Duration) Option {
+	return setting("WithSessionTimeout", "SessionTimeout",
+		nil,
+		func(c *AsyncMessageSourceConfig) { c.SessionTimeout = d },
+	)
+}
+
+// WithMetadataRefreshFrequency sets the MetadataRefreshFrequency of a source.
+func WithMetadataRefreshFrequency(d time.Duration) Option {
+	return setting("WithMetadataRefreshFrequency", "MetadataRefreshFrequency",
+		nil,
+		func(c *AsyncMessageSourceConfig) { c.MetadataRefreshFrequency = d },
+	)
+}
+
+// WithMaxInFlight sets the MaxInFlight of a source. It conflicts with
+// WithAdaptiveWindow.
+func WithMaxInFlight(n int) Option {
+	return setting("WithMaxInFlight", "window",
+		nil,
+		func(c *AsyncMessageSourceConfig) { c.MaxInFlight = n },
+	)
+}
+
+// WithAdaptiveWindow sets the AdaptiveWindow of a source. It conflicts with
+// WithMaxInFlight.
+func WithAdaptiveWindow(w *substrate.AdaptiveWindow) Option {
+	return setting("WithAdaptiveWindow", "window",
+		nil,
+		func(c *AsyncMessageSourceConfig) { c.AdaptiveWindow = w },
+	)
+}
+
+// WithReadAhead sets the ReadAhead of a source.
+func WithReadAhead(n int) Option {
+	return setting("WithReadAhead", "ReadAhead",
+		nil,
+		func(c *AsyncMessageSourceConfig) { c.ReadAhead = n },
+	)
+}
+
+// WithExpectedTimestampType sets the ExpectedTimestampType of a source.
+func WithExpectedTimestampType(t TimestampType) Option {
+	return setting("WithExpectedTimestampType", "ExpectedTimestampType",
+		nil,
+		func(c *AsyncMessageSourceConfig) { c.ExpectedTimestampType = t },
+	)
+}
+
+// WithOnNack sets the OnNack handler of a source.
+func WithOnNack(h substrate.MessageErrorHandler) Option {
+	return setting("WithOnNack", "OnNack",
+		nil,
+		func(c *AsyncMessageSourceConfig) { c.OnNack = h },
+	)
+}
@@ -0,0 +1,139 @@
+package kafka
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/substrate"
+)
+
+func TestNewSinkConfig(t *testing.T) {
+	tlsConfig := &tls.Config{ServerName: "kafka"}
+	c, err := NewSinkConfig(
+		WithTLS(tlsConfig),
+		WithTopic("invoices"),
+		nil,
+		WithBrokers("b1:9092", "b2:9092"),
+		WithVersion("2.4.0"),
+		WithProduceRetries(3, time.Second),
+		WithKeyFunc(func(substrate.Message) []byte { return []byte("key") }),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b1:9092", "b2:9092"}, c.Brokers)
+	assert.Equal(t, "invoices", c.Topic)
+	assert.Equal(t, "2.4.0", c.Version)
+	assert.Equal(t, tlsConfig, c.TLS)
+	assert.True(t, c.RetryProduceErrors)
+	assert.Equal(t, 3, c.ProduceRetryAttempts)
+	assert.Equal(t, time.Second, c.ProduceRetryBackoff)
+	assert.Equal(t, []byte("key"), c.KeyFunc(nil))
+	assert.Nil(t, c.PartitionFunc)
+}
+
+func TestNewSourceConfig(t *testing.T) {
+	c, err := NewSourceConfig(
+		WithBrokers("b1:9092"),
+		WithTopic("invoices"),
+		WithConsumerGroup("billing"),
+		WithOffset(OffsetOldest),
+		WithMaxInFlight(100),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, AsyncMessageSourceConfig{
+		Brokers:       []string{"b1:9092"},
+		Topic:         "invoices",
+		ConsumerGroup: "billing",
+		Offset:        OffsetOldest,
+		MaxInFlight:   100,
+	}, c)
+}
+
+func TestOptionsOverrides(t *testing.T) {
+	base := []Option{
+		WithBrokers("localhost:9092"),
+		WithTopic("invoices"),
+		WithKeyFunc(func(substrate.Message) []byte { return nil }),
+	}
+	c, err := NewSinkConfig(append(base, Overrides(
+		WithBrokers("b1:9092"),
+		WithPartitionFunc(func(substrate.Message) (int32, error) { return 3, nil }),
+	))...)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b1:9092"}, c.Brokers)
+	assert.Equal(t, "invoices", c.Topic)
+	assert.Nil(t, c.KeyFunc)
+	p, err := c.PartitionFunc(nil)
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), p)
+}
+
+func TestOptionsConflicts(t *testing.T) {
+	keyFunc := WithKeyFunc(func(substrate.Message) []byte { return nil })
+	partitionFunc := WithPartitionFunc(func(substrate.Message) (int32, error) { return 0, nil })
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		expected string
+	}{
+		{
+			name:     "key and partition funcs",
+			opts:     []Option{keyFunc, partitionFunc},
+			expected: "kafka: WithKeyFunc conflicts with WithPartitionFunc",
+		},
+		{
+			name:     "partition and key funcs",
+			opts:     []Option{partitionFunc, keyFunc},
+			expected: "kafka: WithKeyFunc conflicts with WithPartitionFunc",
+		},
+		{
+			name:     "strict ordering and retries",
+			opts:     []Option{WithStrictOrdering(), WithProduceRetries(0, 0)},
+			expected: "kafka: WithProduceRetries conflicts with WithStrictOrdering",
+		},
+		{
+			name:     "given twice",
+			opts:     []Option{WithTopic("t1"), WithTopic("t2")},
+			expected: "kafka: WithTopic is given more than once",
+		},
+		{
+			name:     "given twice in overrides",
+			opts:     []Option{WithTopic("t1"), Overrides(WithTopic("t2"), WithTopic("t3"))},
+			expected: "kafka: WithTopic is given more than once in Overrides",
+		},
+		{
+			name:     "source option",
+			opts:     []Option{WithTopic("t1"), WithConsumerGroup("billing")},
+			expected: "kafka: WithConsumerGroup is not an option of AsyncMessageSinkConfig",
+		},
+		{
+			name: "every problem",
+			opts: []Option{keyFunc, partitionFunc, WithConsumerGroup("billing")},
+			expected: "2 problems: " +
+				"kafka: WithKeyFunc conflicts with WithPartitionFunc; " +
+				"kafka: WithConsumerGroup is not an option of AsyncMessageSinkConfig",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			_, err := NewSinkConfig(tst.opts...)
+			assert.EqualError(t, err, tst.expected)
+			_, err = NewSink(tst.opts...)
+			assert.EqualError(t, err, tst.expected)
+		})
+	}
+
+	_, err := NewSourceConfig(WithOffset(OffsetNewest), WithStartTime(time.Now()), WithKeyFunc(nil))
+	assert.EqualError(t, err, "2 problems: "+
+		"kafka: WithOffset conflicts with WithStartTime; "+
+		"kafka: WithKeyFunc is not an option of AsyncMessageSourceConfig")
+}
+
+func TestNewSinkValidatesOptions(t *testing.T) {
+	_, err := NewSink(WithBrokers("localhost:9092"))
+	assert.EqualError(t, err, "kafka: AsyncMessageSinkConfig.Topic must not be empty")
+}
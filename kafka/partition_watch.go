@@ -0,0 +1,84 @@
+package kafka
+
+import (
+	"context"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/uw-labs/substrate/internal/debug"
+)
+
+// partitionWatcher refreshes the metadata of the topic periodically, and
+// calls the OnPartitionCountChange callback when the number of partitions of
+// the topic changes. As sinks partition messages over the partitions in the
+// metadata of the client, refreshing it makes keyed messages use the new
+// partitions straight away.
+type partitionWatcher struct {
+	client   sarama.Client
+	topic    string
+	interval time.Duration
+	onChange func(old, new int)
+	debugger debug.Debugger
+
+	// count is the last known number of partitions, or zero if it is not
+	// known yet.
+	count int
+}
+
+func newPartitionWatcher(client sarama.Client, topic string, interval time.Duration, onChange func(old, new int), debugger debug.Debugger) *partitionWatcher {
+	if onChange == nil && interval <= 0 {
+		return nil
+	}
+	if interval <= 0 {
+		interval = client.Config().Metadata.RefreshFrequency
+	}
+	if interval <= 0 {
+		interval = defaultMetadataRefreshFrequency
+	}
+	return &partitionWatcher{
+		client:   client,
+		topic:    topic,
+		interval: interval,
+		onChange: onChange,
+		debugger: debugger,
+	}
+}
+
+// run checks the number of partitions every interval, until the context is
+// done. Failures to refresh the metadata are retried at the next interval.
+func (w *partitionWatcher) run(ctx context.Context) error {
+	w.check(false)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			w.check(true)
+		}
+	}
+}
+
+// check updates the number of partitions, refreshing the metadata of the
+// topic first if refresh is set.
+func (w *partitionWatcher) check(refresh bool) {
+	if refresh {
+		if err := w.client.RefreshMetadata(w.topic); err != nil {
+			w.debugger.Logf("substrate : failed to refresh the metadata of topic %s : %s\n", w.topic, err)
+			return
+		}
+	}
+	partitions, err := w.client.Partitions(w.topic)
+	if err != nil {
+		w.debugger.Logf("substrate : failed to get the partitions of topic %s : %s\n", w.topic, err)
+		return
+	}
+
+	old := w.count
+	w.count = len(partitions)
+	if old != 0 && old != w.count && w.onChange != nil {
+		w.onChange(old, w.count)
+	}
+}
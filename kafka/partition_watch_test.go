@@ -0,0 +1,98 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/uw-labs/substrate/internal/debug"
+)
+
+// partitionsClient serves the partitions of a topic, which only change when
+// the metadata is refreshed.
+type partitionsClient struct {
+	sarama.Client
+
+	mu         sync.Mutex
+	partitions int
+	refreshed  int
+	refreshErr error
+	// next is the number of partitions after the next refresh.
+	next int
+}
+
+func (c *partitionsClient) Config() *sarama.Config {
+	conf := sarama.NewConfig()
+	conf.Metadata.RefreshFrequency = 5 * time.Minute
+	return conf
+}
+
+func (c *partitionsClient) RefreshMetadata(...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refreshErr != nil {
+		return c.refreshErr
+	}
+	c.refreshed++
+	c.partitions = c.next
+	return nil
+}
+
+func (c *partitionsClient) Partitions(string) ([]int32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return make([]int32, c.partitions), nil
+}
+
+func (c *partitionsClient) set(next int, refreshErr error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.next = next
+	c.refreshErr = refreshErr
+}
+
+func TestPartitionWatcher(t *testing.T) {
+	client := &partitionsClient{partitions: 12, next: 12}
+	changes := make(chan [2]int, 1)
+	w := newPartitionWatcher(client, "topic", 10*time.Millisecond, func(old, new int) {
+		changes <- [2]int{old, new}
+	}, debug.Debugger{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- w.run(ctx)
+	}()
+
+	// Failed refreshes are retried.
+	client.set(24, errors.New("broker unavailable"))
+	time.Sleep(30 * time.Millisecond)
+	assert.Len(t, changes, 0)
+
+	client.set(24, nil)
+	select {
+	case change := <-changes:
+		assert.Equal(t, [2]int{12, 24}, change)
+	case <-time.After(5 * time.Second):
+		t.Fatal("partition count change not detected")
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+	assert.Len(t, changes, 0)
+}
+
+func TestNewPartitionWatcher(t *testing.T) {
+	client := &partitionsClient{}
+	assert.Nil(t, newPartitionWatcher(client, "topic", 0, nil, debug.Debugger{}))
+
+	w := newPartitionWatcher(client, "topic", 0, func(int, int) {}, debug.Debugger{})
+	assert.Equal(t, 5*time.Minute, w.interval)
+
+	w = newPartitionWatcher(client, "topic", time.Minute, nil, debug.Debugger{})
+	assert.Equal(t, time.Minute, w.interval)
+}
@@ -0,0 +1,66 @@
+package kafka
+
+import (
+	"sync"
+
+	"github.com/uw-labs/substrate"
+)
+
+var _ substrate.Pausable = (*asyncMessageSource)(nil)
+
+// pausedProblem is the problem reported by the status of a paused source.
+const pausedProblem = "consumption is paused"
+
+// pauser holds whether consumption is paused, which the claims of every
+// session check before reading messages.
+type pauser struct {
+	mu       sync.Mutex
+	isPaused bool
+	// changed is closed, and replaced, whenever consumption is paused or
+	// resumed.
+	changed chan struct{}
+}
+
+func (p *pauser) set(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.isPaused == paused {
+		return
+	}
+	p.isPaused = paused
+	if p.changed != nil {
+		close(p.changed)
+		p.changed = nil
+	}
+}
+
+// paused reports whether consumption is paused, along with a channel that is
+// closed when it is paused or resumed.
+func (p *pauser) paused() (bool, <-chan struct{}) {
+	if p == nil {
+		return false, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.changed == nil {
+		p.changed = make(chan struct{})
+	}
+	return p.isPaused, p.changed
+}
+
+// Pause implements the substrate.Pausable interface. The claimed partitions
+// stop being read, so sarama stops fetching them once its buffers are full,
+// while the session, and so the membership of the consumer group, is
+// retained. Acknowledgements are still processed.
+func (ams *asyncMessageSource) Pause() error {
+	ams.pauser.set(true)
+	return nil
+}
+
+// Resume implements the substrate.Pausable interface.
+func (ams *asyncMessageSource) Resume() error {
+	ams.pauser.set(false)
+	return nil
+}
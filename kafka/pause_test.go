@@ -0,0 +1,64 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPausedClaimIsNotRead(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var p pauser
+	p.set(true)
+	toAck := make(chan *consumerMessage)
+	handler := &consumerGroupHandler{
+		ctx:    ctx,
+		topic:  "topic",
+		toAck:  toAck,
+		pauser: &p,
+	}
+
+	sessCtx, endSession := context.WithCancel(ctx)
+	sess := &fakeSession{ctx: sessCtx, marked: make(map[int32]int64)}
+	claim := &fakeClaim{messages: make(chan *sarama.ConsumerMessage)}
+	claimDone := make(chan error, 1)
+	go func() {
+		claimDone <- handler.ConsumeClaim(sess, claim)
+	}()
+
+	select {
+	case claim.messages <- &sarama.ConsumerMessage{Topic: "topic", Offset: 4}:
+		t.Fatal("message read while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.set(false)
+	claim.messages <- &sarama.ConsumerMessage{Topic: "topic", Offset: 4}
+	assert.Equal(t, int64(4), (<-toAck).cm.Offset)
+
+	// The session still ends while paused.
+	p.set(true)
+	endSession()
+	require.NoError(t, <-claimDone)
+}
+
+func TestPauser(t *testing.T) {
+	var p pauser
+	paused, changed := p.paused()
+	assert.False(t, paused)
+
+	p.set(true)
+	<-changed
+	paused, _ = p.paused()
+	assert.True(t, paused)
+
+	var none *pauser
+	paused, _ = none.paused()
+	assert.False(t, paused)
+}
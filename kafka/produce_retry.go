@@ -0,0 +1,129 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/clock"
+)
+
+const (
+	defaultProduceRetryAttempts = 5
+	defaultProduceRetryBackoff  = time.Second
+)
+
+// retriableProduceErrors are the errors of messages that may be published
+// successfully when retried, e.g. once a leader has been elected or enough
+// replicas have caught up.
+var retriableProduceErrors = []error{
+	sarama.ErrLeaderNotAvailable,
+	sarama.ErrNotLeaderForPartition,
+	sarama.ErrRequestTimedOut,
+	sarama.ErrNetworkException,
+	sarama.ErrNotEnoughReplicas,
+	sarama.ErrNotEnoughReplicasAfterAppend,
+	sarama.ErrKafkaStorageError,
+	sarama.ErrOutOfBrokers,
+	ErrPublishTimeout,
+}
+
+func isRetriableProduceError(err error) bool {
+	for _, r := range retriableProduceErrors {
+		if errors.Is(err, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// produceRetries publishes the messages that failed with a retriable error
+// again, for the RetryProduceErrors option. A nil produceRetries retries
+// nothing.
+type produceRetries struct {
+	attempts int
+	backoff  time.Duration
+	clock    clock.Clock
+}
+
+func newProduceRetries(c AsyncMessageSinkConfig) *produceRetries {
+	if !c.RetryProduceErrors {
+		return nil
+	}
+	r := &produceRetries{
+		attempts: c.ProduceRetryAttempts,
+		backoff:  c.ProduceRetryBackoff,
+		clock:    clock.Real,
+	}
+	if r.attempts <= 0 {
+		r.attempts = defaultProduceRetryAttempts
+	}
+	if r.backoff <= 0 {
+		r.backoff = defaultProduceRetryBackoff
+	}
+	return r
+}
+
+// retriedMessage is the metadata of a retried message, which keeps the
+// published message for its acknowledgement.
+type retriedMessage struct {
+	msg     substrate.Message
+	attempt int
+}
+
+// publishedMessage returns the message published by the caller that a
+// produced message was created from.
+func publishedMessage(pm *sarama.ProducerMessage) substrate.Message {
+	if rm, ok := pm.Metadata.(*retriedMessage); ok {
+		return rm.msg
+	}
+	return pm.Metadata.(substrate.Message)
+}
+
+// retry returns the message to publish again for a failed message, or the
+// error to terminate publishing with if the error is not retriable, or the
+// message has run out of attempts.
+func (r *produceRetries) retry(perr *sarama.ProducerError) (*sarama.ProducerMessage, error) {
+	if r == nil || !isRetriableProduceError(perr.Err) {
+		return nil, perr
+	}
+	rm, ok := perr.Msg.Metadata.(*retriedMessage)
+	if !ok {
+		rm = &retriedMessage{msg: perr.Msg.Metadata.(substrate.Message), attempt: 1}
+	}
+	if rm.attempt >= r.attempts {
+		return nil, perr
+	}
+	// Sarama keeps the state of its own retries in the message, so a new one
+	// is produced, to the partition chosen for the failed one.
+	return &sarama.ProducerMessage{
+		Topic:     perr.Msg.Topic,
+		Key:       perr.Msg.Key,
+		Value:     perr.Msg.Value,
+		Headers:   perr.Msg.Headers,
+		Partition: perr.Msg.Partition,
+		Timestamp: perr.Msg.Timestamp,
+		Metadata:  &retriedMessage{msg: rm.msg, attempt: rm.attempt + 1},
+	}, nil
+}
+
+// resubmit publishes a retried message once the backoff has elapsed, which
+// starts its deadline, if any.
+func (r *produceRetries) resubmit(ctx context.Context, input chan<- *sarama.ProducerMessage, pm *sarama.ProducerMessage, deadlines *publishDeadlines) error {
+	timer := r.clock.NewTimer(r.backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	deadlines.submitted(pm)
+	select {
+	case input <- pm:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,186 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/testutil"
+)
+
+func TestRetryProduceErrors(t *testing.T) {
+	producer := newFakeProducer()
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	retries := newProduceRetries(AsyncMessageSinkConfig{RetryProduceErrors: true, ProduceRetryAttempts: 3, ProduceRetryBackoff: time.Second})
+	retries.clock = clock
+	sink := &asyncMessageSink{
+		Topic:   "t1",
+		retries: retries,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	messages := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.doPublishMessages(ctx, producer, acks, messages)
+	}()
+
+	msg := &reusedBufferMessage{data: []byte("data"), key: []byte("key")}
+	messages <- msg
+	pm := <-producer.input
+	producer.errors <- &sarama.ProducerError{Msg: pm, Err: sarama.ErrNotEnoughReplicas}
+
+	// The message is produced again after the backoff, and acknowledged
+	// once it succeeds.
+	clock.BlockUntil(1)
+	clock.Advance(time.Second - time.Millisecond)
+	select {
+	case <-producer.input:
+		t.Fatal("message retried before the backoff")
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	retried := <-producer.input
+	assert.True(t, pm != retried)
+	assert.Equal(t, pm.Key, retried.Key)
+	assert.Equal(t, pm.Value, retried.Value)
+	producer.successes <- retried
+	assert.Equal(t, substrate.Message(msg), <-acks)
+
+	// Messages fail once they run out of attempts.
+	messages <- msg
+	pm = <-producer.input
+	for i := 0; i < 2; i++ {
+		producer.errors <- &sarama.ProducerError{Msg: pm, Err: sarama.ErrNotEnoughReplicas}
+		clock.BlockUntil(1)
+		clock.Advance(time.Second)
+		pm = <-producer.input
+	}
+	perr := &sarama.ProducerError{Msg: pm, Err: sarama.ErrNotEnoughReplicas}
+	producer.errors <- perr
+	assert.Equal(t, perr, <-errs)
+}
+
+func TestNonRetriableProduceErrors(t *testing.T) {
+	for _, tst := range []struct {
+		name    string
+		retries *produceRetries
+		err     error
+	}{
+		{name: "not retriable", retries: &produceRetries{attempts: 3, backoff: time.Millisecond}, err: sarama.ErrMessageSizeTooLarge},
+		{name: "retries disabled", err: sarama.ErrNotEnoughReplicas},
+	} {
+		t.Run(tst.name, func(t *testing.T) {
+			producer := newFakeProducer()
+			sink := &asyncMessageSink{Topic: "t1", retries: tst.retries}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			messages := make(chan substrate.Message)
+			errs := make(chan error, 1)
+			go func() {
+				errs <- sink.doPublishMessages(ctx, producer, make(chan substrate.Message), messages)
+			}()
+
+			messages <- &reusedBufferMessage{data: []byte("data")}
+			perr := &sarama.ProducerError{Msg: <-producer.input, Err: tst.err}
+			producer.errors <- perr
+			assert.Equal(t, perr, <-errs)
+		})
+	}
+}
+
+func TestRetryProduceErrorsWithStrictOrdering(t *testing.T) {
+	// Retried messages would be written after the messages published after
+	// them.
+	_, err := NewAsyncMessageSink(AsyncMessageSinkConfig{
+		Brokers:            []string{"localhost:9092"},
+		Topic:              "t1",
+		StrictOrdering:     true,
+		RetryProduceErrors: true,
+	})
+	assert.EqualError(t, err, "kafka: AsyncMessageSinkConfig.RetryProduceErrors cannot be combined with StrictOrdering")
+}
+
+func TestRetryProduceErrorsSkipsPublishedMessages(t *testing.T) {
+	producer := newFakeProducer()
+	registry := substrate.NewLRUPublishedRegistry(10)
+	sink := &asyncMessageSink{
+		Topic:     "t1",
+		retries:   &produceRetries{attempts: 3, backoff: time.Millisecond},
+		published: newPublishedMarker(registry, func(msg substrate.Message) string { return string(msg.Data()) }),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	messages := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	go func() {
+		_ = sink.doPublishMessages(ctx, producer, acks, messages)
+	}()
+
+	// The broker writes the message, but its response is lost and the
+	// request times out. The message was marked by another producer
+	// writing it, so it is acknowledged without being produced again.
+	m1 := &reusedBufferMessage{data: []byte("1")}
+	messages <- m1
+	pm := <-producer.input
+	require.NoError(t, registry.Mark("1"))
+	producer.errors <- &sarama.ProducerError{Msg: pm, Err: sarama.ErrRequestTimedOut}
+	assert.Equal(t, substrate.Message(m1), <-acks)
+	select {
+	case <-producer.input:
+		t.Fatal("written message produced again")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The messages acknowledged by the broker are marked.
+	m2 := &reusedBufferMessage{data: []byte("2")}
+	messages <- m2
+	producer.successes <- <-producer.input
+	assert.Equal(t, substrate.Message(m2), <-acks)
+	seen, err := registry.Seen("2")
+	require.NoError(t, err)
+	assert.True(t, seen)
+}
+
+func TestRetryProduceErrorsKeepsPartition(t *testing.T) {
+	producer := newFakeProducer()
+	sink := &asyncMessageSink{
+		Topic:         "t1",
+		retries:       newProduceRetries(AsyncMessageSinkConfig{RetryProduceErrors: true, ProduceRetryBackoff: time.Millisecond}),
+		partitionFunc: func(substrate.Message) (int32, error) { return 7, nil },
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	messages := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	go func() {
+		_ = sink.doPublishMessages(ctx, producer, acks, messages)
+	}()
+
+	msg := &reusedBufferMessage{data: []byte("data"), key: []byte("key")}
+	messages <- msg
+	pm := <-producer.input
+	assert.Equal(t, int32(7), pm.Partition)
+	producer.errors <- &sarama.ProducerError{Msg: pm, Err: sarama.ErrNotLeaderForPartition}
+
+	retried := <-producer.input
+	assert.Equal(t, int32(7), retried.Partition)
+	producer.successes <- retried
+	assert.Equal(t, substrate.Message(msg), <-acks)
+
+	// The timestamp set on the failed message is kept too.
+	failed := &sarama.ProducerMessage{Topic: "t1", Partition: 3, Timestamp: time.Unix(1600000000, 0), Metadata: substrate.Message(msg)}
+	retried, err := sink.retries.retry(&sarama.ProducerError{Msg: failed, Err: ErrPublishTimeout})
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), retried.Partition)
+	assert.Equal(t, failed.Timestamp, retried.Timestamp)
+}
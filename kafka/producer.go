@@ -2,10 +2,17 @@ package kafka
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Shopify/sarama"
+	metrics "github.com/rcrowley/go-metrics"
 	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/clock"
 	"github.com/uw-labs/substrate/internal/debug"
 	"github.com/uw-labs/substrate/internal/helper"
 	"github.com/uw-labs/substrate/internal/unwrap"
@@ -18,36 +25,272 @@ var (
 )
 
 type AsyncMessageSinkConfig struct {
-	Brokers         []string
-	Topic           string
+	Brokers []string
+	Topic   string
+	// Namespace, if set, is prepended as it is to Topic, e.g. "billing."
+	// for the topics of a team on a shared cluster. The namespaced topic is
+	// the one reported by Status and errors.
+	Namespace       string
 	MaxMessageBytes int
 	KeyFunc         func(substrate.Message) []byte
-	Version         string
+	// PartitionFunc, if set, returns the partition to produce a message to,
+	// rather than hashing its key. Like KeyFunc, it is given the original
+	// message published, and an error terminates PublishMessages.
+	// SourcePartition produces the messages consumed from kafka to the
+	// partition they were consumed from.
+	PartitionFunc func(substrate.Message) (int32, error)
+	Version       string
+	// ClientID is the client id reported to the brokers, which shows up in
+	// their logs and metrics. Defaults to "substrate-" followed by the
+	// topic.
+	ClientID string
+	// CopyOnPublish makes the sink copy the payload and key of every
+	// message as it is received, so that callers may reuse their buffers
+	// as soon as a message is sent to PublishMessages. This costs an
+	// allocation and a copy per message. Without it, the buffers must not
+	// be modified until the message is acknowledged.
+	CopyOnPublish bool
+	// StrictOrdering guarantees that messages are written to a partition in
+	// the order they are published, even when requests are retried, by
+	// allowing a single request in flight per broker. With a Version of at
+	// least 0.11.0, the idempotent producer is also enabled, so that
+	// retries don't write duplicates. This limits throughput, as batches
+	// for a broker are sent one at a time.
+	StrictOrdering bool
+	// FlushMessages and FlushFrequency, if set, make the producer wait for
+	// FlushMessages messages to send to a broker, or for FlushFrequency,
+	// whichever comes first, before sending them, rather than sending them
+	// as soon as possible. Setting FlushMessages to the size of the batches
+	// given to PublishBatches, see substrate.AsyncMessageBatchSink, sends
+	// every batch in a single request per broker.
+	FlushMessages  int
+	FlushFrequency time.Duration
+	// RetryProduceErrors makes the sink publish the messages that failed
+	// with a retriable error, such as kafka.ErrNotEnoughReplicas, again,
+	// rather than terminating PublishMessages, once sarama has run out of
+	// its own retries. Every message is attempted at most
+	// ProduceRetryAttempts times, which defaults to 5, waiting
+	// ProduceRetryBackoff, which defaults to a second, before every retry.
+	// Other errors, and retriable errors of messages that have run out of
+	// attempts, still terminate PublishMessages. Retried messages are
+	// written after the messages published after them, so it cannot be
+	// set along with StrictOrdering, which relies on the retries of sarama
+	// alone, as they keep the messages of a partition in order.
+	RetryProduceErrors   bool
+	ProduceRetryAttempts int
+	ProduceRetryBackoff  time.Duration
+	// PerMessageTimeout, if positive, fails every message that is neither
+	// written nor failed by sarama within it once produced, e.g. when it
+	// is stuck behind an unavailable leader, with ErrPublishTimeout, as
+	// if sarama had failed it. The error terminates PublishMessages,
+	// unless RetryProduceErrors is set, in which case the message is
+	// retried like other retriable errors, or it is handled by OnError,
+	// which fails the message on its own. The outcome reported by sarama
+	// for a failed message afterwards is ignored.
+	PerMessageTimeout time.Duration
+	// OnError, if set, is called with every message that fails to be
+	// produced, once it has run out of any retries, and the error it failed
+	// with, e.g. ErrPublishTimeout, rather than terminating
+	// PublishMessages. If it returns nil, the message is acknowledged and
+	// the other messages keep flowing, so it would typically publish it to
+	// a dead letter sink. If it returns an error, PublishMessages
+	// terminates with it. Failed messages are skipped, so their order
+	// relative to the other messages of a partition is not kept, even with
+	// StrictOrdering.
+	OnError substrate.MessageErrorHandler
+	// OnThrottled, if set, is called every ThrottleCheckInterval, which
+	// defaults to a second, during which the brokers throttled the produce
+	// requests of the sink for exceeding a quota, with the throttle time
+	// of the broker throttling the most, as recorded by sarama. It is
+	// called from the goroutine checking the metrics, so it must not
+	// block.
+	OnThrottled           func(time.Duration)
+	ThrottleCheckInterval time.Duration
+	// AdaptToQuota makes the sink limit the bytes it produces to just
+	// under the throughput of the intervals during which it is throttled,
+	// rather than leaving the brokers to delay its requests, which backs
+	// up every message in flight. The limit is raised while the sink uses
+	// it without being throttled, to follow a raised quota.
+	AdaptToQuota bool
+	// SharedProducer makes the sink create a single producer when it is
+	// created, used by every PublishMessages call and closed along with
+	// the sink, rather than a producer per call, which is costly for
+	// callers calling PublishMessages in a loop, e.g. to reconnect. The
+	// messages still in flight when a call returns are not acknowledged by
+	// the next call, even if they are written.
+	SharedProducer bool
+	// PayloadTransform, if set, is applied to the payload of every message
+	// before it is produced, e.g. to encrypt it. Up to TransformWorkers
+	// payloads, which defaults to 1, are transformed concurrently, and
+	// messages are still produced in order. If a transform fails,
+	// PublishMessages terminates with a PayloadTransformError. Tombstones
+	// are not transformed.
+	PayloadTransform func([]byte) ([]byte, error)
+	TransformWorkers int
+	// PublishedRegistry, if set, is marked with the ID returned by IDFunc
+	// for every message written, as soon as the broker acknowledges it,
+	// including the messages of a previous call with SharedProducer. The
+	// messages retried with RetryProduceErrors, and by failover sinks, are
+	// acknowledged without being produced again if their ID is seen in the
+	// registry, so they are not written twice. Failing to mark or check an
+	// ID terminates PublishMessages.
+	PublishedRegistry substrate.PublishedRegistry
+	IDFunc            func(substrate.Message) string
+	// TLS, if set, enables TLS connections to the brokers. Setting its
+	// GetClientCertificate field to the method of a CertificateReloader
+	// picks up rotated client certificates.
+	TLS *tls.Config
+	// SASL, if set, enables SASL authentication with the brokers.
+	SASL *SASLConfig
+	// StartupChecks enables checking, when the sink is created, that its
+	// credentials may describe and write the topic. Creating the sink fails
+	// if they are not authorized to describe the topic, or if an ACL of the
+	// SASL user denies writing it. If no ACL allows writing it, or the ACLs
+	// can't be described, e.g. without the permission to describe them,
+	// Status reports it as a problem instead.
+	StartupChecks bool
+	// MetricRegistry is the registry sarama records its metrics in, e.g. to
+	// share one across sources and sinks. Defaults to a new registry. The
+	// registry is available through the MetricsReporter interface.
+	MetricRegistry metrics.Registry
+	// Interceptors are called with every message before it is produced,
+	// e.g. to add headers. NewPublishHeadersInterceptor returns one that
+	// adds the publish time and hostname.
+	Interceptors []sarama.ProducerInterceptor
+	// OnPartitionCountChange, if set, is called with the old and new number
+	// of partitions when the number of partitions of the topic changes.
+	// The metadata of the topic is refreshed every PartitionWatchInterval
+	// to detect changes, which also makes keyed messages hash over the new
+	// partitions straight away, rather than after the next periodic
+	// refresh of the metadata.
+	OnPartitionCountChange func(old, new int)
+	// PartitionWatchInterval is the interval at which the metadata of the
+	// topic is refreshed to detect partition count changes. Setting it
+	// watches the partitions without OnPartitionCountChange. Defaults to
+	// the metadata refresh frequency.
+	PartitionWatchInterval time.Duration
+	// Gauges, if set, is sampled with the number of messages awaiting their
+	// acknowledgement, and of the acknowledgements not yet received by the
+	// caller, e.g. to find where publishing backs up.
+	Gauges substrate.Gauges
+	// LifecycleEvents, if set, receives the connected and closed events of
+	// the sink, and a flushed event whenever its producer is closed, which
+	// waits for the messages in flight. Events are dropped when the channel
+	// is full. See substrate.LifecycleEvent.
+	LifecycleEvents chan<- substrate.LifecycleEvent
+	// OnAck, if set, is called with where every message was written, e.g.
+	// to record it for an audit trail, before the message is acknowledged.
+	// It is called as the brokers confirm the messages, which may be out of
+	// the order they were published in across partitions, from the
+	// goroutine handling the confirmations, so it must not block. With
+	// Debug set, a call taking longer than 100ms terminates PublishMessages
+	// with an error, to catch blocking callbacks in tests.
+	OnAck func(ProduceConfirmation)
+	// ClientPool, if set, is used to share the client of the sink with the
+	// other sinks created with the same brokers and options.
+	ClientPool *ClientPool
+	// UseRegisteredDefaults enables applying the defaults registered for
+	// the kafka scheme with the config package to the options that are not
+	// set. It is always set for the sinks obtained from suburl.
+	UseRegisteredDefaults bool
 
 	Debug bool
 }
 
+// ProduceConfirmation describes where a message was written, for the OnAck
+// callback of sinks.
+type ProduceConfirmation struct {
+	// Message is the original message published.
+	Message   substrate.Message
+	Partition int32
+	Offset    int64
+	// Timestamp is the timestamp of the record, which is zero for brokers
+	// older than 0.10.0.
+	Timestamp time.Time
+}
+
+// ErrConcurrentPublish is returned by PublishMessages when it is called while
+// another call on the same sink is still running, as the acknowledgements of
+// their messages couldn't be told apart.
+var ErrConcurrentPublish = errors.New("PublishMessages is already running on this sink")
+
+// slowOnAck is the duration from which an OnAck call terminates publishing
+// in debug mode.
+const slowOnAck = 100 * time.Millisecond
+
 func NewAsyncMessageSink(config AsyncMessageSinkConfig) (substrate.AsyncMessageSink, error) {
+	if err := config.applyRegisteredDefaults(); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	config.resolveTopic()
 	conf, err := config.buildSaramaProducerConfig()
 	if err != nil {
 		return nil, err
 	}
 
-	client, err := sarama.NewClient(config.Brokers, conf)
+	client, err := newClient(config.ClientPool, "sink", config.Brokers, conf, config.MetricRegistry, config.Interceptors, config.SASL)
 	if err != nil {
 		return nil, err
 	}
+	var warnings []string
+	if config.StartupChecks {
+		warnings, err = newStartupChecker(config.Topic, config.SASL, sarama.AclOperationDescribe, sarama.AclOperationWrite).check(client)
+		if err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+	}
 
 	sink := asyncMessageSink{
 		client:  client,
 		Topic:   config.Topic,
 		KeyFunc: config.KeyFunc,
 
+		partitionFunc: config.PartitionFunc,
+		onAck:         config.OnAck,
+		copyOnPublish: config.CopyOnPublish,
+		headers:       conf.Version.IsAtLeast(sarama.V0_11_0_0),
+		transformer:   newPayloadTransformer(config.PayloadTransform, config.TransformWorkers),
+		published:     newPublishedMarker(config.PublishedRegistry, config.IDFunc),
+		retries:       newProduceRetries(config),
+		timeout:       config.PerMessageTimeout,
+		onError:       config.OnError,
+		brokers:       newBrokerStatus(client, config.Brokers, config.Topic),
+		warnings:      warnings,
+		events:        substrate.NewLifecycleEmitter(config.LifecycleEvents, "kafka", config.Topic),
 		debugger: debug.Debugger{
 			Enabled: config.Debug,
 		},
 	}
-	return helper.NewAckOrderingSink(&sink), nil
+	sink.partitions = newPartitionWatcher(client, config.Topic, config.PartitionWatchInterval, config.OnPartitionCountChange, sink.debugger)
+	sink.throttles = newThrottleWatcher(config, client.Config().MetricRegistry, sink.debugger)
+	if config.SharedProducer {
+		sink.producer, err = sarama.NewAsyncProducerFromClient(client)
+		if err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+	}
+	sink.events.Emit(substrate.LifecycleEvent{Type: substrate.LifecycleConnected})
+	ordering := helper.NewAckOrderingSink(&sink)
+	ordering.Gauges = config.Gauges
+	return &orderedSink{
+		AckOrderingSink: ordering,
+		sink:            &sink,
+	}, nil
+}
+
+// PublishMessages implements the substrate.AsyncMessageSink interface,
+// returning ErrConcurrentPublish if it is already running.
+func (s *orderedSink) PublishMessages(ctx context.Context, acks chan<- substrate.Message, messages <-chan substrate.Message) error {
+	if !atomic.CompareAndSwapInt32(&s.publishing, 0, 1) {
+		return ErrConcurrentPublish
+	}
+	defer atomic.StoreInt32(&s.publishing, 0)
+	return s.AckOrderingSink.PublishMessages(ctx, acks, messages)
 }
 
 type asyncMessageSink struct {
@@ -55,10 +298,71 @@ type asyncMessageSink struct {
 	Topic   string
 	KeyFunc func(substrate.Message) []byte
 
+	partitionFunc func(substrate.Message) (int32, error)
+	onAck         func(ProduceConfirmation)
+	onError       substrate.MessageErrorHandler
+	copyOnPublish bool
+	// headers is set when the Version supports record headers, to which
+	// message attributes are written.
+	headers    bool
+	retries    *produceRetries
+	partitions *partitionWatcher
+	throttles  *throttleWatcher
+	brokers    *brokerStatus
+	// warnings are the problems found by the startup checks.
+	warnings []string
 	debugger debug.Debugger
+
+	// producer is the producer shared by the PublishMessages calls, if
+	// SharedProducer is set.
+	producer sarama.AsyncProducer
+	// transformer applies the PayloadTransform, if set.
+	transformer *payloadTransformer
+	// published marks the written messages in the PublishedRegistry, if
+	// set.
+	published *publishedMarker
+	// events emits the lifecycle events of the sink, if enabled.
+	events *substrate.LifecycleEmitter
+	// timeout is the PerMessageTimeout, which is tracked with clock, if
+	// set.
+	timeout time.Duration
+	clock   clock.Clock
+}
+
+// inFlight holds the messages produced by a PublishMessages call on a shared
+// producer, so that the results of the messages produced by the previous
+// calls are ignored. A nil inFlight holds every message.
+type inFlight struct {
+	mu   sync.Mutex
+	msgs map[*sarama.ProducerMessage]struct{}
+}
+
+func (f *inFlight) add(pm *sarama.ProducerMessage) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.msgs[pm] = struct{}{}
+}
+
+// remove removes a message, returning whether it was produced by the call.
+func (f *inFlight) remove(pm *sarama.ProducerMessage) bool {
+	if f == nil {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.msgs[pm]
+	delete(f.msgs, pm)
+	return ok
 }
 
 func (ams *asyncMessageSink) PublishMessages(ctx context.Context, acks chan<- substrate.Message, messages <-chan substrate.Message) error {
+	if ams.producer != nil {
+		return ams.doPublishMessages(ctx, ams.producer, acks, messages)
+	}
+
 	producer, err := sarama.NewAsyncProducerFromClient(ams.client)
 	if err != nil {
 		return err
@@ -66,7 +370,11 @@ func (ams *asyncMessageSink) PublishMessages(ctx context.Context, acks chan<- su
 
 	err = ams.doPublishMessages(ctx, producer, acks, messages)
 
-	if closeErr := producer.Close(); closeErr != nil {
+	// Closing the producer fails for the messages still in flight, which
+	// are not acknowledged, so it doesn't fail a clean shutdown.
+	closeErr := producer.Close()
+	ams.events.Emit(substrate.LifecycleEvent{Type: substrate.LifecycleFlushed, Err: closeErr})
+	if closeErr != nil && ctx.Err() == nil {
 		return closeErr
 	}
 
@@ -78,13 +386,55 @@ func (ams *asyncMessageSink) doPublishMessages(ctx context.Context, producer sar
 	errs := producer.Errors()
 	successes := producer.Successes()
 
+	var flight *inFlight
+	if producer == ams.producer {
+		flight = &inFlight{msgs: make(map[*sarama.ProducerMessage]struct{})}
+	}
+
 	eg, ctx := errgroup.WithContext(ctx)
 
+	deadlines := newPublishDeadlines(ams.timeout, ams.clock)
+	if deadlines != nil {
+		errs = deadlines.watch(ctx, eg, errs)
+	}
+
+	if ams.partitions != nil {
+		eg.Go(func() error {
+			return ams.partitions.run(ctx)
+		})
+	}
+
+	if ams.throttles != nil {
+		eg.Go(func() error {
+			return ams.throttles.run(ctx)
+		})
+	}
+
+	if ams.transformer != nil {
+		transformed := make(chan substrate.Message)
+		ams.transformer.transformPublished(ctx, eg, messages, transformed)
+		messages = transformed
+	}
+
 	eg.Go(func() error {
 		for {
 			select {
 			case suc := <-successes:
-				msg := suc.Metadata.(substrate.Message)
+				if err := ams.published.mark(publishedMessage(suc)); err != nil {
+					return err
+				}
+				if !deadlines.settled(suc) {
+					ams.debugger.Logf("substrate : producer - ignored ack of message that timed out\n")
+					continue
+				}
+				if !flight.remove(suc) {
+					ams.debugger.Logf("substrate : producer - ignored ack of message produced by a previous call\n")
+					continue
+				}
+				msg := publishedMessage(suc)
+				if err := ams.confirm(suc, msg); err != nil {
+					return err
+				}
 				select {
 				case acks <- msg:
 					ams.debugger.Logf("substrate : producer - sent ack to caller for message : %s\n", msg)
@@ -105,24 +455,59 @@ func (ams *asyncMessageSink) doPublishMessages(ctx context.Context, producer sar
 					Topic: ams.Topic,
 				}
 
-				message.Value = sarama.ByteEncoder(m.Data())
+				value := m.Data()
+				if tp, ok := m.(*transformedPayload); ok {
+					m = tp.msg
+				}
 
 				// Get original user message if wrapped
+				var key []byte
 				unwrappedMsg := unwrap.Unwrap(m)
 				if ams.KeyFunc != nil {
 					// Provide original user message to the partition key function.
-					message.Key = sarama.ByteEncoder(ams.KeyFunc(unwrappedMsg))
+					key = ams.KeyFunc(unwrappedMsg)
 				} else {
 					// No user specified key func, check for keyed message type
 					if km, ok := unwrappedMsg.(substrate.KeyedMessage); ok {
-						message.Key = sarama.ByteEncoder(km.Key())
+						key = km.Key()
 					} else {
 						// Use the whole message as the hash key
-						message.Key = sarama.ByteEncoder(unwrappedMsg.Data())
+						key = unwrappedMsg.Data()
+					}
+				}
+
+				if ams.partitionFunc != nil {
+					partition, err := ams.partitionFunc(unwrappedMsg)
+					if err != nil {
+						return err
+					}
+					message.Partition = partition
+				}
+
+				if ams.copyOnPublish {
+					// Sarama encodes the message later, from another goroutine.
+					value = append([]byte(nil), value...)
+					key = append([]byte(nil), key...)
+				}
+				if !isTombstone(m) {
+					// A tombstone has no value, which is not the
+					// same as an empty one.
+					message.Value = sarama.ByteEncoder(value)
+				}
+				message.Key = sarama.ByteEncoder(key)
+
+				if ams.headers {
+					for k, v := range unwrap.Attributes(m) {
+						message.Headers = append(message.Headers, sarama.RecordHeader{Key: []byte(k), Value: []byte(v)})
 					}
 				}
 
 				message.Metadata = m
+				if err := ams.throttles.admit(ctx, len(key)+len(value)); err != nil {
+					return err
+				}
+				flight.add(message)
+				deadlines.submitted(message)
 				select {
 				case input <- message:
 				case <-ctx.Done():
@@ -132,7 +517,45 @@ func (ams *asyncMessageSink) doPublishMessages(ctx context.Context, producer sar
 			case <-ctx.Done():
 				return ctx.Err()
 			case err := <-errs:
-				return err
+				if !flight.remove(err.Msg) {
+					ams.debugger.Logf("substrate : producer - ignored error of message produced by a previous call : %s\n", err.Err)
+					continue
+				}
+				msg := publishedMessage(err.Msg)
+				retry, rerr := ams.retries.retry(err)
+				if rerr != nil {
+					if ams.onError == nil {
+						return rerr
+					}
+					if herr := ams.onError(unwrap.Unwrap(msg), err.Err); herr != nil {
+						return herr
+					}
+					ams.debugger.Logf("substrate : producer - acknowledged message handled by OnError : %s\n", err.Err)
+					select {
+					case acks <- msg:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+					continue
+				}
+				seen, serr := ams.published.seen(msg)
+				if serr != nil {
+					return serr
+				}
+				if seen {
+					ams.debugger.Logf("substrate : producer - acknowledged retried message that was already written : %s\n", msg)
+					select {
+					case acks <- msg:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+					continue
+				}
+				flight.add(retry)
+				ams.debugger.Logf("substrate : producer - retrying message after error : %s\n", err.Err)
+				eg.Go(func() error {
+					return ams.retries.resubmit(ctx, input, retry, deadlines)
+				})
 			}
 		}
 	})
@@ -140,8 +563,38 @@ func (ams *asyncMessageSink) doPublishMessages(ctx context.Context, producer sar
 	return eg.Wait()
 }
 
+// confirm calls the OnAck callback, if any, for a produced message.
+func (ams *asyncMessageSink) confirm(suc *sarama.ProducerMessage, msg substrate.Message) error {
+	if ams.onAck == nil {
+		return nil
+	}
+	c := ProduceConfirmation{
+		Message:   unwrap.Unwrap(msg),
+		Partition: suc.Partition,
+		Offset:    suc.Offset,
+		Timestamp: suc.Timestamp,
+	}
+	if !ams.debugger.Enabled {
+		ams.onAck(c)
+		return nil
+	}
+	start := time.Now()
+	ams.onAck(c)
+	if d := time.Since(start); d > slowOnAck {
+		return fmt.Errorf("OnAck blocked acknowledging the message at offset %d of partition %d for %s", c.Offset, c.Partition, d)
+	}
+	return nil
+}
+
 func (ams *asyncMessageSink) Status() (*substrate.Status, error) {
-	return status(ams.client, ams.Topic)
+	st, err := status(ams.client, ams.Topic)
+	if err != nil {
+		return nil, err
+	}
+	ams.brokers.addTo(st)
+	ams.throttles.addTo(st)
+	st.Problems = append(st.Problems, ams.warnings...)
+	return st, nil
 }
 
 func (ams *AsyncMessageSinkConfig) buildSaramaProducerConfig() (*sarama.Config, error) {
@@ -159,7 +612,18 @@ func (ams *AsyncMessageSinkConfig) buildSaramaProducerConfig() (*sarama.Config,
 		conf.Producer.MaxMessageBytes = int(ams.MaxMessageBytes)
 	}
 
+	conf.Producer.Flush.Messages = ams.FlushMessages
+	conf.Producer.Flush.Frequency = ams.FlushFrequency
+
 	conf.Producer.Partitioner = sarama.NewHashPartitioner
+	if ams.PartitionFunc != nil {
+		conf.Producer.Partitioner = sarama.NewManualPartitioner
+	}
+	conf.ClientID = clientID(ams.ClientID, ams.Topic)
+	if ams.MetricRegistry != nil {
+		conf.MetricRegistry = ams.MetricRegistry
+	}
+	conf.Producer.Interceptors = ams.Interceptors
 
 	if ams.Version != "" {
 		version, err := sarama.ParseKafkaVersion(ams.Version)
@@ -169,11 +633,37 @@ func (ams *AsyncMessageSinkConfig) buildSaramaProducerConfig() (*sarama.Config,
 		conf.Version = version
 	}
 
+	if err := applySecurity(conf, ams.TLS, ams.SASL); err != nil {
+		return nil, err
+	}
+
+	if ams.StrictOrdering {
+		// Retried requests can overtake the requests sent after them.
+		conf.Net.MaxOpenRequests = 1
+		if conf.Version.IsAtLeast(sarama.V0_11_0_0) {
+			conf.Producer.Idempotent = true
+		}
+	}
+
 	return conf, nil
 }
 
 // Close implements the Close method of the substrate.AsyncMessageSink
 // interface.
-func (ams *asyncMessageSink) Close() error {
+func (ams *asyncMessageSink) Close() (err error) {
+	defer func() {
+		ams.events.Emit(substrate.LifecycleEvent{Type: substrate.LifecycleClosed, Err: err})
+	}()
+	if ams.producer != nil {
+		// The messages still in flight fail to close the producer, but no
+		// call awaits them anymore.
+		var perrs sarama.ProducerErrors
+		err := ams.producer.Close()
+		ams.events.Emit(substrate.LifecycleEvent{Type: substrate.LifecycleFlushed, Err: err})
+		if err != nil && !errors.As(err, &perrs) {
+			_ = ams.client.Close()
+			return err
+		}
+	}
 	return ams.client.Close()
 }
@@ -0,0 +1,282 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/helper"
+	"github.com/uw-labs/substrate/mock"
+)
+
+// fakeProducer is a sarama.AsyncProducer holding on to the produced messages,
+// like sarama does until they are encoded.
+type fakeProducer struct {
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+}
+
+func newFakeProducer() *fakeProducer {
+	return &fakeProducer{
+		input:     make(chan *sarama.ProducerMessage, 1),
+		successes: make(chan *sarama.ProducerMessage),
+		errors:    make(chan *sarama.ProducerError),
+	}
+}
+
+func (p *fakeProducer) AsyncClose()                               {}
+func (p *fakeProducer) Close() error                              { return nil }
+func (p *fakeProducer) Input() chan<- *sarama.ProducerMessage     { return p.input }
+func (p *fakeProducer) Successes() <-chan *sarama.ProducerMessage { return p.successes }
+func (p *fakeProducer) Errors() <-chan *sarama.ProducerError      { return p.errors }
+
+type reusedBufferMessage struct {
+	data []byte
+	key  []byte
+}
+
+func (m *reusedBufferMessage) Data() []byte { return m.data }
+func (m *reusedBufferMessage) Key() []byte  { return m.key }
+
+type attributedMessage struct {
+	data       []byte
+	attributes map[string]string
+}
+
+func (m *attributedMessage) Data() []byte                  { return m.data }
+func (m *attributedMessage) Attributes() map[string]string { return m.attributes }
+
+func TestAttributesArePublishedAsHeaders(t *testing.T) {
+	for _, headers := range []bool{false, true} {
+		producer := newFakeProducer()
+		sink := &asyncMessageSink{Topic: "t1", headers: headers}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		messages := make(chan substrate.Message)
+		errs := make(chan error, 1)
+		go func() {
+			errs <- sink.doPublishMessages(ctx, producer, make(chan substrate.Message), messages)
+		}()
+
+		messages <- &attributedMessage{data: []byte("data"), attributes: map[string]string{"attempt": "2"}}
+		pm := <-producer.input
+		if headers {
+			assert.Equal(t, []sarama.RecordHeader{{Key: []byte("attempt"), Value: []byte("2")}}, pm.Headers)
+		} else {
+			// Brokers older than 0.11.0 don't support headers.
+			assert.Empty(t, pm.Headers)
+		}
+
+		cancel()
+		assert.Equal(t, context.Canceled, <-errs)
+	}
+}
+
+func TestCopyOnPublish(t *testing.T) {
+	for _, copyOnPublish := range []bool{false, true} {
+		producer := newFakeProducer()
+		sink := &asyncMessageSink{Topic: "t1", copyOnPublish: copyOnPublish}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		messages := make(chan substrate.Message)
+		acks := make(chan substrate.Message)
+		errs := make(chan error, 1)
+		go func() {
+			errs <- sink.doPublishMessages(ctx, producer, acks, messages)
+		}()
+
+		buf, key := []byte("first"), []byte("key-1")
+		messages <- &reusedBufferMessage{data: buf, key: key}
+		pm := <-producer.input
+		// The caller reuses its buffers before sarama has encoded the message.
+		copy(buf, "xxxxx")
+		copy(key, "xxxxx")
+
+		value, err := pm.Value.Encode()
+		require.NoError(t, err)
+		encodedKey, err := pm.Key.Encode()
+		require.NoError(t, err)
+		if copyOnPublish {
+			assert.Equal(t, "first", string(value))
+			assert.Equal(t, "key-1", string(encodedKey))
+		} else {
+			assert.Equal(t, "xxxxx", string(value))
+			assert.Equal(t, "xxxxx", string(encodedKey))
+		}
+
+		cancel()
+		assert.Equal(t, context.Canceled, <-errs)
+	}
+}
+
+func TestStrictOrdering(t *testing.T) {
+	conf, err := (&AsyncMessageSinkConfig{StrictOrdering: true, Version: "2.4.0"}).buildSaramaProducerConfig()
+	require.NoError(t, err)
+	assert.Equal(t, 1, conf.Net.MaxOpenRequests)
+	assert.True(t, conf.Producer.Idempotent)
+	// The idempotent producer requires all the replicas to acknowledge, and
+	// retries.
+	assert.Equal(t, sarama.WaitForAll, conf.Producer.RequiredAcks)
+	assert.True(t, conf.Producer.Retry.Max > 0)
+
+	// Brokers before 0.11.0 don't support the idempotent producer.
+	conf, err = (&AsyncMessageSinkConfig{StrictOrdering: true, Version: "0.10.2.0"}).buildSaramaProducerConfig()
+	require.NoError(t, err)
+	assert.Equal(t, 1, conf.Net.MaxOpenRequests)
+	assert.False(t, conf.Producer.Idempotent)
+
+	conf, err = (&AsyncMessageSinkConfig{Version: "2.4.0"}).buildSaramaProducerConfig()
+	require.NoError(t, err)
+	assert.False(t, conf.Producer.Idempotent)
+}
+
+func TestOnAck(t *testing.T) {
+	producer := newFakeProducer()
+	confirmations := make(chan ProduceConfirmation, 1)
+	sink := &asyncMessageSink{Topic: "t1", onAck: func(c ProduceConfirmation) { confirmations <- c }}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	messages := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	go func() {
+		_ = sink.doPublishMessages(ctx, producer, acks, messages)
+	}()
+
+	msg := &reusedBufferMessage{data: []byte("data")}
+	messages <- msg
+	pm := <-producer.input
+	pm.Partition, pm.Offset, pm.Timestamp = 2, 42, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	producer.successes <- pm
+
+	// The callback is called before the message is acknowledged.
+	assert.Equal(t, ProduceConfirmation{
+		Message:   msg,
+		Partition: 2,
+		Offset:    42,
+		Timestamp: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	}, <-confirmations)
+	assert.Equal(t, substrate.Message(msg), <-acks)
+}
+
+func TestSlowOnAck(t *testing.T) {
+	producer := newFakeProducer()
+	sink := &asyncMessageSink{Topic: "t1", onAck: func(ProduceConfirmation) { time.Sleep(slowOnAck + 50*time.Millisecond) }}
+	sink.debugger.Enabled = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	messages := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.doPublishMessages(ctx, producer, make(chan substrate.Message), messages)
+	}()
+
+	messages <- &reusedBufferMessage{data: []byte("data")}
+	pm := <-producer.input
+	pm.Partition, pm.Offset = 2, 42
+	producer.successes <- pm
+	err := <-errs
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "OnAck blocked acknowledging the message at offset 42 of partition 2")
+}
+
+func TestConcurrentPublish(t *testing.T) {
+	sink := &orderedSink{AckOrderingSink: helper.NewAckOrderingSink(mock.NewSink())}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishMessages(ctx, make(chan substrate.Message), make(chan substrate.Message))
+	}()
+	for atomic.LoadInt32(&sink.publishing) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	assert.Equal(t, ErrConcurrentPublish, sink.PublishMessages(context.Background(), make(chan substrate.Message), make(chan substrate.Message)))
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+
+	// The sink can publish again once the previous call returned.
+	assert.Equal(t, context.Canceled, sink.PublishMessages(ctx, make(chan substrate.Message), make(chan substrate.Message)))
+}
+
+func TestSharedProducer(t *testing.T) {
+	producer := newFakeProducer()
+	sink := &asyncMessageSink{Topic: "t1", producer: producer}
+
+	// The messages in flight when a call returns are not acknowledged.
+	ctx, cancel := context.WithCancel(context.Background())
+	messages := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.doPublishMessages(ctx, producer, make(chan substrate.Message), messages)
+	}()
+	messages <- &reusedBufferMessage{data: []byte("1")}
+	written := <-producer.input
+	messages <- &reusedBufferMessage{data: []byte("2")}
+	failed := <-producer.input
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+
+	// The next call ignores their results.
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	acks := make(chan substrate.Message)
+	go func() {
+		errs <- sink.doPublishMessages(ctx, producer, acks, messages)
+	}()
+	producer.successes <- written
+	producer.errors <- &sarama.ProducerError{Msg: failed, Err: sarama.ErrMessageSizeTooLarge}
+	msg := &reusedBufferMessage{data: []byte("3")}
+	messages <- msg
+	producer.successes <- <-producer.input
+	assert.Equal(t, substrate.Message(msg), <-acks)
+}
+
+// producerClient is the client producers are created from.
+type producerClient struct {
+	sarama.Client
+}
+
+func (c *producerClient) Config() *sarama.Config {
+	conf := sarama.NewConfig()
+	conf.Producer.Return.Successes = true
+	return conf
+}
+
+func (c *producerClient) Closed() bool {
+	return false
+}
+
+// BenchmarkPublishMessagesReconnect measures calling PublishMessages in a loop,
+// as callers reconnecting after every failure do.
+func BenchmarkPublishMessagesReconnect(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, shared := range []bool{false, true} {
+		b.Run(fmt.Sprintf("shared-%t", shared), func(b *testing.B) {
+			sink := &asyncMessageSink{client: &producerClient{}, Topic: "t1"}
+			if shared {
+				producer, err := sarama.NewAsyncProducerFromClient(sink.client)
+				require.NoError(b, err)
+				defer producer.Close()
+				sink.producer = producer
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = sink.PublishMessages(ctx, make(chan substrate.Message), make(chan substrate.Message))
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package kafka
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+const (
+	// progressWindow is the period over which the consumption rate is
+	// measured.
+	progressWindow = time.Minute
+	// progressSampleInterval is the minimum interval between the samples of
+	// the consumed offsets.
+	progressSampleInterval = time.Second
+)
+
+// ProgressReporter is implemented by the sources returned by
+// NewAsyncMessageSource, to report how far behind the claimed partitions are,
+// e.g. when restoring a consumer during disaster recovery.
+type ProgressReporter interface {
+	// Progress returns the progress of the partitions claimed in the
+	// current consumer group session, ordered by partition. Partitions are
+	// reported once a message has been consumed from them.
+	Progress() []PartitionProgress
+}
+
+// PartitionProgress is the progress of consuming a partition.
+type PartitionProgress struct {
+	Partition int32
+	// Offset is the offset of the next message to consume, that is after
+	// the last acknowledged message, or the offset of the first message
+	// consumed if none was acknowledged yet.
+	Offset int64
+	// HighWaterMark is the offset of the next message to be produced to the
+	// partition, as last fetched.
+	HighWaterMark int64
+	// Remaining is the number of messages from Offset to HighWaterMark.
+	Remaining int64
+	// Rate is the number of messages acknowledged per second over the last
+	// minute.
+	Rate float64
+	// ETA is the estimated time at which the remaining messages are
+	// consumed, at the current rate. It is zero if the rate is zero, and
+	// is the current time if no messages remain.
+	ETA time.Time
+}
+
+var _ ProgressReporter = (*asyncMessageSource)(nil)
+
+// Progress implements the ProgressReporter interface.
+func (ams *asyncMessageSource) Progress() []PartitionProgress {
+	return ams.progress.report()
+}
+
+// offsetSample is the offset acknowledged on a partition at some time.
+type offsetSample struct {
+	at     time.Time
+	offset int64
+}
+
+// partitionProgress holds the offsets of a claimed partition.
+type partitionProgress struct {
+	offset        int64
+	highWaterMark int64
+	// samples are the acknowledged offsets over the progress window, oldest
+	// first.
+	samples []offsetSample
+}
+
+// progressTracker records the offsets of the claimed partitions as messages
+// are consumed and acknowledged. A nil tracker records nothing.
+type progressTracker struct {
+	mu         sync.Mutex
+	partitions map[int32]*partitionProgress
+	now        func() time.Time
+}
+
+func newProgressTracker() *progressTracker {
+	return &progressTracker{
+		partitions: make(map[int32]*partitionProgress),
+		now:        time.Now,
+	}
+}
+
+// claimed drops the partitions that are no longer claimed, when a session
+// starts.
+func (t *progressTracker) claimed(topic string, sess sarama.ConsumerGroupSession) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	partitions := sess.Claims()[topic]
+	claimed := make(map[int32]bool, len(partitions))
+	for _, p := range partitions {
+		claimed[p] = true
+	}
+	for p := range t.partitions {
+		if !claimed[p] {
+			delete(t.partitions, p)
+		}
+	}
+}
+
+// consumed records a message consumed from a claim, along with the high water
+// mark of its partition.
+func (t *progressTracker) consumed(m *sarama.ConsumerMessage, claim sarama.ConsumerGroupClaim) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pp, ok := t.partitions[m.Partition]
+	if !ok {
+		pp = &partitionProgress{offset: m.Offset}
+		t.partitions[m.Partition] = pp
+	}
+	pp.highWaterMark = claim.HighWaterMarkOffset()
+}
+
+// acked records the offset of the next message to consume from a partition,
+// once a message is acknowledged.
+func (t *progressTracker) acked(partition int32, offset int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pp, ok := t.partitions[partition]
+	if !ok {
+		// The partition was revoked.
+		return
+	}
+	pp.offset = offset
+	now := t.now()
+	if n := len(pp.samples); n > 0 && now.Sub(pp.samples[n-1].at) < progressSampleInterval {
+		return
+	}
+	pp.samples = append(pp.samples, offsetSample{at: now, offset: offset})
+	// The oldest sample within the window is kept, along with the one
+	// before it, so that the rate covers the whole window.
+	for len(pp.samples) > 2 && now.Sub(pp.samples[1].at) >= progressWindow {
+		pp.samples = pp.samples[1:]
+	}
+}
+
+func (t *progressTracker) report() []PartitionProgress {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	progress := make([]PartitionProgress, 0, len(t.partitions))
+	for p, pp := range t.partitions {
+		pr := PartitionProgress{
+			Partition:     p,
+			Offset:        pp.offset,
+			HighWaterMark: pp.highWaterMark,
+		}
+		if pp.highWaterMark > pp.offset {
+			pr.Remaining = pp.highWaterMark - pp.offset
+		}
+		if len(pp.samples) > 0 {
+			oldest := pp.samples[0]
+			if elapsed := now.Sub(oldest.at); elapsed > 0 {
+				pr.Rate = float64(pp.offset-oldest.offset) / elapsed.Seconds()
+			}
+		}
+		switch {
+		case pr.Remaining == 0:
+			pr.ETA = now
+		case pr.Rate > 0:
+			pr.ETA = now.Add(time.Duration(float64(pr.Remaining) / pr.Rate * float64(time.Second)))
+		}
+		progress = append(progress, pr)
+	}
+	sort.Slice(progress, func(i, j int) bool {
+		return progress[i].Partition < progress[j].Partition
+	})
+	return progress
+}
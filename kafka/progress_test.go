@@ -0,0 +1,63 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+type highWaterMarkClaim struct {
+	*fakeClaim
+	highWaterMark int64
+}
+
+func (c *highWaterMarkClaim) HighWaterMarkOffset() int64 {
+	return c.highWaterMark
+}
+
+func TestProgress(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tracker := newProgressTracker()
+	tracker.now = func() time.Time { return now }
+
+	claim := &highWaterMarkClaim{fakeClaim: &fakeClaim{}, highWaterMark: 1000}
+	tracker.consumed(&sarama.ConsumerMessage{Partition: 1, Offset: 100}, claim)
+	tracker.consumed(&sarama.ConsumerMessage{Partition: 0, Offset: 10}, &highWaterMarkClaim{fakeClaim: &fakeClaim{}, highWaterMark: 10})
+	assert.Equal(t, []PartitionProgress{
+		{Partition: 0, Offset: 10, HighWaterMark: 10, ETA: now},
+		{Partition: 1, Offset: 100, HighWaterMark: 1000, Remaining: 900},
+	}, tracker.report())
+
+	// The rate is measured from the acknowledged offsets.
+	tracker.acked(1, 101)
+	for i := 1; i <= 10; i++ {
+		now = now.Add(time.Second)
+		tracker.acked(1, 101+int64(i)*10)
+	}
+	progress := tracker.report()[1]
+	assert.Equal(t, int64(201), progress.Offset)
+	assert.Equal(t, int64(799), progress.Remaining)
+	assert.Equal(t, 10.0, progress.Rate)
+	assert.WithinDuration(t, now.Add(79900*time.Millisecond), progress.ETA, time.Millisecond)
+
+	// The rate covers the last minute.
+	for i := 1; i <= 120; i++ {
+		now = now.Add(time.Second)
+		off := int64(201 + i*5)
+		tracker.acked(1, off)
+		tracker.consumed(&sarama.ConsumerMessage{Partition: 1, Offset: off - 1}, claim)
+	}
+	assert.InDelta(t, 5.0, tracker.report()[1].Rate, 0.1)
+
+	// Revoked partitions are no longer reported.
+	tracker.claimed("topic", newClaimsSession(1))
+	progress = tracker.report()[0]
+	assert.Equal(t, int32(1), progress.Partition)
+	assert.Len(t, tracker.report(), 1)
+
+	var none *progressTracker
+	none.acked(0, 1)
+	assert.Nil(t, none.report())
+}
@@ -0,0 +1,157 @@
+package kafka
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/uw-labs/substrate/internal/clock"
+	"golang.org/x/sync/errgroup"
+)
+
+// ErrPublishTimeout is the error of the messages that were neither written nor
+// failed within the PerMessageTimeout of a sink.
+var ErrPublishTimeout = errors.New("message not confirmed within the per message timeout")
+
+// publishDeadlines fails the messages produced by a PublishMessages call that
+// are not confirmed within the PerMessageTimeout, and suppresses the outcome
+// reported by sarama for them afterwards. As every message gets the same
+// timeout, deadlines expire in the order messages are submitted, so they are
+// kept in a list, oldest first. A nil publishDeadlines fails nothing.
+type publishDeadlines struct {
+	timeout time.Duration
+	clock   clock.Clock
+
+	mu sync.Mutex
+	// order holds the pending deadlines, oldest first, and pending holds
+	// their elements by message.
+	order   *list.List
+	pending map[*sarama.ProducerMessage]*list.Element
+	// expired holds the messages that were failed, whose outcome is yet to
+	// be reported by sarama.
+	expired map[*sarama.ProducerMessage]struct{}
+}
+
+// publishDeadline is the deadline of a message.
+type publishDeadline struct {
+	pm *sarama.ProducerMessage
+	at time.Time
+}
+
+func newPublishDeadlines(timeout time.Duration, c clock.Clock) *publishDeadlines {
+	if timeout <= 0 {
+		return nil
+	}
+	if c == nil {
+		c = clock.Real
+	}
+	return &publishDeadlines{
+		timeout: timeout,
+		clock:   c,
+		order:   list.New(),
+		pending: make(map[*sarama.ProducerMessage]*list.Element),
+		expired: make(map[*sarama.ProducerMessage]struct{}),
+	}
+}
+
+// submitted starts the deadline of a message, before it is sent to sarama.
+func (d *publishDeadlines) submitted(pm *sarama.ProducerMessage) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending[pm] = d.order.PushBack(publishDeadline{pm: pm, at: d.clock.Now().Add(d.timeout)})
+}
+
+// settled records the outcome of a message reported by sarama, and returns
+// whether it should be handled, which it shouldn't if the message was
+// already failed.
+func (d *publishDeadlines) settled(pm *sarama.ProducerMessage) bool {
+	if d == nil {
+		return true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.pending[pm]; ok {
+		d.order.Remove(e)
+		delete(d.pending, pm)
+		return true
+	}
+	if _, ok := d.expired[pm]; ok {
+		delete(d.expired, pm)
+		return false
+	}
+	// The message was not produced by this call.
+	return true
+}
+
+// expire removes the messages whose deadline has passed, and returns them
+// along with the time to wait until the next deadline.
+func (d *publishDeadlines) expire() ([]*sarama.ProducerMessage, time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.clock.Now()
+	var expired []*sarama.ProducerMessage
+	for e := d.order.Front(); e != nil; e = d.order.Front() {
+		pd := e.Value.(publishDeadline)
+		if pd.at.After(now) {
+			return expired, pd.at.Sub(now)
+		}
+		d.order.Remove(e)
+		delete(d.pending, pd.pm)
+		d.expired[pd.pm] = struct{}{}
+		expired = append(expired, pd.pm)
+	}
+	// The messages submitted from now on expire after the timeout at the
+	// earliest.
+	return expired, d.timeout
+}
+
+// watch returns the errors of the messages reported by sarama, except the
+// ones that were failed already, along with the errors of the messages
+// failed as their deadline passes.
+func (d *publishDeadlines) watch(ctx context.Context, eg *errgroup.Group, errs <-chan *sarama.ProducerError) <-chan *sarama.ProducerError {
+	out := make(chan *sarama.ProducerError)
+	eg.Go(func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case perr := <-errs:
+				if !d.settled(perr.Msg) {
+					continue
+				}
+				select {
+				case out <- perr:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	})
+	eg.Go(func() error {
+		for {
+			expired, wait := d.expire()
+			for _, pm := range expired {
+				select {
+				case out <- &sarama.ProducerError{Msg: pm, Err: ErrPublishTimeout}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			timer := d.clock.NewTimer(wait)
+			select {
+			case <-timer.C():
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+	})
+	return out
+}
@@ -0,0 +1,176 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/testutil"
+)
+
+func TestPerMessageTimeout(t *testing.T) {
+	// The producer never confirms the messages.
+	producer := newFakeProducer()
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	sink := &asyncMessageSink{Topic: "t1", timeout: time.Second, clock: clock}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	messages := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.doPublishMessages(ctx, producer, make(chan substrate.Message), messages)
+	}()
+
+	messages <- &reusedBufferMessage{data: []byte("data")}
+	pm := <-producer.input
+	clock.BlockUntil(1)
+	clock.Advance(time.Second - time.Millisecond)
+	select {
+	case err := <-errs:
+		t.Fatalf("message failed before the timeout: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(time.Millisecond)
+
+	err := <-errs
+	assert.Equal(t, &sarama.ProducerError{Msg: pm, Err: ErrPublishTimeout}, err)
+}
+
+func TestPerMessageTimeoutRetried(t *testing.T) {
+	producer := newFakeProducer()
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	retries := &produceRetries{attempts: 3, backoff: time.Second, clock: clock}
+	sink := &asyncMessageSink{Topic: "t1", retries: retries, timeout: 10 * time.Second, clock: clock}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	messages := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	go func() {
+		_ = sink.doPublishMessages(ctx, producer, acks, messages)
+	}()
+
+	msg := &reusedBufferMessage{data: []byte("data")}
+	messages <- msg
+	pm := <-producer.input
+
+	// The message times out, and is produced again after the backoff.
+	clock.BlockUntil(1)
+	clock.Advance(10 * time.Second)
+	clock.BlockUntil(2)
+	clock.Advance(time.Second)
+	retried := <-producer.input
+	assert.True(t, pm != retried)
+
+	// The late success of the message that timed out is ignored, and the
+	// message is acknowledged once its retry succeeds.
+	producer.successes <- pm
+	select {
+	case <-acks:
+		t.Fatal("message that timed out acknowledged")
+	case <-time.After(50 * time.Millisecond):
+	}
+	producer.successes <- retried
+	assert.Equal(t, substrate.Message(msg), <-acks)
+}
+
+func TestPerMessageTimeoutOnError(t *testing.T) {
+	type failure struct {
+		msg substrate.Message
+		err error
+	}
+	failures := make(chan failure, 1)
+	producer := newFakeProducer()
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	sink := &asyncMessageSink{Topic: "t1", timeout: time.Second, clock: clock,
+		onError: func(msg substrate.Message, err error) error {
+			failures <- failure{msg: msg, err: err}
+			return nil
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	messages := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.doPublishMessages(ctx, producer, acks, messages)
+	}()
+
+	msg1, msg2 := &reusedBufferMessage{data: []byte("1")}, &reusedBufferMessage{data: []byte("2")}
+	messages <- msg1
+	pm1 := <-producer.input
+	clock.BlockUntil(1)
+	clock.Advance(500 * time.Millisecond)
+	messages <- msg2
+	pm2 := <-producer.input
+
+	// The first message times out on its own, and is acknowledged once
+	// handled.
+	clock.Advance(500 * time.Millisecond)
+	assert.Equal(t, failure{msg: msg1, err: ErrPublishTimeout}, <-failures)
+	assert.Equal(t, substrate.Message(msg1), <-acks)
+
+	// The other messages keep flowing, and the late success of the message
+	// that timed out is ignored.
+	producer.successes <- pm1
+	producer.successes <- pm2
+	assert.Equal(t, substrate.Message(msg2), <-acks)
+	select {
+	case err := <-errs:
+		t.Fatalf("publishing terminated: %v", err)
+	case ack := <-acks:
+		t.Fatalf("unexpected ack: %v", ack)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestOnErrorFails(t *testing.T) {
+	errHandler := errors.New("dead letter sink unavailable")
+	producer := newFakeProducer()
+	sink := &asyncMessageSink{Topic: "t1",
+		onError: func(substrate.Message, error) error { return errHandler },
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	messages := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.doPublishMessages(ctx, producer, make(chan substrate.Message), messages)
+	}()
+
+	messages <- &reusedBufferMessage{data: []byte("data")}
+	producer.errors <- &sarama.ProducerError{Msg: <-producer.input, Err: sarama.ErrMessageSizeTooLarge}
+	assert.Equal(t, errHandler, <-errs)
+}
+
+func TestPublishDeadlinesExpireInOrder(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	d := newPublishDeadlines(time.Second, clock)
+	pm1, pm2, pm3 := &sarama.ProducerMessage{}, &sarama.ProducerMessage{}, &sarama.ProducerMessage{}
+	d.submitted(pm1)
+	clock.Advance(500 * time.Millisecond)
+	d.submitted(pm2)
+	d.submitted(pm3)
+	assert.True(t, d.settled(pm2))
+
+	expired, wait := d.expire()
+	assert.Empty(t, expired)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	clock.Advance(time.Second)
+	expired, wait = d.expire()
+	assert.Equal(t, []*sarama.ProducerMessage{pm1, pm3}, expired)
+	assert.Equal(t, time.Second, wait)
+
+	// The outcome of an expired message is reported once only.
+	assert.False(t, d.settled(pm1))
+	assert.True(t, d.settled(pm1))
+}
@@ -0,0 +1,60 @@
+package kafka
+
+import (
+	"fmt"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/unwrap"
+)
+
+// publishedMarker records the written messages in a PublishedRegistry, and
+// checks whether a message was written before it is published again. A nil
+// publishedMarker records nothing, and has seen nothing.
+type publishedMarker struct {
+	registry substrate.PublishedRegistry
+	idFunc   func(substrate.Message) string
+}
+
+func newPublishedMarker(registry substrate.PublishedRegistry, idFunc func(substrate.Message) string) *publishedMarker {
+	if registry == nil || idFunc == nil {
+		return nil
+	}
+	return &publishedMarker{registry: registry, idFunc: idFunc}
+}
+
+// id returns the ID of the original message published, which is empty for
+// messages without an ID.
+func (p *publishedMarker) id(msg substrate.Message) string {
+	return p.idFunc(unwrap.Unwrap(msg))
+}
+
+// mark records that a message was written.
+func (p *publishedMarker) mark(msg substrate.Message) error {
+	if p == nil {
+		return nil
+	}
+	id := p.id(msg)
+	if id == "" {
+		return nil
+	}
+	if err := p.registry.Mark(id); err != nil {
+		return fmt.Errorf("failed to mark message %s as published: %w", id, err)
+	}
+	return nil
+}
+
+// seen reports whether a message was written.
+func (p *publishedMarker) seen(msg substrate.Message) (bool, error) {
+	if p == nil {
+		return false, nil
+	}
+	id := p.id(msg)
+	if id == "" {
+		return false, nil
+	}
+	seen, err := p.registry.Seen(id)
+	if err != nil {
+		return false, fmt.Errorf("failed to check whether message %s was published: %w", id, err)
+	}
+	return seen, nil
+}
@@ -0,0 +1,54 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	"github.com/uw-labs/substrate"
+)
+
+var (
+	_ substrate.ReadinessChecker = (*orderedSink)(nil)
+	_ substrate.ReadinessChecker = (*asyncMessageSource)(nil)
+)
+
+// Ready implements the substrate.ReadinessChecker interface. It refreshes the
+// metadata of the topic, and checks that the leader of a partition is
+// reachable.
+func (s *orderedSink) Ready(ctx context.Context) error {
+	return ready(ctx, s.sink.client, s.sink.Topic)
+}
+
+// Ready implements the substrate.ReadinessChecker interface. It refreshes the
+// metadata of the topic, and checks that the leader of a partition is
+// reachable.
+func (ams *asyncMessageSource) Ready(ctx context.Context) error {
+	return ready(ctx, ams.client, ams.topic)
+}
+
+// ready checks that the topic has a writable partition whose leader is
+// reachable, by fetching its newest offset. Sarama doesn't support contexts,
+// so the context is checked between requests.
+func ready(ctx context.Context, client sarama.Client, topic string) error {
+	if err := client.RefreshMetadata(topic); err != nil {
+		return err
+	}
+	partitions, err := client.WritablePartitions(topic)
+	if err != nil {
+		return err
+	}
+	if len(partitions) == 0 {
+		return fmt.Errorf("topic %s has no writable partitions", topic)
+	}
+
+	for _, p := range partitions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err = client.GetOffset(topic, p, sarama.OffsetNewest); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("no partition leader of topic %s is reachable: %w", topic, err)
+}
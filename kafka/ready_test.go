@@ -0,0 +1,60 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+// readyClient is a client whose writable partitions and reachable partition
+// leaders are given.
+type readyClient struct {
+	sarama.Client
+
+	refreshErr error
+	writable   []int32
+	reachable  map[int32]bool
+	refreshed  []string
+}
+
+func (c *readyClient) RefreshMetadata(topics ...string) error {
+	c.refreshed = append(c.refreshed, topics...)
+	return c.refreshErr
+}
+
+func (c *readyClient) WritablePartitions(string) ([]int32, error) {
+	return c.writable, nil
+}
+
+func (c *readyClient) GetOffset(_ string, partition int32, _ int64) (int64, error) {
+	if !c.reachable[partition] {
+		return 0, errors.New("connection refused")
+	}
+	return 10, nil
+}
+
+func TestReady(t *testing.T) {
+	ctx := context.Background()
+
+	client := &readyClient{writable: []int32{0, 1}, reachable: map[int32]bool{1: true}}
+	assert.NoError(t, ready(ctx, client, "topic"))
+	assert.Equal(t, []string{"topic"}, client.refreshed)
+
+	client = &readyClient{writable: []int32{0, 1}}
+	assert.EqualError(t, ready(ctx, client, "topic"), "no partition leader of topic topic is reachable: connection refused")
+
+	client = &readyClient{}
+	assert.EqualError(t, ready(ctx, client, "topic"), "topic topic has no writable partitions")
+
+	refreshErr := errors.New("kafka: client has run out of available brokers")
+	client = &readyClient{refreshErr: refreshErr}
+	assert.Equal(t, refreshErr, ready(ctx, client, "topic"))
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	client = &readyClient{writable: []int32{0}, reachable: map[int32]bool{0: true}}
+	assert.Equal(t, context.Canceled, ready(cancelled, client, "topic"))
+}
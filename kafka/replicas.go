@@ -0,0 +1,82 @@
+package kafka
+
+import (
+	"fmt"
+
+	"github.com/Shopify/sarama"
+)
+
+// replicaLocator finds the brokers the claimed partitions are fetched from.
+// The leader of a partition tells consumers with a rack id which replica to
+// fetch from, and sarama follows it, so the locator asks the leader the same.
+type replicaLocator struct {
+	client sarama.Client
+	topic  string
+	rackID string
+	// preferredReplica returns the id of the replica the leader selects for
+	// fetching the partition from the offset, or -1 for the leader itself.
+	preferredReplica func(leader *sarama.Broker, partition int32, offset int64) (int32, error)
+}
+
+func newReplicaLocator(client sarama.Client, topic, rackID string) *replicaLocator {
+	l := &replicaLocator{client: client, topic: topic, rackID: rackID}
+	l.preferredReplica = l.fetchPreferredReplica
+	return l
+}
+
+// fetchPreferredReplica sends the leader a fetch request from the offset, as
+// sarama does, and returns the preferred read replica of the response.
+func (l *replicaLocator) fetchPreferredReplica(leader *sarama.Broker, partition int32, offset int64) (int32, error) {
+	req := &sarama.FetchRequest{
+		Version:  11,
+		MaxBytes: 1,
+		RackID:   l.rackID,
+		// A session epoch of -1 makes a full fetch without creating a
+		// fetch session on the broker.
+		SessionEpoch: -1,
+	}
+	req.AddBlock(l.topic, partition, offset, 1)
+	resp, err := leader.Fetch(req)
+	if err != nil {
+		return 0, err
+	}
+	block := resp.GetBlock(l.topic, partition)
+	if block == nil {
+		return 0, fmt.Errorf("no fetch response for partition %d", partition)
+	}
+	if block.Err != sarama.ErrNoError {
+		return 0, block.Err
+	}
+	return block.PreferredReadReplica, nil
+}
+
+// fetchBroker returns the id of the broker the partition is fetched from.
+func (l *replicaLocator) fetchBroker(partition int32, offset int64) (int32, error) {
+	leader, err := l.client.Leader(l.topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	if l.rackID == "" {
+		return leader.ID(), nil
+	}
+	replica, err := l.preferredReplica(leader, partition, offset)
+	if err != nil {
+		return 0, err
+	}
+	if replica < 0 {
+		return leader.ID(), nil
+	}
+	return replica, nil
+}
+
+// fetchBrokers returns the ids of the brokers the partitions are fetched from,
+// by partition. Partitions whose broker can't be found are omitted.
+func (l *replicaLocator) fetchBrokers(partitions []PartitionProgress) map[int32]int32 {
+	brokers := make(map[int32]int32, len(partitions))
+	for _, p := range partitions {
+		if broker, err := l.fetchBroker(p.Partition, p.Offset); err == nil {
+			brokers[p.Partition] = broker
+		}
+	}
+	return brokers
+}
@@ -0,0 +1,52 @@
+package kafka
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+type leaderClient struct {
+	sarama.Client
+
+	leaders map[int32]*sarama.Broker
+}
+
+func (c *leaderClient) Leader(_ string, partition int32) (*sarama.Broker, error) {
+	leader, ok := c.leaders[partition]
+	if !ok {
+		return nil, sarama.ErrLeaderNotAvailable
+	}
+	return leader, nil
+}
+
+func TestFetchBrokers(t *testing.T) {
+	leader := sarama.NewBroker("localhost:9092")
+	client := &leaderClient{leaders: map[int32]*sarama.Broker{0: leader, 1: leader, 2: leader}}
+	partitions := []PartitionProgress{{Partition: 0, Offset: 10}, {Partition: 1, Offset: 20}, {Partition: 2}, {Partition: 3}}
+
+	// Without a rack id, partitions are fetched from their leader.
+	l := newReplicaLocator(client, "orders", "")
+	l.preferredReplica = func(*sarama.Broker, int32, int64) (int32, error) {
+		t.Fatal("unexpected fetch request")
+		return 0, nil
+	}
+	assert.Equal(t, map[int32]int32{0: leader.ID(), 1: leader.ID(), 2: leader.ID()}, l.fetchBrokers(partitions))
+
+	l = newReplicaLocator(client, "orders", "eu-west-1a")
+	l.preferredReplica = func(b *sarama.Broker, partition int32, offset int64) (int32, error) {
+		assert.Equal(t, leader, b)
+		switch partition {
+		case 0:
+			assert.Equal(t, int64(10), offset)
+			return 3, nil
+		case 1:
+			return -1, nil
+		default:
+			return 0, errors.New("fetch failed")
+		}
+	}
+	assert.Equal(t, map[int32]int32{0: 3, 1: leader.ID()}, l.fetchBrokers(partitions))
+}
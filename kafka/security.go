@@ -0,0 +1,148 @@
+package kafka
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// SASLConfig is the configuration of SASL authentication with the brokers.
+type SASLConfig struct {
+	// Mechanism defaults to sarama.SASLTypePlaintext.
+	Mechanism sarama.SASLMechanism
+	User      string
+	Password  string
+	// PasswordFunc, if set, is called for the password every time a
+	// connection to a broker is authenticated, e.g. to read a password that
+	// is rotated, instead of using Password. It requires a SCRAM mechanism,
+	// as sarama reads the password of the other mechanisms only once.
+	PasswordFunc func() (string, error)
+	// SCRAMClientGeneratorFunc returns the SCRAM client to authenticate
+	// with, and is required by the SCRAM mechanisms.
+	SCRAMClientGeneratorFunc func() sarama.SCRAMClient
+}
+
+// applySecurity enables TLS and SASL authentication on the sarama config, as
+// set on the source or sink config.
+func applySecurity(conf *sarama.Config, tlsConfig *tls.Config, sasl *SASLConfig) error {
+	if tlsConfig != nil {
+		conf.Net.TLS.Enable = true
+		conf.Net.TLS.Config = tlsConfig
+	}
+	if sasl == nil {
+		return nil
+	}
+
+	conf.Net.SASL.Enable = true
+	conf.Net.SASL.Handshake = true
+	conf.Net.SASL.Mechanism = sasl.Mechanism
+	if conf.Net.SASL.Mechanism == "" {
+		conf.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	}
+	conf.Net.SASL.User = sasl.User
+	conf.Net.SASL.Password = sasl.Password
+
+	scram := conf.Net.SASL.Mechanism == sarama.SASLTypeSCRAMSHA256 || conf.Net.SASL.Mechanism == sarama.SASLTypeSCRAMSHA512
+	if scram && sasl.SCRAMClientGeneratorFunc == nil {
+		return errors.New("SCRAM authentication requires a SCRAM client generator")
+	}
+	if sasl.PasswordFunc == nil {
+		conf.Net.SASL.SCRAMClientGeneratorFunc = sasl.SCRAMClientGeneratorFunc
+		return nil
+	}
+	if !scram {
+		return errors.New("a SASL password func requires a SCRAM mechanism")
+	}
+	conf.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+		return &passwordFuncSCRAMClient{
+			SCRAMClient: sasl.SCRAMClientGeneratorFunc(),
+			password:    sasl.PasswordFunc,
+		}
+	}
+	return nil
+}
+
+// passwordFuncSCRAMClient is a SCRAM client that begins the authentication
+// with the password returned by a PasswordFunc.
+type passwordFuncSCRAMClient struct {
+	sarama.SCRAMClient
+	password func() (string, error)
+}
+
+func (c *passwordFuncSCRAMClient) Begin(userName, _, authzID string) error {
+	password, err := c.password()
+	if err != nil {
+		return err
+	}
+	return c.SCRAMClient.Begin(userName, password, authzID)
+}
+
+// CertificateReloader loads a client certificate and its key from files, and
+// loads them again once the files change, e.g. when they are rotated by a
+// sidecar. Its GetClientCertificate method is set on the tls.Config of a
+// source or sink, so that every new connection to a broker uses the current
+// certificate. Established connections are not affected. If loading the
+// changed files fails, e.g. because only one of them was written yet, the
+// previous certificate is used until the next connection. A reloader is safe
+// for concurrent use.
+type CertificateReloader struct {
+	certFile, keyFile string
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+	// certMod and keyMod are the modification times of the loaded files.
+	certMod, keyMod time.Time
+}
+
+// NewCertificateReloader returns a reloader of the certificate in certFile
+// and the key in keyFile, which must be loadable.
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	r := &CertificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetClientCertificate returns the current certificate, for the field of the
+// same name of tls.Config.
+func (r *CertificateReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_ = r.reloadLocked()
+	return r.cert, nil
+}
+
+func (r *CertificateReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.reloadLocked()
+}
+
+// reloadLocked loads the files if they changed since they were loaded.
+func (r *CertificateReloader) reloadLocked() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && certInfo.ModTime().Equal(r.certMod) && keyInfo.ModTime().Equal(r.keyMod) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.certMod, r.keyMod = certInfo.ModTime(), keyInfo.ModTime()
+	return nil
+}
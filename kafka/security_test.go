@@ -0,0 +1,140 @@
+package kafka
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCertificate writes a self signed certificate for the common name, and
+// its key, with the given modification time.
+func writeCertificate(t *testing.T, certFile, keyFile, commonName string, mod time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	require.NoError(t, os.Chtimes(certFile, mod, mod))
+	require.NoError(t, os.Chtimes(keyFile, mod, mod))
+}
+
+func commonName(t *testing.T, cert *tls.Certificate) string {
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return parsed.Subject.CommonName
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	_, err = NewCertificateReloader(certFile, keyFile)
+	assert.Error(t, err)
+
+	mod := time.Now().Add(-time.Hour)
+	writeCertificate(t, certFile, keyFile, "first", mod)
+	r, err := NewCertificateReloader(certFile, keyFile)
+	require.NoError(t, err)
+	conf := &tls.Config{GetClientCertificate: r.GetClientCertificate}
+
+	cert, err := conf.GetClientCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "first", commonName(t, cert))
+
+	// The certificate is rotated.
+	writeCertificate(t, certFile, keyFile, "second", mod.Add(time.Minute))
+	cert, err = conf.GetClientCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "second", commonName(t, cert))
+
+	// A partially written rotation keeps the previous certificate.
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("partial"), 0600))
+	cert, err = conf.GetClientCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "second", commonName(t, cert))
+}
+
+type fakeSCRAMClient struct {
+	user, password string
+}
+
+func (c *fakeSCRAMClient) Begin(userName, password, _ string) error {
+	c.user, c.password = userName, password
+	return nil
+}
+
+func (c *fakeSCRAMClient) Step(string) (string, error) { return "", nil }
+func (c *fakeSCRAMClient) Done() bool                  { return true }
+
+func TestSASLPasswordFunc(t *testing.T) {
+	password := "first"
+	conf, err := (&AsyncMessageSourceConfig{SASL: &SASLConfig{
+		Mechanism:                sarama.SASLTypeSCRAMSHA512,
+		User:                     "user",
+		PasswordFunc:             func() (string, error) { return password, nil },
+		SCRAMClientGeneratorFunc: func() sarama.SCRAMClient { return &fakeSCRAMClient{} },
+	}}).buildSaramaConsumerConfig()
+	require.NoError(t, err)
+	assert.True(t, conf.Net.SASL.Enable)
+	assert.Equal(t, "user", conf.Net.SASL.User)
+
+	// Every authentication uses the current password.
+	for _, p := range []string{"first", "second"} {
+		password = p
+		client := conf.Net.SASL.SCRAMClientGeneratorFunc()
+		require.NoError(t, client.Begin(conf.Net.SASL.User, conf.Net.SASL.Password, ""))
+		assert.Equal(t, p, client.(*passwordFuncSCRAMClient).SCRAMClient.(*fakeSCRAMClient).password)
+	}
+
+	failure := errors.New("secret unavailable")
+	conf, err = (&AsyncMessageSinkConfig{SASL: &SASLConfig{
+		Mechanism:                sarama.SASLTypeSCRAMSHA256,
+		PasswordFunc:             func() (string, error) { return "", failure },
+		SCRAMClientGeneratorFunc: func() sarama.SCRAMClient { return &fakeSCRAMClient{} },
+	}}).buildSaramaProducerConfig()
+	require.NoError(t, err)
+	assert.Equal(t, failure, conf.Net.SASL.SCRAMClientGeneratorFunc().Begin("", "", ""))
+}
+
+func TestSecurityConfig(t *testing.T) {
+	tlsConfig := &tls.Config{}
+	conf, err := (&AsyncMessageSinkConfig{TLS: tlsConfig, SASL: &SASLConfig{User: "user", Password: "password"}}).buildSaramaProducerConfig()
+	require.NoError(t, err)
+	assert.True(t, conf.Net.TLS.Enable)
+	assert.Equal(t, tlsConfig, conf.Net.TLS.Config)
+	assert.Equal(t, sarama.SASLTypePlaintext, conf.Net.SASL.Mechanism)
+	assert.Equal(t, "password", conf.Net.SASL.Password)
+
+	// Sarama reads the password of the plain mechanism once.
+	_, err = (&AsyncMessageSourceConfig{SASL: &SASLConfig{PasswordFunc: func() (string, error) { return "", nil }}}).buildSaramaConsumerConfig()
+	assert.Error(t, err)
+	_, err = (&AsyncMessageSourceConfig{SASL: &SASLConfig{Mechanism: sarama.SASLTypeSCRAMSHA256}}).buildSaramaConsumerConfig()
+	assert.Error(t, err)
+}
@@ -0,0 +1,86 @@
+package kafka
+
+import "sync"
+
+// OffsetSkipper is implemented by the sources returned by
+// NewAsyncMessageSource, to skip poison messages while the source is running,
+// e.g. from an admin endpoint, rather than restarting it with SkipOffsets.
+type OffsetSkipper interface {
+	// Skip skips the message at the offset of the partition, if it is not
+	// delivered yet, as if it was listed in SkipOffsets. A message that is
+	// already delivered must be acknowledged as usual, but is skipped if it
+	// is redelivered, e.g. after a rebalance.
+	Skip(partition int32, offset int64)
+}
+
+var _ OffsetSkipper = (*asyncMessageSource)(nil)
+
+// Skip implements the OffsetSkipper interface.
+func (ams *asyncMessageSource) Skip(partition int32, offset int64) {
+	ams.skips.add(partition, offset)
+}
+
+// offsetSkips holds the offsets of the messages that are skipped. A nil
+// offsetSkips skips nothing.
+type offsetSkips struct {
+	shouldSkip func(partition int32, offset int64) bool
+
+	mu      sync.RWMutex
+	offsets map[int32]map[int64]struct{}
+}
+
+func newOffsetSkips(c AsyncMessageSourceConfig) *offsetSkips {
+	s := &offsetSkips{
+		shouldSkip: c.ShouldSkip,
+		offsets:    make(map[int32]map[int64]struct{}),
+	}
+	for partition, offsets := range c.SkipOffsets {
+		for _, offset := range offsets {
+			s.add(partition, offset)
+		}
+	}
+	return s
+}
+
+func (s *offsetSkips) add(partition int32, offset int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offsets, ok := s.offsets[partition]
+	if !ok {
+		offsets = make(map[int64]struct{})
+		s.offsets[partition] = offsets
+	}
+	offsets[offset] = struct{}{}
+}
+
+// skips reports whether the message at the offset of the partition is
+// skipped.
+func (s *offsetSkips) skips(partition int32, offset int64) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.RLock()
+	_, ok := s.offsets[partition][offset]
+	s.mu.RUnlock()
+	if ok {
+		return true
+	}
+	return s.shouldSkip != nil && s.shouldSkip(partition, offset)
+}
+
+// checkSkip sets skippedOffset if the message is at a skipped offset, and
+// discards its payload.
+func (ap *kafkaAcksProcessor) checkSkip(msg *consumerMessage) {
+	if msg.dropped() || !ap.skips.skips(msg.cm.Partition, msg.cm.Offset) {
+		return
+	}
+	ap.debugger.Logf("substrate : consumer - skipped message at offset %d of partition %d\n", msg.cm.Offset, msg.cm.Partition)
+	msg.skippedOffset = true
+	if ap.onSkipped != nil {
+		ap.onSkipped(msg)
+	}
+	msg.DiscardPayload()
+}
@@ -0,0 +1,99 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+)
+
+func TestOffsetSkips(t *testing.T) {
+	assert.False(t, (*offsetSkips)(nil).skips(0, 1))
+
+	s := newOffsetSkips(AsyncMessageSourceConfig{
+		SkipOffsets: map[int32][]int64{0: {4, 7}, 2: {1}},
+		ShouldSkip: func(partition int32, offset int64) bool {
+			return partition == 1 && offset > 100
+		},
+	})
+	assert.True(t, s.skips(0, 4))
+	assert.True(t, s.skips(0, 7))
+	assert.False(t, s.skips(0, 5))
+	assert.True(t, s.skips(2, 1))
+	assert.False(t, s.skips(1, 1))
+	assert.True(t, s.skips(1, 101))
+
+	s.add(1, 5)
+	assert.True(t, s.skips(1, 5))
+}
+
+func TestSkippedMessagesAreDropped(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	fromKafka := make(chan *consumerMessage)
+	toClient := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	sessCh := make(chan sarama.ConsumerGroupSession)
+	source := &asyncMessageSource{
+		requests: make(chan sessionRequest),
+		skips:    newOffsetSkips(AsyncMessageSourceConfig{SkipOffsets: map[int32][]int64{0: {5}}}),
+	}
+
+	var skipped []int64
+	ap := &kafkaAcksProcessor{
+		toClient:    toClient,
+		fromKafka:   fromKafka,
+		acks:        acks,
+		sessCh:      sessCh,
+		rebalanceCh: make(chan struct{}),
+		requests:    source.requests,
+		skips:       source.skips,
+		onSkipped: func(msg Message) {
+			assert.Equal(t, []byte("poison"), msg.Data())
+			skipped = append(skipped, msg.Offset())
+		},
+	}
+	go func() {
+		_ = ap.run(ctx)
+	}()
+	sessCh <- &fakeSession{marked: make(map[int32]int64)}
+
+	first := &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "topic", Offset: 4, Value: []byte("first")}}
+	fromKafka <- first
+	delivered := <-toClient
+	assert.Equal(t, first, delivered)
+
+	// The skipped message is acknowledged once the message before it is.
+	poison := &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "topic", Offset: 5, Value: []byte("poison")}}
+	fromKafka <- poison
+	marked, err := source.MarkedOffsets(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, marked)
+
+	acks <- delivered
+	marked, err = source.MarkedOffsets(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[int32]int64{0: 6}, marked)
+	assert.Equal(t, []int64{5}, skipped)
+	// The payload of the skipped message is released.
+	assert.Nil(t, poison.cm)
+
+	// Messages skipped while the source is running are skipped from the
+	// next message on.
+	source.Skip(0, 6)
+	fromKafka <- &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "topic", Offset: 6, Value: []byte("poison")}}
+	marked, err = source.MarkedOffsets(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[int32]int64{0: 7}, marked)
+	assert.Equal(t, []int64{5, 6}, skipped)
+
+	last := &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "topic", Offset: 7, Value: []byte("last")}}
+	fromKafka <- last
+	assert.Equal(t, last, <-toClient)
+}
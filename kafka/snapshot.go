@@ -0,0 +1,146 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// snapshot tracks whether the source has caught up with the messages that
+// were in the claimed partitions when they were first claimed, for reading
+// compacted topics as a snapshot before consuming live updates.
+type snapshot struct {
+	caughtUp func()
+	maxIdle  time.Duration
+
+	mu sync.Mutex
+	// targets holds, by partition, the newest offset when the partition was
+	// first claimed, which is the offset of its next message.
+	targets map[int32]int64
+	// reached holds the partitions that have been consumed up to their
+	// target.
+	reached map[int32]bool
+	claims  []int32
+	done    bool
+}
+
+func newSnapshot(c AsyncMessageSourceConfig) *snapshot {
+	if c.CaughtUp == nil {
+		return nil
+	}
+	return &snapshot{
+		caughtUp: c.CaughtUp,
+		maxIdle:  c.MaxIdle,
+		targets:  make(map[int32]int64),
+		reached:  make(map[int32]bool),
+	}
+}
+
+// recordTargets records the newest offsets of the partitions claimed for the
+// first time. Empty partitions have reached their target straight away.
+func (s *snapshot) recordTargets(client sarama.Client, topic string, sess sarama.ConsumerGroupSession) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	claims := sess.Claims()[topic]
+	for _, partition := range claims {
+		if _, ok := s.targets[partition]; ok {
+			continue
+		}
+		newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.targets[partition] = newest
+		if oldest >= newest {
+			s.reached[partition] = true
+		}
+	}
+	s.claims = claims
+	notify := s.checkDone()
+	s.mu.Unlock()
+
+	if notify {
+		s.caughtUp()
+	}
+	return nil
+}
+
+// started is called when consuming a partition starts from initialOffset,
+// which is either an offset or OffsetNewest or OffsetOldest.
+func (s *snapshot) started(partition int32, initialOffset int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	target, ok := s.targets[partition]
+	s.mu.Unlock()
+	if ok && (initialOffset == sarama.OffsetNewest || initialOffset >= target) {
+		s.reach(partition)
+	}
+}
+
+// acked is called when the message at offset is acknowledged.
+func (s *snapshot) acked(partition int32, offset int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	target, ok := s.targets[partition]
+	s.mu.Unlock()
+	if ok && offset+1 >= target {
+		s.reach(partition)
+	}
+}
+
+// idleTimeout returns the time after which an idle partition is considered
+// to have reached its target, or zero if idle partitions are not.
+func (s *snapshot) idleTimeout() time.Duration {
+	if s == nil {
+		return 0
+	}
+	return s.maxIdle
+}
+
+// reach marks the partition as having reached its target, and calls the
+// caught up callback if all the claimed partitions have.
+func (s *snapshot) reach(partition int32) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.reached[partition] {
+		s.mu.Unlock()
+		return
+	}
+	s.reached[partition] = true
+	notify := s.checkDone()
+	s.mu.Unlock()
+
+	if notify {
+		s.caughtUp()
+	}
+}
+
+// checkDone reports whether all the claimed partitions have just reached
+// their target. It must be called with the lock held.
+func (s *snapshot) checkDone() bool {
+	if s.done || len(s.claims) == 0 {
+		return false
+	}
+	for _, p := range s.claims {
+		if !s.reached[p] {
+			return false
+		}
+	}
+	s.done = true
+	return true
+}
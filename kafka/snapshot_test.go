@@ -0,0 +1,136 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/substrate"
+)
+
+type partitionOffsetsClient struct {
+	sarama.Client
+
+	oldest map[int32]int64
+	newest map[int32]int64
+}
+
+func (c *partitionOffsetsClient) GetOffset(_ string, partition int32, time int64) (int64, error) {
+	if time == sarama.OffsetOldest {
+		return c.oldest[partition], nil
+	}
+	return c.newest[partition], nil
+}
+
+type snapshotTest struct {
+	sess     *claimsSession
+	handler  *consumerGroupHandler
+	toClient chan substrate.Message
+	acks     chan substrate.Message
+	caughtUp chan struct{}
+}
+
+func newSnapshotTest(ctx context.Context, t *testing.T, c AsyncMessageSourceConfig, client sarama.Client, partitions ...int32) *snapshotTest {
+	st := &snapshotTest{
+		sess:     newClaimsSession(partitions...),
+		toClient: make(chan substrate.Message),
+		acks:     make(chan substrate.Message),
+		caughtUp: make(chan struct{}, 2),
+	}
+	c.CaughtUp = func() { st.caughtUp <- struct{}{} }
+	snap := newSnapshot(c)
+
+	toAck := make(chan *consumerMessage)
+	sessCh := make(chan sarama.ConsumerGroupSession, 1)
+	ap := &kafkaAcksProcessor{
+		toClient:    st.toClient,
+		fromKafka:   toAck,
+		acks:        st.acks,
+		sessCh:      sessCh,
+		rebalanceCh: make(chan struct{}),
+		topic:       "topic",
+		snapshot:    snap,
+	}
+	go func() {
+		_ = ap.run(ctx)
+	}()
+	st.handler = &consumerGroupHandler{
+		ctx:      ctx,
+		client:   client,
+		topic:    "topic",
+		toAck:    toAck,
+		sessCh:   sessCh,
+		snapshot: snap,
+	}
+	require.NoError(t, st.handler.Setup(st.sess))
+	return st
+}
+
+func (st *snapshotTest) claim(partition int32, initialOffset int64) chan *sarama.ConsumerMessage {
+	claim := &fakeClaim{partition: partition, initialOffset: initialOffset, messages: make(chan *sarama.ConsumerMessage)}
+	go func() {
+		_ = st.handler.ConsumeClaim(st.sess, claim)
+	}()
+	return claim.messages
+}
+
+func (st *snapshotTest) assertNotCaughtUp(t *testing.T) {
+	select {
+	case <-st.caughtUp:
+		t.Error("caught up too early")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestSnapshotCaughtUp(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := &partitionOffsetsClient{
+		// Partition 1 is empty, and partition 2 was already consumed.
+		oldest: map[int32]int64{0: 0, 1: 5, 2: 0},
+		newest: map[int32]int64{0: 3, 1: 5, 2: 8},
+	}
+	st := newSnapshotTest(ctx, t, AsyncMessageSourceConfig{}, client, 0, 1, 2)
+	claim0 := st.claim(0, sarama.OffsetOldest)
+	st.claim(1, sarama.OffsetOldest)
+	st.claim(2, 8)
+
+	// Offset 1 has been removed by compaction.
+	claim0 <- &sarama.ConsumerMessage{Topic: "topic", Partition: 0, Offset: 0}
+	st.acks <- <-st.toClient
+	claim0 <- &sarama.ConsumerMessage{Topic: "topic", Partition: 0, Offset: 2}
+	m := <-st.toClient
+	st.assertNotCaughtUp(t)
+
+	st.acks <- m
+	<-st.caughtUp
+
+	// Live updates are delivered, without calling CaughtUp again.
+	claim0 <- &sarama.ConsumerMessage{Topic: "topic", Partition: 0, Offset: 3}
+	st.acks <- <-st.toClient
+	st.assertNotCaughtUp(t)
+}
+
+func TestSnapshotCaughtUpWhenIdle(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := &partitionOffsetsClient{
+		oldest: map[int32]int64{0: 0},
+		newest: map[int32]int64{0: 5},
+	}
+	st := newSnapshotTest(ctx, t, AsyncMessageSourceConfig{MaxIdle: 50 * time.Millisecond}, client, 0)
+	claim := st.claim(0, sarama.OffsetOldest)
+
+	// The newest messages have been removed by compaction, so the partition
+	// is caught up once it's idle.
+	claim <- &sarama.ConsumerMessage{Topic: "topic", Partition: 0, Offset: 3}
+	st.acks <- <-st.toClient
+	<-st.caughtUp
+
+	assert.Nil(t, newSnapshot(AsyncMessageSourceConfig{}))
+}
@@ -0,0 +1,134 @@
+package kafka
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/uw-labs/substrate/internal/clock"
+	"github.com/uw-labs/substrate/internal/debug"
+)
+
+// StallReport describes a source that hasn't had a message acknowledged for
+// StallTimeout, while messages were in flight.
+type StallReport struct {
+	// Topic is the topic of the source.
+	Topic string
+	// Stalled is how long the source has been waiting for an
+	// acknowledgement.
+	Stalled time.Duration
+	// InFlight are the messages delivered and not acknowledged yet, in the
+	// order they must be acknowledged in.
+	InFlight []InFlightMessage
+}
+
+// InFlightMessage is a message delivered by a source and not acknowledged
+// yet. Its payload is not included.
+type InFlightMessage struct {
+	Partition int32
+	Offset    int64
+	// Age is how long ago the message was delivered.
+	Age time.Duration
+}
+
+// stallDetector reports the in-flight messages once no message has been
+// acknowledged for the timeout. It is owned by the acks processor.
+type stallDetector struct {
+	topic    string
+	timeout  time.Duration
+	onStall  func(StallReport)
+	clock    clock.Clock
+	debugger debug.Debugger
+
+	// lastAck is when a message was last acknowledged.
+	lastAck time.Time
+	// reported is set once the current stall has been reported.
+	reported bool
+}
+
+func newStallDetector(c AsyncMessageSourceConfig, debugger debug.Debugger) *stallDetector {
+	if c.StallTimeout <= 0 {
+		return nil
+	}
+	return &stallDetector{
+		topic:    c.Topic,
+		timeout:  c.StallTimeout,
+		onStall:  c.OnStall,
+		clock:    clock.Real,
+		debugger: debugger,
+	}
+}
+
+// ticks returns the channel ticking when stalls should be checked for, and
+// the function stopping it. The channel is nil if stalls aren't detected.
+func (d *stallDetector) ticks() (<-chan time.Time, func()) {
+	if d == nil {
+		return nil, func() {}
+	}
+	d.acked()
+	ticker := d.clock.NewTicker(d.timeout / 2)
+	return ticker.C(), ticker.Stop
+}
+
+// delivered records when the message was delivered.
+func (d *stallDetector) delivered(msg *consumerMessage) {
+	if d == nil {
+		return
+	}
+	msg.delivered = d.clock.Now()
+}
+
+// acked records that a message was acknowledged, ending the current stall.
+func (d *stallDetector) acked() {
+	if d == nil {
+		return
+	}
+	d.lastAck = d.clock.Now()
+	d.reported = false
+}
+
+// check reports the in-flight messages if none was acknowledged for the
+// timeout, once per stall. The report is built here, as the messages are
+// owned by the acks processor, but the callback is called from a separate
+// goroutine, so that it doesn't delay consuming.
+func (d *stallDetector) check(inFlight []*consumerMessage) {
+	if d == nil || d.reported || len(inFlight) == 0 {
+		return
+	}
+	now := d.clock.Now()
+	// Time spent without messages in flight isn't a stall.
+	since := d.lastAck
+	if inFlight[0].delivered.After(since) {
+		since = inFlight[0].delivered
+	}
+	stalled := now.Sub(since)
+	if stalled < d.timeout {
+		return
+	}
+	d.reported = true
+
+	report := StallReport{
+		Topic:    d.topic,
+		Stalled:  stalled,
+		InFlight: make([]InFlightMessage, len(inFlight)),
+	}
+	for i, msg := range inFlight {
+		report.InFlight[i] = InFlightMessage{
+			Partition: msg.Partition(),
+			Offset:    msg.Offset(),
+			Age:       now.Sub(msg.delivered),
+		}
+	}
+	d.debugger.Logf("substrate : consumer - %s\n", report)
+	if d.onStall != nil {
+		go d.onStall(report)
+	}
+}
+
+func (r StallReport) String() string {
+	s := fmt.Sprintf("no message of topic %s acknowledged for %s, %d in flight", r.Topic, r.Stalled, len(r.InFlight))
+	if len(r.InFlight) > 0 {
+		oldest := r.InFlight[0]
+		s += fmt.Sprintf(", oldest at offset %d of partition %d delivered %s ago", oldest.Offset, oldest.Partition, oldest.Age)
+	}
+	return s
+}
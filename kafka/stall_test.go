@@ -0,0 +1,119 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/debug"
+	"github.com/uw-labs/substrate/internal/testutil"
+)
+
+func TestStallReport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	reports := make(chan StallReport, 2)
+	fromKafka := make(chan *consumerMessage)
+	toClient := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	sessCh := make(chan sarama.ConsumerGroupSession)
+	source := &asyncMessageSource{requests: make(chan sessionRequest)}
+
+	ap := &kafkaAcksProcessor{
+		toClient:    toClient,
+		fromKafka:   fromKafka,
+		acks:        acks,
+		sessCh:      sessCh,
+		rebalanceCh: make(chan struct{}),
+		requests:    source.requests,
+		stalls: &stallDetector{
+			topic:   "topic",
+			timeout: 10 * time.Second,
+			onStall: func(r StallReport) { reports <- r },
+			clock:   clock,
+		},
+	}
+	go func() {
+		_ = ap.run(ctx)
+	}()
+	sessCh <- &fakeSession{marked: make(map[int32]int64)}
+	clock.BlockUntil(1)
+
+	// deliver passes a message to the client, and waits for the acks
+	// processor to record its delivery.
+	deliver := func(partition int32, offset int64) substrate.Message {
+		fromKafka <- &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "topic", Partition: partition, Offset: offset}}
+		msg := <-toClient
+		_, err := source.MarkedOffsets(ctx)
+		require.NoError(t, err)
+		return msg
+	}
+	expectReport := func(expected StallReport) {
+		select {
+		case r := <-reports:
+			assert.Equal(t, expected, r)
+		case <-ctx.Done():
+			t.Fatal("stall not reported")
+		}
+	}
+	expectNoReport := func() {
+		select {
+		case r := <-reports:
+			t.Fatalf("unexpected stall report: %s", r)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	// Time without messages in flight isn't a stall.
+	clock.Advance(20 * time.Second)
+	expectNoReport()
+
+	// The acker gets stuck on the first message.
+	first := deliver(0, 4)
+	clock.Advance(3 * time.Second)
+	deliver(1, 7)
+	clock.Advance(7 * time.Second)
+	expectReport(StallReport{
+		Topic:   "topic",
+		Stalled: 10 * time.Second,
+		InFlight: []InFlightMessage{
+			{Partition: 0, Offset: 4, Age: 10 * time.Second},
+			{Partition: 1, Offset: 7, Age: 7 * time.Second},
+		},
+	})
+
+	// The stall is reported once.
+	clock.Advance(5 * time.Second)
+	expectNoReport()
+
+	// An acknowledgement ends the stall, and the next one is reported
+	// again.
+	acks <- first
+	_, err := source.MarkedOffsets(ctx)
+	require.NoError(t, err)
+	clock.Advance(10 * time.Second)
+	expectReport(StallReport{
+		Topic:   "topic",
+		Stalled: 10 * time.Second,
+		InFlight: []InFlightMessage{
+			{Partition: 1, Offset: 7, Age: 22 * time.Second},
+		},
+	})
+}
+
+func TestStallDetectorDisabled(t *testing.T) {
+	assert.Nil(t, newStallDetector(AsyncMessageSourceConfig{OnStall: func(StallReport) {}}, debug.Debugger{}))
+
+	var d *stallDetector
+	ticks, stop := d.ticks()
+	assert.Nil(t, ticks)
+	stop()
+	d.check([]*consumerMessage{{}})
+}
@@ -0,0 +1,123 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Shopify/sarama"
+)
+
+// aclOperationNames are the names of the operations checked at startup.
+var aclOperationNames = map[sarama.AclOperation]string{
+	sarama.AclOperationRead:     "Read",
+	sarama.AclOperationWrite:    "Write",
+	sarama.AclOperationDescribe: "Describe",
+}
+
+// startupChecker verifies that the credentials of a source or sink may perform
+// the operations it needs on its topic, see StartupChecks.
+type startupChecker struct {
+	topic string
+	// principal is the principal of the SASL user, if any. ACLs are only
+	// evaluated for a known principal.
+	principal string
+	ops       []sarama.AclOperation
+	newAdmin  func(sarama.Client) (sarama.ClusterAdmin, error)
+}
+
+func newStartupChecker(topic string, sasl *SASLConfig, ops ...sarama.AclOperation) *startupChecker {
+	c := &startupChecker{
+		topic:    topic,
+		ops:      ops,
+		newAdmin: sarama.NewClusterAdminFromClient,
+	}
+	if sasl != nil && sasl.User != "" {
+		c.principal = "User:" + sasl.User
+	}
+	return c
+}
+
+// check returns an error if the topic can't be described, or if an ACL
+// denies one of the operations. It returns warnings, to be reported by
+// Status, if no ACL allows an operation, as super users and clusters allowing
+// everyone when no ACL is found don't need one, or if the ACLs can't be
+// described.
+func (c *startupChecker) check(client sarama.Client) ([]string, error) {
+	if err := client.RefreshMetadata(c.topic); errors.Is(err, sarama.ErrTopicAuthorizationFailed) {
+		return nil, fmt.Errorf("not authorized to describe topic %s: %w", c.topic, err)
+	}
+	if c.principal == "" {
+		return nil, nil
+	}
+
+	// The admin is not closed, as that would close the shared client.
+	admin, err := c.newAdmin(client)
+	if err != nil {
+		return []string{fmt.Sprintf("ACLs of topic %s not verified: %v", c.topic, err)}, nil
+	}
+	filter := sarama.AclFilter{
+		ResourceType:              sarama.AclResourceTopic,
+		ResourceName:              &c.topic,
+		ResourcePatternTypeFilter: sarama.AclPatternLiteral,
+		Operation:                 sarama.AclOperationAny,
+		PermissionType:            sarama.AclPermissionAny,
+	}
+	if client.Config().Version.IsAtLeast(sarama.V2_0_0_0) {
+		// Also match the wildcard and prefixed ACLs.
+		filter.Version = 1
+		filter.ResourcePatternTypeFilter = sarama.AclPatternMatch
+	}
+	resources, err := admin.DescribeACLs(filter)
+	switch {
+	case errors.Is(err, sarama.ErrSecurityDisabled):
+		// Without an authorizer, everything is allowed.
+		return nil, nil
+	case err != nil:
+		return []string{fmt.Sprintf("ACLs of topic %s not verified: %v", c.topic, err)}, nil
+	}
+
+	var warnings []string
+	for _, op := range c.ops {
+		allowed, denied := c.evaluate(resources, op)
+		switch {
+		case denied:
+			return nil, fmt.Errorf("%s is denied %s access to topic %s", c.principal, aclOperationNames[op], c.topic)
+		case !allowed:
+			warnings = append(warnings, fmt.Sprintf("no ACL allows %s %s access to topic %s", c.principal, aclOperationNames[op], c.topic))
+		}
+	}
+	return warnings, nil
+}
+
+// evaluate reports whether the ACLs of the principal allow and deny an
+// operation. Host specific ACLs don't deny it, as the host the brokers see
+// isn't known.
+func (c *startupChecker) evaluate(resources []sarama.ResourceAcls, op sarama.AclOperation) (allowed, denied bool) {
+	for _, res := range resources {
+		for _, acl := range res.Acls {
+			if acl.Principal != c.principal && acl.Principal != "User:*" {
+				continue
+			}
+			switch {
+			case acl.PermissionType == sarama.AclPermissionDeny && acl.Host == "*" && implies(acl.Operation, op, false):
+				denied = true
+			case acl.PermissionType == sarama.AclPermissionAllow && implies(acl.Operation, op, true):
+				allowed = true
+			}
+		}
+	}
+	return allowed, denied
+}
+
+// implies reports whether an ACL for the granted operation applies to op. An
+// allowed Read or Write implies Describe.
+func implies(granted, op sarama.AclOperation, allow bool) bool {
+	switch {
+	case granted == op || granted == sarama.AclOperationAll:
+		return true
+	case allow && op == sarama.AclOperationDescribe:
+		return granted == sarama.AclOperationRead || granted == sarama.AclOperationWrite
+	default:
+		return false
+	}
+}
@@ -0,0 +1,140 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type checkedClient struct {
+	sarama.Client
+
+	config      *sarama.Config
+	metadataErr error
+}
+
+func (c *checkedClient) Config() *sarama.Config {
+	return c.config
+}
+
+func (c *checkedClient) RefreshMetadata(...string) error {
+	return c.metadataErr
+}
+
+type aclAdmin struct {
+	sarama.ClusterAdmin
+
+	acls   []*sarama.Acl
+	err    error
+	filter sarama.AclFilter
+}
+
+func (a *aclAdmin) DescribeACLs(filter sarama.AclFilter) ([]sarama.ResourceAcls, error) {
+	a.filter = filter
+	if a.err != nil {
+		return nil, a.err
+	}
+	return []sarama.ResourceAcls{{
+		Resource: sarama.Resource{ResourceType: sarama.AclResourceTopic, ResourceName: "orders"},
+		Acls:     a.acls,
+	}}, nil
+}
+
+func TestStartupChecks(t *testing.T) {
+	allow := func(principal string, op sarama.AclOperation) *sarama.Acl {
+		return &sarama.Acl{Principal: principal, Host: "*", Operation: op, PermissionType: sarama.AclPermissionAllow}
+	}
+	deny := func(principal, host string, op sarama.AclOperation) *sarama.Acl {
+		return &sarama.Acl{Principal: principal, Host: host, Operation: op, PermissionType: sarama.AclPermissionDeny}
+	}
+	for _, tst := range []struct {
+		name        string
+		sasl        *SASLConfig
+		metadataErr error
+		acls        []*sarama.Acl
+		aclErr      error
+		warnings    []string
+		err         string
+	}{
+		{
+			name: "allowed",
+			sasl: &SASLConfig{User: "billing"},
+			acls: []*sarama.Acl{allow("User:billing", sarama.AclOperationRead)},
+		},
+		{
+			name: "allowed everything to everyone",
+			sasl: &SASLConfig{User: "billing"},
+			acls: []*sarama.Acl{allow("User:*", sarama.AclOperationAll)},
+		},
+		{
+			name:        "not authorized to describe",
+			sasl:        &SASLConfig{User: "billing"},
+			metadataErr: sarama.ErrTopicAuthorizationFailed,
+			err:         "not authorized to describe topic orders: " + sarama.ErrTopicAuthorizationFailed.Error(),
+		},
+		{
+			name: "denied",
+			sasl: &SASLConfig{User: "billing"},
+			acls: []*sarama.Acl{
+				allow("User:billing", sarama.AclOperationAll),
+				deny("User:billing", "*", sarama.AclOperationRead),
+			},
+			err: "User:billing is denied Read access to topic orders",
+		},
+		{
+			name: "denied from a host",
+			sasl: &SASLConfig{User: "billing"},
+			acls: []*sarama.Acl{
+				allow("User:billing", sarama.AclOperationRead),
+				deny("User:billing", "10.0.0.1", sarama.AclOperationRead),
+			},
+		},
+		{
+			name: "not allowed",
+			sasl: &SASLConfig{User: "billing"},
+			acls: []*sarama.Acl{
+				allow("User:billing", sarama.AclOperationDescribe),
+				allow("User:shipping", sarama.AclOperationRead),
+			},
+			warnings: []string{"no ACL allows User:billing Read access to topic orders"},
+		},
+		{
+			name:     "ACLs not described",
+			sasl:     &SASLConfig{User: "billing"},
+			aclErr:   sarama.ErrClusterAuthorizationFailed,
+			warnings: []string{"ACLs of topic orders not verified: " + sarama.ErrClusterAuthorizationFailed.Error()},
+		},
+		{
+			name:   "security disabled",
+			sasl:   &SASLConfig{User: "billing"},
+			aclErr: sarama.ErrSecurityDisabled,
+		},
+		{
+			name: "without principal",
+			acls: []*sarama.Acl{deny("User:*", "*", sarama.AclOperationAll)},
+		},
+	} {
+		t.Run(tst.name, func(t *testing.T) {
+			admin := &aclAdmin{acls: tst.acls, err: tst.aclErr}
+			checker := newStartupChecker("orders", tst.sasl, sarama.AclOperationDescribe, sarama.AclOperationRead)
+			checker.newAdmin = func(sarama.Client) (sarama.ClusterAdmin, error) {
+				return admin, nil
+			}
+			config := sarama.NewConfig()
+			config.Version = sarama.V2_0_0_0
+			warnings, err := checker.check(&checkedClient{config: config, metadataErr: tst.metadataErr})
+			if tst.err != "" {
+				assert.EqualError(t, err, tst.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tst.warnings, warnings)
+			if tst.sasl != nil {
+				assert.Equal(t, sarama.AclPatternMatch, admin.filter.ResourcePatternTypeFilter)
+				assert.Equal(t, "orders", *admin.filter.ResourceName)
+			}
+		})
+	}
+}
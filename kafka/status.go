@@ -1,12 +1,15 @@
 package kafka
 
 import (
+	"context"
+	"time"
+
 	"github.com/Shopify/sarama"
 	"github.com/uw-labs/substrate"
 )
 
 func status(client sarama.Client, topic string) (*substrate.Status, error) {
-	status := &substrate.Status{}
+	status := &substrate.Status{Details: map[string]string{"topic": topic}}
 
 	err := client.RefreshMetadata(topic)
 	if err != nil {
@@ -42,3 +45,40 @@ func status(client sarama.Client, topic string) (*substrate.Status, error) {
 	status.Working = true
 	return status, nil
 }
+
+// lagTimeout bounds the requests made to compute the lag of a source.
+const lagTimeout = 5 * time.Second
+
+// lag returns the number of messages after the committed offsets of the
+// consumer group. Partitions without a committed offset are not counted, as
+// where consuming them starts depends on the offset the group is started from.
+func (ams *asyncMessageSource) lag() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lagTimeout)
+	defer cancel()
+
+	committed, err := ams.CommittedOffsets(ctx)
+	if err != nil {
+		return 0, err
+	}
+	newest := make(map[int32]int64, len(committed))
+	for p := range committed {
+		offset, err := ams.client.GetOffset(ams.topic, p, sarama.OffsetNewest)
+		if err != nil {
+			return 0, err
+		}
+		newest[p] = offset
+	}
+	return consumerLag(committed, newest), nil
+}
+
+// consumerLag returns the total number of messages from the committed offsets
+// to the newest offsets of the partitions.
+func consumerLag(committed, newest map[int32]int64) int64 {
+	var lag int64
+	for p, offset := range committed {
+		if n, ok := newest[p]; ok && n > offset {
+			lag += n - offset
+		}
+	}
+	return lag
+}
@@ -0,0 +1,89 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/uw-labs/substrate"
+)
+
+func TestConsumerLag(t *testing.T) {
+	committed := map[int32]int64{0: 10, 1: 5, 2: 7}
+	newest := map[int32]int64{0: 15, 1: 5, 2: 6, 3: 100}
+	// Partition 3 has no committed offset, and partition 2 was truncated.
+	assert.Equal(t, int64(5), consumerLag(committed, newest))
+	assert.Equal(t, int64(0), consumerLag(nil, newest))
+}
+
+// metadataClient serves the brokers, controller and partition leaders of a
+// cluster, counting the controller lookups.
+type metadataClient struct {
+	sarama.Client
+	controller  *sarama.Broker
+	leaders     []*sarama.Broker
+	controllers int
+}
+
+func (c *metadataClient) Brokers() []*sarama.Broker {
+	return []*sarama.Broker{c.controller}
+}
+
+func (c *metadataClient) Controller() (*sarama.Broker, error) {
+	c.controllers++
+	return c.controller, nil
+}
+
+func (c *metadataClient) Partitions(string) ([]int32, error) {
+	return []int32{1, 0}, nil
+}
+
+func (c *metadataClient) Leader(_ string, p int32) (*sarama.Broker, error) {
+	if c.leaders[p] == nil {
+		return nil, sarama.ErrLeaderNotAvailable
+	}
+	return c.leaders[p], nil
+}
+
+func TestBrokerStatus(t *testing.T) {
+	b1 := sarama.NewBroker("kafka-1:9092")
+	client := &metadataClient{controller: b1, leaders: []*sarama.Broker{b1, nil}}
+	s := newBrokerStatus(client, []string{"kafka-1:9092", "kafka-2:9092"}, "topic")
+	s.lookupHost = func(host string) ([]string, error) {
+		if host == "kafka-2" {
+			return nil, errors.New("no such host")
+		}
+		return []string{"10.0.0.1"}, nil
+	}
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	st := &substrate.Status{Working: true}
+	s.addTo(st)
+	id := fmt.Sprint(b1.ID())
+	assert.Equal(t, map[string]string{
+		"broker-kafka-1:9092": "not connected",
+		"broker-kafka-2:9092": "unresolvable",
+		"controller":          id,
+		"partition-0-leader":  id + " (kafka-1:9092)",
+		"partition-1-leader":  "none",
+	}, st.Details)
+	assert.Equal(t, []string{
+		"broker kafka-2:9092 is unresolvable: no such host",
+		"partition 1 has no leader: " + sarama.ErrLeaderNotAvailable.Error(),
+	}, st.Problems)
+
+	// The report is cached until it expires.
+	s.addTo(&substrate.Status{})
+	assert.Equal(t, 1, client.controllers)
+	now = now.Add(brokerStatusTTL)
+	s.addTo(&substrate.Status{})
+	assert.Equal(t, 2, client.controllers)
+
+	var nilStatus *brokerStatus
+	nilStatus.addTo(st)
+}
@@ -0,0 +1,218 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/clock"
+	"github.com/uw-labs/substrate/internal/debug"
+)
+
+const (
+	defaultThrottleCheckInterval = time.Second
+	// throttleMetricPrefix prefixes the names of the histograms of the
+	// time, in milliseconds, the brokers throttled the requests of the
+	// client for, which sarama records per broker.
+	throttleMetricPrefix = "throttle-time-in-ms-for-broker-"
+	// quotaHeadroom is the fraction of the throughput observed while
+	// throttled that a sink adapting to its quota limits itself to.
+	quotaHeadroom = 0.95
+	// quotaProbe is the factor the limit is raised by for every interval
+	// without throttling, so that a raised quota is followed.
+	quotaProbe = 1.05
+)
+
+// throttleWatcher checks the throttle time histograms of the brokers every
+// interval, calling the OnThrottled callback when the brokers throttled the
+// produce requests, and adapting the rate limit of the sink to its quota if
+// AdaptToQuota is set. A nil throttleWatcher watches and limits nothing.
+type throttleWatcher struct {
+	registry    metrics.Registry
+	interval    time.Duration
+	onThrottled func(time.Duration)
+	// limiter is nil unless AdaptToQuota is set.
+	limiter  *rateLimiter
+	clock    clock.Clock
+	debugger debug.Debugger
+
+	// counts are the numbers of throttled requests recorded per histogram
+	// at the last check.
+	counts map[string]int64
+	// produced is the number of bytes produced since the last check,
+	// updated atomically.
+	produced int64
+}
+
+func newThrottleWatcher(c AsyncMessageSinkConfig, registry metrics.Registry, debugger debug.Debugger) *throttleWatcher {
+	if c.OnThrottled == nil && !c.AdaptToQuota {
+		return nil
+	}
+	w := &throttleWatcher{
+		registry:    registry,
+		interval:    c.ThrottleCheckInterval,
+		onThrottled: c.OnThrottled,
+		clock:       clock.Real,
+		debugger:    debugger,
+		counts:      make(map[string]int64),
+	}
+	if w.interval <= 0 {
+		w.interval = defaultThrottleCheckInterval
+	}
+	if c.AdaptToQuota {
+		w.limiter = &rateLimiter{clock: w.clock}
+	}
+	return w
+}
+
+// run checks the throttle times every interval, until the context is done.
+// The throttling recorded before it is called is ignored.
+func (w *throttleWatcher) run(ctx context.Context) error {
+	w.throttled()
+	atomic.StoreInt64(&w.produced, 0)
+
+	ticker := w.clock.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C():
+			w.check()
+		}
+	}
+}
+
+// check reports the throttling since the last check, and adapts the rate
+// limit to the throughput of the sink over the interval.
+func (w *throttleWatcher) check() {
+	throttle := w.throttled()
+	produced := atomic.SwapInt64(&w.produced, 0)
+	if throttle > 0 {
+		w.debugger.Logf("substrate : producer - throttled by the brokers for %s\n", throttle)
+		if w.onThrottled != nil {
+			w.onThrottled(throttle)
+		}
+	}
+	w.limiter.adapt(throttle > 0, float64(produced)/w.interval.Seconds())
+}
+
+// throttled returns the throttle time of the broker throttling the most
+// since the last call, which is the mean of its histogram, or zero if no
+// broker throttled the client.
+func (w *throttleWatcher) throttled() time.Duration {
+	var throttle time.Duration
+	w.registry.Each(func(name string, i interface{}) {
+		h, ok := i.(metrics.Histogram)
+		if !ok || !strings.HasPrefix(name, throttleMetricPrefix) {
+			return
+		}
+		snapshot := h.Snapshot()
+		count := snapshot.Count()
+		if count == w.counts[name] {
+			return
+		}
+		w.counts[name] = count
+		if d := time.Duration(snapshot.Mean() * float64(time.Millisecond)); d > throttle {
+			throttle = d
+		}
+	})
+	return throttle
+}
+
+// admit records n bytes to be produced, waiting until the rate limit allows
+// them, if any.
+func (w *throttleWatcher) admit(ctx context.Context, n int) error {
+	if w == nil {
+		return nil
+	}
+	atomic.AddInt64(&w.produced, int64(n))
+	return w.limiter.wait(ctx, n)
+}
+
+// addTo adds the rate limit of the sink, if limited, to the details of a
+// status.
+func (w *throttleWatcher) addTo(st *substrate.Status) {
+	if w == nil {
+		return
+	}
+	if rate := w.limiter.limit(); rate > 0 {
+		st.Details["quota-rate-limit"] = fmt.Sprintf("%.0f bytes/s", rate)
+	}
+}
+
+// rateLimiter limits the bytes produced by a sink adapting to its quota. A
+// nil rateLimiter limits nothing.
+type rateLimiter struct {
+	clock clock.Clock
+
+	mu sync.Mutex
+	// rate is the limit in bytes per second, or zero if unlimited.
+	rate float64
+	// next is the time from which the next bytes may be produced.
+	next time.Time
+}
+
+// adapt limits the rate just under the observed one, in bytes per second, if
+// the brokers throttled the sink, or raises the limit if the sink used it
+// without being throttled.
+func (l *rateLimiter) adapt(throttled bool, observed float64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case throttled && observed > 0:
+		l.rate = observed * quotaHeadroom
+	case !throttled && l.rate > 0 && observed >= l.rate*quotaHeadroom:
+		l.rate *= quotaProbe
+	}
+}
+
+// wait waits until n bytes may be produced under the limit, or until the
+// context is done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	now := l.clock.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := l.clock.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limit returns the rate limit in bytes per second, or zero if unlimited.
+func (l *rateLimiter) limit() float64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
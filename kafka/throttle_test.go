@@ -0,0 +1,100 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/debug"
+	"github.com/uw-labs/substrate/internal/testutil"
+)
+
+func TestThrottleWatcherDisabled(t *testing.T) {
+	assert.Nil(t, newThrottleWatcher(AsyncMessageSinkConfig{}, metrics.NewRegistry(), debug.Debugger{}))
+
+	var w *throttleWatcher
+	assert.NoError(t, w.admit(context.Background(), 100))
+}
+
+func TestThrottleWatcherOnThrottled(t *testing.T) {
+	registry := metrics.NewRegistry()
+	broker1 := metrics.GetOrRegisterHistogram(throttleMetricPrefix+"1", registry, metrics.NewUniformSample(100))
+	broker2 := metrics.GetOrRegisterHistogram(throttleMetricPrefix+"2", registry, metrics.NewUniformSample(100))
+	metrics.GetOrRegisterHistogram("request-latency-in-ms", registry, metrics.NewUniformSample(100)).Update(1000)
+
+	var throttles []time.Duration
+	w := newThrottleWatcher(AsyncMessageSinkConfig{
+		OnThrottled: func(d time.Duration) { throttles = append(throttles, d) },
+	}, registry, debug.Debugger{})
+	assert.Equal(t, defaultThrottleCheckInterval, w.interval)
+	assert.Nil(t, w.limiter)
+
+	// The broker throttling the most is reported.
+	broker1.Update(200)
+	broker2.Update(50)
+	w.check()
+	assert.Equal(t, []time.Duration{200 * time.Millisecond}, throttles)
+
+	// Histograms without new throttles are ignored.
+	w.check()
+	assert.Len(t, throttles, 1)
+
+	// The throttle time is the mean of the histogram of the broker.
+	broker2.Update(450)
+	w.check()
+	assert.Equal(t, []time.Duration{200 * time.Millisecond, 250 * time.Millisecond}, throttles)
+}
+
+func TestThrottleWatcherAdaptToQuota(t *testing.T) {
+	registry := metrics.NewRegistry()
+	broker := metrics.GetOrRegisterHistogram(throttleMetricPrefix+"1", registry, metrics.NewUniformSample(100))
+
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	w := newThrottleWatcher(AsyncMessageSinkConfig{AdaptToQuota: true}, registry, debug.Debugger{})
+	w.clock, w.limiter.clock = clock, clock
+	ctx := context.Background()
+
+	// The sink is not limited until it is throttled.
+	require.NoError(t, w.admit(ctx, 1000))
+	w.check()
+	assert.Zero(t, w.limiter.limit())
+
+	require.NoError(t, w.admit(ctx, 1000))
+	broker.Update(500)
+	w.check()
+	assert.InDelta(t, 950, w.limiter.limit(), 0.001)
+
+	st := &substrate.Status{Details: map[string]string{}}
+	w.addTo(st)
+	assert.Equal(t, "950 bytes/s", st.Details["quota-rate-limit"])
+
+	// The first bytes pass, and the next wait for them to fit the limit.
+	require.NoError(t, w.admit(ctx, 950))
+	admitted := make(chan error, 1)
+	go func() {
+		admitted <- w.admit(ctx, 95)
+	}()
+	clock.BlockUntil(1)
+	assert.Len(t, admitted, 0)
+	clock.Advance(time.Second)
+	assert.NoError(t, <-admitted)
+
+	// The limit is raised while the sink uses it without being throttled.
+	w.check()
+	assert.InDelta(t, 997.5, w.limiter.limit(), 0.001)
+
+	// Waiting for the limit stops with the context.
+	clock.Advance(time.Second)
+	ctx, cancel := context.WithCancel(ctx)
+	require.NoError(t, w.admit(ctx, 1000))
+	go func() {
+		admitted <- w.admit(ctx, 1000)
+	}()
+	clock.BlockUntil(1)
+	cancel()
+	assert.Equal(t, context.Canceled, <-admitted)
+}
@@ -0,0 +1,86 @@
+package kafka
+
+import (
+	"fmt"
+
+	"github.com/Shopify/sarama"
+)
+
+// TimestampType tells what the timestamps of the records of a topic are the
+// time of, as set by the message.timestamp.type config of the topic.
+type TimestampType string
+
+const (
+	// TimestampTypeUnknown is the type of the timestamps of a topic whose
+	// config could not be described.
+	TimestampTypeUnknown TimestampType = ""
+	// TimestampCreateTime timestamps are set by the producers, when the
+	// records are created.
+	TimestampCreateTime TimestampType = "CreateTime"
+	// TimestampLogAppendTime timestamps are set by the brokers, when the
+	// records are appended to the log.
+	TimestampLogAppendTime TimestampType = "LogAppendTime"
+)
+
+const timestampTypeConfig = "message.timestamp.type"
+
+// timestampTypeChecker describes the timestamp type of the topic of a source,
+// and compares it with the expected one, see ExpectedTimestampType.
+type timestampTypeChecker struct {
+	topic    string
+	expected TimestampType
+	newAdmin func(sarama.Client) (sarama.ClusterAdmin, error)
+}
+
+func newTimestampTypeChecker(c AsyncMessageSourceConfig) *timestampTypeChecker {
+	return &timestampTypeChecker{
+		topic:    c.Topic,
+		expected: c.ExpectedTimestampType,
+		newAdmin: sarama.NewClusterAdminFromClient,
+	}
+}
+
+// check returns the timestamp type of the topic, which is unknown if it can't
+// be described. It returns warnings, to be reported by Status, if the type
+// differs from the expected one, or can't be verified.
+func (c *timestampTypeChecker) check(client sarama.Client) (TimestampType, []string) {
+	typ, err := c.describe(client)
+	switch {
+	case c.expected == TimestampTypeUnknown:
+		return typ, nil
+	case err != nil:
+		return typ, []string{fmt.Sprintf("timestamp type of topic %s not verified: %v", c.topic, err)}
+	case typ != c.expected:
+		return typ, []string{fmt.Sprintf("topic %s has %s timestamps, not %s", c.topic, typ, c.expected)}
+	default:
+		return typ, nil
+	}
+}
+
+func (c *timestampTypeChecker) describe(client sarama.Client) (TimestampType, error) {
+	// The admin is not closed, as that would close the shared client.
+	admin, err := c.newAdmin(client)
+	if err != nil {
+		return TimestampTypeUnknown, err
+	}
+	entries, err := admin.DescribeConfig(sarama.ConfigResource{
+		Type:        sarama.TopicResource,
+		Name:        c.topic,
+		ConfigNames: []string{timestampTypeConfig},
+	})
+	if err != nil {
+		return TimestampTypeUnknown, err
+	}
+	for _, e := range entries {
+		if e.Name != timestampTypeConfig {
+			continue
+		}
+		switch typ := TimestampType(e.Value); typ {
+		case TimestampCreateTime, TimestampLogAppendTime:
+			return typ, nil
+		default:
+			return TimestampTypeUnknown, fmt.Errorf("unknown %s %q", timestampTypeConfig, e.Value)
+		}
+	}
+	return TimestampTypeUnknown, fmt.Errorf("%s not described", timestampTypeConfig)
+}
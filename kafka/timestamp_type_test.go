@@ -0,0 +1,104 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+type configAdmin struct {
+	sarama.ClusterAdmin
+
+	entries  []sarama.ConfigEntry
+	err      error
+	resource sarama.ConfigResource
+}
+
+func (a *configAdmin) DescribeConfig(resource sarama.ConfigResource) ([]sarama.ConfigEntry, error) {
+	a.resource = resource
+	return a.entries, a.err
+}
+
+func TestTimestampTypeChecker(t *testing.T) {
+	entry := func(value string) []sarama.ConfigEntry {
+		return []sarama.ConfigEntry{{Name: timestampTypeConfig, Value: value}}
+	}
+	for _, tst := range []struct {
+		name     string
+		expected TimestampType
+		entries  []sarama.ConfigEntry
+		err      error
+		typ      TimestampType
+		warnings []string
+	}{
+		{
+			name:    "not expected",
+			entries: entry("LogAppendTime"),
+			typ:     TimestampLogAppendTime,
+		},
+		{
+			name: "not expected nor described",
+			err:  sarama.ErrClusterAuthorizationFailed,
+		},
+		{
+			name:     "expected",
+			expected: TimestampCreateTime,
+			entries:  entry("CreateTime"),
+			typ:      TimestampCreateTime,
+		},
+		{
+			name:     "different",
+			expected: TimestampCreateTime,
+			entries:  entry("LogAppendTime"),
+			typ:      TimestampLogAppendTime,
+			warnings: []string{"topic orders has LogAppendTime timestamps, not CreateTime"},
+		},
+		{
+			name:     "not described",
+			expected: TimestampCreateTime,
+			err:      sarama.ErrClusterAuthorizationFailed,
+			warnings: []string{"timestamp type of topic orders not verified: " + sarama.ErrClusterAuthorizationFailed.Error()},
+		},
+		{
+			name:     "missing",
+			expected: TimestampLogAppendTime,
+			warnings: []string{"timestamp type of topic orders not verified: message.timestamp.type not described"},
+		},
+		{
+			name:     "unknown",
+			expected: TimestampLogAppendTime,
+			entries:  entry("AppendTime"),
+			warnings: []string{`timestamp type of topic orders not verified: unknown message.timestamp.type "AppendTime"`},
+		},
+	} {
+		t.Run(tst.name, func(t *testing.T) {
+			admin := &configAdmin{entries: tst.entries, err: tst.err}
+			checker := newTimestampTypeChecker(AsyncMessageSourceConfig{Topic: "orders", ExpectedTimestampType: tst.expected})
+			checker.newAdmin = func(sarama.Client) (sarama.ClusterAdmin, error) {
+				return admin, nil
+			}
+			typ, warnings := checker.check(&checkedClient{})
+			assert.Equal(t, tst.typ, typ)
+			assert.Equal(t, tst.warnings, warnings)
+			assert.Equal(t, sarama.ConfigResource{Type: sarama.TopicResource, Name: "orders", ConfigNames: []string{timestampTypeConfig}}, admin.resource)
+		})
+	}
+}
+
+func TestMessageTimestamps(t *testing.T) {
+	created, appended := time.Unix(1600000000, 0), time.Unix(1600000005, 0)
+	msg := &consumerMessage{
+		cm:            &sarama.ConsumerMessage{Timestamp: created, BlockTimestamp: appended},
+		timestampType: TimestampCreateTime,
+	}
+	assert.Equal(t, created, msg.Timestamp())
+	assert.Equal(t, appended, msg.BlockTimestamp())
+	assert.Equal(t, TimestampCreateTime, msg.TimestampType())
+
+	// The timestamps are kept when the payload is discarded.
+	msg.DiscardPayload()
+	assert.Equal(t, created, msg.Timestamp())
+	assert.Equal(t, appended, msg.BlockTimestamp())
+}
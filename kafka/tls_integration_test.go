@@ -0,0 +1,323 @@
+package kafka
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/substrate"
+)
+
+// tlsBrokerPort is the port of the TLS listener of the broker.
+const tlsBrokerPort = 9093
+
+// TestTLSCertificateRotation rotates the client certificate of a producer and
+// a consumer connected to a broker requiring TLS client authentication. The
+// first certificate expires after the rotation, and the broker is restarted,
+// so the messages published and consumed afterwards show that both
+// reconnected with the rotated certificate.
+func TestTLSCertificateRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls-rotation")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// The broker runs as a different user, which must read the files.
+	require.NoError(t, os.Chmod(dir, 0755))
+
+	ca := newTestCA(t)
+	brokerCert, brokerKey := ca.issue(t, "broker", time.Now().Add(time.Hour))
+	writeFile(t, filepath.Join(dir, "kafka.keystore.pem"), brokerCert)
+	writeFile(t, filepath.Join(dir, "kafka.keystore.key"), brokerKey)
+	writeFile(t, filepath.Join(dir, "kafka.truststore.pem"), ca.certPEM)
+
+	cert, key := ca.issue(t, "ready", time.Now().Add(time.Hour))
+	readyCert, err := tls.X509KeyPair(cert, key)
+	require.NoError(t, err)
+	ks, err := runTLSServer(dir, &tls.Config{RootCAs: ca.pool(), Certificates: []tls.Certificate{readyCert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Kill()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+
+	// The first certificate is only valid for long enough to publish and
+	// consume a message.
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	firstExpiry := time.Now().Add(30 * time.Second)
+	cert, key = ca.issue(t, "client-1", firstExpiry)
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	require.NoError(t, err)
+	tlsConfig := &tls.Config{
+		RootCAs:              ca.pool(),
+		GetClientCertificate: reloader.GetClientCertificate,
+	}
+
+	topic := uuid.New().String()
+	sink, err := NewAsyncMessageSink(AsyncMessageSinkConfig{
+		Brokers: ks.brokers(),
+		Topic:   topic,
+		Version: "2.4.0",
+		TLS:     tlsConfig,
+	})
+	require.NoError(t, err)
+	defer sink.Close()
+	source, err := NewAsyncMessageSource(AsyncMessageSourceConfig{
+		Brokers:       ks.brokers(),
+		ConsumerGroup: uuid.New().String(),
+		Topic:         topic,
+		Offset:        OffsetOldest,
+		Version:       "2.4.0",
+		TLS:           tlsConfig,
+	})
+	require.NoError(t, err)
+	defer source.Close()
+
+	// The consumer is started again whenever it fails.
+	var consumerRestarts int32
+	consumed := make(chan string, 16)
+	consCtx, consCancel := context.WithCancel(ctx)
+	consDone := make(chan struct{})
+	go func() {
+		defer close(consDone)
+		cons := substrate.NewSynchronousMessageSource(source)
+		for consCtx.Err() == nil {
+			err := cons.ConsumeMessages(consCtx, func(ctx context.Context, msg substrate.Message) error {
+				select {
+				case consumed <- string(msg.Data()):
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+			if consCtx.Err() == nil {
+				t.Logf("consumer failed, reconnecting: %s", err)
+				atomic.AddInt32(&consumerRestarts, 1)
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+	defer func() {
+		consCancel()
+		<-consDone
+	}()
+
+	// expectConsumed waits for a message to be consumed, skipping the ones
+	// consumed again after a reconnection.
+	expectConsumed := func(payload string) {
+		t.Helper()
+		for {
+			select {
+			case got := <-consumed:
+				if got == payload {
+					return
+				}
+			case <-ctx.Done():
+				t.Fatalf("message %s was not consumed", payload)
+			}
+		}
+	}
+
+	require.Zero(t, publishUntilAcked(ctx, t, sink, "before rotation"))
+	expectConsumed("before rotation")
+
+	// Rotate the certificate, wait for the first one to expire, and restart
+	// the broker, which drops every connection.
+	cert, key = ca.issue(t, "client-2", time.Now().Add(time.Hour))
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+	rotated := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, rotated, rotated))
+	require.NoError(t, os.Chtimes(keyFile, rotated, rotated))
+	time.Sleep(time.Until(firstExpiry) + time.Second)
+	require.NoError(t, ks.restart())
+
+	failures := publishUntilAcked(ctx, t, sink, "after rotation")
+	expectConsumed("after rotation")
+	t.Logf("producer failed %d times and consumer %d times before reconnecting", failures, atomic.LoadInt32(&consumerRestarts))
+}
+
+// publishUntilAcked publishes a message, calling PublishMessages again
+// whenever it fails, e.g. while the broker is restarting, until the message
+// is acknowledged. It returns the number of failed calls.
+func publishUntilAcked(ctx context.Context, t *testing.T, sink substrate.AsyncMessageSink, payload string) int {
+	t.Helper()
+
+	for failures := 0; ; failures++ {
+		pubCtx, pubCancel := context.WithTimeout(ctx, 20*time.Second)
+		msgs := make(chan substrate.Message, 1)
+		acks := make(chan substrate.Message, 1)
+		errs := make(chan error, 1)
+		msgs <- &message{data: []byte(payload)}
+		go func() {
+			errs <- sink.PublishMessages(pubCtx, acks, msgs)
+		}()
+
+		select {
+		case <-acks:
+			pubCancel()
+			<-errs
+			return failures
+		case err := <-errs:
+			pubCancel()
+			if ctx.Err() != nil {
+				t.Fatalf("message %s was not acknowledged: %s", payload, err)
+			}
+			t.Logf("producer failed, reconnecting: %s", err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// testCA issues certificates for the broker and its clients.
+type testCA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	serial  int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "substrate test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		serial:  1,
+	}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue returns a certificate for the common name, valid for localhost until
+// notAfter, and its PKCS8 key, in PEM.
+func (ca *testCA) issue(t *testing.T, commonName string, notAfter time.Time) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, name string, data []byte) {
+	require.NoError(t, ioutil.WriteFile(name, data, 0644))
+}
+
+// runTLSServer runs a broker whose only listener requires TLS client
+// authentication, with the keystore and truststore in dir, and waits for it to
+// accept clients using the given TLS config.
+func runTLSServer(dir string, tlsConfig *tls.Config) (*testServer, error) {
+	containerName := uuid.New().String()
+
+	cmd := exec.CommandContext(
+		context.Background(),
+		"docker",
+		"run",
+		"-d",
+		"--rm",
+		"--name", containerName,
+		"-p", fmt.Sprintf("%d:%d", tlsBrokerPort, tlsBrokerPort),
+		"-v", dir+":/opt/bitnami/kafka/config/certs:ro",
+		"--env", "KAFKA_CFG_NODE_ID=0",
+		"--env", "KAFKA_CFG_PROCESS_ROLES=controller,broker",
+		"--env", "KAFKA_CFG_CONTROLLER_QUORUM_VOTERS=0@localhost:9094",
+		"--env", "KAFKA_CFG_CONTROLLER_LISTENER_NAMES=CONTROLLER",
+		"--env", fmt.Sprintf("KAFKA_CFG_LISTENERS=SSL://:%d,CONTROLLER://:9094", tlsBrokerPort),
+		"--env", fmt.Sprintf("KAFKA_CFG_ADVERTISED_LISTENERS=SSL://127.0.0.1:%d", tlsBrokerPort),
+		"--env", "KAFKA_CFG_LISTENER_SECURITY_PROTOCOL_MAP=SSL:SSL,CONTROLLER:PLAINTEXT",
+		"--env", "KAFKA_CFG_INTER_BROKER_LISTENER_NAME=SSL",
+		"--env", "KAFKA_CFG_SSL_CLIENT_AUTH=required",
+		"--env", "KAFKA_TLS_TYPE=PEM",
+		"--env", "KAFKA_TLS_CLIENT_AUTH=required",
+		"bitnami/kafka:3.4",
+	)
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	ks := &testServer{containerName, tlsBrokerPort}
+
+	// wait for the broker to accept TLS clients
+	config := sarama.NewConfig()
+	config.Net.TLS.Enable = true
+	config.Net.TLS.Config = tlsConfig
+	if err := ks.waitForBroker(config); err != nil {
+		ks.Kill()
+		return nil, err
+	}
+	return ks, nil
+}
+
+// restart restarts the broker container, waiting for it to stop first.
+func (ks *testServer) restart() error {
+	out, err := exec.Command("docker", "restart", ks.containerName).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error restarting container: %s", out)
+	}
+	return nil
+}
+
+func (ks *testServer) waitForBroker(config *sarama.Config) error {
+	deadline := time.Now().Add(2 * time.Minute)
+	for {
+		c, err := sarama.NewClient(ks.brokers(), config)
+		if err == nil {
+			return c.Close()
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("kafka did not start: %s", err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
@@ -0,0 +1,93 @@
+package kafka
+
+import (
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/unwrap"
+)
+
+// TombstoneHandling is how a source handles tombstones, the records without a
+// value that delete their key from compacted topics.
+type TombstoneHandling int
+
+const (
+	// TombstonesDelivered delivers tombstones like any other message, with
+	// a nil payload.
+	TombstonesDelivered TombstoneHandling = iota
+	// TombstonesSkipped acknowledges tombstones without delivering them.
+	TombstonesSkipped
+	// TombstonesMarked delivers tombstones as messages implementing
+	// TombstoneMessage, so that handlers can tell them apart from messages
+	// with an empty payload.
+	TombstonesMarked
+)
+
+// TombstoneMessage is implemented by the tombstones delivered by sources with
+// TombstonesMarked, and by the messages returned by Tombstone. Messages
+// implementing it and reporting a tombstone are published by sinks as
+// tombstones, without a value.
+type TombstoneMessage interface {
+	substrate.Message
+	IsTombstone() bool
+}
+
+var (
+	_ TombstoneMessage            = (*tombstone)(nil)
+	_ substrate.KeyedMessage      = (*tombstone)(nil)
+	_ Message                     = (*markedTombstone)(nil)
+	_ TombstoneMessage            = (*markedTombstone)(nil)
+	_ unwrap.AnnotatedMessage     = (*markedTombstone)(nil)
+	_ substrate.Nackable          = (*markedTombstone)(nil)
+	_ substrate.AttributedMessage = (*markedTombstone)(nil)
+)
+
+// Tombstone returns a message that sinks publish as a tombstone for key, a
+// record without a value, rather than with an empty one, so that compaction
+// deletes the key.
+func Tombstone(key []byte) substrate.Message {
+	return &tombstone{key: key}
+}
+
+type tombstone struct {
+	key []byte
+}
+
+func (t *tombstone) Data() []byte {
+	return nil
+}
+
+func (t *tombstone) Key() []byte {
+	return t.key
+}
+
+func (t *tombstone) IsTombstone() bool {
+	return true
+}
+
+// markedTombstone is a tombstone delivered by a source with TombstonesMarked.
+type markedTombstone struct {
+	*consumerMessage
+}
+
+func (t *markedTombstone) IsTombstone() bool {
+	return true
+}
+
+// Original returns the consumed message, which is the one acknowledged.
+func (t *markedTombstone) Original() substrate.Message {
+	return t.consumerMessage
+}
+
+// isTombstone reports whether the outermost message in a chain of annotated
+// messages that implements TombstoneMessage reports a tombstone.
+func isTombstone(msg substrate.Message) bool {
+	for {
+		if tm, ok := msg.(TombstoneMessage); ok {
+			return tm.IsTombstone()
+		}
+		aMsg, ok := msg.(unwrap.AnnotatedMessage)
+		if !ok {
+			return false
+		}
+		msg = aMsg.Original()
+	}
+}
@@ -0,0 +1,116 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+)
+
+func TestTombstoneHandling(t *testing.T) {
+	for _, handling := range []TombstoneHandling{TombstonesDelivered, TombstonesSkipped, TombstonesMarked} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+		fromKafka := make(chan *consumerMessage)
+		toClient := make(chan substrate.Message)
+		acks := make(chan substrate.Message)
+		sessCh := make(chan sarama.ConsumerGroupSession)
+		source := &asyncMessageSource{requests: make(chan sessionRequest)}
+		ap := &kafkaAcksProcessor{
+			toClient:    toClient,
+			fromKafka:   fromKafka,
+			acks:        acks,
+			sessCh:      sessCh,
+			rebalanceCh: make(chan struct{}),
+			requests:    source.requests,
+			tombstones:  handling,
+		}
+		go func() {
+			_ = ap.run(ctx)
+		}()
+		sessCh <- &fakeSession{marked: make(map[int32]int64)}
+
+		empty := &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "topic", Offset: 4, Key: []byte("k1"), Value: []byte{}}}
+		fromKafka <- empty
+		delivered := <-toClient
+		assert.Equal(t, empty, delivered)
+		assert.False(t, isTombstone(delivered))
+
+		tombstone := &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "topic", Offset: 5, Key: []byte("k2")}}
+		fromKafka <- tombstone
+		acks <- delivered
+
+		switch handling {
+		case TombstonesSkipped:
+			// The tombstone is acknowledged once the message before it
+			// is.
+			marked, err := source.MarkedOffsets(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, map[int32]int64{0: 6}, marked)
+		case TombstonesDelivered:
+			delivered = <-toClient
+			assert.Equal(t, tombstone, delivered)
+			assert.False(t, isTombstone(delivered))
+		case TombstonesMarked:
+			delivered = <-toClient
+			tm, ok := delivered.(TombstoneMessage)
+			require.True(t, ok)
+			assert.True(t, tm.IsTombstone())
+			assert.Nil(t, tm.Data())
+			assert.Equal(t, []byte("k2"), tm.(substrate.KeyedMessage).Key())
+			assert.Equal(t, int64(5), tm.(Message).Offset())
+		}
+		if handling != TombstonesSkipped {
+			acks <- delivered
+			marked, err := source.MarkedOffsets(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, map[int32]int64{0: 6}, marked)
+		}
+		cancel()
+	}
+}
+
+func TestPublishTombstone(t *testing.T) {
+	producer := newFakeProducer()
+	sink := &asyncMessageSink{Topic: "t1"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	messages := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.doPublishMessages(ctx, producer, acks, messages)
+	}()
+
+	// A tombstone has no value, unlike a message with an empty payload.
+	messages <- Tombstone([]byte("k1"))
+	pm := <-producer.input
+	assert.True(t, pm.Value == nil)
+	key, err := pm.Key.Encode()
+	require.NoError(t, err)
+	assert.Equal(t, "k1", string(key))
+
+	messages <- &reusedBufferMessage{data: []byte{}, key: []byte("k2")}
+	pm = <-producer.input
+	require.False(t, pm.Value == nil)
+	assert.Equal(t, 0, pm.Value.Length())
+
+	// Tombstones consumed with TombstonesMarked are published as
+	// tombstones, including through wrappers.
+	marked := &markedTombstone{&consumerMessage{cm: &sarama.ConsumerMessage{Key: []byte("k3")}}}
+	messages <- callerWrapped{marked}
+	pm = <-producer.input
+	assert.True(t, pm.Value == nil)
+	key, err = pm.Key.Encode()
+	require.NoError(t, err)
+	assert.Equal(t, "k3", string(key))
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
@@ -0,0 +1,242 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/uw-labs/substrate"
+	"golang.org/x/sync/errgroup"
+)
+
+// PayloadTransformError is the reason of the messages nacked by sources
+// because their PayloadTransform failed, and the error returned by sinks when
+// theirs fails.
+type PayloadTransformError struct {
+	Err error
+}
+
+func (e PayloadTransformError) Error() string {
+	return fmt.Sprintf("failed to transform the payload: %s", e.Err)
+}
+
+// Unwrap returns the error returned by the transform.
+func (e PayloadTransformError) Unwrap() error {
+	return e.Err
+}
+
+// payloadTransformer applies a PayloadTransform on a bounded number of
+// workers, so that expensive transforms, such as decryption, use several
+// cores.
+type payloadTransformer struct {
+	transform func([]byte) ([]byte, error)
+	// workers holds a token for every payload being transformed, across
+	// all the claims of a source.
+	workers chan struct{}
+}
+
+func newPayloadTransformer(transform func([]byte) ([]byte, error), workers int) *payloadTransformer {
+	if transform == nil {
+		return nil
+	}
+	if workers <= 0 {
+		workers = 1
+	}
+	return &payloadTransformer{
+		transform: transform,
+		workers:   make(chan struct{}, workers),
+	}
+}
+
+// pendingTransform is a payload being transformed, which is done once done
+// is closed.
+type pendingTransform struct {
+	value []byte
+	err   error
+	done  chan struct{}
+}
+
+// start transforms value once a worker is available. It returns nil if stop
+// is closed first. A nil value, such as the value of a tombstone, is not
+// transformed.
+func (t *payloadTransformer) start(value []byte, stop <-chan struct{}) *pendingTransform {
+	p := &pendingTransform{done: make(chan struct{})}
+	if value == nil {
+		close(p.done)
+		return p
+	}
+	select {
+	case t.workers <- struct{}{}:
+	case <-stop:
+		return nil
+	}
+	go func() {
+		defer func() { <-t.workers }()
+		p.value, p.err = t.transform(value)
+		close(p.done)
+	}()
+	return p
+}
+
+// transformFailures holds the errors of the failed transforms of a claim, by
+// message.
+type transformFailures struct {
+	mu   sync.Mutex
+	errs map[*sarama.ConsumerMessage]error
+}
+
+func (f *transformFailures) add(m *sarama.ConsumerMessage, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.errs == nil {
+		f.errs = make(map[*sarama.ConsumerMessage]error)
+	}
+	f.errs[m] = err
+}
+
+// take returns and forgets the error of the transform of a message, if it
+// failed.
+func (f *transformFailures) take(m *sarama.ConsumerMessage) error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err, ok := f.errs[m]
+	if ok {
+		delete(f.errs, m)
+	}
+	return err
+}
+
+// transformedClaim is a message of a claim being transformed.
+type transformedClaim struct {
+	m *sarama.ConsumerMessage
+	p *pendingTransform
+}
+
+// transformMessages returns the messages of in, in order, once their payload
+// is transformed, until stop is closed. The payload of messages whose
+// transform failed is left as it is, and their error is recorded in the
+// returned failures. Without a transform, in is returned as it is.
+func (t *payloadTransformer) transformMessages(in <-chan *sarama.ConsumerMessage, stop <-chan struct{}) (<-chan *sarama.ConsumerMessage, *transformFailures) {
+	if t == nil {
+		return in, nil
+	}
+	failures := &transformFailures{}
+	out := make(chan *sarama.ConsumerMessage)
+	pending := make(chan transformedClaim, cap(t.workers))
+	go func() {
+		defer close(pending)
+		for {
+			select {
+			case <-stop:
+				return
+			case m, ok := <-in:
+				if !ok {
+					return
+				}
+				p := t.start(m.Value, stop)
+				if p == nil {
+					return
+				}
+				select {
+				case pending <- transformedClaim{m: m, p: p}:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		defer close(out)
+		for tc := range pending {
+			select {
+			case <-tc.p.done:
+			case <-stop:
+				return
+			}
+			if tc.p.err != nil {
+				failures.add(tc.m, tc.p.err)
+			} else {
+				tc.m.Value = tc.p.value
+			}
+			select {
+			case out <- tc.m:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return out, failures
+}
+
+// transformedPayload is a message to publish with its transformed payload.
+type transformedPayload struct {
+	msg   substrate.Message
+	value []byte
+}
+
+func (tp *transformedPayload) Data() []byte {
+	return tp.value
+}
+
+// transformPublished sends the messages received from in to out, in order,
+// as transformedPayload messages, until ctx is done. The returned error of
+// the group is a PayloadTransformError if a transform fails.
+func (t *payloadTransformer) transformPublished(ctx context.Context, eg *errgroup.Group, in <-chan substrate.Message, out chan<- substrate.Message) {
+	pending := make(chan transformedMessage, cap(t.workers))
+	eg.Go(func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case m := <-in:
+				var value []byte
+				if !isTombstone(m) {
+					value = m.Data()
+				}
+				p := t.start(value, ctx.Done())
+				if p == nil {
+					return ctx.Err()
+				}
+				select {
+				case pending <- transformedMessage{msg: m, p: p}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	})
+	eg.Go(func() error {
+		for {
+			var tm transformedMessage
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case tm = <-pending:
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-tm.p.done:
+			}
+			if tm.p.err != nil {
+				return PayloadTransformError{Err: tm.p.err}
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case out <- &transformedPayload{msg: tm.msg, value: tm.p.value}:
+			}
+		}
+	})
+}
+
+// transformedMessage is a message to publish whose payload is being
+// transformed.
+type transformedMessage struct {
+	msg substrate.Message
+	p   *pendingTransform
+}
@@ -0,0 +1,227 @@
+package kafka
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+)
+
+var errUndecodable = errors.New("undecodable payload")
+
+// slowUpper returns the payload in upper case, taking longer for the earlier
+// offsets so that the transforms complete out of order, and fails for "bad".
+func slowUpper(value []byte) ([]byte, error) {
+	if string(value) == "bad" {
+		return nil, errUndecodable
+	}
+	n, _ := strconv.Atoi(string(value[len(value)-1:]))
+	time.Sleep(time.Duration(10-n) * time.Millisecond)
+	out := make([]byte, len(value))
+	for i, b := range value {
+		if b >= 'a' && b <= 'z' {
+			b -= 'a' - 'A'
+		}
+		out[i] = b
+	}
+	return out, nil
+}
+
+func TestTransformMessages(t *testing.T) {
+	assert.Nil(t, newPayloadTransformer(nil, 4))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	in := make(chan *sarama.ConsumerMessage)
+	tr := newPayloadTransformer(slowUpper, 4)
+	out, failures := tr.transformMessages(in, stop)
+
+	go func() {
+		for offset := int64(0); offset < 8; offset++ {
+			value := []byte(fmt.Sprintf("m%d", offset))
+			switch offset {
+			case 3:
+				value = []byte("bad")
+			case 5:
+				value = nil
+			}
+			in <- &sarama.ConsumerMessage{Offset: offset, Value: value}
+		}
+		close(in)
+	}()
+
+	// The messages are in order, even though their transforms are not.
+	for offset := int64(0); offset < 8; offset++ {
+		m := <-out
+		require.Equal(t, offset, m.Offset)
+		switch offset {
+		case 3:
+			assert.Equal(t, "bad", string(m.Value))
+			assert.Equal(t, errUndecodable, failures.take(m))
+		case 5:
+			assert.True(t, m.Value == nil)
+			assert.NoError(t, failures.take(m))
+		default:
+			assert.Equal(t, fmt.Sprintf("M%d", offset), string(m.Value))
+			assert.NoError(t, failures.take(m))
+		}
+	}
+	_, ok := <-out
+	assert.False(t, ok)
+}
+
+func TestUntransformedMessagesAreNacked(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	fromKafka := make(chan *consumerMessage)
+	toClient := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	sessCh := make(chan sarama.ConsumerGroupSession)
+	source := &asyncMessageSource{requests: make(chan sessionRequest)}
+
+	nacked := make(chan error, 1)
+	ap := &kafkaAcksProcessor{
+		toClient:    toClient,
+		fromKafka:   fromKafka,
+		acks:        acks,
+		sessCh:      sessCh,
+		rebalanceCh: make(chan struct{}),
+		requests:    source.requests,
+		onNack: func(msg substrate.Message, reason error) error {
+			assert.Equal(t, []byte("bad"), msg.Data())
+			assert.Equal(t, int64(5), msg.(Message).Offset())
+			nacked <- reason
+			return nil
+		},
+	}
+	go func() {
+		_ = ap.run(ctx)
+	}()
+	sessCh <- &fakeSession{marked: make(map[int32]int64)}
+
+	good := &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "topic", Offset: 4, Value: []byte("GOOD")}}
+	fromKafka <- good
+	delivered := <-toClient
+	assert.Equal(t, good, delivered)
+
+	// The message whose transform failed is nacked once the message before
+	// it is acknowledged, without being delivered.
+	bad := &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "topic", Offset: 5, Value: []byte("bad")}, transformErr: errUndecodable}
+	fromKafka <- bad
+	select {
+	case <-nacked:
+		t.Fatal("message nacked before the messages before it were acknowledged")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	acks <- delivered
+	reason := <-nacked
+	var transformErr PayloadTransformError
+	require.True(t, errors.As(reason, &transformErr))
+	assert.Equal(t, errUndecodable, transformErr.Err)
+	assert.True(t, errors.Is(reason, errUndecodable))
+
+	marked, err := source.MarkedOffsets(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[int32]int64{0: 6}, marked)
+}
+
+func TestPublishTransformed(t *testing.T) {
+	producer := newFakeProducer()
+	sink := &asyncMessageSink{Topic: "t1", transformer: newPayloadTransformer(slowUpper, 4)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	messages := make(chan substrate.Message)
+	acks := make(chan substrate.Message, 3)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.doPublishMessages(ctx, producer, acks, messages)
+	}()
+
+	m1, m2 := &reusedBufferMessage{data: []byte("m1"), key: []byte("k1")}, &reusedBufferMessage{data: []byte("m2"), key: []byte("k2")}
+	messages <- m1
+	messages <- m2
+	messages <- Tombstone([]byte("k3"))
+	for _, want := range []string{"M1", "M2"} {
+		pm := <-producer.input
+		value, err := pm.Value.Encode()
+		require.NoError(t, err)
+		assert.Equal(t, want, string(value))
+		producer.successes <- pm
+	}
+	pm := <-producer.input
+	assert.True(t, pm.Value == nil)
+	producer.successes <- pm
+
+	// The original messages are acknowledged.
+	assert.Equal(t, m1, <-acks)
+	assert.Equal(t, m2, <-acks)
+
+	// A failed transform terminates the call.
+	messages <- &reusedBufferMessage{data: []byte("bad")}
+	err := <-errs
+	var transformErr PayloadTransformError
+	require.True(t, errors.As(err, &transformErr))
+	assert.Equal(t, errUndecodable, transformErr.Err)
+}
+
+// BenchmarkPayloadTransform measures the throughput of sources decrypting
+// their payloads with AES-GCM.
+func BenchmarkPayloadTransform(b *testing.B) {
+	block, err := aes.NewCipher(make([]byte, 32))
+	require.NoError(b, err)
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(b, err)
+	nonce := make([]byte, gcm.NonceSize())
+	decrypt := func(value []byte) ([]byte, error) {
+		return gcm.Open(nil, nonce, value, nil)
+	}
+	sealed := gcm.Seal(nil, nonce, make([]byte, 64*1024), nil)
+
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers %d", workers), func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			toAck := make(chan *consumerMessage)
+			handler := &consumerGroupHandler{
+				ctx:         ctx,
+				topic:       "topic",
+				toAck:       toAck,
+				transformer: newPayloadTransformer(decrypt, workers),
+			}
+			claim := &fakeClaim{messages: make(chan *sarama.ConsumerMessage)}
+			go func() {
+				for i := 0; i < b.N; i++ {
+					value := make([]byte, len(sealed))
+					copy(value, sealed)
+					claim.messages <- &sarama.ConsumerMessage{Topic: "topic", Offset: int64(i), Value: value}
+				}
+				close(claim.messages)
+			}()
+			b.SetBytes(int64(len(sealed)))
+			b.ResetTimer()
+
+			go func() {
+				_ = handler.ConsumeClaim(&fakeSession{marked: make(map[int32]int64)}, claim)
+			}()
+			for i := 0; i < b.N; i++ {
+				if cm := <-toAck; cm.transformErr != nil {
+					b.Fatal(cm.transformErr)
+				}
+			}
+		})
+	}
+}
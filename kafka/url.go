@@ -26,19 +26,26 @@ func newKafkaSink(u *url.URL) (substrate.AsyncMessageSink, error) {
 	}
 
 	conf := AsyncMessageSinkConfig{
-		Brokers: []string{u.Host},
-		Topic:   topic,
+		Brokers:               []string{u.Host},
+		Topic:                 topic,
+		Namespace:             q.Get("namespace"),
+		UseRegisteredDefaults: true,
 	}
 
 	conf.Brokers = append(conf.Brokers, q["broker"]...)
 
 	conf.Version = q.Get("version")
+	conf.ClientID = q.Get("client-id")
 
 	debug := q.Get("debug")
 	if debug == "true" {
 		conf.Debug = true
 	}
 
+	if q.Get("strict-ordering") == "true" {
+		conf.StrictOrdering = true
+	}
+
 	if maxMessageBytes := q.Get("max-message-bytes"); maxMessageBytes != "" {
 		var err error
 		conf.MaxMessageBytes, err = strconv.Atoi(maxMessageBytes)
@@ -62,9 +69,11 @@ func newKafkaSource(u *url.URL) (substrate.AsyncMessageSource, error) {
 	}
 
 	conf := AsyncMessageSourceConfig{
-		Brokers:       []string{u.Host},
-		ConsumerGroup: q.Get("consumer-group"),
-		Topic:         topic,
+		Brokers:               []string{u.Host},
+		ConsumerGroup:         q.Get("consumer-group"),
+		Topic:                 topic,
+		Namespace:             q.Get("namespace"),
+		UseRegisteredDefaults: true,
 	}
 
 	conf.Brokers = append(conf.Brokers, q["broker"]...)
@@ -97,6 +106,8 @@ func newKafkaSource(u *url.URL) (substrate.AsyncMessageSource, error) {
 	}
 
 	conf.Version = q.Get("version")
+	conf.ClientID = q.Get("client-id")
+	conf.RackID = q.Get("rack-id")
 
 	return kafkaSourcer(conf)
 }
@@ -45,6 +45,16 @@ func TestKafkaSink(t *testing.T) {
 			},
 			expectedErr: nil,
 		},
+		{
+			name:  "namespaced",
+			input: "kafka://localhost:123/t1?namespace=billing.",
+			expected: AsyncMessageSinkConfig{
+				Brokers:   []string{"localhost:123"},
+				Topic:     "t1",
+				Namespace: "billing.",
+			},
+			expectedErr: nil,
+		},
 		{
 			name:  "port-and-brokers",
 			input: "kafka://localhost:123/t1/?broker=localhost:234&broker=localhost:345",
@@ -56,11 +66,13 @@ func TestKafkaSink(t *testing.T) {
 		},
 		{
 			name:  "everything",
-			input: "kafka://localhost:123/t1/?broker=localhost:234&broker=localhost:345&version=2.2.0.0&debug=true&max-message-bytes=500",
+			input: "kafka://localhost:123/t1/?broker=localhost:234&broker=localhost:345&version=2.2.0.0&debug=true&max-message-bytes=500&client-id=svc&strict-ordering=true",
 			expected: AsyncMessageSinkConfig{
 				Brokers:         []string{"localhost:123", "localhost:234", "localhost:345"},
 				Topic:           "t1",
 				Version:         "2.2.0.0",
+				ClientID:        "svc",
+				StrictOrdering:  true,
 				Debug:           true,
 				MaxMessageBytes: 500,
 			},
@@ -80,6 +92,9 @@ func TestKafkaSink(t *testing.T) {
 			if tst.expectedErr != err {
 				t.Errorf("expected error %v but got %v", tst.expectedErr, err)
 			}
+			if err == nil {
+				tst.expected.UseRegisteredDefaults = true
+			}
 
 			assert.Equal(tst.expected, conf)
 		})
@@ -121,9 +136,19 @@ func TestKafkaSource(t *testing.T) {
 			},
 			expectedErr: nil,
 		},
+		{
+			name:  "namespaced",
+			input: "kafka://localhost:123/t1?namespace=billing.",
+			expected: AsyncMessageSourceConfig{
+				Brokers:   []string{"localhost:123"},
+				Topic:     "t1",
+				Namespace: "billing.",
+			},
+			expectedErr: nil,
+		},
 		{
 			name:  "everything",
-			input: "kafka://localhost:123/t1/?offset=newest&consumer-group=g1&metadata-refresh=2s&broker=localhost:234&broker=localhost:345&version=0.10.2.0&session-timeout=30s",
+			input: "kafka://localhost:123/t1/?offset=newest&consumer-group=g1&metadata-refresh=2s&broker=localhost:234&broker=localhost:345&version=0.10.2.0&session-timeout=30s&client-id=svc&rack-id=eu-west-1a",
 			expected: AsyncMessageSourceConfig{
 				Brokers:                  []string{"localhost:123", "localhost:234", "localhost:345"},
 				ConsumerGroup:            "g1",
@@ -132,6 +157,8 @@ func TestKafkaSource(t *testing.T) {
 				Offset:                   sarama.OffsetNewest,
 				Topic:                    "t1",
 				Version:                  "0.10.2.0",
+				ClientID:                 "svc",
+				RackID:                   "eu-west-1a",
 			},
 			expectedErr: nil,
 		},
@@ -149,6 +176,9 @@ func TestKafkaSource(t *testing.T) {
 			if tst.expectedErr != err {
 				t.Errorf("expected error %v but got %v", tst.expectedErr, err)
 			}
+			if err == nil {
+				tst.expected.UseRegisteredDefaults = true
+			}
 
 			assert.Equal(tst.expected, conf)
 		})
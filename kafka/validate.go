@@ -0,0 +1,123 @@
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+
+	"github.com/uw-labs/substrate/internal/validate"
+)
+
+// Validate returns an error listing the problems of the config, if any, such
+// as "kafka: AsyncMessageSourceConfig.ConsumerGroup must not be empty". It is
+// called by NewAsyncMessageSource, once the registered defaults are applied.
+func (c AsyncMessageSourceConfig) Validate() error {
+	p := validate.New("kafka", "AsyncMessageSourceConfig")
+	checkBrokers(p, c.Brokers)
+	p.NotEmpty(c.Topic, "Topic")
+	p.NotEmpty(c.ConsumerGroup, "ConsumerGroup")
+	checkOffset(p, c.Offset, "Offset")
+	checkOffset(p, c.NewPartitionOffset, "NewPartitionOffset")
+	version := checkVersion(p, c.Version)
+	p.Check(c.RackID == "" || version.IsAtLeast(sarama.V2_4_0_0), "RackID", "requires a Version of at least 2.4.0")
+
+	p.NotNegativeDuration(c.MetadataRefreshFrequency, "MetadataRefreshFrequency")
+	p.NotNegativeDuration(c.OffsetsRetention, "OffsetsRetention")
+	p.NotNegativeDuration(c.SessionTimeout, "SessionTimeout")
+	p.NotNegativeDuration(c.PartitionWatchInterval, "PartitionWatchInterval")
+	p.NotNegativeDuration(c.MaxIdle, "MaxIdle")
+	p.NotNegativeDuration(c.OnAckedInterval, "OnAckedInterval")
+	p.NotNegativeDuration(c.StallTimeout, "StallTimeout")
+
+	p.Check(c.StartTime.IsZero() || c.EndTime.IsZero() || !c.EndTime.Before(c.StartTime), "EndTime", "must not be before StartTime")
+	p.Check(!c.StopAtEndTime || !c.EndTime.IsZero(), "StopAtEndTime", "requires an EndTime")
+	p.Check(c.TombstoneHandling >= TombstonesDelivered && c.TombstoneHandling <= TombstonesMarked, "TombstoneHandling", "is unknown: %d", c.TombstoneHandling)
+	p.NotNegative(c.MaxMessageBytes, "MaxMessageBytes")
+	p.NotNegative(c.TransformWorkers, "TransformWorkers")
+	p.NotNegative(c.ReadAhead, "ReadAhead")
+	p.NotNegative(c.MaxInFlight, "MaxInFlight")
+	p.Check(c.ExpectedTimestampType == TimestampTypeUnknown || c.ExpectedTimestampType == TimestampCreateTime || c.ExpectedTimestampType == TimestampLogAppendTime, "ExpectedTimestampType", "is unknown: %q", c.ExpectedTimestampType)
+	checkSkipOffsets(p, c.SkipOffsets)
+	checkSASL(p, c.SASL)
+	return p.Err()
+}
+
+// Validate returns an error listing the problems of the config, if any, such
+// as "kafka: AsyncMessageSinkConfig.Topic must not be empty". It is called by
+// NewAsyncMessageSink, once the registered defaults are applied.
+func (c AsyncMessageSinkConfig) Validate() error {
+	p := validate.New("kafka", "AsyncMessageSinkConfig")
+	checkBrokers(p, c.Brokers)
+	p.NotEmpty(c.Topic, "Topic")
+	checkVersion(p, c.Version)
+
+	p.NotNegative(c.MaxMessageBytes, "MaxMessageBytes")
+	p.NotNegative(c.FlushMessages, "FlushMessages")
+	p.NotNegativeDuration(c.FlushFrequency, "FlushFrequency")
+	p.Check(!c.RetryProduceErrors || !c.StrictOrdering, "RetryProduceErrors", "cannot be combined with StrictOrdering")
+	p.NotNegative(c.ProduceRetryAttempts, "ProduceRetryAttempts")
+	p.NotNegativeDuration(c.ProduceRetryBackoff, "ProduceRetryBackoff")
+	p.NotNegativeDuration(c.PerMessageTimeout, "PerMessageTimeout")
+	p.NotNegativeDuration(c.ThrottleCheckInterval, "ThrottleCheckInterval")
+	p.NotNegative(c.TransformWorkers, "TransformWorkers")
+	p.Check(c.PublishedRegistry == nil || c.IDFunc != nil, "PublishedRegistry", "requires an IDFunc")
+	p.NotNegativeDuration(c.PartitionWatchInterval, "PartitionWatchInterval")
+	checkSASL(p, c.SASL)
+	return p.Err()
+}
+
+// Validate returns an error listing the problems of the config, if any, such
+// as "kafka: DirectAsyncMessageSourceConfig.Partitions must not be empty". It
+// is called by NewDirectAsyncMessageSource.
+func (c DirectAsyncMessageSourceConfig) Validate() error {
+	p := validate.New("kafka", "DirectAsyncMessageSourceConfig")
+	checkBrokers(p, c.Brokers)
+	p.NotEmpty(c.Topic, "Topic")
+	p.Check(len(c.Partitions) > 0, "Partitions", "must not be empty")
+	checkOffset(p, c.Offset, "Offset")
+	p.NotNegativeDuration(c.CheckpointInterval, "CheckpointInterval")
+	checkVersion(p, c.Version)
+	checkSASL(p, c.SASL)
+	return p.Err()
+}
+
+func checkBrokers(p *validate.Problems, brokers []string) {
+	p.Check(len(brokers) > 0, "Brokers", "must not be empty")
+	for i, b := range brokers {
+		p.Check(b != "", "Brokers", "must not contain an empty address, at index %d", i)
+	}
+}
+
+// checkOffset checks an optional initial offset.
+func checkOffset(p *validate.Problems, offset int64, field string) {
+	p.Check(offset == 0 || offset == OffsetOldest || offset == OffsetNewest, field, "must be either OffsetOldest or OffsetNewest")
+}
+
+// checkVersion checks the Version field, and returns the version it sets,
+// which is the default version of sarama if it is not set or invalid.
+func checkVersion(p *validate.Problems, v string) sarama.KafkaVersion {
+	if v == "" {
+		return sarama.NewConfig().Version
+	}
+	version, err := sarama.ParseKafkaVersion(v)
+	p.Check(err == nil, "Version", "is invalid: %v", err)
+	return version
+}
+
+// checkSASL checks the SASL field, whose mechanism determines the other
+// fields it requires, see applySecurity.
+func checkSASL(p *validate.Problems, sasl *SASLConfig) {
+	if sasl == nil {
+		return
+	}
+	scram := sasl.Mechanism == sarama.SASLTypeSCRAMSHA256 || sasl.Mechanism == sarama.SASLTypeSCRAMSHA512
+	p.Check(!scram || sasl.SCRAMClientGeneratorFunc != nil, "SASL.SCRAMClientGeneratorFunc", "must be set for the SCRAM mechanisms")
+	p.Check(sasl.PasswordFunc == nil || scram, "SASL.PasswordFunc", "requires a SCRAM mechanism")
+}
+
+func checkSkipOffsets(p *validate.Problems, skips map[int32][]int64) {
+	for partition, offsets := range skips {
+		p.Check(partition >= 0, "SkipOffsets", "must not hold negative partitions, got %d", partition)
+		for _, offset := range offsets {
+			p.Check(offset >= 0, "SkipOffsets", "must not hold negative offsets, got %d for partition %d", offset, partition)
+		}
+	}
+}
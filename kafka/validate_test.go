@@ -0,0 +1,408 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/suburl"
+)
+
+func validSourceConfig() AsyncMessageSourceConfig {
+	return AsyncMessageSourceConfig{Brokers: []string{"localhost:9092"}, Topic: "t1", ConsumerGroup: "g1"}
+}
+
+func TestAsyncMessageSourceConfigValidate(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		modify   func(*AsyncMessageSourceConfig)
+		expected string
+	}{
+		{
+			name:   "valid",
+			modify: func(c *AsyncMessageSourceConfig) {},
+		},
+		{
+			name: "valid with options",
+			modify: func(c *AsyncMessageSourceConfig) {
+				c.Offset = OffsetOldest
+				c.NewPartitionOffset = OffsetNewest
+				c.Version = "2.4.0"
+				c.RackID = "eu-west-1a"
+				c.StartTime, c.EndTime, c.StopAtEndTime = now, now.Add(time.Hour), true
+				c.TombstoneHandling = TombstonesMarked
+				c.SASL = &SASLConfig{Mechanism: sarama.SASLTypeSCRAMSHA512, SCRAMClientGeneratorFunc: func() sarama.SCRAMClient { return nil }}
+			},
+		},
+		{
+			name:     "no brokers",
+			modify:   func(c *AsyncMessageSourceConfig) { c.Brokers = nil },
+			expected: "kafka: AsyncMessageSourceConfig.Brokers must not be empty",
+		},
+		{
+			name:     "empty broker",
+			modify:   func(c *AsyncMessageSourceConfig) { c.Brokers = append(c.Brokers, "") },
+			expected: "kafka: AsyncMessageSourceConfig.Brokers must not contain an empty address, at index 1",
+		},
+		{
+			name:     "no topic",
+			modify:   func(c *AsyncMessageSourceConfig) { c.Topic = "" },
+			expected: "kafka: AsyncMessageSourceConfig.Topic must not be empty",
+		},
+		{
+			name:     "no consumer group",
+			modify:   func(c *AsyncMessageSourceConfig) { c.ConsumerGroup = "" },
+			expected: "kafka: AsyncMessageSourceConfig.ConsumerGroup must not be empty",
+		},
+		{
+			name:     "offset",
+			modify:   func(c *AsyncMessageSourceConfig) { c.Offset = 42 },
+			expected: "kafka: AsyncMessageSourceConfig.Offset must be either OffsetOldest or OffsetNewest",
+		},
+		{
+			name:     "new partition offset",
+			modify:   func(c *AsyncMessageSourceConfig) { c.NewPartitionOffset = 5 },
+			expected: "kafka: AsyncMessageSourceConfig.NewPartitionOffset must be either OffsetOldest or OffsetNewest",
+		},
+		{
+			name:     "version",
+			modify:   func(c *AsyncMessageSourceConfig) { c.Version = "latest" },
+			expected: "kafka: AsyncMessageSourceConfig.Version is invalid: invalid version `latest`",
+		},
+		{
+			name:     "rack id with old version",
+			modify:   func(c *AsyncMessageSourceConfig) { c.RackID, c.Version = "eu-west-1a", "2.3.0" },
+			expected: "kafka: AsyncMessageSourceConfig.RackID requires a Version of at least 2.4.0",
+		},
+		{
+			name:     "rack id with default version",
+			modify:   func(c *AsyncMessageSourceConfig) { c.RackID = "eu-west-1a" },
+			expected: "kafka: AsyncMessageSourceConfig.RackID requires a Version of at least 2.4.0",
+		},
+		{
+			name:     "metadata refresh frequency",
+			modify:   func(c *AsyncMessageSourceConfig) { c.MetadataRefreshFrequency = -time.Second },
+			expected: "kafka: AsyncMessageSourceConfig.MetadataRefreshFrequency must not be negative",
+		},
+		{
+			name:     "offsets retention",
+			modify:   func(c *AsyncMessageSourceConfig) { c.OffsetsRetention = -time.Second },
+			expected: "kafka: AsyncMessageSourceConfig.OffsetsRetention must not be negative",
+		},
+		{
+			name:     "session timeout",
+			modify:   func(c *AsyncMessageSourceConfig) { c.SessionTimeout = -time.Second },
+			expected: "kafka: AsyncMessageSourceConfig.SessionTimeout must not be negative",
+		},
+		{
+			name:     "partition watch interval",
+			modify:   func(c *AsyncMessageSourceConfig) { c.PartitionWatchInterval = -time.Second },
+			expected: "kafka: AsyncMessageSourceConfig.PartitionWatchInterval must not be negative",
+		},
+		{
+			name:     "max idle",
+			modify:   func(c *AsyncMessageSourceConfig) { c.MaxIdle = -time.Second },
+			expected: "kafka: AsyncMessageSourceConfig.MaxIdle must not be negative",
+		},
+		{
+			name:     "on acked interval",
+			modify:   func(c *AsyncMessageSourceConfig) { c.OnAckedInterval = -time.Second },
+			expected: "kafka: AsyncMessageSourceConfig.OnAckedInterval must not be negative",
+		},
+		{
+			name:     "stall timeout",
+			modify:   func(c *AsyncMessageSourceConfig) { c.StallTimeout = -time.Second },
+			expected: "kafka: AsyncMessageSourceConfig.StallTimeout must not be negative",
+		},
+		{
+			name:     "end time before start time",
+			modify:   func(c *AsyncMessageSourceConfig) { c.StartTime, c.EndTime = now, now.Add(-time.Hour) },
+			expected: "kafka: AsyncMessageSourceConfig.EndTime must not be before StartTime",
+		},
+		{
+			name:     "stop at end time without end time",
+			modify:   func(c *AsyncMessageSourceConfig) { c.StopAtEndTime = true },
+			expected: "kafka: AsyncMessageSourceConfig.StopAtEndTime requires an EndTime",
+		},
+		{
+			name:     "tombstone handling",
+			modify:   func(c *AsyncMessageSourceConfig) { c.TombstoneHandling = 7 },
+			expected: "kafka: AsyncMessageSourceConfig.TombstoneHandling is unknown: 7",
+		},
+		{
+			name:     "max message bytes",
+			modify:   func(c *AsyncMessageSourceConfig) { c.MaxMessageBytes = -1 },
+			expected: "kafka: AsyncMessageSourceConfig.MaxMessageBytes must not be negative",
+		},
+		{
+			name:     "transform workers",
+			modify:   func(c *AsyncMessageSourceConfig) { c.TransformWorkers = -1 },
+			expected: "kafka: AsyncMessageSourceConfig.TransformWorkers must not be negative",
+		},
+		{
+			name:     "read ahead",
+			modify:   func(c *AsyncMessageSourceConfig) { c.ReadAhead = -1 },
+			expected: "kafka: AsyncMessageSourceConfig.ReadAhead must not be negative",
+		},
+		{
+			name:     "expected timestamp type",
+			modify:   func(c *AsyncMessageSourceConfig) { c.ExpectedTimestampType = "createtime" },
+			expected: `kafka: AsyncMessageSourceConfig.ExpectedTimestampType is unknown: "createtime"`,
+		},
+		{
+			name:     "max in flight",
+			modify:   func(c *AsyncMessageSourceConfig) { c.MaxInFlight = -1 },
+			expected: "kafka: AsyncMessageSourceConfig.MaxInFlight must not be negative",
+		},
+		{
+			name:     "skip offsets",
+			modify:   func(c *AsyncMessageSourceConfig) { c.SkipOffsets = map[int32][]int64{3: {1042, -1}} },
+			expected: "kafka: AsyncMessageSourceConfig.SkipOffsets must not hold negative offsets, got -1 for partition 3",
+		},
+		{
+			name:     "skip offsets partition",
+			modify:   func(c *AsyncMessageSourceConfig) { c.SkipOffsets = map[int32][]int64{-1: {1042}} },
+			expected: "kafka: AsyncMessageSourceConfig.SkipOffsets must not hold negative partitions, got -1",
+		},
+		{
+			name:     "scram without client generator",
+			modify:   func(c *AsyncMessageSourceConfig) { c.SASL = &SASLConfig{Mechanism: sarama.SASLTypeSCRAMSHA256} },
+			expected: "kafka: AsyncMessageSourceConfig.SASL.SCRAMClientGeneratorFunc must be set for the SCRAM mechanisms",
+		},
+		{
+			name: "password func without scram",
+			modify: func(c *AsyncMessageSourceConfig) {
+				c.SASL = &SASLConfig{PasswordFunc: func() (string, error) { return "", nil }}
+			},
+			expected: "kafka: AsyncMessageSourceConfig.SASL.PasswordFunc requires a SCRAM mechanism",
+		},
+		{
+			name: "every problem",
+			modify: func(c *AsyncMessageSourceConfig) {
+				c.Brokers, c.Topic, c.ConsumerGroup = nil, "", ""
+			},
+			expected: "3 problems: " +
+				"kafka: AsyncMessageSourceConfig.Brokers must not be empty; " +
+				"kafka: AsyncMessageSourceConfig.Topic must not be empty; " +
+				"kafka: AsyncMessageSourceConfig.ConsumerGroup must not be empty",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			c := validSourceConfig()
+			tst.modify(&c)
+			err := c.Validate()
+			if tst.expected == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tst.expected)
+			_, err = NewAsyncMessageSource(c)
+			assert.EqualError(t, err, tst.expected)
+		})
+	}
+}
+
+func TestAsyncMessageSinkConfigValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(*AsyncMessageSinkConfig)
+		expected string
+	}{
+		{
+			name:   "valid",
+			modify: func(c *AsyncMessageSinkConfig) {},
+		},
+		{
+			name: "valid with options",
+			modify: func(c *AsyncMessageSinkConfig) {
+				c.Version = "2.4.0"
+				c.RetryProduceErrors = true
+				c.ProduceRetryAttempts = 3
+				c.ProduceRetryBackoff = time.Second
+				c.PublishedRegistry = substrate.NewLRUPublishedRegistry(10)
+				c.IDFunc = func(substrate.Message) string { return "" }
+			},
+		},
+		{
+			name:     "no brokers",
+			modify:   func(c *AsyncMessageSinkConfig) { c.Brokers = nil },
+			expected: "kafka: AsyncMessageSinkConfig.Brokers must not be empty",
+		},
+		{
+			name:     "empty broker",
+			modify:   func(c *AsyncMessageSinkConfig) { c.Brokers = []string{""} },
+			expected: "kafka: AsyncMessageSinkConfig.Brokers must not contain an empty address, at index 0",
+		},
+		{
+			name:     "no topic",
+			modify:   func(c *AsyncMessageSinkConfig) { c.Topic = "" },
+			expected: "kafka: AsyncMessageSinkConfig.Topic must not be empty",
+		},
+		{
+			name:     "version",
+			modify:   func(c *AsyncMessageSinkConfig) { c.Version = "2" },
+			expected: "kafka: AsyncMessageSinkConfig.Version is invalid: invalid version `2`",
+		},
+		{
+			name:     "max message bytes",
+			modify:   func(c *AsyncMessageSinkConfig) { c.MaxMessageBytes = -1 },
+			expected: "kafka: AsyncMessageSinkConfig.MaxMessageBytes must not be negative",
+		},
+		{
+			name:     "flush messages",
+			modify:   func(c *AsyncMessageSinkConfig) { c.FlushMessages = -1 },
+			expected: "kafka: AsyncMessageSinkConfig.FlushMessages must not be negative",
+		},
+		{
+			name:     "flush frequency",
+			modify:   func(c *AsyncMessageSinkConfig) { c.FlushFrequency = -time.Second },
+			expected: "kafka: AsyncMessageSinkConfig.FlushFrequency must not be negative",
+		},
+		{
+			name:     "retries with strict ordering",
+			modify:   func(c *AsyncMessageSinkConfig) { c.RetryProduceErrors, c.StrictOrdering = true, true },
+			expected: "kafka: AsyncMessageSinkConfig.RetryProduceErrors cannot be combined with StrictOrdering",
+		},
+		{
+			name:     "produce retry attempts",
+			modify:   func(c *AsyncMessageSinkConfig) { c.ProduceRetryAttempts = -1 },
+			expected: "kafka: AsyncMessageSinkConfig.ProduceRetryAttempts must not be negative",
+		},
+		{
+			name:     "produce retry backoff",
+			modify:   func(c *AsyncMessageSinkConfig) { c.ProduceRetryBackoff = -time.Second },
+			expected: "kafka: AsyncMessageSinkConfig.ProduceRetryBackoff must not be negative",
+		},
+		{
+			name:     "per message timeout",
+			modify:   func(c *AsyncMessageSinkConfig) { c.PerMessageTimeout = -time.Second },
+			expected: "kafka: AsyncMessageSinkConfig.PerMessageTimeout must not be negative",
+		},
+		{
+			name:     "throttle check interval",
+			modify:   func(c *AsyncMessageSinkConfig) { c.ThrottleCheckInterval = -time.Second },
+			expected: "kafka: AsyncMessageSinkConfig.ThrottleCheckInterval must not be negative",
+		},
+		{
+			name:     "transform workers",
+			modify:   func(c *AsyncMessageSinkConfig) { c.TransformWorkers = -1 },
+			expected: "kafka: AsyncMessageSinkConfig.TransformWorkers must not be negative",
+		},
+		{
+			name:     "published registry without id func",
+			modify:   func(c *AsyncMessageSinkConfig) { c.PublishedRegistry = substrate.NewLRUPublishedRegistry(10) },
+			expected: "kafka: AsyncMessageSinkConfig.PublishedRegistry requires an IDFunc",
+		},
+		{
+			name:     "partition watch interval",
+			modify:   func(c *AsyncMessageSinkConfig) { c.PartitionWatchInterval = -time.Second },
+			expected: "kafka: AsyncMessageSinkConfig.PartitionWatchInterval must not be negative",
+		},
+		{
+			name:     "scram without client generator",
+			modify:   func(c *AsyncMessageSinkConfig) { c.SASL = &SASLConfig{Mechanism: sarama.SASLTypeSCRAMSHA512} },
+			expected: "kafka: AsyncMessageSinkConfig.SASL.SCRAMClientGeneratorFunc must be set for the SCRAM mechanisms",
+		},
+		{
+			name: "every problem",
+			modify: func(c *AsyncMessageSinkConfig) {
+				c.Topic, c.ProduceRetryAttempts = "", -1
+			},
+			expected: "2 problems: " +
+				"kafka: AsyncMessageSinkConfig.Topic must not be empty; " +
+				"kafka: AsyncMessageSinkConfig.ProduceRetryAttempts must not be negative",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			c := AsyncMessageSinkConfig{Brokers: []string{"localhost:9092"}, Topic: "t1"}
+			tst.modify(&c)
+			err := c.Validate()
+			if tst.expected == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tst.expected)
+			_, err = NewAsyncMessageSink(c)
+			assert.EqualError(t, err, tst.expected)
+		})
+	}
+}
+
+func TestDirectAsyncMessageSourceConfigValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(*DirectAsyncMessageSourceConfig)
+		expected string
+	}{
+		{
+			name:   "valid",
+			modify: func(c *DirectAsyncMessageSourceConfig) {},
+		},
+		{
+			name:     "no brokers",
+			modify:   func(c *DirectAsyncMessageSourceConfig) { c.Brokers = nil },
+			expected: "kafka: DirectAsyncMessageSourceConfig.Brokers must not be empty",
+		},
+		{
+			name:     "no topic",
+			modify:   func(c *DirectAsyncMessageSourceConfig) { c.Topic = "" },
+			expected: "kafka: DirectAsyncMessageSourceConfig.Topic must not be empty",
+		},
+		{
+			name:     "no partitions",
+			modify:   func(c *DirectAsyncMessageSourceConfig) { c.Partitions = nil },
+			expected: "kafka: DirectAsyncMessageSourceConfig.Partitions must not be empty",
+		},
+		{
+			name:     "offset",
+			modify:   func(c *DirectAsyncMessageSourceConfig) { c.Offset = 3 },
+			expected: "kafka: DirectAsyncMessageSourceConfig.Offset must be either OffsetOldest or OffsetNewest",
+		},
+		{
+			name:     "checkpoint interval",
+			modify:   func(c *DirectAsyncMessageSourceConfig) { c.CheckpointInterval = -time.Second },
+			expected: "kafka: DirectAsyncMessageSourceConfig.CheckpointInterval must not be negative",
+		},
+		{
+			name:     "version",
+			modify:   func(c *DirectAsyncMessageSourceConfig) { c.Version = "x" },
+			expected: "kafka: DirectAsyncMessageSourceConfig.Version is invalid: invalid version `x`",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			c := DirectAsyncMessageSourceConfig{Brokers: []string{"localhost:9092"}, Topic: "t1", Partitions: []int32{0}}
+			tst.modify(&c)
+			err := c.Validate()
+			if tst.expected == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tst.expected)
+			_, err = NewDirectAsyncMessageSource(c)
+			assert.EqualError(t, err, tst.expected)
+		})
+	}
+}
+
+func TestURLValidationErrors(t *testing.T) {
+	defer func() {
+		kafkaSourcer = NewAsyncMessageSource
+	}()
+	kafkaSourcer = NewAsyncMessageSource
+
+	// The problems of the config are reported as they are.
+	_, err := suburl.NewSource("kafka://localhost:9092/t1/?session-timeout=-1s")
+	assert.EqualError(t, err, "2 problems: "+
+		"kafka: AsyncMessageSourceConfig.ConsumerGroup must not be empty; "+
+		"kafka: AsyncMessageSourceConfig.SessionTimeout must not be negative")
+}
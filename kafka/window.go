@@ -0,0 +1,115 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// timeWindow restricts consumption to the messages with a timestamp between a
+// start and an end time, for replays.
+type timeWindow struct {
+	start     time.Time
+	end       time.Time
+	stop      bool
+	maxIdle   time.Duration
+	completed func(partition int32)
+
+	mu sync.Mutex
+	// reset holds the partitions whose offset has been reset to the start
+	// time.
+	reset map[int32]bool
+	// done holds the partitions that have passed the end time.
+	done map[int32]bool
+}
+
+func newTimeWindow(c AsyncMessageSourceConfig) *timeWindow {
+	if c.StartTime.IsZero() && c.EndTime.IsZero() {
+		return nil
+	}
+	return &timeWindow{
+		start:     c.StartTime,
+		end:       c.EndTime,
+		stop:      c.StopAtEndTime,
+		maxIdle:   c.MaxIdle,
+		completed: c.PartitionCompleted,
+		reset:     make(map[int32]bool),
+		done:      make(map[int32]bool),
+	}
+}
+
+// resetOffsets resets the offsets of the claimed partitions to the first
+// message at or after the start time. This is only done the first time each
+// partition is claimed, so that rebalances don't restart the replay.
+func (w *timeWindow) resetOffsets(client sarama.Client, topic string, sess sarama.ConsumerGroupSession) error {
+	if w == nil || w.start.IsZero() {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, partition := range sess.Claims()[topic] {
+		if w.reset[partition] {
+			continue
+		}
+		offset, err := client.GetOffset(topic, partition, w.start.UnixNano()/int64(time.Millisecond))
+		if err != nil {
+			return err
+		}
+		if offset == sarama.OffsetNewest {
+			// There are no messages after the start time.
+			if offset, err = client.GetOffset(topic, partition, sarama.OffsetNewest); err != nil {
+				return err
+			}
+		}
+		sess.ResetOffset(topic, partition, offset, "")
+		w.reset[partition] = true
+	}
+	return nil
+}
+
+// pastEnd reports whether the message is after the end time. Messages without
+// a timestamp, which requires a broker Version of at least 0.10.0, never are.
+func (w *timeWindow) pastEnd(m *sarama.ConsumerMessage) bool {
+	return w != nil && !w.end.IsZero() && m.Timestamp.After(w.end)
+}
+
+// idleTimeout returns the time after which an idle partition is considered
+// complete, or zero if idle partitions are not.
+func (w *timeWindow) idleTimeout() time.Duration {
+	if w == nil || w.end.IsZero() {
+		return 0
+	}
+	return w.maxIdle
+}
+
+// complete marks the partition as complete, reporting whether it wasn't
+// already.
+func (w *timeWindow) complete(partition int32) bool {
+	w.mu.Lock()
+	if w.done[partition] {
+		w.mu.Unlock()
+		return false
+	}
+	w.done[partition] = true
+	w.mu.Unlock()
+
+	if w.completed != nil {
+		w.completed(partition)
+	}
+	return true
+}
+
+// allComplete reports whether all the partitions are complete.
+func (w *timeWindow) allComplete(partitions []int32) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, p := range partitions {
+		if !w.done[p] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,219 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/substrate"
+)
+
+type fakeClient struct {
+	sarama.Client
+
+	offsets map[int64]int64
+}
+
+func (c *fakeClient) GetOffset(_ string, _ int32, time int64) (int64, error) {
+	return c.offsets[time], nil
+}
+
+type claimsSession struct {
+	*fakeSession
+
+	claims map[string][]int32
+	resets map[int32]int64
+}
+
+func (s *claimsSession) Claims() map[string][]int32 {
+	return s.claims
+}
+
+func (s *claimsSession) ResetOffset(_ string, partition int32, offset int64, _ string) {
+	s.resets[partition] = offset
+}
+
+func newClaimsSession(partitions ...int32) *claimsSession {
+	return &claimsSession{
+		fakeSession: &fakeSession{marked: make(map[int32]int64)},
+		claims:      map[string][]int32{"topic": partitions},
+		resets:      make(map[int32]int64),
+	}
+}
+
+func TestTimeWindowResetOffsets(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	startMillis := start.UnixNano() / int64(time.Millisecond)
+	client := &fakeClient{offsets: map[int64]int64{
+		startMillis:         sarama.OffsetNewest,
+		sarama.OffsetNewest: 42,
+	}}
+	w := newTimeWindow(AsyncMessageSourceConfig{StartTime: start})
+
+	sess := newClaimsSession(0)
+	require.NoError(t, w.resetOffsets(client, "topic", sess))
+	assert.Equal(t, map[int32]int64{0: 42}, sess.resets)
+
+	// Offsets are only reset the first time a partition is claimed.
+	client.offsets[startMillis] = 7
+	sess = newClaimsSession(0, 1)
+	require.NoError(t, w.resetOffsets(client, "topic", sess))
+	assert.Equal(t, map[int32]int64{1: 7}, sess.resets)
+
+	assert.Nil(t, newTimeWindow(AsyncMessageSourceConfig{}))
+}
+
+func TestTimeWindowConfigValidation(t *testing.T) {
+	now := time.Now()
+	conf := AsyncMessageSourceConfig{Brokers: []string{"localhost:9092"}, Topic: "topic", ConsumerGroup: "group"}
+	conf.StartTime, conf.EndTime = now, now.Add(-time.Hour)
+	_, err := NewAsyncMessageSource(conf)
+	assert.EqualError(t, err, "kafka: AsyncMessageSourceConfig.EndTime must not be before StartTime")
+	conf.StartTime, conf.EndTime, conf.StopAtEndTime = time.Time{}, time.Time{}, true
+	_, err = NewAsyncMessageSource(conf)
+	assert.EqualError(t, err, "kafka: AsyncMessageSourceConfig.StopAtEndTime requires an EndTime")
+}
+
+type fakeClaim struct {
+	sarama.ConsumerGroupClaim
+
+	partition     int32
+	initialOffset int64
+	messages      chan *sarama.ConsumerMessage
+}
+
+func (c *fakeClaim) Partition() int32 {
+	return c.partition
+}
+
+func (c *fakeClaim) InitialOffset() int64 {
+	return c.initialOffset
+}
+
+func (c *fakeClaim) Messages() <-chan *sarama.ConsumerMessage {
+	return c.messages
+}
+
+type windowTest struct {
+	ctx       context.Context
+	sess      *claimsSession
+	handler   *consumerGroupHandler
+	toClient  chan substrate.Message
+	acks      chan substrate.Message
+	errs      chan error
+	completed chan int32
+}
+
+func newWindowTest(ctx context.Context, c AsyncMessageSourceConfig, partitions ...int32) *windowTest {
+	wt := &windowTest{
+		ctx:       ctx,
+		sess:      newClaimsSession(partitions...),
+		toClient:  make(chan substrate.Message),
+		acks:      make(chan substrate.Message),
+		errs:      make(chan error, 1),
+		completed: make(chan int32, len(partitions)),
+	}
+	c.PartitionCompleted = func(p int32) { wt.completed <- p }
+	window := newTimeWindow(c)
+
+	toAck := make(chan *consumerMessage)
+	sessCh := make(chan sarama.ConsumerGroupSession, 1)
+	completeCh := make(chan struct{})
+	sessCh <- wt.sess
+	ap := &kafkaAcksProcessor{
+		toClient:    wt.toClient,
+		fromKafka:   toAck,
+		acks:        wt.acks,
+		sessCh:      sessCh,
+		rebalanceCh: make(chan struct{}),
+		completeCh:  completeCh,
+		topic:       "topic",
+		window:      window,
+	}
+	go func() {
+		wt.errs <- ap.run(ctx)
+	}()
+	wt.handler = &consumerGroupHandler{
+		ctx:        ctx,
+		topic:      "topic",
+		toAck:      toAck,
+		completeCh: completeCh,
+		window:     window,
+	}
+	return wt
+}
+
+func (wt *windowTest) claim(partition int32) chan *sarama.ConsumerMessage {
+	claim := &fakeClaim{partition: partition, messages: make(chan *sarama.ConsumerMessage)}
+	go func() {
+		_ = wt.handler.ConsumeClaim(wt.sess, claim)
+	}()
+	return claim.messages
+}
+
+func TestTimeWindowDropsMessagesAfterEndTime(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	end := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	wt := newWindowTest(ctx, AsyncMessageSourceConfig{EndTime: end}, 0)
+	claim := wt.claim(0)
+
+	claim <- &sarama.ConsumerMessage{Topic: "topic", Offset: 1, Timestamp: end.Add(-time.Second)}
+	m := <-wt.toClient
+	claim <- &sarama.ConsumerMessage{Topic: "topic", Offset: 2, Timestamp: end.Add(time.Second)}
+	claim <- &sarama.ConsumerMessage{Topic: "topic", Offset: 3, Timestamp: end.Add(time.Minute)}
+	assert.Equal(t, int32(0), <-wt.completed)
+
+	// The dropped messages are only marked once the delivered one is acked.
+	wt.sess.mu.Lock()
+	assert.Empty(t, wt.sess.marked)
+	wt.sess.mu.Unlock()
+	wt.acks <- m
+
+	assert.Eventually(t, func() bool {
+		wt.sess.mu.Lock()
+		defer wt.sess.mu.Unlock()
+		return wt.sess.marked[0] == 4
+	}, time.Second, time.Millisecond)
+
+	select {
+	case m := <-wt.toClient:
+		t.Errorf("unexpected message delivered after end time: %v", m)
+	default:
+	}
+}
+
+func TestTimeWindowStopsAtEndTime(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	end := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	wt := newWindowTest(ctx, AsyncMessageSourceConfig{EndTime: end, StopAtEndTime: true, MaxIdle: 50 * time.Millisecond}, 0, 1)
+	claim0 := wt.claim(0)
+	wt.claim(1)
+
+	claim0 <- &sarama.ConsumerMessage{Topic: "topic", Partition: 0, Offset: 1, Timestamp: end.Add(-time.Second)}
+	m := <-wt.toClient
+	claim0 <- &sarama.ConsumerMessage{Topic: "topic", Partition: 0, Offset: 2, Timestamp: end.Add(time.Second)}
+
+	// Partition 0 passes the end time, and idle partition 1 follows.
+	assert.Equal(t, int32(0), <-wt.completed)
+	assert.Equal(t, int32(1), <-wt.completed)
+
+	// Stopping waits for the delivered message to be acknowledged.
+	select {
+	case err := <-wt.errs:
+		t.Fatalf("stopped before the delivered message was acknowledged: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	wt.acks <- m
+	assert.Equal(t, errEndTimeReached, <-wt.errs)
+
+	wt.sess.mu.Lock()
+	defer wt.sess.mu.Unlock()
+	assert.Equal(t, map[int32]int64{0: 2}, wt.sess.marked)
+}
@@ -0,0 +1,153 @@
+package substrate
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/uw-labs/sync/rungroup"
+)
+
+// workerQueueSize is the number of messages that can be queued for each
+// worker of a KeyedWorkerPool.
+const workerQueueSize = 64
+
+// KeyedWorkerPool handles the messages of a source concurrently, while
+// handling messages with the same key serially, in the order they were
+// consumed.
+type KeyedWorkerPool struct {
+	source  AsyncMessageSource
+	keyFunc func(Message) []byte
+	workers int
+	handler ConsumerMessageHandler
+}
+
+// NewKeyedWorkerPool returns a worker pool that consumes messages from source
+// and calls handler for each of them on one of the given number of workers.
+// The worker of each message is chosen by hashing its key, as returned by
+// keyFunc, so all the messages with the same key are handled by the same
+// worker in order. Messages are acknowledged to source in the order they were
+// consumed, once they and all the messages before them have been handled.
+// When Close is called on the pool, this is also propagated to source.
+func NewKeyedWorkerPool(source AsyncMessageSource, keyFunc func(Message) []byte, workers int, handler ConsumerMessageHandler) *KeyedWorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	return &KeyedWorkerPool{
+		source:  source,
+		keyFunc: keyFunc,
+		workers: workers,
+		handler: handler,
+	}
+}
+
+// pooledMessage is a message dispatched to a worker, with done closed once it
+// has been handled.
+type pooledMessage struct {
+	msg  Message
+	done chan struct{}
+}
+
+// Run consumes and handles messages until the context is cancelled or an
+// error occurs. An error returned by the handler, or a panic in it, terminates
+// the pool without acknowledging the failing message.
+func (p *KeyedWorkerPool) Run(ctx context.Context) error {
+	rg, ctx := rungroup.New(ctx)
+
+	messages := make(chan Message)
+	acks := make(chan Message)
+	needAcks := make(chan pooledMessage, 1024)
+
+	rg.Go(func() error {
+		return p.source.ConsumeMessages(ctx, messages, acks)
+	})
+
+	queues := make([]chan pooledMessage, p.workers)
+	for i := range queues {
+		queue := make(chan pooledMessage, workerQueueSize)
+		queues[i] = queue
+		rg.Go(func() error {
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case pm := <-queue:
+					if err := p.handle(ctx, pm.msg); err != nil {
+						return err
+					}
+					close(pm.done)
+				}
+			}
+		})
+	}
+
+	rg.Go(func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case msg := <-messages:
+				pm := pooledMessage{msg: msg, done: make(chan struct{})}
+				select {
+				case needAcks <- pm:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				select {
+				case queues[p.worker(msg)] <- pm:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	})
+
+	rg.Go(func() error {
+		for {
+			var pm pooledMessage
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case pm = <-needAcks:
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-pm.done:
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case acks <- pm.msg:
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+// handle calls the handler, converting a panic into an error.
+func (p *KeyedWorkerPool) handle(ctx context.Context, msg Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while handling message: %v", r)
+		}
+	}()
+	return p.handler(ctx, msg)
+}
+
+func (p *KeyedWorkerPool) worker(msg Message) int {
+	h := fnv.New32a()
+	_, _ = h.Write(p.keyFunc(msg))
+	return int(h.Sum32() % uint32(p.workers))
+}
+
+// Close closes the underlying source.
+func (p *KeyedWorkerPool) Close() error {
+	return p.source.Close()
+}
+
+// Status returns the status of the underlying source.
+func (p *KeyedWorkerPool) Status() (*Status, error) {
+	return p.source.Status()
+}
@@ -0,0 +1,219 @@
+package substrate_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/inmemory"
+)
+
+type keyedMessage struct {
+	data []byte
+	key  []byte
+}
+
+func (m *keyedMessage) Data() []byte {
+	return m.data
+}
+
+func (m *keyedMessage) Key() []byte {
+	return m.key
+}
+
+func messageKey(msg substrate.Message) []byte {
+	return msg.(substrate.KeyedMessage).Key()
+}
+
+func publish(ctx context.Context, t *testing.T, broker *inmemory.Broker, msgs ...substrate.Message) {
+	sink, err := inmemory.NewAsyncMessageSink(inmemory.AsyncMessageSinkConfig{Broker: broker, Topic: "topic"})
+	require.NoError(t, err)
+	producer := substrate.NewSynchronousMessageSink(sink)
+	defer producer.Close()
+	for _, msg := range msgs {
+		require.NoError(t, producer.PublishMessage(ctx, msg))
+	}
+}
+
+func newSource(t *testing.T, broker *inmemory.Broker) substrate.AsyncMessageSource {
+	source, err := inmemory.NewAsyncMessageSource(inmemory.AsyncMessageSourceConfig{
+		Broker:        broker,
+		Topic:         "topic",
+		ConsumerGroup: "group",
+	})
+	require.NoError(t, err)
+	return source
+}
+
+func TestKeyedWorkerPoolOrdering(t *testing.T) {
+	broker := inmemory.NewBroker()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const keys, perKey = 10, 50
+	var msgs []substrate.Message
+	for i := 0; i < perKey; i++ {
+		for k := 0; k < keys; k++ {
+			msgs = append(msgs, &keyedMessage{
+				data: []byte(fmt.Sprintf("%d:%d", k, i)),
+				key:  []byte(fmt.Sprint(k)),
+			})
+		}
+	}
+	publish(ctx, t, broker, msgs...)
+
+	var (
+		mu       sync.Mutex
+		handled  = make(map[string][]string)
+		inFlight = make(map[string]bool)
+		total    int
+		finished = make(chan struct{})
+	)
+	handler := func(ctx context.Context, msg substrate.Message) error {
+		key := string(messageKey(msg))
+		mu.Lock()
+		if inFlight[key] {
+			mu.Unlock()
+			return errors.New("messages with the same key handled concurrently")
+		}
+		inFlight[key] = true
+		mu.Unlock()
+
+		time.Sleep(time.Duration(len(msg.Data())%3) * time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		inFlight[key] = false
+		handled[key] = append(handled[key], string(msg.Data()))
+		if total++; total == len(msgs) {
+			close(finished)
+		}
+		return nil
+	}
+
+	pool := substrate.NewKeyedWorkerPool(newSource(t, broker), messageKey, 4, handler)
+	errs := make(chan error, 1)
+	runCtx, stop := context.WithCancel(ctx)
+	go func() {
+		errs <- pool.Run(runCtx)
+	}()
+
+	select {
+	case <-finished:
+	case err := <-errs:
+		t.Fatal(err)
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+
+	for k := 0; k < keys; k++ {
+		var expected []string
+		for i := 0; i < perKey; i++ {
+			expected = append(expected, fmt.Sprintf("%d:%d", k, i))
+		}
+		assert.Equal(t, expected, handled[fmt.Sprint(k)])
+	}
+
+	// Give the last acknowledgements time to be committed.
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	assert.Equal(t, context.Canceled, <-errs)
+	assert.NoError(t, pool.Close())
+
+	// All the messages were acknowledged in order, so consuming resumes
+	// after them.
+	publish(ctx, t, broker, &keyedMessage{data: []byte("next")})
+	received := make(chan substrate.Message)
+	go func() {
+		_ = newSource(t, broker).ConsumeMessages(ctx, received, make(chan substrate.Message))
+	}()
+	assert.Equal(t, "next", string((<-received).Data()))
+}
+
+func TestKeyedWorkerPoolConcurrency(t *testing.T) {
+	broker := inmemory.NewBroker()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const count = 64
+	var msgs []substrate.Message
+	for i := 0; i < count; i++ {
+		msgs = append(msgs, &keyedMessage{data: []byte("data"), key: []byte(fmt.Sprint(i))})
+	}
+	publish(ctx, t, broker, msgs...)
+
+	var running, maxRunning, handled int32
+	finished := make(chan struct{})
+	handler := func(ctx context.Context, msg substrate.Message) error {
+		r := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if r <= m || atomic.CompareAndSwapInt32(&maxRunning, m, r) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		if atomic.AddInt32(&handled, 1) == count {
+			close(finished)
+		}
+		return nil
+	}
+
+	pool := substrate.NewKeyedWorkerPool(newSource(t, broker), messageKey, 8, handler)
+	start := time.Now()
+	go func() {
+		_ = pool.Run(ctx)
+	}()
+
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+	// Handling serially would take at least 640ms.
+	assert.True(t, time.Since(start) < 320*time.Millisecond, time.Since(start).String())
+	assert.True(t, atomic.LoadInt32(&maxRunning) > 1)
+	assert.True(t, atomic.LoadInt32(&maxRunning) <= 8)
+}
+
+func TestKeyedWorkerPoolHandlerFailures(t *testing.T) {
+	for name, handler := range map[string]substrate.ConsumerMessageHandler{
+		"error": func(context.Context, substrate.Message) error {
+			return errors.New("handler failed")
+		},
+		"panic": func(context.Context, substrate.Message) error {
+			panic("handler failed")
+		},
+	} {
+		handler := handler
+		t.Run(name, func(t *testing.T) {
+			broker := inmemory.NewBroker()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			publish(ctx, t, broker, &keyedMessage{data: []byte("data"), key: []byte("key")})
+
+			pool := substrate.NewKeyedWorkerPool(newSource(t, broker), messageKey, 2, handler)
+			err := pool.Run(ctx)
+			require.Error(t, err)
+			assert.True(t, strings.Contains(err.Error(), "handler failed"), err.Error())
+
+			// The failed message was not acknowledged.
+			received := make(chan substrate.Message)
+			go func() {
+				_ = newSource(t, broker).ConsumeMessages(ctx, received, make(chan substrate.Message))
+			}()
+			assert.Equal(t, "data", string((<-received).Data()))
+		})
+	}
+}
@@ -0,0 +1,365 @@
+package substrate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/uw-labs/sync/rungroup"
+)
+
+// Lifecycle coordinates the graceful shutdown of the sinks and sources of a
+// service. Sources and sinks are registered with AddSource and AddSink, and
+// the returned wrappers are then used in place of them. Shutdown stops
+// consuming, waits for the messages in flight to be acknowledged, and closes
+// every component. As the ConsumeMessages and PublishMessages calls of the
+// wrappers return nil once shutdown has completed, they can be run in the same
+// rungroup as the rest of the service.
+type Lifecycle struct {
+	stopConsuming  chan struct{}
+	stopPublishing chan struct{}
+	stopped        chan struct{}
+
+	shutdownOnce sync.Once
+	shutdownErr  error
+
+	mu         sync.Mutex
+	closers    []io.Closer
+	consumers  map[*drainer]struct{}
+	publishers map[*drainer]struct{}
+}
+
+// NewLifecycle returns a new Lifecycle without any registered components.
+func NewLifecycle() *Lifecycle {
+	return &Lifecycle{
+		stopConsuming:  make(chan struct{}),
+		stopPublishing: make(chan struct{}),
+		stopped:        make(chan struct{}),
+		consumers:      make(map[*drainer]struct{}),
+		publishers:     make(map[*drainer]struct{}),
+	}
+}
+
+// AddSource registers source, and returns a source to use in its place. Once
+// Shutdown is called, the returned source stops delivering messages, and
+// passes on the acknowledgements of the messages delivered so far. Its
+// ConsumeMessages calls return nil once shutdown has completed. The source is
+// closed by Shutdown, so it should not be closed otherwise.
+func (l *Lifecycle) AddSource(source AsyncMessageSource) AsyncMessageSource {
+	l.register(source)
+	return &lifecycleSource{source: source, lifecycle: l}
+}
+
+// AddSink registers sink, and returns a sink to use in its place. Once all
+// the sources have drained during Shutdown, the returned sink stops accepting
+// messages, and passes on the acknowledgements of the messages accepted so
+// far. Its PublishMessages calls return nil once shutdown has completed. The
+// sink is closed by Shutdown, so it should not be closed otherwise.
+func (l *Lifecycle) AddSink(sink AsyncMessageSink) AsyncMessageSink {
+	l.register(sink)
+	return &lifecycleSink{sink: sink, lifecycle: l}
+}
+
+// Shutdown gracefully shuts down all the registered components. It stops the
+// sources from delivering messages, waits for the messages that have been
+// delivered to be acknowledged, then waits for the sinks to acknowledge the
+// messages they have accepted. Once that is done, or ctx is done, all running
+// ConsumeMessages and PublishMessages calls return and the components are
+// closed in reverse registration order. The returned error aggregates the
+// errors of closing the components, and ctx.Err() if it was done before
+// everything was acknowledged. Calling Shutdown more than once returns the
+// result of the first call.
+func (l *Lifecycle) Shutdown(ctx context.Context) error {
+	l.shutdownOnce.Do(func() {
+		var err error
+
+		close(l.stopConsuming)
+		if werr := waitDrained(ctx, l.snapshot(l.consumers)); werr != nil {
+			err = multierror.Append(err, fmt.Errorf("waiting for consumed messages to be acknowledged: %w", werr))
+		}
+		close(l.stopPublishing)
+		if werr := waitDrained(ctx, l.snapshot(l.publishers)); werr != nil {
+			err = multierror.Append(err, fmt.Errorf("waiting for published messages to be acknowledged: %w", werr))
+		}
+
+		close(l.stopped)
+		running := append(l.snapshot(l.consumers), l.snapshot(l.publishers)...)
+		for _, d := range running {
+			select {
+			case <-d.returned:
+			case <-ctx.Done():
+			}
+		}
+
+		l.mu.Lock()
+		closers := l.closers
+		l.mu.Unlock()
+		for i := len(closers) - 1; i >= 0; i-- {
+			err = multierror.Append(err, closers[i].Close()).ErrorOrNil()
+		}
+		l.shutdownErr = err
+	})
+	return l.shutdownErr
+}
+
+func (l *Lifecycle) register(c io.Closer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closers = append(l.closers, c)
+}
+
+func (l *Lifecycle) snapshot(loops map[*drainer]struct{}) []*drainer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ds := make([]*drainer, 0, len(loops))
+	for d := range loops {
+		ds = append(ds, d)
+	}
+	return ds
+}
+
+// start registers a running ConsumeMessages or PublishMessages call.
+func (l *Lifecycle) start(loops map[*drainer]struct{}) *drainer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	d := &drainer{drained: make(chan struct{}), returned: make(chan struct{})}
+	loops[d] = struct{}{}
+	return d
+}
+
+func (l *Lifecycle) finish(loops map[*drainer]struct{}, d *drainer) {
+	l.mu.Lock()
+	delete(loops, d)
+	l.mu.Unlock()
+
+	d.drain()
+	close(d.returned)
+}
+
+// run runs a ConsumeMessages or PublishMessages loop, with a context that is
+// cancelled once shutdown completes, in which case nil is returned.
+func (l *Lifecycle) run(ctx context.Context, loop func(context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-l.stopped:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := loop(ctx)
+	select {
+	case <-l.stopped:
+		return nil
+	default:
+		return err
+	}
+}
+
+func waitDrained(ctx context.Context, ds []*drainer) error {
+	for _, d := range ds {
+		select {
+		case <-d.drained:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// drainer tracks the messages in flight of a running loop, and closes drained
+// once draining has started and no messages are in flight.
+type drainer struct {
+	mu       sync.Mutex
+	inFlight int
+	draining bool
+	closed   bool
+	drained  chan struct{}
+	returned chan struct{}
+}
+
+func (d *drainer) add() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.inFlight++
+}
+
+func (d *drainer) done() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.inFlight--
+	d.check()
+}
+
+func (d *drainer) drain() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.draining = true
+	d.check()
+}
+
+func (d *drainer) check() {
+	if d.draining && d.inFlight <= 0 && !d.closed {
+		d.closed = true
+		close(d.drained)
+	}
+}
+
+type lifecycleSource struct {
+	source    AsyncMessageSource
+	lifecycle *Lifecycle
+}
+
+func (s *lifecycleSource) ConsumeMessages(ctx context.Context, messages chan<- Message, acks <-chan Message) error {
+	l := s.lifecycle
+	d := l.start(l.consumers)
+	defer l.finish(l.consumers, d)
+
+	return l.run(ctx, func(ctx context.Context) error {
+		rg, ctx := rungroup.New(ctx)
+
+		fromInner := make(chan Message, cap(messages))
+		toInner := make(chan Message, cap(acks))
+
+		rg.Go(func() error {
+			return s.source.ConsumeMessages(ctx, fromInner, toInner)
+		})
+
+		rg.Go(func() error {
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-l.stopConsuming:
+					d.drain()
+					<-ctx.Done()
+					return ctx.Err()
+				case msg := <-fromInner:
+					// Count the message before delivering it, as it
+					// may be acknowledged straight away.
+					d.add()
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case <-l.stopConsuming:
+						// The message is not delivered, so it will be
+						// redelivered after a restart.
+						d.done()
+						d.drain()
+						<-ctx.Done()
+						return ctx.Err()
+					case messages <- msg:
+					}
+				}
+			}
+		})
+
+		rg.Go(func() error {
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case ack := <-acks:
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case toInner <- ack:
+					}
+					d.done()
+				}
+			}
+		})
+
+		return rg.Wait()
+	})
+}
+
+// Close closes the underlying source.
+func (s *lifecycleSource) Close() error {
+	return s.source.Close()
+}
+
+// Status returns the status of the underlying source.
+func (s *lifecycleSource) Status() (*Status, error) {
+	return s.source.Status()
+}
+
+type lifecycleSink struct {
+	sink      AsyncMessageSink
+	lifecycle *Lifecycle
+}
+
+func (s *lifecycleSink) PublishMessages(ctx context.Context, acks chan<- Message, messages <-chan Message) error {
+	l := s.lifecycle
+	d := l.start(l.publishers)
+	defer l.finish(l.publishers, d)
+
+	return l.run(ctx, func(ctx context.Context) error {
+		rg, ctx := rungroup.New(ctx)
+
+		toInner := make(chan Message, cap(messages))
+		fromInner := make(chan Message, cap(acks))
+
+		rg.Go(func() error {
+			return s.sink.PublishMessages(ctx, fromInner, toInner)
+		})
+
+		rg.Go(func() error {
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-l.stopPublishing:
+					d.drain()
+					<-ctx.Done()
+					return ctx.Err()
+				case msg := <-messages:
+					d.add()
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case toInner <- msg:
+					}
+				}
+			}
+		})
+
+		rg.Go(func() error {
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case ack := <-fromInner:
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case acks <- ack:
+					}
+					d.done()
+				}
+			}
+		})
+
+		return rg.Wait()
+	})
+}
+
+// Close closes the underlying sink.
+func (s *lifecycleSink) Close() error {
+	return s.sink.Close()
+}
+
+// Status returns the status of the underlying sink.
+func (s *lifecycleSink) Status() (*Status, error) {
+	return s.sink.Status()
+}
@@ -0,0 +1,109 @@
+package substrate
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LifecycleEventType identifies the kind of a LifecycleEvent. Its values are
+// stable, so that they can be logged and matched on by operational tooling.
+type LifecycleEventType string
+
+const (
+	// LifecycleConnected is emitted once a source or sink is connected to
+	// its backend.
+	LifecycleConnected LifecycleEventType = "connected"
+	// LifecycleDisconnected is emitted when the connection to the backend
+	// fails. The event carries the error.
+	LifecycleDisconnected LifecycleEventType = "disconnected"
+	// LifecycleReconnected is emitted when the connection to the backend is
+	// re-established after a failure.
+	LifecycleReconnected LifecycleEventType = "reconnected"
+	// LifecycleSessionStarted is emitted when a consumer session starts,
+	// such as a kafka consumer group session. The event carries the
+	// partitions assigned to the source, if any.
+	LifecycleSessionStarted LifecycleEventType = "session_started"
+	// LifecycleSessionEnded is emitted when a consumer session ends, e.g.
+	// when the consumer group rebalances.
+	LifecycleSessionEnded LifecycleEventType = "session_ended"
+	// LifecycleSwitched is emitted when a wrapper switches the backend it
+	// uses, such as a failover sink. The event detail is the backend
+	// switched to.
+	LifecycleSwitched LifecycleEventType = "switched"
+	// LifecycleFlushed is emitted when a sink has flushed the messages it
+	// buffered, e.g. when its producer is closed.
+	LifecycleFlushed LifecycleEventType = "flushed"
+	// LifecycleClosed is emitted once a source or sink is closed.
+	LifecycleClosed LifecycleEventType = "closed"
+)
+
+// LifecycleEvent is a connection level event of a source or sink, as opposed
+// to the messages it handles, e.g. for structured operational logging. The
+// backends supporting them emit them to the channel set in their config.
+type LifecycleEvent struct {
+	Type LifecycleEventType
+	// Backend is the name of the backend or wrapper emitting the event,
+	// such as "kafka" or "proximo".
+	Backend string
+	// Topic is the topic of the source or sink.
+	Topic string
+	// Time is when the event occurred.
+	Time time.Time
+	// Err is the error that caused the event, if any.
+	Err error
+	// Partitions are the partitions assigned to a source, for
+	// LifecycleSessionStarted.
+	Partitions []int32
+	// Detail describes the event further, such as the backend switched to
+	// for LifecycleSwitched.
+	Detail string
+	// Dropped is the total number of events dropped so far by the emitter
+	// of the event, as the channel was full.
+	Dropped uint64
+}
+
+// LifecycleEmitter emits the lifecycle events of a source or sink to a
+// channel without blocking. Events are dropped when the channel is full, so
+// the channel should be buffered, and the number of events dropped is
+// reported with every event. A nil LifecycleEmitter emits nothing, so that
+// callers don't need to check whether events are enabled.
+type LifecycleEmitter struct {
+	events  chan<- LifecycleEvent
+	backend string
+	topic   string
+	dropped uint64
+}
+
+// NewLifecycleEmitter returns an emitter of the events of a source or sink of
+// the backend on the topic, or nil if events is nil.
+func NewLifecycleEmitter(events chan<- LifecycleEvent, backend, topic string) *LifecycleEmitter {
+	if events == nil {
+		return nil
+	}
+	return &LifecycleEmitter{events: events, backend: backend, topic: topic}
+}
+
+// Emit sends the event to the channel, unless it is full, in which case the
+// event is dropped. The backend, topic and time of the event are set.
+func (e *LifecycleEmitter) Emit(ev LifecycleEvent) {
+	if e == nil {
+		return
+	}
+	ev.Backend = e.backend
+	ev.Topic = e.topic
+	ev.Time = time.Now()
+	ev.Dropped = atomic.LoadUint64(&e.dropped)
+	select {
+	case e.events <- ev:
+	default:
+		atomic.AddUint64(&e.dropped, 1)
+	}
+}
+
+// Dropped returns the number of events dropped so far.
+func (e *LifecycleEmitter) Dropped() uint64 {
+	if e == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&e.dropped)
+}
@@ -0,0 +1,36 @@
+package substrate
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLifecycleEmitter(t *testing.T) {
+	events := make(chan LifecycleEvent, 1)
+	emitter := NewLifecycleEmitter(events, "kafka", "topic")
+
+	errDown := errors.New("down")
+	emitter.Emit(LifecycleEvent{Type: LifecycleDisconnected, Err: errDown})
+	// The channel is full, so the event is dropped rather than blocking.
+	emitter.Emit(LifecycleEvent{Type: LifecycleReconnected})
+	assert.Equal(t, uint64(1), emitter.Dropped())
+
+	ev := <-events
+	assert.Equal(t, LifecycleDisconnected, ev.Type)
+	assert.Equal(t, "kafka", ev.Backend)
+	assert.Equal(t, "topic", ev.Topic)
+	assert.Equal(t, errDown, ev.Err)
+	assert.False(t, ev.Time.IsZero())
+
+	emitter.Emit(LifecycleEvent{Type: LifecycleClosed})
+	ev = <-events
+	assert.Equal(t, LifecycleClosed, ev.Type)
+	assert.Equal(t, uint64(1), ev.Dropped)
+
+	// A nil emitter emits nothing.
+	emitter = NewLifecycleEmitter(nil, "kafka", "topic")
+	emitter.Emit(LifecycleEvent{Type: LifecycleClosed})
+	assert.Zero(t, emitter.Dropped())
+}
@@ -0,0 +1,174 @@
+package substrate
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gatedAsyncSink acknowledges messages once they are released.
+type gatedAsyncSink struct {
+	release chan struct{}
+	closed  func()
+}
+
+func (s *gatedAsyncSink) PublishMessages(ctx context.Context, acks chan<- Message, messages <-chan Message) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg := <-messages:
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-s.release:
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case acks <- msg:
+			}
+		}
+	}
+}
+
+func (s *gatedAsyncSink) Close() error {
+	s.closed()
+	return nil
+}
+
+func (s *gatedAsyncSink) Status() (*Status, error) {
+	return &Status{Working: true}, nil
+}
+
+func TestLifecycleShutdown(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		closed []string
+	)
+	recordClose := func(name string) func() {
+		return func() {
+			mu.Lock()
+			defer mu.Unlock()
+			closed = append(closed, name)
+		}
+	}
+
+	m1, m2, m3, out := message("m1"), message("m2"), message("m3"), message("out")
+	inner := newStreamingAsyncSource(&m1, &m2, &m3)
+	innerSink := &gatedAsyncSink{release: make(chan struct{}), closed: recordClose("sink")}
+
+	l := NewLifecycle()
+	source := l.AddSource(inner)
+	sink := l.AddSink(innerSink)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	toPublish := make(chan Message)
+	published := make(chan Message, 1)
+	errs := make(chan error, 2)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+	go func() {
+		errs <- sink.PublishMessages(ctx, published, toPublish)
+	}()
+
+	assert.Equal(t, &m1, <-msgs)
+	assert.Equal(t, &m2, <-msgs)
+	toPublish <- &out
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- l.Shutdown(ctx)
+	}()
+
+	// Shutdown waits for the delivered messages to be acknowledged.
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("shutdown completed with unacknowledged messages: %v", err)
+	default:
+	}
+	acks <- &m1
+	acks <- &m2
+	assert.Equal(t, &m1, <-inner.acked)
+	assert.Equal(t, &m2, <-inner.acked)
+
+	// Then for the sink to acknowledge the published message.
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("shutdown completed with unacknowledged messages: %v", err)
+	default:
+	}
+	close(innerSink.release)
+	assert.Equal(t, &out, <-published)
+
+	require.NoError(t, <-shutdownErr)
+	assert.NoError(t, <-errs)
+	assert.NoError(t, <-errs)
+
+	// The third message was never delivered.
+	select {
+	case m := <-msgs:
+		t.Errorf("unexpected message delivered: %s", m.Data())
+	default:
+	}
+
+	select {
+	case <-inner.closed:
+	default:
+		t.Error("source didn't get closed")
+	}
+	assert.Equal(t, []string{"sink"}, closed)
+	assert.NoError(t, l.Shutdown(ctx))
+}
+
+func TestLifecycleShutdownClosesInReverseOrder(t *testing.T) {
+	var closed []string
+	l := NewLifecycle()
+	for _, name := range []string{"first", "second", "third"} {
+		name := name
+		l.AddSink(&gatedAsyncSink{closed: func() { closed = append(closed, name) }})
+	}
+
+	assert.NoError(t, l.Shutdown(context.Background()))
+	assert.Equal(t, []string{"third", "second", "first"}, closed)
+}
+
+func TestLifecycleShutdownDeadline(t *testing.T) {
+	m1 := message("m1")
+	inner := newStreamingAsyncSource(&m1)
+	l := NewLifecycle()
+	source := l.AddSource(inner)
+
+	msgs := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(context.Background(), msgs, make(chan Message))
+	}()
+	<-msgs
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := l.Shutdown(ctx)
+	require.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), context.DeadlineExceeded.Error()), err.Error())
+
+	// Consuming stops and the source is closed regardless.
+	assert.NoError(t, <-errs)
+	select {
+	case <-inner.closed:
+	default:
+		t.Error("source didn't get closed")
+	}
+}
@@ -0,0 +1,32 @@
+// Package localqueue provides a durable local queue for substrate, backed by
+// a bbolt database, for store and forward use at the edge.
+//
+// Usage
+//
+// This package support two methods of use.  The first is to directly use this package. See the function documentation for more details.
+//
+// The second method is to use the suburl package. See https://godoc.org/github.com/uw-labs/substrate/suburl for more information.
+//
+// A sink accepts messages into the queue, acknowledging them once they are
+// fsynced to disk, and a source in the same or a later process delivers them
+// in insertion order, removing them from the queue once acknowledged. A queue
+// is a directory holding a bbolt database of the unacknowledged messages,
+// keyed by sequence number. Its transactions are atomic, so a crash never
+// leaves a partially written message, and unacknowledged messages are
+// redelivered when the queue is opened again. A corrupt database fails
+// opening the queue rather than dropping messages. A queue can only be open
+// in a single process at a time.
+//
+// Using suburl
+//
+// The url structure is localqueue:///path/to/dir
+//
+// For sinks, the following url parameters are available
+//
+//      max-bytes - The maximum size in bytes of the unacknowledged messages.
+//
+// For sources, the following url parameters are available
+//
+//      max-age - The age after which messages are dropped. E.g., '1h' '24h'
+//
+package localqueue
@@ -0,0 +1,97 @@
+package localqueue
+
+import (
+	"context"
+
+	"github.com/uw-labs/substrate"
+)
+
+var _ substrate.AsyncMessageSink = (*asyncMessageSink)(nil)
+
+const maxAppendBatch = 1024
+
+// AsyncMessageSinkConfig is the configuration parameters for an
+// AsyncMessageSink.
+type AsyncMessageSinkConfig struct {
+	// Dir is the directory holding the queue. It is created if needed.
+	Dir string
+	// MaxBytes is the maximum size of the unacknowledged messages, as
+	// reported by Stats. When it would be exceeded, publishing fails with
+	// ErrQueueFull. Zero means no limit.
+	MaxBytes int64
+}
+
+// NewAsyncMessageSink returns a new sink appending messages to the local
+// queue in the configured directory. Messages are acknowledged once they are
+// durably written to disk. The returned sink implements Statser.
+func NewAsyncMessageSink(c AsyncMessageSinkConfig) (substrate.AsyncMessageSink, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	q, err := acquire(c.Dir)
+	if err != nil {
+		return nil, err
+	}
+	return &asyncMessageSink{q: q, conf: c}, nil
+}
+
+type asyncMessageSink struct {
+	q    *queue
+	conf AsyncMessageSinkConfig
+}
+
+func (ams *asyncMessageSink) PublishMessages(ctx context.Context, acks chan<- substrate.Message, messages <-chan substrate.Message) error {
+	for {
+		var batch []substrate.Message
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg := <-messages:
+			batch = append(batch, msg)
+		}
+
+		// Append whatever else is already waiting, so that it shares a
+		// single fsync.
+	drain:
+		for len(batch) < maxAppendBatch {
+			select {
+			case msg := <-messages:
+				batch = append(batch, msg)
+			default:
+				break drain
+			}
+		}
+
+		payloads := make([][]byte, len(batch))
+		for i, msg := range batch {
+			payloads[i] = msg.Data()
+		}
+		n, appendErr := ams.q.append(payloads, ams.conf.MaxBytes)
+
+		for _, msg := range batch[:n] {
+			select {
+			case acks <- msg:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if appendErr != nil {
+			return appendErr
+		}
+	}
+}
+
+// Stats returns a snapshot of the queue contents.
+func (ams *asyncMessageSink) Stats() Stats {
+	return ams.q.stats()
+}
+
+func (ams *asyncMessageSink) Status() (*substrate.Status, error) {
+	return &substrate.Status{Working: true}, nil
+}
+
+// Close implements the Close method of the substrate.AsyncMessageSink
+// interface.
+func (ams *asyncMessageSink) Close() error {
+	return ams.q.release()
+}
@@ -0,0 +1,183 @@
+package localqueue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/uw-labs/substrate"
+)
+
+var _ substrate.AsyncMessageSource = (*asyncMessageSource)(nil)
+
+// AsyncMessageSourceConfig is the configuration parameters for an
+// AsyncMessageSource.
+type AsyncMessageSourceConfig struct {
+	// Dir is the directory holding the queue. It is created if needed.
+	Dir string
+	// MaxAge is the maximum age of a message. Older messages are dropped
+	// instead of being delivered. Zero means no limit.
+	MaxAge time.Duration
+}
+
+// NewAsyncMessageSource returns a new source delivering the messages of the
+// local queue in the configured directory, in the order they were appended.
+// Messages are removed from the queue once acknowledged. Only a single source
+// may be open for a queue at a time. The returned source implements Statser.
+func NewAsyncMessageSource(c AsyncMessageSourceConfig) (substrate.AsyncMessageSource, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	q, err := acquire(c.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	registryMu.Lock()
+	taken := q.hasSource
+	q.hasSource = true
+	registryMu.Unlock()
+	if taken {
+		_ = q.release()
+		return nil, fmt.Errorf("local queue %s already has a source", q.dir)
+	}
+
+	return &asyncMessageSource{q: q, conf: c}, nil
+}
+
+type asyncMessageSource struct {
+	q    *queue
+	conf AsyncMessageSourceConfig
+}
+
+type consumerMessage struct {
+	data []byte
+}
+
+func (cm *consumerMessage) Data() []byte {
+	return cm.data
+}
+
+// pendingRecord is a delivered record waiting for its ack, or an expired
+// record (with a nil msg) that is removed along with its predecessors.
+type pendingRecord struct {
+	msg   *consumerMessage
+	end   uint64
+	acked bool
+}
+
+func (ams *asyncMessageSource) ConsumeMessages(ctx context.Context, messages chan<- substrate.Message, acks <-chan substrate.Message) error {
+	var (
+		// readOff is the sequence number to read from next. The queue
+		// only holds unacknowledged records, so reading starts from its
+		// first one.
+		readOff uint64
+		pending []pendingRecord
+		next    *pendingRecord
+	)
+
+	for {
+		var wake <-chan struct{}
+		if next == nil {
+			rec, w, err := ams.q.next(readOff)
+			if err != nil {
+				return err
+			}
+			wake = w
+			if rec != nil {
+				readOff = rec.end
+				if ams.conf.MaxAge > 0 && time.Since(rec.ts) > ams.conf.MaxAge {
+					pending = append(pending, pendingRecord{end: rec.end})
+					if err := ams.commit(&pending); err != nil {
+						return err
+					}
+					continue
+				}
+				next = &pendingRecord{msg: &consumerMessage{data: rec.data}, end: rec.end}
+			}
+		}
+
+		var toClient chan<- substrate.Message
+		var msg substrate.Message
+		if next != nil {
+			toClient, msg = messages, next.msg
+		}
+
+		select {
+		case toClient <- msg:
+			pending = append(pending, *next)
+			next = nil
+		case <-wake:
+		case ack := <-acks:
+			if err := ams.ack(&pending, ack); err != nil {
+				return err
+			}
+			// Handle any further acks that are already waiting before
+			// committing, to reduce the number of fsyncs.
+		drain:
+			for {
+				select {
+				case ack := <-acks:
+					if err := ams.ack(&pending, ack); err != nil {
+						return err
+					}
+				default:
+					break drain
+				}
+			}
+			if err := ams.commit(&pending); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ack marks the first delivered record as acknowledged, checking that it is
+// the expected one.
+func (ams *asyncMessageSource) ack(pending *[]pendingRecord, ack substrate.Message) error {
+	for i, p := range *pending {
+		if p.msg == nil || p.acked {
+			continue
+		}
+		if !substrate.SameMessage(ack, p.msg) {
+			return substrate.InvalidAckError{Acked: ack, Expected: p.msg}
+		}
+		(*pending)[i].acked = true
+		return nil
+	}
+	return substrate.InvalidAckError{Acked: ack, Expected: nil}
+}
+
+// commit removes the leading acknowledged and expired records from the queue.
+func (ams *asyncMessageSource) commit(pending *[]pendingRecord) error {
+	n := 0
+	for n < len(*pending) && ((*pending)[n].msg == nil || (*pending)[n].acked) {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	end := (*pending)[n-1].end
+	*pending = (*pending)[n:]
+	return ams.q.commit(end)
+}
+
+// Stats returns a snapshot of the queue contents.
+func (ams *asyncMessageSource) Stats() Stats {
+	return ams.q.stats()
+}
+
+func (ams *asyncMessageSource) Status() (*substrate.Status, error) {
+	return &substrate.Status{Working: true}, nil
+}
+
+// Close implements the Close method of the substrate.AsyncMessageSource
+// interface.
+func (ams *asyncMessageSource) Close() error {
+	registryMu.Lock()
+	ams.q.hasSource = false
+	registryMu.Unlock()
+	return ams.q.release()
+}
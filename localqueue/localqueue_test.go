@@ -0,0 +1,291 @@
+package localqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+)
+
+type message struct {
+	data []byte
+}
+
+func (m *message) Data() []byte {
+	return m.data
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "localqueue")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func publish(t *testing.T, conf AsyncMessageSinkConfig, payloads ...string) error {
+	sink, err := NewAsyncMessageSink(conf)
+	require.NoError(t, err)
+	defer sink.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan substrate.Message, len(payloads))
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishMessages(ctx, acks, msgs)
+	}()
+
+	for _, p := range payloads {
+		msgs <- &message{data: []byte(p)}
+	}
+	for range payloads {
+		select {
+		case <-acks:
+		case err := <-errs:
+			return err
+		}
+	}
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		return err
+	}
+	return nil
+}
+
+type consumer struct {
+	source substrate.AsyncMessageSource
+	msgs   chan substrate.Message
+	acks   chan substrate.Message
+	errs   chan error
+	cancel context.CancelFunc
+}
+
+func startConsumer(t *testing.T, conf AsyncMessageSourceConfig) *consumer {
+	source, err := NewAsyncMessageSource(conf)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	c := &consumer{
+		source: source,
+		msgs:   make(chan substrate.Message),
+		acks:   make(chan substrate.Message),
+		errs:   make(chan error, 1),
+		cancel: cancel,
+	}
+	go func() {
+		c.errs <- source.ConsumeMessages(ctx, c.msgs, c.acks)
+	}()
+	return c
+}
+
+// receive returns the payloads of the next n messages, acknowledging the
+// first acked of them.
+func (c *consumer) receive(t *testing.T, n, acked int) []string {
+	var payloads []string
+	for i := 0; i < n; i++ {
+		select {
+		case m := <-c.msgs:
+			payloads = append(payloads, string(m.Data()))
+			if i < acked {
+				c.acks <- m
+			}
+		case err := <-c.errs:
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	return payloads
+}
+
+// waitForMessages waits until acknowledgements have been committed and the
+// queue holds n messages.
+func (c *consumer) waitForMessages(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for c.source.(Statser).Stats().Messages != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d messages in queue", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (c *consumer) stop(t *testing.T) {
+	c.cancel()
+	assert.Equal(t, context.Canceled, <-c.errs)
+	require.NoError(t, c.source.Close())
+}
+
+func TestPublishAndConsume(t *testing.T) {
+	dir := tempDir(t)
+
+	require.NoError(t, publish(t, AsyncMessageSinkConfig{Dir: dir}, "one", "two", "", "three"))
+
+	c := startConsumer(t, AsyncMessageSourceConfig{Dir: dir})
+	assert.Equal(t, Stats{Messages: 4, Bytes: 4*recordOverhead + 11}, c.source.(Statser).Stats())
+	assert.Equal(t, []string{"one", "two", "", "three"}, c.receive(t, 4, 4))
+
+	// Messages published while consuming are delivered too.
+	require.NoError(t, publish(t, AsyncMessageSinkConfig{Dir: dir}, "four"))
+	assert.Equal(t, []string{"four"}, c.receive(t, 1, 1))
+	c.stop(t)
+
+	c = startConsumer(t, AsyncMessageSourceConfig{Dir: dir})
+	assert.Equal(t, Stats{}, c.source.(Statser).Stats())
+	c.stop(t)
+}
+
+// copyQueue copies the database of the queue in dir while it is open, as a
+// crash at that point would leave it, and returns the directory of the copy.
+func copyQueue(t *testing.T, dir string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, dbFileName))
+	require.NoError(t, err)
+	crashed := tempDir(t)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(crashed, dbFileName), data, 0644))
+	return crashed
+}
+
+func TestCrashRecovery(t *testing.T) {
+	dir := tempDir(t)
+
+	require.NoError(t, publish(t, AsyncMessageSinkConfig{Dir: dir}, "one", "two", "three", "four"))
+
+	c := startConsumer(t, AsyncMessageSourceConfig{Dir: dir})
+	assert.Equal(t, []string{"one", "two", "three"}, c.receive(t, 3, 2))
+	c.waitForMessages(t, 2)
+	crashed := copyQueue(t, dir)
+	c.stop(t)
+
+	// The acknowledged messages are gone and the others are redelivered.
+	c = startConsumer(t, AsyncMessageSourceConfig{Dir: crashed})
+	assert.Equal(t, 2, c.source.(Statser).Stats().Messages)
+	assert.Equal(t, []string{"three", "four"}, c.receive(t, 2, 2))
+	c.stop(t)
+}
+
+func TestCrashKeepsPublishedMessages(t *testing.T) {
+	dir := tempDir(t)
+
+	sink, err := NewAsyncMessageSink(AsyncMessageSinkConfig{Dir: dir})
+	require.NoError(t, err)
+	defer sink.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msgs := make(chan substrate.Message, 3)
+	acks := make(chan substrate.Message, 3)
+	go func() {
+		_ = sink.PublishMessages(ctx, acks, msgs)
+	}()
+	for _, p := range []string{"one", "two", "three"} {
+		msgs <- &message{data: []byte(p)}
+	}
+	for i := 0; i < 3; i++ {
+		<-acks
+	}
+
+	// Every acknowledged message is on disk, without closing the sink.
+	c := startConsumer(t, AsyncMessageSourceConfig{Dir: copyQueue(t, dir)})
+	assert.Equal(t, []string{"one", "two", "three"}, c.receive(t, 3, 3))
+	c.stop(t)
+}
+
+func TestCorruptQueueFails(t *testing.T) {
+	dir := tempDir(t)
+
+	require.NoError(t, publish(t, AsyncMessageSinkConfig{Dir: dir}, "one", "two"))
+
+	path := filepath.Join(dir, dbFileName)
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	// Both meta pages are overwritten.
+	for i := range data[:2*os.Getpagesize()] {
+		data[i] = 0xff
+	}
+	require.NoError(t, ioutil.WriteFile(path, data, 0644))
+
+	_, err = NewAsyncMessageSource(AsyncMessageSourceConfig{Dir: dir})
+	assert.Error(t, err)
+}
+
+func TestMaxBytes(t *testing.T) {
+	dir := tempDir(t)
+	conf := AsyncMessageSinkConfig{Dir: dir, MaxBytes: 2 * (recordOverhead + 3)}
+
+	require.NoError(t, publish(t, conf, "one", "two"))
+	assert.Equal(t, ErrQueueFull, publish(t, conf, "six"))
+
+	c := startConsumer(t, AsyncMessageSourceConfig{Dir: dir})
+	c.receive(t, 1, 1)
+	c.waitForMessages(t, 1)
+	require.NoError(t, publish(t, conf, "six"))
+	assert.Equal(t, []string{"two", "six"}, c.receive(t, 2, 2))
+	c.stop(t)
+}
+
+func TestMaxAge(t *testing.T) {
+	dir := tempDir(t)
+
+	require.NoError(t, publish(t, AsyncMessageSinkConfig{Dir: dir}, "old", "older"))
+	time.Sleep(100 * time.Millisecond)
+
+	c := startConsumer(t, AsyncMessageSourceConfig{Dir: dir, MaxAge: 50 * time.Millisecond})
+	require.NoError(t, publish(t, AsyncMessageSinkConfig{Dir: dir}, "new"))
+	assert.Equal(t, []string{"new"}, c.receive(t, 1, 1))
+	c.stop(t)
+
+	c = startConsumer(t, AsyncMessageSourceConfig{Dir: dir})
+	assert.Equal(t, Stats{}, c.source.(Statser).Stats())
+	c.stop(t)
+}
+
+func TestInvalidAck(t *testing.T) {
+	dir := tempDir(t)
+
+	require.NoError(t, publish(t, AsyncMessageSinkConfig{Dir: dir}, "one"))
+
+	c := startConsumer(t, AsyncMessageSourceConfig{Dir: dir})
+	first := <-c.msgs
+	other := &message{data: []byte("one")}
+	c.acks <- other
+	assert.Equal(t, substrate.InvalidAckError{Acked: other, Expected: first}, <-c.errs)
+	require.NoError(t, c.source.Close())
+}
+
+type ackKey struct{}
+
+func TestAckWrappedMessage(t *testing.T) {
+	dir := tempDir(t)
+
+	require.NoError(t, publish(t, AsyncMessageSinkConfig{Dir: dir}, "one", "two"))
+
+	// Wrappers are acknowledged as the messages they wrap, which are
+	// removed from the queue.
+	c := startConsumer(t, AsyncMessageSourceConfig{Dir: dir})
+	for i := 0; i < 2; i++ {
+		c.acks <- substrate.WithValue(<-c.msgs, ackKey{}, i)
+	}
+	c.waitForMessages(t, 0)
+	c.stop(t)
+}
+
+func TestSingleSource(t *testing.T) {
+	dir := tempDir(t)
+
+	source, err := NewAsyncMessageSource(AsyncMessageSourceConfig{Dir: dir})
+	require.NoError(t, err)
+
+	_, err = NewAsyncMessageSource(AsyncMessageSourceConfig{Dir: dir})
+	assert.Error(t, err)
+
+	require.NoError(t, source.Close())
+	source, err = NewAsyncMessageSource(AsyncMessageSourceConfig{Dir: dir})
+	require.NoError(t, err)
+	require.NoError(t, source.Close())
+}
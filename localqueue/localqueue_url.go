@@ -0,0 +1,52 @@
+package localqueue
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/suburl"
+)
+
+func init() {
+	suburl.RegisterSink("localqueue", newLocalQueueSink)
+	suburl.RegisterSource("localqueue", newLocalQueueSource)
+}
+
+func newLocalQueueSink(u *url.URL) (substrate.AsyncMessageSink, error) {
+	conf := AsyncMessageSinkConfig{
+		Dir: u.Path,
+	}
+
+	if v := u.Query().Get("max-bytes"); v != "" {
+		maxBytes, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse max-bytes value '%s'", v)
+		}
+		conf.MaxBytes = maxBytes
+	}
+
+	return localQueueSinker(conf)
+}
+
+var localQueueSinker = NewAsyncMessageSink
+
+func newLocalQueueSource(u *url.URL) (substrate.AsyncMessageSource, error) {
+	conf := AsyncMessageSourceConfig{
+		Dir: u.Path,
+	}
+
+	if v := u.Query().Get("max-age"); v != "" {
+		maxAge, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse max-age value '%s'", v)
+		}
+		conf.MaxAge = maxAge
+	}
+
+	return localQueueSourcer(conf)
+}
+
+var localQueueSourcer = NewAsyncMessageSource
@@ -0,0 +1,93 @@
+package localqueue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/suburl"
+)
+
+func TestLocalQueueSink(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		expected    AsyncMessageSinkConfig
+		expectedErr bool
+	}{
+		{
+			name:     "simple",
+			input:    "localqueue:///var/lib/queue",
+			expected: AsyncMessageSinkConfig{Dir: "/var/lib/queue"},
+		},
+		{
+			name:     "everything",
+			input:    "localqueue:///var/lib/queue?max-bytes=1048576",
+			expected: AsyncMessageSinkConfig{Dir: "/var/lib/queue", MaxBytes: 1048576},
+		},
+		{
+			name:        "invalid max bytes",
+			input:       "localqueue:///var/lib/queue?max-bytes=lots",
+			expectedErr: true,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			var conf AsyncMessageSinkConfig
+			localQueueSinker = func(c AsyncMessageSinkConfig) (substrate.AsyncMessageSink, error) {
+				conf = c
+				return nil, nil
+			}
+			_, err := suburl.NewSink(tst.input)
+
+			if tst.expectedErr == (err == nil) {
+				t.Errorf("expected error %v but got %v", tst.expectedErr, err)
+			}
+			assert.Equal(t, tst.expected, conf)
+		})
+	}
+}
+
+func TestLocalQueueSource(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		expected    AsyncMessageSourceConfig
+		expectedErr bool
+	}{
+		{
+			name:     "simple",
+			input:    "localqueue:///var/lib/queue",
+			expected: AsyncMessageSourceConfig{Dir: "/var/lib/queue"},
+		},
+		{
+			name:     "everything",
+			input:    "localqueue:///var/lib/queue?max-age=24h",
+			expected: AsyncMessageSourceConfig{Dir: "/var/lib/queue", MaxAge: 24 * time.Hour},
+		},
+		{
+			name:        "invalid max age",
+			input:       "localqueue:///var/lib/queue?max-age=forever",
+			expectedErr: true,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			var conf AsyncMessageSourceConfig
+			localQueueSourcer = func(c AsyncMessageSourceConfig) (substrate.AsyncMessageSource, error) {
+				conf = c
+				return nil, nil
+			}
+			_, err := suburl.NewSource(tst.input)
+
+			if tst.expectedErr == (err == nil) {
+				t.Errorf("expected error %v but got %v", tst.expectedErr, err)
+			}
+			assert.Equal(t, tst.expected, conf)
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package localqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrQueueFull is returned by the sink when appending messages would exceed
+// the configured maximum queue size.
+var ErrQueueFull = errors.New("local queue is full")
+
+const (
+	dbFileName = "queue.db"
+
+	// Each record is stored under its sequence number, with a value made of
+	// the enqueue time in unix nanoseconds followed by the payload.
+	recordOverhead = 16
+
+	// openTimeout is how long opening a queue waits for the lock held by
+	// another process that has it open.
+	openTimeout = time.Second
+)
+
+var messagesBucket = []byte("messages")
+
+// Stats is a snapshot of the contents of a local queue.
+type Stats struct {
+	// Messages is the number of messages that have not been acknowledged.
+	Messages int
+	// Bytes is the size of the unacknowledged messages, including the 16
+	// bytes of their key and enqueue time.
+	Bytes int64
+}
+
+// Statser is implemented by the sinks and sources of this package.
+type Statser interface {
+	Stats() Stats
+}
+
+type record struct {
+	data []byte
+	ts   time.Time
+	end  uint64
+}
+
+// queue is a bbolt database holding the unacknowledged records, keyed by
+// their sequence number. Acknowledged records are deleted.
+type queue struct {
+	dir  string
+	refs int
+
+	// hasSource is guarded by registryMu.
+	hasSource bool
+
+	mu     sync.Mutex
+	db     *bolt.DB
+	tail   uint64
+	count  int
+	bytes  int64
+	wake   chan struct{}
+	closed bool
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]*queue)
+)
+
+// acquire returns the open queue for dir, opening it if needed. Sinks and
+// sources in the same process share a single queue per directory.
+func acquire(dir string) (*queue, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if q, ok := registry[abs]; ok {
+		q.refs++
+		return q, nil
+	}
+	q, err := openQueue(abs)
+	if err != nil {
+		return nil, err
+	}
+	q.refs = 1
+	registry[abs] = q
+	return q, nil
+}
+
+func (q *queue) release() error {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if q.refs--; q.refs > 0 {
+		return nil
+	}
+	delete(registry, q.dir)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	return q.db.Close()
+}
+
+// openQueue opens the database of the queue in dir. bbolt only ever makes
+// committed transactions visible, so a crash can't leave a partially written
+// record behind, and a corrupt database fails opening the queue rather than
+// losing records.
+func openQueue(dir string) (*queue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(dir, dbFileName), 0644, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, err
+	}
+
+	q := &queue{
+		dir:  dir,
+		db:   db,
+		wake: make(chan struct{}),
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(messagesBucket)
+		if err != nil {
+			return err
+		}
+		q.tail = b.Sequence() + 1
+		return b.ForEach(func(_, v []byte) error {
+			q.count++
+			q.bytes += int64(8 + len(v))
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+func encodeKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// append durably writes as many of the payloads as fit within maxBytes (when
+// positive), returning how many were written. ErrQueueFull is returned along
+// with the count when not all of them fit.
+func (q *queue) append(payloads [][]byte, maxBytes int64) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return 0, os.ErrClosed
+	}
+
+	var (
+		full  bool
+		n     int
+		added int64
+		tail  uint64
+	)
+	now := time.Now().UnixNano()
+	// The transaction is only committed, and fsynced, once for all the
+	// payloads that fit.
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(messagesBucket)
+		for _, p := range payloads {
+			size := int64(recordOverhead + len(p))
+			if maxBytes > 0 && q.bytes+added+size > maxBytes {
+				full = true
+				break
+			}
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			value := make([]byte, 8+len(p))
+			binary.BigEndian.PutUint64(value, uint64(now))
+			copy(value[8:], p)
+			if err := b.Put(encodeKey(seq), value); err != nil {
+				return err
+			}
+			added += size
+			tail = seq + 1
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if n > 0 {
+		q.tail = tail
+		q.count += n
+		q.bytes += added
+		close(q.wake)
+		q.wake = make(chan struct{})
+	}
+
+	if full {
+		return n, ErrQueueFull
+	}
+	return n, nil
+}
+
+// next returns the first record with a sequence number of at least seq, or
+// a channel that is closed when new records are appended if there is none
+// yet.
+func (q *queue) next(seq uint64) (*record, <-chan struct{}, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, nil, os.ErrClosed
+	}
+	if seq >= q.tail {
+		return nil, q.wake, nil
+	}
+
+	var rec *record
+	err := q.db.View(func(tx *bolt.Tx) error {
+		k, v := tx.Bucket(messagesBucket).Cursor().Seek(encodeKey(seq))
+		if k == nil {
+			return nil
+		}
+		// Values are only valid for the life of the transaction.
+		rec = &record{
+			data: append([]byte(nil), v[8:]...),
+			ts:   time.Unix(0, int64(binary.BigEndian.Uint64(v[:8]))),
+			end:  binary.BigEndian.Uint64(k) + 1,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if rec == nil {
+		return nil, q.wake, nil
+	}
+	return rec, nil, nil
+}
+
+// commit durably deletes the records with a sequence number lower than end,
+// which have been acknowledged.
+func (q *queue) commit(end uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return os.ErrClosed
+	}
+
+	var (
+		n       int
+		removed int64
+	)
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(messagesBucket)
+		// Deleting while iterating with a cursor can skip keys, so the
+		// keys are collected first.
+		var keys [][]byte
+		c := b.Cursor()
+		for k, v := c.First(); k != nil && binary.BigEndian.Uint64(k) < end; k, v = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+			removed += int64(8 + len(v))
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	q.count -= n
+	q.bytes -= removed
+	return nil
+}
+
+func (q *queue) stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return Stats{
+		Messages: q.count,
+		Bytes:    q.bytes,
+	}
+}
@@ -0,0 +1,23 @@
+package localqueue
+
+import "github.com/uw-labs/substrate/internal/validate"
+
+// Validate returns an error listing the problems of the config, if any, such
+// as "localqueue: AsyncMessageSinkConfig.Dir must not be empty". It is called
+// by NewAsyncMessageSink.
+func (c AsyncMessageSinkConfig) Validate() error {
+	p := validate.New("localqueue", "AsyncMessageSinkConfig")
+	p.NotEmpty(c.Dir, "Dir")
+	p.Check(c.MaxBytes >= 0, "MaxBytes", "must not be negative")
+	return p.Err()
+}
+
+// Validate returns an error listing the problems of the config, if any, such
+// as "localqueue: AsyncMessageSourceConfig.Dir must not be empty". It is
+// called by NewAsyncMessageSource.
+func (c AsyncMessageSourceConfig) Validate() error {
+	p := validate.New("localqueue", "AsyncMessageSourceConfig")
+	p.NotEmpty(c.Dir, "Dir")
+	p.NotNegativeDuration(c.MaxAge, "MaxAge")
+	return p.Err()
+}
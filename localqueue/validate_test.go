@@ -0,0 +1,84 @@
+package localqueue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsyncMessageSinkConfigValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   AsyncMessageSinkConfig
+		expected string
+	}{
+		{
+			name:   "valid",
+			config: AsyncMessageSinkConfig{Dir: "queue", MaxBytes: 1024},
+		},
+		{
+			name:     "no dir",
+			config:   AsyncMessageSinkConfig{},
+			expected: "localqueue: AsyncMessageSinkConfig.Dir must not be empty",
+		},
+		{
+			name:   "every problem",
+			config: AsyncMessageSinkConfig{MaxBytes: -1},
+			expected: "2 problems: " +
+				"localqueue: AsyncMessageSinkConfig.Dir must not be empty; " +
+				"localqueue: AsyncMessageSinkConfig.MaxBytes must not be negative",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			err := tst.config.Validate()
+			if tst.expected == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tst.expected)
+			_, err = NewAsyncMessageSink(tst.config)
+			assert.EqualError(t, err, tst.expected)
+		})
+	}
+}
+
+func TestAsyncMessageSourceConfigValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   AsyncMessageSourceConfig
+		expected string
+	}{
+		{
+			name:   "valid",
+			config: AsyncMessageSourceConfig{Dir: "queue", MaxAge: time.Hour},
+		},
+		{
+			name:     "no dir",
+			config:   AsyncMessageSourceConfig{},
+			expected: "localqueue: AsyncMessageSourceConfig.Dir must not be empty",
+		},
+		{
+			name:   "every problem",
+			config: AsyncMessageSourceConfig{MaxAge: -time.Hour},
+			expected: "2 problems: " +
+				"localqueue: AsyncMessageSourceConfig.Dir must not be empty; " +
+				"localqueue: AsyncMessageSourceConfig.MaxAge must not be negative",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			err := tst.config.Validate()
+			if tst.expected == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tst.expected)
+			_, err = NewAsyncMessageSource(tst.config)
+			assert.EqualError(t, err, tst.expected)
+		})
+	}
+}
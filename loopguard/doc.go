@@ -0,0 +1,34 @@
+// Package loopguard provides substrate sink and source wrappers that stop
+// messages from looping forever through services consuming from and
+// publishing to the same topic, such as enrichment services writing back to
+// the topic they read, where a bug can amplify the traffic until the cluster
+// falls over.
+//
+// Usage
+//
+// A service wraps its sink and its source with the same config. The sink
+// stamps every published message with the name and generation of the service,
+// in the Attribute attribute, after the stamps the message already has. The
+// source drops the messages stamped by the service more than MaxStamps times,
+// acknowledging them without delivering them, and counts them with Metrics.
+//
+//      c := loopguard.Config{
+//          Service:    "enricher",
+//          Generation: version,
+//          MaxStamps:  1,
+//          Metrics:    metrics,
+//      }
+//      sink, err = loopguard.NewLoopGuardSink(sink, c)
+//      ...
+//      source, err = loopguard.NewLoopGuardSource(source, c)
+//
+// The stamps are carried by the attributes of the messages, so both backends
+// must support attributes. Services publishing new messages, rather than the
+// ones they consume, carry the stamps over with Propagate:
+//
+//      out := loopguard.Propagate(msg, enrich(msg))
+//
+// The instrumented package provides NewLoopCounter to count the dropped
+// messages with prometheus.
+//
+package loopguard
@@ -0,0 +1,150 @@
+package loopguard
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/transform"
+	"github.com/uw-labs/substrate/internal/unwrap"
+	"github.com/uw-labs/substrate/internal/validate"
+)
+
+// Attribute is the attribute listing the services that published a message,
+// as comma separated service@generation stamps, oldest first.
+const Attribute = "substrate-processed-by"
+
+// ErrLoop is the error a message is dropped with by a loop guarded source,
+// when it was stamped by the service more than MaxStamps times.
+var ErrLoop = errors.New("message is looping through the service")
+
+// Metrics is implemented by callers wishing to count the messages dropped by
+// a loop guarded source. Dropped is called for every dropped message, so it
+// must not block.
+type Metrics interface {
+	// Dropped is called for a message stamped by the service more than
+	// MaxStamps times, which is acknowledged without being delivered.
+	Dropped()
+}
+
+// Config is the configuration parameters of a loop guarded sink and source,
+// which are given the same config, so that the source recognizes the stamps
+// of the sink.
+type Config struct {
+	// Service is the name of the service, stamped on the published
+	// messages. It must not contain commas or @ signs.
+	Service string
+	// Generation identifies the deployment of the service, such as its
+	// version, stamped along with Service to trace where a loop started.
+	// It doesn't take part in detecting loops, which may span deployments.
+	// It must not contain commas.
+	Generation string
+	// MaxStamps is the number of times a message may have been stamped by
+	// the service and still be delivered by the source. Zero drops every
+	// message the service published itself.
+	MaxStamps int
+	// Metrics, if set, counts the messages dropped by the source.
+	Metrics Metrics
+}
+
+// Validate returns an error listing the problems of the config, if any, such
+// as "loopguard: Config.Service must not be empty". It is called by
+// NewLoopGuardSink and NewLoopGuardSource.
+func (c Config) Validate() error {
+	p := validate.New("loopguard", "Config")
+	p.NotEmpty(c.Service, "Service")
+	p.Check(!strings.ContainsAny(c.Service, ",@"), "Service", "must not contain commas or @ signs, got %q", c.Service)
+	p.Check(!strings.Contains(c.Generation, ","), "Generation", "must not contain commas, got %q", c.Generation)
+	p.NotNegative(c.MaxStamps, "MaxStamps")
+	return p.Err()
+}
+
+// NewLoopGuardSink returns a sink that stamps every message with the Service
+// and Generation of the config, in its Attribute attribute, before publishing
+// it to sink. The stamp is appended to the ones of the message, so the
+// backend of sink must carry attributes. Acknowledged messages are the ones
+// sent to the returned sink.
+func NewLoopGuardSink(sink substrate.AsyncMessageSink, c Config) (substrate.AsyncMessageSink, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	stamp := c.Service + "@" + c.Generation
+	return transform.NewMessageSink(sink, func(msg substrate.Message) ([]byte, map[string]string, error) {
+		attrs := unwrap.Attributes(msg)
+		out := make(map[string]string, len(attrs)+1)
+		for k, v := range attrs {
+			out[k] = v
+		}
+		if stamps := attrs[Attribute]; stamps != "" {
+			out[Attribute] = stamps + "," + stamp
+		} else {
+			out[Attribute] = stamp
+		}
+		return msg.Data(), out, nil
+	}), nil
+}
+
+// NewLoopGuardSource returns a source that drops the messages consumed from
+// source that were stamped by the Service of the config more than MaxStamps
+// times, which are acknowledged to source without being delivered, and
+// counted by Metrics. The other messages are delivered unchanged.
+func NewLoopGuardSource(source substrate.AsyncMessageSource, c Config) (substrate.AsyncMessageSource, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return substrate.NewValidatingSource(source, func(msg substrate.Message) error {
+		if Stamps(msg, c.Service) > c.MaxStamps {
+			return ErrLoop
+		}
+		return nil
+	}, func(substrate.Message, error) error {
+		if c.Metrics != nil {
+			c.Metrics.Dropped()
+		}
+		return nil
+	}), nil
+}
+
+// Stamps returns the number of times a message was stamped by the service.
+func Stamps(msg substrate.Message, service string) int {
+	n := 0
+	for _, stamp := range strings.Split(unwrap.Attributes(msg)[Attribute], ",") {
+		if i := strings.IndexByte(stamp, '@'); i >= 0 && stamp[:i] == service {
+			n++
+		}
+	}
+	return n
+}
+
+// Propagate returns msg with the stamps of the consumed message it was
+// derived from, for services publishing new messages rather than the ones
+// they consume, as a loop is only detected if the stamps are carried over.
+// The returned message can be unwrapped to msg.
+func Propagate(consumed, msg substrate.Message) substrate.Message {
+	stamps, ok := unwrap.Attributes(consumed)[Attribute]
+	if !ok {
+		return msg
+	}
+	attrs := unwrap.Attributes(msg)
+	out := make(map[string]string, len(attrs)+1)
+	for k, v := range attrs {
+		out[k] = v
+	}
+	out[Attribute] = stamps
+	return &propagatedMessage{Message: msg, attrs: out}
+}
+
+// propagatedMessage is a message with the stamps of the message it was
+// derived from.
+type propagatedMessage struct {
+	substrate.Message
+	attrs map[string]string
+}
+
+func (m *propagatedMessage) Original() substrate.Message {
+	return m.Message
+}
+
+func (m *propagatedMessage) Attributes() map[string]string {
+	return m.attrs
+}
@@ -0,0 +1,167 @@
+package loopguard
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/inmemory"
+	"github.com/uw-labs/substrate/internal/unwrap"
+)
+
+type message struct {
+	data  []byte
+	attrs map[string]string
+}
+
+func (m *message) Data() []byte {
+	return m.data
+}
+
+func (m *message) Attributes() map[string]string {
+	return m.attrs
+}
+
+// droppedCounter signals every dropped message on its channel.
+type droppedCounter chan struct{}
+
+func (c droppedCounter) Dropped() {
+	c <- struct{}{}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		c        Config
+		expected string
+	}{
+		{
+			name: "valid",
+			c:    Config{Service: "enricher", Generation: "v1.2.0", MaxStamps: 1},
+		},
+		{
+			name:     "no service",
+			c:        Config{},
+			expected: "loopguard: Config.Service must not be empty",
+		},
+		{
+			name:     "service with separator",
+			c:        Config{Service: "enricher@eu"},
+			expected: `loopguard: Config.Service must not contain commas or @ signs, got "enricher@eu"`,
+		},
+		{
+			name:     "generation with separator",
+			c:        Config{Service: "enricher", Generation: "1,2"},
+			expected: `loopguard: Config.Generation must not contain commas, got "1,2"`,
+		},
+		{
+			name:     "max stamps",
+			c:        Config{Service: "enricher", MaxStamps: -1},
+			expected: "loopguard: Config.MaxStamps must not be negative",
+		},
+	}
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			err := tst.c.Validate()
+			if tst.expected == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Equal(t, tst.expected, err.Error())
+		})
+	}
+}
+
+func TestStamps(t *testing.T) {
+	msg := &message{attrs: map[string]string{Attribute: "enricher@v1,indexer@v3,enricher@v2,enricher-eu@v2"}}
+	assert.Equal(t, 2, Stamps(msg, "enricher"))
+	assert.Equal(t, 1, Stamps(msg, "indexer"))
+	assert.Equal(t, 0, Stamps(msg, "archiver"))
+	assert.Equal(t, 0, Stamps(&message{}, "enricher"))
+}
+
+func TestPropagate(t *testing.T) {
+	consumed := &message{data: []byte("in"), attrs: map[string]string{Attribute: "enricher@v1", "id": "1"}}
+	out := &message{data: []byte("out"), attrs: map[string]string{"id": "2"}}
+
+	msg := Propagate(consumed, out)
+	assert.Equal(t, map[string]string{Attribute: "enricher@v1", "id": "2"}, unwrap.Attributes(msg))
+	assert.Equal(t, substrate.Message(out), unwrap.Unwrap(msg))
+	assert.Equal(t, map[string]string{"id": "2"}, out.attrs)
+
+	// Messages without stamps have nothing to propagate.
+	assert.Equal(t, substrate.Message(out), Propagate(&message{}, out))
+}
+
+// TestLoopGuardInMemory runs a service republishing every message it consumes
+// to the same topic, which loops forever without the loop guard.
+func TestLoopGuardInMemory(t *testing.T) {
+	broker := inmemory.NewBroker()
+	newSink := func() substrate.AsyncMessageSink {
+		sink, err := inmemory.NewAsyncMessageSink(inmemory.AsyncMessageSinkConfig{Broker: broker, Topic: "events"})
+		require.NoError(t, err)
+		return sink
+	}
+	newSource := func() substrate.AsyncMessageSource {
+		source, err := inmemory.NewAsyncMessageSource(inmemory.AsyncMessageSourceConfig{Broker: broker, Topic: "events", ConsumerGroup: "enricher"})
+		require.NoError(t, err)
+		return source
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	require.NoError(t, substrate.NewSynchronousMessageSink(newSink()).PublishMessage(ctx, &message{data: []byte("event")}))
+
+	dropped := make(droppedCounter, 1)
+	c := Config{Service: "enricher", Generation: "v2", MaxStamps: 2, Metrics: dropped}
+	sink, err := NewLoopGuardSink(newSink(), c)
+	require.NoError(t, err)
+	source, err := NewLoopGuardSource(newSource(), c)
+	require.NoError(t, err)
+
+	toSink, sinkAcks := make(chan substrate.Message), make(chan substrate.Message)
+	delivered, sourceAcks := make(chan substrate.Message), make(chan substrate.Message)
+	errs := make(chan error, 2)
+	go func() {
+		errs <- sink.PublishMessages(ctx, sinkAcks, toSink)
+	}()
+	go func() {
+		errs <- source.ConsumeMessages(ctx, delivered, sourceAcks)
+	}()
+
+	var stamps []string
+loop:
+	for {
+		select {
+		case msg := <-delivered:
+			stamps = append(stamps, unwrap.Attributes(msg)[Attribute])
+			toSink <- msg
+			assert.Equal(t, msg, <-sinkAcks)
+			sourceAcks <- msg
+		case <-dropped:
+			break loop
+		case <-ctx.Done():
+			t.Fatalf("the message kept looping, with the stamps %q", stamps)
+		}
+	}
+	assert.Equal(t, []string{"", "enricher@v2", "enricher@v2,enricher@v2"}, stamps)
+
+	// The dropped message is acknowledged, so it is not consumed again.
+	assert.Eventually(t, func() bool {
+		ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		msgs := make(chan substrate.Message, 1)
+		err := newSource().ConsumeMessages(ctx, msgs, make(chan substrate.Message))
+		return err == context.DeadlineExceeded && len(msgs) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+	assert.Equal(t, context.Canceled, <-errs)
+}
@@ -0,0 +1,65 @@
+package substrate
+
+// WithValue returns a message wrapping msg, which carries value for key along
+// with the values carried by msg, e.g. for wrappers to attach the trace span
+// or the retry count of a message to it, rather than keeping them in a map
+// keyed by message, which leaks the messages that are dropped. Like context
+// keys, keys should be of an unexported type, to avoid collisions between
+// packages. The returned message implements an Original method returning msg,
+// so that it is acknowledged as msg, see SameMessage, and backends still find
+// the key and attributes of msg. It implements Nackable if msg does.
+func WithValue(msg Message, key, value interface{}) Message {
+	vm := valueMessage{original: msg, key: key, value: value}
+	if _, ok := msg.(Nackable); ok {
+		return &nackableValueMessage{vm}
+	}
+	return &vm
+}
+
+// Value returns the value carried by msg for key, or nil if there is none. The
+// values attached by WithValue are found through any wrapper implementing an
+// Original method, the most recently attached value of a key taking
+// precedence.
+func Value(msg Message, key interface{}) interface{} {
+	for {
+		switch m := msg.(type) {
+		case *valueMessage:
+			if m.key == key {
+				return m.value
+			}
+		case *nackableValueMessage:
+			if m.key == key {
+				return m.value
+			}
+		}
+		wrapper, ok := msg.(interface{ Original() Message })
+		if !ok {
+			return nil
+		}
+		msg = wrapper.Original()
+	}
+}
+
+// valueMessage is a message carrying a value, as returned by WithValue.
+type valueMessage struct {
+	original   Message
+	key, value interface{}
+}
+
+func (m *valueMessage) Data() []byte {
+	return m.original.Data()
+}
+
+func (m *valueMessage) Original() Message {
+	return m.original
+}
+
+// nackableValueMessage is a value message wrapping a nackable message.
+type nackableValueMessage struct {
+	valueMessage
+}
+
+// Nack implements the Nackable interface by nacking the original message.
+func (m *nackableValueMessage) Nack(reason error) {
+	m.original.(Nackable).Nack(reason)
+}
@@ -0,0 +1,89 @@
+package substrate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type valueKey int
+
+const (
+	spanKey valueKey = iota
+	attemptKey
+)
+
+type nackedMessage struct {
+	message
+	reason error
+}
+
+func (m *nackedMessage) Nack(reason error) {
+	m.reason = reason
+}
+
+func TestMessageValues(t *testing.T) {
+	m := message("one")
+	withSpan := WithValue(&m, spanKey, "span")
+	withAttempt := WithValue(callerWrapped{withSpan}, attemptKey, 1)
+	overridden := WithValue(withAttempt, attemptKey, 2)
+
+	assert.Nil(t, Value(&m, spanKey))
+	assert.Equal(t, "span", Value(withSpan, spanKey))
+	assert.Nil(t, Value(withSpan, attemptKey))
+	// Values are found through other wrappers.
+	assert.Equal(t, "span", Value(withAttempt, spanKey))
+	assert.Equal(t, 1, Value(withAttempt, attemptKey))
+	assert.Equal(t, 2, Value(overridden, attemptKey))
+
+	assert.Equal(t, []byte("one"), overridden.Data())
+	assert.True(t, SameMessage(overridden, &m))
+	assert.True(t, SameMessage(withSpan, withAttempt))
+	other := message("one")
+	assert.False(t, SameMessage(withSpan, &other))
+}
+
+func TestMessageValuesNack(t *testing.T) {
+	m := &nackedMessage{message: message("one")}
+	withValue := WithValue(m, spanKey, "span")
+	nackable, ok := withValue.(Nackable)
+	if assert.True(t, ok) {
+		nackable.Nack(ErrNacked)
+		assert.Equal(t, ErrNacked, m.reason)
+	}
+
+	plain := message("two")
+	_, ok = WithValue(&plain, spanKey, "span").(Nackable)
+	assert.False(t, ok)
+}
+
+func TestAckMessageWithValues(t *testing.T) {
+	inner := &mockAsyncSource{
+		toSend: make(chan Message, 1),
+		acked:  make(chan Message, 1),
+		closed: make(chan struct{}),
+	}
+	source := NewValidatingSource(inner, validatePayload, nil)
+	m := message("good")
+	inner.toSend <- &m
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	// The caller attaches a value to the delivered message, and
+	// acknowledges the message carrying it.
+	acks <- WithValue(<-msgs, spanKey, "span")
+	assert.Equal(t, Message(&m), <-inner.acked)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
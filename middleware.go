@@ -0,0 +1,164 @@
+package substrate
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// SourceMiddleware wraps a source, such as NewValidatingSource with its
+// options set. See ChainSource.
+type SourceMiddleware func(AsyncMessageSource) AsyncMessageSource
+
+// SinkMiddleware wraps a sink, such as NewValidatingSink with its options set.
+// See ChainSink.
+type SinkMiddleware func(AsyncMessageSink) AsyncMessageSink
+
+// ChainSource returns source wrapped with every middleware, in the order they
+// are listed: the first middleware is the outermost one, which sees the
+// messages last as they are delivered, and the acknowledgements first. For
+// example, with metrics listed before validation, the metrics only count the
+// messages that passed validation:
+//
+//      source = substrate.ChainSource(source,
+//          instrumented.SourceMiddleware(counterOpts, topic),
+//          substrate.ValidatingSourceMiddleware(validate, onInvalid),
+//      )
+//
+// Nil middleware are skipped, so that middleware can be listed conditionally.
+// As wrappers propagate Close, closing the returned source closes source.
+func ChainSource(source AsyncMessageSource, mw ...SourceMiddleware) AsyncMessageSource {
+	for i := len(mw) - 1; i >= 0; i-- {
+		if mw[i] != nil {
+			source = mw[i](source)
+		}
+	}
+	return source
+}
+
+// ChainSink returns sink wrapped with every middleware, in the order they are
+// listed: the first middleware is the outermost one, which sees the messages
+// first as they are published, and the acknowledgements last. Nil middleware
+// are skipped. As wrappers propagate Close, closing the returned sink closes
+// sink.
+func ChainSink(sink AsyncMessageSink, mw ...SinkMiddleware) AsyncMessageSink {
+	for i := len(mw) - 1; i >= 0; i-- {
+		if mw[i] != nil {
+			sink = mw[i](sink)
+		}
+	}
+	return sink
+}
+
+// AuditedSourceMiddleware returns a middleware wrapping sources with
+// NewAuditedSource.
+func AuditedSourceMiddleware(auditSink AsyncMessageSink, digest func(Message) []byte, opts AuditOptions) SourceMiddleware {
+	return func(source AsyncMessageSource) AsyncMessageSource {
+		return NewAuditedSource(source, auditSink, digest, opts)
+	}
+}
+
+// BoundedSourceMiddleware returns a middleware wrapping sources with
+// NewBoundedSource.
+func BoundedSourceMiddleware(opts BoundedSourceOptions) SourceMiddleware {
+	return func(source AsyncMessageSource) AsyncMessageSource {
+		return NewBoundedSource(source, opts)
+	}
+}
+
+// ClaimCheckSourceMiddleware returns a middleware wrapping sources with
+// NewClaimCheckSource.
+func ClaimCheckSourceMiddleware(fetch func(ctx context.Context, ref string) ([]byte, error)) SourceMiddleware {
+	return func(source AsyncMessageSource) AsyncMessageSource {
+		return NewClaimCheckSource(source, fetch)
+	}
+}
+
+// ExpiringSourceMiddleware returns a middleware wrapping sources with
+// NewExpiringSource.
+func ExpiringSourceMiddleware(ttl time.Duration, timestampFunc func(Message) (time.Time, bool), onExpired func(Message)) SourceMiddleware {
+	return func(source AsyncMessageSource) AsyncMessageSource {
+		return NewExpiringSource(source, ttl, timestampFunc, onExpired)
+	}
+}
+
+// IdempotentSourceMiddleware returns a middleware wrapping sources with
+// NewIdempotentSource.
+func IdempotentSourceMiddleware(store IdempotencyStore, keyFunc func(Message) string, ttl time.Duration) SourceMiddleware {
+	return func(source AsyncMessageSource) AsyncMessageSource {
+		return NewIdempotentSource(source, store, keyFunc, ttl)
+	}
+}
+
+// InFlightLimitedSourceMiddleware returns a middleware wrapping sources with
+// NewInFlightLimitedSource.
+func InFlightLimitedSourceMiddleware(opts InFlightLimitOptions) SourceMiddleware {
+	return func(source AsyncMessageSource) AsyncMessageSource {
+		return NewInFlightLimitedSource(source, opts)
+	}
+}
+
+// PacedSourceMiddleware returns a middleware wrapping sources with
+// NewPacedSource.
+func PacedSourceMiddleware(timestampFunc func(Message) (time.Time, bool), speedup float64, maxDelay time.Duration) SourceMiddleware {
+	return func(source AsyncMessageSource) AsyncMessageSource {
+		return NewPacedSource(source, timestampFunc, speedup, maxDelay)
+	}
+}
+
+// RecordingSourceMiddleware returns a middleware wrapping sources with
+// NewRecordingSource.
+func RecordingSourceMiddleware(w io.Writer) SourceMiddleware {
+	return func(source AsyncMessageSource) AsyncMessageSource {
+		return NewRecordingSource(source, w)
+	}
+}
+
+// SamplingSourceMiddleware returns a middleware wrapping sources with
+// NewSamplingSource. The fraction can't be changed afterwards, so
+// NewSamplingSource should be used directly to change it at runtime.
+func SamplingSourceMiddleware(fraction float64, keyFunc func(Message) []byte) SourceMiddleware {
+	return func(source AsyncMessageSource) AsyncMessageSource {
+		return NewSamplingSource(source, fraction, keyFunc)
+	}
+}
+
+// SizeLimitedSourceMiddleware returns a middleware wrapping sources with
+// NewSizeLimitedSource.
+func SizeLimitedSourceMiddleware(maxBytes int, onOversize MessageErrorHandler) SourceMiddleware {
+	return func(source AsyncMessageSource) AsyncMessageSource {
+		return NewSizeLimitedSource(source, maxBytes, onOversize)
+	}
+}
+
+// ValidatingSourceMiddleware returns a middleware wrapping sources with
+// NewValidatingSource.
+func ValidatingSourceMiddleware(validate func(Message) error, onInvalid MessageErrorHandler) SourceMiddleware {
+	return func(source AsyncMessageSource) AsyncMessageSource {
+		return NewValidatingSource(source, validate, onInvalid)
+	}
+}
+
+// BatchingSinkMiddleware returns a middleware wrapping sinks with
+// NewBatchingSink.
+func BatchingSinkMiddleware(opts BatchingSinkOptions) SinkMiddleware {
+	return func(sink AsyncMessageSink) AsyncMessageSink {
+		return NewBatchingSink(sink, opts)
+	}
+}
+
+// SizeLimitedSinkMiddleware returns a middleware wrapping sinks with
+// NewSizeLimitedSink.
+func SizeLimitedSinkMiddleware(maxBytes int, onOversize OversizeHandler) SinkMiddleware {
+	return func(sink AsyncMessageSink) AsyncMessageSink {
+		return NewSizeLimitedSink(sink, maxBytes, onOversize)
+	}
+}
+
+// ValidatingSinkMiddleware returns a middleware wrapping sinks with
+// NewValidatingSink.
+func ValidatingSinkMiddleware(validate func(Message) error, onInvalid MessageErrorHandler) SinkMiddleware {
+	return func(sink AsyncMessageSink) AsyncMessageSink {
+		return NewValidatingSink(sink, validate, onInvalid)
+	}
+}
@@ -0,0 +1,168 @@
+package substrate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// observingSource logs the payload of the messages it delivers, as a
+// stand-in for a wrapper with side effects, such as metrics.
+type observingSource struct {
+	AsyncMessageSource
+	name string
+	log  chan<- string
+}
+
+func observingSourceMiddleware(name string, log chan<- string) SourceMiddleware {
+	return func(source AsyncMessageSource) AsyncMessageSource {
+		return &observingSource{AsyncMessageSource: source, name: name, log: log}
+	}
+}
+
+func (s *observingSource) ConsumeMessages(ctx context.Context, messages chan<- Message, acks <-chan Message) error {
+	fromInner := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.AsyncMessageSource.ConsumeMessages(ctx, fromInner, acks)
+	}()
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case msg := <-fromInner:
+			s.log <- s.name + ": " + string(msg.Data())
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case messages <- msg:
+			}
+		}
+	}
+}
+
+// observingSink logs the payload of the messages it publishes.
+type observingSink struct {
+	AsyncMessageSink
+	name string
+	log  chan<- string
+}
+
+func observingSinkMiddleware(name string, log chan<- string) SinkMiddleware {
+	return func(sink AsyncMessageSink) AsyncMessageSink {
+		return &observingSink{AsyncMessageSink: sink, name: name, log: log}
+	}
+}
+
+func (s *observingSink) PublishMessages(ctx context.Context, acks chan<- Message, messages <-chan Message) error {
+	toInner := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.AsyncMessageSink.PublishMessages(ctx, acks, toInner)
+	}()
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case msg := <-messages:
+			s.log <- s.name + ": " + string(msg.Data())
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case toInner <- msg:
+			}
+		}
+	}
+}
+
+func TestChainSource(t *testing.T) {
+	m1, m2 := message("bad"), message("good")
+	inner := newStreamingAsyncSource(&m1, &m2)
+	log := make(chan string, 4)
+	acceptInvalid := func(Message, error) error {
+		return nil
+	}
+	// The metrics are outside of the validation, and only observe the
+	// messages that passed it.
+	source := ChainSource(inner,
+		observingSourceMiddleware("metrics", log),
+		nil,
+		ValidatingSourceMiddleware(validatePayload, acceptInvalid),
+		observingSourceMiddleware("inner", log),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	delivered := <-msgs
+	assert.Equal(t, &m2, delivered)
+	acks <- delivered
+	assert.Equal(t, &m1, <-inner.acked)
+	assert.Equal(t, &m2, <-inner.acked)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+	close(log)
+	var effects []string
+	for e := range log {
+		effects = append(effects, e)
+	}
+	assert.Equal(t, []string{"inner: bad", "inner: good", "metrics: good"}, effects)
+
+	assert.NoError(t, source.Close())
+	select {
+	case <-inner.closed:
+	default:
+		t.Fatal("the chained source was not closed")
+	}
+}
+
+func TestChainSink(t *testing.T) {
+	inner := newRecordingAsyncSink()
+	log := make(chan string, 4)
+	acceptInvalid := func(Message, error) error {
+		return nil
+	}
+	// The metrics are outside of the validation, and observe every message
+	// published.
+	sink := ChainSink(inner,
+		observingSinkMiddleware("metrics", log),
+		ValidatingSinkMiddleware(validatePayload, acceptInvalid),
+		observingSinkMiddleware("inner", log),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message, 2)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishMessages(ctx, acks, msgs)
+	}()
+
+	m1, m2 := message("bad"), message("good")
+	msgs <- &m1
+	msgs <- &m2
+	assert.Equal(t, &m1, <-acks)
+	assert.Equal(t, &m2, <-acks)
+	assert.Equal(t, &m2, <-inner.published)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+	close(log)
+	var effects []string
+	for e := range log {
+		effects = append(effects, e)
+	}
+	assert.Equal(t, []string{"metrics: bad", "metrics: good", "inner: good"}, effects)
+}
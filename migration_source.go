@@ -0,0 +1,248 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/uw-labs/sync/rungroup"
+)
+
+const defaultMaxHeld = 1024
+
+// ErrTooManyHeld is returned by a migration source using FailWhenFull when
+// more messages would be held than allowed by MaxHeld.
+var ErrTooManyHeld = errors.New("too many messages held until the cutover")
+
+// HeldOverflowPolicy determines what a migration source does with a message
+// that must be held until the cutover when MaxHeld messages are held already.
+type HeldOverflowPolicy int
+
+const (
+	// BlockWhenFull stops consuming from the source of the message until
+	// the cutover.
+	BlockWhenFull HeldOverflowPolicy = iota
+	// FailWhenFull terminates consuming with ErrTooManyHeld.
+	FailWhenFull
+)
+
+// MigrationSourceOptions is the configuration parameters for a migration
+// source.
+type MigrationSourceOptions struct {
+	// MaxHeld is the maximum number of messages held until the cutover.
+	// Defaults to 1024.
+	MaxHeld int
+	// OnFull determines what happens to a message that must be held when
+	// MaxHeld messages are held already. Defaults to BlockWhenFull.
+	OnFull HeldOverflowPolicy
+	// OnSuperseded, if set, is called with the messages of the from source
+	// that are acknowledged without being delivered after the cutover, as
+	// the to source delivered messages with the same key.
+	OnSuperseded func(Message)
+}
+
+// NewMigrationSource returns a source that merges the messages of from and to
+// while migrating consumers from the from source to the to source, such as
+// two clusters that messages are mirrored between, so that the messages for a
+// key are not interleaved arbitrarily. The key of every message is computed by
+// keyFunc. Until cutover is closed, each key is owned by the source that
+// delivered a message with the key first, and the messages of the other
+// source with the key are held, up to MaxHeld messages. Once cutover is
+// closed, the to source is authoritative: its held messages are delivered, in
+// order, and the messages from the from source with a key that the to source
+// delivered are acknowledged without being delivered, and passed to
+// OnSuperseded. As a result, for every key, no message from the from source
+// is delivered after a message from the to source, and the messages of each
+// source with the key are delivered in order.
+//
+// Held messages, and the messages of a source after them, are acknowledged to
+// their source once they are delivered and acknowledged, or superseded. The
+// owners of the keys are kept in memory, along with whether the cutover
+// happened, for the lifetime of the returned source. When Close is called on
+// the returned source, this is also propagated to both sources.
+func NewMigrationSource(from, to AsyncMessageSource, keyFunc func(Message) string, cutover <-chan struct{}, opts MigrationSourceOptions) AsyncMessageSource {
+	if opts.MaxHeld <= 0 {
+		opts.MaxHeld = defaultMaxHeld
+	}
+	return &migrationSource{
+		sources: [2]AsyncMessageSource{from, to},
+		keyFunc: keyFunc,
+		cutover: cutover,
+		opts:    opts,
+		owners:  make(map[string]migrationOrigin),
+	}
+}
+
+// migrationOrigin identifies a source of a migration source.
+type migrationOrigin int
+
+const (
+	fromOrigin migrationOrigin = iota
+	toOrigin
+)
+
+type migrationSource struct {
+	sources [2]AsyncMessageSource
+	keyFunc func(Message) string
+	cutover <-chan struct{}
+	opts    MigrationSourceOptions
+
+	// owners holds the source that owns each key, which is the source that
+	// delivered a message with the key first until the cutover.
+	owners  map[string]migrationOrigin
+	cutOver bool
+}
+
+// migrationEntry is a message consumed from one of the sources, which is
+// acknowledged to it once done.
+type migrationEntry struct {
+	msg    Message
+	key    string
+	origin migrationOrigin
+	done   bool
+}
+
+func (s *migrationSource) ConsumeMessages(ctx context.Context, messages chan<- Message, acks <-chan Message) error {
+	rg, ctx := rungroup.New(ctx)
+
+	var fromInner, toInner [2]chan Message
+	for i := range s.sources {
+		fromInner[i] = make(chan Message, cap(messages))
+		toInner[i] = make(chan Message, cap(acks))
+		source, from, to := s.sources[i], fromInner[i], toInner[i]
+		rg.Go(func() error {
+			return source.ConsumeMessages(ctx, from, to)
+		})
+	}
+
+	rg.Go(func() error {
+		var (
+			// consumed holds the entries of each source that have not been
+			// acknowledged to it, in order.
+			consumed [2][]*migrationEntry
+			// ready holds the entries to deliver, and delivered the ones
+			// awaiting their acknowledgement.
+			ready     []*migrationEntry
+			delivered []*migrationEntry
+			held      []*migrationEntry
+			// stalled holds the message of a source that could not be held
+			// with BlockWhenFull, which stops consuming from it until the
+			// cutover.
+			stalled [2]*migrationEntry
+			cutover = s.cutover
+		)
+		if s.cutOver {
+			cutover = nil
+		}
+
+		// route delivers, holds or supersedes an entry.
+		route := func(e *migrationEntry) error {
+			owner, owned := s.owners[e.key]
+			switch {
+			case !owned || owner == e.origin:
+				s.owners[e.key] = e.origin
+				ready = append(ready, e)
+			case !s.cutOver:
+				if len(held) < s.opts.MaxHeld {
+					held = append(held, e)
+				} else if s.opts.OnFull == FailWhenFull {
+					return ErrTooManyHeld
+				} else {
+					stalled[e.origin] = e
+				}
+			case e.origin == toOrigin:
+				s.owners[e.key] = toOrigin
+				ready = append(ready, e)
+			default:
+				if s.opts.OnSuperseded != nil {
+					s.opts.OnSuperseded(e.msg)
+				}
+				e.done = true
+			}
+			return nil
+		}
+
+		for {
+			var (
+				in      [2]<-chan Message
+				ackOut  [2]chan<- Message
+				ackNext [2]Message
+				out     chan<- Message
+				next    Message
+			)
+			for i := range consumed {
+				if stalled[i] == nil {
+					in[i] = fromInner[i]
+				}
+				if len(consumed[i]) > 0 && consumed[i][0].done {
+					ackOut[i], ackNext[i] = toInner[i], consumed[i][0].msg
+				}
+			}
+			if len(ready) > 0 {
+				out, next = messages, ready[0].msg
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-cutover:
+				cutover = nil
+				s.cutOver = true
+				pending := append(held, stalled[fromOrigin], stalled[toOrigin])
+				held, stalled = nil, [2]*migrationEntry{}
+				for _, e := range pending {
+					if e != nil {
+						if err := route(e); err != nil {
+							return err
+						}
+					}
+				}
+			case msg := <-in[fromOrigin]:
+				e := &migrationEntry{msg: msg, key: s.keyFunc(msg), origin: fromOrigin}
+				consumed[fromOrigin] = append(consumed[fromOrigin], e)
+				if err := route(e); err != nil {
+					return err
+				}
+			case msg := <-in[toOrigin]:
+				e := &migrationEntry{msg: msg, key: s.keyFunc(msg), origin: toOrigin}
+				consumed[toOrigin] = append(consumed[toOrigin], e)
+				if err := route(e); err != nil {
+					return err
+				}
+			case out <- next:
+				delivered = append(delivered, ready[0])
+				ready = ready[1:]
+			case ack := <-acks:
+				if len(delivered) == 0 {
+					return InvalidAckError{Acked: ack}
+				}
+				if !SameMessage(ack, delivered[0].msg) {
+					return InvalidAckError{Acked: ack, Expected: delivered[0].msg}
+				}
+				delivered[0].done = true
+				delivered = delivered[1:]
+			case ackOut[fromOrigin] <- ackNext[fromOrigin]:
+				consumed[fromOrigin] = consumed[fromOrigin][1:]
+			case ackOut[toOrigin] <- ackNext[toOrigin]:
+				consumed[toOrigin] = consumed[toOrigin][1:]
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+// Close closes both underlying sources.
+func (s *migrationSource) Close() (err error) {
+	for _, closer := range []io.Closer{s.sources[fromOrigin], s.sources[toOrigin]} {
+		err = multierror.Append(err, closer.Close()).ErrorOrNil()
+	}
+	return err
+}
+
+// Status returns the combined status of both underlying sources, which is
+// working only if both of them are.
+func (s *migrationSource) Status() (*Status, error) {
+	return CombinedStatus(s.sources[fromOrigin], s.sources[toOrigin])
+}
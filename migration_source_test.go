@@ -0,0 +1,247 @@
+package substrate
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// migrationTestMessage is a message of one of the sources of a migration
+// source, with its position in that source.
+type migrationTestMessage struct {
+	origin migrationOrigin
+	key    string
+	seq    int
+}
+
+func (m *migrationTestMessage) Data() []byte {
+	return []byte(fmt.Sprintf("%d/%s/%d", m.origin, m.key, m.seq))
+}
+
+func migrationTestKey(msg Message) string {
+	return msg.(*migrationTestMessage).key
+}
+
+// listSource delivers its messages without waiting for their
+// acknowledgements, once started, and records the acknowledgements.
+type listSource struct {
+	msgs  []Message
+	start chan struct{}
+	acked chan Message
+}
+
+func newListSource(origin migrationOrigin, keys []string) *listSource {
+	s := &listSource{
+		start: make(chan struct{}),
+		acked: make(chan Message, len(keys)),
+	}
+	for i, k := range keys {
+		s.msgs = append(s.msgs, &migrationTestMessage{origin: origin, key: k, seq: i})
+	}
+	close(s.start)
+	return s
+}
+
+func (s *listSource) ConsumeMessages(ctx context.Context, messages chan<- Message, acks <-chan Message) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.start:
+	}
+	for sent := 0; ; {
+		var out chan<- Message
+		var next Message
+		if sent < len(s.msgs) {
+			out, next = messages, s.msgs[sent]
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case out <- next:
+			sent++
+		case ack := <-acks:
+			s.acked <- ack
+		}
+	}
+}
+
+func (s *listSource) Close() error {
+	return nil
+}
+
+func (s *listSource) Status() (*Status, error) {
+	return &Status{Working: true}, nil
+}
+
+func (s *listSource) allAcked() bool {
+	return len(s.acked) == len(s.msgs)
+}
+
+// runMigration consumes all the messages of the sources, closing the cutover
+// channel once cutAfter messages were delivered, or once no messages are
+// delivered for a while, and returns the delivered messages, the number
+// delivered before the cutover and the superseded messages.
+func runMigration(t *testing.T, from, to *listSource, cutAfter, maxHeld int) (delivered []*migrationTestMessage, beforeCutover int, superseded []*migrationTestMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cutover := make(chan struct{})
+	supersededCh := make(chan Message, len(from.msgs))
+	source := NewMigrationSource(from, to, migrationTestKey, cutover, MigrationSourceOptions{
+		MaxHeld:      maxHeld,
+		OnSuperseded: func(msg Message) { supersededCh <- msg },
+	})
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	beforeCutover = -1
+	cut := func() {
+		if beforeCutover < 0 {
+			beforeCutover = len(delivered)
+			close(cutover)
+		}
+	}
+	for !from.allAcked() || !to.allAcked() {
+		if len(delivered) == cutAfter {
+			cut()
+		}
+		select {
+		case msg := <-msgs:
+			delivered = append(delivered, msg.(*migrationTestMessage))
+			acks <- msg
+		case <-time.After(5 * time.Millisecond):
+			cut()
+		case err := <-errs:
+			require.NoError(t, err)
+		case <-ctx.Done():
+			t.Fatal("timed out consuming the messages")
+		}
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+
+	close(supersededCh)
+	for msg := range supersededCh {
+		superseded = append(superseded, msg.(*migrationTestMessage))
+	}
+	return delivered, beforeCutover, superseded
+}
+
+func TestMigrationSourceProperties(t *testing.T) {
+	keys := func(ks []uint8) []string {
+		out := make([]string, len(ks))
+		for i, k := range ks {
+			out[i] = fmt.Sprint(k % 4)
+		}
+		return out
+	}
+
+	property := func(fromKeys, toKeys []uint8, cutAfter, maxHeld uint8) bool {
+		from := newListSource(fromOrigin, keys(fromKeys))
+		to := newListSource(toOrigin, keys(toKeys))
+		delivered, beforeCutover, superseded := runMigration(t, from, to, int(cutAfter)%(len(fromKeys)+len(toKeys)+1), int(maxHeld%4)+1)
+
+		// Every message is delivered exactly once, or superseded if it
+		// comes from the from source.
+		seen := make(map[*migrationTestMessage]bool)
+		for _, m := range append(append([]*migrationTestMessage{}, delivered...), superseded...) {
+			if seen[m] {
+				t.Logf("message %s handled twice", m.Data())
+				return false
+			}
+			seen[m] = true
+		}
+		if len(seen) != len(fromKeys)+len(toKeys) {
+			t.Logf("%d messages handled out of %d", len(seen), len(fromKeys)+len(toKeys))
+			return false
+		}
+		for _, m := range superseded {
+			if m.origin != fromOrigin {
+				t.Logf("message %s of the to source superseded", m.Data())
+				return false
+			}
+		}
+
+		// For every key, no message from the from source is delivered
+		// after one from the to source, the messages of each source are
+		// delivered in order, and a single source delivers messages
+		// before the cutover.
+		lastSeq := make(map[string][2]int)
+		fromTo := make(map[string]bool)
+		owners := make(map[string]migrationOrigin)
+		for i, m := range delivered {
+			if m.origin == toOrigin {
+				fromTo[m.key] = true
+			} else if fromTo[m.key] {
+				t.Logf("message %s delivered after one of the to source", m.Data())
+				return false
+			}
+			seqs, ok := lastSeq[m.key]
+			if !ok {
+				seqs = [2]int{-1, -1}
+			}
+			if m.seq <= seqs[m.origin] {
+				t.Logf("message %s delivered out of order", m.Data())
+				return false
+			}
+			seqs[m.origin] = m.seq
+			lastSeq[m.key] = seqs
+
+			if i < beforeCutover {
+				if owner, ok := owners[m.key]; ok && owner != m.origin {
+					t.Logf("message %s interleaved before the cutover", m.Data())
+					return false
+				}
+				owners[m.key] = m.origin
+			}
+		}
+
+		// All the messages are acknowledged to their sources in order.
+		for _, s := range []*listSource{from, to} {
+			for _, expected := range s.msgs {
+				if ack := <-s.acked; ack != expected {
+					t.Logf("message %s acknowledged instead of %s", ack.Data(), expected.Data())
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	require.NoError(t, quick.Check(property, &quick.Config{MaxCount: 200}))
+}
+
+func TestMigrationSourceFailWhenFull(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	from := newListSource(fromOrigin, []string{"k"})
+	to := newListSource(toOrigin, []string{"k", "k"})
+	to.start = make(chan struct{})
+	source := NewMigrationSource(from, to, migrationTestKey, make(chan struct{}), MigrationSourceOptions{
+		MaxHeld: 1,
+		OnFull:  FailWhenFull,
+	})
+
+	msgs := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, make(chan Message))
+	}()
+
+	// The key is owned by the from source, so the messages of the to
+	// source are held, and the second one doesn't fit.
+	assert.Equal(t, from.msgs[0], <-msgs)
+	close(to.start)
+	assert.Equal(t, ErrTooManyHeld, <-errs)
+}
@@ -0,0 +1,29 @@
+// Package mock provides substrate sources and sinks with scripted behaviour,
+// for the unit tests of code using substrate.
+//
+// Usage
+//
+// A Source delivers the messages of its script, and records the
+// acknowledgements it receives. Its script is built by chaining calls, and is
+// run across calls of ConsumeMessages, so that a step returning an error can
+// be followed by more messages for the retry:
+//
+//      source := mock.NewSource().
+//          Deliver("a", "b", "c").
+//          WaitForAcks().
+//          Return(errors.New("connection lost"))
+//      ...
+//      source.AssertAcked(t, "a", "b", "c")
+//
+// A Sink records and acknowledges the published messages, unless its script
+// says otherwise:
+//
+//      sink := mock.NewSink().WithholdAck(2)
+//      ...
+//      sink.AssertPublished(t, "a", "b")
+//
+// Sources and sinks are safe for concurrent use. Waiting for acknowledgements,
+// and the assertions, give up after a timeout, which defaults to 5 seconds, so
+// that a test of misbehaving code fails instead of hanging.
+//
+package mock
@@ -0,0 +1,103 @@
+package mock
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uw-labs/substrate"
+)
+
+const defaultTimeout = 5 * time.Second
+
+// Message is a message delivered by a Source.
+type Message struct {
+	Payload []byte
+}
+
+// Data returns the payload of the message.
+func (m *Message) Data() []byte {
+	return m.Payload
+}
+
+// NewMessages returns messages with the given payloads.
+func NewMessages(payloads ...string) []substrate.Message {
+	msgs := make([]substrate.Message, len(payloads))
+	for i, p := range payloads {
+		msgs[i] = &Message{Payload: []byte(p)}
+	}
+	return msgs
+}
+
+// recorder records messages, and allows waiting for them.
+type recorder struct {
+	mu   sync.Mutex
+	msgs []substrate.Message
+	// changed is closed, and replaced, when a message is recorded.
+	changed chan struct{}
+}
+
+func (r *recorder) record(msg substrate.Message) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.msgs = append(r.msgs, msg)
+	if r.changed != nil {
+		close(r.changed)
+		r.changed = nil
+	}
+	return len(r.msgs)
+}
+
+func (r *recorder) recorded() []substrate.Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]substrate.Message(nil), r.msgs...)
+}
+
+// wait waits until n messages are recorded, or the timeout elapses, and
+// returns the recorded messages.
+func (r *recorder) wait(n int, timeout time.Duration) []substrate.Message {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		r.mu.Lock()
+		if len(r.msgs) >= n {
+			msgs := append([]substrate.Message(nil), r.msgs...)
+			r.mu.Unlock()
+			return msgs
+		}
+		if r.changed == nil {
+			r.changed = make(chan struct{})
+		}
+		changed := r.changed
+		r.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return r.recorded()
+		}
+	}
+}
+
+// assertPayloads waits for the expected number of messages to be recorded,
+// and checks their payloads.
+func (r *recorder) assertPayloads(t testing.TB, what string, timeout time.Duration, payloads []string) bool {
+	t.Helper()
+
+	msgs := r.wait(len(payloads), timeout)
+	actual := make([]string, len(msgs))
+	for i, m := range msgs {
+		actual[i] = string(m.Data())
+	}
+	equal := len(actual) == len(payloads)
+	for i := 0; equal && i < len(actual); i++ {
+		equal = actual[i] == payloads[i]
+	}
+	if !equal {
+		t.Errorf("expected %s messages %q, got %q", what, payloads, actual)
+	}
+	return equal
+}
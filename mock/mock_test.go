@@ -0,0 +1,128 @@
+package mock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/uw-labs/substrate"
+)
+
+func TestPipe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	failure := errors.New("connection lost")
+	source := NewSource().Deliver("a", "b").WaitForAcks().Return(failure).Deliver("c")
+	sink := NewSink()
+
+	assert.Equal(t, failure, substrate.Pipe(ctx, source, sink, substrate.PipeOptions{}))
+	sink.AssertPublished(t, "a", "b")
+	source.AssertAcked(t, "a", "b")
+
+	// The script carries on after the error.
+	errs := make(chan error, 1)
+	go func() {
+		errs <- substrate.Pipe(ctx, source, sink, substrate.PipeOptions{})
+	}()
+	sink.AssertPublished(t, "a", "b", "c")
+	source.AssertAcked(t, "a", "b", "c")
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+func TestSinkWithholdAck(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	source := NewSource().WithTimeout(50*time.Millisecond).Deliver("a", "b", "c").WaitForAcks()
+	sink := NewSink().WithholdAck(2)
+
+	err := substrate.Pipe(ctx, source, sink, substrate.PipeOptions{})
+	assert.EqualError(t, err, "mock: 2 messages not acknowledged within 50ms")
+	sink.AssertPublished(t, "a", "b", "c")
+	assert.Len(t, source.Acked(), 1)
+}
+
+func TestSinkFailAt(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	failure := errors.New("publish failed")
+	source := NewSource().Deliver("a", "b", "c")
+	sink := NewSink().FailAt(2, failure)
+
+	assert.Equal(t, failure, substrate.Pipe(ctx, source, sink, substrate.PipeOptions{}))
+	assert.Len(t, sink.Published(), 1)
+}
+
+func TestSourceInvalidAck(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	source := NewSource().Deliver("a", "b")
+	messages := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, messages, acks)
+	}()
+
+	a, b := <-messages, <-messages
+	acks <- b
+	assert.Equal(t, substrate.InvalidAckError{Acked: b, Expected: a}, <-errs)
+}
+
+type ackKey struct{}
+
+func TestSourceAckWrappedMessage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	source := NewSource().Deliver("a", "b").WaitForAcks()
+	messages := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, messages, acks)
+	}()
+
+	// Wrappers are acknowledged as the messages they wrap, which are the
+	// ones recorded.
+	a := <-messages
+	acks <- substrate.WithValue(a, ackKey{}, 1)
+	b := <-messages
+	acks <- substrate.WithValue(b, ackKey{}, 2)
+	source.AssertAcked(t, "a", "b")
+	assert.Equal(t, []substrate.Message{a, b}, source.Acked())
+	cancel()
+	<-errs
+}
+
+// recordingT records the errors reported by the assertions.
+type recordingT struct {
+	testing.TB
+	errors []string
+}
+
+func (t *recordingT) Helper() {}
+
+func (t *recordingT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestAssertionsTimeOut(t *testing.T) {
+	sink := NewSink().WithTimeout(10 * time.Millisecond)
+	rt := &recordingT{}
+	assert.False(t, sink.AssertPublished(rt, "a"))
+	assert.Equal(t, []string{`expected published messages ["a"], got []`}, rt.errors)
+
+	source := NewSource().WithTimeout(10 * time.Millisecond)
+	rt = &recordingT{}
+	assert.False(t, source.AssertAcked(rt, "a"))
+	assert.Len(t, rt.errors, 1)
+}
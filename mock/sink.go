@@ -0,0 +1,157 @@
+package mock
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uw-labs/substrate"
+)
+
+var _ substrate.AsyncMessageSink = (*Sink)(nil)
+
+// Sink is a substrate.AsyncMessageSink recording the published messages, and
+// acknowledging them unless its script says otherwise. Messages are counted
+// from 1, across calls of PublishMessages.
+type Sink struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	status  *substrate.Status
+	closed  bool
+	// received is the number of messages received by PublishMessages.
+	received     int
+	withholdFrom int
+	failures     map[int]error
+
+	published recorder
+}
+
+// NewSink returns a sink acknowledging all the messages.
+func NewSink() *Sink {
+	return &Sink{timeout: defaultTimeout, failures: make(map[int]error)}
+}
+
+// WithTimeout sets how long AssertPublished waits for.
+func (s *Sink) WithTimeout(timeout time.Duration) *Sink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.timeout = timeout
+	return s
+}
+
+// WithholdAck makes the sink stop acknowledging messages from the nth one. As
+// sinks acknowledge messages in order, none of the messages after it are
+// acknowledged either.
+func (s *Sink) WithholdAck(n int) *Sink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.withholdFrom = n
+	return s
+}
+
+// FailAt makes PublishMessages return err, instead of publishing the nth
+// message.
+func (s *Sink) FailAt(n int, err error) *Sink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures[n] = err
+	return s
+}
+
+// SetStatus sets the status returned by Status. The status defaults to
+// working.
+func (s *Sink) SetStatus(status *substrate.Status) *Sink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status = status
+	return s
+}
+
+// receive returns whether msg is acknowledged, or the error to fail with.
+func (s *Sink) receive(msg substrate.Message) (bool, error) {
+	s.mu.Lock()
+	s.received++
+	n := s.received
+	err := s.failures[n]
+	withheld := s.withholdFrom > 0 && n >= s.withholdFrom
+	s.mu.Unlock()
+
+	if err != nil {
+		return false, err
+	}
+	s.published.record(msg)
+	return !withheld, nil
+}
+
+// PublishMessages records the messages, and acknowledges them according to
+// the script of the sink.
+func (s *Sink) PublishMessages(ctx context.Context, acks chan<- substrate.Message, messages <-chan substrate.Message) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg := <-messages:
+			ack, err := s.receive(msg)
+			if err != nil {
+				return err
+			}
+			if !ack {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case acks <- msg:
+			}
+		}
+	}
+}
+
+// Published returns the published messages, in the order they were published.
+func (s *Sink) Published() []substrate.Message {
+	return s.published.recorded()
+}
+
+// AssertPublished checks that exactly the messages with the given payloads
+// were published, waiting up to the timeout of the sink for them.
+func (s *Sink) AssertPublished(t testing.TB, payloads ...string) bool {
+	t.Helper()
+
+	s.mu.Lock()
+	timeout := s.timeout
+	s.mu.Unlock()
+	return s.published.assertPayloads(t, "published", timeout, payloads)
+}
+
+// Closed returns whether the sink was closed.
+func (s *Sink) Closed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+// Close closes the sink.
+func (s *Sink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	return nil
+}
+
+// Status returns the status set with SetStatus.
+func (s *Sink) Status() (*substrate.Status, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.status == nil {
+		return &substrate.Status{Working: true}, nil
+	}
+	return s.status, nil
+}
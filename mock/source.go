@@ -0,0 +1,234 @@
+package mock
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uw-labs/substrate"
+)
+
+var _ substrate.AsyncMessageSource = (*Source)(nil)
+
+// step is a step of the script of a Source. It returns a non nil error to
+// terminate ConsumeMessages.
+type step func(ctx context.Context, s *Source, messages chan<- substrate.Message, acks <-chan substrate.Message) error
+
+// Source is a substrate.AsyncMessageSource running a script. Once the script
+// is done, ConsumeMessages keeps processing acknowledgements until its context
+// is done.
+type Source struct {
+	mu      sync.Mutex
+	steps   []step
+	timeout time.Duration
+	status  *substrate.Status
+	closed  bool
+	// pending are the delivered messages yet to be acknowledged, in the order
+	// they were delivered.
+	pending []substrate.Message
+
+	acked recorder
+}
+
+// NewSource returns a source with an empty script.
+func NewSource() *Source {
+	return &Source{timeout: defaultTimeout}
+}
+
+// WithTimeout sets how long WaitForAcks and AssertAcked wait for.
+func (s *Source) WithTimeout(timeout time.Duration) *Source {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.timeout = timeout
+	return s
+}
+
+// Deliver adds delivering messages with the given payloads to the script.
+func (s *Source) Deliver(payloads ...string) *Source {
+	return s.DeliverMessages(NewMessages(payloads...)...)
+}
+
+// DeliverMessages adds delivering the given messages to the script.
+func (s *Source) DeliverMessages(msgs ...substrate.Message) *Source {
+	return s.add(func(ctx context.Context, s *Source, messages chan<- substrate.Message, acks <-chan substrate.Message) error {
+		for _, msg := range msgs {
+			delivered := false
+			for !delivered {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case messages <- msg:
+					s.mu.Lock()
+					s.pending = append(s.pending, msg)
+					s.mu.Unlock()
+					delivered = true
+				case ack := <-acks:
+					if err := s.ack(ack); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// WaitForAcks adds waiting for all the delivered messages to be acknowledged
+// to the script. ConsumeMessages returns an error if they aren't within the
+// timeout of the source.
+func (s *Source) WaitForAcks() *Source {
+	return s.add(func(ctx context.Context, s *Source, _ chan<- substrate.Message, acks <-chan substrate.Message) error {
+		s.mu.Lock()
+		timeout := s.timeout
+		s.mu.Unlock()
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for {
+			s.mu.Lock()
+			pending := len(s.pending)
+			s.mu.Unlock()
+			if pending == 0 {
+				return nil
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-timer.C:
+				return fmt.Errorf("mock: %d messages not acknowledged within %s", pending, timeout)
+			case ack := <-acks:
+				if err := s.ack(ack); err != nil {
+					return err
+				}
+			}
+		}
+	})
+}
+
+// Return adds returning err from ConsumeMessages to the script. The script
+// carries on with the next call of ConsumeMessages.
+func (s *Source) Return(err error) *Source {
+	return s.add(func(context.Context, *Source, chan<- substrate.Message, <-chan substrate.Message) error {
+		return err
+	})
+}
+
+// SetStatus sets the status returned by Status. The status defaults to
+// working.
+func (s *Source) SetStatus(status *substrate.Status) *Source {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status = status
+	return s
+}
+
+func (s *Source) add(st step) *Source {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.steps = append(s.steps, st)
+	return s
+}
+
+// next removes the next step from the script, and returns it, or nil if the
+// script is done.
+func (s *Source) next() step {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.steps) == 0 {
+		return nil
+	}
+	st := s.steps[0]
+	s.steps = s.steps[1:]
+	return st
+}
+
+// ack records the acknowledgement of the oldest pending message.
+func (s *Source) ack(ack substrate.Message) error {
+	s.mu.Lock()
+	if len(s.pending) == 0 || !substrate.SameMessage(ack, s.pending[0]) {
+		var expected substrate.Message
+		if len(s.pending) > 0 {
+			expected = s.pending[0]
+		}
+		s.mu.Unlock()
+		return substrate.InvalidAckError{Acked: ack, Expected: expected}
+	}
+	acked := s.pending[0]
+	s.pending = s.pending[1:]
+	s.mu.Unlock()
+
+	s.acked.record(acked)
+	return nil
+}
+
+// ConsumeMessages runs the script of the source.
+func (s *Source) ConsumeMessages(ctx context.Context, messages chan<- substrate.Message, acks <-chan substrate.Message) error {
+	for st := s.next(); st != nil; st = s.next() {
+		if err := st(ctx, s, messages, acks); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ack := <-acks:
+			if err := s.ack(ack); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Acked returns the acknowledged messages, in the order they were
+// acknowledged.
+func (s *Source) Acked() []substrate.Message {
+	return s.acked.recorded()
+}
+
+// AssertAcked checks that exactly the messages with the given payloads were
+// acknowledged, waiting up to the timeout of the source for them.
+func (s *Source) AssertAcked(t testing.TB, payloads ...string) bool {
+	t.Helper()
+
+	s.mu.Lock()
+	timeout := s.timeout
+	s.mu.Unlock()
+	return s.acked.assertPayloads(t, "acknowledged", timeout, payloads)
+}
+
+// Closed returns whether the source was closed.
+func (s *Source) Closed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+// Close closes the source.
+func (s *Source) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	return nil
+}
+
+// Status returns the status set with SetStatus.
+func (s *Source) Status() (*substrate.Status, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.status == nil {
+		return &substrate.Status{Working: true}, nil
+	}
+	return s.status, nil
+}
@@ -45,6 +45,9 @@ type AsyncMessageSinkConfig struct {
 }
 
 func NewAsyncMessageSink(config AsyncMessageSinkConfig) (substrate.AsyncMessageSink, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
 	sink := asyncMessageSink{subject: config.Subject, connectionLost: make(chan error, 1)}
 
 	clientID := config.ClientID
@@ -158,15 +161,15 @@ type asyncMessageSource struct {
 }
 
 func NewAsyncMessageSource(c AsyncMessageSourceConfig) (substrate.AsyncMessageSource, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
 	clientID := c.ClientID
 	if clientID == "" {
 		clientID = c.QueueGroup + generateID()
 	}
-	switch {
-	case c.Offset == 0:
+	if c.Offset == 0 {
 		c.Offset = OffsetNewest
-	case c.Offset < -2:
-		return nil, fmt.Errorf("invalid offset: '%v'", c.Offset)
 	}
 
 	if c.ConnectionPingInterval < 1 {
@@ -273,8 +276,7 @@ func handleAcks(ctx context.Context, msgsToAck chan *consumerMessage, acks <-cha
 				return substrate.InvalidAckError{Acked: cr, Expected: nil}
 			}
 			msgToAck := toAck[0]
-			cm, ok := cr.(*consumerMessage)
-			if !ok || cm != msgToAck {
+			if !substrate.SameMessage(cr, msgToAck) {
 				return substrate.InvalidAckError{Acked: cr, Expected: msgToAck}
 			}
 			if err := msgToAck.m.Ack(); err != nil {
@@ -0,0 +1,26 @@
+package natsstreaming
+
+import "github.com/uw-labs/substrate/internal/validate"
+
+// Validate returns an error listing the problems of the config, if any, such
+// as "natsstreaming: AsyncMessageSinkConfig.ClusterID must not be empty". It
+// is called by NewAsyncMessageSink.
+func (c AsyncMessageSinkConfig) Validate() error {
+	p := validate.New("natsstreaming", "AsyncMessageSinkConfig")
+	p.NotEmpty(c.ClusterID, "ClusterID")
+	p.NotEmpty(c.Subject, "Subject")
+	return p.Err()
+}
+
+// Validate returns an error listing the problems of the config, if any, such
+// as "natsstreaming: AsyncMessageSourceConfig.Subject must not be empty". It
+// is called by NewAsyncMessageSource.
+func (c AsyncMessageSourceConfig) Validate() error {
+	p := validate.New("natsstreaming", "AsyncMessageSourceConfig")
+	p.NotEmpty(c.ClusterID, "ClusterID")
+	p.NotEmpty(c.Subject, "Subject")
+	p.Check(c.Offset >= OffsetOldest, "Offset", "must be either OffsetOldest, OffsetNewest or a sequence number")
+	p.NotNegative(c.MaxInFlight, "MaxInFlight")
+	p.NotNegativeDuration(c.AckWait, "AckWait")
+	return p.Err()
+}
@@ -0,0 +1,112 @@
+package natsstreaming
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsyncMessageSinkConfigValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   AsyncMessageSinkConfig
+		expected string
+	}{
+		{
+			name:   "valid",
+			config: AsyncMessageSinkConfig{ClusterID: "c1", Subject: "s1"},
+		},
+		{
+			name:     "no cluster id",
+			config:   AsyncMessageSinkConfig{Subject: "s1"},
+			expected: "natsstreaming: AsyncMessageSinkConfig.ClusterID must not be empty",
+		},
+		{
+			name:     "no subject",
+			config:   AsyncMessageSinkConfig{ClusterID: "c1"},
+			expected: "natsstreaming: AsyncMessageSinkConfig.Subject must not be empty",
+		},
+		{
+			name:   "every problem",
+			config: AsyncMessageSinkConfig{},
+			expected: "2 problems: " +
+				"natsstreaming: AsyncMessageSinkConfig.ClusterID must not be empty; " +
+				"natsstreaming: AsyncMessageSinkConfig.Subject must not be empty",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			err := tst.config.Validate()
+			if tst.expected == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tst.expected)
+			_, err = NewAsyncMessageSink(tst.config)
+			assert.EqualError(t, err, tst.expected)
+		})
+	}
+}
+
+func TestAsyncMessageSourceConfigValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(*AsyncMessageSourceConfig)
+		expected string
+	}{
+		{
+			name:   "valid",
+			modify: func(c *AsyncMessageSourceConfig) {},
+		},
+		{
+			name: "valid with options",
+			modify: func(c *AsyncMessageSourceConfig) {
+				c.Offset = 42
+				c.MaxInFlight = 10
+				c.AckWait = time.Minute
+			},
+		},
+		{
+			name:     "no cluster id",
+			modify:   func(c *AsyncMessageSourceConfig) { c.ClusterID = "" },
+			expected: "natsstreaming: AsyncMessageSourceConfig.ClusterID must not be empty",
+		},
+		{
+			name:     "no subject",
+			modify:   func(c *AsyncMessageSourceConfig) { c.Subject = "" },
+			expected: "natsstreaming: AsyncMessageSourceConfig.Subject must not be empty",
+		},
+		{
+			name:     "offset",
+			modify:   func(c *AsyncMessageSourceConfig) { c.Offset = -3 },
+			expected: "natsstreaming: AsyncMessageSourceConfig.Offset must be either OffsetOldest, OffsetNewest or a sequence number",
+		},
+		{
+			name:     "max in flight",
+			modify:   func(c *AsyncMessageSourceConfig) { c.MaxInFlight = -1 },
+			expected: "natsstreaming: AsyncMessageSourceConfig.MaxInFlight must not be negative",
+		},
+		{
+			name:     "ack wait",
+			modify:   func(c *AsyncMessageSourceConfig) { c.AckWait = -time.Second },
+			expected: "natsstreaming: AsyncMessageSourceConfig.AckWait must not be negative",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			c := AsyncMessageSourceConfig{ClusterID: "c1", Subject: "s1"}
+			tst.modify(&c)
+			err := c.Validate()
+			if tst.expected == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tst.expected)
+			_, err = NewAsyncMessageSource(c)
+			assert.EqualError(t, err, tst.expected)
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package substrate
+
+import (
+	"context"
+	"time"
+
+	"github.com/uw-labs/sync/rungroup"
+
+	"github.com/uw-labs/substrate/internal/clock"
+)
+
+// NewPacedSource returns a source that delays the delivery of the messages
+// consumed from source, so that the gaps between them match the gaps between
+// the times they were originally produced, divided by speedup, e.g. to replay
+// recorded traffic with its original burst shape. A speedup of 2 replays
+// twice as fast as real time, and defaults to 1 if it is not positive. The
+// time a message was produced is returned by timestampFunc, or, if it is nil,
+// by the Timestamp method of messages implementing TimestampedMessage.
+// Messages without a timestamp are delivered immediately.
+//
+// Gaps are measured from the first message, so messages are delivered
+// immediately while the caller is behind, until it catches up. If maxDelay is
+// positive, no message is delayed by more than maxDelay, e.g. across the gaps
+// in the traffic, and the following messages are paced from that message.
+// Acknowledgements are passed to source untouched. When Close is called on
+// the returned source, this is also propagated to source.
+func NewPacedSource(source AsyncMessageSource, timestampFunc func(Message) (time.Time, bool), speedup float64, maxDelay time.Duration) AsyncMessageSource {
+	if timestampFunc == nil {
+		timestampFunc = messageTimestamp
+	}
+	if speedup <= 0 {
+		speedup = 1
+	}
+	return &pacedSource{
+		source:        source,
+		timestampFunc: timestampFunc,
+		speedup:       speedup,
+		maxDelay:      maxDelay,
+		clock:         clock.Real,
+	}
+}
+
+type pacedSource struct {
+	source        AsyncMessageSource
+	timestampFunc func(Message) (time.Time, bool)
+	speedup       float64
+	maxDelay      time.Duration
+	clock         clock.Clock
+}
+
+func (s *pacedSource) ConsumeMessages(ctx context.Context, messages chan<- Message, acks <-chan Message) error {
+	rg, ctx := rungroup.New(ctx)
+
+	fromInner := make(chan Message, cap(messages))
+
+	rg.Go(func() error {
+		return s.source.ConsumeMessages(ctx, fromInner, acks)
+	})
+
+	rg.Go(func() error {
+		p := &pacer{speedup: s.speedup, maxDelay: s.maxDelay}
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case msg := <-fromInner:
+				if ts, ok := s.timestampFunc(msg); ok {
+					if d := p.delay(ts, s.clock.Now()); d > 0 {
+						timer := s.clock.NewTimer(d)
+						select {
+						case <-timer.C():
+						case <-ctx.Done():
+							timer.Stop()
+							return ctx.Err()
+						}
+					}
+				}
+				select {
+				case messages <- msg:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+// pacer schedules the delivery of messages relative to the first one.
+type pacer struct {
+	speedup  float64
+	maxDelay time.Duration
+
+	started bool
+	// start is when the message produced at origin was scheduled for
+	// delivery.
+	start, origin time.Time
+}
+
+// delay returns how long to wait before delivering a message produced at ts,
+// which is not positive if the message is due.
+func (p *pacer) delay(ts, now time.Time) time.Duration {
+	if !p.started {
+		p.started = true
+		p.start, p.origin = now, ts
+		return 0
+	}
+	d := p.start.Add(time.Duration(float64(ts.Sub(p.origin)) / p.speedup)).Sub(now)
+	if p.maxDelay > 0 && d > p.maxDelay {
+		d = p.maxDelay
+		p.start, p.origin = now.Add(d), ts
+	}
+	return d
+}
+
+// Close closes the underlying source.
+func (s *pacedSource) Close() error {
+	return s.source.Close()
+}
+
+// Status returns the status of the underlying source.
+func (s *pacedSource) Status() (*Status, error) {
+	return s.source.Status()
+}
@@ -0,0 +1,119 @@
+package substrate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/uw-labs/substrate/internal/testutil"
+)
+
+func TestPacedSourceMatchesTimestampGaps(t *testing.T) {
+	inner := &mockAsyncSource{
+		toSend: make(chan Message, 4),
+		acked:  make(chan Message, 4),
+		closed: make(chan struct{}),
+	}
+	source := NewPacedSource(inner, nil, 2, 0)
+	clock := testutil.NewFakeClock(time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC))
+	source.(*pacedSource).clock = clock
+
+	origin := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	gaps := []time.Duration{0, 200 * time.Millisecond, 200 * time.Millisecond, 0}
+	ts := origin
+	for i, gap := range gaps {
+		ts = ts.Add(gap)
+		inner.toSend <- &timestampedTestMessage{data: string(rune('a' + i)), timestamp: ts}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	for i, gap := range gaps {
+		// Each message is delivered once the clock has advanced by half
+		// the gap, and not before.
+		if gap > 0 {
+			clock.BlockUntil(1)
+			clock.Advance(gap/2 - time.Millisecond)
+			select {
+			case m := <-msgs:
+				t.Fatalf("message %q delivered early", m.Data())
+			default:
+			}
+			clock.Advance(time.Millisecond)
+		}
+		m := <-msgs
+		assert.Equal(t, string(rune('a'+i)), string(m.Data()))
+		acks <- m
+		// Acknowledgements are passed through.
+		assert.Equal(t, m, <-inner.acked)
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+func TestPacer(t *testing.T) {
+	origin := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	now := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	p := &pacer{speedup: 2, maxDelay: 10 * time.Second}
+	assert.Equal(t, time.Duration(0), p.delay(origin, now))
+	assert.Equal(t, 5*time.Second, p.delay(origin.Add(10*time.Second), now))
+
+	// Messages are due immediately while the caller is behind.
+	now = now.Add(time.Minute)
+	assert.True(t, p.delay(origin.Add(20*time.Second), now) < 0)
+
+	// Long gaps are capped, and the following messages are paced from the
+	// capped one.
+	assert.Equal(t, 10*time.Second, p.delay(origin.Add(time.Hour), now))
+	now = now.Add(5 * time.Second)
+	assert.Equal(t, 6*time.Second, p.delay(origin.Add(time.Hour+2*time.Second), now))
+}
+
+func TestPacedSourceWithoutTimestamps(t *testing.T) {
+	inner := &mockAsyncSource{
+		toSend: make(chan Message, 2),
+		acked:  make(chan Message, 2),
+		closed: make(chan struct{}),
+	}
+	source := NewPacedSource(inner, nil, 1, 0)
+	first, second := message("first"), message("second")
+	inner.toSend <- &first
+	inner.toSend <- &second
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	go func() {
+		_ = source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	for range []Message{&first, &second} {
+		select {
+		case m := <-msgs:
+			acks <- m
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("message without timestamp delayed")
+		}
+	}
+
+	assert.NoError(t, source.Close())
+	select {
+	case <-inner.closed:
+	default:
+		t.Error("underlying async source didn't get closed")
+	}
+}
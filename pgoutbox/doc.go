@@ -0,0 +1,49 @@
+// Package pgoutbox provides a substrate source consuming a PostgreSQL
+// transactional outbox table.
+//
+// Usage
+//
+// Applications write messages to the outbox table in the same transaction as
+// their business data, and this source publishes them onwards. Rows are read
+// through database/sql, with the github.com/lib/pq driver registered as
+// "postgres" by default, or with another registered driver (for example
+// github.com/jackc/pgx/v4/stdlib) named by DriverName, or an existing *sql.DB
+// passed in the configuration.
+//
+// A suitable table looks like:
+//
+//      CREATE TABLE outbox (
+//          id           BIGSERIAL PRIMARY KEY,
+//          payload      BYTEA NOT NULL,
+//          processed_at TIMESTAMPTZ
+//      );
+//
+// Multiple sources may consume the same table concurrently. Each row is
+// delivered to a single consumer, as rows are locked with FOR UPDATE SKIP
+// LOCKED until acknowledged. Ordering is only guaranteed within a single
+// consumer.
+//
+// The next batch of rows is selected as soon as the rows of the current one
+// have been delivered, while they wait for their acknowledgements, so a
+// consumer holding many messages before acknowledging them, such as a batching
+// consumer, keeps several batches open.
+//
+// The outbox is polled every PollInterval while it is empty. Setting
+// NotifyChannel makes the source LISTEN on a channel as well, and select rows
+// as soon as it is notified, e.g. by a trigger on the outbox table:
+//
+//      CREATE FUNCTION notify_outbox() RETURNS trigger AS $$
+//      BEGIN
+//          PERFORM pg_notify('outbox', '');
+//          RETURN NULL;
+//      END;
+//      $$ LANGUAGE plpgsql;
+//
+//      CREATE TRIGGER outbox_notify AFTER INSERT ON outbox
+//          FOR EACH STATEMENT EXECUTE PROCEDURE notify_outbox();
+//
+// Listening uses github.com/lib/pq, with a connection to DSN.
+//
+// This package is not available through suburl.
+//
+package pgoutbox
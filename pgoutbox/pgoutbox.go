@@ -0,0 +1,406 @@
+package pgoutbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/uw-labs/substrate"
+)
+
+var _ substrate.AsyncMessageSource = (*asyncMessageSource)(nil)
+
+const (
+	defaultDriverName      = "postgres"
+	defaultIDColumn        = "id"
+	defaultPayloadColumn   = "payload"
+	defaultProcessedColumn = "processed_at"
+	defaultPollInterval    = time.Second
+	defaultBatchSize       = 100
+	statusTimeout          = 5 * time.Second
+
+	// The reconnect intervals of the listener of NotifyChannel.
+	minListenerReconnect = 100 * time.Millisecond
+	maxListenerReconnect = 10 * time.Second
+)
+
+// AsyncMessageSourceConfig is the configuration parameters for an
+// AsyncMessageSource.
+type AsyncMessageSourceConfig struct {
+	// DB is the database handle to use. When it is nil, a new handle is
+	// opened using DriverName and DSN, and closed when the source is closed.
+	DB *sql.DB
+	// DriverName is the name of the registered database/sql driver used
+	// with DSN. Defaults to "postgres".
+	DriverName string
+	// DSN is the data source name used when DB is nil.
+	DSN string
+	// Table is the outbox table name, optionally schema qualified.
+	Table string
+	// IDColumn is the column rows are ordered and identified by.
+	// Defaults to "id".
+	IDColumn string
+	// PayloadColumn is the column holding the message payload.
+	// Defaults to "payload".
+	PayloadColumn string
+	// KeyColumn is an optional column holding the message key. When set,
+	// delivered messages implement substrate.KeyedMessage.
+	KeyColumn string
+	// ProcessedColumn is the nullable timestamp column set when a row is
+	// acknowledged. Only rows where it is null are delivered.
+	// Defaults to "processed_at". Not used when Delete is set.
+	ProcessedColumn string
+	// Delete makes the source delete acknowledged rows instead of marking
+	// them processed.
+	Delete bool
+	// PollInterval is how long to wait before polling again when the outbox
+	// is empty. Defaults to 1s.
+	PollInterval time.Duration
+	// NotifyChannel, if set, is a channel the source LISTENs on, through a
+	// github.com/lib/pq connection to DSN, to select rows as soon as it is
+	// notified, e.g. by a trigger on the outbox table calling
+	// pg_notify('outbox', ''). The outbox is still polled every
+	// PollInterval, as notifications are lost while reconnecting.
+	NotifyChannel string
+	// BatchSize is the maximum number of rows selected and locked at once.
+	// Defaults to 100.
+	BatchSize int
+}
+
+// NewAsyncMessageSource returns a new source consuming the rows of an outbox
+// table.
+//
+// Rows are selected in batches with FOR UPDATE SKIP LOCKED, and the selecting
+// transaction stays open until every row of the batch has been acknowledged,
+// at which point the rows are marked processed (or deleted) and the
+// transaction committed. This means that competing consumers of the same
+// table never receive the same row, and unacknowledged rows are released for
+// redelivery if a consumer stops or fails.
+//
+// The next batch is selected, in its own transaction, as soon as every row of
+// the previous one has been delivered, so a consumer holding more messages
+// than BatchSize before acknowledging them keeps several batches open, each
+// holding a connection of the pool, and each committed once all of its rows
+// are acknowledged.
+func NewAsyncMessageSource(c AsyncMessageSourceConfig) (substrate.AsyncMessageSource, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.DriverName == "" {
+		c.DriverName = defaultDriverName
+	}
+	if c.IDColumn == "" {
+		c.IDColumn = defaultIDColumn
+	}
+	if c.PayloadColumn == "" {
+		c.PayloadColumn = defaultPayloadColumn
+	}
+	if c.ProcessedColumn == "" {
+		c.ProcessedColumn = defaultProcessedColumn
+	}
+	if c.PollInterval <= 0 {
+		c.PollInterval = defaultPollInterval
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = defaultBatchSize
+	}
+
+	db, ownDB := c.DB, false
+	if db == nil {
+		var err error
+		db, err = sql.Open(c.DriverName, c.DSN)
+		if err != nil {
+			return nil, err
+		}
+		ownDB = true
+	}
+
+	return &asyncMessageSource{
+		db:    db,
+		ownDB: ownDB,
+		conf:  c,
+	}, nil
+}
+
+type asyncMessageSource struct {
+	db    *sql.DB
+	ownDB bool
+	conf  AsyncMessageSourceConfig
+}
+
+type consumerMessage struct {
+	id   interface{}
+	data []byte
+}
+
+func (cm *consumerMessage) Data() []byte {
+	if cm.data == nil {
+		panic("attempt to use payload after discarding.")
+	}
+	return cm.data
+}
+
+func (cm *consumerMessage) DiscardPayload() {
+	cm.data = nil
+}
+
+type keyedConsumerMessage struct {
+	consumerMessage
+	key []byte
+}
+
+func (cm *keyedConsumerMessage) Key() []byte {
+	return cm.key
+}
+
+// batch is a batch of locked rows, along with the transaction holding the
+// locks.
+type batch struct {
+	tx        *sql.Tx
+	msgs      []substrate.Message
+	delivered int
+	acked     int
+}
+
+func (ams *asyncMessageSource) ConsumeMessages(ctx context.Context, messages chan<- substrate.Message, acks <-chan substrate.Message) error {
+	var notifications <-chan *pq.Notification
+	if ams.conf.NotifyChannel != "" {
+		listener := pq.NewListener(ams.conf.DSN, minListenerReconnect, maxListenerReconnect, nil)
+		defer listener.Close()
+		if err := listener.Listen(ams.conf.NotifyChannel); err != nil {
+			return err
+		}
+		notifications = listener.Notify
+	}
+
+	var (
+		// open are the batches with rows that are not acknowledged yet,
+		// oldest first. Rows are delivered and acknowledged in order, so
+		// only the last one can have undelivered rows, and only the first
+		// one acknowledged rows.
+		open []*batch
+		// poll is set when the outbox is to be polled once every selected
+		// row is delivered.
+		poll    = true
+		pollDue <-chan time.Time
+	)
+	for {
+		if poll && (len(open) == 0 || open[len(open)-1].delivered == len(open[len(open)-1].msgs)) {
+			b, err := ams.selectBatch(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ams.shutdown(ctx, open)
+				}
+				ams.rollback(open)
+				return err
+			}
+			if b != nil {
+				open = append(open, b)
+			} else {
+				poll, pollDue = false, time.After(ams.conf.PollInterval)
+			}
+		}
+
+		var toClient chan<- substrate.Message
+		var next substrate.Message
+		if len(open) > 0 {
+			if last := open[len(open)-1]; last.delivered < len(last.msgs) {
+				toClient, next = messages, last.msgs[last.delivered]
+			}
+		}
+
+		select {
+		case toClient <- next:
+			open[len(open)-1].delivered++
+		case ack := <-acks:
+			if len(open) == 0 || open[0].acked == open[0].delivered {
+				ams.rollback(open)
+				return substrate.InvalidAckError{Acked: ack, Expected: nil}
+			}
+			first := open[0]
+			if expected := first.msgs[first.acked]; !substrate.SameMessage(ack, expected) {
+				ams.rollback(open)
+				return substrate.InvalidAckError{Acked: ack, Expected: expected}
+			}
+			if first.acked++; first.acked == len(first.msgs) {
+				open = open[1:]
+				if err := ams.complete(first.tx, first.msgs); err != nil {
+					ams.rollback(open)
+					return err
+				}
+			}
+		case <-pollDue:
+			poll, pollDue = true, nil
+		case <-notifications:
+			poll, pollDue = true, nil
+		case <-ctx.Done():
+			return ams.shutdown(ctx, open)
+		}
+	}
+}
+
+// shutdown completes the acknowledged rows of the open batches, releases the
+// others and returns the context error.
+func (ams *asyncMessageSource) shutdown(ctx context.Context, open []*batch) error {
+	if len(open) == 0 {
+		return ctx.Err()
+	}
+	first := open[0]
+	ams.rollback(open[1:])
+	if err := ams.complete(first.tx, first.msgs[:first.acked]); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// rollback releases the rows of the open batches without completing any.
+func (ams *asyncMessageSource) rollback(open []*batch) {
+	for _, b := range open {
+		_ = b.tx.Rollback()
+	}
+}
+
+// selectBatch begins a transaction and locks a batch of rows with it,
+// returning nil if there are none.
+func (ams *asyncMessageSource) selectBatch(ctx context.Context) (*batch, error) {
+	// The transaction is deliberately not bound to ctx, so that the rows that
+	// were acknowledged before ctx is done can still be completed.
+	tx, err := ams.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := ams.selectRows(ctx, tx)
+	if err != nil || len(msgs) == 0 {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return &batch{tx: tx, msgs: msgs}, nil
+}
+
+func (ams *asyncMessageSource) selectRows(ctx context.Context, tx *sql.Tx) ([]substrate.Message, error) {
+	columns := []string{quoteIdentifier(ams.conf.IDColumn), quoteIdentifier(ams.conf.PayloadColumn)}
+	if ams.conf.KeyColumn != "" {
+		columns = append(columns, quoteIdentifier(ams.conf.KeyColumn))
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), quoteIdentifier(ams.conf.Table))
+	if !ams.conf.Delete {
+		query += fmt.Sprintf(" WHERE %s IS NULL", quoteIdentifier(ams.conf.ProcessedColumn))
+	}
+	query += fmt.Sprintf(" ORDER BY %s LIMIT $1 FOR UPDATE SKIP LOCKED", quoteIdentifier(ams.conf.IDColumn))
+
+	rows, err := tx.QueryContext(ctx, query, ams.conf.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []substrate.Message
+	for rows.Next() {
+		var (
+			id      interface{}
+			payload []byte
+			key     []byte
+		)
+		dest := []interface{}{&id, &payload}
+		if ams.conf.KeyColumn != "" {
+			dest = append(dest, &key)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		if payload == nil {
+			// A nil payload is indistinguishable from a discarded one.
+			payload = []byte{}
+		}
+
+		cm := consumerMessage{id: id, data: payload}
+		if ams.conf.KeyColumn != "" {
+			batch = append(batch, &keyedConsumerMessage{consumerMessage: cm, key: key})
+		} else {
+			batch = append(batch, &cm)
+		}
+	}
+	return batch, rows.Err()
+}
+
+// complete marks the given rows as processed, or deletes them, and commits the
+// transaction, which also releases the locks on any remaining rows.
+func (ams *asyncMessageSource) complete(tx *sql.Tx, done []substrate.Message) error {
+	if len(done) == 0 {
+		return tx.Rollback()
+	}
+
+	ids := make([]interface{}, len(done))
+	placeholders := make([]string, len(done))
+	for i, m := range done {
+		id, err := messageID(m)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		ids[i] = id
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+
+	var query string
+	if ams.conf.Delete {
+		query = fmt.Sprintf("DELETE FROM %s WHERE %s IN (%s)",
+			quoteIdentifier(ams.conf.Table), quoteIdentifier(ams.conf.IDColumn), strings.Join(placeholders, ", "))
+	} else {
+		query = fmt.Sprintf("UPDATE %s SET %s = now() WHERE %s IN (%s)",
+			quoteIdentifier(ams.conf.Table), quoteIdentifier(ams.conf.ProcessedColumn), quoteIdentifier(ams.conf.IDColumn), strings.Join(placeholders, ", "))
+	}
+
+	if _, err := tx.Exec(query, ids...); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// messageID returns the id of the row a message was delivered for, unwrapping
+// messages implementing an Original method, or an error if the message was not
+// delivered by this package.
+func messageID(m substrate.Message) (interface{}, error) {
+	for {
+		switch cm := m.(type) {
+		case *consumerMessage:
+			return cm.id, nil
+		case *keyedConsumerMessage:
+			return cm.id, nil
+		case interface{ Original() substrate.Message }:
+			m = cm.Original()
+		default:
+			return nil, fmt.Errorf("pgoutbox: unexpected message type %T", m)
+		}
+	}
+}
+
+// quoteIdentifier quotes each part of a possibly schema qualified identifier.
+func quoteIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = `"` + strings.Replace(p, `"`, `""`, -1) + `"`
+	}
+	return strings.Join(parts, ".")
+}
+
+func (ams *asyncMessageSource) Status() (*substrate.Status, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), statusTimeout)
+	defer cancel()
+	if err := ams.db.PingContext(ctx); err != nil {
+		return &substrate.Status{Working: false, Problems: []string{err.Error()}}, nil
+	}
+	return &substrate.Status{Working: true}, nil
+}
+
+func (ams *asyncMessageSource) Close() error {
+	if ams.ownDB {
+		return ams.db.Close()
+	}
+	return nil
+}
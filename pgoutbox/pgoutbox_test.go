@@ -0,0 +1,500 @@
+package pgoutbox
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+)
+
+// fakeTable is an in memory outbox table served through a fake database/sql
+// driver. It understands only the statements issued by the source, and
+// emulates the row locking of FOR UPDATE SKIP LOCKED.
+type fakeTable struct {
+	mu      sync.Mutex
+	rows    []*fakeRow
+	queries []string
+}
+
+type fakeRow struct {
+	id        int64
+	payload   []byte
+	key       []byte
+	processed bool
+	deleted   bool
+	lockedBy  *fakeTx
+}
+
+func newFakeTable(n int) *fakeTable {
+	ft := &fakeTable{}
+	for i := 1; i <= n; i++ {
+		ft.rows = append(ft.rows, &fakeRow{
+			id:      int64(i),
+			payload: []byte(fmt.Sprintf("message-%d", i)),
+			key:     []byte(fmt.Sprintf("key-%d", i)),
+		})
+	}
+	return ft
+}
+
+func (ft *fakeTable) db() *sql.DB {
+	return sql.OpenDB(ft)
+}
+
+func (ft *fakeTable) row(id int64) fakeRow {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	for _, r := range ft.rows {
+		if r.id == id {
+			return *r
+		}
+	}
+	panic(fmt.Sprintf("no row with id %d", id))
+}
+
+// statement returns the first statement issued starting with prefix.
+func (ft *fakeTable) statement(t *testing.T, prefix string) string {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	for _, q := range ft.queries {
+		if strings.HasPrefix(q, prefix) {
+			return q
+		}
+	}
+	t.Fatalf("no statement starting with %q", prefix)
+	return ""
+}
+
+func (ft *fakeTable) Connect(context.Context) (driver.Conn, error) {
+	return &fakeConn{table: ft}, nil
+}
+
+func (ft *fakeTable) Driver() driver.Driver {
+	panic("not supported")
+}
+
+type fakeConn struct {
+	table *fakeTable
+	tx    *fakeTx
+}
+
+func (fc *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: fc, query: query}, nil
+}
+
+func (fc *fakeConn) Close() error {
+	return nil
+}
+
+func (fc *fakeConn) Begin() (driver.Tx, error) {
+	fc.tx = &fakeTx{conn: fc}
+	return fc.tx, nil
+}
+
+type fakeTx struct {
+	conn *fakeConn
+}
+
+func (tx *fakeTx) Commit() error {
+	return tx.release()
+}
+
+func (tx *fakeTx) Rollback() error {
+	return tx.release()
+}
+
+func (tx *fakeTx) release() error {
+	ft := tx.conn.table
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	for _, r := range ft.rows {
+		if r.lockedBy == tx {
+			r.lockedBy = nil
+		}
+	}
+	tx.conn.tx = nil
+	return nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (fs *fakeStmt) Close() error {
+	return nil
+}
+
+func (fs *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (fs *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	ft := fs.conn.table
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.queries = append(ft.queries, fs.query)
+
+	var n int64
+	for _, r := range ft.rows {
+		for _, id := range args {
+			if r.id != id.(int64) {
+				continue
+			}
+			switch {
+			case strings.HasPrefix(fs.query, "UPDATE "):
+				r.processed = true
+			case strings.HasPrefix(fs.query, "DELETE "):
+				r.deleted = true
+			default:
+				return nil, fmt.Errorf("unexpected statement: %s", fs.query)
+			}
+			n++
+		}
+	}
+	return driver.RowsAffected(n), nil
+}
+
+func (fs *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	ft := fs.conn.table
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.queries = append(ft.queries, fs.query)
+
+	if !strings.HasPrefix(fs.query, "SELECT ") || !strings.HasSuffix(fs.query, "FOR UPDATE SKIP LOCKED") {
+		return nil, fmt.Errorf("unexpected query: %s", fs.query)
+	}
+	withKey := strings.Contains(fs.query, `"key"`)
+	onlyUnprocessed := strings.Contains(fs.query, "IS NULL")
+
+	fr := &fakeRows{columns: []string{"id", "payload"}}
+	if withKey {
+		fr.columns = append(fr.columns, "key")
+	}
+	for _, r := range ft.rows {
+		if int64(len(fr.values)) == args[0].(int64) {
+			break
+		}
+		if r.deleted || (onlyUnprocessed && r.processed) || (r.lockedBy != nil && r.lockedBy != fs.conn.tx) {
+			continue
+		}
+		r.lockedBy = fs.conn.tx
+		vals := []driver.Value{r.id, r.payload}
+		if withKey {
+			vals = append(vals, r.key)
+		}
+		fr.values = append(fr.values, vals)
+	}
+	return fr, nil
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (fr *fakeRows) Columns() []string {
+	return fr.columns
+}
+
+func (fr *fakeRows) Close() error {
+	return nil
+}
+
+func (fr *fakeRows) Next(dest []driver.Value) error {
+	if len(fr.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, fr.values[0])
+	fr.values = fr.values[1:]
+	return nil
+}
+
+type consumer struct {
+	msgs   chan substrate.Message
+	acks   chan substrate.Message
+	errs   chan error
+	cancel context.CancelFunc
+}
+
+func startConsumer(t *testing.T, conf AsyncMessageSourceConfig) *consumer {
+	source, err := NewAsyncMessageSource(conf)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	c := &consumer{
+		msgs:   make(chan substrate.Message),
+		acks:   make(chan substrate.Message),
+		errs:   make(chan error, 1),
+		cancel: cancel,
+	}
+	go func() {
+		c.errs <- source.ConsumeMessages(ctx, c.msgs, c.acks)
+		source.Close()
+	}()
+	return c
+}
+
+func (c *consumer) stop() error {
+	c.cancel()
+	return <-c.errs
+}
+
+func TestConsumeMarksProcessed(t *testing.T) {
+	ft := newFakeTable(5)
+	c := startConsumer(t, AsyncMessageSourceConfig{
+		DB:           ft.db(),
+		Table:        "public.outbox",
+		BatchSize:    2,
+		PollInterval: 10 * time.Millisecond,
+	})
+
+	for i := 1; i <= 5; i++ {
+		m := <-c.msgs
+		assert.Equal(t, fmt.Sprintf("message-%d", i), string(m.Data()))
+		_, keyed := m.(substrate.KeyedMessage)
+		assert.False(t, keyed)
+		c.acks <- m
+	}
+	assert.Equal(t, context.Canceled, c.stop())
+
+	for i := int64(1); i <= 5; i++ {
+		assert.True(t, ft.row(i).processed)
+		assert.Nil(t, ft.row(i).lockedBy)
+	}
+	assert.Equal(t, `SELECT "id", "payload" FROM "public"."outbox" WHERE "processed_at" IS NULL ORDER BY "id" LIMIT $1 FOR UPDATE SKIP LOCKED`, ft.statement(t, "SELECT "))
+	assert.Equal(t, `UPDATE "public"."outbox" SET "processed_at" = now() WHERE "id" IN ($1, $2)`, ft.statement(t, "UPDATE "))
+}
+
+func TestConsumeDeletes(t *testing.T) {
+	ft := newFakeTable(3)
+	c := startConsumer(t, AsyncMessageSourceConfig{
+		DB:           ft.db(),
+		Table:        "outbox",
+		KeyColumn:    "key",
+		Delete:       true,
+		PollInterval: 10 * time.Millisecond,
+	})
+
+	for i := 1; i <= 3; i++ {
+		m := <-c.msgs
+		keyed, ok := m.(substrate.KeyedMessage)
+		require.True(t, ok)
+		assert.Equal(t, fmt.Sprintf("key-%d", i), string(keyed.Key()))
+		c.acks <- m
+	}
+	assert.Equal(t, context.Canceled, c.stop())
+
+	for i := int64(1); i <= 3; i++ {
+		assert.True(t, ft.row(i).deleted)
+		assert.False(t, ft.row(i).processed)
+	}
+	assert.Equal(t, `DELETE FROM "outbox" WHERE "id" IN ($1, $2, $3)`, ft.statement(t, "DELETE "))
+}
+
+func TestConsumerHoldingMoreThanBatchSize(t *testing.T) {
+	ft := newFakeTable(5)
+	c := startConsumer(t, AsyncMessageSourceConfig{
+		DB:           ft.db(),
+		Table:        "outbox",
+		BatchSize:    2,
+		PollInterval: 10 * time.Millisecond,
+	})
+
+	// Every row is delivered before any is acknowledged.
+	var held []substrate.Message
+	for i := 1; i <= 5; i++ {
+		select {
+		case m := <-c.msgs:
+			assert.Equal(t, fmt.Sprintf("message-%d", i), string(m.Data()))
+			held = append(held, m)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("stalled after %d messages", len(held))
+		}
+	}
+	for i := 1; i <= 5; i++ {
+		assert.NotNil(t, ft.row(int64(i)).lockedBy, "row %d is not locked", i)
+	}
+
+	for _, m := range held[:3] {
+		c.acks <- m
+	}
+	// The first batch is completed, and the second one is still open.
+	assert.Eventually(t, func() bool {
+		return ft.row(2).processed && ft.row(2).lockedBy == nil
+	}, 5*time.Second, time.Millisecond)
+	assert.False(t, ft.row(3).processed)
+	assert.NotNil(t, ft.row(4).lockedBy)
+
+	for _, m := range held[3:] {
+		c.acks <- m
+	}
+	assert.Eventually(t, func() bool {
+		return ft.row(5).processed
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, context.Canceled, c.stop())
+	for i := int64(1); i <= 5; i++ {
+		assert.True(t, ft.row(i).processed)
+		assert.Nil(t, ft.row(i).lockedBy)
+	}
+}
+
+func TestShutdownCompletesAckedRowsOnly(t *testing.T) {
+	ft := newFakeTable(3)
+	conf := AsyncMessageSourceConfig{
+		DB:           ft.db(),
+		Table:        "outbox",
+		PollInterval: 10 * time.Millisecond,
+	}
+	c := startConsumer(t, conf)
+
+	c.acks <- <-c.msgs
+	<-c.msgs
+	assert.Equal(t, context.Canceled, c.stop())
+
+	assert.True(t, ft.row(1).processed)
+	for i := int64(2); i <= 3; i++ {
+		assert.False(t, ft.row(i).processed)
+		assert.Nil(t, ft.row(i).lockedBy)
+	}
+
+	// The unacknowledged rows are redelivered.
+	c = startConsumer(t, conf)
+	assert.Equal(t, "message-2", string((<-c.msgs).Data()))
+	assert.Equal(t, context.Canceled, c.stop())
+}
+
+func TestInvalidAckRollsBack(t *testing.T) {
+	ft := newFakeTable(2)
+	c := startConsumer(t, AsyncMessageSourceConfig{
+		DB:    ft.db(),
+		Table: "outbox",
+	})
+
+	first := <-c.msgs
+	<-c.msgs
+	other := &consumerMessage{id: int64(1), data: []byte("message-1")}
+	c.acks <- other
+
+	err := <-c.errs
+	assert.Equal(t, substrate.InvalidAckError{Acked: other, Expected: first}, err)
+	for i := int64(1); i <= 2; i++ {
+		assert.False(t, ft.row(i).processed)
+		assert.Nil(t, ft.row(i).lockedBy)
+	}
+}
+
+type ackKey struct{}
+
+type otherMessage []byte
+
+func (m otherMessage) Data() []byte {
+	return m
+}
+
+func TestAckWrappedMessage(t *testing.T) {
+	ft := newFakeTable(2)
+	c := startConsumer(t, AsyncMessageSourceConfig{
+		DB:           ft.db(),
+		Table:        "outbox",
+		PollInterval: 10 * time.Millisecond,
+	})
+
+	for i := 0; i < 2; i++ {
+		c.acks <- substrate.WithValue(<-c.msgs, ackKey{}, i)
+	}
+	assert.Equal(t, context.Canceled, c.stop())
+
+	for i := int64(1); i <= 2; i++ {
+		assert.True(t, ft.row(i).processed)
+	}
+}
+
+func TestMessageID(t *testing.T) {
+	m := &keyedConsumerMessage{consumerMessage: consumerMessage{id: int64(7), data: []byte("message-7")}}
+	id, err := messageID(substrate.WithValue(m, ackKey{}, true))
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), id)
+
+	_, err = messageID(substrate.WithValue(otherMessage("other"), ackKey{}, true))
+	assert.EqualError(t, err, "pgoutbox: unexpected message type pgoutbox.otherMessage")
+}
+
+func TestCompetingConsumersReceiveDistinctRows(t *testing.T) {
+	const rows = 20
+	ft := newFakeTable(rows)
+	conf := AsyncMessageSourceConfig{
+		DB:           ft.db(),
+		Table:        "outbox",
+		BatchSize:    3,
+		PollInterval: 10 * time.Millisecond,
+	}
+
+	var (
+		mu       sync.Mutex
+		received = make(map[int64]int)
+		total    int
+		done     = make(chan struct{})
+	)
+	consumers := []*consumer{startConsumer(t, conf), startConsumer(t, conf)}
+	for _, c := range consumers {
+		go func(c *consumer) {
+			for {
+				select {
+				case m := <-c.msgs:
+					id, err := messageID(m)
+					require.NoError(t, err)
+					mu.Lock()
+					received[id.(int64)]++
+					if total++; total == rows {
+						close(done)
+					}
+					mu.Unlock()
+					select {
+					case c.acks <- m:
+					case <-done:
+					}
+				case <-done:
+					return
+				}
+			}
+		}(c)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for messages")
+	}
+	for _, c := range consumers {
+		assert.Equal(t, context.Canceled, c.stop())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, received, rows)
+	for _, n := range received {
+		assert.Equal(t, 1, n, "row delivered more than once")
+	}
+}
+
+func TestNewAsyncMessageSourceRequiresTable(t *testing.T) {
+	_, err := NewAsyncMessageSource(AsyncMessageSourceConfig{DB: newFakeTable(0).db()})
+	assert.Error(t, err)
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	assert.Equal(t, `"outbox"`, quoteIdentifier("outbox"))
+	assert.Equal(t, `"events"."outbox"`, quoteIdentifier("events.outbox"))
+	assert.Equal(t, `"out""box"`, quoteIdentifier(`out"box`))
+}
@@ -0,0 +1,14 @@
+package pgoutbox
+
+import "github.com/uw-labs/substrate/internal/validate"
+
+// Validate returns an error listing the problems of the config, if any, such
+// as "pgoutbox: AsyncMessageSourceConfig.Table must not be empty". It is
+// called by NewAsyncMessageSource.
+func (c AsyncMessageSourceConfig) Validate() error {
+	p := validate.New("pgoutbox", "AsyncMessageSourceConfig")
+	p.NotEmpty(c.Table, "Table")
+	p.Check(c.DB != nil || c.DSN != "", "DSN", "must not be empty when DB is not set")
+	p.Check(c.NotifyChannel == "" || c.DSN != "", "DSN", "must not be empty when NotifyChannel is set")
+	return p.Err()
+}
@@ -0,0 +1,55 @@
+package pgoutbox
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsyncMessageSourceConfigValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   AsyncMessageSourceConfig
+		expected string
+	}{
+		{
+			name:   "valid with db",
+			config: AsyncMessageSourceConfig{DB: &sql.DB{}, Table: "outbox"},
+		},
+		{
+			name:   "valid with dsn",
+			config: AsyncMessageSourceConfig{DSN: "postgres://localhost/app", Table: "outbox"},
+		},
+		{
+			name:     "no table",
+			config:   AsyncMessageSourceConfig{DB: &sql.DB{}},
+			expected: "pgoutbox: AsyncMessageSourceConfig.Table must not be empty",
+		},
+		{
+			name:     "no db nor dsn",
+			config:   AsyncMessageSourceConfig{Table: "outbox"},
+			expected: "pgoutbox: AsyncMessageSourceConfig.DSN must not be empty when DB is not set",
+		},
+		{
+			name:   "every problem",
+			config: AsyncMessageSourceConfig{},
+			expected: "2 problems: " +
+				"pgoutbox: AsyncMessageSourceConfig.Table must not be empty; " +
+				"pgoutbox: AsyncMessageSourceConfig.DSN must not be empty when DB is not set",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			err := tst.config.Validate()
+			if tst.expected == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tst.expected)
+			_, err = NewAsyncMessageSource(tst.config)
+			assert.EqualError(t, err, tst.expected)
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/uw-labs/sync/rungroup"
+)
+
+// ErrPublishTimeout is the reason passed to the OnTimeout handler of Pipe, and
+// the error Pipe returns without one, when the sink doesn't acknowledge a
+// message within the PerMessageTimeout.
+var ErrPublishTimeout = errors.New("message not acknowledged by the sink within the timeout")
+
+// PipeOptions are the options of Pipe.
+type PipeOptions struct {
+	// Transform, if set, returns the message to publish for each consumed
+	// message. If it returns a nil message, the consumed message is
+	// acknowledged without publishing anything, and if it returns an error,
+	// Pipe terminates with that error.
+	Transform func(Message) (Message, error)
+	// PerMessageTimeout, if set, bounds the time from handing a message to
+	// the sink to its acknowledgement by the sink. Since the consumed
+	// messages are acknowledged in order, a message that is never
+	// acknowledged by the sink would otherwise hold back the acknowledgements
+	// of all the messages after it.
+	PerMessageTimeout time.Duration
+	// OnTimeout is called with the consumed message, and ErrPublishTimeout,
+	// when the sink doesn't acknowledge a message within the
+	// PerMessageTimeout, e.g. to publish it to a dead letter sink. If it
+	// returns nil, the consumed message is acknowledged, and the late
+	// acknowledgement of the sink is ignored, otherwise Pipe terminates with
+	// the returned error. Without it, Pipe terminates with ErrPublishTimeout.
+	OnTimeout MessageErrorHandler
+}
+
+// pipedMessage is a consumed message in flight through a Pipe.
+type pipedMessage struct {
+	consumed  Message
+	published Message
+	// deadline is the time by which the sink must acknowledge the message,
+	// zero if there is no timeout.
+	deadline time.Time
+	// done is set once the consumed message can be acknowledged.
+	done bool
+}
+
+// Pipe consumes messages from source and publishes them to sink, until the
+// context is done or an error occurs. Consumed messages are acknowledged in
+// order, once the sink has acknowledged them and all the messages consumed
+// before them. Pipe doesn't close source or sink.
+func Pipe(ctx context.Context, source AsyncMessageSource, sink AsyncMessageSink, opts PipeOptions) error {
+	rg, ctx := rungroup.New(ctx)
+
+	messages := make(chan Message)
+	acks := make(chan Message)
+	toSink := make(chan Message)
+	sinkAcks := make(chan Message)
+	needAcks := make(chan *pipedMessage, 1024)
+
+	rg.Go(func() error {
+		return source.ConsumeMessages(ctx, messages, acks)
+	})
+	rg.Go(func() error {
+		return sink.PublishMessages(ctx, sinkAcks, toSink)
+	})
+
+	rg.Go(func() error {
+		for {
+			var msg Message
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case msg = <-messages:
+			}
+			pm := &pipedMessage{consumed: msg, published: msg}
+			if opts.Transform != nil {
+				published, err := opts.Transform(msg)
+				if err != nil {
+					return err
+				}
+				pm.published = published
+			}
+			if pm.published == nil {
+				pm.done = true
+			} else if opts.PerMessageTimeout > 0 {
+				pm.deadline = time.Now().Add(opts.PerMessageTimeout)
+			}
+			select {
+			case needAcks <- pm:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if pm.published == nil {
+				continue
+			}
+			select {
+			case toSink <- pm.published:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+
+	rg.Go(func() error {
+		return pipeAcks(ctx, opts.OnTimeout, needAcks, sinkAcks, acks)
+	})
+
+	return rg.Wait()
+}
+
+// pipeAcks matches the acknowledgements of the sink to the messages in flight,
+// and acknowledges the consumed messages in order. As all the messages have the
+// same timeout, their deadlines are in the order they were consumed, so a
+// single timer for the oldest message in flight is enough, however many
+// messages are in flight.
+func pipeAcks(ctx context.Context, onTimeout MessageErrorHandler, needAcks <-chan *pipedMessage, sinkAcks <-chan Message, acks chan<- Message) error {
+	// pending are the messages in flight, in the order they were consumed,
+	// and published the ones yet to be acknowledged by the sink, including
+	// those that timed out.
+	var pending, published []*pipedMessage
+	add := func(pm *pipedMessage) {
+		pending = append(pending, pm)
+		if pm.published != nil {
+			published = append(published, pm)
+		}
+	}
+
+	timer := time.NewTimer(time.Hour)
+	stopTimer(timer)
+	// timed is the message the timer is set for.
+	var timed *pipedMessage
+	var timeout <-chan time.Time
+
+	for {
+		// Acknowledge the messages that are done, up to the first one that
+		// isn't, and wait for the deadline of that one.
+		for len(pending) > 0 && pending[0].done {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case acks <- pending[0].consumed:
+			}
+			pending[0] = nil
+			pending = pending[1:]
+		}
+		var oldest *pipedMessage
+		if len(pending) > 0 && !pending[0].deadline.IsZero() {
+			oldest = pending[0]
+		}
+		if oldest != timed {
+			stopTimer(timer)
+			timed, timeout = oldest, nil
+			if oldest != nil {
+				timer.Reset(time.Until(oldest.deadline))
+				timeout = timer.C
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case pm := <-needAcks:
+			add(pm)
+		case ack := <-sinkAcks:
+			// The sink acknowledges a message after it is added, but it
+			// may still be buffered.
+		drain:
+			for {
+				select {
+				case pm := <-needAcks:
+					add(pm)
+				default:
+					break drain
+				}
+			}
+			if len(published) == 0 || !SameMessage(ack, published[0].published) {
+				var expected Message
+				if len(published) > 0 {
+					expected = published[0].published
+				}
+				return InvalidAckError{Acked: ack, Expected: expected}
+			}
+			published[0].done = true
+			published[0] = nil
+			published = published[1:]
+		case <-timeout:
+			// The timer is not set again for the same message.
+			timeout = nil
+			pm := timed
+			if onTimeout == nil {
+				return ErrPublishTimeout
+			}
+			if err := onTimeout(pm.consumed, ErrPublishTimeout); err != nil {
+				return err
+			}
+			pm.done = true
+		}
+	}
+}
+
+// stopTimer stops the timer and drains its channel if it had fired, so that it
+// can be reset.
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipe(t *testing.T) {
+	a, skipped, b := message("a"), message("skipped"), message("b")
+	source := newStreamingAsyncSource(&a, &skipped, &b)
+	sink := newRecordingAsyncSink()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- Pipe(ctx, source, sink, PipeOptions{
+			Transform: func(msg Message) (Message, error) {
+				if string(msg.Data()) == "skipped" {
+					return nil, nil
+				}
+				m := message(strings.ToUpper(string(msg.Data())))
+				return &m, nil
+			},
+			PerMessageTimeout: time.Minute,
+		})
+	}()
+
+	assert.Equal(t, "A", string((<-sink.published).Data()))
+	assert.Equal(t, "B", string((<-sink.published).Data()))
+	for _, m := range []Message{&a, &skipped, &b} {
+		assert.Equal(t, m, <-source.acked)
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+func TestPipeTransformError(t *testing.T) {
+	a := message("a")
+	source := newStreamingAsyncSource(&a)
+
+	failure := errors.New("transform failed")
+	err := Pipe(context.Background(), source, newRecordingAsyncSink(), PipeOptions{
+		Transform: func(Message) (Message, error) { return nil, failure },
+	})
+	assert.Equal(t, failure, err)
+}
+
+func TestPipeTimeout(t *testing.T) {
+	a := message("a")
+	source := newStreamingAsyncSource(&a)
+	sink := &gatedAsyncSink{release: make(chan struct{})}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	err := Pipe(ctx, source, sink, PipeOptions{PerMessageTimeout: 50 * time.Millisecond})
+	assert.Equal(t, ErrPublishTimeout, err)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	assert.Empty(t, source.acked)
+}
+
+func TestPipeOnTimeout(t *testing.T) {
+	a, b := message("a"), message("b")
+	source := newStreamingAsyncSource(&a, &b)
+	sink := &gatedAsyncSink{release: make(chan struct{})}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	timedOut := make(chan Message, 2)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- Pipe(ctx, source, sink, PipeOptions{
+			PerMessageTimeout: 50 * time.Millisecond,
+			OnTimeout: func(msg Message, err error) error {
+				assert.Equal(t, ErrPublishTimeout, err)
+				timedOut <- msg
+				return nil
+			},
+		})
+	}()
+
+	// Both messages are stuck in the sink, and are acknowledged once they
+	// time out.
+	for _, m := range []Message{&a, &b} {
+		assert.Equal(t, m, <-timedOut)
+		assert.Equal(t, m, <-source.acked)
+	}
+
+	// The late acknowledgements of the sink are ignored.
+	sink.release <- struct{}{}
+	sink.release <- struct{}{}
+	c := message("c")
+	source.toSend <- &c
+	sink.release <- struct{}{}
+	require.Equal(t, &c, <-source.acked)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+// countingAsyncSource delivers n messages, without waiting for them to be
+// acknowledged, and closes done once they all are.
+type countingAsyncSource struct {
+	n    int
+	done chan struct{}
+}
+
+func (s *countingAsyncSource) ConsumeMessages(ctx context.Context, messages chan<- Message, acks <-chan Message) error {
+	msg := message("benchmark")
+	sent, acked := 0, 0
+	for {
+		out := messages
+		if sent == s.n {
+			out = nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case out <- &msg:
+			sent++
+		case <-acks:
+			if acked++; acked == s.n {
+				close(s.done)
+			}
+		}
+	}
+}
+
+func (s *countingAsyncSource) Close() error {
+	return nil
+}
+
+func (s *countingAsyncSource) Status() (*Status, error) {
+	return &Status{Working: true}, nil
+}
+
+// ackingAsyncSink acknowledges every message straight away.
+type ackingAsyncSink struct{}
+
+func (ackingAsyncSink) PublishMessages(ctx context.Context, acks chan<- Message, messages <-chan Message) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m := <-messages:
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case acks <- m:
+			}
+		}
+	}
+}
+
+func (ackingAsyncSink) Close() error {
+	return nil
+}
+
+func (ackingAsyncSink) Status() (*Status, error) {
+	return &Status{Working: true}, nil
+}
+
+func BenchmarkPipe(b *testing.B) {
+	for _, bm := range []struct {
+		name    string
+		timeout time.Duration
+	}{
+		{"without timeout", 0},
+		{"with timeout", time.Minute},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			source := &countingAsyncSource{n: b.N, done: make(chan struct{})}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			b.ResetTimer()
+			go func() {
+				_ = Pipe(ctx, source, ackingAsyncSink{}, PipeOptions{PerMessageTimeout: bm.timeout})
+			}()
+			<-source.done
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package substrate
+
+import (
+	"context"
+	"io"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/uw-labs/sync/rungroup"
+)
+
+// PrioritySourceOptions is the configuration parameters for a priority
+// source.
+type PrioritySourceOptions struct {
+	// LowPriorityQuota, if positive, is the number of consecutive high
+	// priority messages after which a waiting low priority message is
+	// delivered, so that the low priority source is not starved entirely.
+	// When zero, low priority messages are only delivered while the high
+	// priority source has no messages available.
+	LowPriorityQuota int
+}
+
+// NewPrioritySource returns a source that merges the messages of high and low,
+// delivering messages from high whenever they are available, and messages from
+// low only while high is idle, or as allowed by the LowPriorityQuota option.
+// Acknowledgements are passed on to the source that each message came from,
+// in order. When Close is called on the returned source, this is also
+// propagated to both sources.
+func NewPrioritySource(high, low AsyncMessageSource, opts PrioritySourceOptions) AsyncMessageSource {
+	return &prioritySource{
+		high: high,
+		low:  low,
+		opts: opts,
+	}
+}
+
+type prioritySource struct {
+	high AsyncMessageSource
+	low  AsyncMessageSource
+	opts PrioritySourceOptions
+}
+
+// priorityMessage is a delivered message along with the source it came from.
+type priorityMessage struct {
+	msg  Message
+	high bool
+}
+
+func (s *prioritySource) ConsumeMessages(ctx context.Context, messages chan<- Message, acks <-chan Message) error {
+	rg, ctx := rungroup.New(ctx)
+
+	fromHigh := make(chan Message, cap(messages))
+	toHigh := make(chan Message, cap(acks))
+	fromLow := make(chan Message, cap(messages))
+	toLow := make(chan Message, cap(acks))
+	needAcks := make(chan priorityMessage, 1024)
+
+	rg.Go(func() error {
+		return s.high.ConsumeMessages(ctx, fromHigh, toHigh)
+	})
+	rg.Go(func() error {
+		return s.low.ConsumeMessages(ctx, fromLow, toLow)
+	})
+
+	rg.Go(func() error {
+		// deliver sends a message, and then queues it for acknowledgement.
+		// The acknowledgement can't be read before it is queued, as this is
+		// the only goroutine queueing messages.
+		deliver := func(pm priorityMessage) error {
+			select {
+			case messages <- pm.msg:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			select {
+			case needAcks <- pm:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		// waiting is a low priority message that has been received but
+		// not delivered yet, as high priority messages take precedence.
+		var waiting Message
+		var highStreak int
+		for {
+			if s.opts.LowPriorityQuota > 0 && highStreak >= s.opts.LowPriorityQuota {
+				if waiting == nil {
+					select {
+					case waiting = <-fromLow:
+					default:
+					}
+				}
+				if waiting != nil {
+					if err := deliver(priorityMessage{msg: waiting}); err != nil {
+						return err
+					}
+					waiting, highStreak = nil, 0
+					continue
+				}
+			}
+
+			select {
+			case msg := <-fromHigh:
+				if err := deliver(priorityMessage{msg: msg, high: true}); err != nil {
+					return err
+				}
+				highStreak++
+				continue
+			default:
+			}
+
+			if waiting == nil {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case msg := <-fromHigh:
+					if err := deliver(priorityMessage{msg: msg, high: true}); err != nil {
+						return err
+					}
+					highStreak++
+				case msg := <-fromLow:
+					waiting = msg
+				}
+				continue
+			}
+
+			// Offer the low priority message while high is idle, but
+			// still give precedence to any high priority message arriving
+			// in the meantime.
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case msg := <-fromHigh:
+				if err := deliver(priorityMessage{msg: msg, high: true}); err != nil {
+					return err
+				}
+				highStreak++
+			case messages <- waiting:
+				select {
+				case needAcks <- priorityMessage{msg: waiting}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				waiting, highStreak = nil, 0
+			}
+		}
+	})
+
+	rg.Go(func() error {
+		for {
+			var pm priorityMessage
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case pm = <-needAcks:
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case ack := <-acks:
+				if !SameMessage(ack, pm.msg) {
+					return InvalidAckError{Acked: ack, Expected: pm.msg}
+				}
+			}
+			to := toLow
+			if pm.high {
+				to = toHigh
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case to <- pm.msg:
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+// Close closes both underlying sources.
+func (s *prioritySource) Close() (err error) {
+	for _, closer := range []io.Closer{s.high, s.low} {
+		err = multierror.Append(err, closer.Close()).ErrorOrNil()
+	}
+	return err
+}
+
+// Status returns the combined status of both underlying sources, which is
+// working only if both of them are.
+func (s *prioritySource) Status() (*Status, error) {
+	return CombinedStatus(s.high, s.low)
+}
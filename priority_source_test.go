@@ -0,0 +1,195 @@
+package substrate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// streamingAsyncSource delivers messages without waiting for the previous ones
+// to be acknowledged, and keeps receiving acknowledgements while it waits to
+// deliver a message.
+type streamingAsyncSource struct {
+	toSend chan Message
+	acked  chan Message
+	closed chan struct{}
+	status *Status
+}
+
+func newStreamingAsyncSource(msgs ...Message) *streamingAsyncSource {
+	s := &streamingAsyncSource{
+		toSend: make(chan Message, 16),
+		acked:  make(chan Message, 16),
+		closed: make(chan struct{}),
+		status: &Status{Working: true},
+	}
+	for _, m := range msgs {
+		s.toSend <- m
+	}
+	return s
+}
+
+func (s *streamingAsyncSource) ConsumeMessages(ctx context.Context, messages chan<- Message, acks <-chan Message) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg := <-s.toSend:
+			for sent := false; !sent; {
+				select {
+				case messages <- msg:
+					sent = true
+				case ack := <-acks:
+					s.acked <- ack
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		case ack := <-acks:
+			s.acked <- ack
+		}
+	}
+}
+
+func (s *streamingAsyncSource) Close() error {
+	close(s.closed)
+	return nil
+}
+
+func (s *streamingAsyncSource) Status() (*Status, error) {
+	return s.status, nil
+}
+
+func consumePriority(ctx context.Context, t *testing.T, source AsyncMessageSource, n int) []Message {
+	msgs := make(chan Message)
+	acks := make(chan Message, n)
+	go func() {
+		_ = source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	var rcvd []Message
+	for i := 0; i < n; i++ {
+		// Give the sources time to have their next messages ready.
+		time.Sleep(10 * time.Millisecond)
+		select {
+		case m := <-msgs:
+			rcvd = append(rcvd, m)
+			acks <- m
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+	}
+	return rcvd
+}
+
+func TestPrioritySourcePrefersHighPriority(t *testing.T) {
+	assert := assert.New(t)
+
+	h1, h2, h3 := message("h1"), message("h2"), message("h3")
+	l1, l2 := message("l1"), message("l2")
+	high := newStreamingAsyncSource(&h1, &h2, &h3)
+	low := newStreamingAsyncSource(&l1, &l2)
+	source := NewPrioritySource(high, low, PrioritySourceOptions{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rcvd := consumePriority(ctx, t, source, 5)
+	assert.Equal([]Message{&h1, &h2, &h3, &l1, &l2}, rcvd)
+
+	// Acknowledgements are routed to the source each message came from.
+	for _, expected := range []Message{&h1, &h2, &h3} {
+		assert.Equal(expected, <-high.acked)
+	}
+	for _, expected := range []Message{&l1, &l2} {
+		assert.Equal(expected, <-low.acked)
+	}
+
+	assert.NoError(source.Close())
+	for _, s := range []*streamingAsyncSource{high, low} {
+		select {
+		case <-s.closed:
+		default:
+			t.Error("underlying async source didn't get closed")
+		}
+	}
+}
+
+func TestPrioritySourceLowPriorityQuota(t *testing.T) {
+	h1, h2, h3, h4, h5 := message("h1"), message("h2"), message("h3"), message("h4"), message("h5")
+	l1, l2 := message("l1"), message("l2")
+	high := newStreamingAsyncSource(&h1, &h2, &h3, &h4, &h5)
+	low := newStreamingAsyncSource(&l1, &l2)
+	source := NewPrioritySource(high, low, PrioritySourceOptions{LowPriorityQuota: 2})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rcvd := consumePriority(ctx, t, source, 7)
+	assert.Equal(t, []Message{&h1, &h2, &l1, &h3, &h4, &l2, &h5}, rcvd)
+}
+
+func TestPrioritySourceInvalidAck(t *testing.T) {
+	h1 := message("h1")
+	source := NewPrioritySource(newStreamingAsyncSource(&h1), newStreamingAsyncSource(), PrioritySourceOptions{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	<-msgs
+	invalid := message("invalid")
+	acks <- &invalid
+	assert.Equal(t, InvalidAckError{Acked: &invalid, Expected: &h1}, <-errs)
+}
+
+func TestPrioritySourceStatus(t *testing.T) {
+	high, low := newStreamingAsyncSource(), newStreamingAsyncSource()
+	source := NewPrioritySource(high, low, PrioritySourceOptions{})
+
+	status, err := source.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, &Status{Working: true}, status)
+
+	low.status = &Status{Working: false, Problems: []string{"low is down"}}
+	status, err = source.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, &Status{Working: false, Problems: []string{"low is down"}}, status)
+
+	// The problems of working components are reported too.
+	high.status = &Status{Working: true, Problems: []string{"high is lagging"}}
+	status, err = source.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, &Status{Working: false, Problems: []string{"high is lagging", "low is down"}}, status)
+
+	low.status = &Status{Working: true}
+	status, err = source.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, &Status{Working: true, Problems: []string{"high is lagging"}}, status)
+}
+
+func TestPrioritySourceStatusLag(t *testing.T) {
+	high, low := newStreamingAsyncSource(), newStreamingAsyncSource()
+	source := NewPrioritySource(high, low, PrioritySourceOptions{})
+
+	highLag, lowLag := int64(3), int64(4)
+	high.status = &Status{Working: true, Lag: &highLag, Details: map[string]string{"topic": "high"}}
+	status, err := source.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), *status.Lag)
+	assert.Equal(t, map[string]string{"topic": "high"}, status.Details)
+
+	low.status = &Status{Working: true, Lag: &lowLag, Details: map[string]string{"topic": "low", "group": "g"}}
+	status, err = source.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), *status.Lag)
+	assert.Equal(t, map[string]string{"topic": "high", "group": "g"}, status.Details)
+}
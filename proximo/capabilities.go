@@ -0,0 +1,175 @@
+package proximo
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Feature is an optional feature of a proximo server.
+type Feature string
+
+const (
+	// FeatureOffsetSelection is the selection of the initial offset of a
+	// consumer group.
+	FeatureOffsetSelection Feature = "consumer-offset-selection"
+	// FeatureCumulativeConfirmation is the confirmation of all the
+	// messages of a consumer stream up to the confirmed one.
+	FeatureCumulativeConfirmation Feature = "cumulative-confirmation"
+)
+
+// featureDescriptions are used in errors and status problems.
+var featureDescriptions = map[Feature]string{
+	FeatureOffsetSelection:        "consumer offset selection",
+	FeatureCumulativeConfirmation: "cumulative confirmation",
+}
+
+const (
+	capabilitiesMethod         = "/proximo.ServerInfo/GetCapabilities"
+	defaultCapabilitiesTimeout = 10 * time.Second
+)
+
+// Capabilities holds the optional features supported by a proximo server.
+type Capabilities struct {
+	// Legacy is set for servers that predate capability detection, which
+	// are assumed not to support any optional feature.
+	Legacy bool
+	// Features holds the features supported by the server.
+	Features map[Feature]bool
+}
+
+// Supports reports whether the server supports the feature.
+func (c Capabilities) Supports(f Feature) bool {
+	return c.Features[f]
+}
+
+// CapabilitiesReporter is implemented by the sources and sinks of this
+// package created with DetectCapabilities set.
+type CapabilitiesReporter interface {
+	// Capabilities returns the capabilities detected when the source or
+	// sink was created.
+	Capabilities() Capabilities
+}
+
+// unsupportedFeatureError returns the error for a configuration option that
+// requires a feature the server doesn't support.
+func unsupportedFeatureError(f Feature) error {
+	return errors.Errorf("server does not support %s", featureDescriptions[f])
+}
+
+// capabilityProblems returns a status problem for each of the relevant
+// features that the server doesn't support.
+func capabilityProblems(caps *Capabilities, relevant ...Feature) []string {
+	if caps == nil {
+		return nil
+	}
+	var problems []string
+	for _, f := range relevant {
+		if !caps.Supports(f) {
+			problems = append(problems, unsupportedFeatureError(f).Error())
+		}
+	}
+	return problems
+}
+
+// detectCapabilities asks the server for its capabilities. Servers that don't
+// implement the capabilities method are reported as legacy servers.
+func detectCapabilities(ctx context.Context, conn *grpc.ClientConn) (*Capabilities, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultCapabilitiesTimeout)
+	defer cancel()
+
+	var features []string
+	err := conn.Invoke(ctx, capabilitiesMethod, capabilitiesRequest{}, &features, grpc.ForceCodec(capabilitiesCodec{}))
+	switch {
+	case status.Code(err) == codes.Unimplemented:
+		return &Capabilities{Legacy: true, Features: map[Feature]bool{}}, nil
+	case err != nil:
+		return nil, errors.Wrap(err, "failed to detect proximo server capabilities")
+	}
+
+	caps := &Capabilities{Features: make(map[Feature]bool, len(features))}
+	for _, f := range features {
+		caps.Features[Feature(f)] = true
+	}
+	return caps, nil
+}
+
+// capabilitiesRequest is the empty request of the capabilities method.
+type capabilitiesRequest struct{}
+
+// capabilitiesCodec encodes the capabilities request and decodes the
+// response, a protobuf message with the supported features as a repeated
+// string in field 1, without depending on generated code.
+type capabilitiesCodec struct{}
+
+func (capabilitiesCodec) Marshal(v interface{}) ([]byte, error) {
+	if _, ok := v.(capabilitiesRequest); !ok {
+		return nil, errors.Errorf("unexpected capabilities request type %T", v)
+	}
+	return []byte{}, nil
+}
+
+func (capabilitiesCodec) Unmarshal(data []byte, v interface{}) error {
+	features, ok := v.(*[]string)
+	if !ok {
+		return errors.Errorf("unexpected capabilities response type %T", v)
+	}
+	for len(data) > 0 {
+		key, n := decodeVarint(data)
+		if n == 0 {
+			return errInvalidCapabilities
+		}
+		data = data[n:]
+
+		field, wireType := key>>3, key&7
+		switch wireType {
+		case 0:
+			_, n = decodeVarint(data)
+		case 1:
+			n = 8
+		case 2:
+			size, sn := decodeVarint(data)
+			if sn == 0 || size > uint64(len(data)-sn) {
+				return errInvalidCapabilities
+			}
+			if field == 1 {
+				*features = append(*features, string(data[sn:sn+int(size)]))
+			}
+			n = sn + int(size)
+		case 5:
+			n = 4
+		default:
+			return errInvalidCapabilities
+		}
+		if n == 0 || n > len(data) {
+			return errInvalidCapabilities
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// Name returns proto, as the messages are protobuf encoded.
+func (capabilitiesCodec) Name() string {
+	return "proto"
+}
+
+var errInvalidCapabilities = errors.New("invalid capabilities response")
+
+// decodeVarint decodes a protobuf varint, returning the number of bytes read,
+// which is zero if the data is not a valid varint.
+func decodeVarint(data []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(data) && i < 10; i++ {
+		b := data[i]
+		v |= uint64(b&0x7f) << (7 * uint(i))
+		if b < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,43 @@
+package proximo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapabilitiesCodec(t *testing.T) {
+	codec := capabilitiesCodec{}
+
+	req, err := codec.Marshal(capabilitiesRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, req)
+
+	// Field 1 holds the features, field 2 is an unknown varint field.
+	data := []byte{0x0a, 0x19}
+	data = append(data, "consumer-offset-selection"...)
+	data = append(data, 0x10, 0x96, 0x01, 0x0a, 0x04)
+	data = append(data, "keys"...)
+
+	var features []string
+	require.NoError(t, codec.Unmarshal(data, &features))
+	assert.Equal(t, []string{"consumer-offset-selection", "keys"}, features)
+
+	assert.Equal(t, errInvalidCapabilities, codec.Unmarshal([]byte{0x0a, 0x05, 'a'}, &features))
+	assert.Equal(t, errInvalidCapabilities, codec.Unmarshal([]byte{0x80}, &features))
+}
+
+func TestCapabilityProblems(t *testing.T) {
+	assert.Empty(t, capabilityProblems(nil, FeatureOffsetSelection))
+
+	supported := &Capabilities{Features: map[Feature]bool{FeatureOffsetSelection: true}}
+	assert.Empty(t, capabilityProblems(supported, FeatureOffsetSelection))
+
+	legacy := &Capabilities{Legacy: true}
+	assert.False(t, legacy.Supports(FeatureOffsetSelection))
+	assert.Equal(t,
+		[]string{"server does not support consumer offset selection"},
+		capabilityProblems(legacy, FeatureOffsetSelection),
+	)
+}
@@ -0,0 +1,119 @@
+package proximo
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// ConnPool shares gRPC connections between the sources and sinks created with
+// the pool set on their configs, with the same broker and connection options.
+// Since ClientName defaults to a name derived from the topic, and is sent as
+// the user agent of the connection, it must be set for sources or sinks of
+// different topics to share a connection. Connections are reference counted,
+// so closing a source or sink doesn't affect the others, and a connection is
+// closed once all the sources and sinks using it are closed. A pool is safe
+// for concurrent use.
+type ConnPool struct {
+	mu    sync.Mutex
+	conns map[connKey]*pooledConn
+}
+
+// NewConnPool returns a new, empty, connection pool.
+func NewConnPool() *ConnPool {
+	return &ConnPool{conns: make(map[connKey]*pooledConn)}
+}
+
+// connKey identifies the connections that can be shared.
+type connKey struct {
+	broker         string
+	insecure       bool
+	keepAlive      bool
+	keepAliveTime  time.Duration
+	keepAliveTO    time.Duration
+	maxRecvMsgSize int
+	maxSendMsgSize int
+	userAgent      string
+}
+
+func newConnKey(conf dialConfig) connKey {
+	key := connKey{
+		broker:         conf.broker,
+		insecure:       conf.insecure,
+		maxRecvMsgSize: conf.maxRecvMsgSize,
+		maxSendMsgSize: conf.maxSendMsgSize,
+		userAgent:      conf.userAgent,
+	}
+	if key.maxRecvMsgSize <= 0 {
+		key.maxRecvMsgSize = defaultMaxRecvMsgSize
+	}
+	if conf.keepAlive != nil {
+		key.keepAlive = true
+		key.keepAliveTime = conf.keepAlive.Time
+		key.keepAliveTO = conf.keepAlive.Timeout
+	}
+	return key
+}
+
+type pooledConn struct {
+	conn *grpc.ClientConn
+	refs int
+}
+
+// acquire returns a connection for the dial config, which is dialled if the
+// pool holds none, and a function releasing the reference to it.
+func (p *ConnPool) acquire(conf dialConfig) (*grpc.ClientConn, func() error, error) {
+	key := newConnKey(conf)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pc, ok := p.conns[key]
+	if !ok {
+		conn, err := proximoDialer(conf)
+		if err != nil {
+			return nil, nil, err
+		}
+		pc = &pooledConn{conn: conn}
+		p.conns[key] = pc
+	}
+	pc.refs++
+
+	var once sync.Once
+	var err error
+	return pc.conn, func() error {
+		once.Do(func() {
+			err = p.release(key)
+		})
+		return err
+	}, nil
+}
+
+// release drops a reference to the connection for the key, which is closed
+// once it is no longer referenced.
+func (p *ConnPool) release(key connKey) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pc := p.conns[key]
+	pc.refs--
+	if pc.refs > 0 {
+		return nil
+	}
+	delete(p.conns, key)
+	return pc.conn.Close()
+}
+
+// dial returns a connection from the pool if it is set, or a new one, and a
+// function closing it.
+func dial(pool *ConnPool, conf dialConfig) (*grpc.ClientConn, func() error, error) {
+	if pool == nil {
+		conn, err := proximoDialer(conf)
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, conn.Close, nil
+	}
+	return pool.acquire(conf)
+}
@@ -0,0 +1,44 @@
+package proximo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+func TestConnPoolSharesConnections(t *testing.T) {
+	var dialed []*grpc.ClientConn
+	proximoDialer = func(conf dialConfig) (*grpc.ClientConn, error) {
+		conn, err := grpc.Dial(conf.broker, grpc.WithInsecure())
+		dialed = append(dialed, conn)
+		return conn, err
+	}
+	defer func() { proximoDialer = dialProximo }()
+
+	pool := NewConnPool()
+	sink, err := NewAsyncMessageSink(AsyncMessageSinkConfig{Broker: "localhost:123", Topic: "orders", ClientName: "billing", ConnPool: pool})
+	require.NoError(t, err)
+	source, err := NewAsyncMessageSource(AsyncMessageSourceConfig{Broker: "localhost:123", Topic: "payments", ConsumerGroup: "billing", ClientName: "billing", ConnPool: pool})
+	require.NoError(t, err)
+	require.Len(t, dialed, 1)
+
+	// Different connection options require a separate connection.
+	other, err := NewAsyncMessageSink(AsyncMessageSinkConfig{Broker: "localhost:123", Topic: "orders", ClientName: "billing", Insecure: true, ConnPool: pool})
+	require.NoError(t, err)
+	require.Len(t, dialed, 2)
+
+	// The connection is closed once the last source or sink using it is.
+	require.NoError(t, sink.Close())
+	require.NoError(t, sink.Close())
+	assert.NotEqual(t, connectivity.Shutdown, dialed[0].GetState())
+	require.NoError(t, source.Close())
+	assert.Equal(t, connectivity.Shutdown, dialed[0].GetState())
+	assert.NotEqual(t, connectivity.Shutdown, dialed[1].GetState())
+
+	require.NoError(t, other.Close())
+	assert.Equal(t, connectivity.Shutdown, dialed[1].GetState())
+	assert.Empty(t, pool.conns)
+}
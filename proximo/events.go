@@ -0,0 +1,198 @@
+package proximo
+
+import (
+	"sync"
+	"time"
+
+	"github.com/uw-labs/substrate"
+)
+
+// EventType identifies the kind of a connection Event.
+type EventType int
+
+const (
+	// EventConnected is emitted when the first stream to proximo is established.
+	EventConnected EventType = iota + 1
+	// EventDisconnected is emitted when the stream to proximo fails. The
+	// event carries the error that terminated the stream.
+	EventDisconnected
+	// EventRetrying is emitted before every reconnect attempt. The event
+	// carries the attempt number and the backoff waited before the attempt.
+	EventRetrying
+	// EventResumed is emitted when a stream is re-established after a
+	// disconnection.
+	EventResumed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConnected:
+		return "connected"
+	case EventDisconnected:
+		return "disconnected"
+	case EventRetrying:
+		return "retrying"
+	case EventResumed:
+		return "resumed"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes a change in the state of the stream to proximo.
+type Event struct {
+	Type EventType
+	// Time is when the event occurred.
+	Time time.Time
+	// Err is the error that terminated the stream, for EventDisconnected.
+	Err error
+	// Attempt is the number of consecutive reconnect attempts, starting
+	// from 1, for EventRetrying and EventResumed.
+	Attempt int
+	// Backoff is the delay before the reconnect attempt, for EventRetrying.
+	Backoff time.Duration
+	// Dropped is the total number of events dropped so far because the
+	// Events callback did not keep up.
+	Dropped uint64
+}
+
+// Reconnect provides configuration for re-establishing the stream to proximo
+// when it fails.
+type Reconnect struct {
+	// Backoff is the delay before the first reconnect attempt, doubling for
+	// each subsequent attempt.
+	Backoff time.Duration
+	// MaxBackoff caps the exponential backoff. Defaults to 30s.
+	MaxBackoff time.Duration
+	// MaxAttempts is the maximum number of consecutive failed reconnect
+	// attempts before giving up. Zero means no limit.
+	MaxAttempts int
+}
+
+const (
+	defaultReconnectBackoff    = 100 * time.Millisecond
+	defaultMaxReconnectBackoff = 30 * time.Second
+	defaultEventBufferSize     = 64
+)
+
+// backoff returns the delay before the given reconnect attempt.
+func (r *Reconnect) backoff(attempt int) time.Duration {
+	backoff, max := r.Backoff, r.MaxBackoff
+	if backoff <= 0 {
+		backoff = defaultReconnectBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxReconnectBackoff
+	}
+	for i := 1; i < attempt && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+// eventEmitter delivers events to a callback without blocking the caller.
+// Events are buffered while the callback is busy, and the oldest buffered
+// event is dropped when the buffer is full.
+type eventEmitter struct {
+	callback func(Event)
+	size     int
+
+	mu          sync.Mutex
+	buffer      []Event
+	dropped     uint64
+	dispatching bool
+}
+
+func newEventEmitter(callback func(Event), size int) *eventEmitter {
+	if callback == nil {
+		return nil
+	}
+	if size <= 0 {
+		size = defaultEventBufferSize
+	}
+	return &eventEmitter{callback: callback, size: size}
+}
+
+// emit queues the event for delivery. It is a no-op on a nil emitter, so
+// that callers don't need to check whether events are enabled.
+func (e *eventEmitter) emit(ev Event) {
+	if e == nil {
+		return
+	}
+	ev.Time = time.Now()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.buffer) == e.size {
+		e.buffer = e.buffer[1:]
+		e.dropped++
+	}
+	ev.Dropped = e.dropped
+	e.buffer = append(e.buffer, ev)
+
+	if !e.dispatching {
+		e.dispatching = true
+		go e.dispatch()
+	}
+}
+
+func (e *eventEmitter) dispatch() {
+	for {
+		e.mu.Lock()
+		if len(e.buffer) == 0 {
+			e.dispatching = false
+			e.mu.Unlock()
+			return
+		}
+		ev := e.buffer[0]
+		e.buffer = e.buffer[1:]
+		e.mu.Unlock()
+
+		e.callback(ev)
+	}
+}
+
+// streamState tracks the lifecycle of consecutive streams to proximo and
+// emits the corresponding events.
+type streamState struct {
+	events    *eventEmitter
+	lifecycle *substrate.LifecycleEmitter
+	reconnect *Reconnect
+
+	connected bool
+	attempts  int
+}
+
+// established records that a stream was opened successfully.
+func (s *streamState) established() {
+	switch {
+	case !s.connected:
+		s.events.emit(Event{Type: EventConnected})
+		s.lifecycle.Emit(substrate.LifecycleEvent{Type: substrate.LifecycleConnected})
+	case s.attempts > 0:
+		s.events.emit(Event{Type: EventResumed, Attempt: s.attempts})
+		s.lifecycle.Emit(substrate.LifecycleEvent{Type: substrate.LifecycleReconnected})
+	}
+	s.connected = true
+	s.attempts = 0
+}
+
+// failed records that a stream failed with err, and returns the delay to wait
+// before reconnecting, or false if the error should be returned instead.
+func (s *streamState) failed(err error) (time.Duration, bool) {
+	if s.connected && s.attempts == 0 {
+		s.events.emit(Event{Type: EventDisconnected, Err: err})
+		s.lifecycle.Emit(substrate.LifecycleEvent{Type: substrate.LifecycleDisconnected, Err: err})
+	}
+	if s.reconnect == nil || (s.reconnect.MaxAttempts > 0 && s.attempts >= s.reconnect.MaxAttempts) {
+		return 0, false
+	}
+	s.attempts++
+	backoff := s.reconnect.backoff(s.attempts)
+	s.events.emit(Event{Type: EventRetrying, Attempt: s.attempts, Backoff: backoff})
+	return backoff, true
+}
@@ -0,0 +1,159 @@
+package proximo
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/substrate"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	r := &Reconnect{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	assert.Equal(t, time.Second, r.backoff(1))
+	assert.Equal(t, 2*time.Second, r.backoff(2))
+	assert.Equal(t, 4*time.Second, r.backoff(3))
+	assert.Equal(t, 5*time.Second, r.backoff(4))
+	assert.Equal(t, 5*time.Second, r.backoff(100))
+
+	r = &Reconnect{}
+	assert.Equal(t, defaultReconnectBackoff, r.backoff(1))
+	assert.Equal(t, defaultMaxReconnectBackoff, r.backoff(100))
+}
+
+func TestEventEmitterDropsOldest(t *testing.T) {
+	block := make(chan struct{})
+	received := make(chan Event, 10)
+	e := newEventEmitter(func(ev Event) {
+		<-block
+		received <- ev
+	}, 2)
+
+	// The first event is taken by the dispatcher, which then blocks.
+	e.emit(Event{Type: EventConnected})
+	require.Eventually(t, func() bool {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return len(e.buffer) == 0
+	}, time.Second, time.Millisecond)
+
+	e.emit(Event{Type: EventDisconnected})
+	e.emit(Event{Type: EventRetrying, Attempt: 1})
+	e.emit(Event{Type: EventRetrying, Attempt: 2})
+	e.emit(Event{Type: EventResumed, Attempt: 2})
+	close(block)
+
+	var events []Event
+	for i := 0; i < 3; i++ {
+		select {
+		case ev := <-received:
+			events = append(events, ev)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+	}
+	assert.Equal(t, EventConnected, events[0].Type)
+	assert.Equal(t, uint64(0), events[0].Dropped)
+	assert.Equal(t, EventRetrying, events[1].Type)
+	assert.Equal(t, 2, events[1].Attempt)
+	assert.Equal(t, uint64(1), events[1].Dropped)
+	assert.Equal(t, EventResumed, events[2].Type)
+	assert.Equal(t, uint64(2), events[2].Dropped)
+}
+
+func TestNilEventEmitter(t *testing.T) {
+	e := newEventEmitter(nil, 0)
+	assert.Nil(t, e)
+	e.emit(Event{Type: EventConnected})
+}
+
+func TestStreamState(t *testing.T) {
+	received := make(chan Event, 10)
+	s := streamState{
+		events:    newEventEmitter(func(ev Event) { received <- ev }, 0),
+		reconnect: &Reconnect{Backoff: time.Second, MaxAttempts: 2},
+	}
+	next := func() Event {
+		select {
+		case ev := <-received:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for event")
+			return Event{}
+		}
+	}
+	failure := errors.New("stream failed")
+
+	s.established()
+	assert.Equal(t, EventConnected, next().Type)
+
+	backoff, ok := s.failed(failure)
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, backoff)
+	ev := next()
+	assert.Equal(t, EventDisconnected, ev.Type)
+	assert.Equal(t, failure, ev.Err)
+	ev = next()
+	assert.Equal(t, EventRetrying, ev.Type)
+	assert.Equal(t, 1, ev.Attempt)
+	assert.Equal(t, time.Second, ev.Backoff)
+
+	// A failed reconnect attempt doesn't emit another disconnection.
+	backoff, ok = s.failed(failure)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Second, backoff)
+	ev = next()
+	assert.Equal(t, EventRetrying, ev.Type)
+	assert.Equal(t, 2, ev.Attempt)
+
+	s.established()
+	ev = next()
+	assert.Equal(t, EventResumed, ev.Type)
+	assert.Equal(t, 2, ev.Attempt)
+
+	// The attempts are reset after resuming.
+	_, ok = s.failed(failure)
+	assert.True(t, ok)
+	assert.Equal(t, EventDisconnected, next().Type)
+	assert.Equal(t, 1, next().Attempt)
+	_, ok = s.failed(failure)
+	assert.True(t, ok)
+	next()
+	_, ok = s.failed(failure)
+	assert.False(t, ok)
+}
+
+func TestStreamStateWithoutReconnect(t *testing.T) {
+	s := streamState{}
+	s.established()
+	_, ok := s.failed(errors.New("stream failed"))
+	assert.False(t, ok)
+}
+
+func TestStreamStateLifecycleEvents(t *testing.T) {
+	lifecycle := make(chan substrate.LifecycleEvent, 10)
+	s := streamState{
+		lifecycle: substrate.NewLifecycleEmitter(lifecycle, "proximo", "topic"),
+		reconnect: &Reconnect{Backoff: time.Second},
+	}
+	failure := errors.New("stream failed")
+
+	s.established()
+	_, _ = s.failed(failure)
+	_, _ = s.failed(failure)
+	s.established()
+
+	close(lifecycle)
+	var types []substrate.LifecycleEventType
+	for ev := range lifecycle {
+		assert.Equal(t, "proximo", ev.Backend)
+		types = append(types, ev.Type)
+	}
+	assert.Equal(t, []substrate.LifecycleEventType{
+		substrate.LifecycleConnected,
+		substrate.LifecycleDisconnected,
+		substrate.LifecycleReconnected,
+	}, types)
+}
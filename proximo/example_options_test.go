@@ -0,0 +1,80 @@
+package proximo_test
+
+import (
+	"log"
+	"os"
+
+	"github.com/uw-labs/substrate/proximo"
+)
+
+// A sink created from a config struct:
+//
+//      sink, err := proximo.NewAsyncMessageSink(proximo.AsyncMessageSinkConfig{
+//          Broker:   "localhost:6868",
+//          Topic:    "invoices",
+//          Insecure: true,
+//      })
+//
+// is created with options as follows.
+func ExampleNewSink() {
+	sink, err := proximo.NewSink(
+		proximo.WithBroker("localhost:6868"),
+		proximo.WithTopic("invoices"),
+		proximo.WithInsecure(),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sink.Close()
+}
+
+// A source created from a config struct:
+//
+//      source, err := proximo.NewAsyncMessageSource(proximo.AsyncMessageSourceConfig{
+//          Broker:        "localhost:6868",
+//          Topic:         "invoices",
+//          ConsumerGroup: "billing",
+//          Offset:        proximo.OffsetOldest,
+//          Insecure:      true,
+//      })
+//
+// is created with options as follows.
+func ExampleNewSource() {
+	source, err := proximo.NewSource(
+		proximo.WithBroker("localhost:6868"),
+		proximo.WithTopic("invoices"),
+		proximo.WithConsumerGroup("billing"),
+		proximo.WithOffset(proximo.OffsetOldest),
+		proximo.WithInsecure(),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer source.Close()
+}
+
+// The settings of an environment are given to Overrides, on top of the ones
+// shared by every environment. WithCredentials replaces WithInsecure, which
+// it would conflict with otherwise.
+func ExampleOverrides() {
+	opts := []proximo.Option{
+		proximo.WithBroker("localhost:6868"),
+		proximo.WithTopic("invoices"),
+		proximo.WithInsecure(),
+	}
+	if os.Getenv("ENVIRONMENT") == "production" {
+		opts = append(opts, proximo.Overrides(
+			proximo.WithBroker("proximo.prod:443"),
+			proximo.WithCredentials(&proximo.Credentials{
+				ClientID: os.Getenv("PROXIMO_CLIENT_ID"),
+				Secret:   os.Getenv("PROXIMO_SECRET"),
+			}),
+		))
+	}
+
+	sink, err := proximo.NewSink(opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sink.Close()
+}
@@ -0,0 +1,81 @@
+//go:build faults
+// +build faults
+
+package proximo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/Shopify/toxiproxy"
+	"github.com/sirupsen/logrus"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/testshared"
+)
+
+// faultProxyPort is the port of the proxy in front of the proximo server.
+const faultProxyPort = 16868
+
+func TestFaults(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	ts, err := runServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Kill()
+
+	proxy := toxiproxy.NewProxy()
+	proxy.Name = "proximo"
+	proxy.Listen = fmt.Sprintf("localhost:%d", faultProxyPort)
+	proxy.Upstream = fmt.Sprintf("localhost:%d", ts.port)
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Stop()
+
+	testshared.TestFaults(t, &faultServer{proxy: proxy})
+}
+
+// faultServer creates sources and sinks that connect through the proxy, and
+// that reconnect when their stream fails.
+type faultServer struct {
+	proxy *toxiproxy.Proxy
+}
+
+func (fs *faultServer) Proxy() *toxiproxy.Proxy {
+	return fs.proxy
+}
+
+func (fs *faultServer) NewConsumer(topic string, groupID string) substrate.AsyncMessageSource {
+	s, err := NewAsyncMessageSource(AsyncMessageSourceConfig{
+		Broker:        fs.proxy.Listen,
+		ConsumerGroup: groupID,
+		Topic:         topic,
+		Offset:        OffsetOldest,
+		Insecure:      true,
+		Reconnect:     &Reconnect{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func (fs *faultServer) NewProducer(topic string) substrate.AsyncMessageSink {
+	s, err := NewAsyncMessageSink(AsyncMessageSinkConfig{
+		Broker:    fs.proxy.Listen,
+		Topic:     topic,
+		Insecure:  true,
+		Reconnect: &Reconnect{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func (fs *faultServer) TestEnd() {}
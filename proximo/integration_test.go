@@ -45,6 +45,34 @@ func (ts *testServer) NewConsumer(topic string, groupID string) substrate.AsyncM
 	return s
 }
 
+func (ts *testServer) NewConsumerWithEvents(topic string, groupID string, events chan<- substrate.LifecycleEvent) substrate.AsyncMessageSource {
+	s, err := NewAsyncMessageSource(AsyncMessageSourceConfig{
+		Broker:          fmt.Sprintf("localhost:%d", ts.port),
+		ConsumerGroup:   groupID,
+		Topic:           topic,
+		Offset:          OffsetOldest,
+		Insecure:        true,
+		LifecycleEvents: events,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func (ts *testServer) NewProducerWithEvents(topic string, events chan<- substrate.LifecycleEvent) substrate.AsyncMessageSink {
+	s, err := NewAsyncMessageSink(AsyncMessageSinkConfig{
+		Broker:          fmt.Sprintf("localhost:%d", ts.port),
+		Topic:           topic,
+		Insecure:        true,
+		LifecycleEvents: events,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
 func (ts *testServer) NewProducer(topic string) substrate.AsyncMessageSink {
 	s, err := NewAsyncMessageSink(AsyncMessageSinkConfig{
 		Broker:   fmt.Sprintf("localhost:%d", ts.port),
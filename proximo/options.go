@@ -0,0 +1,322 @@
+package proximo
+
+import (
+	"time"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/options"
+)
+
+// Option is a functional option of a sink or a source, an alternative to
+// setting the fields of their config structs, see NewSink and NewSource.
+// Options shared by sinks and sources, such as WithBroker, can be given to
+// either. Options are order-independent: an option conflicts with itself, and
+// with options setting the same fields, such as WithInsecure and
+// WithCredentials, unless it is given to Overrides. A nil Option is ignored,
+// so that options can be chosen conditionally.
+type Option func(*settings)
+
+type settings []options.Setting
+
+func (s *settings) add(opts []Option) {
+	for _, opt := range opts {
+		if opt != nil {
+			opt(s)
+		}
+	}
+}
+
+// setting returns an option setting the group of fields of a sink config with
+// sink, and of a source config with source, either of which is nil if the
+// option doesn't apply to it.
+func setting(option, group string, sink func(*AsyncMessageSinkConfig), source func(*AsyncMessageSourceConfig)) Option {
+	return func(s *settings) {
+		*s = append(*s, options.Setting{
+			Option: option,
+			Group:  group,
+			Apply: func(conf interface{}) bool {
+				switch c := conf.(type) {
+				case *AsyncMessageSinkConfig:
+					if sink != nil {
+						sink(c)
+						return true
+					}
+				case *AsyncMessageSourceConfig:
+					if source != nil {
+						source(c)
+						return true
+					}
+				}
+				return false
+			},
+		})
+	}
+}
+
+// Overrides returns an option giving precedence to opts over the other
+// options setting the same fields, e.g. for the settings of an environment
+// on top of the ones shared by every environment:
+//
+//      opts := []proximo.Option{proximo.WithBroker("localhost:6868"), proximo.WithInsecure()}
+//      if env == "production" {
+//          opts = append(opts, proximo.Overrides(proximo.WithBroker(broker), proximo.WithCredentials(creds)))
+//      }
+//
+// The options given to Overrides still conflict with each other.
+func Overrides(opts ...Option) Option {
+	return func(s *settings) {
+		var overrides settings
+		overrides.add(opts)
+		for i := range overrides {
+			overrides[i].Override = true
+		}
+		*s = append(*s, overrides...)
+	}
+}
+
+// NewSinkConfig returns the config of a sink set by opts, e.g. to set the
+// fields that have no option before calling NewAsyncMessageSink. It returns an
+// error listing the options that conflict, or are not options of a sink.
+func NewSinkConfig(opts ...Option) (AsyncMessageSinkConfig, error) {
+	var s settings
+	s.add(opts)
+	var c AsyncMessageSinkConfig
+	err := options.Resolve("proximo", &c, s)
+	return c, err
+}
+
+// NewSourceConfig returns the config of a source set by opts, e.g. to set the
+// fields that have no option before calling NewAsyncMessageSource. It returns
+// an error listing the options that conflict, or are not options of a source.
+func NewSourceConfig(opts ...Option) (AsyncMessageSourceConfig, error) {
+	var s settings
+	s.add(opts)
+	var c AsyncMessageSourceConfig
+	err := options.Resolve("proximo", &c, s)
+	return c, err
+}
+
+// NewSink returns a new sink configured by opts, see NewAsyncMessageSink.
+func NewSink(opts ...Option) (substrate.AsyncMessageSink, error) {
+	c, err := NewSinkConfig(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewAsyncMessageSink(c)
+}
+
+// NewSource returns a new source configured by opts, see
+// NewAsyncMessageSource.
+func NewSource(opts ...Option) (substrate.AsyncMessageSource, error) {
+	c, err := NewSourceConfig(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewAsyncMessageSource(c)
+}
+
+// WithBroker sets the Broker of a sink or a source.
+func WithBroker(broker string) Option {
+	return setting("WithBroker", "Broker",
+		func(c *AsyncMessageSinkConfig) { c.Broker = broker },
+		func(c *AsyncMessageSourceConfig) { c.Broker = broker },
+	)
+}
+
+// WithTopic sets the Topic of a sink or a source.
+func WithTopic(topic string) Option {
+	return setting("WithTopic", "Topic",
+		func(c *AsyncMessageSinkConfig) { c.Topic = topic },
+		func(c *AsyncMessageSourceConfig) { c.Topic = topic },
+	)
+}
+
+// WithNamespace sets the Namespace of a sink or a source.
+func WithNamespace(namespace string) Option {
+	return setting("WithNamespace", "Namespace",
+		func(c *AsyncMessageSinkConfig) { c.Namespace = namespace },
+		func(c *AsyncMessageSourceConfig) { c.Namespace = namespace },
+	)
+}
+
+// WithInsecure sets Insecure on a sink or a source. It conflicts with
+// WithCredentials, as the credentials would be sent in plain text.
+func WithInsecure() Option {
+	return setting("WithInsecure", "security",
+		func(c *AsyncMessageSinkConfig) { c.Insecure = true },
+		func(c *AsyncMessageSourceConfig) { c.Insecure = true },
+	)
+}
+
+// WithCredentials sets the Credentials of a sink or a source. It conflicts
+// with WithInsecure.
+func WithCredentials(creds *Credentials) Option {
+	return setting("WithCredentials", "security",
+		func(c *AsyncMessageSinkConfig) { c.Credentials = creds },
+		func(c *AsyncMessageSourceConfig) { c.Credentials = creds },
+	)
+}
+
+// WithKeepAlive sets the KeepAlive of a sink or a source.
+func WithKeepAlive(ka *KeepAlive) Option {
+	return setting("WithKeepAlive", "KeepAlive",
+		func(c *AsyncMessageSinkConfig) { c.KeepAlive = ka },
+		func(c *AsyncMessageSourceConfig) { c.KeepAlive = ka },
+	)
+}
+
+// WithReconnect sets the Reconnect policy of a sink or a source.
+func WithReconnect(r *Reconnect) Option {
+	return setting("WithReconnect", "Reconnect",
+		func(c *AsyncMessageSinkConfig) { c.Reconnect = r },
+		func(c *AsyncMessageSourceConfig) { c.Reconnect = r },
+	)
+}
+
+// WithEvents sets the Events callback of a sink or a source, and the
+// EventBufferSize, which defaults when zero.
+func WithEvents(events func(Event), bufferSize int) Option {
+	return setting("WithEvents", "Events",
+		func(c *AsyncMessageSinkConfig) { c.Events, c.EventBufferSize = events, bufferSize },
+		func(c *AsyncMessageSourceConfig) { c.Events, c.EventBufferSize = events, bufferSize },
+	)
+}
+
+// WithLifecycleEvents sets the LifecycleEvents channel of a sink or a source.
+func WithLifecycleEvents(events chan<- substrate.LifecycleEvent) Option {
+	return setting("WithLifecycleEvents", "LifecycleEvents",
+		func(c *AsyncMessageSinkConfig) { c.LifecycleEvents = events },
+		func(c *AsyncMessageSourceConfig) { c.LifecycleEvents = events },
+	)
+}
+
+// WithDetectCapabilities sets DetectCapabilities on a sink or a source.
+func WithDetectCapabilities() Option {
+	return setting("WithDetectCapabilities", "DetectCapabilities",
+		func(c *AsyncMessageSinkConfig) { c.DetectCapabilities = true },
+		func(c *AsyncMessageSourceConfig) { c.DetectCapabilities = true },
+	)
+}
+
+// WithClientName sets the ClientName of a sink or a source.
+func WithClientName(name string) Option {
+	return setting("WithClientName", "ClientName",
+		func(c *AsyncMessageSinkConfig) { c.ClientName = name },
+		func(c *AsyncMessageSourceConfig) { c.ClientName = name },
+	)
+}
+
+// WithGauges sets the Gauges of a sink or a source.
+func WithGauges(g substrate.Gauges) Option {
+	return setting("WithGauges", "Gauges",
+		func(c *AsyncMessageSinkConfig) { c.Gauges = g },
+		func(c *AsyncMessageSourceConfig) { c.Gauges = g },
+	)
+}
+
+// WithConnPool sets the ConnPool of a sink or a source.
+func WithConnPool(p *ConnPool) Option {
+	return setting("WithConnPool", "ConnPool",
+		func(c *AsyncMessageSinkConfig) { c.ConnPool = p },
+		func(c *AsyncMessageSourceConfig) { c.ConnPool = p },
+	)
+}
+
+// WithRegisteredDefaults sets UseRegisteredDefaults on a sink or a source.
+func WithRegisteredDefaults() Option {
+	return setting("WithRegisteredDefaults", "UseRegisteredDefaults",
+		func(c *AsyncMessageSinkConfig) { c.UseRegisteredDefaults = true },
+		func(c *AsyncMessageSourceConfig) { c.UseRegisteredDefaults = true },
+	)
+}
+
+// WithCopyOnPublish sets CopyOnPublish on a sink.
+func WithCopyOnPublish() Option {
+	return setting("WithCopyOnPublish", "CopyOnPublish",
+		func(c *AsyncMessageSinkConfig) { c.CopyOnPublish = true },
+		nil,
+	)
+}
+
+// WithBatching sets the BatchSize and BatchDelay of a sink, which defaults
+// when zero.
+func WithBatching(size int, delay time.Duration) Option {
+	return setting("WithBatching", "Batch",
+		func(c *AsyncMessageSinkConfig) { c.BatchSize, c.BatchDelay = size, delay },
+		nil,
+	)
+}
+
+// WithMaxSendMsgSize sets the MaxSendMsgSize of a sink.
+func WithMaxSendMsgSize(n int) Option {
+	return setting("WithMaxSendMsgSize", "MaxSendMsgSize",
+		func(c *AsyncMessageSinkConfig) { c.MaxSendMsgSize = n },
+		nil,
+	)
+}
+
+// WithMaxMessageBytes sets the MaxMessageBytes of a sink, and its OnOversize
+// handler, which may be nil.
+func WithMaxMessageBytes(n int, onOversize substrate.MessageErrorHandler) Option {
+	return setting("WithMaxMessageBytes", "MaxMessageBytes",
+		func(c *AsyncMessageSinkConfig) { c.MaxMessageBytes, c.OnOversize = n, onOversize },
+		nil,
+	)
+}
+
+// WithDebug sets Debug on a sink.
+func WithDebug() Option {
+	return setting("WithDebug", "Debug",
+		func(c *AsyncMessageSinkConfig) { c.Debug = true },
+		nil,
+	)
+}
+
+// WithConsumerGroup sets the ConsumerGroup of a source.
+func WithConsumerGroup(group string) Option {
+	return setting("WithConsumerGroup", "ConsumerGroup",
+		nil,
+		func(c *AsyncMessageSourceConfig) { c.ConsumerGroup = group },
+	)
+}
+
+// WithOffset sets the Offset a source starts from.
+func WithOffset(offset Offset) Option {
+	return setting("WithOffset", "Offset",
+		nil,
+		func(c *AsyncMessageSourceConfig) { c.Offset = offset },
+	)
+}
+
+// WithMaxRecvMsgSize sets the MaxRecvMsgSize of a source.
+func WithMaxRecvMsgSize(n int) Option {
+	return setting("WithMaxRecvMsgSize", "MaxRecvMsgSize",
+		nil,
+		func(c *AsyncMessageSourceConfig) { c.MaxRecvMsgSize = n },
+	)
+}
+
+// WithAckStrategy sets the AckStrategy of a source.
+func WithAckStrategy(s AckStrategy) Option {
+	return setting("WithAckStrategy", "AckStrategy",
+		nil,
+		func(c *AsyncMessageSourceConfig) { c.AckStrategy = s },
+	)
+}
+
+// WithMaxInFlight sets the MaxInFlight of a source.
+func WithMaxInFlight(n int) Option {
+	return setting("WithMaxInFlight", "MaxInFlight",
+		nil,
+		func(c *AsyncMessageSourceConfig) { c.MaxInFlight = n },
+	)
+}
+
+// WithTracing sets the OnMessage and OnAck callbacks of a source, either of
+// which may be nil.
+func WithTracing(onMessage, onAck func(id string)) Option {
+	return setting("WithTracing", "tracing",
+		nil,
+		func(c *AsyncMessageSourceConfig) { c.OnMessage, c.OnAck = onMessage, onAck },
+	)
+}
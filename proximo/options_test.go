@@ -0,0 +1,82 @@
+package proximo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSourceConfig(t *testing.T) {
+	c, err := NewSourceConfig(
+		WithAckStrategy(AckStrategy{Count: 100}),
+		WithBroker("localhost:6868"),
+		WithTopic("invoices"),
+		WithConsumerGroup("billing"),
+		WithOffset(OffsetOldest),
+		WithInsecure(),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, AsyncMessageSourceConfig{
+		Broker:        "localhost:6868",
+		Topic:         "invoices",
+		ConsumerGroup: "billing",
+		Offset:        OffsetOldest,
+		Insecure:      true,
+		AckStrategy:   AckStrategy{Count: 100},
+	}, c)
+}
+
+func TestOptionsOverrides(t *testing.T) {
+	creds := &Credentials{ClientID: "billing", Secret: "secret"}
+	c, err := NewSinkConfig(
+		WithBroker("localhost:6868"),
+		WithTopic("invoices"),
+		WithInsecure(),
+		WithBatching(10, time.Millisecond),
+		Overrides(WithBroker("proximo.prod:443"), WithCredentials(creds)),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, AsyncMessageSinkConfig{
+		Broker:      "proximo.prod:443",
+		Topic:       "invoices",
+		Credentials: creds,
+		BatchSize:   10,
+		BatchDelay:  time.Millisecond,
+	}, c)
+}
+
+func TestOptionsConflicts(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		expected string
+	}{
+		{
+			name:     "insecure and credentials",
+			opts:     []Option{WithCredentials(&Credentials{}), WithInsecure()},
+			expected: "proximo: WithCredentials conflicts with WithInsecure",
+		},
+		{
+			name:     "given twice",
+			opts:     []Option{WithBroker("b1"), WithBroker("b2")},
+			expected: "proximo: WithBroker is given more than once",
+		},
+		{
+			name:     "source option",
+			opts:     []Option{WithMaxInFlight(10)},
+			expected: "proximo: WithMaxInFlight is not an option of AsyncMessageSinkConfig",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			_, err := NewSink(tst.opts...)
+			assert.EqualError(t, err, tst.expected)
+		})
+	}
+
+	_, err := NewSource(WithBatching(10, 0))
+	assert.EqualError(t, err, "proximo: WithBatching is not an option of AsyncMessageSourceConfig")
+}
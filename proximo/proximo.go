@@ -31,10 +31,30 @@ type dialConfig struct {
 	insecure       bool
 	keepAlive      *KeepAlive
 	maxRecvMsgSize int
+	maxSendMsgSize int
+	userAgent      string
 }
 
 const defaultMaxRecvMsgSize = 1024 * 1024 * 64
 
+// defaultMaxSendMsgSize is the default maximum size of the messages received
+// by gRPC servers.
+const defaultMaxSendMsgSize = 1024 * 1024 * 4
+
+// clientNameHeader is the metadata header carrying the client name.
+const clientNameHeader = "x-client-name"
+
+// clientName returns the configured client name, or a default derived from
+// the topic.
+func clientName(configured, topic string) string {
+	if configured != "" {
+		return configured
+	}
+	return "substrate-" + topic
+}
+
+var proximoDialer = dialProximo
+
 func dialProximo(conf dialConfig) (*grpc.ClientConn, error) {
 	var opts []grpc.DialOption
 
@@ -55,7 +75,15 @@ func dialProximo(conf dialConfig) (*grpc.ClientConn, error) {
 	if conf.maxRecvMsgSize > 0 {
 		maxRecvMsgSize = conf.maxRecvMsgSize
 	}
-	opts = append(opts, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxRecvMsgSize)))
+	callOpts := []grpc.CallOption{grpc.MaxCallRecvMsgSize(maxRecvMsgSize)}
+	if conf.maxSendMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallSendMsgSize(conf.maxSendMsgSize))
+	}
+	opts = append(opts, grpc.WithDefaultCallOptions(callOpts...))
+
+	if conf.userAgent != "" {
+		opts = append(opts, grpc.WithUserAgent(conf.userAgent))
+	}
 
 	conn, err := grpc.Dial(conf.broker, opts...)
 	if err != nil {
@@ -66,18 +94,39 @@ func dialProximo(conf dialConfig) (*grpc.ClientConn, error) {
 }
 
 func proximoStatus(conn *grpc.ClientConn) (*substrate.Status, error) {
-	switch state := conn.GetState(); state {
+	state := conn.GetState()
+	// The proximo protocol doesn't expose the lag of a consumer.
+	status := &substrate.Status{Details: map[string]string{"connectivity": state.String()}}
+	switch state {
 	case connectivity.Idle, connectivity.Ready:
-		return &substrate.Status{Working: true}, nil
+		status.Working = true
 	case connectivity.Connecting:
-		return &substrate.Status{Working: true, Problems: []string{"connecting"}}, nil
+		status.Working, status.Problems = true, []string{"connecting"}
 	case connectivity.TransientFailure:
-		return &substrate.Status{Working: true, Problems: []string{"transient failure"}}, nil
+		status.Working, status.Problems = true, []string{"transient failure"}
 	case connectivity.Shutdown:
-		return &substrate.Status{Working: false, Problems: []string{"connection shutdown"}}, nil
+		status.Working, status.Problems = false, []string{"connection shutdown"}
 	default:
 		return nil, errors.Errorf("unknown connection state: %s", state)
 	}
+	return status, nil
+}
+
+// waitForReady waits for the connection to be ready, until the context is
+// done.
+func waitForReady(ctx context.Context, conn *grpc.ClientConn) error {
+	for {
+		state := conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.Shutdown:
+			return errors.New("connection shutdown")
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			return errors.Wrapf(ctx.Err(), "connection not ready, last state %s", state)
+		}
+	}
 }
 
 type Credentials struct {
@@ -85,13 +134,20 @@ type Credentials struct {
 	Secret   string
 }
 
-func setupAuthentication(ctx context.Context, credentials *Credentials) context.Context {
-	if credentials == nil || (credentials.ClientID == "" && credentials.Secret == "") {
+// setupMetadata returns a context carrying the client name and, if any, the
+// credentials as outgoing metadata.
+func setupMetadata(ctx context.Context, credentials *Credentials, name string) context.Context {
+	var kv []string
+	if name != "" {
+		kv = append(kv, clientNameHeader, name)
+	}
+	if credentials != nil && (credentials.ClientID != "" || credentials.Secret != "") {
+		basicAuth := fmt.Sprintf("%s:%s", credentials.ClientID, credentials.Secret)
+		token := base64.StdEncoding.EncodeToString([]byte(basicAuth))
+		kv = append(kv, "Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+	if len(kv) == 0 {
 		return ctx
 	}
-
-	basicAuth := fmt.Sprintf("%s:%s", credentials.ClientID, credentials.Secret)
-	token := base64.StdEncoding.EncodeToString([]byte(basicAuth))
-	md := metadata.Pairs("Authorization", fmt.Sprintf("Bearer %s", token))
-	return metadata.NewOutgoingContext(ctx, md)
+	return metadata.NewOutgoingContext(ctx, metadata.Pairs(kv...))
 }
@@ -3,6 +3,8 @@ package proximo
 import (
 	"context"
 	"io"
+	"sync"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -15,52 +17,235 @@ import (
 	"github.com/uw-labs/sync/rungroup"
 
 	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/clock"
 	"github.com/uw-labs/substrate/internal/debug"
+	"github.com/uw-labs/substrate/internal/flush"
+	"github.com/uw-labs/substrate/internal/helper"
 )
 
-var _ substrate.AsyncMessageSink = (*asyncMessageSink)(nil)
+var (
+	_ substrate.AsyncMessageSink = (*asyncMessageSink)(nil)
+	_ substrate.ReadinessChecker = (*asyncMessageSink)(nil)
+	_ substrate.Flushable        = (*asyncMessageSink)(nil)
+)
 
 type AsyncMessageSinkConfig struct {
-	Broker      string
-	Topic       string
+	Broker string
+	Topic  string
+	// Namespace, if set, is prepended as it is to Topic, e.g. "billing."
+	// for the topics of a team on a shared cluster. The namespaced topic is
+	// the one reported by Status and errors.
+	Namespace   string
 	Insecure    bool
 	KeepAlive   *KeepAlive
 	Credentials *Credentials
 	Debug       bool
+	// Reconnect enables re-establishing the stream when it fails, instead of
+	// returning the error from PublishMessages. Messages that were not yet
+	// confirmed are sent again on the new stream.
+	Reconnect *Reconnect
+	// Events is an optional callback receiving connection events. It is
+	// called from a separate goroutine, so a slow callback never blocks
+	// publishing.
+	Events func(Event)
+	// EventBufferSize is the number of events buffered for a slow Events
+	// callback before the oldest ones are dropped. Defaults to 64.
+	EventBufferSize int
+	// LifecycleEvents, if set, receives the connected, disconnected and
+	// reconnected events of the streams to proximo, and a closed event
+	// once the connection is closed. Events are dropped when the channel
+	// is full. See substrate.LifecycleEvent.
+	LifecycleEvents chan<- substrate.LifecycleEvent
+	// DetectCapabilities enables detecting the capabilities of the server
+	// when the sink is created.
+	DetectCapabilities bool
+	// ClientName identifies the client to the server, as the gRPC user
+	// agent and in the x-client-name metadata header. Defaults to
+	// "substrate-" followed by the topic.
+	ClientName string
+	// CopyOnPublish makes the sink copy the payload of every message as
+	// it is received, so that callers may reuse their buffers as soon as a
+	// message is sent to PublishMessages. This costs an allocation and a
+	// copy per message. Without it, the buffers must not be modified until
+	// the message is acknowledged, as unconfirmed messages are sent again
+	// after reconnecting.
+	CopyOnPublish bool
+	// BatchSize, if greater than one, enables accumulating up to BatchSize
+	// messages, for at most BatchDelay, before sending them. The proximo
+	// protocol carries a single message per request, so the messages of a
+	// batch are sent back to back, which lets gRPC write them together.
+	BatchSize int
+	// BatchDelay is the longest time a message waits for its batch to
+	// fill up. Defaults to 5ms.
+	BatchDelay time.Duration
+	// MaxSendMsgSize, if set, is the gRPC max send message size in bytes.
+	// It should match the max receive message size of the server, which gRPC
+	// servers default to 4MiB.
+	MaxSendMsgSize int
+	// MaxMessageBytes is the maximum size of the payload of the published
+	// messages. It defaults to MaxSendMsgSize, or 4MiB if it isn't set, less
+	// a margin for the protocol overhead. A larger message would fail the
+	// stream along with the messages in flight, so it isn't sent, and is
+	// passed to OnOversize along with a substrate.OversizeError instead. If
+	// OnOversize returns nil, the message is acknowledged, and publishing
+	// continues. If OnOversize is nil or returns an error, PublishMessages
+	// terminates with that error.
+	MaxMessageBytes int
+	OnOversize      substrate.MessageErrorHandler
+	// Gauges, if set, is sampled with the number of messages awaiting their
+	// confirmation, and of the acknowledgements not yet received by the
+	// caller, e.g. to find where publishing backs up.
+	Gauges substrate.Gauges
+	// ConnPool, if set, is used to share the connection of the sink with
+	// the other sources and sinks created with the same broker and
+	// connection options.
+	ConnPool *ConnPool
+	// UseRegisteredDefaults enables applying the defaults registered for
+	// the proximo scheme with the config package to the options that are not
+	// set. It is always set for the sinks obtained from suburl.
+	UseRegisteredDefaults bool
+}
+
+const defaultBatchDelay = 5 * time.Millisecond
+
+// messageOverhead is the margin left for the protocol overhead of a request,
+// such as the message ID, when defaulting MaxMessageBytes.
+const messageOverhead = 1024
+
+// maxMessageBytes returns the configured maximum message size, or a default
+// derived from the max send message size.
+func maxMessageBytes(configured, maxSendMsgSize int) int {
+	if configured > 0 {
+		return configured
+	}
+	if maxSendMsgSize <= 0 {
+		maxSendMsgSize = defaultMaxSendMsgSize
+	}
+	return maxSendMsgSize - messageOverhead
 }
 
 func NewAsyncMessageSink(c AsyncMessageSinkConfig) (substrate.AsyncMessageSink, error) {
-	conn, err := dialProximo(dialConfig{
-		broker:    c.Broker,
-		insecure:  c.Insecure,
-		keepAlive: c.KeepAlive,
+	if err := c.applyRegisteredDefaults(); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	c.resolveTopic()
+	name := clientName(c.ClientName, c.Topic)
+	conn, closeConn, err := dial(c.ConnPool, dialConfig{
+		broker:         c.Broker,
+		insecure:       c.Insecure,
+		keepAlive:      c.KeepAlive,
+		maxSendMsgSize: c.MaxSendMsgSize,
+		userAgent:      name,
 	})
 	if err != nil {
 		return nil, err
 	}
 
+	var caps *Capabilities
+	if c.DetectCapabilities {
+		caps, err = detectCapabilities(setupMetadata(context.Background(), c.Credentials, name), conn)
+		if err != nil {
+			_ = closeConn()
+			return nil, err
+		}
+	}
+
+	batchDelay := c.BatchDelay
+	if batchDelay <= 0 {
+		batchDelay = defaultBatchDelay
+	}
+
 	return &asyncMessageSink{
 		conn:        conn,
+		closeConn:   closeConn,
 		topic:       c.Topic,
 		credentials: c.Credentials,
+		clientName:  name,
 		debugger: debug.Debugger{
 			Enabled: c.Debug,
 		},
+		reconnect:     c.Reconnect,
+		events:        newEventEmitter(c.Events, c.EventBufferSize),
+		lifecycle:     substrate.NewLifecycleEmitter(c.LifecycleEvents, "proximo", c.Topic),
+		caps:          caps,
+		copyOnPublish: c.CopyOnPublish,
+		batchSize:     c.BatchSize,
+		batchDelay:    batchDelay,
+		maxBytes:      maxMessageBytes(c.MaxMessageBytes, c.MaxSendMsgSize),
+		onOversize:    c.OnOversize,
+		clock:         clock.Real,
+		gauges:        c.Gauges,
 	}, nil
 }
 
+var _ CapabilitiesReporter = (*asyncMessageSink)(nil)
+
 type asyncMessageSink struct {
 	conn        *grpc.ClientConn
+	closeConn   func() error
 	topic       string
 	credentials *Credentials
+	clientName  string
+	reconnect   *Reconnect
+	events      *eventEmitter
+	lifecycle   *substrate.LifecycleEmitter
+	// caps holds the detected capabilities, if detection is enabled.
+	caps          *Capabilities
+	copyOnPublish bool
+	batchSize     int
+	batchDelay    time.Duration
+	// maxBytes is the maximum size of the sent messages, if set.
+	maxBytes   int
+	onOversize substrate.MessageErrorHandler
+	clock      clock.Clock
+	gauges     substrate.Gauges
+	flushes    flush.Tracker
 
 	debugger debug.Debugger
 }
 
 func (ams *asyncMessageSink) PublishMessages(ctx context.Context, acks chan<- substrate.Message, messages <-chan substrate.Message) (rerr error) {
-	rg, ctx := rungroup.New(setupAuthentication(ctx, ams.credentials))
+	ams.flushes.Start()
+	defer func() { ams.flushes.Stop(rerr) }()
+
+	rg, ctx := rungroup.New(setupMetadata(ctx, ams.credentials, ams.clientName))
 
 	client := proto.NewMessageSinkClient(ams.conn)
+	pending := newPendingMessages()
+	proximoAcks := make(chan string)
+
+	rg.Go(func() error {
+		state := streamState{events: ams.events, lifecycle: ams.lifecycle, reconnect: ams.reconnect}
+		for {
+			err := ams.publishStream(ctx, client, &state, pending, messages, proximoAcks)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			backoff, ok := state.failed(err)
+			if !ok {
+				return err
+			}
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+	rg.Go(func() error {
+		return ams.passAcksToUser(ctx, acks, pending, proximoAcks)
+	})
+
+	return rg.Wait()
+}
+
+func (ams *asyncMessageSink) publishStream(ctx context.Context, client proto.MessageSinkClient, state *streamState, pending *pendingMessages, messages <-chan substrate.Message, proximoAcks chan<- string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	stream, err := client.Publish(ctx)
 	if err != nil {
 		return errors.Wrap(err, "failed to start publishing")
@@ -74,21 +259,23 @@ func (ams *asyncMessageSink) PublishMessages(ctx context.Context, acks chan<- su
 	if err != nil {
 		return errors.Wrap(err, "failed to set publish topic")
 	}
+	state.established()
 
-	toAck := make(chan *ackMessage)
-	proximoAcks := make(chan string)
-
+	rg, ctx := rungroup.New(ctx)
 	rg.Go(func() error {
 		defer stream.CloseSend()
 
-		return ams.sendMessagesToProximo(ctx, stream, messages, toAck)
+		// Messages that weren't confirmed on a previous stream are sent again.
+		for _, pMsg := range pending.unconfirmed() {
+			if err := ams.send(ctx, stream, pMsg); err != nil {
+				return err
+			}
+		}
+		return ams.sendMessagesToProximo(ctx, stream, messages, pending)
 	})
 	rg.Go(func() error {
 		return ams.receiveAcksFromProximo(ctx, stream, proximoAcks)
 	})
-	rg.Go(func() error {
-		return ams.passAcksToUser(ctx, acks, toAck, proximoAcks)
-	})
 
 	return rg.Wait()
 }
@@ -97,34 +284,130 @@ type msgSendStream interface {
 	Send(*proto.PublisherRequest) error
 }
 
-func (ams *asyncMessageSink) sendMessagesToProximo(ctx context.Context, stream msgSendStream, messages <-chan substrate.Message, toAck chan<- *ackMessage) error {
+func (ams *asyncMessageSink) sendMessagesToProximo(ctx context.Context, stream msgSendStream, messages <-chan substrate.Message, pending *pendingMessages) error {
+	if ams.batchSize > 1 {
+		return ams.sendBatchesToProximo(ctx, stream, messages, pending)
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
+		case req := <-ams.flushes.Requests():
+			ams.flushes.Mark(req)
 		case msg := <-messages:
-			pMsg := &proto.Message{
-				Id:   uuid.Must(uuid.NewV4()).String(),
-				Data: msg.Data(),
+			ams.flushes.Submitted()
+			if rejected, err := ams.rejectOversize(msg, pending); err != nil {
+				return err
+			} else if rejected {
+				continue
 			}
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case toAck <- &ackMessage{id: pMsg.Id, msg: msg}:
+			pMsg := ams.newProtoMessage(msg)
+			pending.add(pMsg, msg)
+			if err := ams.send(ctx, stream, pMsg); err != nil {
+				return err
 			}
-			if err := stream.Send(&proto.PublisherRequest{Msg: pMsg}); err != nil {
-				if err == io.EOF || status.Code(err) == codes.Canceled {
-					if ctx.Err() != nil {
-						return ctx.Err()
-					}
+		}
+	}
+}
+
+// sendBatchesToProximo accumulates up to batchSize messages, for at most
+// batchDelay, and sends them back to back, as a request carries a single
+// message.
+func (ams *asyncMessageSink) sendBatchesToProximo(ctx context.Context, stream msgSendStream, messages <-chan substrate.Message, pending *pendingMessages) error {
+	batch := make([]*proto.Message, 0, ams.batchSize)
+	var (
+		timer   clock.Timer
+		timeout <-chan time.Time
+	)
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case req := <-ams.flushes.Requests():
+			ams.flushes.Mark(req)
+			continue
+		case msg := <-messages:
+			ams.flushes.Submitted()
+			if rejected, err := ams.rejectOversize(msg, pending); err != nil {
+				return err
+			} else if rejected {
+				continue
+			}
+			pMsg := ams.newProtoMessage(msg)
+			pending.add(pMsg, msg)
+			batch = append(batch, pMsg)
+			if len(batch) < ams.batchSize {
+				if timeout == nil {
+					timer = ams.clock.NewTimer(ams.batchDelay)
+					timeout = timer.C()
 				}
-				return errors.Wrap(err, "failed to send message to proximo")
+				continue
+			}
+			if timer != nil {
+				timer.Stop()
 			}
-			ams.debugger.Logf("substrate : sent to proximo : %s which has id %s\n", pMsg, pMsg.Id)
+		case <-timeout:
 		}
+		timer, timeout = nil, nil
+
+		for _, pMsg := range batch {
+			if err := ams.send(ctx, stream, pMsg); err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
 	}
 }
 
+// rejectOversize passes a message larger than maxBytes to onOversize, and has
+// it acknowledged if onOversize returns nil, reporting whether it was.
+func (ams *asyncMessageSink) rejectOversize(msg substrate.Message, pending *pendingMessages) (bool, error) {
+	size := len(msg.Data())
+	if ams.maxBytes <= 0 || size <= ams.maxBytes {
+		return false, nil
+	}
+	oerr := substrate.OversizeError{Size: size, MaxBytes: ams.maxBytes}
+	if ams.onOversize == nil {
+		return false, oerr
+	}
+	if err := ams.onOversize(msg, oerr); err != nil {
+		return false, err
+	}
+	ams.debugger.Logf("substrate : rejected message of %d bytes\n", size)
+	pending.reject(msg)
+	return true, nil
+}
+
+func (ams *asyncMessageSink) newProtoMessage(msg substrate.Message) *proto.Message {
+	data := msg.Data()
+	if ams.copyOnPublish {
+		data = append([]byte(nil), data...)
+	}
+	return &proto.Message{
+		Id:   uuid.Must(uuid.NewV4()).String(),
+		Data: data,
+	}
+}
+
+func (ams *asyncMessageSink) send(ctx context.Context, stream msgSendStream, pMsg *proto.Message) error {
+	if err := stream.Send(&proto.PublisherRequest{Msg: pMsg}); err != nil {
+		if err == io.EOF || status.Code(err) == codes.Canceled {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+		return errors.Wrap(err, "failed to send message to proximo")
+	}
+	ams.debugger.Logf("substrate : sent to proximo : %s which has id %s\n", pMsg, pMsg.Id)
+	return nil
+}
+
 type ackReceiverStream interface {
 	Recv() (*proto.Confirmation, error)
 }
@@ -149,47 +432,184 @@ func (ams *asyncMessageSink) receiveAcksFromProximo(ctx context.Context, stream
 	}
 }
 
-func (ams *asyncMessageSink) passAcksToUser(ctx context.Context, acks chan<- substrate.Message, toAck <-chan *ackMessage, proximoAcks <-chan string) error {
-	ackMap := make(map[string]substrate.Message)
+func (ams *asyncMessageSink) passAcksToUser(ctx context.Context, acks chan<- substrate.Message, pending *pendingMessages, proximoAcks <-chan string) error {
+	ticks, stop := helper.GaugeTicks(ams.gauges)
+	defer stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case ack := <-toAck:
-			ackMap[ack.id] = ack.msg
+		case <-ticks:
+			ams.sampleGauges(pending, acks, 0)
+		case <-pending.rejections:
+			for _, msg := range pending.takeRejected() {
+				if err := ams.sendAck(ctx, acks, pending, ticks, msg); err != nil {
+					return err
+				}
+			}
 		case msgID := <-proximoAcks:
-			msg, ok := ackMap[msgID]
+			msg, ok := pending.confirm(msgID)
 			if !ok {
+				if ams.reconnect != nil {
+					// A message sent again after reconnecting can be
+					// confirmed by both streams.
+					continue
+				}
 				return errors.New("received unexpected message confirmation from proximo")
 			}
-			sent := false
-			for !sent {
-				select {
-				case <-ctx.Done():
-					return ctx.Err()
-				case ack := <-toAck:
-					ackMap[ack.id] = ack.msg
-				case acks <- msg:
-					ams.debugger.Logf("substrate : sent ack to user : %v\n", msg)
-					delete(ackMap, msgID)
-					sent = true
-				}
+			if err := ams.sendAck(ctx, acks, pending, ticks, msg); err != nil {
+				return err
 			}
 		}
 	}
 }
 
+func (ams *asyncMessageSink) sendAck(ctx context.Context, acks chan<- substrate.Message, pending *pendingMessages, ticks <-chan time.Time, msg substrate.Message) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticks:
+			ams.sampleGauges(pending, acks, 1)
+		case acks <- msg:
+			ams.flushes.Acked()
+			ams.debugger.Logf("substrate : sent ack to user : %v\n", msg)
+			return nil
+		}
+	}
+}
+
+// sampleGauges sets the gauges to the number of messages awaiting their
+// confirmation, and of the acknowledgements not yet received by the caller,
+// including the unsent ones.
+func (ams *asyncMessageSink) sampleGauges(pending *pendingMessages, acks chan<- substrate.Message, unsent int) {
+	ams.gauges.SetInFlight(pending.count() + unsent)
+	ams.gauges.SetPendingAcks(len(acks) + unsent)
+}
+
+// Flush implements the substrate.Flushable interface.
+func (ams *asyncMessageSink) Flush(ctx context.Context) error {
+	return ams.flushes.Flush(ctx)
+}
+
+// Ready implements the substrate.ReadinessChecker interface. It waits for
+// the gRPC connection to be ready.
+func (ams *asyncMessageSink) Ready(ctx context.Context) error {
+	return waitForReady(ctx, ams.conn)
+}
+
+// Capabilities implements the CapabilitiesReporter interface.
+func (ams *asyncMessageSink) Capabilities() Capabilities {
+	if ams.caps == nil {
+		return Capabilities{}
+	}
+	return *ams.caps
+}
+
 func (ams *asyncMessageSink) Status() (*substrate.Status, error) {
-	return proximoStatus(ams.conn)
+	st, err := proximoStatus(ams.conn)
+	if err != nil {
+		return nil, err
+	}
+	st.Details["topic"] = ams.topic
+	return st, nil
 }
 
 // Close implements the Close method of the substrate.AsyncMessageSink
 // interface.
 func (ams *asyncMessageSink) Close() error {
-	return ams.conn.Close()
+	err := ams.closeConn()
+	ams.lifecycle.Emit(substrate.LifecycleEvent{Type: substrate.LifecycleClosed, Err: err})
+	return err
+}
+
+// pendingMessages tracks the messages sent to proximo that haven't been
+// confirmed yet, in the order they were sent.
+type pendingMessages struct {
+	mu    sync.Mutex
+	order []*proto.Message
+	msgs  map[string]substrate.Message
+	// rejected are the messages that weren't sent, to be acknowledged
+	// straight away. rejections signals that there are some.
+	rejected   []substrate.Message
+	rejections chan struct{}
+}
+
+func newPendingMessages() *pendingMessages {
+	return &pendingMessages{
+		msgs:       make(map[string]substrate.Message),
+		rejections: make(chan struct{}, 1),
+	}
+}
+
+// reject records a message that wasn't sent, so that it is acknowledged
+// without waiting for a confirmation. It never blocks, so that a slow caller
+// doesn't delay sending the messages after it.
+func (p *pendingMessages) reject(msg substrate.Message) {
+	p.mu.Lock()
+	p.rejected = append(p.rejected, msg)
+	p.mu.Unlock()
+
+	select {
+	case p.rejections <- struct{}{}:
+	default:
+	}
+}
+
+// takeRejected returns the rejected messages, in order, and forgets them.
+func (p *pendingMessages) takeRejected() []substrate.Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rejected := p.rejected
+	p.rejected = nil
+	return rejected
+}
+
+func (p *pendingMessages) add(pMsg *proto.Message, msg substrate.Message) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.order = append(p.order, pMsg)
+	p.msgs[pMsg.Id] = msg
+}
+
+func (p *pendingMessages) confirm(id string) (substrate.Message, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	msg, ok := p.msgs[id]
+	if ok {
+		delete(p.msgs, id)
+	}
+	for len(p.order) > 0 {
+		if _, ok := p.msgs[p.order[0].Id]; ok {
+			break
+		}
+		p.order = p.order[1:]
+	}
+	return msg, ok
+}
+
+// count returns the number of messages that are still waiting for a
+// confirmation.
+func (p *pendingMessages) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.msgs)
 }
 
-type ackMessage struct {
-	id  string
-	msg substrate.Message
+// unconfirmed returns the messages that are still waiting for a confirmation.
+func (p *pendingMessages) unconfirmed() []*proto.Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var out []*proto.Message
+	for _, pMsg := range p.order {
+		if _, ok := p.msgs[pMsg.Id]; ok {
+			out = append(out, pMsg)
+		}
+	}
+	p.order = append(p.order[:0], out...)
+	return out
 }
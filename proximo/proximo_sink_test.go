@@ -0,0 +1,338 @@
+package proximo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/proximo/proto"
+	"google.golang.org/grpc"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/clock"
+	"github.com/uw-labs/substrate/internal/testutil"
+)
+
+type recordingSendStream struct {
+	sent chan *proto.PublisherRequest
+}
+
+func (s recordingSendStream) Send(req *proto.PublisherRequest) error {
+	s.sent <- req
+	return nil
+}
+
+type bufferMessage []byte
+
+func (m bufferMessage) Data() []byte { return m }
+
+func TestCopyOnPublish(t *testing.T) {
+	for _, copyOnPublish := range []bool{false, true} {
+		sink := &asyncMessageSink{copyOnPublish: copyOnPublish}
+		stream := recordingSendStream{sent: make(chan *proto.PublisherRequest, 1)}
+		pending := newPendingMessages()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		messages := make(chan substrate.Message)
+		errs := make(chan error, 1)
+		go func() {
+			errs <- sink.sendMessagesToProximo(ctx, stream, messages, pending)
+		}()
+
+		buf := []byte("first")
+		messages <- bufferMessage(buf)
+		<-stream.sent
+		// The caller reuses its buffer before the message is confirmed.
+		copy(buf, "xxxxx")
+
+		// Unconfirmed messages are what is sent again after reconnecting.
+		unconfirmed := pending.unconfirmed()
+		require.Len(t, unconfirmed, 1)
+		if copyOnPublish {
+			assert.Equal(t, "first", string(unconfirmed[0].Data))
+		} else {
+			assert.Equal(t, "xxxxx", string(unconfirmed[0].Data))
+		}
+
+		cancel()
+		assert.Equal(t, context.Canceled, <-errs)
+	}
+}
+
+func TestBatching(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	sink := &asyncMessageSink{batchSize: 3, batchDelay: 50 * time.Millisecond, clock: clock}
+	stream := recordingSendStream{sent: make(chan *proto.PublisherRequest, 3)}
+	pending := newPendingMessages()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	messages := make(chan substrate.Message)
+	go func() {
+		_ = sink.sendMessagesToProximo(ctx, stream, messages, pending)
+	}()
+
+	// A full batch is sent straight away, in order.
+	messages <- bufferMessage("1")
+	messages <- bufferMessage("2")
+	assert.Len(t, stream.sent, 0)
+	messages <- bufferMessage("3")
+	for _, expected := range []string{"1", "2", "3"} {
+		assert.Equal(t, expected, string((<-stream.sent).Msg.Data))
+	}
+
+	// A partial batch is sent after the delay.
+	messages <- bufferMessage("4")
+	clock.BlockUntil(1)
+	clock.Advance(49 * time.Millisecond)
+	assert.Len(t, stream.sent, 0)
+	clock.Advance(time.Millisecond)
+	assert.Equal(t, "4", string((<-stream.sent).Msg.Data))
+
+	// Confirmations are mapped back to the messages.
+	unconfirmed := pending.unconfirmed()
+	require.Len(t, unconfirmed, 4)
+	msg, ok := pending.confirm(unconfirmed[0].Id)
+	require.True(t, ok)
+	assert.Equal(t, bufferMessage("1"), msg)
+}
+
+func TestOversizeMessagesAreRejected(t *testing.T) {
+	for _, batchSize := range []int{1, 3} {
+		var rejected []substrate.Message
+		sink := &asyncMessageSink{
+			batchSize:  batchSize,
+			batchDelay: time.Millisecond,
+			clock:      clock.Real,
+			maxBytes:   5,
+			onOversize: func(msg substrate.Message, err error) error {
+				assert.Equal(t, substrate.OversizeError{Size: 6, MaxBytes: 5}, err)
+				rejected = append(rejected, msg)
+				return nil
+			},
+		}
+		stream := recordingSendStream{sent: make(chan *proto.PublisherRequest, 2)}
+		pending := newPendingMessages()
+		proximoAcks := make(chan string)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		messages := make(chan substrate.Message)
+		acks := make(chan substrate.Message)
+		go func() {
+			_ = sink.sendMessagesToProximo(ctx, stream, messages, pending)
+		}()
+		go func() {
+			_ = sink.passAcksToUser(ctx, acks, pending, proximoAcks)
+		}()
+
+		// The oversize message is acknowledged without being sent.
+		larger := bufferMessage("larger")
+		messages <- larger
+		assert.Equal(t, larger, <-acks)
+		assert.Equal(t, []substrate.Message{larger}, rejected)
+
+		// The messages after it are still sent.
+		messages <- bufferMessage("small")
+		messages <- bufferMessage("after")
+		first, second := <-stream.sent, <-stream.sent
+		assert.Equal(t, "small", string(first.Msg.Data))
+		assert.Equal(t, "after", string(second.Msg.Data))
+		proximoAcks <- first.Msg.Id
+		assert.Equal(t, bufferMessage("small"), <-acks)
+		proximoAcks <- second.Msg.Id
+		assert.Equal(t, bufferMessage("after"), <-acks)
+		assert.Len(t, stream.sent, 0)
+		cancel()
+	}
+}
+
+func TestOversizeMessagesWithoutHandler(t *testing.T) {
+	sink := &asyncMessageSink{maxBytes: 5}
+	stream := recordingSendStream{sent: make(chan *proto.PublisherRequest, 1)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	messages := make(chan substrate.Message, 1)
+	messages <- bufferMessage("larger")
+	err := sink.sendMessagesToProximo(ctx, stream, messages, newPendingMessages())
+	assert.Equal(t, substrate.OversizeError{Size: 6, MaxBytes: 5}, err)
+	assert.Len(t, stream.sent, 0)
+}
+
+func TestMaxMessageBytes(t *testing.T) {
+	assert.Equal(t, 4*1024*1024-messageOverhead, maxMessageBytes(0, 0))
+	assert.Equal(t, 1024*1024-messageOverhead, maxMessageBytes(0, 1024*1024))
+	assert.Equal(t, 100, maxMessageBytes(100, 1024*1024))
+}
+
+// confirmingServer is an in-process proximo server confirming every message
+// it receives.
+type confirmingServer struct{}
+
+func (confirmingServer) Publish(stream proto.MessageSink_PublishServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if req.Msg == nil {
+			continue
+		}
+		if err := stream.Send(&proto.Confirmation{MsgID: req.Msg.Id}); err != nil {
+			return err
+		}
+	}
+}
+
+// startConfirmingServer serves a confirmingServer on a local port, and
+// returns its address.
+func startConfirmingServer(tb testing.TB) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(tb, err)
+	srv := grpc.NewServer()
+	proto.RegisterMessageSinkServer(srv, confirmingServer{})
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	tb.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+func TestBatchesArePublished(t *testing.T) {
+	sink, err := NewAsyncMessageSink(AsyncMessageSinkConfig{
+		Broker:     startConfirmingServer(t),
+		Topic:      "orders",
+		Insecure:   true,
+		BatchSize:  3,
+		BatchDelay: time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer sink.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	messages := make(chan substrate.Message, 10)
+	acks := make(chan substrate.Message, 10)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishMessages(ctx, acks, messages)
+	}()
+
+	// Two full batches and a partial one are acknowledged in order.
+	for i := 0; i < 7; i++ {
+		messages <- bufferMessage(fmt.Sprint(i))
+	}
+	for i := 0; i < 7; i++ {
+		select {
+		case msg := <-acks:
+			assert.Equal(t, fmt.Sprint(i), string(msg.Data()))
+		case err := <-errs:
+			t.Fatalf("publishing failed: %s", err)
+		}
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+// BenchmarkPublishMessages publishes 100 byte messages to an in-process
+// server, and waits for their acknowledgements, with and without batching.
+func BenchmarkPublishMessages(b *testing.B) {
+	addr := startConfirmingServer(b)
+	payload := bufferMessage(make([]byte, 100))
+	for _, batchSize := range []int{1, 100} {
+		b.Run(fmt.Sprintf("batch-%d", batchSize), func(b *testing.B) {
+			sink, err := NewAsyncMessageSink(AsyncMessageSinkConfig{
+				Broker:     addr,
+				Topic:      "benchmark",
+				Insecure:   true,
+				BatchSize:  batchSize,
+				BatchDelay: time.Millisecond,
+			})
+			require.NoError(b, err)
+			defer sink.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			messages := make(chan substrate.Message, 1024)
+			acks := make(chan substrate.Message, 1024)
+			errs := make(chan error, 1)
+			go func() {
+				errs <- sink.PublishMessages(ctx, acks, messages)
+			}()
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			go func() {
+				for i := 0; i < b.N; i++ {
+					select {
+					case messages <- payload:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+			for i := 0; i < b.N; i++ {
+				select {
+				case <-acks:
+				case err := <-errs:
+					b.Fatalf("publishing failed: %s", err)
+				}
+			}
+			b.StopTimer()
+		})
+	}
+}
+
+func TestFlush(t *testing.T) {
+	sink := &asyncMessageSink{}
+	stream := recordingSendStream{sent: make(chan *proto.PublisherRequest, 2)}
+	pending := newPendingMessages()
+	proximoAcks := make(chan string)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sink.flushes.Start()
+	messages := make(chan substrate.Message)
+	acks := make(chan substrate.Message, 2)
+	go func() {
+		_ = sink.sendMessagesToProximo(ctx, stream, messages, pending)
+	}()
+	go func() {
+		_ = sink.passAcksToUser(ctx, acks, pending, proximoAcks)
+	}()
+
+	messages <- bufferMessage("1")
+	messages <- bufferMessage("2")
+	first, second := <-stream.sent, <-stream.sent
+
+	// The server is slow to confirm the messages.
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- sink.Flush(ctx)
+	}()
+	proximoAcks <- first.Msg.Id
+	select {
+	case err := <-flushed:
+		t.Fatalf("flush returned before all messages were confirmed: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	proximoAcks <- second.Msg.Id
+	assert.NoError(t, <-flushed)
+	assert.Len(t, acks, 2)
+
+	// Messages in flight when publishing fails are failed.
+	messages <- bufferMessage("3")
+	<-stream.sent
+	failure := fmt.Errorf("stream failed")
+	sink.flushes.Stop(failure)
+	assert.Equal(t, failure, sink.Flush(ctx))
+}
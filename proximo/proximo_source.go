@@ -2,7 +2,9 @@ package proximo
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"time"
 
 	"github.com/pkg/errors"
 	"google.golang.org/grpc"
@@ -13,6 +15,7 @@ import (
 	"github.com/uw-labs/sync/rungroup"
 
 	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/helper"
 )
 
 // Offset is the type used to specify the initial subscription offset
@@ -25,52 +28,228 @@ const (
 	OffsetNewest Offset = 2
 )
 
-var _ substrate.AsyncMessageSource = (*asyncMessageSource)(nil)
+var (
+	_ substrate.AsyncMessageSource = (*asyncMessageSource)(nil)
+	_ substrate.ReadinessChecker   = (*asyncMessageSource)(nil)
+)
 
 // AsyncMessageSource represents a proximo message source and implements the
 // substrate.AsyncMessageSource interface.
 type AsyncMessageSourceConfig struct {
-	ConsumerGroup  string
-	Topic          string
+	ConsumerGroup string
+	Topic         string
+	// Namespace, if set, is prepended as it is to Topic, e.g. "billing."
+	// for the topics of a team on a shared cluster. The namespaced topic is
+	// the one reported by Status and errors.
+	Namespace      string
 	Broker         string
 	Offset         Offset
 	Insecure       bool
 	KeepAlive      *KeepAlive
 	MaxRecvMsgSize int
 	Credentials    *Credentials
+	// Reconnect enables re-establishing the stream when it fails, instead of
+	// returning the error from ConsumeMessages.
+	Reconnect *Reconnect
+	// Events is an optional callback receiving connection events. It is
+	// called from a separate goroutine, so a slow callback never blocks
+	// consuming.
+	Events func(Event)
+	// EventBufferSize is the number of events buffered for a slow Events
+	// callback before the oldest ones are dropped. Defaults to 64.
+	EventBufferSize int
+	// LifecycleEvents, if set, receives the connected, disconnected and
+	// reconnected events of the streams to proximo, and a closed event
+	// once the connection is closed. Events are dropped when the channel
+	// is full. See substrate.LifecycleEvent.
+	LifecycleEvents chan<- substrate.LifecycleEvent
+	// DetectCapabilities enables detecting the capabilities of the server
+	// when the source is created, which then fails if the server doesn't
+	// support the configured options.
+	DetectCapabilities bool
+	// ClientName identifies the client to the server, as the gRPC user
+	// agent and in the x-client-name metadata header. Defaults to
+	// "substrate-" followed by the topic.
+	ClientName string
+	// OnMessage and OnAck, if set, are called with the server assigned ID of
+	// each message as it is received from the server, and as it is
+	// acknowledged, before the acknowledgement is confirmed to the server.
+	// They are intended for tracing individual messages, and are called
+	// synchronously, so they must not block.
+	OnMessage func(id string)
+	OnAck     func(id string)
+	// AckStrategy determines when the acknowledged messages are confirmed
+	// to the server. Defaults to confirming every message.
+	AckStrategy AckStrategy
+	// MaxInFlight, if positive, limits the number of messages received from
+	// a stream and not confirmed to the server yet. As the protocol has no
+	// flow control of its own, receiving from the stream is paused while
+	// the limit is reached, so that messages aren't considered delivered by
+	// the server while they wait for a slow consumer. With cumulative
+	// confirmation, the acknowledged messages are confirmed as the limit is
+	// reached, whatever the AckStrategy.
+	MaxInFlight int
+	// Gauges, if set, is sampled with the number of messages delivered and
+	// not acknowledged yet, and of the acknowledgements not processed yet,
+	// e.g. to find where consuming backs up.
+	Gauges substrate.Gauges
+	// ConnPool, if set, is used to share the connection of the source with
+	// the other sources and sinks created with the same broker and
+	// connection options.
+	ConnPool *ConnPool
+	// UseRegisteredDefaults enables applying the defaults registered for
+	// the proximo scheme with the config package to the options that are not
+	// set. It is always set for the sources obtained from suburl.
+	UseRegisteredDefaults bool
+}
+
+// AckStrategy determines when the acknowledged messages of a source are
+// confirmed to the server. The zero value confirms every message as it is
+// acknowledged. Setting Count or Interval enables cumulative confirmation,
+// where only the last of the acknowledged messages is confirmed, once Count
+// messages are acknowledged, or every Interval, whichever comes first. This
+// reduces the traffic for small messages, but requires a server supporting
+// cumulative confirmation, and the acknowledged messages that were not
+// confirmed yet are redelivered when the source terminates or its stream
+// fails.
+type AckStrategy struct {
+	Count    int
+	Interval time.Duration
+}
+
+func (s AckStrategy) cumulative() bool {
+	return s.Count > 0 || s.Interval > 0
 }
 
 func NewAsyncMessageSource(c AsyncMessageSourceConfig) (substrate.AsyncMessageSource, error) {
-	conn, err := dialProximo(dialConfig{
+	if err := c.applyRegisteredDefaults(); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	c.resolveTopic()
+	name := clientName(c.ClientName, c.Topic)
+	conn, closeConn, err := dial(c.ConnPool, dialConfig{
 		broker:         c.Broker,
 		insecure:       c.Insecure,
 		keepAlive:      c.KeepAlive,
 		maxRecvMsgSize: c.MaxRecvMsgSize,
+		userAgent:      name,
 	})
 	if err != nil {
 		return nil, err
 	}
 
+	var caps *Capabilities
+	if c.DetectCapabilities {
+		caps, err = detectCapabilities(setupMetadata(context.Background(), c.Credentials, name), conn)
+		switch {
+		case err != nil:
+		case c.Offset != 0 && !caps.Supports(FeatureOffsetSelection):
+			err = unsupportedFeatureError(FeatureOffsetSelection)
+		case c.AckStrategy.cumulative() && !caps.Supports(FeatureCumulativeConfirmation):
+			err = unsupportedFeatureError(FeatureCumulativeConfirmation)
+		}
+		if err != nil {
+			_ = closeConn()
+			return nil, err
+		}
+	}
+
 	return &asyncMessageSource{
 		conn:          conn,
+		closeConn:     closeConn,
 		consumerGroup: c.ConsumerGroup,
 		topic:         c.Topic,
 		offset:        c.Offset,
 		credentials:   c.Credentials,
+		clientName:    name,
+		reconnect:     c.Reconnect,
+		events:        newEventEmitter(c.Events, c.EventBufferSize),
+		lifecycle:     substrate.NewLifecycleEmitter(c.LifecycleEvents, "proximo", c.Topic),
+		caps:          caps,
+		onMessage:     c.OnMessage,
+		onAck:         c.OnAck,
+		ackStrategy:   c.AckStrategy,
+		maxInFlight:   c.MaxInFlight,
+		gauges:        c.Gauges,
 	}, nil
 }
 
+var _ CapabilitiesReporter = (*asyncMessageSource)(nil)
+
 type asyncMessageSource struct {
 	conn          *grpc.ClientConn
+	closeConn     func() error
 	consumerGroup string
 	topic         string
 	offset        Offset
 	credentials   *Credentials
+	clientName    string
+	reconnect     *Reconnect
+	events        *eventEmitter
+	lifecycle     *substrate.LifecycleEmitter
+	// caps holds the detected capabilities, if detection is enabled.
+	caps        *Capabilities
+	onMessage   func(id string)
+	onAck       func(id string)
+	ackStrategy AckStrategy
+	maxInFlight int
+	gauges      substrate.Gauges
+}
+
+// Message is implemented by the messages delivered by the source, to expose
+// the ID assigned to them by the proximo server, e.g. to correlate
+// acknowledgements with the server logs.
+type Message interface {
+	substrate.Message
+	// ID returns the server assigned ID of the message.
+	ID() string
+}
+
+var _ Message = (*consMsg)(nil)
+
+// consumeStream is a single consume stream, which is done once receiving
+// from it has failed.
+type consumeStream struct {
+	proto.MessageSource_ConsumeClient
+	done chan struct{}
+	// window holds a token for every message received and not confirmed
+	// yet, if MaxInFlight is set.
+	window chan struct{}
+}
+
+// acquire waits until another message may be received from the stream.
+func (cs *consumeStream) acquire(ctx context.Context) error {
+	if cs.window == nil {
+		return nil
+	}
+	select {
+	case cs.window <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release records that n messages received from the stream were confirmed.
+func (cs *consumeStream) release(n int) {
+	for ; cs.window != nil && n > 0; n-- {
+		<-cs.window
+	}
+}
+
+// windowFull returns whether n unconfirmed messages exhaust the window of
+// the stream.
+func (cs *consumeStream) windowFull(n int) bool {
+	return cs.window != nil && n >= cap(cs.window)
 }
 
 type consMsg struct {
-	id string
-	pm *proto.Message
+	id     string
+	pm     *proto.Message
+	stream *consumeStream
 }
 
 func (cm *consMsg) Data() []byte {
@@ -87,16 +266,105 @@ func (cm *consMsg) DiscardPayload() {
 	}
 }
 
-func (cm *consMsg) getMsgID() string {
+// ID implements the Message interface.
+func (cm *consMsg) ID() string {
 	if cm.pm != nil {
 		return cm.pm.Id
 	}
 	return cm.id
 }
 
+// String identifies the message by its ID, e.g. in InvalidAckError.
+func (cm *consMsg) String() string {
+	return fmt.Sprintf("proximo message %s", cm.ID())
+}
+
+// ConsumeMessages consumes messages from proximo. If the stream fails and
+// reconnecting is enabled, messages that were delivered but not yet
+// acknowledged must still be acknowledged in order, but they are not confirmed
+// to proximo as the server redelivers them on the new stream.
 func (ams *asyncMessageSource) ConsumeMessages(ctx context.Context, messages chan<- substrate.Message, acks <-chan substrate.Message) error {
-	rg, ctx := rungroup.New(setupAuthentication(ctx, ams.credentials))
-	client := proto.NewMessageSourceClient(ams.conn)
+	rg, ctx := rungroup.New(setupMetadata(ctx, ams.credentials, ams.clientName))
+	client := newSourceClient(ams.conn)
+
+	toAck := make(chan *consMsg)
+
+	rg.Go(func() error {
+		return ams.processAcks(ctx, toAck, acks)
+	})
+
+	rg.Go(func() error {
+		state := streamState{events: ams.events, lifecycle: ams.lifecycle, reconnect: ams.reconnect}
+		for {
+			err := ams.consumeStream(ctx, client, &state, toAck, messages)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			backoff, ok := state.failed(err)
+			if !ok {
+				return err
+			}
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+var newSourceClient = proto.NewMessageSourceClient
+
+// processAcks confirms the acknowledged messages to proximo, checking that
+// they are acknowledged in the order they were delivered.
+func (ams *asyncMessageSource) processAcks(ctx context.Context, toAck <-chan *consMsg, acks <-chan substrate.Message) error {
+	var toAckList []*consMsg
+	confirmer := &cumulativeConfirmer{ams: ams}
+	ticks, stop := helper.GaugeTicks(ams.gauges)
+	defer stop()
+	var flushTicks <-chan time.Time
+	if ams.ackStrategy.Interval > 0 {
+		ticker := time.NewTicker(ams.ackStrategy.Interval)
+		defer ticker.Stop()
+		flushTicks = ticker.C
+	}
+	for {
+		select {
+		case <-flushTicks:
+			if err := confirmer.flush(ctx); err != nil {
+				return err
+			}
+		case <-ticks:
+			ams.gauges.SetInFlight(len(toAckList))
+			ams.gauges.SetPendingAcks(len(acks))
+		case ta := <-toAck:
+			toAckList = append(toAckList, ta)
+		case a := <-acks:
+			switch {
+			case len(toAckList) == 0:
+				return substrate.InvalidAckError{Acked: a}
+			case !substrate.SameMessage(a, toAckList[0]):
+				return substrate.InvalidAckError{Acked: a, Expected: toAckList[0]}
+			default:
+				if ams.onAck != nil {
+					ams.onAck(toAckList[0].ID())
+				}
+				if err := confirmer.acknowledged(ctx, toAckList[0]); err != nil {
+					return err
+				}
+				toAckList = toAckList[1:]
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (ams *asyncMessageSource) consumeStream(ctx context.Context, client proto.MessageSourceClient, state *streamState, toAck chan<- *consMsg, messages chan<- substrate.Message) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	stream, err := client.Consume(ctx)
 	if err != nil {
@@ -118,74 +386,140 @@ func (ams *asyncMessageSource) ConsumeMessages(ctx context.Context, messages cha
 	}); err != nil {
 		return err
 	}
+	state.established()
 
-	toAck := make(chan *consMsg)
-
-	rg.Go(func() error {
-		defer stream.CloseSend()
+	cs := &consumeStream{MessageSource_ConsumeClient: stream, done: make(chan struct{})}
+	if ams.maxInFlight > 0 {
+		cs.window = make(chan struct{}, ams.maxInFlight)
+	}
+	defer close(cs.done)
 
-		var toAckList []*consMsg
-		for {
-			select {
-			case ta := <-toAck:
-				toAckList = append(toAckList, ta)
-			case a := <-acks:
-				switch {
-				case len(toAckList) == 0:
-					return substrate.InvalidAckError{Acked: a}
-				case a != toAckList[0]:
-					return substrate.InvalidAckError{Acked: a, Expected: toAckList[0]}
-				default:
-					id := toAckList[0].getMsgID()
-					if err := stream.Send(&proto.ConsumerRequest{Confirmation: &proto.Confirmation{MsgID: id}}); err != nil {
-						if err == io.EOF || status.Code(err) == codes.Canceled {
-							if ctx.Err() != nil {
-								return ctx.Err()
-							}
-						}
-						return err
-					}
-					toAckList = toAckList[1:]
+	for {
+		if err := cs.acquire(ctx); err != nil {
+			return err
+		}
+		in, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF || status.Code(err) == codes.Canceled {
+				if ctx.Err() != nil {
+					return ctx.Err()
 				}
-			case <-ctx.Done():
-				return ctx.Err()
 			}
+			return err
 		}
-	})
 
-	rg.Go(func() error {
-		for {
-			in, err := stream.Recv()
-			if err != nil {
-				if err == io.EOF || status.Code(err) == codes.Canceled {
-					if ctx.Err() != nil {
-						return ctx.Err()
-					}
-				}
-				return err
-			}
+		m := &consMsg{pm: in, stream: cs}
+		if ams.onMessage != nil {
+			ams.onMessage(in.GetId())
+		}
+		select {
+		case toAck <- m:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case messages <- m:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
 
-			m := &consMsg{pm: in}
-			select {
-			case toAck <- m:
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-			select {
-			case messages <- m:
-			case <-ctx.Done():
-				return ctx.Err()
-			}
+// cumulativeConfirmer confirms the acknowledged messages according to the ack
+// strategy of the source.
+type cumulativeConfirmer struct {
+	ams *asyncMessageSource
+	// last is the last acknowledged message that was not confirmed yet, and
+	// count the number of acknowledged messages that it confirms.
+	last  *consMsg
+	count int
+}
+
+// acknowledged confirms an acknowledged message, or, with cumulative
+// confirmation, records it to confirm later.
+func (c *cumulativeConfirmer) acknowledged(ctx context.Context, cm *consMsg) error {
+	if !c.ams.ackStrategy.cumulative() {
+		return c.ams.confirm(ctx, cm, 1)
+	}
+	if c.last != nil && c.last.stream != cm.stream {
+		// A confirmation only applies to the messages of its own stream.
+		if err := c.flush(ctx); err != nil {
+			return err
 		}
-	})
+	}
+	c.last = cm
+	c.count++
+	if c.ams.ackStrategy.Count > 0 && c.count >= c.ams.ackStrategy.Count || cm.stream.windowFull(c.count) {
+		return c.flush(ctx)
+	}
+	return nil
+}
 
-	return rg.Wait()
+// flush confirms the last acknowledged message, if it isn't confirmed yet.
+func (c *cumulativeConfirmer) flush(ctx context.Context) error {
+	if c.last == nil {
+		return nil
+	}
+	last, count := c.last, c.count
+	c.last, c.count = nil, 0
+	return c.ams.confirm(ctx, last, count)
+}
+
+// confirm sends the confirmation of an acknowledged message on the stream it
+// was received from, which confirms count messages received from it.
+func (ams *asyncMessageSource) confirm(ctx context.Context, cm *consMsg, count int) error {
+	select {
+	case <-cm.stream.done:
+		// The stream has failed, so the message will be redelivered.
+		return nil
+	default:
+	}
+
+	err := cm.stream.Send(&proto.ConsumerRequest{Confirmation: &proto.Confirmation{MsgID: cm.ID()}})
+	switch {
+	case err == nil:
+		cm.stream.release(count)
+		return nil
+	case (err == io.EOF || status.Code(err) == codes.Canceled) && ctx.Err() != nil:
+		return ctx.Err()
+	case ams.reconnect != nil:
+		// The failure is handled when receiving from the stream fails.
+		return nil
+	default:
+		return err
+	}
+}
+
+// Ready implements the substrate.ReadinessChecker interface. It waits for
+// the gRPC connection to be ready.
+func (ams *asyncMessageSource) Ready(ctx context.Context) error {
+	return waitForReady(ctx, ams.conn)
+}
+
+// Capabilities implements the CapabilitiesReporter interface.
+func (ams *asyncMessageSource) Capabilities() Capabilities {
+	if ams.caps == nil {
+		return Capabilities{}
+	}
+	return *ams.caps
 }
 
 func (ams *asyncMessageSource) Status() (*substrate.Status, error) {
-	return proximoStatus(ams.conn)
+	st, err := proximoStatus(ams.conn)
+	if err != nil {
+		return nil, err
+	}
+	st.Details["topic"] = ams.topic
+	relevant := []Feature{FeatureOffsetSelection}
+	if ams.ackStrategy.cumulative() {
+		relevant = append(relevant, FeatureCumulativeConfirmation)
+	}
+	st.Problems = append(st.Problems, capabilityProblems(ams.caps, relevant...)...)
+	return st, nil
 }
 
 func (ams *asyncMessageSource) Close() error {
-	return ams.conn.Close()
+	err := ams.closeConn()
+	ams.lifecycle.Emit(substrate.LifecycleEvent{Type: substrate.LifecycleClosed, Err: err})
+	return err
 }
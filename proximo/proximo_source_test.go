@@ -0,0 +1,357 @@
+package proximo
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/proximo/proto"
+	"google.golang.org/grpc"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/helper"
+	"github.com/uw-labs/substrate/internal/testshared"
+)
+
+// recordingConsumeStream records the confirmations sent on it.
+type recordingConsumeStream struct {
+	proto.MessageSource_ConsumeClient
+	confirmed chan string
+}
+
+func (s recordingConsumeStream) Send(req *proto.ConsumerRequest) error {
+	s.confirmed <- req.Confirmation.MsgID
+	return nil
+}
+
+func TestProcessAcksTracesMessages(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var acked []string
+	ams := &asyncMessageSource{
+		onAck: func(id string) { acked = append(acked, id) },
+	}
+	stream := &consumeStream{
+		MessageSource_ConsumeClient: recordingConsumeStream{confirmed: make(chan string, 2)},
+		done:                        make(chan struct{}),
+	}
+	m1 := &consMsg{pm: &proto.Message{Id: "id-1", Data: []byte("one")}, stream: stream}
+	m2 := &consMsg{pm: &proto.Message{Id: "id-2", Data: []byte("two")}, stream: stream}
+
+	toAck := make(chan *consMsg)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ams.processAcks(ctx, toAck, acks)
+	}()
+	// The messages are received before they are acknowledged.
+	toAck <- m1
+	toAck <- m2
+
+	var msg Message = m1
+	assert.Equal(t, "id-1", msg.ID())
+	acks <- m1
+	assert.Equal(t, "id-1", <-stream.MessageSource_ConsumeClient.(recordingConsumeStream).confirmed)
+
+	// The IDs identify the messages in InvalidAckError.
+	m1.DiscardPayload()
+	acks <- m1
+	err := <-errs
+	require.IsType(t, substrate.InvalidAckError{}, err)
+	assert.Contains(t, err.Error(), "Expected message 'proximo message id-2' but got 'proximo message id-1'")
+	assert.Equal(t, []string{"id-1"}, acked)
+}
+
+type ackKey struct{}
+
+func TestProcessAcksWrappedMessage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ams := &asyncMessageSource{}
+	confirmed := make(chan string, 1)
+	stream := &consumeStream{
+		MessageSource_ConsumeClient: recordingConsumeStream{confirmed: confirmed},
+		done:                        make(chan struct{}),
+	}
+	m := &consMsg{pm: &proto.Message{Id: "id-1", Data: []byte("one")}, stream: stream}
+
+	toAck := make(chan *consMsg)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ams.processAcks(ctx, toAck, acks)
+	}()
+
+	// Wrappers are acknowledged as the messages they wrap.
+	toAck <- m
+	acks <- substrate.WithValue(m, ackKey{}, 1)
+	assert.Equal(t, "id-1", <-confirmed)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+func TestProcessAcksGauges(t *testing.T) {
+	defer func(interval time.Duration) {
+		helper.GaugesInterval = interval
+	}(helper.GaugesInterval)
+	helper.GaugesInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	gauges := &testshared.Gauges{}
+	ams := &asyncMessageSource{gauges: gauges}
+	stream := &consumeStream{
+		MessageSource_ConsumeClient: recordingConsumeStream{confirmed: make(chan string, 2)},
+		done:                        make(chan struct{}),
+	}
+	m1 := &consMsg{pm: &proto.Message{Id: "id-1"}, stream: stream}
+	m2 := &consMsg{pm: &proto.Message{Id: "id-2"}, stream: stream}
+
+	toAck := make(chan *consMsg, 2)
+	acks := make(chan substrate.Message)
+	toAck <- m1
+	toAck <- m2
+	go func() {
+		_ = ams.processAcks(ctx, toAck, acks)
+	}()
+
+	assert.Eventually(t, func() bool {
+		inFlight, pendingAcks := gauges.Values()
+		return inFlight == 2 && pendingAcks == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	acks <- m1
+	assert.Eventually(t, func() bool {
+		inFlight, _ := gauges.Values()
+		return inFlight == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// cumulativeServer is an in-memory proximo server for a single consumer group,
+// which treats confirmations as cumulative, and delivers the messages after
+// the last confirmed one on every new stream.
+type cumulativeServer struct {
+	messages []*proto.Message
+
+	mu            sync.Mutex
+	confirmed     int
+	confirmations []string
+	// maxOutstanding is the largest number of messages that were delivered
+	// and not confirmed at the same time.
+	maxOutstanding int
+}
+
+func newCumulativeServer(count int) *cumulativeServer {
+	s := &cumulativeServer{}
+	for i := 1; i <= count; i++ {
+		s.messages = append(s.messages, &proto.Message{Id: strconv.Itoa(i)})
+	}
+	return s
+}
+
+func (s *cumulativeServer) Consume(ctx context.Context, opts ...grpc.CallOption) (proto.MessageSource_ConsumeClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &cumulativeStream{ctx: ctx, server: s, pending: s.messages[s.confirmed:]}, nil
+}
+
+func (s *cumulativeServer) confirm(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.confirmations = append(s.confirmations, id)
+	for i, m := range s.messages {
+		if m.Id == id {
+			s.confirmed = i + 1
+		}
+	}
+}
+
+func (s *cumulativeServer) delivered(m *proto.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.messages {
+		if s.messages[i] == m && i+1-s.confirmed > s.maxOutstanding {
+			s.maxOutstanding = i + 1 - s.confirmed
+		}
+	}
+}
+
+func (s *cumulativeServer) getMaxOutstanding() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxOutstanding
+}
+
+func (s *cumulativeServer) getConfirmations() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.confirmations...)
+}
+
+type cumulativeStream struct {
+	proto.MessageSource_ConsumeClient
+	ctx     context.Context
+	server  *cumulativeServer
+	pending []*proto.Message
+}
+
+func (s *cumulativeStream) Send(req *proto.ConsumerRequest) error {
+	if req.Confirmation != nil {
+		s.server.confirm(req.Confirmation.MsgID)
+	}
+	return nil
+}
+
+func (s *cumulativeStream) Recv() (*proto.Message, error) {
+	if len(s.pending) > 0 {
+		m := s.pending[0]
+		s.pending = s.pending[1:]
+		s.server.delivered(m)
+		return m, nil
+	}
+	<-s.ctx.Done()
+	return nil, io.EOF
+}
+
+// consumeIDs consumes count messages from source, acknowledging the first
+// acked ones, and returns their IDs once the acknowledgements are processed.
+func consumeIDs(t *testing.T, source substrate.AsyncMessageSource, count, acked int, processed func() bool) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	var ids []string
+	for len(ids) < count {
+		m := <-msgs
+		ids = append(ids, m.(Message).ID())
+		if len(ids) <= acked {
+			acks <- m
+		}
+	}
+	assert.Eventually(t, processed, 5*time.Second, time.Millisecond)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+	return ids
+}
+
+func TestCumulativeConfirmation(t *testing.T) {
+	server := newCumulativeServer(5)
+	defer func() {
+		newSourceClient = proto.NewMessageSourceClient
+	}()
+	newSourceClient = func(*grpc.ClientConn) proto.MessageSourceClient {
+		return server
+	}
+	source := &asyncMessageSource{ackStrategy: AckStrategy{Count: 2}}
+
+	// Only the second of the three acknowledged messages is confirmed.
+	ids := consumeIDs(t, source, 5, 3, func() bool {
+		return len(server.getConfirmations()) == 1
+	})
+	assert.Equal(t, []string{"1", "2", "3", "4", "5"}, ids)
+	assert.Equal(t, []string{"2"}, server.getConfirmations())
+
+	// The messages after the confirmed one are redelivered, including the
+	// acknowledged one that was not confirmed.
+	ids = consumeIDs(t, source, 3, 3, func() bool {
+		return len(server.getConfirmations()) == 2
+	})
+	assert.Equal(t, []string{"3", "4", "5"}, ids)
+	assert.Equal(t, []string{"2", "4"}, server.getConfirmations())
+}
+
+func TestCumulativeConfirmationInterval(t *testing.T) {
+	server := newCumulativeServer(3)
+	defer func() {
+		newSourceClient = proto.NewMessageSourceClient
+	}()
+	newSourceClient = func(*grpc.ClientConn) proto.MessageSourceClient {
+		return server
+	}
+	source := &asyncMessageSource{ackStrategy: AckStrategy{Interval: 10 * time.Millisecond}}
+
+	consumeIDs(t, source, 3, 2, func() bool {
+		return len(server.getConfirmations()) > 0
+	})
+	assert.Equal(t, []string{"2"}, server.getConfirmations())
+}
+
+func TestMaxInFlight(t *testing.T) {
+	server := newCumulativeServer(10)
+	defer func() {
+		newSourceClient = proto.NewMessageSourceClient
+	}()
+	newSourceClient = func(*grpc.ClientConn) proto.MessageSourceClient {
+		return server
+	}
+	source := &asyncMessageSource{maxInFlight: 2}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msgs := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	// No more messages are received until the first ones are confirmed.
+	m1, m2 := <-msgs, <-msgs
+	select {
+	case m := <-msgs:
+		t.Fatalf("unexpected message %s received before confirming", m.(Message).ID())
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, 2, server.getMaxOutstanding())
+
+	acks <- m1
+	acks <- m2
+	for i := 3; i <= 10; i++ {
+		m := <-msgs
+		assert.Equal(t, strconv.Itoa(i), m.(Message).ID())
+		acks <- m
+	}
+	assert.Eventually(t, func() bool {
+		return len(server.getConfirmations()) == 10
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, 2, server.getMaxOutstanding())
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+func TestMaxInFlightCumulativeConfirmation(t *testing.T) {
+	server := newCumulativeServer(6)
+	defer func() {
+		newSourceClient = proto.NewMessageSourceClient
+	}()
+	newSourceClient = func(*grpc.ClientConn) proto.MessageSourceClient {
+		return server
+	}
+	// The acknowledged messages are confirmed as the window is exhausted,
+	// long before the count of the ack strategy is reached.
+	source := &asyncMessageSource{maxInFlight: 3, ackStrategy: AckStrategy{Count: 100}}
+
+	ids := consumeIDs(t, source, 6, 6, func() bool {
+		return len(server.getConfirmations()) == 2
+	})
+	assert.Equal(t, []string{"1", "2", "3", "4", "5", "6"}, ids)
+	assert.Equal(t, []string{"3", "6"}, server.getConfirmations())
+	assert.Equal(t, 3, server.getMaxOutstanding())
+}
@@ -0,0 +1,58 @@
+package proximo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestClientNameIsPropagated(t *testing.T) {
+	var dialed []dialConfig
+	proximoDialer = func(conf dialConfig) (*grpc.ClientConn, error) {
+		dialed = append(dialed, conf)
+		return nil, nil
+	}
+	defer func() { proximoDialer = dialProximo }()
+
+	sink, err := NewAsyncMessageSink(AsyncMessageSinkConfig{Broker: "localhost:123", Topic: "orders"})
+	require.NoError(t, err)
+	source, err := NewAsyncMessageSource(AsyncMessageSourceConfig{Broker: "localhost:123", Topic: "orders", ConsumerGroup: "billing", ClientName: "billing"})
+	require.NoError(t, err)
+
+	require.Len(t, dialed, 2)
+	assert.Equal(t, "substrate-orders", dialed[0].userAgent)
+	assert.Equal(t, "billing", dialed[1].userAgent)
+	assert.Equal(t, "substrate-orders", sink.(*asyncMessageSink).clientName)
+	assert.Equal(t, "billing", source.(*asyncMessageSource).clientName)
+}
+
+func TestSetupMetadata(t *testing.T) {
+	ctx := setupMetadata(context.Background(), &Credentials{ClientID: "id", Secret: "secret"}, "billing")
+	md, ok := metadata.FromOutgoingContext(ctx)
+	require.True(t, ok)
+	assert.Equal(t, []string{"billing"}, md[clientNameHeader])
+	assert.Equal(t, []string{"Bearer aWQ6c2VjcmV0"}, md["authorization"])
+
+	ctx = context.Background()
+	assert.Equal(t, ctx, setupMetadata(ctx, nil, ""))
+}
+
+func TestNamespace(t *testing.T) {
+	proximoDialer = func(conf dialConfig) (*grpc.ClientConn, error) {
+		return nil, nil
+	}
+	defer func() { proximoDialer = dialProximo }()
+
+	sink, err := NewAsyncMessageSink(AsyncMessageSinkConfig{Broker: "localhost:123", Topic: "orders", Namespace: "billing."})
+	require.NoError(t, err)
+	source, err := NewAsyncMessageSource(AsyncMessageSourceConfig{Broker: "localhost:123", Topic: "orders", ConsumerGroup: "billing", Namespace: "billing."})
+	require.NoError(t, err)
+
+	assert.Equal(t, "billing.orders", sink.(*asyncMessageSink).topic)
+	assert.Equal(t, "substrate-billing.orders", sink.(*asyncMessageSink).clientName)
+	assert.Equal(t, "billing.orders", source.(*asyncMessageSource).topic)
+}
@@ -26,8 +26,10 @@ func newProximoSink(u *url.URL) (substrate.AsyncMessageSink, error) {
 	}
 
 	conf := AsyncMessageSinkConfig{
-		Broker: u.Host,
-		Topic:  topic,
+		Broker:                u.Host,
+		Topic:                 topic,
+		Namespace:             q.Get("namespace"),
+		UseRegisteredDefaults: true,
 	}
 
 	ka, err := keepAliveFromURLValues(q)
@@ -50,6 +52,11 @@ func newProximoSink(u *url.URL) (substrate.AsyncMessageSink, error) {
 		conf.Debug = true
 	}
 
+	if q.Get("detect-capabilities") == "true" {
+		conf.DetectCapabilities = true
+	}
+
+	conf.ClientName = q.Get("client-name")
 	conf.Credentials = credentialsFromURL(*u)
 
 	return proximoSinker(conf)
@@ -78,9 +85,11 @@ func newProximoSource(u *url.URL) (substrate.AsyncMessageSource, error) {
 	}
 
 	conf := AsyncMessageSourceConfig{
-		Broker:        u.Host,
-		ConsumerGroup: q.Get("consumer-group"),
-		Topic:         topic,
+		Broker:                u.Host,
+		ConsumerGroup:         q.Get("consumer-group"),
+		Topic:                 topic,
+		Namespace:             q.Get("namespace"),
+		UseRegisteredDefaults: true,
 	}
 
 	switch q.Get("insecure") {
@@ -116,6 +125,35 @@ func newProximoSource(u *url.URL) (substrate.AsyncMessageSource, error) {
 		conf.MaxRecvMsgSize = size
 	}
 
+	if ackCount := q.Get("ack-count"); ackCount != "" {
+		count, err := strconv.Atoi(ackCount)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse ack-count parameter: %s", err.Error())
+		}
+		conf.AckStrategy.Count = count
+	}
+
+	if ackInterval := q.Get("ack-interval"); ackInterval != "" {
+		interval, err := time.ParseDuration(ackInterval)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse ack-interval parameter: %s", err.Error())
+		}
+		conf.AckStrategy.Interval = interval
+	}
+
+	if maxInFlight := q.Get("max-in-flight"); maxInFlight != "" {
+		max, err := strconv.Atoi(maxInFlight)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse max-in-flight parameter: %s", err.Error())
+		}
+		conf.MaxInFlight = max
+	}
+
+	if q.Get("detect-capabilities") == "true" {
+		conf.DetectCapabilities = true
+	}
+
+	conf.ClientName = q.Get("client-name")
 	conf.Credentials = credentialsFromURL(*u)
 	return proximoSourcer(conf)
 }
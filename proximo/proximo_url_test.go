@@ -36,6 +36,16 @@ func TestProximoSink(t *testing.T) {
 			},
 			expectedErr: nil,
 		},
+		{
+			name:  "namespaced",
+			input: "proximo://localhost:123/t1?namespace=billing.",
+			expected: AsyncMessageSinkConfig{
+				Broker:    "localhost:123",
+				Topic:     "t1",
+				Namespace: "billing.",
+			},
+			expectedErr: nil,
+		},
 		{
 			name:  "with-keep-alive",
 			input: "proximo://localhost:123/t1?keep-alive-time=60m",
@@ -70,6 +80,24 @@ func TestProximoSink(t *testing.T) {
 			},
 			expectedErr: nil,
 		},
+		{
+			name:  "detect-capabilities",
+			input: "proximo://localhost:123/t1?detect-capabilities=true",
+			expected: AsyncMessageSinkConfig{
+				Broker:             "localhost:123",
+				Topic:              "t1",
+				DetectCapabilities: true,
+			},
+		},
+		{
+			name:  "client-name",
+			input: "proximo://localhost:123/t1?client-name=billing",
+			expected: AsyncMessageSinkConfig{
+				Broker:     "localhost:123",
+				Topic:      "t1",
+				ClientName: "billing",
+			},
+		},
 		{
 			name:  "withdebug",
 			input: "proximo://localhost:123/t1?debug=true",
@@ -133,6 +161,9 @@ func TestProximoSink(t *testing.T) {
 			if tst.expectedErr != err {
 				t.Errorf("expected error %v but got %v", tst.expectedErr, err)
 			}
+			if err == nil {
+				tst.expected.UseRegisteredDefaults = true
+			}
 
 			assert.Equal(tst.expected, conf)
 		})
@@ -165,6 +196,16 @@ func TestProximoSource(t *testing.T) {
 			},
 			expectedErr: nil,
 		},
+		{
+			name:  "namespaced",
+			input: "proximo://localhost:123/t1?namespace=billing.",
+			expected: AsyncMessageSourceConfig{
+				Broker:    "localhost:123",
+				Topic:     "t1",
+				Namespace: "billing.",
+			},
+			expectedErr: nil,
+		},
 		{
 			name:  "insecure",
 			input: "proximo://localhost:123/t1?insecure=true",
@@ -175,6 +216,24 @@ func TestProximoSource(t *testing.T) {
 			},
 			expectedErr: nil,
 		},
+		{
+			name:  "detect-capabilities",
+			input: "proximo://localhost:123/t1?detect-capabilities=true",
+			expected: AsyncMessageSourceConfig{
+				Broker:             "localhost:123",
+				Topic:              "t1",
+				DetectCapabilities: true,
+			},
+		},
+		{
+			name:  "client-name",
+			input: "proximo://localhost:123/t1?client-name=billing",
+			expected: AsyncMessageSourceConfig{
+				Broker:     "localhost:123",
+				Topic:      "t1",
+				ClientName: "billing",
+			},
+		},
 		{
 			name:  "with-keep-alive",
 			input: "proximo://localhost:123/t1?keep-alive-time=60m",
@@ -235,6 +294,27 @@ func TestProximoSource(t *testing.T) {
 			},
 			expectedErr: nil,
 		},
+		{
+			name:  "ack-strategy",
+			input: "proximo://localhost:123/t1?ack-count=100&ack-interval=2s",
+			expected: AsyncMessageSourceConfig{
+				Broker: "localhost:123",
+				Topic:  "t1",
+				AckStrategy: AckStrategy{
+					Count:    100,
+					Interval: 2 * time.Second,
+				},
+			},
+		},
+		{
+			name:  "max-in-flight",
+			input: "proximo://localhost:123/t1?max-in-flight=10",
+			expected: AsyncMessageSourceConfig{
+				Broker:      "localhost:123",
+				Topic:       "t1",
+				MaxInFlight: 10,
+			},
+		},
 		{
 			name:  "everything",
 			input: "proximo://localhost:123/t1/?offset=newest&consumer-group=g1",
@@ -260,6 +340,9 @@ func TestProximoSource(t *testing.T) {
 			if tst.expectedErr != err {
 				t.Errorf("expected error %v but got %v", tst.expectedErr, err)
 			}
+			if err == nil {
+				tst.expected.UseRegisteredDefaults = true
+			}
 
 			assert.Equal(tst.expected, conf)
 		})
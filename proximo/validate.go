@@ -0,0 +1,58 @@
+package proximo
+
+import "github.com/uw-labs/substrate/internal/validate"
+
+// Validate returns an error listing the problems of the config, if any, such
+// as "proximo: AsyncMessageSourceConfig.ConsumerGroup must not be empty". It
+// is called by NewAsyncMessageSource, once the registered defaults are
+// applied.
+func (c AsyncMessageSourceConfig) Validate() error {
+	p := validate.New("proximo", "AsyncMessageSourceConfig")
+	p.NotEmpty(c.Broker, "Broker")
+	p.NotEmpty(c.Topic, "Topic")
+	p.NotEmpty(c.ConsumerGroup, "ConsumerGroup")
+	p.Check(c.Offset == 0 || c.Offset == OffsetOldest || c.Offset == OffsetNewest, "Offset", "must be either OffsetOldest or OffsetNewest")
+	checkKeepAlive(p, c.KeepAlive)
+	p.NotNegative(c.MaxRecvMsgSize, "MaxRecvMsgSize")
+	checkReconnect(p, c.Reconnect)
+	p.NotNegative(c.EventBufferSize, "EventBufferSize")
+	p.NotNegative(c.AckStrategy.Count, "AckStrategy.Count")
+	p.NotNegativeDuration(c.AckStrategy.Interval, "AckStrategy.Interval")
+	p.NotNegative(c.MaxInFlight, "MaxInFlight")
+	return p.Err()
+}
+
+// Validate returns an error listing the problems of the config, if any, such
+// as "proximo: AsyncMessageSinkConfig.Topic must not be empty". It is called
+// by NewAsyncMessageSink, once the registered defaults are applied.
+func (c AsyncMessageSinkConfig) Validate() error {
+	p := validate.New("proximo", "AsyncMessageSinkConfig")
+	p.NotEmpty(c.Broker, "Broker")
+	p.NotEmpty(c.Topic, "Topic")
+	checkKeepAlive(p, c.KeepAlive)
+	checkReconnect(p, c.Reconnect)
+	p.NotNegative(c.EventBufferSize, "EventBufferSize")
+	p.NotNegative(c.BatchSize, "BatchSize")
+	p.NotNegativeDuration(c.BatchDelay, "BatchDelay")
+	p.NotNegative(c.MaxSendMsgSize, "MaxSendMsgSize")
+	p.NotNegative(c.MaxMessageBytes, "MaxMessageBytes")
+	p.Check(c.MaxSendMsgSize == 0 || c.MaxMessageBytes < c.MaxSendMsgSize, "MaxMessageBytes", "must be less than MaxSendMsgSize")
+	return p.Err()
+}
+
+func checkKeepAlive(p *validate.Problems, ka *KeepAlive) {
+	if ka == nil {
+		return
+	}
+	p.NotNegativeDuration(ka.Time, "KeepAlive.Time")
+	p.NotNegativeDuration(ka.Timeout, "KeepAlive.Timeout")
+}
+
+func checkReconnect(p *validate.Problems, r *Reconnect) {
+	if r == nil {
+		return
+	}
+	p.NotNegativeDuration(r.Backoff, "Reconnect.Backoff")
+	p.NotNegativeDuration(r.MaxBackoff, "Reconnect.MaxBackoff")
+	p.NotNegative(r.MaxAttempts, "Reconnect.MaxAttempts")
+}
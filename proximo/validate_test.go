@@ -0,0 +1,227 @@
+package proximo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/uw-labs/substrate/suburl"
+)
+
+func TestAsyncMessageSourceConfigValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(*AsyncMessageSourceConfig)
+		expected string
+	}{
+		{
+			name:   "valid",
+			modify: func(c *AsyncMessageSourceConfig) {},
+		},
+		{
+			name: "valid with options",
+			modify: func(c *AsyncMessageSourceConfig) {
+				c.Offset = OffsetOldest
+				c.KeepAlive = &KeepAlive{Time: time.Minute, Timeout: 10 * time.Second}
+				c.Reconnect = &Reconnect{Backoff: time.Second, MaxAttempts: 10}
+				c.AckStrategy = AckStrategy{Count: 100, Interval: time.Second}
+				c.MaxInFlight = 10
+			},
+		},
+		{
+			name:     "no broker",
+			modify:   func(c *AsyncMessageSourceConfig) { c.Broker = "" },
+			expected: "proximo: AsyncMessageSourceConfig.Broker must not be empty",
+		},
+		{
+			name:     "no topic",
+			modify:   func(c *AsyncMessageSourceConfig) { c.Topic = "" },
+			expected: "proximo: AsyncMessageSourceConfig.Topic must not be empty",
+		},
+		{
+			name:     "no consumer group",
+			modify:   func(c *AsyncMessageSourceConfig) { c.ConsumerGroup = "" },
+			expected: "proximo: AsyncMessageSourceConfig.ConsumerGroup must not be empty",
+		},
+		{
+			name:     "offset",
+			modify:   func(c *AsyncMessageSourceConfig) { c.Offset = 3 },
+			expected: "proximo: AsyncMessageSourceConfig.Offset must be either OffsetOldest or OffsetNewest",
+		},
+		{
+			name:     "keep alive time",
+			modify:   func(c *AsyncMessageSourceConfig) { c.KeepAlive = &KeepAlive{Time: -time.Second} },
+			expected: "proximo: AsyncMessageSourceConfig.KeepAlive.Time must not be negative",
+		},
+		{
+			name:     "keep alive timeout",
+			modify:   func(c *AsyncMessageSourceConfig) { c.KeepAlive = &KeepAlive{Timeout: -time.Second} },
+			expected: "proximo: AsyncMessageSourceConfig.KeepAlive.Timeout must not be negative",
+		},
+		{
+			name:     "max recv msg size",
+			modify:   func(c *AsyncMessageSourceConfig) { c.MaxRecvMsgSize = -1 },
+			expected: "proximo: AsyncMessageSourceConfig.MaxRecvMsgSize must not be negative",
+		},
+		{
+			name:     "reconnect backoff",
+			modify:   func(c *AsyncMessageSourceConfig) { c.Reconnect = &Reconnect{Backoff: -time.Second} },
+			expected: "proximo: AsyncMessageSourceConfig.Reconnect.Backoff must not be negative",
+		},
+		{
+			name:     "reconnect max backoff",
+			modify:   func(c *AsyncMessageSourceConfig) { c.Reconnect = &Reconnect{MaxBackoff: -time.Second} },
+			expected: "proximo: AsyncMessageSourceConfig.Reconnect.MaxBackoff must not be negative",
+		},
+		{
+			name:     "reconnect max attempts",
+			modify:   func(c *AsyncMessageSourceConfig) { c.Reconnect = &Reconnect{MaxAttempts: -1} },
+			expected: "proximo: AsyncMessageSourceConfig.Reconnect.MaxAttempts must not be negative",
+		},
+		{
+			name:     "event buffer size",
+			modify:   func(c *AsyncMessageSourceConfig) { c.EventBufferSize = -1 },
+			expected: "proximo: AsyncMessageSourceConfig.EventBufferSize must not be negative",
+		},
+		{
+			name:     "ack count",
+			modify:   func(c *AsyncMessageSourceConfig) { c.AckStrategy.Count = -1 },
+			expected: "proximo: AsyncMessageSourceConfig.AckStrategy.Count must not be negative",
+		},
+		{
+			name:     "ack interval",
+			modify:   func(c *AsyncMessageSourceConfig) { c.AckStrategy.Interval = -time.Second },
+			expected: "proximo: AsyncMessageSourceConfig.AckStrategy.Interval must not be negative",
+		},
+		{
+			name:     "max in flight",
+			modify:   func(c *AsyncMessageSourceConfig) { c.MaxInFlight = -1 },
+			expected: "proximo: AsyncMessageSourceConfig.MaxInFlight must not be negative",
+		},
+		{
+			name: "every problem",
+			modify: func(c *AsyncMessageSourceConfig) {
+				c.Broker, c.ConsumerGroup = "", ""
+			},
+			expected: "2 problems: " +
+				"proximo: AsyncMessageSourceConfig.Broker must not be empty; " +
+				"proximo: AsyncMessageSourceConfig.ConsumerGroup must not be empty",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			c := AsyncMessageSourceConfig{Broker: "localhost:123", Topic: "t1", ConsumerGroup: "g1"}
+			tst.modify(&c)
+			err := c.Validate()
+			if tst.expected == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tst.expected)
+			_, err = NewAsyncMessageSource(c)
+			assert.EqualError(t, err, tst.expected)
+		})
+	}
+}
+
+func TestAsyncMessageSinkConfigValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(*AsyncMessageSinkConfig)
+		expected string
+	}{
+		{
+			name:   "valid",
+			modify: func(c *AsyncMessageSinkConfig) {},
+		},
+		{
+			name: "valid with options",
+			modify: func(c *AsyncMessageSinkConfig) {
+				c.BatchSize = 10
+				c.BatchDelay = time.Millisecond
+				c.MaxSendMsgSize = 4 << 20
+				c.MaxMessageBytes = 1 << 20
+			},
+		},
+		{
+			name:     "no broker",
+			modify:   func(c *AsyncMessageSinkConfig) { c.Broker = "" },
+			expected: "proximo: AsyncMessageSinkConfig.Broker must not be empty",
+		},
+		{
+			name:     "no topic",
+			modify:   func(c *AsyncMessageSinkConfig) { c.Topic = "" },
+			expected: "proximo: AsyncMessageSinkConfig.Topic must not be empty",
+		},
+		{
+			name:     "keep alive time",
+			modify:   func(c *AsyncMessageSinkConfig) { c.KeepAlive = &KeepAlive{Time: -time.Second} },
+			expected: "proximo: AsyncMessageSinkConfig.KeepAlive.Time must not be negative",
+		},
+		{
+			name:     "reconnect backoff",
+			modify:   func(c *AsyncMessageSinkConfig) { c.Reconnect = &Reconnect{Backoff: -time.Second} },
+			expected: "proximo: AsyncMessageSinkConfig.Reconnect.Backoff must not be negative",
+		},
+		{
+			name:     "event buffer size",
+			modify:   func(c *AsyncMessageSinkConfig) { c.EventBufferSize = -1 },
+			expected: "proximo: AsyncMessageSinkConfig.EventBufferSize must not be negative",
+		},
+		{
+			name:     "batch size",
+			modify:   func(c *AsyncMessageSinkConfig) { c.BatchSize = -1 },
+			expected: "proximo: AsyncMessageSinkConfig.BatchSize must not be negative",
+		},
+		{
+			name:     "batch delay",
+			modify:   func(c *AsyncMessageSinkConfig) { c.BatchDelay = -time.Millisecond },
+			expected: "proximo: AsyncMessageSinkConfig.BatchDelay must not be negative",
+		},
+		{
+			name:     "max send msg size",
+			modify:   func(c *AsyncMessageSinkConfig) { c.MaxSendMsgSize = -1 },
+			expected: "proximo: AsyncMessageSinkConfig.MaxSendMsgSize must not be negative",
+		},
+		{
+			name:     "max message bytes",
+			modify:   func(c *AsyncMessageSinkConfig) { c.MaxMessageBytes = -1 },
+			expected: "proximo: AsyncMessageSinkConfig.MaxMessageBytes must not be negative",
+		},
+		{
+			name:     "max message bytes above max send msg size",
+			modify:   func(c *AsyncMessageSinkConfig) { c.MaxSendMsgSize, c.MaxMessageBytes = 1024, 2048 },
+			expected: "proximo: AsyncMessageSinkConfig.MaxMessageBytes must be less than MaxSendMsgSize",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			c := AsyncMessageSinkConfig{Broker: "localhost:123", Topic: "t1"}
+			tst.modify(&c)
+			err := c.Validate()
+			if tst.expected == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tst.expected)
+			_, err = NewAsyncMessageSink(c)
+			assert.EqualError(t, err, tst.expected)
+		})
+	}
+}
+
+func TestURLValidationErrors(t *testing.T) {
+	defer func() {
+		proximoSourcer = NewAsyncMessageSource
+	}()
+	proximoSourcer = NewAsyncMessageSource
+
+	// The problems of the config are reported as they are.
+	_, err := suburl.NewSource("proximo://localhost:123/t1?ack-count=-1")
+	assert.EqualError(t, err, "2 problems: "+
+		"proximo: AsyncMessageSourceConfig.ConsumerGroup must not be empty; "+
+		"proximo: AsyncMessageSourceConfig.AckStrategy.Count must not be negative")
+}
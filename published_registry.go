@@ -0,0 +1,72 @@
+package substrate
+
+import (
+	"container/list"
+	"sync"
+)
+
+// PublishedRegistry records the IDs of the messages written by a sink, as
+// soon as the backend acknowledges them, so that sinks republishing the
+// messages in flight, e.g. after a reconnect or a failover, skip the ones
+// that were written but not acknowledged to the caller yet, rather than
+// writing them twice. The IDs are returned by an IDFunc set along with the
+// registry.
+type PublishedRegistry interface {
+	// Seen reports whether the message with the ID was marked.
+	Seen(id string) (bool, error)
+	// Mark records that the message with the ID was written.
+	Mark(id string) error
+}
+
+var _ PublishedRegistry = (*LRUPublishedRegistry)(nil)
+
+// LRUPublishedRegistry is an in-memory PublishedRegistry, which remembers
+// the most recently marked IDs. It only covers republishing within a process,
+// unlike a registry shared between processes, such as the one of the
+// redisstore package.
+type LRUPublishedRegistry struct {
+	size int
+
+	mu    sync.Mutex
+	order *list.List
+	ids   map[string]*list.Element
+}
+
+// NewLRUPublishedRegistry returns a registry remembering the last size IDs
+// marked, which should be more than the number of messages a sink can have in
+// flight.
+func NewLRUPublishedRegistry(size int) *LRUPublishedRegistry {
+	if size <= 0 {
+		size = 1
+	}
+	return &LRUPublishedRegistry{
+		size:  size,
+		order: list.New(),
+		ids:   make(map[string]*list.Element, size),
+	}
+}
+
+// Seen implements the Seen method of the PublishedRegistry interface.
+func (r *LRUPublishedRegistry) Seen(id string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.ids[id]
+	return ok, nil
+}
+
+// Mark implements the Mark method of the PublishedRegistry interface.
+func (r *LRUPublishedRegistry) Mark(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.ids[id]; ok {
+		r.order.MoveToFront(e)
+		return nil
+	}
+	r.ids[id] = r.order.PushFront(id)
+	if r.order.Len() > r.size {
+		oldest := r.order.Back()
+		r.order.Remove(oldest)
+		delete(r.ids, oldest.Value.(string))
+	}
+	return nil
+}
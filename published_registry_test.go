@@ -0,0 +1,24 @@
+package substrate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUPublishedRegistry(t *testing.T) {
+	registry := NewLRUPublishedRegistry(2)
+	require.NoError(t, registry.Mark("a"))
+	require.NoError(t, registry.Mark("b"))
+	// Marking a again makes b the least recently marked ID, which is
+	// evicted by c.
+	require.NoError(t, registry.Mark("a"))
+	require.NoError(t, registry.Mark("c"))
+
+	for id, expected := range map[string]bool{"a": true, "b": false, "c": true, "d": false} {
+		seen, err := registry.Seen(id)
+		require.NoError(t, err)
+		assert.Equal(t, expected, seen, id)
+	}
+}
@@ -0,0 +1,477 @@
+package substrate
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/uw-labs/sync/rungroup"
+)
+
+// A recording starts with a magic value and a version byte, followed by a
+// record for every delivered and every acknowledged message, in the order
+// they happened. Each record is its kind, the length of its body and its
+// body. The body of a delivered record is the sequence number of the message,
+// the delivery time in unix nanoseconds, the length prefixed key, the number
+// of attributes, the length prefixed key and value of every attribute, and
+// the length prefixed payload. The body of an acknowledged record is the
+// sequence number of the message and the acknowledgement time. Numbers are
+// encoded as varints.
+const (
+	recordingMagic   = "SUBSTREC"
+	recordingVersion = 1
+
+	recordDelivered byte = 'D'
+	recordAcked     byte = 'A'
+
+	defaultMaxRecordBytes = 64 * 1024 * 1024
+)
+
+// ErrInvalidRecording is returned by a replay source for a stream that is not
+// a recording of a supported version, or that can not be parsed.
+var ErrInvalidRecording = errors.New("invalid recording")
+
+// NewRecordingSource returns a source that writes every message delivered
+// from source to w, along with the time it was delivered and the time it was
+// acknowledged, so that the stream can be replayed with NewReplaySource, e.g.
+// to reproduce a bug locally. Every delivery and acknowledgement is written
+// to w as it happens, with a single call to Write, so that a recording is
+// usable up to the point where the process stopped. Consuming terminates if
+// writing fails. When Close is called on the returned source, this is also
+// propagated to source, but not to w.
+func NewRecordingSource(source AsyncMessageSource, w io.Writer) AsyncMessageSource {
+	return &recordingSource{
+		source: source,
+		w:      w,
+	}
+}
+
+type recordingSource struct {
+	source AsyncMessageSource
+
+	mu            sync.Mutex
+	w             io.Writer
+	headerWritten bool
+	seq           uint64
+}
+
+// recordedMessage is a delivered message awaiting its acknowledgement.
+type recordedMessage struct {
+	msg Message
+	seq uint64
+}
+
+func (s *recordingSource) ConsumeMessages(ctx context.Context, messages chan<- Message, acks <-chan Message) error {
+	rg, ctx := rungroup.New(ctx)
+
+	fromInner := make(chan Message, cap(messages))
+	toInner := make(chan Message, cap(acks))
+	needAcks := make(chan recordedMessage, 1024)
+
+	rg.Go(func() error {
+		return s.source.ConsumeMessages(ctx, fromInner, toInner)
+	})
+
+	rg.Go(func() error {
+		for {
+			var msg Message
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case msg = <-fromInner:
+			}
+			// The message is encoded before it is delivered, as its
+			// payload may be discarded once it is.
+			seq, contents := s.encode(msg)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case messages <- msg:
+			}
+			body := appendVarint(appendUvarint(nil, seq), time.Now().UnixNano())
+			if err := s.write(recordDelivered, append(body, contents...)); err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case needAcks <- recordedMessage{msg: msg, seq: seq}:
+			}
+		}
+	})
+
+	rg.Go(func() error {
+		for {
+			var rm recordedMessage
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case rm = <-needAcks:
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case ack := <-acks:
+				if !SameMessage(ack, rm.msg) {
+					return InvalidAckError{Acked: ack, Expected: rm.msg}
+				}
+			}
+			if err := s.write(recordAcked, appendVarint(appendUvarint(nil, rm.seq), time.Now().UnixNano())); err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case toInner <- rm.msg:
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+// encode assigns the message its sequence number, and encodes its key,
+// attributes and payload.
+func (s *recordingSource) encode(msg Message) (uint64, []byte) {
+	var key []byte
+	if km, ok := msg.(KeyedMessage); ok {
+		key = km.Key()
+	}
+	var attrs map[string]string
+	if am, ok := msg.(AttributedMessage); ok {
+		attrs = am.Attributes()
+	}
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := appendLengthPrefixed(nil, key)
+	out = appendUvarint(out, uint64(len(keys)))
+	for _, k := range keys {
+		out = appendLengthPrefixed(out, []byte(k))
+		out = appendLengthPrefixed(out, []byte(attrs[k]))
+	}
+	out = appendLengthPrefixed(out, msg.Data())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seq := s.seq
+	s.seq++
+	return seq, out
+}
+
+// write writes a record, preceded by the header if it is the first one.
+func (s *recordingSource) write(kind byte, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []byte
+	if !s.headerWritten {
+		out = append([]byte(recordingMagic), recordingVersion)
+	}
+	out = append(out, kind)
+	out = appendLengthPrefixed(out, body)
+	if _, err := s.w.Write(out); err != nil {
+		return fmt.Errorf("failed to write recording: %w", err)
+	}
+	s.headerWritten = true
+	return nil
+}
+
+// Close closes the underlying source.
+func (s *recordingSource) Close() error {
+	return s.source.Close()
+}
+
+// Status returns the status of the underlying source.
+func (s *recordingSource) Status() (*Status, error) {
+	return s.source.Status()
+}
+
+// ReplayOptions are the options of a replay source.
+type ReplayOptions struct {
+	// OriginalTiming delays the delivery of every message by the time
+	// between its original delivery and the original delivery of the
+	// message before it. Otherwise, messages are delivered as fast as
+	// possible.
+	OriginalTiming bool
+	// MaxRecordBytes is the maximum size of a record, which is slightly
+	// larger than the message it holds. Defaults to 64MiB.
+	MaxRecordBytes int
+}
+
+// NewReplaySource returns a source delivering the messages of a recording
+// written by a source returned by NewRecordingSource. The delivered messages
+// have the payload, key and attributes of the recorded messages, and expose
+// the time they were originally delivered through the ReplayedMessage
+// interface. Recorded acknowledgements are not replayed, but
+// acknowledgements are still required in order. ConsumeMessages returns nil
+// once the recording is exhausted and all the delivered messages have been
+// acknowledged, or ErrInvalidRecording if r is not a recording. Recordings cut
+// short by a stopped process are replayed up to their last complete record.
+func NewReplaySource(r io.Reader, opts ReplayOptions) AsyncMessageSource {
+	if opts.MaxRecordBytes <= 0 {
+		opts.MaxRecordBytes = defaultMaxRecordBytes
+	}
+	return &replaySource{
+		r:    bufio.NewReader(r),
+		opts: opts,
+	}
+}
+
+// ReplayedMessage is implemented by the messages delivered by replay sources.
+type ReplayedMessage interface {
+	KeyedMessage
+	AttributedMessage
+	// DeliveredAt returns the time the message was originally delivered.
+	DeliveredAt() time.Time
+}
+
+var _ ReplayedMessage = (*replayedMessage)(nil)
+
+type replayedMessage struct {
+	data        []byte
+	key         []byte
+	attrs       map[string]string
+	deliveredAt time.Time
+}
+
+func (m *replayedMessage) Data() []byte {
+	return m.data
+}
+
+func (m *replayedMessage) Key() []byte {
+	return m.key
+}
+
+func (m *replayedMessage) Attributes() map[string]string {
+	return m.attrs
+}
+
+func (m *replayedMessage) DeliveredAt() time.Time {
+	return m.deliveredAt
+}
+
+type replaySource struct {
+	r    *bufio.Reader
+	opts ReplayOptions
+
+	headerRead bool
+	exhausted  bool
+	// next is a message read but not delivered before the last call to
+	// ConsumeMessages returned.
+	next *replayedMessage
+	// last is the original delivery time of the last replayed message, and
+	// lastReplayed is the time it was replayed.
+	last         time.Time
+	lastReplayed time.Time
+}
+
+func (s *replaySource) ConsumeMessages(ctx context.Context, messages chan<- Message, acks <-chan Message) error {
+	var inFlight []Message
+	for {
+		if s.next == nil && !s.exhausted {
+			msg, err := s.read()
+			switch {
+			case err == io.EOF:
+				s.exhausted = true
+			case err != nil:
+				return err
+			default:
+				s.next = msg
+			}
+		}
+		if s.next == nil && len(inFlight) == 0 {
+			return nil
+		}
+
+		var (
+			toClient chan<- Message
+			timer    *time.Timer
+			delay    <-chan time.Time
+		)
+		if s.next != nil {
+			if wait := s.wait(); wait > 0 {
+				timer = time.NewTimer(wait)
+				delay = timer.C
+			} else {
+				toClient = messages
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-delay:
+		case toClient <- s.next:
+			inFlight = append(inFlight, s.next)
+			s.last, s.lastReplayed = s.next.deliveredAt, time.Now()
+			s.next = nil
+		case ack := <-acks:
+			if len(inFlight) == 0 {
+				return InvalidAckError{Acked: ack}
+			}
+			if !SameMessage(ack, inFlight[0]) {
+				return InvalidAckError{Acked: ack, Expected: inFlight[0]}
+			}
+			inFlight = inFlight[1:]
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// wait returns how long to wait before delivering the next message, which
+// is due after the original time between the deliveries has passed since the
+// last message was replayed.
+func (s *replaySource) wait() time.Duration {
+	if !s.opts.OriginalTiming || s.lastReplayed.IsZero() {
+		return 0
+	}
+	return time.Until(s.lastReplayed.Add(s.next.deliveredAt.Sub(s.last)))
+}
+
+// read reads the next delivered record, skipping the other records. It
+// returns io.EOF once the recording is exhausted.
+func (s *replaySource) read() (*replayedMessage, error) {
+	if !s.headerRead {
+		header := make([]byte, len(recordingMagic)+1)
+		if _, err := io.ReadFull(s.r, header); err != nil {
+			if err == io.EOF {
+				// An empty recording has no messages.
+				return nil, io.EOF
+			}
+			return nil, ErrInvalidRecording
+		}
+		if string(header[:len(recordingMagic)]) != recordingMagic || header[len(recordingMagic)] != recordingVersion {
+			return nil, ErrInvalidRecording
+		}
+		s.headerRead = true
+	}
+
+	for {
+		kind, err := s.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, fmt.Errorf("failed to read recording: %w", err)
+		}
+		size, err := binary.ReadUvarint(s.r)
+		if err != nil {
+			return nil, truncated(err)
+		}
+		if size > uint64(s.opts.MaxRecordBytes) {
+			return nil, fmt.Errorf("%w: record of %d bytes exceeds the limit of %d bytes", ErrInvalidRecording, size, s.opts.MaxRecordBytes)
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(s.r, body); err != nil {
+			return nil, truncated(err)
+		}
+		if kind != recordDelivered {
+			continue
+		}
+		msg, ok := decodeDelivered(body)
+		if !ok {
+			return nil, ErrInvalidRecording
+		}
+		return msg, nil
+	}
+}
+
+// truncated treats a record cut short as the end of the recording.
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	return fmt.Errorf("failed to read recording: %w", err)
+}
+
+func decodeDelivered(body []byte) (*replayedMessage, bool) {
+	_, n := binary.Uvarint(body)
+	if n <= 0 {
+		return nil, false
+	}
+	body = body[n:]
+	at, n := binary.Varint(body)
+	if n <= 0 {
+		return nil, false
+	}
+	body = body[n:]
+
+	msg := &replayedMessage{deliveredAt: time.Unix(0, at)}
+	var ok bool
+	if msg.key, body, ok = readLengthPrefixed(body); !ok {
+		return nil, false
+	}
+	if len(msg.key) == 0 {
+		msg.key = nil
+	}
+	count, n := binary.Uvarint(body)
+	// Every attribute takes at least two bytes, which bounds the count
+	// before anything is allocated for it.
+	if n <= 0 || count > uint64(len(body)-n)/2 {
+		return nil, false
+	}
+	body = body[n:]
+	if count > 0 {
+		msg.attrs = make(map[string]string, count)
+	}
+	for i := uint64(0); i < count; i++ {
+		var k, v []byte
+		if k, body, ok = readLengthPrefixed(body); !ok {
+			return nil, false
+		}
+		if v, body, ok = readLengthPrefixed(body); !ok {
+			return nil, false
+		}
+		msg.attrs[string(k)] = string(v)
+	}
+	if msg.data, body, ok = readLengthPrefixed(body); !ok || len(body) != 0 {
+		return nil, false
+	}
+	return msg, true
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+func appendLengthPrefixed(b []byte, value []byte) []byte {
+	return append(appendUvarint(b, uint64(len(value))), value...)
+}
+
+// readLengthPrefixed reads a length prefixed byte string.
+func readLengthPrefixed(b []byte) (value []byte, rest []byte, ok bool) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || l > uint64(len(b)-n) {
+		return nil, nil, false
+	}
+	end := n + int(l)
+	return b[n:end], b[end:], true
+}
+
+// Close has no effect, as the reader is owned by the caller.
+func (s *replaySource) Close() error {
+	return nil
+}
+
+// Status always reports a working source.
+func (s *replaySource) Status() (*Status, error) {
+	return &Status{Working: true}, nil
+}
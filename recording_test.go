@@ -0,0 +1,175 @@
+package substrate
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordedTestMessage struct {
+	data  []byte
+	key   []byte
+	attrs map[string]string
+}
+
+func (m *recordedTestMessage) Data() []byte {
+	return m.data
+}
+
+func (m *recordedTestMessage) Key() []byte {
+	return m.key
+}
+
+func (m *recordedTestMessage) Attributes() map[string]string {
+	return m.attrs
+}
+
+// consumeAndAck consumes messages from source until it returns, or until
+// count messages have been acknowledged.
+func consumeAndAck(ctx context.Context, source AsyncMessageSource, count int) ([]Message, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	var consumed []Message
+	for len(consumed) < count {
+		select {
+		case m := <-msgs:
+			consumed = append(consumed, m)
+			acks <- m
+		case err := <-errs:
+			return consumed, err
+		}
+	}
+	return consumed, nil
+}
+
+func record(t *testing.T, msgs ...Message) []byte {
+	inner := &mockAsyncSource{
+		toSend: make(chan Message, len(msgs)),
+		acked:  make(chan Message, len(msgs)),
+		closed: make(chan struct{}),
+	}
+	for _, m := range msgs {
+		inner.toSend <- m
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var recording bytes.Buffer
+	source := NewRecordingSource(inner, &recording)
+	consumed := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, consumed, acks)
+	}()
+
+	for _, expected := range msgs {
+		m := <-consumed
+		require.Equal(t, expected, m)
+		acks <- m
+	}
+	// The last acknowledgement is recorded before it reaches the inner
+	// source.
+	for _, expected := range msgs {
+		require.Equal(t, expected, <-inner.acked)
+	}
+	cancel()
+	require.Equal(t, context.Canceled, <-errs)
+	require.NoError(t, source.Close())
+	return recording.Bytes()
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	m1 := &recordedTestMessage{data: []byte("first"), key: []byte("key"), attrs: map[string]string{"a": "1", "b": "2"}}
+	m2 := &recordedTestMessage{data: []byte("second")}
+	m3 := message("third")
+	recording := record(t, m1, m2, &m3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	replayed, err := consumeAndAck(ctx, NewReplaySource(bytes.NewReader(recording), ReplayOptions{}), 4)
+	require.NoError(t, err)
+	require.Len(t, replayed, 3)
+
+	for i, expected := range []*recordedTestMessage{m1, m2, {data: []byte("third")}} {
+		m := replayed[i].(ReplayedMessage)
+		assert.Equal(t, expected.data, m.Data())
+		assert.Equal(t, expected.key, m.Key())
+		assert.Equal(t, expected.attrs, m.Attributes())
+		assert.False(t, m.DeliveredAt().IsZero())
+	}
+}
+
+func TestReplayOriginalTiming(t *testing.T) {
+	recording := []byte(recordingMagic + string([]byte{recordingVersion}))
+	start := time.Now()
+	for i, gap := range []time.Duration{0, 100 * time.Millisecond, 50 * time.Millisecond} {
+		start = start.Add(gap)
+		body := appendVarint(appendUvarint(nil, uint64(i)), start.UnixNano())
+		body = appendLengthPrefixed(body, nil)
+		body = appendUvarint(body, 0)
+		body = appendLengthPrefixed(body, []byte("message"))
+		recording = appendLengthPrefixed(append(recording, recordDelivered), body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	began := time.Now()
+	replayed, err := consumeAndAck(ctx, NewReplaySource(bytes.NewReader(recording), ReplayOptions{}), 4)
+	require.NoError(t, err)
+	require.Len(t, replayed, 3)
+	assert.Less(t, int64(time.Since(began)), int64(100*time.Millisecond))
+
+	began = time.Now()
+	replayed, err = consumeAndAck(ctx, NewReplaySource(bytes.NewReader(recording), ReplayOptions{OriginalTiming: true}), 4)
+	require.NoError(t, err)
+	require.Len(t, replayed, 3)
+	assert.GreaterOrEqual(t, int64(time.Since(began)), int64(150*time.Millisecond))
+}
+
+func TestReplayTruncatedRecording(t *testing.T) {
+	m1, m2 := message("first"), message("second")
+	recording := record(t, &m1, &m2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The recording is cut in the middle of the last record.
+	replayed, err := consumeAndAck(ctx, NewReplaySource(bytes.NewReader(recording[:len(recording)-2]), ReplayOptions{}), 3)
+	require.NoError(t, err)
+	require.Len(t, replayed, 2)
+	assert.Equal(t, []byte("second"), replayed[1].Data())
+
+	replayed, err = consumeAndAck(ctx, NewReplaySource(bytes.NewReader(nil), ReplayOptions{}), 1)
+	require.NoError(t, err)
+	assert.Empty(t, replayed)
+}
+
+func TestReplayInvalidRecording(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	m := message("message")
+	recording := record(t, &m)
+	recording[len(recordingMagic)] = recordingVersion + 1
+
+	for _, r := range [][]byte{[]byte("not a recording"), recording} {
+		_, err := consumeAndAck(ctx, NewReplaySource(bytes.NewReader(r), ReplayOptions{}), 1)
+		assert.Equal(t, ErrInvalidRecording, err)
+	}
+}
@@ -0,0 +1,27 @@
+// Package redisstore provides a redis backed substrate.IdempotencyStore, for
+// skipping messages that were already processed by any of the replicas
+// consuming from a source, and a redis backed substrate.PublishedRegistry,
+// for skipping messages that were already written when sinks republish them.
+//
+// Usage
+//
+//      store, err := redisstore.NewIdempotencyStore(redisstore.Config{
+//          Addr:      "localhost:6379",
+//          KeyPrefix: "my-service:processed:",
+//      })
+//      ...
+//      defer store.Close()
+//
+//      source = substrate.NewIdempotentSource(source, store, func(msg substrate.Message) string {
+//          return messageID(msg)
+//      }, 24*time.Hour)
+//
+// A PublishedRegistry is set on the sinks supporting it, such as kafka sinks,
+// along with the function returning the ID of the messages:
+//
+//      registry, err := redisstore.NewPublishedRegistry(redisstore.Config{
+//          Addr:      "localhost:6379",
+//          KeyPrefix: "my-service:published:",
+//      }, time.Hour)
+//
+package redisstore
@@ -0,0 +1,55 @@
+package redisstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/uw-labs/substrate"
+)
+
+var _ substrate.PublishedRegistry = (*PublishedRegistry)(nil)
+
+// PublishedRegistry is a substrate.PublishedRegistry backed by redis, which
+// is shared by the processes publishing the same messages, so that a process
+// restarted after a crash skips the messages written before it.
+type PublishedRegistry struct {
+	store *IdempotencyStore
+	ttl   time.Duration
+}
+
+// NewPublishedRegistry returns a new redis backed registry, whose IDs expire
+// after ttl, unless it is zero. The connection is established on first use,
+// and every request is bounded by DialTimeout.
+func NewPublishedRegistry(c Config, ttl time.Duration) (*PublishedRegistry, error) {
+	store, err := NewIdempotencyStore(c)
+	if err != nil {
+		return nil, err
+	}
+	return &PublishedRegistry{store: store, ttl: ttl}, nil
+}
+
+// Seen implements the Seen method of the substrate.PublishedRegistry
+// interface.
+func (r *PublishedRegistry) Seen(id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.store.conf.DialTimeout)
+	defer cancel()
+	return r.store.GetProcessed(ctx, id)
+}
+
+// Mark implements the Mark method of the substrate.PublishedRegistry
+// interface.
+func (r *PublishedRegistry) Mark(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.store.conf.DialTimeout)
+	defer cancel()
+	return r.store.SetProcessed(ctx, id, r.ttl)
+}
+
+// Close closes the connection to redis.
+func (r *PublishedRegistry) Close() error {
+	return r.store.Close()
+}
+
+// Status returns the status of the connection to redis.
+func (r *PublishedRegistry) Status() (*substrate.Status, error) {
+	return r.store.Status()
+}
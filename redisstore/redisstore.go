@@ -0,0 +1,246 @@
+package redisstore
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/uw-labs/substrate"
+)
+
+var _ substrate.IdempotencyStore = (*IdempotencyStore)(nil)
+
+const defaultDialTimeout = 5 * time.Second
+
+// Config is the configuration parameters for an IdempotencyStore.
+type Config struct {
+	// Addr is the host:port address of the redis server.
+	Addr string
+	// Password is used to authenticate, if set.
+	Password string
+	// DB is the index of the database to select.
+	DB int
+	// KeyPrefix is prepended to every key, to separate the keys of
+	// different consumers sharing a database.
+	KeyPrefix string
+	// TLSConfig enables TLS when set.
+	TLSConfig *tls.Config
+	// DialTimeout is the timeout for establishing a connection.
+	// Defaults to 5s.
+	DialTimeout time.Duration
+}
+
+// IdempotencyStore is a substrate.IdempotencyStore backed by redis. It uses a
+// single connection, which is re-established after any error.
+type IdempotencyStore struct {
+	conf Config
+
+	mu   sync.Mutex
+	conn net.Conn
+	rw   *bufio.ReadWriter
+}
+
+// NewIdempotencyStore returns a new redis backed idempotency store. The
+// connection is established on first use.
+func NewIdempotencyStore(c Config) (*IdempotencyStore, error) {
+	if c.Addr == "" {
+		return nil, errors.New("redis address must be set")
+	}
+	if c.DialTimeout == 0 {
+		c.DialTimeout = defaultDialTimeout
+	}
+	return &IdempotencyStore{conf: c}, nil
+}
+
+// GetProcessed reports whether the key has been marked as processed.
+func (s *IdempotencyStore) GetProcessed(ctx context.Context, key string) (bool, error) {
+	reply, err := s.do(ctx, "EXISTS", s.conf.KeyPrefix+key)
+	if err != nil {
+		return false, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return false, fmt.Errorf("unexpected redis reply to EXISTS: %v", reply)
+	}
+	return n > 0, nil
+}
+
+// SetProcessed marks the key as processed for the given time to live. A zero
+// ttl means the key does not expire.
+func (s *IdempotencyStore) SetProcessed(ctx context.Context, key string, ttl time.Duration) error {
+	args := []string{"SET", s.conf.KeyPrefix + key, "1"}
+	if ttl > 0 {
+		ms := ttl.Milliseconds()
+		if ms == 0 {
+			ms = 1
+		}
+		args = append(args, "PX", strconv.FormatInt(ms, 10))
+	}
+	_, err := s.do(ctx, args...)
+	return err
+}
+
+// Close closes the connection to redis.
+func (s *IdempotencyStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn, s.rw = nil, nil
+	return err
+}
+
+// Status returns the status of the connection to redis.
+func (s *IdempotencyStore) Status() (*substrate.Status, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.conf.DialTimeout)
+	defer cancel()
+
+	if _, err := s.do(ctx, "PING"); err != nil {
+		return &substrate.Status{Working: false, Problems: []string{err.Error()}}, nil
+	}
+	return &substrate.Status{Working: true}, nil
+}
+
+func (s *IdempotencyStore) do(ctx context.Context, args ...string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		if err := s.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := s.roundTrip(ctx, args)
+	if err != nil {
+		var rerr redisError
+		if !errors.As(err, &rerr) {
+			// The connection is in an unknown state, so start over.
+			s.conn.Close()
+			s.conn, s.rw = nil, nil
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (s *IdempotencyStore) connect(ctx context.Context) error {
+	dialer := &net.Dialer{Timeout: s.conf.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.conf.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	if s.conf.TLSConfig != nil {
+		conn = tls.Client(conn, s.conf.TLSConfig)
+	}
+	s.conn = conn
+	s.rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	var setup [][]string
+	if s.conf.Password != "" {
+		setup = append(setup, []string{"AUTH", s.conf.Password})
+	}
+	if s.conf.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(s.conf.DB)})
+	}
+	for _, args := range setup {
+		if _, err := s.roundTrip(ctx, args); err != nil {
+			conn.Close()
+			s.conn, s.rw = nil, nil
+			return fmt.Errorf("failed to set up redis connection: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *IdempotencyStore) roundTrip(ctx context.Context, args []string) (interface{}, error) {
+	// A zero deadline, when the context has none, clears any previous one.
+	deadline, _ := ctx.Deadline()
+	if err := s.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	// The deadline doesn't cover cancellation, which closes the connection
+	// instead so that s.mu is not held by a blocked read or write.
+	conn := s.conn
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	reply, err := s.send(args)
+	if ctx.Err() != nil {
+		// The connection may have been closed, even if the reply was read.
+		return nil, ctx.Err()
+	}
+	return reply, err
+}
+
+func (s *IdempotencyStore) send(args []string) (interface{}, error) {
+	fmt.Fprintf(s.rw, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(s.rw, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := s.rw.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(s.rw.Reader)
+}
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// readReply reads a single RESP reply. Arrays are not supported, as none of
+// the commands used return them.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("invalid redis reply: %q", line)
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis reply: %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	default:
+		return nil, fmt.Errorf("unsupported redis reply: %q", line)
+	}
+}
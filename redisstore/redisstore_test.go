@@ -0,0 +1,269 @@
+package redisstore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis implements the subset of the redis protocol used by the store.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu       sync.Mutex
+	keys     map[string]time.Time
+	commands [][]string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	f := &fakeRedis{listener: l, password: password, keys: make(map[string]time.Time)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authenticated := f.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, args)
+		var reply string
+		switch {
+		case args[0] == "AUTH":
+			if args[1] == f.password {
+				authenticated = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case args[0] == "PING":
+			reply = "+PONG\r\n"
+		case args[0] == "SELECT":
+			reply = "+OK\r\n"
+		case args[0] == "EXISTS":
+			expiry, ok := f.keys[args[1]]
+			if ok && (expiry.IsZero() || time.Now().Before(expiry)) {
+				reply = ":1\r\n"
+			} else {
+				reply = ":0\r\n"
+			}
+		case args[0] == "SET":
+			var expiry time.Time
+			if len(args) == 5 && args[3] == "PX" {
+				ms, _ := strconv.Atoi(args[4])
+				expiry = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			}
+			f.keys[args[1]] = expiry
+			reply = "+OK\r\n"
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		f.mu.Unlock()
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	store, err := NewIdempotencyStore(Config{
+		Addr:      server.listener.Addr().String(),
+		Password:  "secret",
+		DB:        2,
+		KeyPrefix: "svc:",
+	})
+	require.NoError(t, err)
+	defer store.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	processed, err := store.GetProcessed(ctx, "key")
+	require.NoError(t, err)
+	assert.False(t, processed)
+
+	require.NoError(t, store.SetProcessed(ctx, "key", time.Minute))
+	require.NoError(t, store.SetProcessed(ctx, "short", time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+
+	processed, err = store.GetProcessed(ctx, "key")
+	require.NoError(t, err)
+	assert.True(t, processed)
+	processed, err = store.GetProcessed(ctx, "short")
+	require.NoError(t, err)
+	assert.False(t, processed)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	assert.Equal(t, [][]string{
+		{"AUTH", "secret"},
+		{"SELECT", "2"},
+		{"EXISTS", "svc:key"},
+		{"SET", "svc:key", "1", "PX", "60000"},
+		{"SET", "svc:short", "1", "PX", "1"},
+		{"EXISTS", "svc:key"},
+		{"EXISTS", "svc:short"},
+	}, server.commands)
+}
+
+func TestIdempotencyStoreErrors(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	store, err := NewIdempotencyStore(Config{Addr: server.listener.Addr().String(), Password: "wrong"})
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = store.GetProcessed(context.Background(), "key")
+	assert.EqualError(t, err, "failed to set up redis connection: redis: WRONGPASS invalid password")
+
+	status, err := store.Status()
+	require.NoError(t, err)
+	assert.False(t, status.Working)
+
+	_, err = NewIdempotencyStore(Config{})
+	assert.Error(t, err)
+}
+
+func TestIdempotencyStoreReconnects(t *testing.T) {
+	server := newFakeRedis(t, "")
+	store, err := NewIdempotencyStore(Config{Addr: server.listener.Addr().String()})
+	require.NoError(t, err)
+	defer store.Close()
+
+	ctx := context.Background()
+	require.NoError(t, store.SetProcessed(ctx, "key", 0))
+
+	// Break the connection, which is detected by the next command.
+	store.mu.Lock()
+	store.conn.Close()
+	store.mu.Unlock()
+	_, err = store.GetProcessed(ctx, "key")
+	assert.Error(t, err)
+
+	processed, err := store.GetProcessed(ctx, "key")
+	require.NoError(t, err)
+	assert.True(t, processed)
+
+	status, err := store.Status()
+	require.NoError(t, err)
+	assert.True(t, status.Working, fmt.Sprint(status.Problems))
+}
+
+func TestIdempotencyStoreCancel(t *testing.T) {
+	// A server that never replies.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+
+	store, err := NewIdempotencyStore(Config{Addr: l.Addr().String()})
+	require.NoError(t, err)
+	defer store.Close()
+
+	// The context has no deadline, so only cancelling it unblocks the read.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, err = store.GetProcessed(ctx, "key")
+	assert.Equal(t, context.Canceled, err)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	assert.Nil(t, store.conn)
+}
+
+func TestPublishedRegistry(t *testing.T) {
+	server := newFakeRedis(t, "")
+	registry, err := NewPublishedRegistry(Config{
+		Addr:      server.listener.Addr().String(),
+		KeyPrefix: "svc:published:",
+	}, time.Hour)
+	require.NoError(t, err)
+	defer registry.Close()
+
+	seen, err := registry.Seen("id1")
+	require.NoError(t, err)
+	assert.False(t, seen)
+	require.NoError(t, registry.Mark("id1"))
+	seen, err = registry.Seen("id1")
+	require.NoError(t, err)
+	assert.True(t, seen)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	assert.Equal(t, [][]string{
+		{"EXISTS", "svc:published:id1"},
+		{"SET", "svc:published:id1", "1", "PX", "3600000"},
+		{"EXISTS", "svc:published:id1"},
+	}, server.commands)
+}
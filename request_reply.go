@@ -0,0 +1,437 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/uw-labs/sync/rungroup"
+)
+
+// CorrelationIDAttribute is the attribute of requests, and of their replies,
+// holding the id that correlates them.
+const CorrelationIDAttribute = "substrate-correlation-id"
+
+// ErrRequesterClosed is returned by Do once the requester is closed.
+var ErrRequesterClosed = errors.New("requester was closed")
+
+// RequesterConfig is the configuration of a Requester.
+type RequesterConfig struct {
+	// Correlate, if set, returns whether reply is the reply to request, for
+	// responders that don't copy the CorrelationIDAttribute to their
+	// replies. The request is the message published, whose attributes
+	// include the CorrelationIDAttribute. By default, replies are matched
+	// by the CorrelationIDAttribute.
+	Correlate func(request, reply Message) bool
+	// Timeout, if set, bounds the time Do waits for a reply, on top of the
+	// deadline of its context.
+	Timeout time.Duration
+	// OnOrphanedReply, if set, is called with the replies that match no
+	// request in flight, e.g. replies arriving after Do gave up, before
+	// they are dropped. It is called from the goroutine consuming replies,
+	// and must not block.
+	OnOrphanedReply func(Message)
+}
+
+// Requester publishes requests and waits for their replies, for request-reply
+// interactions over a request topic and a reply topic. Requests are
+// correlated with their replies by a generated id, so many requests can be in
+// flight at once. The reply topic must be consumed by a single requester,
+// e.g. with a consumer group of its own.
+type Requester struct {
+	sink   AsyncMessageSink
+	source AsyncMessageSource
+	conf   RequesterConfig
+	// requests are the requests to publish.
+	requests chan Message
+
+	mu sync.Mutex
+	// pending are the requests in flight, by correlation id.
+	pending map[string]*pendingRequest
+
+	cancel context.CancelFunc
+	// done is closed once consuming replies terminates, with err set to
+	// the reason.
+	done chan struct{}
+	err  error
+}
+
+// pendingRequest is a request waiting for its reply.
+type pendingRequest struct {
+	request Message
+	// reply is buffered, so that a reply can be received before Do waits
+	// for it, e.g. before the request sink acknowledged the request.
+	reply chan Message
+}
+
+// requestMessage is a request with its correlation id.
+type requestMessage struct {
+	original Message
+	attrs    map[string]string
+}
+
+func (m *requestMessage) Data() []byte {
+	return m.original.Data()
+}
+
+func (m *requestMessage) Attributes() map[string]string {
+	return m.attrs
+}
+
+func (m *requestMessage) Original() Message {
+	return m.original
+}
+
+// withAttribute returns a message with the attributes of msg, and the given
+// attribute.
+func withAttribute(msg Message, key, value string) *requestMessage {
+	attrs := map[string]string{key: value}
+	if am, ok := msg.(AttributedMessage); ok {
+		for k, v := range am.Attributes() {
+			if k != key {
+				attrs[k] = v
+			}
+		}
+	}
+	return &requestMessage{original: msg, attrs: attrs}
+}
+
+// correlationID returns the correlation id attribute of a message.
+func correlationID(msg Message) (string, bool) {
+	am, ok := msg.(AttributedMessage)
+	if !ok {
+		return "", false
+	}
+	id, ok := am.Attributes()[CorrelationIDAttribute]
+	return id, ok
+}
+
+// NewRequester returns a requester publishing requests to requestSink, and
+// consuming their replies from replySource until it is closed. When Close is
+// called on the requester, this is also propagated to requestSink and
+// replySource.
+func NewRequester(requestSink AsyncMessageSink, replySource AsyncMessageSource, c RequesterConfig) *Requester {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Requester{
+		sink:     requestSink,
+		source:   replySource,
+		conf:     c,
+		requests: make(chan Message),
+		pending:  make(map[string]*pendingRequest),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go func() {
+		err := r.run(ctx)
+		if err == nil || err == context.Canceled {
+			err = ErrRequesterClosed
+		}
+		r.err = err
+		close(r.done)
+	}()
+	return r
+}
+
+// Do publishes a request, and returns its reply. It returns an error if no
+// reply is received before the context is done, or the Timeout of the
+// requester elapses, or if publishing or consuming fails, which closes the
+// requester. The reply may be received before the request sink has
+// acknowledged the request. Replies received after Do returned are dropped.
+func (r *Requester) Do(ctx context.Context, request Message) (Message, error) {
+	if r.conf.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.conf.Timeout)
+		defer cancel()
+	}
+
+	id := uuid.Must(uuid.NewV4()).String()
+	p := &pendingRequest{
+		request: withAttribute(request, CorrelationIDAttribute, id),
+		reply:   make(chan Message, 1),
+	}
+	if err := r.add(id, p); err != nil {
+		return nil, err
+	}
+	defer r.remove(id)
+
+	select {
+	case r.requests <- p.request:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.done:
+		return nil, r.err
+	}
+	select {
+	case reply := <-p.reply:
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.done:
+		return nil, r.err
+	}
+}
+
+func (r *Requester) add(id string, p *pendingRequest) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	select {
+	case <-r.done:
+		return r.err
+	default:
+	}
+	r.pending[id] = p
+	return nil
+}
+
+func (r *Requester) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.pending, id)
+}
+
+// match removes the request a reply is for from the requests in flight, and
+// returns it, or nil if there is none.
+func (r *Requester) match(reply Message) *pendingRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conf.Correlate == nil {
+		id, ok := correlationID(reply)
+		if !ok {
+			return nil
+		}
+		p, ok := r.pending[id]
+		if ok {
+			delete(r.pending, id)
+		}
+		return p
+	}
+	for id, p := range r.pending {
+		if r.conf.Correlate(p.request, reply) {
+			delete(r.pending, id)
+			return p
+		}
+	}
+	return nil
+}
+
+// run publishes the requests, and hands the replies to the requests they are
+// for, acknowledging them.
+func (r *Requester) run(ctx context.Context) error {
+	rg, ctx := rungroup.New(ctx)
+
+	toSink := make(chan Message)
+	sinkAcks := make(chan Message)
+	messages := make(chan Message)
+	acks := make(chan Message)
+
+	rg.Go(func() error {
+		return r.sink.PublishMessages(ctx, sinkAcks, toSink)
+	})
+	rg.Go(func() error {
+		return r.source.ConsumeMessages(ctx, messages, acks)
+	})
+
+	rg.Go(func() error {
+		// published are the requests awaiting their acknowledgement, which
+		// are taken while a request is sent, as sinks may acknowledge
+		// messages before taking the next one.
+		var published []Message
+		ack := func(ack Message) error {
+			if len(published) == 0 || !SameMessage(ack, published[0]) {
+				var expected Message
+				if len(published) > 0 {
+					expected = published[0]
+				}
+				return InvalidAckError{Acked: ack, Expected: expected}
+			}
+			published[0] = nil
+			published = published[1:]
+			return nil
+		}
+		for {
+			var request Message
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case request = <-r.requests:
+			case a := <-sinkAcks:
+				if err := ack(a); err != nil {
+					return err
+				}
+				continue
+			}
+			for request != nil {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case toSink <- request:
+					published = append(published, request)
+					request = nil
+				case a := <-sinkAcks:
+					if err := ack(a); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	})
+
+	rg.Go(func() error {
+		for {
+			var reply Message
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case reply = <-messages:
+			}
+			if p := r.match(reply); p != nil {
+				p.reply <- reply
+			} else if r.conf.OnOrphanedReply != nil {
+				r.conf.OnOrphanedReply(reply)
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case acks <- reply:
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+// Close stops publishing requests and consuming replies, and closes the
+// request sink and the reply source. Calls of Do in progress return
+// ErrRequesterClosed.
+func (r *Requester) Close() error {
+	r.cancel()
+	<-r.done
+	sinkErr := r.sink.Close()
+	if err := r.source.Close(); err != nil {
+		return err
+	}
+	return sinkErr
+}
+
+// ReplyHandler returns the reply to a request, or nil if there is none.
+type ReplyHandler func(ctx context.Context, request Message) (Message, error)
+
+// Responder handles the requests published by a Requester, and publishes
+// their replies.
+type Responder struct {
+	source  AsyncMessageSource
+	sink    AsyncMessageSink
+	handler ReplyHandler
+}
+
+// NewResponder returns a responder that consumes requests from
+// requestSource, and publishes the replies returned by handler to replySink,
+// with the CorrelationIDAttribute of their request. When Close is called on
+// the responder, this is also propagated to requestSource and replySink.
+func NewResponder(requestSource AsyncMessageSource, replySink AsyncMessageSink, handler ReplyHandler) *Responder {
+	return &Responder{source: requestSource, sink: replySink, handler: handler}
+}
+
+// answeredRequest is a request awaiting the acknowledgement of its reply,
+// which is nil if there is none.
+type answeredRequest struct {
+	request Message
+	reply   Message
+}
+
+// Run handles requests until the context is cancelled or an error occurs.
+// Requests are handled one at a time, and acknowledged in order once their
+// reply has been published, so that a request is handled again if its reply
+// may have been lost. An error returned by the handler terminates the
+// responder without acknowledging the failing request.
+func (r *Responder) Run(ctx context.Context) error {
+	rg, ctx := rungroup.New(ctx)
+
+	requests := make(chan Message)
+	acks := make(chan Message)
+	replies := make(chan Message)
+	replyAcks := make(chan Message)
+	needAcks := make(chan answeredRequest, 1024)
+
+	rg.Go(func() error {
+		return r.source.ConsumeMessages(ctx, requests, acks)
+	})
+	rg.Go(func() error {
+		return r.sink.PublishMessages(ctx, replyAcks, replies)
+	})
+
+	rg.Go(func() error {
+		for {
+			var request Message
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case request = <-requests:
+			}
+			reply, err := r.handler(ctx, request)
+			if err != nil {
+				return err
+			}
+			if reply != nil {
+				if id, ok := correlationID(request); ok {
+					reply = withAttribute(reply, CorrelationIDAttribute, id)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case needAcks <- answeredRequest{request: request, reply: reply}:
+			}
+			if reply == nil {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case replies <- reply:
+			}
+		}
+	})
+
+	rg.Go(func() error {
+		for {
+			var ar answeredRequest
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case ar = <-needAcks:
+			}
+			if ar.reply != nil {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case ack := <-replyAcks:
+					if !SameMessage(ack, ar.reply) {
+						return InvalidAckError{Acked: ack, Expected: ar.reply}
+					}
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case acks <- ar.request:
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+// Close closes the request source and the reply sink.
+func (r *Responder) Close() error {
+	sinkErr := r.sink.Close()
+	if err := r.source.Close(); err != nil {
+		return err
+	}
+	return sinkErr
+}
@@ -0,0 +1,166 @@
+package substrate_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/inmemory"
+	"github.com/uw-labs/substrate/mock"
+)
+
+type payload []byte
+
+func (p *payload) Data() []byte {
+	return *p
+}
+
+func newPayload(s string) *payload {
+	p := payload(s)
+	return &p
+}
+
+func topicSink(t *testing.T, broker *inmemory.Broker, topic string) substrate.AsyncMessageSink {
+	sink, err := inmemory.NewAsyncMessageSink(inmemory.AsyncMessageSinkConfig{Broker: broker, Topic: topic})
+	require.NoError(t, err)
+	return sink
+}
+
+func topicSource(t *testing.T, broker *inmemory.Broker, topic string) substrate.AsyncMessageSource {
+	source, err := inmemory.NewAsyncMessageSource(inmemory.AsyncMessageSourceConfig{
+		Broker:        broker,
+		Topic:         topic,
+		ConsumerGroup: "group",
+	})
+	require.NoError(t, err)
+	return source
+}
+
+// runResponder runs a responder replying with the upper cased request.
+func runResponder(ctx context.Context, t *testing.T, broker *inmemory.Broker) <-chan error {
+	responder := substrate.NewResponder(topicSource(t, broker, "requests"), topicSink(t, broker, "replies"), func(_ context.Context, request substrate.Message) (substrate.Message, error) {
+		return newPayload(strings.ToUpper(string(request.Data()))), nil
+	})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- responder.Run(ctx)
+	}()
+	return errs
+}
+
+func TestRequestReply(t *testing.T) {
+	broker := inmemory.NewBroker()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	responderErrs := runResponder(ctx, t, broker)
+	requester := substrate.NewRequester(topicSink(t, broker, "requests"), topicSource(t, broker, "replies"), substrate.RequesterConfig{})
+
+	// Many requests are in flight at once, and get their own reply.
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reply, err := requester.Do(ctx, newPayload(fmt.Sprintf("request %d", i)))
+			if assert.NoError(t, err) {
+				assert.Equal(t, fmt.Sprintf("REQUEST %d", i), string(reply.Data()))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	require.NoError(t, requester.Close())
+	_, err := requester.Do(ctx, newPayload("closed"))
+	assert.Equal(t, substrate.ErrRequesterClosed, err)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-responderErrs)
+}
+
+func TestRequesterTimeout(t *testing.T) {
+	broker := inmemory.NewBroker()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	orphans := make(chan substrate.Message, 1)
+	requester := substrate.NewRequester(topicSink(t, broker, "requests"), topicSource(t, broker, "replies"), substrate.RequesterConfig{
+		Timeout:         50 * time.Millisecond,
+		OnOrphanedReply: func(msg substrate.Message) { orphans <- msg },
+	})
+	defer requester.Close()
+
+	_, err := requester.Do(ctx, newPayload("late"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// The reply arriving after the request timed out is dropped, and the
+	// requester carries on.
+	runResponder(ctx, t, broker)
+	assert.Equal(t, "LATE", string((<-orphans).Data()))
+	reply, err := requester.Do(ctx, newPayload("on time"))
+	require.NoError(t, err)
+	assert.Equal(t, "ON TIME", string(reply.Data()))
+}
+
+func TestRequesterCorrelate(t *testing.T) {
+	broker := inmemory.NewBroker()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	requester := substrate.NewRequester(topicSink(t, broker, "requests"), topicSource(t, broker, "replies"), substrate.RequesterConfig{
+		Correlate: func(request, reply substrate.Message) bool {
+			return string(reply.Data()) == "reply to "+string(request.Data())
+		},
+	})
+	defer requester.Close()
+
+	// The responder doesn't keep the correlation id of the requests.
+	go func() {
+		replies := substrate.NewSynchronousMessageSink(topicSink(t, broker, "replies"))
+		defer replies.Close()
+		_ = substrate.NewSynchronousMessageSource(topicSource(t, broker, "requests")).ConsumeMessages(ctx, func(ctx context.Context, msg substrate.Message) error {
+			return replies.PublishMessage(ctx, newPayload("reply to "+string(msg.Data())))
+		})
+	}()
+
+	reply, err := requester.Do(ctx, newPayload("a"))
+	require.NoError(t, err)
+	assert.Equal(t, "reply to a", string(reply.Data()))
+}
+
+func TestResponderAcksRequestsAfterReplies(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	requests := mock.NewSource().WithTimeout(100*time.Millisecond).Deliver("a", "b").WaitForAcks()
+	// The reply to the second request is never acknowledged.
+	replies := mock.NewSink().WithholdAck(2)
+	responder := substrate.NewResponder(requests, replies, func(_ context.Context, request substrate.Message) (substrate.Message, error) {
+		return newPayload("reply to " + string(request.Data())), nil
+	})
+
+	assert.EqualError(t, responder.Run(ctx), "mock: 1 messages not acknowledged within 100ms")
+	replies.AssertPublished(t, "reply to a", "reply to b")
+	requests.AssertAcked(t, "a")
+}
+
+func TestResponderHandlerError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	failure := errors.New("handler failed")
+	requests := mock.NewSource().Deliver("a")
+	responder := substrate.NewResponder(requests, mock.NewSink(), func(context.Context, substrate.Message) (substrate.Message, error) {
+		return nil, failure
+	})
+	assert.Equal(t, failure, responder.Run(ctx))
+	assert.Empty(t, requests.Acked())
+}
@@ -0,0 +1,41 @@
+// Package retryqueue provides delayed redelivery of messages that fail
+// processing, on top of any substrate backend.
+//
+// Usage
+//
+// Sources are wrapped with NewSource, and the application nacks a message
+// that should be redelivered later by calling Nack on it before acknowledging
+// it as usual:
+//
+//      for msg := range messages {
+//          if err := process(msg); err != nil {
+//              msg.(*retryqueue.Message).Nack(err)
+//          }
+//          acks <- msg
+//      }
+//
+// A nacked message is republished to the retry sink, with the
+// AttemptAttribute, NotBeforeAttribute and ErrorAttribute set, before the
+// original message is acknowledged to the underlying source. The delay before
+// the next attempt starts at Backoff and doubles with every attempt, up to
+// MaxBackoff. Once a message has been delivered MaxAttempts times, nacking it
+// publishes it to the dead letter sink instead.
+//
+// The retry topic is consumed by a source wrapped in the same way, which
+// holds back every message until the time in its NotBeforeAttribute, so the
+// application typically consumes both the main and the retry topic:
+//
+//      main, err := retryqueue.NewSource(mainSource, retryqueue.Config{
+//          RetrySink:      newRetrySink(),
+//          DeadLetterSink: newDeadLetterSink(),
+//      })
+//      ...
+//      retries, err := retryqueue.NewSource(retrySource, retryqueue.Config{
+//          RetrySink:      newRetrySink(),
+//          DeadLetterSink: newDeadLetterSink(),
+//      })
+//
+// Attributes must be supported by the backends of the retry and dead letter
+// topics, see substrate.AttributedMessage.
+//
+package retryqueue
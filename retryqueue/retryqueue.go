@@ -0,0 +1,374 @@
+package retryqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/uw-labs/sync/rungroup"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/clock"
+	"github.com/uw-labs/substrate/internal/unwrap"
+)
+
+const (
+	// AttemptAttribute is the attribute holding the delivery attempt of a
+	// republished message, starting from 2 for the first retry.
+	AttemptAttribute = "substrate-retry-attempt"
+	// NotBeforeAttribute is the attribute holding the time, in RFC 3339
+	// format, before which a republished message must not be delivered.
+	NotBeforeAttribute = "substrate-retry-not-before"
+	// ErrorAttribute is the attribute holding the reason the message was
+	// last nacked.
+	ErrorAttribute = "substrate-retry-error"
+)
+
+const (
+	defaultMaxAttempts = 5
+	defaultBackoff     = time.Second
+	defaultMaxBackoff  = 5 * time.Minute
+)
+
+var (
+	_ substrate.AsyncMessageSource = (*retrySource)(nil)
+	_ substrate.Pausable           = (*retrySource)(nil)
+	_ substrate.Nackable           = (*Message)(nil)
+)
+
+// Config is the configuration parameters for a retry source.
+type Config struct {
+	// RetrySink publishes nacked messages to the retry topic. It is required.
+	RetrySink substrate.AsyncMessageSink
+	// DeadLetterSink publishes messages that have been nacked MaxAttempts
+	// times. If it is nil, such a message terminates consuming with an
+	// error instead.
+	DeadLetterSink substrate.AsyncMessageSink
+	// MaxAttempts is the maximum number of deliveries of a message,
+	// including the first one. Defaults to 5.
+	MaxAttempts int
+	// Backoff is the delay before the first retry, which is doubled for
+	// every subsequent one. Defaults to 1s.
+	Backoff time.Duration
+	// MaxBackoff caps the delay between retries. Defaults to 5m.
+	MaxBackoff time.Duration
+}
+
+// NewSource returns a source that delivers messages from source, which is
+// either the main topic or the retry topic, and republishes the messages that
+// the application nacks to the retry topic, to be delivered again after a
+// delay. Messages carrying a NotBeforeAttribute are held back until that
+// time, which also holds back the messages following them. A nacked message
+// is acknowledged to source only after it has been published to the retry or
+// dead letter sink. The sinks are used exclusively by the returned source,
+// so separate sink instances are required for every source. When Close is
+// called on the returned source, this is also propagated to source and the
+// sinks.
+func NewSource(source substrate.AsyncMessageSource, c Config) (substrate.AsyncMessageSource, error) {
+	if c.RetrySink == nil {
+		return nil, errors.New("retry sink must be set")
+	}
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = defaultMaxAttempts
+	}
+	if c.Backoff == 0 {
+		c.Backoff = defaultBackoff
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = defaultMaxBackoff
+	}
+	return &retrySource{source: source, conf: c, clock: clock.Real}, nil
+}
+
+type retrySource struct {
+	source substrate.AsyncMessageSource
+	conf   Config
+	clock  clock.Clock
+}
+
+// Message is a message delivered by a retry source.
+type Message struct {
+	original substrate.Message
+	attempt  int
+	reason   error
+}
+
+// Data returns the payload of the original message.
+func (m *Message) Data() []byte {
+	return m.original.Data()
+}
+
+// Key returns the key of the original message, if it has one.
+func (m *Message) Key() []byte {
+	if km, ok := unwrap.Unwrap(m.original).(substrate.KeyedMessage); ok {
+		return km.Key()
+	}
+	return nil
+}
+
+// Attributes returns the attributes of the original message, including the
+// retry attributes.
+func (m *Message) Attributes() map[string]string {
+	return unwrap.Attributes(m.original)
+}
+
+// Original returns the message consumed from the underlying source.
+func (m *Message) Original() substrate.Message {
+	return m.original
+}
+
+// Attempt returns the delivery attempt of the message, starting from 1.
+func (m *Message) Attempt() int {
+	return m.attempt
+}
+
+// Nack implements the substrate.Nackable interface. It marks the message for
+// redelivery, which happens once the message is acknowledged. It must be
+// called before the message is acknowledged.
+func (m *Message) Nack(reason error) {
+	if reason == nil {
+		reason = substrate.ErrNacked
+	}
+	m.reason = reason
+}
+
+// republished is a nacked message published to the retry or dead letter sink.
+type republished struct {
+	data       []byte
+	key        []byte
+	attributes map[string]string
+}
+
+func (m *republished) Data() []byte {
+	return m.data
+}
+
+func (m *republished) Key() []byte {
+	return m.key
+}
+
+func (m *republished) Attributes() map[string]string {
+	return m.attributes
+}
+
+func (s *retrySource) ConsumeMessages(ctx context.Context, messages chan<- substrate.Message, acks <-chan substrate.Message) error {
+	rg, ctx := rungroup.New(ctx)
+
+	fromInner := make(chan substrate.Message, cap(messages))
+	toInner := make(chan substrate.Message, cap(acks))
+	needAcks := make(chan *Message, 1024)
+
+	toRetry := make(chan substrate.Message)
+	retryAcks := make(chan substrate.Message)
+	rg.Go(func() error {
+		return s.conf.RetrySink.PublishMessages(ctx, retryAcks, toRetry)
+	})
+	toDeadLetter := make(chan substrate.Message)
+	deadLetterAcks := make(chan substrate.Message)
+	if s.conf.DeadLetterSink != nil {
+		rg.Go(func() error {
+			return s.conf.DeadLetterSink.PublishMessages(ctx, deadLetterAcks, toDeadLetter)
+		})
+	}
+
+	rg.Go(func() error {
+		return s.source.ConsumeMessages(ctx, fromInner, toInner)
+	})
+
+	rg.Go(func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case msg := <-fromInner:
+				attempt, notBefore, err := retryAttributes(msg)
+				if err != nil {
+					return err
+				}
+				if err := waitUntil(ctx, s.clock, notBefore); err != nil {
+					return err
+				}
+				m := &Message{original: msg, attempt: attempt}
+				select {
+				case needAcks <- m:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				select {
+				case messages <- m:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	})
+
+	rg.Go(func() error {
+		for {
+			var m *Message
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case m = <-needAcks:
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case ack := <-acks:
+				if !substrate.SameMessage(ack, m) {
+					return substrate.InvalidAckError{Acked: ack, Expected: m}
+				}
+			}
+			if m.reason != nil {
+				sink, sinkAcks := toRetry, retryAcks
+				if m.attempt >= s.conf.MaxAttempts {
+					if s.conf.DeadLetterSink == nil {
+						return fmt.Errorf("message failed after %d attempts: %w", m.attempt, m.reason)
+					}
+					sink, sinkAcks = toDeadLetter, deadLetterAcks
+				}
+				rm := s.republish(m, s.clock.Now())
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case sink <- rm:
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-sinkAcks:
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case toInner <- m.original:
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+// republish returns the message to publish for a nacked message. Messages
+// that have run out of attempts keep their last attempt, and have no
+// NotBeforeAttribute.
+func (s *retrySource) republish(m *Message, now time.Time) *republished {
+	rm := &republished{
+		data:       m.Data(),
+		key:        m.Key(),
+		attributes: make(map[string]string),
+	}
+	for k, v := range m.Attributes() {
+		rm.attributes[k] = v
+	}
+	rm.attributes[ErrorAttribute] = m.reason.Error()
+
+	if m.attempt >= s.conf.MaxAttempts {
+		rm.attributes[AttemptAttribute] = strconv.Itoa(m.attempt)
+		delete(rm.attributes, NotBeforeAttribute)
+		return rm
+	}
+	rm.attributes[AttemptAttribute] = strconv.Itoa(m.attempt + 1)
+	rm.attributes[NotBeforeAttribute] = now.Add(s.backoff(m.attempt)).UTC().Format(time.RFC3339Nano)
+	return rm
+}
+
+// backoff returns the delay before redelivering a message nacked on the given
+// attempt.
+func (s *retrySource) backoff(attempt int) time.Duration {
+	backoff := s.conf.Backoff
+	for i := 1; i < attempt && backoff < s.conf.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > s.conf.MaxBackoff {
+		backoff = s.conf.MaxBackoff
+	}
+	return backoff
+}
+
+// retryAttributes returns the attempt and the time before which msg must not
+// be delivered, which is zero if there is no such time.
+func retryAttributes(msg substrate.Message) (int, time.Time, error) {
+	attrs := unwrap.Attributes(msg)
+
+	attempt := 1
+	if v, ok := attrs[AttemptAttribute]; ok {
+		a, err := strconv.Atoi(v)
+		if err != nil || a < 1 {
+			return 0, time.Time{}, fmt.Errorf("invalid %s attribute: %q", AttemptAttribute, v)
+		}
+		attempt = a
+	}
+
+	var notBefore time.Time
+	if v, ok := attrs[NotBeforeAttribute]; ok {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return 0, time.Time{}, fmt.Errorf("invalid %s attribute: %q", NotBeforeAttribute, v)
+		}
+		notBefore = t
+	}
+	return attempt, notBefore, nil
+}
+
+func waitUntil(ctx context.Context, c clock.Clock, t time.Time) error {
+	d := clock.Until(c, t)
+	if t.IsZero() || d <= 0 {
+		return nil
+	}
+	timer := c.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close closes the underlying source and sinks.
+func (s *retrySource) Close() (err error) {
+	closers := []io.Closer{s.source, s.conf.RetrySink}
+	if s.conf.DeadLetterSink != nil {
+		closers = append(closers, s.conf.DeadLetterSink)
+	}
+	for _, closer := range closers {
+		err = multierror.Append(err, closer.Close()).ErrorOrNil()
+	}
+	return err
+}
+
+// Pause pauses the underlying source, or returns
+// substrate.ErrPauseNotSupported if it does not implement substrate.Pausable.
+// The messages already received from it are still delivered.
+func (s *retrySource) Pause() error {
+	if p, ok := s.source.(substrate.Pausable); ok {
+		return p.Pause()
+	}
+	return substrate.ErrPauseNotSupported
+}
+
+// Resume resumes the underlying source, or returns
+// substrate.ErrPauseNotSupported if it does not implement substrate.Pausable.
+func (s *retrySource) Resume() error {
+	if p, ok := s.source.(substrate.Pausable); ok {
+		return p.Resume()
+	}
+	return substrate.ErrPauseNotSupported
+}
+
+// Status returns the status of the underlying source and sinks, with the
+// total lag of those reporting one.
+func (s *retrySource) Status() (*substrate.Status, error) {
+	components := []substrate.Statuser{s.source, s.conf.RetrySink}
+	if s.conf.DeadLetterSink != nil {
+		components = append(components, s.conf.DeadLetterSink)
+	}
+	return substrate.CombinedStatus(components...)
+}
@@ -0,0 +1,283 @@
+package retryqueue
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/inmemory"
+	"github.com/uw-labs/substrate/internal/testutil"
+)
+
+type keyedMessage struct {
+	data []byte
+	key  []byte
+}
+
+func (m *keyedMessage) Data() []byte {
+	return m.data
+}
+
+func (m *keyedMessage) Key() []byte {
+	return m.key
+}
+
+func newSink(t *testing.T, broker *inmemory.Broker, topic string) substrate.AsyncMessageSink {
+	sink, err := inmemory.NewAsyncMessageSink(inmemory.AsyncMessageSinkConfig{Broker: broker, Topic: topic})
+	require.NoError(t, err)
+	return sink
+}
+
+func newSource(t *testing.T, broker *inmemory.Broker, topic string) substrate.AsyncMessageSource {
+	source, err := inmemory.NewAsyncMessageSource(inmemory.AsyncMessageSourceConfig{
+		Broker:        broker,
+		Topic:         topic,
+		ConsumerGroup: "group",
+	})
+	require.NoError(t, err)
+	return source
+}
+
+type consumer struct {
+	messages chan substrate.Message
+	acks     chan substrate.Message
+	errs     chan error
+}
+
+func consume(ctx context.Context, source substrate.AsyncMessageSource) *consumer {
+	c := &consumer{
+		messages: make(chan substrate.Message),
+		acks:     make(chan substrate.Message),
+		errs:     make(chan error, 1),
+	}
+	go func() {
+		c.errs <- source.ConsumeMessages(ctx, c.messages, c.acks)
+	}()
+	return c
+}
+
+func TestRetriesUntilDeadLetter(t *testing.T) {
+	broker := inmemory.NewBroker()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conf := func() Config {
+		return Config{
+			RetrySink:      newSink(t, broker, "retry"),
+			DeadLetterSink: newSink(t, broker, "dead"),
+			MaxAttempts:    3,
+			Backoff:        time.Second,
+		}
+	}
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	main, err := NewSource(newSource(t, broker, "main"), conf())
+	require.NoError(t, err)
+	defer main.Close()
+	main.(*retrySource).clock = clock
+	retries, err := NewSource(newSource(t, broker, "retry"), conf())
+	require.NoError(t, err)
+	defer retries.Close()
+	retries.(*retrySource).clock = clock
+
+	producer := substrate.NewSynchronousMessageSink(newSink(t, broker, "main"))
+	defer producer.Close()
+	require.NoError(t, producer.PublishMessage(ctx, &keyedMessage{data: []byte("data"), key: []byte("key")}))
+
+	mainConsumer := consume(ctx, main)
+	m := (<-mainConsumer.messages).(*Message)
+	assert.Equal(t, 1, m.Attempt())
+	m.Nack(errors.New("first failure"))
+	mainConsumer.acks <- m
+
+	retryConsumer := consume(ctx, retries)
+	m = awaitRetry(t, clock, retryConsumer, time.Second)
+	assert.Equal(t, 2, m.Attempt())
+	assert.Equal(t, "data", string(m.Data()))
+	assert.Equal(t, "key", string(m.Key()))
+	assert.Equal(t, "first failure", m.Attributes()[ErrorAttribute])
+	m.Nack(errors.New("second failure"))
+	retryConsumer.acks <- m
+
+	// The backoff doubles for the second retry.
+	m = awaitRetry(t, clock, retryConsumer, 2*time.Second)
+	assert.Equal(t, 3, m.Attempt())
+	m.Nack(errors.New("third failure"))
+	retryConsumer.acks <- m
+
+	deadConsumer := consume(ctx, newSource(t, broker, "dead"))
+	dead := <-deadConsumer.messages
+	assert.Equal(t, "data", string(dead.Data()))
+	assert.Equal(t, "key", string(dead.(substrate.KeyedMessage).Key()))
+	attrs := dead.(substrate.AttributedMessage).Attributes()
+	assert.Equal(t, "3", attrs[AttemptAttribute])
+	assert.Equal(t, "third failure", attrs[ErrorAttribute])
+	_, ok := attrs[NotBeforeAttribute]
+	assert.False(t, ok)
+}
+
+// awaitRetry advances the clock until the backoff of the next retry, and
+// returns the retried message, checking that it isn't delivered earlier.
+func awaitRetry(t *testing.T, clock *testutil.FakeClock, c *consumer, backoff time.Duration) *Message {
+	t.Helper()
+
+	// The retry source waits for the backoff once it has consumed the
+	// retried message.
+	clock.BlockUntil(1)
+	clock.Advance(backoff - time.Millisecond)
+	select {
+	case m := <-c.messages:
+		t.Fatalf("message %q retried before the backoff", m.Data())
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	return (<-c.messages).(*Message)
+}
+
+func TestAcknowledgedMessagesAreNotRetried(t *testing.T) {
+	broker := inmemory.NewBroker()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	source, err := NewSource(newSource(t, broker, "main"), Config{RetrySink: newSink(t, broker, "retry")})
+	require.NoError(t, err)
+
+	producer := substrate.NewSynchronousMessageSink(newSink(t, broker, "main"))
+	defer producer.Close()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, producer.PublishMessage(ctx, &keyedMessage{data: []byte(strconv.Itoa(i))}))
+	}
+
+	c := consume(ctx, source)
+	for i := 0; i < 3; i++ {
+		m := (<-c.messages).(*Message)
+		assert.Equal(t, strconv.Itoa(i), string(m.Data()))
+		if i == 1 {
+			m.Nack(nil)
+		}
+		c.acks <- m
+	}
+
+	retryConsumer := consume(ctx, newSource(t, broker, "retry"))
+	retried := <-retryConsumer.messages
+	assert.Equal(t, "1", string(retried.Data()))
+	assert.Equal(t, "message nacked", retried.(substrate.AttributedMessage).Attributes()[ErrorAttribute])
+
+	// Only the nacked message is published to the retry topic.
+	select {
+	case m := <-retryConsumer.messages:
+		t.Errorf("unexpected retried message: %s", m.Data())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMaxAttemptsWithoutDeadLetterSink(t *testing.T) {
+	broker := inmemory.NewBroker()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	source, err := NewSource(newSource(t, broker, "main"), Config{
+		RetrySink:   newSink(t, broker, "retry"),
+		MaxAttempts: 1,
+	})
+	require.NoError(t, err)
+
+	producer := substrate.NewSynchronousMessageSink(newSink(t, broker, "main"))
+	defer producer.Close()
+	require.NoError(t, producer.PublishMessage(ctx, &keyedMessage{data: []byte("data")}))
+
+	c := consume(ctx, source)
+	m := (<-c.messages).(*Message)
+	failure := errors.New("failure")
+	m.Nack(failure)
+	c.acks <- m
+
+	err = <-c.errs
+	assert.True(t, errors.Is(err, failure))
+	assert.EqualError(t, err, "message failed after 1 attempts: failure")
+}
+
+func TestInvalidAck(t *testing.T) {
+	broker := inmemory.NewBroker()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	source, err := NewSource(newSource(t, broker, "main"), Config{RetrySink: newSink(t, broker, "retry")})
+	require.NoError(t, err)
+
+	producer := substrate.NewSynchronousMessageSink(newSink(t, broker, "main"))
+	defer producer.Close()
+	require.NoError(t, producer.PublishMessage(ctx, &keyedMessage{data: []byte("data")}))
+
+	c := consume(ctx, source)
+	m := <-c.messages
+	invalid := &keyedMessage{data: []byte("data")}
+	c.acks <- invalid
+	assert.Equal(t, substrate.InvalidAckError{Acked: invalid, Expected: m}, <-c.errs)
+}
+
+func TestBackoff(t *testing.T) {
+	s := &retrySource{conf: Config{Backoff: time.Second, MaxBackoff: 10 * time.Second}}
+
+	assert.Equal(t, time.Second, s.backoff(1))
+	assert.Equal(t, 2*time.Second, s.backoff(2))
+	assert.Equal(t, 8*time.Second, s.backoff(4))
+	assert.Equal(t, 10*time.Second, s.backoff(5))
+	assert.Equal(t, 10*time.Second, s.backoff(100))
+}
+
+func TestInvalidAttributes(t *testing.T) {
+	_, _, err := retryAttributes(&attributedMessage{AttemptAttribute: "zero"})
+	assert.Error(t, err)
+	_, _, err = retryAttributes(&attributedMessage{NotBeforeAttribute: "tomorrow"})
+	assert.Error(t, err)
+
+	_, err = NewSource(nil, Config{})
+	assert.Error(t, err)
+}
+
+type attributedMessage map[string]string
+
+func (m *attributedMessage) Data() []byte {
+	return nil
+}
+
+func (m *attributedMessage) Attributes() map[string]string {
+	return *m
+}
+
+type pausableSource struct {
+	substrate.AsyncMessageSource
+	paused bool
+}
+
+func (s *pausableSource) Pause() error {
+	s.paused = true
+	return nil
+}
+
+func (s *pausableSource) Resume() error {
+	s.paused = false
+	return nil
+}
+
+func TestPause(t *testing.T) {
+	broker := inmemory.NewBroker()
+	inner := &pausableSource{AsyncMessageSource: newSource(t, broker, "main")}
+	source, err := NewSource(inner, Config{RetrySink: newSink(t, broker, "retry")})
+	require.NoError(t, err)
+
+	require.NoError(t, source.(substrate.Pausable).Pause())
+	assert.True(t, inner.paused)
+	require.NoError(t, source.(substrate.Pausable).Resume())
+	assert.False(t, inner.paused)
+
+	source, err = NewSource(newSource(t, broker, "main"), Config{RetrySink: newSink(t, broker, "retry")})
+	require.NoError(t, err)
+	assert.Equal(t, substrate.ErrPauseNotSupported, source.(substrate.Pausable).Pause())
+}
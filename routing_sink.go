@@ -0,0 +1,234 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/uw-labs/sync/rungroup"
+
+	"github.com/uw-labs/substrate/internal/flush"
+)
+
+// ErrNoRoute is the error passed to a MessageErrorHandler, or returned when
+// there is none, for a message that a routing sink has no route for.
+var ErrNoRoute = errors.New("no route for message")
+
+// NewRoutingSink returns a sink that publishes each message to the sink for
+// the topic returned by route. The sink for a topic is created with
+// sinkForTopic when the first message for the topic is published, and is kept
+// for later messages. Messages are acknowledged in the order they are
+// published, so a slow topic delays the acknowledgements for the others.
+// Messages for which route returns an empty topic are passed to onUnrouted
+// along with ErrNoRoute. If onUnrouted returns nil, the message is
+// acknowledged as handled. If onUnrouted is nil or returns an error,
+// publishing terminates with that error. When Close is called on the returned
+// sink, all the created sinks are closed. The returned sink implements the
+// Flushable interface.
+func NewRoutingSink(route func(Message) string, sinkForTopic func(topic string) (AsyncMessageSink, error), onUnrouted MessageErrorHandler) AsyncMessageSink {
+	return &routingSink{
+		route:        route,
+		sinkForTopic: sinkForTopic,
+		onUnrouted:   onUnrouted,
+		sinks:        make(map[string]AsyncMessageSink),
+	}
+}
+
+type routingSink struct {
+	route        func(Message) string
+	sinkForTopic func(topic string) (AsyncMessageSink, error)
+	onUnrouted   MessageErrorHandler
+
+	mu    sync.Mutex
+	sinks map[string]AsyncMessageSink
+
+	flushes flush.Tracker
+}
+
+var _ Flushable = (*routingSink)(nil)
+
+// routedMessage is a message awaiting its acknowledgement from the sink for
+// its topic, unless the message had no route.
+type routedMessage struct {
+	msg   Message
+	topic string
+}
+
+// sink returns the sink for the topic, creating it if needed.
+func (s *routingSink) sink(topic string) (AsyncMessageSink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sink, ok := s.sinks[topic]; ok {
+		return sink, nil
+	}
+	sink, err := s.sinkForTopic(topic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sink for topic %s: %w", topic, err)
+	}
+	s.sinks[topic] = sink
+	return sink, nil
+}
+
+func (s *routingSink) PublishMessages(ctx context.Context, acks chan<- Message, messages <-chan Message) (err error) {
+	s.flushes.Start()
+	defer func() { s.flushes.Stop(err) }()
+
+	rg, ctx := rungroup.New(ctx)
+
+	needAcks := make(chan routedMessage, 1024)
+	fromInner := make(chan routedMessage, cap(acks))
+
+	rg.Go(func() error {
+		toInner := make(map[string]chan Message)
+		for {
+			var msg Message
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case req := <-s.flushes.Requests():
+				s.flushes.Mark(req)
+				continue
+			case msg = <-messages:
+			}
+			s.flushes.Submitted()
+
+			topic := s.route(msg)
+			if topic == "" {
+				if s.onUnrouted == nil {
+					return ErrNoRoute
+				}
+				if err := s.onUnrouted(msg, ErrNoRoute); err != nil {
+					return err
+				}
+			}
+			select {
+			case needAcks <- routedMessage{msg: msg, topic: topic}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if topic == "" {
+				continue
+			}
+
+			to, ok := toInner[topic]
+			if !ok {
+				sink, err := s.sink(topic)
+				if err != nil {
+					return err
+				}
+				to = make(chan Message, cap(messages))
+				toInner[topic] = to
+				startRoute(ctx, rg, sink, topic, to, fromInner)
+			}
+			select {
+			case to <- msg:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+
+	rg.Go(func() error {
+		// arrived holds the acknowledgements received from the sink for
+		// each topic, before the messages published ahead of them are
+		// acknowledged.
+		arrived := make(map[string][]Message)
+		for {
+			var rm routedMessage
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case rm = <-needAcks:
+			}
+			if rm.topic != "" {
+				for len(arrived[rm.topic]) == 0 {
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case ack := <-fromInner:
+						arrived[ack.topic] = append(arrived[ack.topic], ack.msg)
+					}
+				}
+				ack := arrived[rm.topic][0]
+				arrived[rm.topic] = arrived[rm.topic][1:]
+				if !SameMessage(ack, rm.msg) {
+					return InvalidAckError{Acked: ack, Expected: rm.msg}
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case acks <- rm.msg:
+				s.flushes.Acked()
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+// startRoute publishes the messages for the topic to its sink, and forwards
+// the acknowledgements along with the topic.
+func startRoute(ctx context.Context, rg *rungroup.Group, sink AsyncMessageSink, topic string, messages <-chan Message, routedAcks chan<- routedMessage) {
+	acks := make(chan Message, cap(messages))
+	rg.Go(func() error {
+		return sink.PublishMessages(ctx, acks, messages)
+	})
+	rg.Go(func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case ack := <-acks:
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case routedAcks <- routedMessage{msg: ack, topic: topic}:
+				}
+			}
+		}
+	})
+}
+
+// Flush implements the Flushable interface. It waits for the messages to be
+// acknowledged by the sinks of their topics, rather than flushing those.
+func (s *routingSink) Flush(ctx context.Context) error {
+	return s.flushes.Flush(ctx)
+}
+
+// topics returns the topics of the created sinks, in order.
+func (s *routingSink) topics() []string {
+	topics := make([]string, 0, len(s.sinks))
+	for topic := range s.sinks {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Close closes all the created sinks.
+func (s *routingSink) Close() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, topic := range s.topics() {
+		err = multierror.Append(err, s.sinks[topic].Close()).ErrorOrNil()
+	}
+	return err
+}
+
+// Status returns the combined status of all the created sinks.
+func (s *routingSink) Status() (*Status, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statusers := make([]Statuser, 0, len(s.sinks))
+	for _, topic := range s.topics() {
+		statusers = append(statusers, s.sinks[topic])
+	}
+	return CombinedStatus(statusers...)
+}
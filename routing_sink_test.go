@@ -0,0 +1,173 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// routeSink records the messages published to it, and acknowledges each of
+// them after delay.
+type routeSink struct {
+	delay time.Duration
+
+	mu        sync.Mutex
+	published []string
+	closed    bool
+}
+
+func (s *routeSink) PublishMessages(ctx context.Context, acks chan<- Message, messages <-chan Message) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m := <-messages:
+			time.Sleep(s.delay)
+			s.mu.Lock()
+			s.published = append(s.published, string(m.Data()))
+			s.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case acks <- m:
+			}
+		}
+	}
+}
+
+func (s *routeSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *routeSink) Status() (*Status, error) {
+	return &Status{Working: true}, nil
+}
+
+// routeByPrefix routes messages to the topic before the colon in their payload.
+func routeByPrefix(msg Message) string {
+	if i := strings.Index(string(msg.Data()), ":"); i >= 0 {
+		return string(msg.Data())[:i]
+	}
+	return ""
+}
+
+func TestRoutingSink(t *testing.T) {
+	sinks := map[string]*routeSink{
+		"slow": {delay: 20 * time.Millisecond},
+		"fast": {},
+	}
+	var created []string
+	sink := NewRoutingSink(routeByPrefix, func(topic string) (AsyncMessageSink, error) {
+		created = append(created, topic)
+		return sinks[topic], nil
+	}, func(Message, error) error {
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message, 10)
+	acks := make(chan Message, 10)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishMessages(ctx, acks, msgs)
+	}()
+
+	var published []Message
+	for _, payload := range []string{"slow:1", "fast:1", "unrouted", "fast:2", "slow:2", "fast:3"} {
+		m := message(payload)
+		published = append(published, &m)
+		msgs <- &m
+	}
+	// Messages are acknowledged in order, even though the fast sink
+	// acknowledges its messages first.
+	for _, m := range published {
+		assert.Equal(t, m, <-acks)
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+
+	assert.Equal(t, []string{"slow", "fast"}, created)
+	assert.Equal(t, []string{"slow:1", "slow:2"}, sinks["slow"].published)
+	assert.Equal(t, []string{"fast:1", "fast:2", "fast:3"}, sinks["fast"].published)
+
+	status, err := sink.Status()
+	require.NoError(t, err)
+	assert.Equal(t, &Status{Working: true}, status)
+
+	require.NoError(t, sink.Close())
+	assert.True(t, sinks["slow"].closed)
+	assert.True(t, sinks["fast"].closed)
+}
+
+func TestRoutingSinkWithoutHandler(t *testing.T) {
+	sink := NewRoutingSink(routeByPrefix, func(string) (AsyncMessageSink, error) {
+		return &routeSink{}, nil
+	}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	m := message("unrouted")
+	msgs := make(chan Message, 1)
+	msgs <- &m
+	err := sink.PublishMessages(ctx, make(chan Message), msgs)
+	assert.Equal(t, ErrNoRoute, err)
+}
+
+func TestRoutingSinkCreateError(t *testing.T) {
+	createErr := errors.New("unknown topic")
+	sink := NewRoutingSink(routeByPrefix, func(string) (AsyncMessageSink, error) {
+		return nil, createErr
+	}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	m := message("orders:1")
+	msgs := make(chan Message, 1)
+	msgs <- &m
+	err := sink.PublishMessages(ctx, make(chan Message), msgs)
+	assert.True(t, errors.Is(err, createErr))
+}
+
+func TestRoutingSinkFlush(t *testing.T) {
+	sink := NewRoutingSink(routeByPrefix, func(topic string) (AsyncMessageSink, error) {
+		return &routeSink{delay: 50 * time.Millisecond}, nil
+	}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msgs := make(chan Message)
+	acks := make(chan Message, 10)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishMessages(ctx, acks, msgs)
+	}()
+
+	publish := func(payload string) {
+		m := message(payload)
+		msgs <- &m
+	}
+
+	publish("a:1")
+	publish("b:1")
+	require.NoError(t, sink.(Flushable).Flush(ctx))
+	assert.Len(t, acks, 2)
+
+	// Messages in flight when publishing fails are failed.
+	publish("a:2")
+	publish("unrouted")
+	assert.Equal(t, ErrNoRoute, <-errs)
+	assert.Equal(t, ErrNoRoute, sink.(Flushable).Flush(ctx))
+}
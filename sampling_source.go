@@ -0,0 +1,103 @@
+package substrate
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+var _ AsyncMessageSource = (*SamplingSource)(nil)
+
+// SamplingSource delivers a sample of the messages of a source, e.g. for a
+// new version of a consumer to process a fraction of the traffic in shadow
+// mode before it is rolled out.
+type SamplingSource struct {
+	source  AsyncMessageSource
+	keyFunc func(Message) []byte
+	// fraction holds the bits of the float64 fraction of the messages
+	// delivered, so that it can be changed while consuming.
+	fraction uint64
+}
+
+// NewSamplingSource returns a source that delivers the given fraction of the
+// messages consumed from source, between 0 and 1, and acknowledges the others
+// to source without delivering them. If keyFunc is nil, messages are sampled
+// randomly. Otherwise messages are sampled by hashing their key, as returned
+// by keyFunc, so that either all or none of the messages with the same key are
+// delivered. When Close is called on the returned source, this is also
+// propagated to source.
+func NewSamplingSource(source AsyncMessageSource, fraction float64, keyFunc func(Message) []byte) *SamplingSource {
+	s := &SamplingSource{source: source, keyFunc: keyFunc}
+	s.SetFraction(fraction)
+	return s
+}
+
+// SetFraction sets the fraction of the messages delivered, which applies from
+// the next message consumed, including while ConsumeMessages is running. The
+// fraction is clamped between 0 and 1. With a keyFunc, increasing the fraction
+// keeps delivering the keys sampled so far.
+func (s *SamplingSource) SetFraction(fraction float64) {
+	fraction = math.Max(0, math.Min(1, fraction))
+	atomic.StoreUint64(&s.fraction, math.Float64bits(fraction))
+}
+
+// Fraction returns the fraction of the messages delivered.
+func (s *SamplingSource) Fraction() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.fraction))
+}
+
+// ConsumeMessages implements the AsyncMessageSource interface.
+func (s *SamplingSource) ConsumeMessages(ctx context.Context, messages chan<- Message, acks <-chan Message) error {
+	// The messages are checked by a single goroutine, so the random source
+	// doesn't need to be locked.
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	vs := &validatingSource{
+		source: s.source,
+		check: func(msg Message) (bool, error) {
+			return !s.sampled(msg, rnd), nil
+		},
+	}
+	return vs.ConsumeMessages(ctx, messages, acks)
+}
+
+// sampled returns whether a message is part of the sample.
+func (s *SamplingSource) sampled(msg Message, rnd *rand.Rand) bool {
+	fraction := s.Fraction()
+	switch {
+	case fraction >= 1:
+		return true
+	case fraction <= 0:
+		return false
+	case s.keyFunc == nil:
+		return rnd.Float64() < fraction
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(s.keyFunc(msg))
+	// The top 53 bits of the mixed hash make a float64 uniformly
+	// distributed in [0, 1).
+	return float64(mix64(h.Sum64())>>11)/(1<<53) < fraction
+}
+
+// mix64 is the finalizer of murmur3, which spreads every bit of the FNV hash,
+// whose top bits barely depend on the last bytes of the key, over all bits.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// Close closes the underlying source.
+func (s *SamplingSource) Close() error {
+	return s.source.Close()
+}
+
+// Status returns the status of the underlying source.
+func (s *SamplingSource) Status() (*Status, error) {
+	return s.source.Status()
+}
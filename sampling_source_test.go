@@ -0,0 +1,129 @@
+package substrate
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// consumeSample consumes the messages from a sampling source of inner, until
+// all of them are acknowledged to inner, and returns the delivered ones.
+func consumeSample(t *testing.T, source *SamplingSource, inner *mockAsyncSource, msgs []Message, during func(delivered int)) []Message {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, m := range msgs {
+		inner.toSend <- m
+	}
+	delivered := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, delivered, acks)
+	}()
+
+	var sample []Message
+	for acked := 0; acked < len(msgs); {
+		select {
+		case m := <-delivered:
+			sample = append(sample, m)
+			if during != nil {
+				during(len(sample))
+			}
+			acks <- m
+		case m := <-inner.acked:
+			// Every message is acknowledged in order, whether it was
+			// delivered or not.
+			require.Equal(t, msgs[acked], m)
+			acked++
+		case err := <-errs:
+			t.Fatalf("consuming failed: %s", err)
+		}
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+	return sample
+}
+
+func newSamplingMock(n int) *mockAsyncSource {
+	return &mockAsyncSource{
+		toSend: make(chan Message, n),
+		acked:  make(chan Message, n),
+		closed: make(chan struct{}),
+	}
+}
+
+func numberedMessages(n int, key func(i int) string) []Message {
+	msgs := make([]Message, n)
+	for i := range msgs {
+		m := message(key(i))
+		msgs[i] = &m
+	}
+	return msgs
+}
+
+func TestSamplingSourceRandom(t *testing.T) {
+	const n = 20000
+	inner := newSamplingMock(n)
+	source := NewSamplingSource(inner, 0.1, nil)
+
+	sample := consumeSample(t, source, inner, numberedMessages(n, strconv.Itoa), nil)
+	// The standard deviation of the sample size is about 42 messages.
+	assert.InDelta(t, 2000, len(sample), 250)
+}
+
+func TestSamplingSourceKeyed(t *testing.T) {
+	const (
+		n    = 20000
+		keys = 4000
+	)
+	inner := newSamplingMock(n)
+	source := NewSamplingSource(inner, 0.25, func(msg Message) []byte {
+		return msg.Data()
+	})
+
+	msgs := numberedMessages(n, func(i int) string {
+		return "entity-" + strconv.Itoa(i%keys)
+	})
+	sample := consumeSample(t, source, inner, msgs, nil)
+
+	counts := make(map[string]int)
+	for _, m := range sample {
+		counts[string(m.Data())]++
+	}
+	// All the messages of a sampled key are delivered.
+	for key, count := range counts {
+		assert.Equal(t, n/keys, count, key)
+	}
+	// The standard deviation of the number of sampled keys is about 27.
+	assert.InDelta(t, 1000, len(counts), 150)
+
+	// The same keys are sampled again.
+	resampled := consumeSample(t, source, inner, msgs, nil)
+	assert.Equal(t, sample, resampled)
+}
+
+func TestSamplingSourceSetFraction(t *testing.T) {
+	const n = 1000
+	inner := newSamplingMock(n)
+	source := NewSamplingSource(inner, 1, nil)
+
+	// Once the fraction is set to 0 while consuming, no more messages are
+	// delivered.
+	sample := consumeSample(t, source, inner, numberedMessages(n, strconv.Itoa), func(delivered int) {
+		if delivered == 10 {
+			source.SetFraction(0)
+		}
+	})
+	assert.Len(t, sample, 10)
+	assert.Equal(t, 0.0, source.Fraction())
+
+	source.SetFraction(2)
+	assert.Equal(t, 1.0, source.Fraction())
+	sample = consumeSample(t, source, inner, numberedMessages(n, strconv.Itoa), nil)
+	assert.Len(t, sample, n)
+}
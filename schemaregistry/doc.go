@@ -0,0 +1,24 @@
+// Package schemaregistry provides validation of messages against a confluent
+// style schema registry.
+//
+// Usage
+//
+// Payloads are expected to be in the confluent wire format, that is a zero
+// magic byte, followed by the big endian 4 byte id of the schema they were
+// written with. A Validator accepts payloads written with a schema that is a
+// version of the configured subject, optionally restricted to specific
+// versions. The payload itself is not decoded.
+//
+// The Validate method can be used with the validating sink and source
+// wrappers of the substrate package, so that messages written with an
+// unexpected schema are rejected before they reach the broker, or before they
+// are delivered to the consumer:
+//
+//      v, err := schemaregistry.NewValidator(schemaregistry.Config{
+//          URL:     "http://schema-registry:8081",
+//          Subject: "orders-value",
+//      })
+//      ...
+//      sink = substrate.NewValidatingSink(sink, v.Validate, onInvalid)
+//
+package schemaregistry
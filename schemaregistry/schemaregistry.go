@@ -0,0 +1,259 @@
+package schemaregistry
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uw-labs/substrate"
+)
+
+const (
+	magicByte              = 0
+	headerSize             = 5
+	contentType            = "application/vnd.schemaregistry.v1+json"
+	defaultTimeout         = 10 * time.Second
+	defaultRefreshInterval = time.Minute
+)
+
+// ErrNoSchemaID is returned when a payload does not start with the magic
+// byte and schema id of the confluent wire format.
+var ErrNoSchemaID = errors.New("payload does not start with a schema id")
+
+// UnexpectedSchemaError is returned when a payload was written with a schema
+// that is not an accepted version of the configured subject.
+type UnexpectedSchemaError struct {
+	Subject string
+	ID      int
+}
+
+func (e UnexpectedSchemaError) Error() string {
+	return fmt.Sprintf("schema id %d is not an accepted version of subject %s", e.ID, e.Subject)
+}
+
+// Config is the configuration parameters for a Validator.
+type Config struct {
+	// URL is the base URL of the schema registry.
+	URL string
+	// Username and Password, when set, are used for basic authentication.
+	Username string
+	Password string
+	// Client is the HTTP client used for requests. Defaults to a client
+	// with a 10s timeout.
+	Client *http.Client
+	// Subject is the subject that payloads must have been written with.
+	Subject string
+	// Versions restricts the accepted schema versions of the subject. When
+	// empty, any version is accepted.
+	Versions []int
+	// Schema, when AutoRegister is set, is registered under the subject when
+	// the validator is created, so that it is accepted even if it is new.
+	Schema string
+	// SchemaType is the type of Schema, for example PROTOBUF or JSON.
+	// Defaults to AVRO, as in the registry itself.
+	SchemaType string
+	// AutoRegister registers Schema under the subject.
+	AutoRegister bool
+	// RefreshInterval is the minimum interval between fetching the versions
+	// of the subject from the registry when an unknown schema id is seen.
+	// Defaults to 1m.
+	RefreshInterval time.Duration
+}
+
+// Validator checks that messages are framed with the schema id of an accepted
+// version of a subject. Its Validate method is intended for use with
+// substrate.NewValidatingSink and substrate.NewValidatingSource.
+type Validator struct {
+	conf       Config
+	versions   map[int]bool
+	registered int
+
+	mu          sync.Mutex
+	accepted    map[int]bool
+	lastRefresh time.Time
+}
+
+// NewValidator returns a new Validator, registering the configured schema
+// when AutoRegister is set, and fetching the accepted schema ids.
+func NewValidator(c Config) (*Validator, error) {
+	if c.URL == "" {
+		return nil, fmt.Errorf("schema registry url must not be empty")
+	}
+	if c.Subject == "" {
+		return nil, fmt.Errorf("schema registry subject must not be empty")
+	}
+	if c.AutoRegister && c.Schema == "" {
+		return nil, fmt.Errorf("schema must be set to auto register")
+	}
+	c.URL = strings.TrimSuffix(c.URL, "/")
+	if c.Client == nil {
+		c.Client = &http.Client{Timeout: defaultTimeout}
+	}
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = defaultRefreshInterval
+	}
+
+	v := &Validator{
+		conf:     c,
+		accepted: make(map[int]bool),
+	}
+	if len(c.Versions) > 0 {
+		v.versions = make(map[int]bool, len(c.Versions))
+		for _, version := range c.Versions {
+			v.versions[version] = true
+		}
+	}
+
+	if c.AutoRegister {
+		id, err := v.register()
+		if err != nil {
+			return nil, err
+		}
+		v.registered = id
+	}
+	if err := v.refresh(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// SchemaID returns the schema id a payload in the confluent wire format was
+// written with.
+func SchemaID(data []byte) (int, error) {
+	if len(data) < headerSize || data[0] != magicByte {
+		return 0, ErrNoSchemaID
+	}
+	return int(binary.BigEndian.Uint32(data[1:headerSize])), nil
+}
+
+// Frame returns the payload prefixed with the magic byte and schema id of the
+// confluent wire format.
+func Frame(id int, payload []byte) []byte {
+	framed := make([]byte, headerSize+len(payload))
+	framed[0] = magicByte
+	binary.BigEndian.PutUint32(framed[1:headerSize], uint32(id))
+	copy(framed[headerSize:], payload)
+	return framed
+}
+
+// RegisteredID returns the id of the auto registered schema, or zero if
+// AutoRegister was not set.
+func (v *Validator) RegisteredID() int {
+	return v.registered
+}
+
+// Validate returns nil if the message was written with an accepted schema.
+func (v *Validator) Validate(msg substrate.Message) error {
+	id, err := SchemaID(msg.Data())
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.accepted[id] {
+		return nil
+	}
+	// The id may belong to a version registered since the last refresh.
+	if time.Since(v.lastRefresh) >= v.conf.RefreshInterval {
+		if err := v.refreshLocked(); err != nil {
+			return err
+		}
+		if v.accepted[id] {
+			return nil
+		}
+	}
+	return UnexpectedSchemaError{Subject: v.conf.Subject, ID: id}
+}
+
+func (v *Validator) refresh() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.refreshLocked()
+}
+
+// refreshLocked fetches the schema ids of the accepted versions of the
+// subject. It must be called with mu held.
+func (v *Validator) refreshLocked() error {
+	v.lastRefresh = time.Now()
+
+	var versions []int
+	if err := v.get("/subjects/"+url.PathEscape(v.conf.Subject)+"/versions", &versions); err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if v.versions != nil && !v.versions[version] {
+			continue
+		}
+		var schema struct {
+			ID int `json:"id"`
+		}
+		if err := v.get(fmt.Sprintf("/subjects/%s/versions/%d", url.PathEscape(v.conf.Subject), version), &schema); err != nil {
+			return err
+		}
+		v.accepted[schema.ID] = true
+	}
+	return nil
+}
+
+func (v *Validator) register() (int, error) {
+	body, err := json.Marshal(struct {
+		Schema     string `json:"schema"`
+		SchemaType string `json:"schemaType,omitempty"`
+	}{v.conf.Schema, v.conf.SchemaType})
+	if err != nil {
+		return 0, err
+	}
+
+	var resp struct {
+		ID int `json:"id"`
+	}
+	if err := v.do(http.MethodPost, "/subjects/"+url.PathEscape(v.conf.Subject)+"/versions", body, &resp); err != nil {
+		return 0, err
+	}
+	return resp.ID, nil
+}
+
+func (v *Validator) get(path string, out interface{}) error {
+	return v.do(http.MethodGet, path, nil, out)
+}
+
+func (v *Validator) do(method, path string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, v.conf.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", contentType)
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if v.conf.Username != "" {
+		req.SetBasicAuth(v.conf.Username, v.conf.Password)
+	}
+
+	resp, err := v.conf.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var regErr struct {
+			ErrorCode int    `json:"error_code"`
+			Message   string `json:"message"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&regErr); err == nil && regErr.Message != "" {
+			return fmt.Errorf("schema registry request %s %s failed with status %s: %s", method, path, resp.Status, regErr.Message)
+		}
+		return fmt.Errorf("schema registry request %s %s failed with status %s", method, path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,161 @@
+package schemaregistry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type message struct {
+	data []byte
+}
+
+func (m *message) Data() []byte {
+	return m.data
+}
+
+// fakeRegistry serves the subset of the schema registry API used by the
+// validator, for a single subject.
+type fakeRegistry struct {
+	mu      sync.Mutex
+	subject string
+	ids     []int // schema id of each version, starting at version 1
+	nextID  int
+}
+
+func (fr *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	prefix := "/subjects/" + fr.subject + "/versions"
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == prefix:
+		var req struct {
+			Schema     string `json:"schema"`
+			SchemaType string `json:"schemaType"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Schema == "" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_, _ = w.Write([]byte(`{"error_code":42201,"message":"Invalid schema"}`))
+			return
+		}
+		fr.ids = append(fr.ids, fr.nextID)
+		_ = json.NewEncoder(w).Encode(map[string]int{"id": fr.nextID})
+		fr.nextID++
+	case r.Method == http.MethodGet && r.URL.Path == prefix:
+		var versions []int
+		for i := range fr.ids {
+			versions = append(versions, i+1)
+		}
+		_ = json.NewEncoder(w).Encode(versions)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, prefix+"/"):
+		var version int
+		if _, err := fmt.Sscanf(strings.TrimPrefix(r.URL.Path, prefix+"/"), "%d", &version); err != nil || version < 1 || version > len(fr.ids) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error_code":40402,"message":"Version not found."}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"subject": fr.subject,
+			"version": version,
+			"id":      fr.ids[version-1],
+		})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error_code":40401,"message":"Subject not found."}`))
+	}
+}
+
+func (fr *fakeRegistry) addVersion(id int) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.ids = append(fr.ids, id)
+}
+
+func TestValidate(t *testing.T) {
+	reg := &fakeRegistry{subject: "orders-value", ids: []int{10, 11}}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	v, err := NewValidator(Config{URL: srv.URL, Subject: "orders-value"})
+	require.NoError(t, err)
+
+	assert.NoError(t, v.Validate(&message{data: Frame(10, []byte("payload"))}))
+	assert.NoError(t, v.Validate(&message{data: Frame(11, nil)}))
+	assert.Equal(t, UnexpectedSchemaError{Subject: "orders-value", ID: 12}, v.Validate(&message{data: Frame(12, []byte("payload"))}))
+	assert.Equal(t, ErrNoSchemaID, v.Validate(&message{data: []byte("plain text")}))
+	assert.Equal(t, ErrNoSchemaID, v.Validate(&message{data: []byte{0, 0}}))
+}
+
+func TestValidateRestrictedVersions(t *testing.T) {
+	reg := &fakeRegistry{subject: "orders-value", ids: []int{10, 11, 12}}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	v, err := NewValidator(Config{URL: srv.URL, Subject: "orders-value", Versions: []int{2, 3}})
+	require.NoError(t, err)
+
+	assert.Equal(t, UnexpectedSchemaError{Subject: "orders-value", ID: 10}, v.Validate(&message{data: Frame(10, nil)}))
+	assert.NoError(t, v.Validate(&message{data: Frame(11, nil)}))
+	assert.NoError(t, v.Validate(&message{data: Frame(12, nil)}))
+}
+
+func TestValidateRefreshesUnknownIDs(t *testing.T) {
+	reg := &fakeRegistry{subject: "orders-value", ids: []int{10}}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	v, err := NewValidator(Config{URL: srv.URL, Subject: "orders-value", RefreshInterval: 50 * time.Millisecond})
+	require.NoError(t, err)
+
+	reg.addVersion(20)
+	// Within the refresh interval, the registry is not asked again.
+	assert.Error(t, v.Validate(&message{data: Frame(20, nil)}))
+	time.Sleep(60 * time.Millisecond)
+	assert.NoError(t, v.Validate(&message{data: Frame(20, nil)}))
+}
+
+func TestAutoRegister(t *testing.T) {
+	reg := &fakeRegistry{subject: "orders-value", nextID: 7}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	v, err := NewValidator(Config{
+		URL:          srv.URL,
+		Subject:      "orders-value",
+		Schema:       `syntax = "proto3"; message Order {}`,
+		SchemaType:   "PROTOBUF",
+		AutoRegister: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 7, v.RegisteredID())
+	assert.NoError(t, v.Validate(&message{data: Frame(v.RegisteredID(), []byte("payload"))}))
+}
+
+func TestRegistryErrors(t *testing.T) {
+	reg := &fakeRegistry{subject: "orders-value"}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	_, err := NewValidator(Config{URL: srv.URL, Subject: "unknown"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Subject not found.")
+
+	_, err = NewValidator(Config{URL: srv.URL, Subject: "orders-value", AutoRegister: true})
+	assert.Error(t, err)
+}
+
+func TestSchemaID(t *testing.T) {
+	id, err := SchemaID(Frame(0x01020304, []byte("payload")))
+	require.NoError(t, err)
+	assert.Equal(t, 0x01020304, id)
+	assert.Equal(t, []byte{0, 0, 0, 0, 42, 'x'}, Frame(42, []byte("x")))
+}
@@ -0,0 +1,112 @@
+package substrate_test
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/inmemory"
+)
+
+// TestShutdownReturnsContextError checks that the wrappers return the error of
+// their context once it is done, as the sources and sinks they wrap do. The
+// deadline of the context is exceeded, so that wrappers returning nil, or
+// context.Canceled for their own cancellation, are caught.
+func TestShutdownReturnsContextError(t *testing.T) {
+	broker := inmemory.NewBroker()
+	key := func(msg substrate.Message) string { return string(msg.Data()) }
+	valid := func(substrate.Message) error { return nil }
+	noTimestamp := func(substrate.Message) (time.Time, bool) { return time.Time{}, false }
+
+	sources := map[string]func() substrate.AsyncMessageSource{
+		"expiring": func() substrate.AsyncMessageSource {
+			return substrate.NewExpiringSource(topicSource(t, broker, "t"), time.Hour, nil, nil)
+		},
+		"idempotent": func() substrate.AsyncMessageSource {
+			return substrate.NewIdempotentSource(topicSource(t, broker, "t"), substrate.NewMemoryIdempotencyStore(), key, time.Hour)
+		},
+		"migration": func() substrate.AsyncMessageSource {
+			return substrate.NewMigrationSource(topicSource(t, broker, "t"), topicSource(t, broker, "u"), key, make(chan struct{}), substrate.MigrationSourceOptions{})
+		},
+		"paced": func() substrate.AsyncMessageSource {
+			return substrate.NewPacedSource(topicSource(t, broker, "t"), noTimestamp, 1, time.Second)
+		},
+		"priority": func() substrate.AsyncMessageSource {
+			return substrate.NewPrioritySource(topicSource(t, broker, "t"), topicSource(t, broker, "u"), substrate.PrioritySourceOptions{})
+		},
+		"recording": func() substrate.AsyncMessageSource {
+			return substrate.NewRecordingSource(topicSource(t, broker, "t"), ioutil.Discard)
+		},
+		"size limited": func() substrate.AsyncMessageSource {
+			return substrate.NewSizeLimitedSource(topicSource(t, broker, "t"), 1024, nil)
+		},
+		"claim check": func() substrate.AsyncMessageSource {
+			return substrate.NewClaimCheckSource(topicSource(t, broker, "t"), func(context.Context, string) ([]byte, error) { return nil, nil })
+		},
+		"validating": func() substrate.AsyncMessageSource {
+			return substrate.NewValidatingSource(topicSource(t, broker, "t"), valid, nil)
+		},
+	}
+	for name, newSource := range sources {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			err := newSource().ConsumeMessages(ctx, make(chan substrate.Message), make(chan substrate.Message))
+			assert.Equal(t, context.DeadlineExceeded, err)
+		})
+	}
+
+	sinks := map[string]func() substrate.AsyncMessageSink{
+		"size limited": func() substrate.AsyncMessageSink {
+			return substrate.NewSizeLimitedSink(topicSink(t, broker, "t"), 1024, substrate.RejectOversize(nil))
+		},
+		"validating": func() substrate.AsyncMessageSink {
+			return substrate.NewValidatingSink(topicSink(t, broker, "t"), valid, nil)
+		},
+		"routing": func() substrate.AsyncMessageSink {
+			return substrate.NewRoutingSink(key, func(topic string) (substrate.AsyncMessageSink, error) {
+				return topicSink(t, broker, topic), nil
+			}, nil)
+		},
+	}
+	for name, newSink := range sinks {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			err := newSink().PublishMessages(ctx, make(chan substrate.Message), make(chan substrate.Message))
+			assert.Equal(t, context.DeadlineExceeded, err)
+		})
+	}
+
+	runners := map[string]func(ctx context.Context) error{
+		"synchronous source": func(ctx context.Context) error {
+			return substrate.NewSynchronousMessageSource(topicSource(t, broker, "t")).ConsumeMessages(ctx, func(context.Context, substrate.Message) error {
+				return nil
+			})
+		},
+		"keyed worker pool": func(ctx context.Context) error {
+			return substrate.NewKeyedWorkerPool(topicSource(t, broker, "t"), nil, 2, func(context.Context, substrate.Message) error {
+				return nil
+			}).Run(ctx)
+		},
+		"pipe": func(ctx context.Context) error {
+			return substrate.Pipe(ctx, topicSource(t, broker, "t"), topicSink(t, broker, "u"), substrate.PipeOptions{})
+		},
+		"responder": func(ctx context.Context) error {
+			return substrate.NewResponder(topicSource(t, broker, "t"), topicSink(t, broker, "u"), func(context.Context, substrate.Message) (substrate.Message, error) {
+				return nil, nil
+			}).Run(ctx)
+		},
+	}
+	for name, run := range runners {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			assert.Equal(t, context.DeadlineExceeded, run(ctx))
+		})
+	}
+}
@@ -0,0 +1,398 @@
+package substrate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/gofrs/uuid"
+	"github.com/hashicorp/go-multierror"
+	"github.com/uw-labs/sync/rungroup"
+)
+
+// claimCheckPrefix starts the payload of the pointer messages published in
+// place of messages stored in an overflow sink, and is followed by the
+// reference of the stored message.
+var claimCheckPrefix = []byte("substrate-claim-check:")
+
+// OversizeError is the error passed to a MessageErrorHandler, or returned
+// when there is none, for a message exceeding the size limit of a sink.
+type OversizeError struct {
+	Size     int
+	MaxBytes int
+}
+
+func (e OversizeError) Error() string {
+	return fmt.Sprintf("message of %d bytes exceeds the limit of %d bytes", e.Size, e.MaxBytes)
+}
+
+// OversizeHandler determines how a size limited sink handles the messages
+// exceeding its limit. It is created with RejectOversize, TruncateOversize or
+// ClaimCheckOversize.
+type OversizeHandler struct {
+	reject   MessageErrorHandler
+	truncate func(msg Message, maxBytes int) (Message, error)
+	overflow AsyncMessageSink
+}
+
+// RejectOversize returns an OversizeHandler that does not publish oversize
+// messages, and passes them to onOversize along with an OversizeError
+// instead. If onOversize returns nil, the message is acknowledged as handled.
+// If onOversize is nil or returns an error, publishing terminates with that
+// error.
+func RejectOversize(onOversize MessageErrorHandler) OversizeHandler {
+	return OversizeHandler{reject: onOversize}
+}
+
+// TruncateOversize returns an OversizeHandler that publishes the message
+// returned by truncate in place of an oversize message. Publishing terminates
+// with an error if truncate fails, or returns a message that is still over
+// the limit.
+func TruncateOversize(truncate func(msg Message, maxBytes int) (Message, error)) OversizeHandler {
+	return OversizeHandler{truncate: truncate}
+}
+
+// ClaimCheckOversize returns an OversizeHandler that publishes oversize
+// messages to overflow, with a generated reference as their key, and then
+// publishes a small pointer message holding the reference in their place. The
+// pointer message keeps the key and attributes of the original message.
+// Sources wrapped with NewClaimCheckSource fetch the original payloads back.
+// The overflow sink is closed along with the size limited sink.
+func ClaimCheckOversize(overflow AsyncMessageSink) OversizeHandler {
+	return OversizeHandler{overflow: overflow}
+}
+
+// NewSizeLimitedSink returns a sink that publishes the messages with a
+// payload of at most maxBytes to sink, and handles larger messages with
+// onOversize. When Close is called on the returned sink, this is also
+// propagated to sink.
+func NewSizeLimitedSink(sink AsyncMessageSink, maxBytes int, onOversize OversizeHandler) AsyncMessageSink {
+	return &sizeLimitedSink{
+		sink:       sink,
+		maxBytes:   maxBytes,
+		onOversize: onOversize,
+	}
+}
+
+type sizeLimitedSink struct {
+	sink       AsyncMessageSink
+	maxBytes   int
+	onOversize OversizeHandler
+}
+
+// replacedMessage is a message awaiting its acknowledgement, along with the
+// message published in its place, which is nil if it was rejected.
+type replacedMessage struct {
+	msg       Message
+	published Message
+}
+
+// claimCheckPointer is published in place of a message stored in the overflow
+// sink. Backends retrieve the key and attributes from the original message.
+type claimCheckPointer struct {
+	original Message
+	data     []byte
+}
+
+func (m *claimCheckPointer) Data() []byte {
+	return m.data
+}
+
+func (m *claimCheckPointer) Original() Message {
+	return m.original
+}
+
+// claimCheckOverflow is a message published to the overflow sink.
+type claimCheckOverflow struct {
+	data []byte
+	ref  []byte
+}
+
+func (m *claimCheckOverflow) Data() []byte {
+	return m.data
+}
+
+func (m *claimCheckOverflow) Key() []byte {
+	return m.ref
+}
+
+func (s *sizeLimitedSink) PublishMessages(ctx context.Context, acks chan<- Message, messages <-chan Message) error {
+	rg, ctx := rungroup.New(ctx)
+
+	toInner := make(chan Message, cap(messages))
+	fromInner := make(chan Message, cap(acks))
+	needAcks := make(chan replacedMessage, 1024)
+
+	rg.Go(func() error {
+		return s.sink.PublishMessages(ctx, fromInner, toInner)
+	})
+
+	toOverflow := make(chan Message)
+	overflowAcks := make(chan Message)
+	if s.onOversize.overflow != nil {
+		rg.Go(func() error {
+			return s.onOversize.overflow.PublishMessages(ctx, overflowAcks, toOverflow)
+		})
+	}
+
+	// storeOverflow publishes the payload to the overflow sink, and returns
+	// the pointer to publish in its place once it is acknowledged.
+	storeOverflow := func(msg Message) (Message, error) {
+		ref := []byte(uuid.Must(uuid.NewV4()).String())
+		om := &claimCheckOverflow{data: msg.Data(), ref: ref}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case toOverflow <- om:
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case ack := <-overflowAcks:
+			if !SameMessage(ack, om) {
+				return nil, InvalidAckError{Acked: ack, Expected: om}
+			}
+		}
+		return &claimCheckPointer{original: msg, data: append(append([]byte{}, claimCheckPrefix...), ref...)}, nil
+	}
+
+	rg.Go(func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case msg := <-messages:
+				rm := replacedMessage{msg: msg, published: msg}
+				if size := len(msg.Data()); size > s.maxBytes {
+					var err error
+					switch h := s.onOversize; {
+					case h.truncate != nil:
+						rm.published, err = h.truncate(msg, s.maxBytes)
+						if err == nil && len(rm.published.Data()) > s.maxBytes {
+							err = OversizeError{Size: len(rm.published.Data()), MaxBytes: s.maxBytes}
+						}
+					case h.overflow != nil:
+						rm.published, err = storeOverflow(msg)
+					default:
+						rm.published = nil
+						oerr := OversizeError{Size: size, MaxBytes: s.maxBytes}
+						if h.reject == nil {
+							err = oerr
+						} else {
+							err = h.reject(msg, oerr)
+						}
+					}
+					if err != nil {
+						return err
+					}
+				}
+				select {
+				case needAcks <- rm:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				if rm.published == nil {
+					continue
+				}
+				select {
+				case toInner <- rm.published:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	})
+
+	rg.Go(func() error {
+		for {
+			var rm replacedMessage
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case rm = <-needAcks:
+			}
+			if rm.published != nil {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case ack := <-fromInner:
+					if !SameMessage(ack, rm.published) {
+						return InvalidAckError{Acked: ack, Expected: rm.published}
+					}
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case acks <- rm.msg:
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+// Close closes the underlying sink, and the overflow sink if there is one.
+func (s *sizeLimitedSink) Close() (err error) {
+	closers := []io.Closer{s.sink}
+	if s.onOversize.overflow != nil {
+		closers = append(closers, s.onOversize.overflow)
+	}
+	for _, closer := range closers {
+		err = multierror.Append(err, closer.Close()).ErrorOrNil()
+	}
+	return err
+}
+
+// Status returns the combined status of the underlying sink and the overflow
+// sink if there is one.
+func (s *sizeLimitedSink) Status() (*Status, error) {
+	if s.onOversize.overflow == nil {
+		return s.sink.Status()
+	}
+	return CombinedStatus(s.sink, s.onOversize.overflow)
+}
+
+// NewSizeLimitedSource returns a source that delivers the messages consumed
+// from source with a payload of at most maxBytes, e.g. to guard consumers
+// against malformed giant messages. Larger messages are not delivered, and
+// are passed to onOversize along with an OversizeError instead, which may for
+// example publish them to a dead letter sink. If onOversize returns nil, the
+// message is acknowledged to source, so that it doesn't block the messages
+// after it. If onOversize is nil or returns an error, consuming terminates
+// with that error. When Close is called on the returned source, this is also
+// propagated to source.
+func NewSizeLimitedSource(source AsyncMessageSource, maxBytes int, onOversize MessageErrorHandler) AsyncMessageSource {
+	return &validatingSource{
+		source: source,
+		check: func(msg Message) (bool, error) {
+			return checkSize(msg, maxBytes, onOversize)
+		},
+	}
+}
+
+// checkSize checks the size of msg, reporting whether it was over the limit
+// and handled.
+func checkSize(msg Message, maxBytes int, onOversize MessageErrorHandler) (bool, error) {
+	size := len(msg.Data())
+	if size <= maxBytes {
+		return false, nil
+	}
+	oerr := OversizeError{Size: size, MaxBytes: maxBytes}
+	if onOversize == nil {
+		return false, oerr
+	}
+	if err := onOversize(msg, oerr); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// NewClaimCheckSource returns a source that replaces the pointer messages
+// published by a sink using ClaimCheckOversize with the original payloads,
+// which are fetched by reference with fetch. Other messages are delivered as
+// they are. When Close is called on the returned source, this is also
+// propagated to source.
+func NewClaimCheckSource(source AsyncMessageSource, fetch func(ctx context.Context, ref string) ([]byte, error)) AsyncMessageSource {
+	return &claimCheckSource{
+		source: source,
+		fetch:  fetch,
+	}
+}
+
+type claimCheckSource struct {
+	source AsyncMessageSource
+	fetch  func(ctx context.Context, ref string) ([]byte, error)
+}
+
+// claimCheckedMessage is a pointer message with its payload fetched.
+type claimCheckedMessage struct {
+	original Message
+	data     []byte
+}
+
+func (m *claimCheckedMessage) Data() []byte {
+	return m.data
+}
+
+// Original returns the pointer message consumed from the underlying source.
+func (m *claimCheckedMessage) Original() Message {
+	return m.original
+}
+
+func (s *claimCheckSource) ConsumeMessages(ctx context.Context, messages chan<- Message, acks <-chan Message) error {
+	rg, ctx := rungroup.New(ctx)
+
+	fromInner := make(chan Message, cap(messages))
+	toInner := make(chan Message, cap(acks))
+	needAcks := make(chan replacedMessage, 1024)
+
+	rg.Go(func() error {
+		return s.source.ConsumeMessages(ctx, fromInner, toInner)
+	})
+
+	rg.Go(func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case msg := <-fromInner:
+				rm := replacedMessage{msg: msg, published: msg}
+				if data := msg.Data(); bytes.HasPrefix(data, claimCheckPrefix) {
+					payload, err := s.fetch(ctx, string(data[len(claimCheckPrefix):]))
+					if err != nil {
+						return err
+					}
+					rm.published = &claimCheckedMessage{original: msg, data: payload}
+				}
+				select {
+				case needAcks <- rm:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				select {
+				case messages <- rm.published:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	})
+
+	rg.Go(func() error {
+		for {
+			var rm replacedMessage
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case rm = <-needAcks:
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case ack := <-acks:
+				if !SameMessage(ack, rm.published) {
+					return InvalidAckError{Acked: ack, Expected: rm.published}
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case toInner <- rm.msg:
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+// Close closes the underlying source.
+func (s *claimCheckSource) Close() error {
+	return s.source.Close()
+}
+
+// Status returns the status of the underlying source.
+func (s *claimCheckSource) Status() (*Status, error) {
+	return s.source.Status()
+}
@@ -0,0 +1,269 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingAsyncSink acknowledges and records every message.
+type recordingAsyncSink struct {
+	published chan Message
+	closed    chan struct{}
+}
+
+func newRecordingAsyncSink() *recordingAsyncSink {
+	return &recordingAsyncSink{
+		published: make(chan Message, 16),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (s *recordingAsyncSink) PublishMessages(ctx context.Context, acks chan<- Message, messages <-chan Message) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m := <-messages:
+			s.published <- m
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case acks <- m:
+			}
+		}
+	}
+}
+
+func (s *recordingAsyncSink) Close() error {
+	close(s.closed)
+	return nil
+}
+
+func (s *recordingAsyncSink) Status() (*Status, error) {
+	return &Status{Working: true}, nil
+}
+
+type keyedTestMessage struct {
+	data []byte
+	key  []byte
+}
+
+func (m *keyedTestMessage) Data() []byte {
+	return m.data
+}
+
+func (m *keyedTestMessage) Key() []byte {
+	return m.key
+}
+
+// publishAll publishes msgs to sink, and returns the acknowledged messages.
+func publishAll(ctx context.Context, sink AsyncMessageSink, msgs ...Message) ([]Message, error) {
+	acks := make(chan Message, len(msgs))
+	toSend := make(chan Message, len(msgs))
+	for _, m := range msgs {
+		toSend <- m
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishMessages(ctx, acks, toSend)
+	}()
+
+	var acked []Message
+	for range msgs {
+		select {
+		case ack := <-acks:
+			acked = append(acked, ack)
+		case err := <-errs:
+			return acked, err
+		}
+	}
+	return acked, nil
+}
+
+func TestSizeLimitedSinkReject(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	inner := newRecordingAsyncSink()
+	var rejected []Message
+	sink := NewSizeLimitedSink(inner, 5, RejectOversize(func(msg Message, err error) error {
+		assert.Equal(t, OversizeError{Size: 6, MaxBytes: 5}, err)
+		rejected = append(rejected, msg)
+		return nil
+	}))
+
+	small, large, exact := message("small"), message("larger"), message("exact")
+	acked, err := publishAll(ctx, sink, &small, &large, &exact)
+	require.NoError(t, err)
+	assert.Equal(t, []Message{&small, &large, &exact}, acked)
+	assert.Equal(t, []Message{&large}, rejected)
+	assert.Equal(t, &small, <-inner.published)
+	assert.Equal(t, &exact, <-inner.published)
+
+	// Without a handler, an oversize message terminates publishing.
+	sink = NewSizeLimitedSink(newRecordingAsyncSink(), 5, RejectOversize(nil))
+	_, err = publishAll(ctx, sink, &large)
+	assert.Equal(t, OversizeError{Size: 6, MaxBytes: 5}, err)
+}
+
+func TestSizeLimitedSinkTruncate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	inner := newRecordingAsyncSink()
+	sink := NewSizeLimitedSink(inner, 5, TruncateOversize(func(msg Message, maxBytes int) (Message, error) {
+		m := message(msg.Data()[:maxBytes])
+		return &m, nil
+	}))
+
+	large := message("larger")
+	acked, err := publishAll(ctx, sink, &large)
+	require.NoError(t, err)
+	assert.Equal(t, []Message{&large}, acked)
+	assert.Equal(t, "large", string((<-inner.published).Data()))
+
+	// Truncating must bring the message within the limit.
+	sink = NewSizeLimitedSink(newRecordingAsyncSink(), 5, TruncateOversize(func(msg Message, _ int) (Message, error) {
+		return msg, nil
+	}))
+	_, err = publishAll(ctx, sink, &large)
+	assert.Equal(t, OversizeError{Size: 6, MaxBytes: 5}, err)
+
+	failure := errors.New("failure")
+	sink = NewSizeLimitedSink(newRecordingAsyncSink(), 5, TruncateOversize(func(Message, int) (Message, error) {
+		return nil, failure
+	}))
+	_, err = publishAll(ctx, sink, &large)
+	assert.Equal(t, failure, err)
+}
+
+func TestClaimCheckRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	inner, overflow := newRecordingAsyncSink(), newRecordingAsyncSink()
+	sink := NewSizeLimitedSink(inner, 64, ClaimCheckOversize(overflow))
+
+	small := &keyedTestMessage{data: []byte("small"), key: []byte("k1")}
+	large := &keyedTestMessage{data: make([]byte, 100), key: []byte("k2")}
+	copy(large.data, "large payload")
+	acked, err := publishAll(ctx, sink, small, large)
+	require.NoError(t, err)
+	assert.Equal(t, []Message{small, large}, acked)
+
+	// The payload is stored in the overflow sink, keyed by its reference.
+	stored := make(map[string][]byte)
+	om := (<-overflow.published).(KeyedMessage)
+	assert.Equal(t, large.data, om.Data())
+	stored[string(om.Key())] = om.Data()
+
+	// A pointer is published in its place, keeping the original key.
+	published := []Message{<-inner.published, <-inner.published}
+	assert.Equal(t, small, published[0])
+	pointer := published[1]
+	assert.True(t, len(pointer.Data()) <= 64)
+	assert.Equal(t, large, pointer.(*claimCheckPointer).Original())
+
+	consumed := newStreamingAsyncSource(published...)
+	source := NewClaimCheckSource(consumed, func(_ context.Context, ref string) ([]byte, error) {
+		data, ok := stored[ref]
+		if !ok {
+			return nil, errors.New("unknown reference")
+		}
+		return data, nil
+	})
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	go func() {
+		_ = source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	m := <-msgs
+	assert.Equal(t, small, m)
+	acks <- m
+	m = <-msgs
+	assert.Equal(t, large.data, m.Data())
+	acks <- m
+
+	// The acknowledgements are passed on for the consumed messages.
+	assert.Equal(t, small, <-consumed.acked)
+	assert.Equal(t, pointer, <-consumed.acked)
+
+	assert.NoError(t, sink.Close())
+	for _, s := range []*recordingAsyncSink{inner, overflow} {
+		select {
+		case <-s.closed:
+		default:
+			t.Error("underlying async sink didn't get closed")
+		}
+	}
+}
+
+func TestClaimCheckSourceFetchFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pointer := message("substrate-claim-check:missing")
+	failure := errors.New("not found")
+	source := NewClaimCheckSource(newStreamingAsyncSource(&pointer), func(context.Context, string) ([]byte, error) {
+		return nil, failure
+	})
+	assert.Equal(t, failure, source.ConsumeMessages(ctx, make(chan Message), make(chan Message)))
+}
+
+func TestSizeLimitedSource(t *testing.T) {
+	inner := &mockAsyncSource{
+		toSend: make(chan Message, 3),
+		acked:  make(chan Message, 3),
+		closed: make(chan struct{}),
+	}
+	var skipped []Message
+	source := NewSizeLimitedSource(inner, 5, func(msg Message, err error) error {
+		assert.Equal(t, OversizeError{Size: 6, MaxBytes: 5}, err)
+		skipped = append(skipped, msg)
+		return nil
+	})
+
+	small, large, exact := message("small"), message("larger"), message("exact")
+	for _, m := range []Message{&small, &large, &exact} {
+		inner.toSend <- m
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	for _, expected := range []Message{&small, &exact} {
+		m := <-msgs
+		assert.Equal(t, expected, m)
+		acks <- m
+	}
+	// The oversize message is acknowledged in order, without being delivered.
+	for _, expected := range []Message{&small, &large, &exact} {
+		assert.Equal(t, expected, <-inner.acked)
+	}
+	assert.Equal(t, []Message{&large}, skipped)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+
+	// Without a handler, an oversize message terminates consuming.
+	inner.toSend <- &large
+	source = NewSizeLimitedSource(inner, 5, nil)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := source.ConsumeMessages(ctx, make(chan Message), make(chan Message))
+	assert.Equal(t, OversizeError{Size: 6, MaxBytes: 5}, err)
+}
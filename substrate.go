@@ -2,7 +2,9 @@ package substrate
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 )
 
 // Message is the single type that represents all messages in substrate.
@@ -18,6 +20,31 @@ type KeyedMessage interface {
 	Key() []byte
 }
 
+// AttributedMessage is a message carrying string attributes alongside its
+// payload, such as kafka record headers. Backends that support attributes
+// publish the attributes of messages implementing this interface, and deliver
+// messages implementing it. Backends without attribute support ignore them.
+type AttributedMessage interface {
+	Message
+	Attributes() map[string]string
+}
+
+// TimestampedMessage is a message carrying the time it was produced, such as
+// the kafka record timestamp. A zero time means that the time is not known.
+type TimestampedMessage interface {
+	Message
+	Timestamp() time.Time
+}
+
+// PartitionedMessage is a message consumed from a partitioned log, such as a
+// kafka topic, which exposes the partition it was consumed from and its
+// offset in that partition.
+type PartitionedMessage interface {
+	Message
+	Partition() int32
+	Offset() int64
+}
+
 // DiscardableMessage allows a consumer to discard the payload after use (but
 // before acking) in order to release memory earlier.  This can be useful in
 // cases where a consumer reads a very large number of messages before acking
@@ -31,6 +58,43 @@ type DiscardableMessage interface {
 	DiscardPayload()
 }
 
+// Nackable is implemented by the messages of sources that can handle messages
+// that could not be processed. The caller nacks a message by calling Nack, and
+// then acknowledges it as usual, so that acknowledgements stay in order. How a
+// nacked message is handled is defined by each backend, e.g. by publishing it
+// to a dead letter topic, skipping it, or delivering it again. Since not all
+// backends implement this, a checked type assertion is recommended.
+type Nackable interface {
+	Message
+	// Nack marks the message as not processed, for the given reason, which
+	// defaults to ErrNacked if nil. It must be called before the message
+	// is acknowledged.
+	Nack(reason error)
+}
+
+// ErrNacked is the reason of messages nacked without one.
+var ErrNacked = errors.New("message nacked")
+
+// Pausable is implemented by the sources of backends that can pause
+// consumption without ConsumeMessages terminating, e.g. during maintenance
+// windows. While paused, no more messages are delivered, but the
+// acknowledgements of the delivered messages are still processed, and the
+// membership of consumer groups is retained. The status of a paused source
+// reports it as a problem. Source wrappers implement this by forwarding to the
+// source they wrap, returning ErrPauseNotSupported if it does not implement
+// it, and since not all backends implement this, a checked type assertion is
+// recommended.
+type Pausable interface {
+	// Pause stops the delivery of messages until Resume is called.
+	Pause() error
+	// Resume resumes the delivery of messages.
+	Resume() error
+}
+
+// ErrPauseNotSupported is returned by source wrappers when pausing or resuming
+// a source that does not implement Pausable.
+var ErrPauseNotSupported = errors.New("source does not support pausing")
+
 // AsyncMessageSink represents a message sink that allows publishing messages,
 // and multiple messages can be in flight before any acks are recieved,
 // depending upon the configuration of the underlying message sink.
@@ -41,7 +105,10 @@ type AsyncMessageSink interface {
 	// or until an error occurs.  Messages will always be processed
 	// and acknowledged in order.
 	// Normal termination is achieved when the passed Context is done,
-	// and will return the associated Context error.
+	// and will return the associated Context error, as returned by
+	// ctx.Err(), rather than nil or an error of the underlying client
+	// caused by the cancellation, so that callers can tell a clean
+	// shutdown from a failure by comparing the error with ctx.Err().
 	PublishMessages(ctx context.Context, acks chan<- Message, messages <-chan Message) error
 	// Close permanently closes the AsyncMessageSink and frees underlying resources
 	Close() error
@@ -57,7 +124,11 @@ type AsyncMessageSource interface {
 	// that have been handled properly.  This function will block until
 	// `ctx` is done, or until an error occurs.
 	// Normal termination is achieved when the passed Context is done,
-	// and will return the associated Context error.
+	// and will return the associated Context error, as returned by
+	// ctx.Err(), like PublishMessages. Sources reaching the end of a
+	// bounded stream, such as a replay source, return nil.
+	// A delivered message may be acknowledged either as it is, or wrapped
+	// in a message whose Original method returns it, see SameMessage.
 	ConsumeMessages(ctx context.Context, messages chan<- Message, acks <-chan Message) error
 	// Close permanently closes the AsyncMessageSource and frees underlying resources
 	Close() error
@@ -80,7 +151,8 @@ type SynchronousMessageSource interface {
 	// acknowledgement will be sent to the broker.  If an error is returned
 	// by the handler, it will be propogated and returned from this
 	// function.  This function will block until `ctx` is done or until an
-	// error occurs.
+	// error occurs, and returns the associated Context error once `ctx`
+	// is done.
 	ConsumeMessages(ctx context.Context, handler ConsumerMessageHandler) error
 	Statuser
 }
@@ -98,6 +170,14 @@ type SynchronousMessageSink interface {
 	Statuser
 }
 
+// MessageErrorHandler is implemented by callers wishing to handle failures to
+// publish individual messages, for sinks that support it.  The handler is
+// called with the message that could not be published and the reason.  If it
+// returns nil, the message is treated as handled and is acknowledged, so that
+// publishing can continue.  If it returns an error, publishing terminates with
+// that error.
+type MessageErrorHandler func(Message, error) error
+
 // InvalidAckError means that a message acknowledgement was not as expected.
 // This is possilbly from mis-use of the asynchronous APIs, for example acking
 // out of order.
@@ -110,15 +190,125 @@ func (e InvalidAckError) Error() string {
 	return fmt.Sprintf("Message ack was out of order. Expected message '%s' but got '%s'", e.Expected, e.Acked)
 }
 
+// SameMessage reports whether a and b are the same message, once unwrapped.
+// Messages implementing an Original method, returning the message they
+// wrap, are unwrapped down to the innermost message, so that sources accept
+// the acknowledgement of either a delivered message or a wrapper of it.
+func SameMessage(a, b Message) bool {
+	return a == b || unwrapMessage(a) == unwrapMessage(b)
+}
+
+// unwrapMessage returns the innermost message of a chain of wrappers.
+func unwrapMessage(msg Message) Message {
+	for {
+		wrapper, ok := msg.(interface{ Original() Message })
+		if !ok {
+			return msg
+		}
+		msg = wrapper.Original()
+	}
+}
+
 // Statuser is the interface that wraps the Status method.
 type Statuser interface {
 	Status() (*Status, error)
 }
 
+// CombinedStatus returns the status of multiple components, which is working
+// only if all of them are. Its problems are those of every component, working
+// or not, its lag is the total lag of the components that report one, and its
+// details are those of the components, with the first component reporting a
+// detail taking precedence. It is used by the wrappers combining several
+// sources or sinks.
+func CombinedStatus(components ...Statuser) (*Status, error) {
+	status := &Status{Working: true}
+	for _, c := range components {
+		st, err := c.Status()
+		if err != nil {
+			return nil, err
+		}
+		if !st.Working {
+			status.Working = false
+		}
+		status.Problems = append(status.Problems, st.Problems...)
+		if st.Lag != nil {
+			lag := *st.Lag
+			if status.Lag != nil {
+				lag += *status.Lag
+			}
+			status.Lag = &lag
+		}
+		for k, v := range st.Details {
+			if status.Details == nil {
+				status.Details = make(map[string]string)
+			}
+			if _, ok := status.Details[k]; !ok {
+				status.Details[k] = v
+			}
+		}
+	}
+	return status, nil
+}
+
+// ReadinessChecker is implemented by the sinks and sources of backends that
+// can check that they are usable before they are used, e.g. while a service
+// starts up, since connections may otherwise only fail once messages flow.
+// Since not all backends implement this, a checked type assertion is
+// recommended.
+type ReadinessChecker interface {
+	// Ready returns nil once the backend is usable, or an error if it is
+	// not usable before the context is done.
+	Ready(ctx context.Context) error
+}
+
+// Flushable is implemented by the sinks of backends that can wait for the
+// messages in flight, e.g. to make sure that everything published has been
+// acknowledged before a service is taken out of rotation. Since not all
+// backends implement this, a checked type assertion is recommended.
+type Flushable interface {
+	// Flush blocks until all the messages received by PublishMessages
+	// before the call have been acknowledged, or have failed, or until the
+	// context is done. Messages still buffered in the messages channel are
+	// not waited for. If messages failed, because publishing terminated
+	// with them in flight, the error publishing terminated with is
+	// returned. Flush may be called concurrently with PublishMessages.
+	Flush(ctx context.Context) error
+}
+
+// Gauges is implemented by callers wishing to observe where messages back up
+// in a source or sink, for backends that support it. The values are sampled
+// periodically, about once a second, rather than for every message, from the
+// internal loops of the backend, so the methods must not block.
+type Gauges interface {
+	// SetInFlight is called with the number of messages delivered by a
+	// source, or published to a sink, that have not been acknowledged yet.
+	SetInFlight(n int)
+	// SetPendingAcks is called with the number of acknowledgements that
+	// have not been processed yet, that is, for a source, the ones sent by
+	// the caller, and for a sink, the ones not yet received by the caller.
+	SetPendingAcks(n int)
+}
+
+// WindowGauges is implemented by Gauges that also observe the window of the
+// sources limiting their messages in flight with an AdaptiveWindow.
+type WindowGauges interface {
+	Gauges
+	// SetWindow is called with the current window.
+	SetWindow(n int)
+}
+
 // Status represents a snapshot of the state of a source or sink.
 type Status struct {
 	// Working indicates whether the source or sink is in a working state
 	Working bool
 	// Problems indicates and problems with the source or sink, whether or not they prevent it working.
 	Problems []string
+	// Lag is the number of messages available to a source that it has not
+	// consumed yet, for backends that can compute it, such as the messages
+	// after the committed offsets of a kafka consumer group. It is nil if
+	// the lag is unknown.
+	Lag *int64
+	// Details holds further backend specific information about the source or
+	// sink, such as the topic it consumes from, for display. It may be nil.
+	Details map[string]string
 }
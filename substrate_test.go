@@ -0,0 +1,64 @@
+package substrate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// callerWrapped is a message wrapped by a caller, e.g. to log it, which
+// exposes the message it wraps.
+type callerWrapped struct {
+	Message
+}
+
+func (m callerWrapped) Original() Message {
+	return m.Message
+}
+
+func TestSameMessage(t *testing.T) {
+	m1, m2 := message("one"), message("two")
+	pointer := &claimCheckPointer{original: &m1}
+
+	assert.True(t, SameMessage(&m1, &m1))
+	assert.False(t, SameMessage(&m1, &m2))
+	assert.True(t, SameMessage(callerWrapped{&m1}, &m1))
+	assert.True(t, SameMessage(&m1, callerWrapped{callerWrapped{&m1}}))
+	assert.True(t, SameMessage(callerWrapped{&m1}, pointer))
+	assert.False(t, SameMessage(callerWrapped{&m2}, pointer))
+}
+
+func TestAckWrappedMessage(t *testing.T) {
+	inner := &mockAsyncSource{
+		toSend: make(chan Message, 2),
+		acked:  make(chan Message, 2),
+		closed: make(chan struct{}),
+	}
+	source := NewValidatingSource(inner, validatePayload, nil)
+
+	m1, m2 := message("good"), message("good again")
+	inner.toSend <- &m1
+	inner.toSend <- &m2
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	// The caller wraps the delivered messages, and acknowledges the
+	// wrappers.
+	for _, expected := range []Message{&m1, &m2} {
+		acks <- callerWrapped{callerWrapped{<-msgs}}
+		assert.Equal(t, expected, <-inner.acked)
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
@@ -27,6 +27,12 @@
 //
 //      import _ "github.com/uw-labs/substrate/kafka"
 //
+// Default options
+//
+// Drivers supporting it, such as kafka and proximo, take the options not set by
+// the url from the defaults registered for its scheme with the config package,
+// see https://godoc.org/github.com/uw-labs/substrate/config.
+//
 // More complete documentation of options
 //
 // For a full description of the url options available for each scheme, see the documentation for the particular driver,
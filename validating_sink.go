@@ -0,0 +1,143 @@
+package substrate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/uw-labs/sync/rungroup"
+)
+
+// ValidationError is the error passed to a MessageErrorHandler, or returned
+// when there is none, for a message that failed validation.
+type ValidationError struct {
+	Err error
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("message failed validation: %s", e.Err)
+}
+
+// Unwrap returns the error returned by the validation function.
+func (e ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// NewValidatingSink returns a sink that calls validate for each message before
+// publishing it to sink. Messages failing validation are never published to
+// sink, and are passed to onInvalid along with a ValidationError instead. If
+// onInvalid returns nil, the message is acknowledged as handled. If onInvalid
+// is nil or returns an error, publishing terminates with that error.
+// When Close is called on the returned sink, this is also propagated to sink.
+func NewValidatingSink(sink AsyncMessageSink, validate func(Message) error, onInvalid MessageErrorHandler) AsyncMessageSink {
+	return &validatingSink{
+		sink:      sink,
+		validate:  validate,
+		onInvalid: onInvalid,
+	}
+}
+
+type validatingSink struct {
+	sink      AsyncMessageSink
+	validate  func(Message) error
+	onInvalid MessageErrorHandler
+}
+
+// validatedMessage is a message awaiting its acknowledgement, which comes from
+// the wrapped sink or source unless the message was rejected.
+type validatedMessage struct {
+	msg      Message
+	rejected bool
+}
+
+// checkMessage validates msg, reporting whether it was rejected and handled.
+func checkMessage(msg Message, validate func(Message) error, onInvalid MessageErrorHandler) (bool, error) {
+	err := validate(msg)
+	if err == nil {
+		return false, nil
+	}
+	verr := ValidationError{Err: err}
+	if onInvalid == nil {
+		return false, verr
+	}
+	if err := onInvalid(msg, verr); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *validatingSink) PublishMessages(ctx context.Context, acks chan<- Message, messages <-chan Message) error {
+	rg, ctx := rungroup.New(ctx)
+
+	toInner := make(chan Message, cap(messages))
+	fromInner := make(chan Message, cap(acks))
+	needAcks := make(chan validatedMessage, 1024)
+
+	rg.Go(func() error {
+		return s.sink.PublishMessages(ctx, fromInner, toInner)
+	})
+
+	rg.Go(func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case msg := <-messages:
+				rejected, err := checkMessage(msg, s.validate, s.onInvalid)
+				if err != nil {
+					return err
+				}
+				select {
+				case needAcks <- validatedMessage{msg: msg, rejected: rejected}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				if rejected {
+					continue
+				}
+				select {
+				case toInner <- msg:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	})
+
+	rg.Go(func() error {
+		for {
+			var vm validatedMessage
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case vm = <-needAcks:
+			}
+			if !vm.rejected {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case ack := <-fromInner:
+					if !SameMessage(ack, vm.msg) {
+						return InvalidAckError{Acked: ack, Expected: vm.msg}
+					}
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case acks <- vm.msg:
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+// Close closes the underlying sink.
+func (s *validatingSink) Close() error {
+	return s.sink.Close()
+}
+
+// Status returns the status of the underlying sink.
+func (s *validatingSink) Status() (*Status, error) {
+	return s.sink.Status()
+}
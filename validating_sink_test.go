@@ -0,0 +1,90 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errInvalidPayload = errors.New("invalid payload")
+
+func validatePayload(msg Message) error {
+	if string(msg.Data()) == "bad" {
+		return errInvalidPayload
+	}
+	return nil
+}
+
+func TestValidatingSinkRejectsInvalidMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &mockAsyncSink{2, make(chan struct{}, 1)}
+	var rejected []Message
+	var rejectedErrs []error
+	sink := NewValidatingSink(inner, validatePayload, func(msg Message, err error) error {
+		rejected = append(rejected, msg)
+		rejectedErrs = append(rejectedErrs, err)
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishMessages(ctx, acks, msgs)
+	}()
+
+	m1, m2, m3 := message("good"), message("bad"), message("good again")
+	for _, m := range []Message{&m1, &m2, &m3} {
+		msgs <- m
+		assert.Equal(m, <-acks)
+	}
+	assert.Equal([]Message{&m2}, rejected)
+	assert.Equal([]error{ValidationError{Err: errInvalidPayload}}, rejectedErrs)
+	assert.True(errors.Is(rejectedErrs[0], errInvalidPayload))
+
+	cancel()
+	assert.Equal(context.Canceled, <-errs)
+
+	assert.NoError(sink.Close())
+	select {
+	case <-inner.closed:
+	default:
+		t.Error("underlying async sink didn't get closed")
+	}
+}
+
+func TestValidatingSinkWithoutHandler(t *testing.T) {
+	sink := NewValidatingSink(&mockAsyncSink{1, make(chan struct{}, 1)}, validatePayload, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	m := message("bad")
+	msgs := make(chan Message, 1)
+	msgs <- &m
+	err := sink.PublishMessages(ctx, make(chan Message), msgs)
+	assert.Equal(t, ValidationError{Err: errInvalidPayload}, err)
+}
+
+func TestValidatingSinkHandlerError(t *testing.T) {
+	handlerErr := errors.New("dead letter sink unavailable")
+	sink := NewValidatingSink(&mockAsyncSink{1, make(chan struct{}, 1)}, validatePayload, func(Message, error) error {
+		return handlerErr
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	m := message("bad")
+	msgs := make(chan Message, 1)
+	msgs <- &m
+	err := sink.PublishMessages(ctx, make(chan Message), msgs)
+	assert.Equal(t, handlerErr, err)
+}
@@ -0,0 +1,108 @@
+package substrate
+
+import (
+	"context"
+
+	"github.com/uw-labs/sync/rungroup"
+)
+
+// NewValidatingSource returns a source that calls validate for each message
+// consumed from source before delivering it. Messages failing validation are
+// not delivered, and are passed to onInvalid along with a ValidationError
+// instead, which may for example publish them to a dead letter sink. If
+// onInvalid returns nil, the message is acknowledged to source. If onInvalid
+// is nil or returns an error, consuming terminates with that error.
+// When Close is called on the returned source, this is also propagated to
+// source.
+func NewValidatingSource(source AsyncMessageSource, validate func(Message) error, onInvalid MessageErrorHandler) AsyncMessageSource {
+	return &validatingSource{
+		source: source,
+		check: func(msg Message) (bool, error) {
+			return checkMessage(msg, validate, onInvalid)
+		},
+	}
+}
+
+// validatingSource delivers the messages of source that are not rejected by
+// check, which reports whether a message was rejected and handled.
+type validatingSource struct {
+	source AsyncMessageSource
+	check  func(Message) (bool, error)
+}
+
+func (s *validatingSource) ConsumeMessages(ctx context.Context, messages chan<- Message, acks <-chan Message) error {
+	rg, ctx := rungroup.New(ctx)
+
+	fromInner := make(chan Message, cap(messages))
+	toInner := make(chan Message, cap(acks))
+	needAcks := make(chan validatedMessage, 1024)
+
+	rg.Go(func() error {
+		return s.source.ConsumeMessages(ctx, fromInner, toInner)
+	})
+
+	rg.Go(func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case msg := <-fromInner:
+				rejected, err := s.check(msg)
+				if err != nil {
+					return err
+				}
+				select {
+				case needAcks <- validatedMessage{msg: msg, rejected: rejected}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				if rejected {
+					continue
+				}
+				select {
+				case messages <- msg:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	})
+
+	rg.Go(func() error {
+		for {
+			var vm validatedMessage
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case vm = <-needAcks:
+			}
+			if !vm.rejected {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case ack := <-acks:
+					if !SameMessage(ack, vm.msg) {
+						return InvalidAckError{Acked: ack, Expected: vm.msg}
+					}
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case toInner <- vm.msg:
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+// Close closes the underlying source.
+func (s *validatingSource) Close() error {
+	return s.source.Close()
+}
+
+// Status returns the status of the underlying source.
+func (s *validatingSource) Status() (*Status, error) {
+	return s.source.Status()
+}
@@ -0,0 +1,105 @@
+package substrate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatingSourceRejectsInvalidMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &mockAsyncSource{
+		toSend: make(chan Message, 3),
+		acked:  make(chan Message, 3),
+		closed: make(chan struct{}),
+	}
+	var deadLettered []Message
+	source := NewValidatingSource(inner, validatePayload, func(msg Message, err error) error {
+		assert.Equal(ValidationError{Err: errInvalidPayload}, err)
+		deadLettered = append(deadLettered, msg)
+		return nil
+	})
+
+	m1, m2, m3 := message("good"), message("bad"), message("good again")
+	for _, m := range []Message{&m1, &m2, &m3} {
+		inner.toSend <- m
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	for _, expected := range []Message{&m1, &m3} {
+		m := <-msgs
+		assert.Equal(expected, m)
+		acks <- m
+	}
+	// All messages, including the rejected one, are acknowledged in order.
+	for _, expected := range []Message{&m1, &m2, &m3} {
+		assert.Equal(expected, <-inner.acked)
+	}
+	assert.Equal([]Message{&m2}, deadLettered)
+
+	cancel()
+	assert.Equal(context.Canceled, <-errs)
+
+	assert.NoError(source.Close())
+	select {
+	case <-inner.closed:
+	default:
+		t.Error("underlying async source didn't get closed")
+	}
+}
+
+func TestValidatingSourceWithoutHandler(t *testing.T) {
+	inner := &mockAsyncSource{
+		toSend: make(chan Message, 1),
+		acked:  make(chan Message, 1),
+		closed: make(chan struct{}),
+	}
+	source := NewValidatingSource(inner, validatePayload, nil)
+
+	m := message("bad")
+	inner.toSend <- &m
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := source.ConsumeMessages(ctx, make(chan Message), make(chan Message))
+	assert.Equal(t, ValidationError{Err: errInvalidPayload}, err)
+}
+
+func TestValidatingSourceInvalidAck(t *testing.T) {
+	inner := &mockAsyncSource{
+		toSend: make(chan Message, 1),
+		acked:  make(chan Message, 1),
+		closed: make(chan struct{}),
+	}
+	source := NewValidatingSource(inner, validatePayload, nil)
+
+	m, other := message("good"), message("other")
+	inner.toSend <- &m
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan Message)
+	acks := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	<-msgs
+	acks <- &other
+	assert.Equal(t, InvalidAckError{Acked: &other, Expected: &m}, <-errs)
+}
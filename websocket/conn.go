@@ -0,0 +1,325 @@
+package websocket
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+
+	"github.com/uw-labs/substrate"
+)
+
+const defaultMaxMessageBytes = 1024 * 1024 * 64
+
+var (
+	// ErrConnectionClosed is returned when the remote end closes the websocket connection.
+	ErrConnectionClosed = errors.New("websocket connection closed by peer")
+	// ErrMessageTooLarge is returned when a received message exceeds the configured maximum size.
+	ErrMessageTooLarge = errors.New("websocket message exceeds maximum size")
+	// ErrClosed is returned when the source or sink is closed while consuming or publishing.
+	ErrClosed = errors.New("websocket source or sink closed")
+
+	errKeepAliveTimeout = errors.New("websocket keep alive timed out")
+)
+
+// frame is a single websocket frame, sent and received with frameCodec so
+// that the payload type is explicit.
+type frame struct {
+	payloadType byte
+	data        []byte
+}
+
+var frameCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		f := v.(frame)
+		return f.data, f.payloadType, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		f := v.(*frame)
+		f.payloadType, f.data = payloadType, data
+		return nil
+	},
+}
+
+// conn is a client websocket connection. The websocket library answers pings
+// and handles close frames, and conn adds keep alive pings and records why
+// the connection was closed.
+type conn struct {
+	ws      *websocket.Conn
+	netConn net.Conn
+
+	lastRead int64 // unix nanoseconds, accessed atomically
+
+	closeOnce sync.Once
+	closeMu   sync.Mutex
+	closeErr  error
+}
+
+// readTracker records when anything, including a pong, was last read from
+// the connection.
+type readTracker struct {
+	net.Conn
+	lastRead *int64
+}
+
+func (r readTracker) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(r.lastRead, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+type dialConfig struct {
+	url             string
+	origin          string
+	header          http.Header
+	dialer          *net.Dialer
+	tlsConfig       *tls.Config
+	maxMessageBytes int
+}
+
+func dial(ctx context.Context, conf dialConfig) (*conn, error) {
+	u, err := url.Parse(conf.url)
+	if err != nil {
+		return nil, err
+	}
+	var secure bool
+	switch u.Scheme {
+	case "ws", "http":
+	case "wss", "https":
+		secure = true
+	default:
+		return nil, fmt.Errorf("unsupported websocket scheme : %s", u.Scheme)
+	}
+
+	origin := conf.origin
+	if origin == "" {
+		origin = (&url.URL{Scheme: "http", Host: u.Host}).String()
+		if secure {
+			origin = (&url.URL{Scheme: "https", Host: u.Host}).String()
+		}
+	}
+	config, err := websocket.NewConfig(conf.url, origin)
+	if err != nil {
+		return nil, err
+	}
+	config.Header = conf.header
+
+	dialer := conf.dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	netConn, err := dialer.DialContext(ctx, "tcp", hostPort(u, secure))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to dial %s", conf.url)
+	}
+	if secure {
+		tlsConfig := &tls.Config{}
+		if conf.tlsConfig != nil {
+			tlsConfig = conf.tlsConfig.Clone()
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = u.Hostname()
+		}
+		netConn = tls.Client(netConn, tlsConfig)
+	}
+
+	c := &conn{
+		netConn:  netConn,
+		lastRead: time.Now().UnixNano(),
+	}
+
+	// The opening handshake doesn't take a context, so the connection is
+	// closed to abort it.
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			netConn.Close()
+		case <-done:
+		}
+	}()
+	ws, err := websocket.NewClient(config, readTracker{Conn: netConn, lastRead: &c.lastRead})
+	close(done)
+	if err != nil {
+		netConn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, errors.Wrapf(err, "websocket handshake with %s failed", conf.url)
+	}
+
+	ws.MaxPayloadBytes = conf.maxMessageBytes
+	if ws.MaxPayloadBytes <= 0 {
+		ws.MaxPayloadBytes = defaultMaxMessageBytes
+	}
+	c.ws = ws
+	return c, nil
+}
+
+func hostPort(u *url.URL, secure bool) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if secure {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// readMessage returns the payload type and data of the next text or binary
+// frame.
+func (c *conn) readMessage() (byte, []byte, error) {
+	var f frame
+	switch err := frameCodec.Receive(c.ws, &f); err {
+	case nil:
+		return f.payloadType, f.data, nil
+	case io.EOF:
+		// The server sent a close frame or closed the connection.
+		c.closeWithError(ErrConnectionClosed)
+		return 0, nil, c.err(ErrConnectionClosed)
+	case websocket.ErrFrameTooLarge:
+		return 0, nil, c.err(ErrMessageTooLarge)
+	default:
+		return 0, nil, c.err(err)
+	}
+}
+
+func (c *conn) writeMessage(payloadType byte, data []byte) error {
+	return c.err(frameCodec.Send(c.ws, frame{payloadType: payloadType, data: data}))
+}
+
+// keepAlive pings the peer every interval and closes the connection if
+// nothing has been read from it for interval+timeout. It returns once done
+// is closed.
+func (c *conn) keepAlive(interval, timeout time.Duration, done <-chan struct{}) {
+	if timeout <= 0 {
+		timeout = interval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-t.C:
+			last := time.Unix(0, atomic.LoadInt64(&c.lastRead))
+			if now.Sub(last) > interval+timeout {
+				c.closeWithError(errKeepAliveTimeout)
+				return
+			}
+			if err := c.writeMessage(websocket.PingFrame, nil); err != nil {
+				c.closeWithError(err)
+				return
+			}
+		}
+	}
+}
+
+// closeWithError closes the underlying connection, recording the reason so
+// that blocked readers and writers report it instead of a generic I/O error.
+// The connection is closed without a closing handshake, which could block
+// behind a write to an unresponsive peer.
+func (c *conn) closeWithError(reason error) {
+	c.closeOnce.Do(func() {
+		c.closeMu.Lock()
+		c.closeErr = reason
+		c.closeMu.Unlock()
+		_ = c.netConn.Close()
+	})
+}
+
+func (c *conn) close() {
+	c.closeWithError(nil)
+}
+
+// err prefers the recorded close reason over the error observed by an
+// individual read or write.
+func (c *conn) err(err error) error {
+	if err == nil {
+		return nil
+	}
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closeErr != nil {
+		return c.closeErr
+	}
+	return err
+}
+
+// connSet holds the open connections of a source or sink, so that Close can
+// close them.
+type connSet struct {
+	mu     sync.Mutex
+	closed bool
+	conns  map[*conn]struct{}
+}
+
+// add registers the connection, or closes it and returns ErrClosed if the
+// set was closed.
+func (s *connSet) add(c *conn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		c.closeWithError(ErrClosed)
+		return ErrClosed
+	}
+	if s.conns == nil {
+		s.conns = make(map[*conn]struct{})
+	}
+	s.conns[c] = struct{}{}
+	return nil
+}
+
+func (s *connSet) remove(c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+}
+
+func (s *connSet) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for c := range s.conns {
+		c.closeWithError(ErrClosed)
+	}
+	s.conns = nil
+}
+
+// connState tracks the connection state reported by Status.
+type connState struct {
+	mu        sync.Mutex
+	connected bool
+	lastErr   error
+}
+
+func (s *connState) set(connected bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connected = connected
+	s.lastErr = err
+}
+
+func (s *connState) status() (*substrate.Status, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.connected:
+		return &substrate.Status{Working: true}, nil
+	case s.lastErr != nil:
+		return &substrate.Status{Working: false, Problems: []string{s.lastErr.Error()}}, nil
+	default:
+		return &substrate.Status{Working: true, Problems: []string{"not connected"}}, nil
+	}
+}
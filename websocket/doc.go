@@ -0,0 +1,20 @@
+// Package websocket provides websocket support for substrate
+//
+// Usage
+//
+// This package support two methods of use.  The first is to directly use this package. See the function documentation for more details.
+//
+// The second method is to use the suburl package. See https://godoc.org/github.com/uw-labs/substrate/suburl for more information.
+//
+// Connections use golang.org/x/net/websocket.  Each text or binary frame received by the source is delivered as a
+// substrate message, as fragmented messages are not reassembled, and each message published by the sink is written as a
+// single frame.  Options such as authentication headers, keep alive pings, reconnecting and
+// acknowledgement frames are only available when using this package directly.
+//
+// Using suburl
+//
+// The url structure is ws://host:port/path or wss://host:port/path
+//
+// The url is used unchanged as the websocket endpoint, including any url parameters.
+//
+package websocket
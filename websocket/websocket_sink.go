@@ -0,0 +1,210 @@
+package websocket
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/uw-labs/sync/rungroup"
+	"golang.org/x/net/websocket"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/internal/helper"
+	"github.com/uw-labs/substrate/internal/unwrap"
+)
+
+var _ substrate.AsyncMessageSink = (*asyncMessageSink)(nil)
+
+// AsyncMessageSinkConfig is the configuration parameters for an
+// AsyncMessageSink.
+type AsyncMessageSinkConfig struct {
+	// URL is the websocket endpoint, using the ws or wss scheme.
+	URL string
+	// Header contains additional headers sent with the opening handshake,
+	// for example an Authorization header.
+	Header http.Header
+	// Origin is sent with the opening handshake. Defaults to the host of the
+	// URL with an http or https scheme.
+	Origin string
+	// Dialer is used to connect to the server. Defaults to a net.Dialer
+	// without a timeout.
+	Dialer *net.Dialer
+	// TLSConfig is used for wss connections.
+	TLSConfig *tls.Config
+	// PingInterval is the interval at which pings are sent to the server.
+	// Zero disables keep alive pings.
+	PingInterval time.Duration
+	// PongTimeout is how long to wait past PingInterval for any frame from
+	// the server before the connection is considered dead. Defaults to
+	// PingInterval.
+	PongTimeout time.Duration
+	// Text sends messages as text frames instead of binary frames.
+	Text bool
+	// Confirm, when set, is called with every frame received from the
+	// server for each unconfirmed message, oldest first, and the first
+	// message it returns true for is acknowledged. The original user
+	// message is passed to the function. When not set, messages
+	// are acknowledged as soon as they are written to the connection.
+	Confirm func(frame []byte, msg substrate.Message) bool
+	// MaxMessageBytes is the maximum size of a received frame.
+	// Defaults to 64MiB.
+	MaxMessageBytes int
+}
+
+// NewAsyncMessageSink returns a new websocket message sink. A connection is
+// established for every call to PublishMessages.
+func NewAsyncMessageSink(c AsyncMessageSinkConfig) (substrate.AsyncMessageSink, error) {
+	sink := &asyncMessageSink{conf: c}
+	if c.Confirm != nil {
+		// Confirmations may arrive out of order.
+		return helper.NewAckOrderingSink(sink), nil
+	}
+	return sink, nil
+}
+
+type asyncMessageSink struct {
+	conf  AsyncMessageSinkConfig
+	state connState
+	conns connSet
+}
+
+func (ams *asyncMessageSink) PublishMessages(ctx context.Context, acks chan<- substrate.Message, messages <-chan substrate.Message) error {
+	c, err := dial(ctx, dialConfig{
+		url:             ams.conf.URL,
+		origin:          ams.conf.Origin,
+		header:          ams.conf.Header,
+		dialer:          ams.conf.Dialer,
+		tlsConfig:       ams.conf.TLSConfig,
+		maxMessageBytes: ams.conf.MaxMessageBytes,
+	})
+	if err == nil {
+		err = ams.conns.add(c)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		ams.state.set(false, err)
+		return err
+	}
+	defer ams.conns.remove(c)
+	ams.state.set(true, nil)
+
+	rg, ctx := rungroup.New(ctx)
+	go func() {
+		<-ctx.Done()
+		c.close()
+	}()
+	if ams.conf.PingInterval > 0 {
+		go c.keepAlive(ams.conf.PingInterval, ams.conf.PongTimeout, ctx.Done())
+	}
+
+	pending := &pendingMessages{}
+	rg.Go(func() error {
+		return ams.receiveFrames(ctx, c, acks, pending)
+	})
+	rg.Go(func() error {
+		return ams.sendMessages(ctx, c, acks, messages, pending)
+	})
+
+	err = rg.Wait()
+	ams.state.set(false, nil)
+	return err
+}
+
+func (ams *asyncMessageSink) sendMessages(ctx context.Context, c *conn, acks chan<- substrate.Message, messages <-chan substrate.Message, pending *pendingMessages) error {
+	payloadType := byte(websocket.BinaryFrame)
+	if ams.conf.Text {
+		payloadType = websocket.TextFrame
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg := <-messages:
+			if ams.conf.Confirm != nil {
+				pending.add(msg)
+			}
+			if err := c.writeMessage(payloadType, msg.Data()); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return err
+			}
+			if ams.conf.Confirm != nil {
+				continue
+			}
+			select {
+			case acks <- msg:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// receiveFrames reads frames from the server, which is required for ping and
+// close handling even when no confirmation matcher is configured.
+func (ams *asyncMessageSink) receiveFrames(ctx context.Context, c *conn, acks chan<- substrate.Message, pending *pendingMessages) error {
+	for {
+		_, frame, err := c.readMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if ams.conf.Confirm == nil {
+			continue
+		}
+		msg := pending.match(frame, ams.conf.Confirm)
+		if msg == nil {
+			continue
+		}
+		select {
+		case acks <- msg:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (ams *asyncMessageSink) Status() (*substrate.Status, error) {
+	return ams.state.status()
+}
+
+// Close closes any open connection, making PublishMessages return
+// ErrClosed.
+func (ams *asyncMessageSink) Close() error {
+	ams.conns.close()
+	return nil
+}
+
+// pendingMessages holds messages written to the connection that are awaiting
+// a confirmation frame.
+type pendingMessages struct {
+	mu   sync.Mutex
+	msgs []substrate.Message
+}
+
+func (p *pendingMessages) add(msg substrate.Message) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.msgs = append(p.msgs, msg)
+}
+
+func (p *pendingMessages) match(frame []byte, confirm func([]byte, substrate.Message) bool) substrate.Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, msg := range p.msgs {
+		// Provide original user message to the confirmation function.
+		if confirm(frame, unwrap.Unwrap(msg)) {
+			p.msgs = append(p.msgs[:i], p.msgs[i+1:]...)
+			return msg
+		}
+	}
+	return nil
+}
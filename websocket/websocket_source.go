@@ -0,0 +1,282 @@
+package websocket
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/uw-labs/sync/rungroup"
+	"golang.org/x/net/websocket"
+
+	"github.com/uw-labs/substrate"
+)
+
+var _ substrate.AsyncMessageSource = (*asyncMessageSource)(nil)
+
+// AsyncMessageSourceConfig is the configuration parameters for an
+// AsyncMessageSource.
+type AsyncMessageSourceConfig struct {
+	// URL is the websocket endpoint, using the ws or wss scheme.
+	URL string
+	// Header contains additional headers sent with the opening handshake,
+	// for example an Authorization header.
+	Header http.Header
+	// Origin is sent with the opening handshake. Defaults to the host of the
+	// URL with an http or https scheme.
+	Origin string
+	// Dialer is used to connect to the server. Defaults to a net.Dialer
+	// without a timeout.
+	Dialer *net.Dialer
+	// TLSConfig is used for wss connections.
+	TLSConfig *tls.Config
+	// PingInterval is the interval at which pings are sent to the server.
+	// Zero disables keep alive pings.
+	PingInterval time.Duration
+	// PongTimeout is how long to wait past PingInterval for any frame from
+	// the server before the connection is considered dead. Defaults to
+	// PingInterval.
+	PongTimeout time.Duration
+	// ReconnectBackoff is the delay before reconnecting after the
+	// connection is lost. Zero disables reconnecting, in which case the
+	// connection error is returned from ConsumeMessages.
+	ReconnectBackoff time.Duration
+	// MaxReconnects is the maximum number of consecutive failed connection
+	// attempts before giving up. Zero means no limit.
+	MaxReconnects int
+	// ResumeHeader, when set, is called with each message as it is
+	// delivered, and returns headers that are added to the handshake when
+	// reconnecting after the message was the last one acknowledged, to tell
+	// the server where to resume.
+	ResumeHeader func(substrate.Message) http.Header
+	// AckFrame, when set, is called with each message as it is delivered,
+	// and the returned payload is sent to the server as a text frame once
+	// the message is acknowledged.
+	AckFrame func(substrate.Message) []byte
+	// MaxInFlight limits the number of delivered messages awaiting an
+	// acknowledgement. Reading from the connection pauses when the limit is
+	// reached. Zero means no limit.
+	MaxInFlight int
+	// MaxMessageBytes is the maximum size of a received message.
+	// Defaults to 64MiB.
+	MaxMessageBytes int
+}
+
+// NewAsyncMessageSource returns a new websocket message source. The
+// connection is established when ConsumeMessages is called.
+func NewAsyncMessageSource(c AsyncMessageSourceConfig) (substrate.AsyncMessageSource, error) {
+	return &asyncMessageSource{conf: c}, nil
+}
+
+type asyncMessageSource struct {
+	conf  AsyncMessageSourceConfig
+	state connState
+	conns connSet
+
+	mu           sync.Mutex
+	resumeHeader http.Header
+}
+
+// consumerMessage holds what acknowledging it needs alongside the payload,
+// as the payload may have been discarded by then.
+type consumerMessage struct {
+	data         []byte
+	conn         *conn
+	ackFrame     []byte
+	resumeHeader http.Header
+}
+
+func (cm *consumerMessage) Data() []byte {
+	if cm.data == nil {
+		panic("attempt to use payload after discarding.")
+	}
+	return cm.data
+}
+
+func (cm *consumerMessage) DiscardPayload() {
+	cm.data = nil
+}
+
+// ConsumeMessages reads messages from the websocket. If the connection is lost
+// and reconnecting is enabled, messages that were delivered but not yet
+// acknowledged must still be acknowledged in order, but no acknowledgement
+// frame is sent for them as the server is expected to redeliver them.
+func (ams *asyncMessageSource) ConsumeMessages(ctx context.Context, messages chan<- substrate.Message, acks <-chan substrate.Message) error {
+	rg, ctx := rungroup.New(ctx)
+
+	toAck := make(chan *consumerMessage)
+
+	var slots chan struct{}
+	if ams.conf.MaxInFlight > 0 {
+		slots = make(chan struct{}, ams.conf.MaxInFlight)
+	}
+
+	rg.Go(func() error {
+		var toAckList []*consumerMessage
+		for {
+			select {
+			case ta := <-toAck:
+				toAckList = append(toAckList, ta)
+			case a := <-acks:
+				switch {
+				case len(toAckList) == 0:
+					return substrate.InvalidAckError{Acked: a}
+				case !substrate.SameMessage(a, toAckList[0]):
+					return substrate.InvalidAckError{Acked: a, Expected: toAckList[0]}
+				default:
+					if err := ams.ack(toAckList[0]); err != nil {
+						return err
+					}
+					toAckList = toAckList[1:]
+					if slots != nil {
+						<-slots
+					}
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+
+	rg.Go(func() error {
+		attempts := 0
+		for {
+			c, err := ams.connect(ctx)
+			if err == nil {
+				err = ams.conns.add(c)
+			}
+			if err == nil {
+				attempts = 0
+				ams.state.set(true, nil)
+				err = ams.readMessages(ctx, c, toAck, messages, slots)
+				ams.conns.remove(c)
+				c.close()
+			}
+			if ctx.Err() != nil {
+				ams.state.set(false, nil)
+				return ctx.Err()
+			}
+			ams.state.set(false, err)
+			if err == ErrClosed {
+				return err
+			}
+
+			attempts++
+			if ams.conf.ReconnectBackoff == 0 || (ams.conf.MaxReconnects > 0 && attempts > ams.conf.MaxReconnects) {
+				return err
+			}
+			select {
+			case <-time.After(ams.conf.ReconnectBackoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+
+	return rg.Wait()
+}
+
+func (ams *asyncMessageSource) connect(ctx context.Context) (*conn, error) {
+	header := make(http.Header)
+	for k, vs := range ams.conf.Header {
+		header[k] = vs
+	}
+	ams.mu.Lock()
+	for k, vs := range ams.resumeHeader {
+		header[k] = vs
+	}
+	ams.mu.Unlock()
+
+	return dial(ctx, dialConfig{
+		url:             ams.conf.URL,
+		origin:          ams.conf.Origin,
+		header:          header,
+		dialer:          ams.conf.Dialer,
+		tlsConfig:       ams.conf.TLSConfig,
+		maxMessageBytes: ams.conf.MaxMessageBytes,
+	})
+}
+
+func (ams *asyncMessageSource) readMessages(ctx context.Context, c *conn, toAck chan<- *consumerMessage, messages chan<- substrate.Message, slots chan struct{}) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.close()
+		case <-done:
+		}
+	}()
+	if ams.conf.PingInterval > 0 {
+		go c.keepAlive(ams.conf.PingInterval, ams.conf.PongTimeout, done)
+	}
+
+	for {
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		_, data, err := c.readMessage()
+		if err != nil {
+			if slots != nil {
+				<-slots
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		m := &consumerMessage{data: data, conn: c}
+		if ams.conf.AckFrame != nil {
+			m.ackFrame = ams.conf.AckFrame(m)
+		}
+		if ams.conf.ResumeHeader != nil {
+			m.resumeHeader = ams.conf.ResumeHeader(m)
+		}
+		select {
+		case toAck <- m:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case messages <- m:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (ams *asyncMessageSource) ack(m *consumerMessage) error {
+	if m.resumeHeader != nil {
+		ams.mu.Lock()
+		ams.resumeHeader = m.resumeHeader
+		ams.mu.Unlock()
+	}
+
+	if ams.conf.AckFrame == nil {
+		return nil
+	}
+	if err := m.conn.writeMessage(websocket.TextFrame, m.ackFrame); err != nil {
+		// The connection this message arrived on is gone. The reading side
+		// observes the same failure and decides whether to reconnect.
+		m.conn.closeWithError(err)
+	}
+	return nil
+}
+
+func (ams *asyncMessageSource) Status() (*substrate.Status, error) {
+	return ams.state.status()
+}
+
+// Close closes any open connection, making ConsumeMessages return ErrClosed.
+func (ams *asyncMessageSource) Close() error {
+	ams.conns.close()
+	return nil
+}
@@ -0,0 +1,502 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+
+	"github.com/uw-labs/substrate"
+)
+
+// newTestServer starts a websocket server calling handler for each accepted
+// connection. The connection is closed when the handler returns.
+func newTestServer(t *testing.T, handler func(r *http.Request, ws *websocket.Conn)) (*httptest.Server, string) {
+	srv := httptest.NewServer(websocket.Server{
+		Handler: func(ws *websocket.Conn) {
+			handler(ws.Request(), ws)
+		},
+	})
+	return srv, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func send(ws *websocket.Conn, payloadType byte, data []byte) error {
+	return frameCodec.Send(ws, frame{payloadType: payloadType, data: data})
+}
+
+func receive(ws *websocket.Conn) (byte, []byte, error) {
+	var f frame
+	err := frameCodec.Receive(ws, &f)
+	return f.payloadType, f.data, err
+}
+
+type message struct {
+	data []byte
+}
+
+func (m *message) Data() []byte {
+	return m.data
+}
+
+// consume starts consuming from the source, returning the channels it uses
+// and a channel receiving the error returned from ConsumeMessages.
+func consume(ctx context.Context, source substrate.AsyncMessageSource) (chan substrate.Message, chan substrate.Message, chan error) {
+	msgs := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+	return msgs, acks, errs
+}
+
+func TestSourceMessageSizes(t *testing.T) {
+	sizes := []int{0, 1, 125, 126, 127, 65535, 65536, 200000}
+	srv, u := newTestServer(t, func(r *http.Request, ws *websocket.Conn) {
+		for _, size := range sizes {
+			if err := send(ws, websocket.BinaryFrame, bytes.Repeat([]byte{'x'}, size)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		_, _, _ = receive(ws)
+	})
+	defer srv.Close()
+
+	source, err := NewAsyncMessageSource(AsyncMessageSourceConfig{URL: u})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msgs, acks, errs := consume(ctx, source)
+
+	for _, size := range sizes {
+		m := <-msgs
+		assert.Equal(t, bytes.Repeat([]byte{'x'}, size), m.Data())
+		acks <- m
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+func TestSourceMessageTooLarge(t *testing.T) {
+	srv, u := newTestServer(t, func(r *http.Request, ws *websocket.Conn) {
+		_ = send(ws, websocket.TextFrame, []byte("more than ten bytes"))
+		_, _, _ = receive(ws)
+	})
+	defer srv.Close()
+
+	source, err := NewAsyncMessageSource(AsyncMessageSourceConfig{
+		URL:             u,
+		MaxMessageBytes: 10,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = source.ConsumeMessages(ctx, make(chan substrate.Message), make(chan substrate.Message))
+	assert.Equal(t, ErrMessageTooLarge, err)
+}
+
+func TestSourceConsumeAndAckFrames(t *testing.T) {
+	ackFrames := make(chan string, 3)
+
+	srv, u := newTestServer(t, func(r *http.Request, ws *websocket.Conn) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("unexpected authorization header: %s", r.Header.Get("Authorization"))
+			return
+		}
+		for _, m := range []string{"one", "two", "three"} {
+			if err := send(ws, websocket.TextFrame, []byte(m)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		for {
+			_, frame, err := receive(ws)
+			if err != nil {
+				return
+			}
+			ackFrames <- string(frame)
+		}
+	})
+	defer srv.Close()
+
+	source, err := NewAsyncMessageSource(AsyncMessageSourceConfig{
+		URL:    u,
+		Header: http.Header{"Authorization": []string{"Bearer token"}},
+		AckFrame: func(m substrate.Message) []byte {
+			return []byte("ack:" + string(m.Data()))
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	for _, expected := range []string{"one", "two", "three"} {
+		m := <-msgs
+		assert.Equal(t, expected, string(m.Data()))
+		acks <- m
+		assert.Equal(t, "ack:"+expected, <-ackFrames)
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+type ackKey struct{}
+
+func TestSourceAckWrappedMessage(t *testing.T) {
+	ackFrames := make(chan string, 2)
+
+	srv, u := newTestServer(t, func(r *http.Request, ws *websocket.Conn) {
+		for _, m := range []string{"one", "two"} {
+			if err := send(ws, websocket.TextFrame, []byte(m)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		for {
+			_, frame, err := receive(ws)
+			if err != nil {
+				return
+			}
+			ackFrames <- string(frame)
+		}
+	})
+	defer srv.Close()
+
+	source, err := NewAsyncMessageSource(AsyncMessageSourceConfig{
+		URL: u,
+		AckFrame: func(m substrate.Message) []byte {
+			return []byte("ack:" + string(m.Data()))
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	// Wrappers are acknowledged as the messages they wrap.
+	for i, expected := range []string{"one", "two"} {
+		acks <- substrate.WithValue(<-msgs, ackKey{}, i)
+		assert.Equal(t, "ack:"+expected, <-ackFrames)
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+func TestSourceAckAfterDiscardPayload(t *testing.T) {
+	ackFrames := make(chan string, 1)
+
+	srv, u := newTestServer(t, func(r *http.Request, ws *websocket.Conn) {
+		_ = send(ws, websocket.TextFrame, []byte("one"))
+		_, frame, err := receive(ws)
+		if err == nil {
+			ackFrames <- string(frame)
+		}
+		_, _, _ = receive(ws)
+	})
+	defer srv.Close()
+
+	source, err := NewAsyncMessageSource(AsyncMessageSourceConfig{
+		URL: u,
+		AckFrame: func(m substrate.Message) []byte {
+			return []byte("ack:" + string(m.Data()))
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msgs, acks, errs := consume(ctx, source)
+
+	m := <-msgs
+	m.(substrate.DiscardableMessage).DiscardPayload()
+	acks <- m
+	assert.Equal(t, "ack:one", <-ackFrames)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+func TestSourceClose(t *testing.T) {
+	srv, u := newTestServer(t, func(r *http.Request, ws *websocket.Conn) {
+		_ = send(ws, websocket.TextFrame, []byte("one"))
+		_, _, _ = receive(ws)
+	})
+	defer srv.Close()
+
+	source, err := NewAsyncMessageSource(AsyncMessageSourceConfig{
+		URL:              u,
+		ReconnectBackoff: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msgs, _, errs := consume(ctx, source)
+
+	<-msgs
+	require.NoError(t, source.Close())
+	// Closing stops reconnecting.
+	assert.Equal(t, ErrClosed, <-errs)
+}
+
+func TestSourceReconnectsWithResumeHeader(t *testing.T) {
+	resumeFroms := make(chan string, 2)
+
+	srv, u := newTestServer(t, func(r *http.Request, ws *websocket.Conn) {
+		resumeFroms <- r.Header.Get("Resume-From")
+		if r.Header.Get("Resume-From") == "" {
+			_ = send(ws, websocket.BinaryFrame, []byte("one"))
+			_ = send(ws, websocket.BinaryFrame, []byte("two"))
+			// Wait for the first ack, then drop the connection.
+			_, _, _ = receive(ws)
+			return
+		}
+		_ = send(ws, websocket.BinaryFrame, []byte("three"))
+		for {
+			if _, _, err := receive(ws); err != nil {
+				return
+			}
+		}
+	})
+	defer srv.Close()
+
+	source, err := NewAsyncMessageSource(AsyncMessageSourceConfig{
+		URL:              u,
+		ReconnectBackoff: 10 * time.Millisecond,
+		AckFrame: func(m substrate.Message) []byte {
+			return m.Data()
+		},
+		ResumeHeader: func(m substrate.Message) http.Header {
+			return http.Header{"Resume-From": []string{string(m.Data())}}
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.ConsumeMessages(ctx, msgs, acks)
+	}()
+
+	one := <-msgs
+	assert.Equal(t, "one", string(one.Data()))
+	assert.Equal(t, "", <-resumeFroms)
+	acks <- one
+
+	two := <-msgs
+	assert.Equal(t, "two", string(two.Data()))
+	// Hold on to the second message until the source has reconnected, so that
+	// the resume header is derived from the first one.
+	assert.Equal(t, "one", <-resumeFroms)
+	acks <- two
+
+	three := <-msgs
+	assert.Equal(t, "three", string(three.Data()))
+	acks <- three
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+func TestSourceConnectionLostWithoutReconnect(t *testing.T) {
+	srv, u := newTestServer(t, func(r *http.Request, ws *websocket.Conn) {
+		_ = ws.Close()
+	})
+	defer srv.Close()
+
+	source, err := NewAsyncMessageSource(AsyncMessageSourceConfig{URL: u})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = source.ConsumeMessages(ctx, make(chan substrate.Message), make(chan substrate.Message))
+	assert.Equal(t, ErrConnectionClosed, err)
+
+	status, err := source.Status()
+	require.NoError(t, err)
+	assert.False(t, status.Working)
+}
+
+func TestSourceKeepAliveTimeout(t *testing.T) {
+	srv, u := newTestServer(t, func(r *http.Request, ws *websocket.Conn) {
+		// Never read, so pings are not answered.
+		time.Sleep(time.Second)
+	})
+	defer srv.Close()
+
+	source, err := NewAsyncMessageSource(AsyncMessageSourceConfig{
+		URL:          u,
+		PingInterval: 20 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = source.ConsumeMessages(ctx, make(chan substrate.Message), make(chan substrate.Message))
+	assert.Equal(t, errKeepAliveTimeout, err)
+}
+
+func TestSinkAcksOnWrite(t *testing.T) {
+	frames := make(chan string, 3)
+	srv, u := newTestServer(t, func(r *http.Request, ws *websocket.Conn) {
+		for {
+			op, frame, err := receive(ws)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, byte(websocket.TextFrame), op)
+			frames <- string(frame)
+		}
+	})
+	defer srv.Close()
+
+	sink, err := NewAsyncMessageSink(AsyncMessageSinkConfig{URL: u, Text: true})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishMessages(ctx, acks, msgs)
+	}()
+
+	for _, payload := range []string{"one", "two", "three"} {
+		m := &message{data: []byte(payload)}
+		msgs <- m
+		assert.Equal(t, m, <-acks)
+		assert.Equal(t, payload, <-frames)
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+func TestSinkClose(t *testing.T) {
+	srv, u := newTestServer(t, func(r *http.Request, ws *websocket.Conn) {
+		for {
+			if _, _, err := receive(ws); err != nil {
+				return
+			}
+		}
+	})
+	defer srv.Close()
+
+	sink, err := NewAsyncMessageSink(AsyncMessageSinkConfig{URL: u})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishMessages(ctx, acks, msgs)
+	}()
+
+	m := &message{data: []byte("one")}
+	msgs <- m
+	assert.Equal(t, m, <-acks)
+
+	require.NoError(t, sink.Close())
+	assert.Equal(t, ErrClosed, <-errs)
+}
+
+func TestSinkAcksOnConfirmation(t *testing.T) {
+	srv, u := newTestServer(t, func(r *http.Request, ws *websocket.Conn) {
+		var received [][]byte
+		for len(received) < 3 {
+			_, frame, err := receive(ws)
+			if err != nil {
+				return
+			}
+			received = append(received, frame)
+		}
+		// Confirm in reverse order.
+		for i := len(received) - 1; i >= 0; i-- {
+			_ = send(ws, websocket.TextFrame, append([]byte("ok:"), received[i]...))
+		}
+		for {
+			if _, _, err := receive(ws); err != nil {
+				return
+			}
+		}
+	})
+	defer srv.Close()
+
+	sink, err := NewAsyncMessageSink(AsyncMessageSinkConfig{
+		URL: u,
+		Confirm: func(frame []byte, msg substrate.Message) bool {
+			return string(frame) == "ok:"+string(msg.Data())
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := make(chan substrate.Message, 3)
+	acks := make(chan substrate.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sink.PublishMessages(ctx, acks, msgs)
+	}()
+
+	sent := []substrate.Message{
+		&message{data: []byte("one")},
+		&message{data: []byte("two")},
+		&message{data: []byte("three")},
+	}
+	for _, m := range sent {
+		msgs <- m
+	}
+	for _, m := range sent {
+		select {
+		case ack := <-acks:
+			assert.Equal(t, m, ack)
+		case err := <-errs:
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
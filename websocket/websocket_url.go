@@ -0,0 +1,31 @@
+package websocket
+
+import (
+	"net/url"
+
+	"github.com/uw-labs/substrate"
+	"github.com/uw-labs/substrate/suburl"
+)
+
+func init() {
+	suburl.RegisterSink("ws", newWebsocketSink)
+	suburl.RegisterSource("ws", newWebsocketSource)
+	suburl.RegisterSink("wss", newWebsocketSink)
+	suburl.RegisterSource("wss", newWebsocketSource)
+}
+
+func newWebsocketSink(u *url.URL) (substrate.AsyncMessageSink, error) {
+	return websocketSinker(AsyncMessageSinkConfig{
+		URL: u.String(),
+	})
+}
+
+var websocketSinker = NewAsyncMessageSink
+
+func newWebsocketSource(u *url.URL) (substrate.AsyncMessageSource, error) {
+	return websocketSourcer(AsyncMessageSourceConfig{
+		URL: u.String(),
+	})
+}
+
+var websocketSourcer = NewAsyncMessageSource